@@ -0,0 +1,403 @@
+// Package client is a Go client for the mini-redis HTTP API.
+//
+// Client talks to a single server; ShardedClient spreads keys over several
+// servers with a consistent-hash ring.
+package client
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by Get for a key that doesn't exist or has expired.
+var ErrNotFound = errors.New("key not found")
+
+// DefaultTimeout bounds every request of a Client created without WithHTTPClient.
+const DefaultTimeout = 10 * time.Second
+
+// ServerError is returned when a server answers with an unexpected status,
+// e.g. 503 while it is loading its dataset or 409 for a write to a replica.
+type ServerError struct {
+	Addr       string // Server that answered
+	StatusCode int    // HTTP status code
+	Code       string // Error code, e.g. "cache_full" (empty if the body isn't a JSON error)
+	Message    string // Error message, or the response body
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server %s responded %d: %s", e.Addr, e.StatusCode, e.Message)
+}
+
+// CommandError is returned when a command of a pipeline fails, e.g. Incr
+// of a value that isn't an integer.
+type CommandError struct {
+	Addr    string // Server that answered
+	Code    string // Error code, e.g. "not_integer"
+	Message string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("server %s: %s", e.Addr, e.Message)
+}
+
+// Client is a client for a single mini-redis server. It is safe for
+// concurrent use.
+type Client struct {
+	addr    string
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// Option configures optional Client behavior in New.
+type Option func(*Client)
+
+// WithHTTPClient sends requests with hc instead of a client with DefaultTimeout.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithTimeout bounds every request, including reading the response.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.http = &http.Client{Timeout: timeout}
+	}
+}
+
+// WithToken authenticates the requests with an API token (see ACL_USERS
+// and ADMIN_TOKEN).
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// New creates a client for the server at addr, either "host:port", a base
+// URL such as "https://cache.example.com", or "unix://" and the path of the
+// unix socket of a server on the same host (-unix-socket), such as
+// "unix:///var/run/mini-redis.sock". With a unix socket, the transport of
+// the HTTP client dials the socket: a copy of it if it is an
+// *http.Transport (see WithHTTPClient), and a new one otherwise.
+func New(addr string, opts ...Option) *Client {
+	baseURL := addr
+	socket, isUnix := strings.CutPrefix(addr, "unix://")
+	switch {
+	case isUnix:
+		baseURL = "http://unix" // The host is ignored: every request dials the socket
+	case !strings.Contains(addr, "://"):
+		baseURL = "http://" + addr
+	}
+	c := &Client{
+		addr:    addr,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http:    &http.Client{Timeout: DefaultTimeout},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if isUnix {
+		transport, ok := c.http.Transport.(*http.Transport)
+		if ok {
+			transport = transport.Clone()
+		} else {
+			transport = http.DefaultTransport.(*http.Transport).Clone()
+		}
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		hc := *c.http // Don't change the client of WithHTTPClient
+		hc.Transport = transport
+		c.http = &hc
+	}
+	return c
+}
+
+// Addr returns the address the client was created with.
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/v1/get?key="+url.QueryEscape(key), nil)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := c.do(req, http.StatusNotFound)
+	if err != nil {
+		return "", err
+	}
+	if body == nil {
+		return "", ErrNotFound
+	}
+
+	var resp struct {
+		Value       string `json:"value"`
+		ValueBase64 string `json:"value_base64"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", fmt.Errorf("invalid response from %s: %w", c.addr, err)
+	}
+	if resp.ValueBase64 != "" {
+		value, err := base64.StdEncoding.DecodeString(resp.ValueBase64)
+		if err != nil {
+			return "", fmt.Errorf("invalid response from %s: %w", c.addr, err)
+		}
+		return string(value), nil
+	}
+	return resp.Value, nil
+}
+
+// Set stores value under key. A positive ttl expires the key after that
+// time, rounded up to whole seconds; 0 means no expiration.
+func (c *Client) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	payload := map[string]any{"key": key, "value": value}
+	if ttl > 0 {
+		payload["ttl"] = int64((ttl + time.Second - 1) / time.Second)
+	}
+	_, err := c.postJSON(ctx, "/v1/set", payload)
+	return err
+}
+
+// Del deletes key and reports whether it existed.
+func (c *Client) Del(ctx context.Context, key string) (bool, error) {
+	body, err := c.postJSON(ctx, "/v1/del", map[string]string{"key": key})
+	if err != nil {
+		return false, err
+	}
+
+	var resp struct {
+		Deleted bool `json:"deleted"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return false, fmt.Errorf("invalid response from %s: %w", c.addr, err)
+	}
+	return resp.Deleted, nil
+}
+
+// MGet returns the values of the keys that exist, by key. The server has no
+// batch endpoint, so the keys are fetched one by one.
+func (c *Client) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, err := c.Get(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return values, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// Exists reports whether key exists, without counting as an access.
+func (c *Client) Exists(ctx context.Context, key string) (bool, error) {
+	var exists bool
+	err := c.command(ctx, map[string]any{"cmd": "exists", "key": key}, &exists)
+	return exists, err
+}
+
+// Incr adds by to the integer value of key, a missing key counting as 0,
+// and returns the new value.
+func (c *Client) Incr(ctx context.Context, key string, by int64) (int64, error) {
+	var value int64
+	err := c.command(ctx, map[string]any{"cmd": "incr", "key": key, "by": by}, &value)
+	return value, err
+}
+
+// Expire sets the TTL of key, rounded up to whole seconds, or removes it if
+// ttl is 0, and reports whether the key exists.
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	var exists bool
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	err := c.command(ctx, map[string]any{"cmd": "expire", "key": key, "ttl": seconds}, &exists)
+	return exists, err
+}
+
+// TTL returns the time until key expires, in whole seconds rounded up, 0 if
+// it has no TTL, or ErrNotFound.
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	var seconds int64
+	if err := c.command(ctx, map[string]any{"cmd": "ttl", "key": key}, &seconds); err != nil {
+		return 0, err
+	}
+	switch {
+	case seconds == -2:
+		return 0, ErrNotFound
+	case seconds < 0:
+		return 0, nil
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Scan returns a page of up to count keys starting with prefix (every key
+// if empty), and the cursor of the next page, empty after the last one.
+// The first page is that of an empty cursor. Pages may hold fewer keys, or
+// none, before the last one; a key that exists during the whole iteration
+// is returned exactly once.
+func (c *Client) Scan(ctx context.Context, prefix, cursor string, count int) ([]string, string, error) {
+	query := url.Values{"prefix": {prefix}, "cursor": {cursor}}
+	if count > 0 {
+		query.Set("count", strconv.Itoa(count))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/v1/scan?"+query.Encode(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := c.do(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var resp struct {
+		Keys   []string `json:"keys"`
+		Cursor string   `json:"cursor"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, "", fmt.Errorf("invalid response from %s: %w", c.addr, err)
+	}
+	return resp.Keys, resp.Cursor, nil
+}
+
+// Stats returns the size of the dataset of the server and its limits.
+// Watchers isn't reported by the HTTP API and is always 0.
+func (c *Client) Stats(ctx context.Context) (*Stats, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/v1/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Keys           int64  `json:"keys"`
+		MaxKeys        int64  `json:"max_keys"`
+		UsedMemory     int64  `json:"used_memory"`
+		MaxMemory      int64  `json:"max_memory"`
+		EvictionPolicy string `json:"eviction_policy"`
+		ExpiredLazy    int64  `json:"expired_lazy"`
+		ExpiredActive  int64  `json:"expired_active"`
+		Evicted        int64  `json:"evicted"`
+		Deleted        int64  `json:"deleted"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response from %s: %w", c.addr, err)
+	}
+	return &Stats{
+		Keys:           resp.Keys,
+		MaxKeys:        resp.MaxKeys,
+		UsedMemory:     resp.UsedMemory,
+		MaxMemory:      resp.MaxMemory,
+		EvictionPolicy: resp.EvictionPolicy,
+		ExpiredLazy:    resp.ExpiredLazy,
+		ExpiredActive:  resp.ExpiredActive,
+		Evicted:        resp.Evicted,
+		Deleted:        resp.Deleted,
+	}, nil
+}
+
+// command runs cmd with /pipeline, the only endpoint of some commands, and
+// decodes its result into result.
+func (c *Client) command(ctx context.Context, cmd map[string]any, result any) error {
+	body, err := c.postJSON(ctx, "/v1/pipeline", []map[string]any{cmd})
+	if err != nil {
+		return err
+	}
+
+	var resp []struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || len(resp) != 1 {
+		return fmt.Errorf("invalid response from %s: %v", c.addr, cmp.Or(err, errors.New("not one result")))
+	}
+	if e := resp[0].Error; e != nil {
+		return &CommandError{Addr: c.addr, Code: e.Code, Message: e.Message}
+	}
+	if err := json.Unmarshal(resp[0].Result, result); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", c.addr, err)
+	}
+	return nil
+}
+
+// postJSON sends payload as a JSON POST request to path.
+func (c *Client) postJSON(ctx context.Context, path string, payload any) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req)
+}
+
+// do sends req and returns the body of a 200 response. A response with one
+// of the allowed statuses returns a nil body; any other status returns a
+// *ServerError.
+func (c *Client) do(req *http.Request, allowed ...int) ([]byte, error) {
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from %s: %w", c.addr, err)
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		return body, nil
+	}
+	for _, status := range allowed {
+		if resp.StatusCode == status {
+			return nil, nil
+		}
+	}
+	serverErr := &ServerError{
+		Addr:       c.addr,
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+	}
+	var errResp struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &errResp) == nil && errResp.Error.Code != "" {
+		serverErr.Code, serverErr.Message = errResp.Error.Code, errResp.Error.Message
+	}
+	return nil, serverErr
+}
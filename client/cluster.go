@@ -0,0 +1,248 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mini-redis/internal/cluster"
+)
+
+// maxRedirects bounds the MOVED redirects followed for a single request.
+const maxRedirects = 5
+
+// ClusterClient is a client for servers in cluster mode. It loads the slot
+// map from GET /cluster/slots and sends every request straight to the node
+// owning the key's slot (see cluster.KeySlot). When the slots have moved, the
+// node answers with a MOVED redirect; the client then follows it and reloads
+// the slot map from that node.
+//
+// A plain Client also works against a cluster, since the redirects are HTTP
+// 307 responses that net/http follows, but every request for a key of
+// another node then takes two round trips.
+//
+// A ClusterClient is safe for concurrent use.
+type ClusterClient struct {
+	opts []Option
+
+	mu    sync.RWMutex
+	slots [cluster.SlotCount]string // Owner of every slot
+	nodes map[string]*Client
+}
+
+// MovedError is returned when a node redirects a key to another node and
+// the redirect can't be followed.
+type MovedError struct {
+	Slot int    // Slot of the key
+	Addr string // Node owning the slot
+}
+
+func (e *MovedError) Error() string {
+	return fmt.Sprintf("MOVED %d %s", e.Slot, e.Addr)
+}
+
+// NewClusterClient creates a client for the cluster that the nodes at seeds
+// belong to. The slot map is loaded from the first seed that answers.
+func NewClusterClient(ctx context.Context, seeds []string, opts ...Option) (*ClusterClient, error) {
+	if len(seeds) == 0 {
+		return nil, fmt.Errorf("no cluster nodes given")
+	}
+	c := &ClusterClient{opts: opts, nodes: make(map[string]*Client)}
+
+	var errs []error
+	for _, seed := range seeds {
+		err := c.refresh(ctx, seed)
+		if err == nil {
+			return c, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("failed to load the cluster slot map: %w", errors.Join(errs...))
+}
+
+// Refresh reloads the slot map from the node owning slot 0.
+func (c *ClusterClient) Refresh(ctx context.Context) error {
+	c.mu.RLock()
+	addr := c.slots[0]
+	c.mu.RUnlock()
+	return c.refresh(ctx, addr)
+}
+
+// refresh loads the slot map from the node at addr.
+func (c *ClusterClient) refresh(ctx context.Context, addr string) error {
+	node := c.node(addr)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, node.baseURL+"/v1/cluster/slots", nil)
+	if err != nil {
+		return err
+	}
+	body, err := node.do(req)
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Slots []cluster.SlotRange `json:"slots"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("invalid slot map from %s: %w", addr, err)
+	}
+	// Validate the map before using it
+	if _, err := cluster.NewSlotMap(resp.Slots); err != nil {
+		return fmt.Errorf("invalid slot map from %s: %w", addr, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range resp.Slots {
+		for slot := r.Start; slot <= r.End; slot++ {
+			c.slots[slot] = r.Node
+		}
+	}
+	return nil
+}
+
+// Owner returns the address of the node owning key, according to the slot
+// map last loaded.
+func (c *ClusterClient) Owner(key string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.slots[cluster.KeySlot(key)]
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (c *ClusterClient) Get(ctx context.Context, key string) (string, error) {
+	var value string
+	err := c.route(ctx, key, func(n *Client) error {
+		var err error
+		value, err = n.Get(ctx, key)
+		return err
+	})
+	return value, err
+}
+
+// Set stores value under key (see Client.Set).
+func (c *ClusterClient) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return c.route(ctx, key, func(n *Client) error {
+		return n.Set(ctx, key, value, ttl)
+	})
+}
+
+// Del deletes key and reports whether it existed.
+func (c *ClusterClient) Del(ctx context.Context, key string) (bool, error) {
+	var deleted bool
+	err := c.route(ctx, key, func(n *Client) error {
+		var err error
+		deleted, err = n.Del(ctx, key)
+		return err
+	})
+	return deleted, err
+}
+
+// MGet returns the values of the keys that exist, by key. The keys are
+// grouped by node and fetched from all nodes in parallel. If some keys fail,
+// the other values are returned with the errors joined.
+func (c *ClusterClient) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	groups := make(map[string][]string)
+	for _, key := range keys {
+		owner := c.Owner(key)
+		groups[owner] = append(groups[owner], key)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
+	values := make(map[string]string, len(keys))
+	for _, group := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, key := range group {
+				value, err := c.Get(ctx, key)
+				if errors.Is(err, ErrNotFound) {
+					continue
+				}
+
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, err)
+				} else {
+					values[key] = value
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return values, errors.Join(errs...)
+}
+
+// route runs op against the node owning key, following MOVED redirects and
+// reloading the slot map from the node redirected to.
+func (c *ClusterClient) route(ctx context.Context, key string, op func(*Client) error) error {
+	addr := c.Owner(key)
+	var moved *MovedError
+	for range maxRedirects {
+		err := op(c.node(addr))
+		var ok bool
+		if moved, ok = movedError(err); !ok {
+			return err
+		}
+
+		// Use the new owner right away, then learn the rest of the new map
+		c.mu.Lock()
+		c.slots[moved.Slot] = moved.Addr
+		c.mu.Unlock()
+		c.refresh(ctx, moved.Addr)
+		addr = moved.Addr
+	}
+	return fmt.Errorf("too many redirects for key %q: %w", key, moved)
+}
+
+// node returns the client for the node at addr. It doesn't follow redirects,
+// so route sees them.
+func (c *ClusterClient) node(addr string) *Client {
+	c.mu.RLock()
+	n, ok := c.nodes[addr]
+	c.mu.RUnlock()
+	if ok {
+		return n
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n, ok := c.nodes[addr]; ok {
+		return n
+	}
+	n = New(addr, c.opts...)
+	hc := *n.http
+	hc.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	n.http = &hc
+	c.nodes[addr] = n
+	return n
+}
+
+// movedError extracts the MOVED redirect from an error returned by a Client.
+func movedError(err error) (*MovedError, bool) {
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.StatusCode != http.StatusTemporaryRedirect {
+		return nil, false
+	}
+	fields := strings.Fields(serverErr.Message)
+	if len(fields) != 3 || fields[0] != "MOVED" {
+		return nil, false
+	}
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil || slot < 0 || slot >= cluster.SlotCount {
+		return nil, false
+	}
+	return &MovedError{Slot: slot, Addr: fields[2]}, true
+}
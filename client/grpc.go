@@ -0,0 +1,332 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mini-redis/internal/grpcapi"
+)
+
+// GRPCClient is a client for the gRPC API of a server (-grpc-addr). It
+// speaks gRPC over the HTTP/2 of net/http, so it needs no dependencies, and
+// has the same methods as Client plus those only the gRPC API has: MSet,
+// Expire, Watch, and Stats. Calls are bounded by the deadline of their
+// context, which the server is told of, rather than by a client timeout.
+//
+// A GRPCClient is safe for concurrent use.
+type GRPCClient struct {
+	addr    string
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// GRPCError is returned when a call fails with a gRPC status, e.g.
+// UNAVAILABLE while the server is loading its dataset. Errors of the HTTP
+// API start the message with their code, e.g. "cache_full: ...".
+type GRPCError struct {
+	Addr    string // Server that answered
+	Code    int    // gRPC status code, e.g. 5 for NOT_FOUND
+	Message string
+}
+
+func (e *GRPCError) Error() string {
+	return fmt.Sprintf("server %s responded %s: %s", e.Addr, grpcapi.Code(e.Code), e.Message)
+}
+
+// GRPCOption configures optional GRPCClient behavior in NewGRPCClient.
+type GRPCOption func(*grpcOptions)
+
+type grpcOptions struct {
+	token string
+	tls   *tls.Config
+}
+
+// WithGRPCToken authenticates the calls with an API token (see ACL_USERS
+// and ADMIN_TOKEN).
+func WithGRPCToken(token string) GRPCOption {
+	return func(o *grpcOptions) {
+		o.token = token
+	}
+}
+
+// WithGRPCTLS connects with TLS, for a server with -tls-cert or
+// -tls-self-signed. Without it, the client connects in cleartext.
+func WithGRPCTLS(config *tls.Config) GRPCOption {
+	return func(o *grpcOptions) {
+		o.tls = config
+	}
+}
+
+// NewGRPCClient creates a client for the gRPC API at addr, "host:port".
+func NewGRPCClient(addr string, opts ...GRPCOption) *GRPCClient {
+	var o grpcOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var protocols http.Protocols
+	scheme := "http"
+	if o.tls != nil {
+		protocols.SetHTTP2(true)
+		scheme = "https"
+	} else {
+		protocols.SetUnencryptedHTTP2(true) // Prior knowledge, like gRPC clients
+	}
+	transport := &http.Transport{
+		Protocols:       &protocols,
+		TLSClientConfig: o.tls,
+	}
+	return &GRPCClient{
+		addr:    addr,
+		baseURL: scheme + "://" + addr,
+		token:   o.token,
+		http:    &http.Client{Transport: transport},
+	}
+}
+
+// Addr returns the address the client was created with.
+func (c *GRPCClient) Addr() string {
+	return c.addr
+}
+
+// Close closes the idle connections of the client.
+func (c *GRPCClient) Close() {
+	c.http.CloseIdleConnections()
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (c *GRPCClient) Get(ctx context.Context, key string) (string, error) {
+	var resp grpcapi.GetResponse
+	if err := c.call(ctx, grpcapi.PathGet, &grpcapi.GetRequest{Key: key}, &resp); err != nil {
+		return "", err
+	}
+	if !resp.Found {
+		return "", ErrNotFound
+	}
+	return string(resp.Value), nil
+}
+
+// Set stores value under key. A positive ttl expires the key after that
+// time, in milliseconds; 0 means no expiration.
+func (c *GRPCClient) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	req := &grpcapi.SetRequest{Key: key, Value: []byte(value), TTLMs: ttl.Milliseconds()}
+	return c.call(ctx, grpcapi.PathSet, req, &grpcapi.Empty{})
+}
+
+// Del deletes keys and returns how many existed.
+func (c *GRPCClient) Del(ctx context.Context, keys ...string) (int, error) {
+	var resp grpcapi.DelResponse
+	if err := c.call(ctx, grpcapi.PathDel, &grpcapi.Keys{Keys: keys}, &resp); err != nil {
+		return 0, err
+	}
+	return int(resp.Deleted), nil
+}
+
+// MGet returns the values of the keys that exist, by key, in one call.
+func (c *GRPCClient) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	var resp grpcapi.MGetResponse
+	if err := c.call(ctx, grpcapi.PathMGet, &grpcapi.Keys{Keys: keys}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Values) != len(keys) {
+		return nil, fmt.Errorf("invalid response from %s: %d values for %d keys", c.addr, len(resp.Values), len(keys))
+	}
+	values := make(map[string]string, len(keys))
+	for i, v := range resp.Values {
+		if v.Found {
+			values[keys[i]] = string(v.Value)
+		}
+	}
+	return values, nil
+}
+
+// MSet stores the values by key, all of them or none, with the same ttl
+// (0: no expiration).
+func (c *GRPCClient) MSet(ctx context.Context, values map[string]string, ttl time.Duration) error {
+	req := &grpcapi.MSetRequest{Entries: make([]*grpcapi.KeyValue, 0, len(values))}
+	for key, value := range values {
+		req.Entries = append(req.Entries, &grpcapi.KeyValue{Key: key, Value: []byte(value), TTLMs: ttl.Milliseconds()})
+	}
+	return c.call(ctx, grpcapi.PathMSet, req, &grpcapi.Empty{})
+}
+
+// Expire sets the TTL of key, or removes it if ttl is 0, and reports
+// whether the key exists.
+func (c *GRPCClient) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	var resp grpcapi.ExpireResponse
+	if err := c.call(ctx, grpcapi.PathExpire, &grpcapi.ExpireRequest{Key: key, TTLMs: ttl.Milliseconds()}, &resp); err != nil {
+		return false, err
+	}
+	return resp.Exists, nil
+}
+
+// Stats describes the dataset of a server and its limits.
+type Stats struct {
+	Keys           int64
+	MaxKeys        int64 // 0: unlimited
+	UsedMemory     int64
+	MaxMemory      int64 // 0: unlimited
+	EvictionPolicy string
+	ExpiredLazy    int64
+	ExpiredActive  int64
+	Evicted        int64
+	Deleted        int64
+	Watchers       int64 // Open Watch streams (GRPCClient only)
+}
+
+// Stats returns the size of the dataset of the server and its limits.
+func (c *GRPCClient) Stats(ctx context.Context) (*Stats, error) {
+	var resp grpcapi.StatsResponse
+	if err := c.call(ctx, grpcapi.PathStats, &grpcapi.Empty{}, &resp); err != nil {
+		return nil, err
+	}
+	return &Stats{
+		Keys:           resp.Keys,
+		MaxKeys:        resp.MaxKeys,
+		UsedMemory:     resp.UsedMemory,
+		MaxMemory:      resp.MaxMemory,
+		EvictionPolicy: resp.EvictionPolicy,
+		ExpiredLazy:    resp.ExpiredLazy,
+		ExpiredActive:  resp.ExpiredActive,
+		Evicted:        resp.Evicted,
+		Deleted:        resp.Deleted,
+		Watchers:       resp.Watchers,
+	}, nil
+}
+
+// KeyEvent is a change of a key streamed by Watch.
+type KeyEvent struct {
+	Type string // set, del, expire, expired, or evicted
+	Key  string
+	Time time.Time
+}
+
+// Watch streams the changes of the keys starting with prefix (every key if
+// empty) until ctx is done or the loop stops. The stream ends with an error
+// if the server ends it, e.g. RESOURCE_EXHAUSTED when the client fell
+// behind, or UNAVAILABLE when the server shuts down; events missed then
+// aren't sent again.
+func (c *GRPCClient) Watch(ctx context.Context, prefix string) iter.Seq2[KeyEvent, error] {
+	return func(yield func(KeyEvent, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		resp, err := c.send(ctx, grpcapi.PathWatch, &grpcapi.WatchRequest{Prefix: prefix})
+		if err != nil {
+			yield(KeyEvent{}, err)
+			return
+		}
+		defer resp.Body.Close()
+		for {
+			var ev grpcapi.KeyEvent
+			err := grpcapi.ReadMessage(resp.Body, &ev, grpcapi.DefaultMaxMessageBytes)
+			if err == io.EOF {
+				if err := c.status(resp); err != nil {
+					yield(KeyEvent{}, err)
+				}
+				return
+			}
+			if err != nil {
+				yield(KeyEvent{}, c.readError(ctx, err))
+				return
+			}
+			if !yield(KeyEvent{Type: ev.Type, Key: ev.Key, Time: time.UnixMilli(ev.TimeUnixMs)}, nil) {
+				return
+			}
+		}
+	}
+}
+
+// call sends a unary call and reads its response message into resp.
+func (c *GRPCClient) call(ctx context.Context, path string, req, resp grpcapi.Message) error {
+	r, err := c.send(ctx, path, req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	readErr := grpcapi.ReadMessage(r.Body, resp, grpcapi.DefaultMaxMessageBytes)
+	if readErr != nil && readErr != io.EOF {
+		return c.readError(ctx, readErr)
+	}
+	if _, err := io.Copy(io.Discard, r.Body); err != nil { // The trailers follow the body
+		return c.readError(ctx, err)
+	}
+	if err := c.status(r); err != nil {
+		return err
+	}
+	if readErr == io.EOF {
+		return fmt.Errorf("invalid response from %s: no message", c.addr)
+	}
+	return nil
+}
+
+// send starts a call with the request message req.
+func (c *GRPCClient) send(ctx context.Context, path string, req grpcapi.Message) (*http.Response, error) {
+	var body bytes.Buffer
+	if err := grpcapi.WriteMessage(&body, req); err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, &body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", grpcapi.ContentType)
+	r.Header.Set("TE", "trailers")
+	if c.token != "" {
+		r.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		r.Header.Set("Grpc-Timeout", grpcapi.FormatTimeout(time.Until(deadline)))
+	}
+	resp, err := c.http.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), grpcapi.ContentType) {
+		resp.Body.Close()
+		return nil, &ServerError{Addr: c.addr, StatusCode: resp.StatusCode, Message: "not a gRPC response"}
+	}
+	if resp.Header.Get("Grpc-Status") != "" { // Trailers-only response: the call failed
+		resp.Body.Close()
+		return nil, c.status(resp)
+	}
+	return resp, nil
+}
+
+// status returns the error of the grpc-status of resp, in its trailers or,
+// for a response without body, its headers; nil for OK.
+func (c *GRPCClient) status(resp *http.Response) error {
+	h := resp.Trailer
+	if h.Get("Grpc-Status") == "" {
+		h = resp.Header
+	}
+	code, err := strconv.Atoi(h.Get("Grpc-Status"))
+	if err != nil {
+		return fmt.Errorf("invalid response from %s: no grpc-status", c.addr)
+	}
+	if code == int(grpcapi.OK) {
+		return nil
+	}
+	return &GRPCError{Addr: c.addr, Code: code, Message: grpcapi.DecodeMessage(h.Get("Grpc-Message"))}
+}
+
+// readError returns the error of reading a response: that of ctx if it is
+// done, and otherwise err, as a GRPCError if it is a gRPC status.
+func (c *GRPCClient) readError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var status *grpcapi.Status
+	if errors.As(err, &status) {
+		return &GRPCError{Addr: c.addr, Code: int(status.Code), Message: status.Message}
+	}
+	return fmt.Errorf("failed to read response from %s: %w", c.addr, err)
+}
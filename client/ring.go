@@ -0,0 +1,95 @@
+package client
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of points each node gets on the ring.
+const DefaultVirtualNodes = 160
+
+// ring is a consistent-hash ring: every node is placed at several points
+// (virtual nodes), and a key belongs to the first node clockwise from the
+// key's hash. Adding or removing a node only moves the keys between its
+// points and their predecessors, about 1/n of all keys, instead of almost
+// all keys with modulo hashing.
+type ring struct {
+	vnodes int
+	points []ringPoint // Sorted by hash
+	nodes  []string    // Node addresses, in the order they were added
+}
+
+// ringPoint is a virtual node on the ring.
+type ringPoint struct {
+	hash uint32
+	node string
+}
+
+// newRing creates an empty ring placing every node at vnodes points.
+func newRing(vnodes int) *ring {
+	return &ring{vnodes: vnodes}
+}
+
+// ringHash hashes a key or virtual node name onto the ring, like ketama.
+func ringHash(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// add places a node on the ring. Adding a node twice does nothing.
+func (r *ring) add(node string) {
+	if slices.Contains(r.nodes, node) {
+		return
+	}
+	r.nodes = append(r.nodes, node)
+
+	for i := range r.vnodes {
+		r.points = append(r.points, ringPoint{hash: ringHash(node + "#" + strconv.Itoa(i)), node: node})
+	}
+	// Ties are broken by node so the order doesn't depend on the order of adds
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].node < r.points[j].node
+	})
+}
+
+// remove takes a node off the ring.
+func (r *ring) remove(node string) {
+	points := r.points[:0]
+	for _, p := range r.points {
+		if p.node != node {
+			points = append(points, p)
+		}
+	}
+	clear(r.points[len(points):])
+	r.points = points
+
+	if i := slices.Index(r.nodes, node); i >= 0 {
+		r.nodes = slices.Delete(r.nodes, i, i+1)
+	}
+}
+
+// owners returns the distinct nodes clockwise from the key's hash: the node
+// owning the key first, then the nodes that take over if it is unavailable.
+func (r *ring) owners(key string) []string {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	hash := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+
+	owners := make([]string, 0, len(r.nodes))
+	for i := 0; i < len(r.points) && len(owners) < len(r.nodes); i++ {
+		node := r.points[(start+i)%len(r.points)].node
+		if !slices.Contains(owners, node) {
+			owners = append(owners, node)
+		}
+	}
+	return owners
+}
@@ -0,0 +1,322 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health check defaults of a ShardedClient.
+const (
+	DefaultFailureThreshold = 3               // Consecutive failures before a node is marked unhealthy
+	DefaultRetryInterval    = 5 * time.Second // How long an unhealthy node is skipped before it is tried again
+)
+
+// ErrNoNodes is returned when no node can serve a key: the ring is empty, or
+// the owning node is unhealthy and rerouting is disabled or found no other.
+var ErrNoNodes = errors.New("no healthy node for key")
+
+// ShardedClient spreads keys over several servers with a consistent-hash
+// ring (see ring), so adding or removing a server only moves about 1/n of the
+// keys. Every key is read and written on the node that owns it; multi-key
+// operations are split by node and sent in parallel.
+//
+// A node that fails DefaultFailureThreshold requests in a row (connection
+// errors and 5xx responses) is marked unhealthy and skipped for the retry
+// interval. Its keys then fail with ErrNoNodes, or, with WithRerouting, go to
+// the next healthy node on the ring; the requests that failed before return
+// their error. Rerouted writes stay on that node: once the owner is healthy
+// again, reads go back to the owner, which doesn't have them.
+//
+// A ShardedClient is safe for concurrent use.
+type ShardedClient struct {
+	vnodes           int
+	failureThreshold int
+	retryInterval    time.Duration
+	reroute          bool
+	clientOpts       []Option
+
+	mu    sync.RWMutex
+	ring  *ring
+	nodes map[string]*shardNode
+}
+
+// shardNode is a server of a ShardedClient with its health.
+type shardNode struct {
+	client *Client
+
+	mu        sync.Mutex
+	failures  int       // Consecutive failed requests
+	downUntil time.Time // Skipped until then, once failures reached the threshold
+}
+
+// NodeStatus describes the health of a node of a ShardedClient.
+type NodeStatus struct {
+	Addr      string
+	Healthy   bool
+	Failures  int       // Consecutive failed requests
+	DownUntil time.Time // When an unhealthy node is tried again
+}
+
+// ShardOption configures optional ShardedClient behavior in NewShardedClient.
+type ShardOption func(*ShardedClient)
+
+// WithVirtualNodes places every node at n points on the ring (default
+// DefaultVirtualNodes). More points spread keys more evenly.
+func WithVirtualNodes(n int) ShardOption {
+	return func(s *ShardedClient) {
+		s.vnodes = n
+	}
+}
+
+// WithFailureThreshold marks a node unhealthy after n consecutive failed
+// requests (default DefaultFailureThreshold), and skips it for retryInterval
+// (default DefaultRetryInterval) before trying it again.
+func WithFailureThreshold(n int, retryInterval time.Duration) ShardOption {
+	return func(s *ShardedClient) {
+		s.failureThreshold = n
+		s.retryInterval = retryInterval
+	}
+}
+
+// WithRerouting sends the requests for keys of an unhealthy node to the next
+// healthy node on the ring instead of failing them with ErrNoNodes.
+func WithRerouting(enabled bool) ShardOption {
+	return func(s *ShardedClient) {
+		s.reroute = enabled
+	}
+}
+
+// WithClientOptions configures the Client of every node.
+func WithClientOptions(opts ...Option) ShardOption {
+	return func(s *ShardedClient) {
+		s.clientOpts = opts
+	}
+}
+
+// NewShardedClient creates a client sharding keys over the servers at addrs
+// (see New for the address format).
+func NewShardedClient(addrs []string, opts ...ShardOption) (*ShardedClient, error) {
+	s := &ShardedClient{
+		vnodes:           DefaultVirtualNodes,
+		failureThreshold: DefaultFailureThreshold,
+		retryInterval:    DefaultRetryInterval,
+		nodes:            make(map[string]*shardNode),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.vnodes < 1 {
+		return nil, fmt.Errorf("invalid virtual node count %d (must be > 0)", s.vnodes)
+	}
+	if s.failureThreshold < 1 {
+		return nil, fmt.Errorf("invalid failure threshold %d (must be > 0)", s.failureThreshold)
+	}
+
+	s.ring = newRing(s.vnodes)
+	for _, addr := range addrs {
+		if err := s.AddNode(addr); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// AddNode adds a server to the ring; it takes over about 1/n of the keys.
+func (s *ShardedClient) AddNode(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.nodes[addr]; ok {
+		return fmt.Errorf("node %s is already in the ring", addr)
+	}
+	s.nodes[addr] = &shardNode{client: New(addr, s.clientOpts...)}
+	s.ring.add(addr)
+	return nil
+}
+
+// RemoveNode removes a server from the ring; its keys move to the next nodes.
+func (s *ShardedClient) RemoveNode(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.nodes, addr)
+	s.ring.remove(addr)
+}
+
+// Owner returns the address of the node owning key, regardless of its health.
+func (s *ShardedClient) Owner(key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	owners := s.ring.owners(key)
+	if len(owners) == 0 {
+		return ""
+	}
+	return owners[0]
+}
+
+// Nodes returns the health of every node, in the order they were added.
+func (s *ShardedClient) Nodes() []NodeStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	statuses := make([]NodeStatus, 0, len(s.ring.nodes))
+	for _, addr := range s.ring.nodes {
+		statuses = append(statuses, s.nodes[addr].status(s.failureThreshold))
+	}
+	return statuses
+}
+
+// Get returns the value of key from its node, or ErrNotFound.
+func (s *ShardedClient) Get(ctx context.Context, key string) (string, error) {
+	var value string
+	err := s.route(key, func(c *Client) error {
+		var err error
+		value, err = c.Get(ctx, key)
+		return err
+	})
+	return value, err
+}
+
+// Set stores value under key on its node (see Client.Set).
+func (s *ShardedClient) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return s.route(key, func(c *Client) error {
+		return c.Set(ctx, key, value, ttl)
+	})
+}
+
+// Del deletes key from its node and reports whether it existed.
+func (s *ShardedClient) Del(ctx context.Context, key string) (bool, error) {
+	var deleted bool
+	err := s.route(key, func(c *Client) error {
+		var err error
+		deleted, err = c.Del(ctx, key)
+		return err
+	})
+	return deleted, err
+}
+
+// MGet returns the values of the keys that exist, by key. The keys are
+// grouped by node and fetched from all nodes in parallel. If some nodes fail,
+// the values from the others are returned with the errors joined.
+func (s *ShardedClient) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	// Group the keys by the node that currently serves them
+	groups := make(map[*shardNode][]string)
+	var errs []error
+	for _, key := range keys {
+		node, err := s.pick(key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		groups[node] = append(groups[node], key)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	values := make(map[string]string, len(keys))
+	for node, group := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			part, err := node.client.MGet(ctx, group...)
+			s.record(node, err)
+
+			mu.Lock()
+			defer mu.Unlock()
+			for key, value := range part {
+				values[key] = value
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return values, errors.Join(errs...)
+}
+
+// route runs op against the node serving key (see pick) and records the
+// result in the node's health.
+func (s *ShardedClient) route(key string, op func(*Client) error) error {
+	node, err := s.pick(key)
+	if err != nil {
+		return err
+	}
+	err = op(node.client)
+	s.record(node, err)
+	return err
+}
+
+// pick returns the node serving key: its owner, or with rerouting the next
+// healthy node on the ring if the owner is unhealthy.
+func (s *ShardedClient) pick(key string) (*shardNode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, addr := range s.ring.owners(key) {
+		node := s.nodes[addr]
+		if node.healthy(s.failureThreshold) {
+			return node, nil
+		}
+		if !s.reroute {
+			break
+		}
+	}
+	return nil, fmt.Errorf("%w %q", ErrNoNodes, key)
+}
+
+// record updates the health of node after a request that returned err.
+func (s *ShardedClient) record(node *shardNode, err error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if err == nil || !isNodeFailure(err) {
+		node.failures = 0
+		return
+	}
+	node.failures++
+	if node.failures >= s.failureThreshold {
+		node.downUntil = time.Now().Add(s.retryInterval)
+	}
+}
+
+// healthy reports whether requests should be sent to the node: it hasn't
+// failed threshold times in a row, or its retry interval is over.
+func (n *shardNode) healthy(threshold int) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.failures < threshold || !time.Now().Before(n.downUntil)
+}
+
+// status returns the health of the node.
+func (n *shardNode) status(threshold int) NodeStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	status := NodeStatus{Addr: n.client.Addr(), Failures: n.failures}
+	if n.failures >= threshold && time.Now().Before(n.downUntil) {
+		status.DownUntil = n.downUntil
+	} else {
+		status.Healthy = true
+	}
+	return status
+}
+
+// isNodeFailure reports whether err means the node is unavailable
+// (connection errors and 5xx responses), rather than a problem with the request.
+func isNodeFailure(err error) bool {
+	if errors.Is(err, ErrNotFound) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// owners returns the owner of every key.
+func owners(s *ShardedClient, keys []string) map[string]string {
+	owned := make(map[string]string, len(keys))
+	for _, key := range keys {
+		owned[key] = s.Owner(key)
+	}
+	return owned
+}
+
+// testKeys returns n distinct keys.
+func testKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%d", i)
+	}
+	return keys
+}
+
+// TestShardedClientAddNodeMovesFewKeys checks that adding a fifth node only
+// moves keys to the new node, and about a fifth of them.
+func TestShardedClientAddNodeMovesFewKeys(t *testing.T) {
+	keys := testKeys(50_000)
+	s, err := NewShardedClient([]string{"a:1", "b:1", "c:1", "d:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := owners(s, keys)
+	if err := s.AddNode("e:1"); err != nil {
+		t.Fatal(err)
+	}
+	after := owners(s, keys)
+
+	moved := 0
+	for _, key := range keys {
+		if before[key] == after[key] {
+			continue
+		}
+		moved++
+		if after[key] != "e:1" {
+			t.Fatalf("%s moved from %s to %s, not to the new node", key, before[key], after[key])
+		}
+	}
+	// Ideally 1/5; modulo hashing would move about 4/5
+	if frac := float64(moved) / float64(len(keys)); frac < 0.12 || frac > 0.28 {
+		t.Errorf("%.1f%% of the keys moved, want about 20%%", 100*frac)
+	}
+}
+
+// TestShardedClientRemoveNodeMovesOnlyItsKeys checks that removing a node
+// only moves the keys it owned.
+func TestShardedClientRemoveNodeMovesOnlyItsKeys(t *testing.T) {
+	keys := testKeys(20_000)
+	s, err := NewShardedClient([]string{"a:1", "b:1", "c:1", "d:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := owners(s, keys)
+	s.RemoveNode("b:1")
+	after := owners(s, keys)
+
+	for _, key := range keys {
+		if before[key] != "b:1" && before[key] != after[key] {
+			t.Fatalf("%s moved from %s to %s, but its node wasn't removed", key, before[key], after[key])
+		}
+		if after[key] == "b:1" {
+			t.Fatalf("%s is still owned by the removed node", key)
+		}
+	}
+}
+
+// fakeServer is a minimal server for the key endpoints used by ShardedClient.
+// A failing server answers 503 to everything.
+type fakeServer struct {
+	mu      sync.Mutex
+	data    map[string]string
+	failing bool
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.URL.Path {
+	case "/v1/get":
+		value, ok := f.data[r.URL.Query().Get("key")]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"value": value})
+	case "/v1/set":
+		var req struct{ Key, Value string }
+		json.NewDecoder(r.Body).Decode(&req)
+		f.data[req.Key] = req.Value
+		w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// startFakeServers starts n fake servers and returns them with their addresses.
+func startFakeServers(t *testing.T, n int) ([]*fakeServer, []string) {
+	var servers []*fakeServer
+	var addrs []string
+	for range n {
+		f := &fakeServer{data: make(map[string]string)}
+		srv := httptest.NewServer(f)
+		t.Cleanup(srv.Close)
+		servers = append(servers, f)
+		addrs = append(addrs, srv.URL)
+	}
+	return servers, addrs
+}
+
+// TestShardedClientRoutesAndReroutes checks that keys are stored on their
+// owner, that MGet merges the values of all nodes, and that the keys of a
+// node marked unhealthy go to the next node with rerouting.
+func TestShardedClientRoutesAndReroutes(t *testing.T) {
+	ctx := context.Background()
+	servers, addrs := startFakeServers(t, 3)
+	s, err := NewShardedClient(addrs, WithFailureThreshold(2, time.Minute), WithRerouting(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := testKeys(30)
+	for _, key := range keys {
+		if err := s.Set(ctx, key, "v-"+key, 0); err != nil {
+			t.Fatalf("Set(%s): %v", key, err)
+		}
+	}
+	for i, addr := range addrs {
+		for key, value := range servers[i].data {
+			if owner := s.Owner(key); owner != addr || value != "v-"+key {
+				t.Errorf("%s = %q stored on %s, owned by %s", key, value, addr, owner)
+			}
+		}
+	}
+	values, err := s.MGet(ctx, append(keys, "missing")...)
+	if err != nil {
+		t.Fatalf("MGet: %v", err)
+	}
+	if len(values) != len(keys) {
+		t.Errorf("MGet returned %d values, want %d", len(values), len(keys))
+	}
+
+	// Fail the owner of a key until it is marked unhealthy
+	key := keys[0]
+	down := s.Owner(key)
+	for i, addr := range addrs {
+		if addr == down {
+			servers[i].mu.Lock()
+			servers[i].failing = true
+			servers[i].mu.Unlock()
+		}
+	}
+	for range 2 {
+		if _, err := s.Get(ctx, key); err == nil || errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get from a failing node returned %v", err)
+		}
+	}
+	for _, status := range s.Nodes() {
+		if healthy := status.Addr != down; status.Healthy != healthy {
+			t.Errorf("node %s healthy = %v, want %v", status.Addr, status.Healthy, healthy)
+		}
+	}
+
+	// The key now goes to the next node on the ring, which doesn't have it yet
+	if _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("rerouted Get error = %v, want ErrNotFound", err)
+	}
+	if err := s.Set(ctx, key, "rerouted", 0); err != nil {
+		t.Fatalf("rerouted Set: %v", err)
+	}
+	if value, err := s.Get(ctx, key); err != nil || value != "rerouted" {
+		t.Errorf("rerouted Get = %q, %v", value, err)
+	}
+}
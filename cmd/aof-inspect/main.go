@@ -0,0 +1,436 @@
+// Package main implements aof-inspect, a command-line tool for examining
+// mini-redis AOF files without starting the server.
+//
+// Usage:
+//
+//	aof-inspect dump [-key k] [-op SET|DEL] [-json] <file>
+//	aof-inspect stats <file>
+//	aof-inspect verify <file>
+//	aof-inspect tail [-f] [-n count] [-key k] [-op SET|DEL] [-json] <file>
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// followInterval is how often tail -f polls the file for new records.
+const followInterval = 200 * time.Millisecond
+
+// main dispatches to the subcommand named by the first argument.
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "dump":
+		err = runDump(os.Args[2:])
+	case "stats":
+		err = runStats(os.Args[2:])
+	case "verify":
+		err = runVerify(os.Args[2:])
+	case "tail":
+		err = runTail(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// usage prints the list of subcommands.
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: aof-inspect <command> [flags] <file>
+
+Commands:
+  dump    Print records, optionally filtered by key or operation
+  stats   Show record counts by operation, distinct keys, and file size
+  verify  Check that every record is valid and report the first corruption
+  tail    Print the last records, optionally following new ones (-f)`)
+}
+
+// recordFilter selects which records are printed.
+type recordFilter struct {
+	key  string
+	op   string
+	json bool
+}
+
+// register adds the filter flags to a flag set.
+func (f *recordFilter) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.key, "key", "", "only show records for this key")
+	fs.StringVar(&f.op, "op", "", "only show records with this operation (SET or DEL)")
+	fs.BoolVar(&f.json, "json", false, "print records as JSON lines")
+}
+
+// match reports whether a command passes the filter.
+func (f *recordFilter) match(cmd cache.AOFCommand) bool {
+	if f.key != "" && cmd.Key != f.key {
+		return false
+	}
+	if f.op != "" && !strings.EqualFold(cmd.Op, f.op) {
+		return false
+	}
+	return true
+}
+
+// print writes a single record to stdout.
+func (f *recordFilter) print(offset int64, cmd cache.AOFCommand) {
+	if f.json {
+		data, _ := json.Marshal(cmd)
+		fmt.Println(string(data))
+		return
+	}
+
+	line := fmt.Sprintf("%10d  seq=%-8d %-3s %s", offset, cmd.Seq, cmd.Op, strconv.Quote(cmd.Key))
+	if cmd.Op == "SET" {
+		line += " " + strconv.Quote(cmd.Value)
+		switch {
+		case !cmd.ExpiresAt.IsZero():
+			line += " expires=" + cmd.ExpiresAt.Format(time.RFC3339Nano)
+		case cmd.TTL > 0:
+			line += fmt.Sprintf(" ttl=%ds", cmd.TTL)
+		}
+		if !cmd.LastAccess.IsZero() {
+			line += " accessed=" + cmd.LastAccess.Format(time.RFC3339Nano)
+		}
+		if cmd.ContentType != "" {
+			line += " type=" + strconv.Quote(cmd.ContentType)
+		}
+	}
+	if cmd.Reason != "" {
+		line += " reason=" + cmd.Reason
+	}
+	fmt.Println(line)
+}
+
+// parseArgs parses subcommand flags and returns the single file argument.
+func parseArgs(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("expected exactly one AOF file argument")
+	}
+	return fs.Arg(0), nil
+}
+
+// openReader opens an AOF file and returns a reader for it.
+func openReader(path string) (*os.File, *cache.AOFReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := cache.NewAOFReader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, reader, nil
+}
+
+// runDump prints every record matching the filter.
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	var filter recordFilter
+	filter.register(fs)
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	file, reader, err := openReader(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := printPreamble(reader, &filter); err != nil {
+		return err
+	}
+
+	for {
+		offset := reader.Offset()
+		cmd, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("record %d at offset %d: %w", reader.Records()+1, offset, err)
+		}
+		if filter.match(cmd) {
+			filter.print(offset, cmd)
+		}
+	}
+}
+
+// printPreamble prints a line describing the dataset preamble, if the file has one.
+func printPreamble(reader *cache.AOFReader, filter *recordFilter) error {
+	if !reader.HasPreamble() || filter.json {
+		return nil
+	}
+	count, createdAt, err := reader.Preamble()
+	if err != nil {
+		return fmt.Errorf("preamble: %w", err)
+	}
+	fmt.Printf("-- preamble: %d entries written at %s --\n", count, createdAt.Format(time.RFC3339))
+	return nil
+}
+
+// runStats prints record counts and file statistics.
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	file, reader, err := openReader(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	byOp := make(map[string]int)
+	byReason := make(map[string]int) // DEL records not written by a client
+	keys := make(map[string]struct{})
+	preambleEntries := 0
+	var badErr error
+	var badOffset int64
+	for {
+		offset := reader.Offset()
+		cmd, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			badErr, badOffset = err, offset
+			break
+		}
+		if reader.InPreamble() {
+			preambleEntries++
+		} else {
+			byOp[cmd.Op]++
+			if cmd.Reason != "" {
+				byReason[cmd.Reason]++
+			}
+		}
+		keys[cmd.Key] = struct{}{}
+	}
+
+	format := "binary"
+	if reader.Legacy() {
+		format = "legacy JSON"
+	}
+
+	fmt.Printf("File:          %s\n", path)
+	fmt.Printf("Format:        %s\n", format)
+	fmt.Printf("Size:          %d bytes\n", info.Size())
+	if reader.HasPreamble() {
+		_, createdAt, _ := reader.Preamble()
+		fmt.Printf("Preamble:      %d entries written at %s\n", preambleEntries, createdAt.Format(time.RFC3339))
+	}
+	fmt.Printf("Records:       %d\n", reader.Records()-preambleEntries)
+	for _, op := range []string{"SET", "DEL"} {
+		fmt.Printf("  %-12s %d\n", op+":", byOp[op])
+	}
+	for op, n := range byOp {
+		if op != "SET" && op != "DEL" {
+			fmt.Printf("  %-12s %d\n", op+":", n)
+		}
+	}
+	for reason, n := range byReason {
+		fmt.Printf("    %-10s %d\n", reason+":", n)
+	}
+	fmt.Printf("Distinct keys: %d\n", len(keys))
+	if badErr != nil {
+		fmt.Printf("Bad records:   1 at offset %d (%v), %d bytes unreadable\n", badOffset, badErr, info.Size()-badOffset)
+	} else {
+		fmt.Printf("Bad records:   0\n")
+	}
+	return nil
+}
+
+// runVerify checks every record and reports the first corruption.
+// It exits with status 1 if the file is corrupted.
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	file, reader, err := openReader(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var lastSeq uint64
+	for {
+		offset, record := reader.Offset(), reader.Records()+1
+		cmd, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		var recErr *cache.AOFRecordError
+		if err != nil && !errors.As(err, &recErr) {
+			return err // I/O error, not corruption
+		}
+		if err == nil && cmd.Seq != 0 && cmd.Seq <= lastSeq {
+			err = fmt.Errorf("sequence number %d after %d", cmd.Seq, lastSeq)
+		}
+		if err != nil {
+			fmt.Printf("CORRUPT: record %d at offset %d: %v\n", record, offset, err)
+			fmt.Printf("%d of %d bytes are valid, %d bytes would be discarded on load\n", offset, info.Size(), info.Size()-offset)
+			os.Exit(1)
+		}
+		if cmd.Seq != 0 {
+			lastSeq = cmd.Seq
+		}
+	}
+
+	fmt.Printf("OK: %d records, %d bytes\n", reader.Records(), info.Size())
+	return nil
+}
+
+// runTail prints the last records of the file and optionally follows new ones.
+func runTail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	var filter recordFilter
+	filter.register(fs)
+	follow := fs.Bool("f", false, "follow the file and print records as they are appended")
+	count := fs.Int("n", 10, "number of records to print before following")
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	file, reader, err := openReader(path)
+	if err != nil {
+		return err
+	}
+	defer func() { file.Close() }()
+
+	// Keep only the last n matching records
+	type record struct {
+		offset int64
+		cmd    cache.AOFCommand
+	}
+	var last []record
+	for {
+		offset := reader.Offset()
+		cmd, err := reader.Next()
+		if err != nil {
+			if err == io.EOF || isIncomplete(err) {
+				break
+			}
+			return fmt.Errorf("record %d at offset %d: %w", reader.Records()+1, offset, err)
+		}
+		if !filter.match(cmd) {
+			continue
+		}
+		last = append(last, record{offset, cmd})
+		if len(last) > *count {
+			last = last[1:]
+		}
+	}
+	for _, r := range last {
+		filter.print(r.offset, r.cmd)
+	}
+
+	if !*follow {
+		return nil
+	}
+
+	for {
+		time.Sleep(followInterval)
+
+		// A rewrite or snapshot replaces or truncates the file: start over
+		replaced, err := fileReplaced(path, file, reader.Offset())
+		if err != nil {
+			return err
+		}
+		if replaced {
+			fmt.Fprintln(os.Stderr, "-- AOF was rewritten or truncated, reading from the start --")
+			file.Close()
+			if file, reader, err = openReader(path); err != nil {
+				return err
+			}
+		} else {
+			// Continue after the last complete record (a partial record may have been buffered)
+			if _, err := file.Seek(reader.Offset(), io.SeekStart); err != nil {
+				return err
+			}
+			reader.Reset(file)
+		}
+
+		for {
+			offset := reader.Offset()
+			cmd, err := reader.Next()
+			if err != nil {
+				if err == io.EOF || isIncomplete(err) {
+					break // Wait for more data
+				}
+				return fmt.Errorf("record %d at offset %d: %w", reader.Records()+1, offset, err)
+			}
+			if filter.match(cmd) {
+				filter.print(offset, cmd)
+			}
+		}
+	}
+}
+
+// isIncomplete reports whether err is an incomplete record, which in follow
+// mode just means the writer hasn't finished writing it yet.
+func isIncomplete(err error) bool {
+	var recErr *cache.AOFRecordError
+	return errors.As(err, &recErr) && strings.HasPrefix(recErr.Reason, "incomplete")
+}
+
+// fileReplaced reports whether the file at path is no longer the open file,
+// or has been truncated below the current offset.
+func fileReplaced(path string, file *os.File, offset int64) (bool, error) {
+	current, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil // Mid-rename, try again later
+		}
+		return false, err
+	}
+	open, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	return !os.SameFile(current, open) || current.Size() < offset, nil
+}
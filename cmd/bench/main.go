@@ -0,0 +1,507 @@
+// Package main implements bench, a load generator that measures a mini-redis
+// server the way redis-benchmark measures Redis: clients send GETs and SETs
+// over the HTTP API for a fixed duration, and throughput, latency
+// percentiles, and errors are reported per operation.
+//
+// Usage:
+//
+//	bench [-addr host:port] [-c clients] [-d duration] [-warmup duration]
+//	      [-keys n] [-size bytes] [-ratio reads] [-dist uniform|zipf] [-zipf-s s]
+//	      [-ttl seconds] [-populate=false] [-verify] [-format text|csv|json]
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"mini-redis/client"
+)
+
+// config holds the command-line settings of a run.
+type config struct {
+	addr     string
+	clients  int
+	duration time.Duration
+	warmup   time.Duration
+	keys     int
+	size     int
+	ratio    float64
+	dist     string
+	zipfS    float64
+	ttl      time.Duration
+	populate bool
+	verify   bool
+	format   string
+	timeout  time.Duration
+}
+
+// main parses the flags, runs the benchmark, and prints the report.
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.addr, "addr", "localhost:8080", "Server address (host:port or base URL)")
+	flag.IntVar(&cfg.clients, "c", 50, "Concurrent clients")
+	flag.DurationVar(&cfg.duration, "d", 10*time.Second, "Measured duration")
+	flag.DurationVar(&cfg.warmup, "warmup", 2*time.Second, "Unmeasured warm-up before the measured duration (0 = none)")
+	flag.IntVar(&cfg.keys, "keys", 10000, "Number of distinct keys")
+	flag.IntVar(&cfg.size, "size", 64, "Value size in bytes")
+	flag.Float64Var(&cfg.ratio, "ratio", 0.9, "Fraction of requests that are GETs (0 to 1)")
+	flag.StringVar(&cfg.dist, "dist", "uniform", "Key access distribution: uniform or zipf")
+	flag.Float64Var(&cfg.zipfS, "zipf-s", 1.1, "Exponent of the zipf distribution (> 1, higher is more skewed)")
+	ttl := flag.Int("ttl", 0, "TTL of the keys set, in seconds (0 = no expiry)")
+	flag.BoolVar(&cfg.populate, "populate", true, "Set every key once before the warm-up, so GETs hit")
+	flag.BoolVar(&cfg.verify, "verify", false, "Check that every GET returns the client's last SET of the key (each client gets its own keys)")
+	flag.StringVar(&cfg.format, "format", "text", "Report format: text, csv, or json")
+	flag.DurationVar(&cfg.timeout, "timeout", 5*time.Second, "Timeout of each request")
+	flag.Parse()
+	cfg.ttl = time.Duration(*ttl) * time.Second
+
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	rep, err := run(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := rep.write(os.Stdout, cfg.format); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if rep.VerifyFailures > 0 {
+		os.Exit(1)
+	}
+}
+
+// validate checks the settings.
+func (cfg *config) validate() error {
+	switch {
+	case cfg.clients < 1:
+		return fmt.Errorf("invalid client count %d (must be at least 1)", cfg.clients)
+	case cfg.duration <= 0:
+		return fmt.Errorf("invalid duration %v (must be positive)", cfg.duration)
+	case cfg.warmup < 0:
+		return fmt.Errorf("invalid warm-up %v (must not be negative)", cfg.warmup)
+	case cfg.keys < 1:
+		return fmt.Errorf("invalid key count %d (must be at least 1)", cfg.keys)
+	case cfg.size < 1:
+		return fmt.Errorf("invalid value size %d (must be at least 1)", cfg.size)
+	case cfg.ratio < 0 || cfg.ratio > 1:
+		return fmt.Errorf("invalid read ratio %v (must be between 0 and 1)", cfg.ratio)
+	case cfg.dist != "uniform" && cfg.dist != "zipf":
+		return fmt.Errorf("unknown distribution %q (must be uniform or zipf)", cfg.dist)
+	case cfg.dist == "zipf" && cfg.zipfS <= 1:
+		return fmt.Errorf("invalid zipf exponent %v (must be greater than 1)", cfg.zipfS)
+	case cfg.ttl < 0:
+		return fmt.Errorf("invalid TTL %v (must not be negative)", cfg.ttl)
+	case cfg.format != "text" && cfg.format != "csv" && cfg.format != "json":
+		return fmt.Errorf("unknown format %q (must be text, csv, or json)", cfg.format)
+	}
+	return nil
+}
+
+// run populates the keys, warms up, and measures, with cfg.clients workers.
+func run(cfg config) (*report, error) {
+	hc := &http.Client{
+		Timeout: cfg.timeout,
+		Transport: &http.Transport{
+			MaxIdleConns:        cfg.clients,
+			MaxIdleConnsPerHost: cfg.clients, // Keep a connection per client instead of reconnecting
+		},
+	}
+	c := client.New(cfg.addr, client.WithHTTPClient(hc))
+
+	// In verify mode every worker has its own keys, named after the run, so
+	// it knows the last value of each and no other run's keys interfere
+	run := strconv.FormatInt(time.Now().UnixNano(), 36)
+	var shared []string
+	if !cfg.verify {
+		shared = keyNames("bench:", cfg.keys)
+	}
+	workers := make([]*worker, cfg.clients)
+	for i := range workers {
+		keys := shared
+		if cfg.verify {
+			keys = keyNames(fmt.Sprintf("bench:%s:%d:", run, i), cfg.keys)
+		}
+		workers[i] = newWorker(i, cfg, c, keys)
+	}
+
+	if cfg.populate {
+		if err := phase(workers, (*worker).populate); err != nil {
+			return nil, fmt.Errorf("failed to populate keys: %w", err)
+		}
+	}
+	if cfg.warmup > 0 {
+		deadline := time.Now().Add(cfg.warmup)
+		phase(workers, func(w *worker) error { return w.load(deadline) })
+	}
+	for _, w := range workers {
+		w.reset() // Only the measured requests are reported
+	}
+
+	start := time.Now()
+	deadline := start.Add(cfg.duration)
+	phase(workers, func(w *worker) error { return w.load(deadline) })
+	return newReport(cfg, workers, time.Since(start)), nil
+}
+
+// keyNames returns the names of n keys with the given prefix.
+func keyNames(prefix string, n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = prefix + strconv.Itoa(i)
+	}
+	return keys
+}
+
+// phase runs fn on every worker concurrently and returns the first error.
+func phase(workers []*worker, fn func(*worker) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(workers))
+	for i, w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(w)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// worker is a client sending requests one at a time and recording them.
+type worker struct {
+	id     int
+	cfg    config
+	client *client.Client
+	keys   []string
+	rng    *rand.Rand
+	zipf   *rand.Zipf     // nil for the uniform distribution
+	value  []byte         // Value written by SETs; starts with a sequence number in verify mode
+	last   map[int]string // Last value set per key index (verify mode only)
+	seq    int            // SETs sent, numbering the values in verify mode
+
+	get, set opStats
+	hits     int64
+	misses   int64
+	failures int64 // GETs that didn't return the last value set (verify mode only)
+}
+
+// opStats records the requests of one operation.
+type opStats struct {
+	latencies []time.Duration
+	errors    map[string]int64 // Failed requests by error message
+}
+
+// newWorker creates worker id, sending requests for keys.
+func newWorker(id int, cfg config, c *client.Client, keys []string) *worker {
+	w := &worker{
+		id:     id,
+		cfg:    cfg,
+		client: c,
+		keys:   keys,
+		rng:    rand.New(rand.NewPCG(uint64(time.Now().UnixNano()), uint64(id))),
+		value:  make([]byte, cfg.size),
+	}
+	if cfg.dist == "zipf" {
+		w.zipf = rand.NewZipf(w.rng, cfg.zipfS, 1, uint64(len(keys)-1))
+	}
+	for i := range w.value {
+		w.value[i] = 'a' + byte(w.rng.IntN(26))
+	}
+	if cfg.verify {
+		w.last = make(map[int]string, len(keys))
+	}
+	w.reset()
+	return w
+}
+
+// reset discards the recorded requests, e.g. after the warm-up.
+func (w *worker) reset() {
+	w.get = opStats{errors: make(map[string]int64)}
+	w.set = opStats{errors: make(map[string]int64)}
+	w.hits, w.misses, w.failures = 0, 0, 0
+}
+
+// populate sets the worker's share of the keys: all of its own keys in
+// verify mode, or every cfg.clients-th shared key otherwise.
+func (w *worker) populate() error {
+	step, first := w.cfg.clients, w.id
+	if w.cfg.verify {
+		step, first = 1, 0
+	}
+	for i := first; i < len(w.keys); i += step {
+		if err := w.doSet(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load sends requests until deadline.
+func (w *worker) load(deadline time.Time) error {
+	for time.Now().Before(deadline) {
+		i := w.nextKey()
+		if w.rng.Float64() < w.cfg.ratio {
+			w.doGet(i)
+		} else {
+			w.doSet(i)
+		}
+	}
+	return nil
+}
+
+// nextKey returns the index of the next key by the access distribution.
+func (w *worker) nextKey() int {
+	if w.zipf != nil {
+		return int(w.zipf.Uint64())
+	}
+	return w.rng.IntN(len(w.keys))
+}
+
+// doSet sets key i and records the request.
+func (w *worker) doSet(i int) error {
+	value := w.nextValue()
+	start := time.Now()
+	err := w.client.Set(context.Background(), w.keys[i], value, w.cfg.ttl)
+	w.set.record(time.Since(start), err)
+	if err == nil && w.last != nil {
+		w.last[i] = value
+	}
+	return err
+}
+
+// nextValue returns the value of the next SET: the same value every time,
+// or in verify mode one starting with a sequence number, so a GET can tell
+// which SET it reads.
+func (w *worker) nextValue() string {
+	if !w.cfg.verify {
+		return string(w.value)
+	}
+	w.seq++
+	prefix := strconv.Itoa(w.seq) + ":"
+	if len(prefix) >= len(w.value) {
+		return prefix
+	}
+	return prefix + string(w.value[len(prefix):])
+}
+
+// doGet gets key i, records the request, and checks the value in verify mode.
+func (w *worker) doGet(i int) {
+	start := time.Now()
+	value, err := w.client.Get(context.Background(), w.keys[i])
+	elapsed := time.Since(start)
+	if errors.Is(err, client.ErrNotFound) {
+		w.get.record(elapsed, nil)
+		w.misses++
+	} else {
+		w.get.record(elapsed, err)
+		if err == nil {
+			w.hits++
+		}
+	}
+	if w.last == nil || err != nil && !errors.Is(err, client.ErrNotFound) {
+		return
+	}
+
+	expected, written := w.last[i]
+	switch {
+	case !written && err == nil:
+		w.failures++ // A key this run never set
+	case written && err == nil && value != expected:
+		w.failures++ // Not the last value set
+	case written && err != nil && w.cfg.ttl == 0:
+		w.failures++ // Lost without expiring (eviction also causes this)
+	}
+}
+
+// record adds a request that took elapsed and failed with err, or succeeded.
+func (s *opStats) record(elapsed time.Duration, err error) {
+	if err != nil {
+		s.errors[err.Error()]++
+		return
+	}
+	s.latencies = append(s.latencies, elapsed)
+}
+
+// report is the result of a run.
+type report struct {
+	Duration       float64          `json:"duration_s"`      // Measured duration in seconds
+	Clients        int              `json:"clients"`         // Concurrent clients
+	Keys           int              `json:"keys"`            // Distinct keys (per client in verify mode)
+	ValueSize      int              `json:"value_size"`      // Value size in bytes
+	Distribution   string           `json:"distribution"`    // Key access distribution
+	Ops            int64            `json:"ops"`             // Requests sent, including failed ones
+	OpsPerSec      float64          `json:"ops_per_sec"`     // Ops per second
+	Hits           int64            `json:"hits"`            // GETs that found the key
+	Misses         int64            `json:"misses"`          // GETs that didn't
+	Errors         int64            `json:"errors"`          // Failed requests
+	VerifyFailures int64            `json:"verify_failures"` // GETs that didn't return the last value set (verify mode)
+	Get            opReport         `json:"get"`
+	Set            opReport         `json:"set"`
+	ErrorMessages  map[string]int64 `json:"error_messages,omitempty"` // Failed requests by error message
+}
+
+// opReport summarizes the requests of one operation. Latencies are in
+// microseconds and only include successful requests.
+type opReport struct {
+	Ops       int64   `json:"ops"`
+	OpsPerSec float64 `json:"ops_per_sec"`
+	Errors    int64   `json:"errors"`
+	P50       float64 `json:"p50_us"`
+	P90       float64 `json:"p90_us"`
+	P99       float64 `json:"p99_us"`
+	P999      float64 `json:"p999_us"`
+	Max       float64 `json:"max_us"`
+}
+
+// newReport merges the requests recorded by the workers.
+func newReport(cfg config, workers []*worker, elapsed time.Duration) *report {
+	rep := &report{
+		Duration:      elapsed.Seconds(),
+		Clients:       cfg.clients,
+		Keys:          cfg.keys,
+		ValueSize:     cfg.size,
+		Distribution:  cfg.dist,
+		ErrorMessages: make(map[string]int64),
+	}
+	var gets, sets []opStats
+	for _, w := range workers {
+		gets = append(gets, w.get)
+		sets = append(sets, w.set)
+		rep.Hits += w.hits
+		rep.Misses += w.misses
+		rep.VerifyFailures += w.failures
+	}
+	rep.Get = summarize(gets, elapsed, rep.ErrorMessages)
+	rep.Set = summarize(sets, elapsed, rep.ErrorMessages)
+	rep.Ops = rep.Get.Ops + rep.Set.Ops
+	rep.OpsPerSec = float64(rep.Ops) / elapsed.Seconds()
+	rep.Errors = rep.Get.Errors + rep.Set.Errors
+	return rep
+}
+
+// summarize merges the stats of an operation and adds its errors to messages.
+func summarize(stats []opStats, elapsed time.Duration, messages map[string]int64) opReport {
+	var latencies []time.Duration
+	var r opReport
+	for _, s := range stats {
+		latencies = append(latencies, s.latencies...)
+		for msg, n := range s.errors {
+			messages[msg] += n
+			r.Errors += n
+		}
+	}
+	slices.Sort(latencies)
+
+	r.Ops = int64(len(latencies)) + r.Errors
+	r.OpsPerSec = float64(r.Ops) / elapsed.Seconds()
+	r.P50 = percentile(latencies, 0.50)
+	r.P90 = percentile(latencies, 0.90)
+	r.P99 = percentile(latencies, 0.99)
+	r.P999 = percentile(latencies, 0.999)
+	r.Max = percentile(latencies, 1)
+	return r
+}
+
+// percentile returns the p-th percentile (0 to 1) of sorted latencies, in
+// microseconds, or 0 if there are none.
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	i = min(max(i, 0), len(sorted)-1)
+	return float64(sorted[i]) / float64(time.Microsecond)
+}
+
+// write prints the report in the given format.
+func (rep *report) write(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rep)
+	case "csv":
+		return rep.writeCSV(w)
+	default:
+		return rep.writeText(w)
+	}
+}
+
+// writeText prints the report for humans.
+func (rep *report) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "%d clients, %d keys, %d-byte values, %s access, %.1fs\n",
+		rep.Clients, rep.Keys, rep.ValueSize, rep.Distribution, rep.Duration)
+	fmt.Fprintf(w, "Throughput: %.0f ops/s (%d ops, %d errors)\n", rep.OpsPerSec, rep.Ops, rep.Errors)
+	if lookups := rep.Hits + rep.Misses; lookups > 0 {
+		fmt.Fprintf(w, "GET hit rate: %.1f%% (%d hits, %d misses)\n", 100*float64(rep.Hits)/float64(lookups), rep.Hits, rep.Misses)
+	}
+	fmt.Fprintf(w, "\n%-4s %10s %10s %8s %10s %10s %10s %10s %10s\n", "op", "ops", "ops/s", "errors", "p50", "p90", "p99", "p99.9", "max")
+	for _, op := range []struct {
+		name string
+		r    opReport
+	}{{"GET", rep.Get}, {"SET", rep.Set}} {
+		fmt.Fprintf(w, "%-4s %10d %10.0f %8d %10s %10s %10s %10s %10s\n", op.name, op.r.Ops, op.r.OpsPerSec, op.r.Errors,
+			formatMicros(op.r.P50), formatMicros(op.r.P90), formatMicros(op.r.P99), formatMicros(op.r.P999), formatMicros(op.r.Max))
+	}
+
+	if len(rep.ErrorMessages) > 0 {
+		fmt.Fprintln(w, "\nErrors:")
+		messages := make([]string, 0, len(rep.ErrorMessages))
+		for msg := range rep.ErrorMessages {
+			messages = append(messages, msg)
+		}
+		sort.Slice(messages, func(i, j int) bool { return rep.ErrorMessages[messages[i]] > rep.ErrorMessages[messages[j]] })
+		for _, msg := range messages {
+			fmt.Fprintf(w, "  %8d  %s\n", rep.ErrorMessages[msg], msg)
+		}
+	}
+	if rep.VerifyFailures > 0 {
+		fmt.Fprintf(w, "\nVerification FAILED: %d GETs didn't return the last value set\n", rep.VerifyFailures)
+	}
+	return nil
+}
+
+// formatMicros formats a latency in microseconds.
+func formatMicros(us float64) string {
+	return time.Duration(us * float64(time.Microsecond)).Round(time.Microsecond).String()
+}
+
+// writeCSV prints a header and a row per operation, for CI tracking.
+func (rep *report) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"op", "clients", "keys", "value_size", "distribution", "duration_s", "ops", "ops_per_sec", "errors",
+		"p50_us", "p90_us", "p99_us", "p999_us", "max_us", "verify_failures"})
+	for _, op := range []struct {
+		name string
+		r    opReport
+	}{{"get", rep.Get}, {"set", rep.Set}} {
+		cw.Write([]string{op.name, strconv.Itoa(rep.Clients), strconv.Itoa(rep.Keys), strconv.Itoa(rep.ValueSize), rep.Distribution,
+			formatFloat(rep.Duration), strconv.FormatInt(op.r.Ops, 10), formatFloat(op.r.OpsPerSec), strconv.FormatInt(op.r.Errors, 10),
+			formatFloat(op.r.P50), formatFloat(op.r.P90), formatFloat(op.r.P99), formatFloat(op.r.P999), formatFloat(op.r.Max),
+			strconv.FormatInt(rep.VerifyFailures, 10)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatFloat formats a number for CSV with up to 3 decimals.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 3, 64)
+}
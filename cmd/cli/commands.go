@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"mini-redis/client"
+)
+
+// command is a command of the CLI.
+type command struct {
+	name    string
+	args    string // Arguments, for usage messages
+	summary string
+	minArgs int
+	maxArgs int // -1: any number
+	run     func(ctx context.Context, c *cli, args []string) (any, error)
+}
+
+// commands are the commands of the CLI, in the order of help. Names are
+// matched without regard to case, like Redis.
+var commands = []command{
+	{"get", "key", "Value of a key", 1, 1, runGet},
+	{"set", "key value [ttl]", "Store a value, with a TTL in seconds or as a duration (1h30m)", 2, 3, runSet},
+	{"del", "key [key...]", "Delete keys, and count those that existed", 1, -1, runDel},
+	{"exists", "key", "Whether a key exists", 1, 1, runExists},
+	{"incr", "key", "Add 1 to an integer value", 1, 1, runIncr},
+	{"incrby", "key increment", "Add to an integer value", 2, 2, runIncr},
+	{"expire", "key ttl", "Set the TTL of a key, or remove it with 0", 2, 2, runExpire},
+	{"ttl", "key", "Time until a key expires", 1, 1, runTTL},
+	{"mget", "key [key...]", "Values of several keys", 1, -1, runMGet},
+	{"scan", "[cursor] [match pattern] [count n]", "A page of keys, and the cursor of the next one", 0, 5, runScan},
+	{"keys", "[pattern]", "Every key matching a pattern, page after page", 0, 1, runKeys},
+	{"stats", "", "Size of the dataset, limits, and removed keys", 0, 0, runStats},
+	{"help", "", "List the commands", 0, 0, nil},                                // Run by cli.run
+	{"quit", "", "Leave the interactive prompt (also exit, Ctrl-D)", 0, 0, nil}, // Run by cli.repl
+}
+
+// lookupCommand returns the command named name, except help and quit.
+func lookupCommand(name string) (*command, bool) {
+	for i := range commands {
+		if strings.EqualFold(commands[i].name, name) && commands[i].run != nil {
+			return &commands[i], true
+		}
+	}
+	return nil, false
+}
+
+// completeCommand returns the command names starting with prefix, for tab
+// completion.
+func completeCommand(prefix string) []string {
+	var names []string
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	names = append(names, "exit")
+	return slices.DeleteFunc(names, func(name string) bool { return !strings.HasPrefix(name, strings.ToLower(prefix)) })
+}
+
+// printCommands prints the commands and their arguments.
+func printCommands(w io.Writer) {
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-45s %s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.summary)
+	}
+}
+
+// usageError is the error of invalid arguments.
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+// Results printed by printResult and printJSON.
+type (
+	okResult   struct{}  // Success without a value: OK
+	nilResult  struct{}  // Missing key: (nil)
+	valueList  []*string // Values, nil for missing keys
+	keyList    []string
+	ttlResult  int64 // Seconds until expiration, -1 without TTL, -2 for a missing key
+	scanResult struct {
+		Keys   []string `json:"keys"`
+		Cursor string   `json:"cursor"` // Empty after the last page
+	}
+)
+
+// statsResult is the result of stats.
+type statsResult struct {
+	Keys           int64  `json:"keys"`
+	MaxKeys        int64  `json:"max_keys"`
+	UsedMemory     int64  `json:"used_memory"`
+	MaxMemory      int64  `json:"max_memory"`
+	EvictionPolicy string `json:"eviction_policy"`
+	ExpiredLazy    int64  `json:"expired_lazy"`
+	ExpiredActive  int64  `json:"expired_active"`
+	Evicted        int64  `json:"evicted"`
+	Deleted        int64  `json:"deleted"`
+}
+
+func runGet(ctx context.Context, c *cli, args []string) (any, error) {
+	value, err := c.client.Get(ctx, args[0])
+	if errors.Is(err, client.ErrNotFound) {
+		return nilResult{}, nil
+	}
+	return value, err
+}
+
+func runSet(ctx context.Context, c *cli, args []string) (any, error) {
+	var ttl time.Duration
+	if len(args) == 3 {
+		var err error
+		if ttl, err = parseTTL(args[2]); err != nil {
+			return nil, err
+		}
+		if ttl == 0 {
+			return nil, &usageError{"invalid ttl 0, omit it for no expiration"}
+		}
+	}
+	return okResult{}, c.client.Set(ctx, args[0], args[1], ttl)
+}
+
+func runDel(ctx context.Context, c *cli, args []string) (any, error) {
+	var deleted int64
+	for _, key := range args {
+		existed, err := c.client.Del(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if existed {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func runExists(ctx context.Context, c *cli, args []string) (any, error) {
+	return c.client.Exists(ctx, args[0])
+}
+
+func runIncr(ctx context.Context, c *cli, args []string) (any, error) {
+	by := int64(1)
+	if len(args) == 2 {
+		var err error
+		if by, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return nil, &usageError{fmt.Sprintf("invalid increment %q", args[1])}
+		}
+	}
+	return c.client.Incr(ctx, args[0], by)
+}
+
+func runExpire(ctx context.Context, c *cli, args []string) (any, error) {
+	ttl, err := parseTTL(args[1])
+	if err != nil {
+		return nil, err
+	}
+	return c.client.Expire(ctx, args[0], ttl)
+}
+
+func runTTL(ctx context.Context, c *cli, args []string) (any, error) {
+	ttl, err := c.client.TTL(ctx, args[0])
+	switch {
+	case errors.Is(err, client.ErrNotFound):
+		return ttlResult(-2), nil
+	case err != nil:
+		return nil, err
+	case ttl == 0:
+		return ttlResult(-1), nil
+	}
+	return ttlResult(ttl / time.Second), nil
+}
+
+func runMGet(ctx context.Context, c *cli, args []string) (any, error) {
+	found, err := c.client.MGet(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	values := make(valueList, len(args))
+	for i, key := range args {
+		if value, ok := found[key]; ok {
+			values[i] = &value
+		}
+	}
+	return values, nil
+}
+
+// runScan returns a page of keys. Its arguments are those of Redis SCAN,
+// except that the cursor is a string, empty for the first page, and the
+// pattern must select a prefix, e.g. user:*.
+func runScan(ctx context.Context, c *cli, args []string) (any, error) {
+	cursor, pattern, count := "", "*", 0
+	if len(args)%2 == 1 {
+		cursor, args = args[0], args[1:]
+	}
+	for ; len(args) >= 2; args = args[2:] {
+		switch strings.ToLower(args[0]) {
+		case "match":
+			pattern = args[1]
+		case "count":
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n <= 0 {
+				return nil, &usageError{fmt.Sprintf("invalid count %q", args[1])}
+			}
+			count = n
+		default:
+			return nil, &usageError{fmt.Sprintf("unknown option %q", args[0])}
+		}
+	}
+	prefix, exact, err := patternPrefix(pattern)
+	if err != nil {
+		return nil, err
+	}
+	keys, next, err := c.client.Scan(ctx, prefix, cursor, count)
+	if err != nil {
+		return nil, err
+	}
+	if exact {
+		keys = slices.DeleteFunc(keys, func(key string) bool { return key != prefix })
+	}
+	return scanResult{Keys: keys, Cursor: next}, nil
+}
+
+// runKeys returns every key matching a pattern, scanning page after page.
+// Unlike Redis KEYS, it doesn't block the server while it runs.
+func runKeys(ctx context.Context, c *cli, args []string) (any, error) {
+	pattern := "*"
+	if len(args) == 1 {
+		pattern = args[0]
+	}
+	prefix, exact, err := patternPrefix(pattern)
+	if err != nil {
+		return nil, err
+	}
+	keys := keyList{}
+	cursor := ""
+	for {
+		page, next, err := c.client.Scan(ctx, prefix, cursor, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range page {
+			if !exact || key == prefix {
+				keys = append(keys, key)
+			}
+		}
+		if next == "" {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+func runStats(ctx context.Context, c *cli, args []string) (any, error) {
+	stats, err := c.client.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return statsResult{
+		Keys:           stats.Keys,
+		MaxKeys:        stats.MaxKeys,
+		UsedMemory:     stats.UsedMemory,
+		MaxMemory:      stats.MaxMemory,
+		EvictionPolicy: stats.EvictionPolicy,
+		ExpiredLazy:    stats.ExpiredLazy,
+		ExpiredActive:  stats.ExpiredActive,
+		Evicted:        stats.Evicted,
+		Deleted:        stats.Deleted,
+	}, nil
+}
+
+// parseTTL parses a TTL in seconds or as a duration, e.g. 90 or 1h30m.
+func parseTTL(s string) (time.Duration, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return d, nil
+	}
+	return 0, &usageError{fmt.Sprintf("invalid ttl %q: must be seconds or a duration like 1h30m", s)}
+}
+
+// patternPrefix returns the prefix selected by a pattern: * for every key,
+// a prefix followed by *, or a key without *, which exact reports. The
+// server only filters keys by prefix, so other glob patterns are rejected.
+func patternPrefix(pattern string) (prefix string, exact bool, err error) {
+	prefix, star := strings.CutSuffix(pattern, "*")
+	if strings.ContainsAny(prefix, `*?[\`) {
+		return "", false, &usageError{fmt.Sprintf("unsupported pattern %q: only prefixes are, e.g. user:*", pattern)}
+	}
+	return prefix, !star, nil
+}
+
+// printResult prints a result for people: strings quoted, like redis-cli,
+// so that spaces and binary data are visible, and TTLs as durations.
+func printResult(w io.Writer, result any) {
+	switch r := result.(type) {
+	case okResult:
+		fmt.Fprintln(w, "OK")
+	case nilResult:
+		fmt.Fprintln(w, "(nil)")
+	case string:
+		fmt.Fprintln(w, strconv.Quote(r))
+	case int64:
+		fmt.Fprintf(w, "(integer) %d\n", r)
+	case bool:
+		fmt.Fprintf(w, "(integer) %d\n", map[bool]int{false: 0, true: 1}[r])
+	case ttlResult:
+		switch {
+		case r == -2:
+			fmt.Fprintln(w, "(nil) key not found")
+		case r == -1:
+			fmt.Fprintln(w, "(no ttl)")
+		default:
+			fmt.Fprintf(w, "(ttl) %v\n", time.Duration(r)*time.Second)
+		}
+	case valueList:
+		if len(r) == 0 {
+			fmt.Fprintln(w, "(empty list)")
+		}
+		for i, v := range r {
+			if v == nil {
+				fmt.Fprintf(w, "%d) (nil)\n", i+1)
+			} else {
+				fmt.Fprintf(w, "%d) %s\n", i+1, strconv.Quote(*v))
+			}
+		}
+	case keyList:
+		printKeys(w, r)
+	case scanResult:
+		printKeys(w, r.Keys)
+		if r.Cursor == "" {
+			fmt.Fprintln(w, "(end of keys)")
+		} else {
+			fmt.Fprintf(w, "(next cursor) %s\n", quoteArg(r.Cursor))
+		}
+	case statsResult:
+		fmt.Fprintf(w, "keys:            %d%s\n", r.Keys, limit(r.MaxKeys))
+		fmt.Fprintf(w, "used_memory:     %d%s\n", r.UsedMemory, limit(r.MaxMemory))
+		fmt.Fprintf(w, "eviction_policy: %s\n", r.EvictionPolicy)
+		fmt.Fprintf(w, "expired:         %d lazily, %d by the cleanup\n", r.ExpiredLazy, r.ExpiredActive)
+		fmt.Fprintf(w, "evicted:         %d\n", r.Evicted)
+		fmt.Fprintf(w, "deleted:         %d\n", r.Deleted)
+	default:
+		fmt.Fprintln(w, r)
+	}
+}
+
+// printKeys prints keys as a numbered list.
+func printKeys(w io.Writer, keys []string) {
+	if len(keys) == 0 {
+		fmt.Fprintln(w, "(empty list)")
+	}
+	for i, key := range keys {
+		fmt.Fprintf(w, "%d) %s\n", i+1, strconv.Quote(key))
+	}
+}
+
+// limit formats a limit of stats, 0 meaning none.
+func limit(n int64) string {
+	if n == 0 {
+		return " (no limit)"
+	}
+	return fmt.Sprintf(" of %d", n)
+}
+
+// quoteArg quotes s if it must be quoted to be read back as one argument by
+// splitArgs.
+func quoteArg(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\"'\\") || strings.IndexFunc(s, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// printJSON prints a result as JSON, for scripts: values as strings, nil
+// for missing keys, TTLs in seconds (-1: none, -2: missing key).
+func printJSON(w io.Writer, result any) {
+	switch result.(type) {
+	case okResult:
+		result = "OK"
+	case nilResult:
+		result = nil
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		fmt.Fprintf(w, "%q\n", err.Error())
+		return
+	}
+	fmt.Fprintf(w, "%s\n", b)
+}
+
+// printError prints the error of a command, with the code of server errors.
+func printError(w io.Writer, err error) {
+	var serverErr *client.ServerError
+	var commandErr *client.CommandError
+	switch {
+	case errors.As(err, &serverErr) && serverErr.Code != "":
+		fmt.Fprintf(w, "(error) %s: %s\n", serverErr.Code, serverErr.Message)
+	case errors.As(err, &serverErr):
+		fmt.Fprintf(w, "(error) HTTP %d: %s\n", serverErr.StatusCode, serverErr.Message)
+	case errors.As(err, &commandErr):
+		fmt.Fprintf(w, "(error) %s: %s\n", commandErr.Code, commandErr.Message)
+	case errors.Is(err, context.DeadlineExceeded):
+		fmt.Fprintln(w, "(error) timed out, see -timeout")
+	default:
+		fmt.Fprintf(w, "(error) %v\n", err)
+	}
+}
+
+// splitArgs splits a line into arguments, like redis-cli: they are
+// separated by spaces, and may be quoted with "..." (with the escapes \n,
+// \r, \t, \", \\, and \xHH) or '...' (with \' only).
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for i := 0; ; {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		var arg strings.Builder
+		var quote byte
+		for ; i < len(line); i++ {
+			ch := line[i]
+			switch {
+			case quote == 0 && (ch == ' ' || ch == '\t'):
+			case quote == 0 && (ch == '"' || ch == '\''):
+				quote = ch
+				continue
+			case quote != 0 && ch == quote:
+				quote = 0
+				if i+1 < len(line) && line[i+1] != ' ' && line[i+1] != '\t' {
+					return nil, errors.New("invalid argument: closing quote must be followed by a space")
+				}
+				continue
+			case quote != 0 && ch == '\\' && i+1 < len(line):
+				n, s, ok := unescape(quote, line[i+1:])
+				if ok {
+					arg.WriteString(s)
+					i += n
+					continue
+				}
+				arg.WriteByte(ch)
+				continue
+			default:
+				arg.WriteByte(ch)
+				continue
+			}
+			break
+		}
+		if quote != 0 {
+			return nil, errors.New("invalid argument: unbalanced quotes")
+		}
+		args = append(args, arg.String())
+	}
+}
+
+// unescape decodes the escape sequence at the start of s, after a
+// backslash within quote, and returns its length.
+func unescape(quote byte, s string) (int, string, bool) {
+	if quote == '\'' {
+		if s[0] == '\'' {
+			return 1, "'", true
+		}
+		return 0, "", false
+	}
+	switch s[0] {
+	case 'n':
+		return 1, "\n", true
+	case 'r':
+		return 1, "\r", true
+	case 't':
+		return 1, "\t", true
+	case '"', '\\':
+		return 1, s[:1], true
+	case 'x':
+		if len(s) >= 3 {
+			if b, err := strconv.ParseUint(s[1:3], 16, 8); err == nil {
+				return 3, string([]byte{byte(b)}), true
+			}
+		}
+	}
+	return 0, "", false
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// errInterrupted is returned by readLine when Ctrl-C discards the line.
+var errInterrupted = errors.New("interrupted")
+
+// lineEditor reads lines from a terminal with the usual readline keys:
+// arrows, Home and End, Ctrl-A/E/B/F to move, Backspace, Delete, Ctrl-K/U/W
+// to delete, Up and Down (Ctrl-P/N) for the history, Tab to complete the
+// command name, Ctrl-L to clear the screen, Ctrl-C to discard the line, and
+// Ctrl-D on an empty line to quit. The terminal is only in raw mode while a
+// line is read, so commands print and can be interrupted as usual.
+type lineEditor struct {
+	in          *os.File
+	r           *bufio.Reader // Reads in, kept between lines for pasted input
+	out         io.Writer
+	complete    func(prefix string) []string // Completions of the first word
+	history     []string                     // Oldest first
+	historyPath string                       // File the history is loaded from and saved to (empty: none)
+}
+
+// readLine reads a line after printing prompt. It returns io.EOF for Ctrl-D
+// on an empty line and errInterrupted for Ctrl-C.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	restore, err := makeRaw(e.in)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	if e.r == nil {
+		e.r = bufio.NewReader(e.in)
+	}
+	r := e.r
+	var line []rune
+	pos := 0
+	hist := len(e.history) // Position in the history, len(e.history) for the new line
+	pending := ""          // New line while the history is browsed
+	refresh := func() {
+		// Redraw the line and put the cursor back at pos
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K\r", prompt, string(line))
+		if n := utf8.RuneCountInString(prompt) + pos; n > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dC", n)
+		}
+	}
+	browse := func(to int) {
+		if to < 0 || to > len(e.history) || to == hist {
+			return
+		}
+		if hist == len(e.history) {
+			pending = string(line)
+		}
+		hist = to
+		if hist == len(e.history) {
+			line = []rune(pending)
+		} else {
+			line = []rune(e.history[hist])
+		}
+		pos = len(line)
+	}
+
+	refresh()
+	for {
+		ch, _, err := r.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch ch {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			s := string(line)
+			e.addHistory(s)
+			return s, nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+		case 127, 8: // Backspace, Ctrl-H
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(line)
+		case 2: // Ctrl-B
+			pos = max(pos-1, 0)
+		case 6: // Ctrl-F
+			pos = min(pos+1, len(line))
+		case 11: // Ctrl-K
+			line = line[:pos]
+		case 21: // Ctrl-U
+			line = line[pos:]
+			pos = 0
+		case 23: // Ctrl-W
+			start := pos
+			for start > 0 && line[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && line[start-1] != ' ' {
+				start--
+			}
+			line = append(line[:start], line[pos:]...)
+			pos = start
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case 16: // Ctrl-P
+			browse(hist - 1)
+		case 14: // Ctrl-N
+			browse(hist + 1)
+		case '\t':
+			line, pos = e.completeLine(line, pos)
+		case 27: // Escape sequence
+			switch e.readEscape(r) {
+			case 'A':
+				browse(hist - 1)
+			case 'B':
+				browse(hist + 1)
+			case 'C':
+				pos = min(pos+1, len(line))
+			case 'D':
+				pos = max(pos-1, 0)
+			case 'H':
+				pos = 0
+			case 'F':
+				pos = len(line)
+			case '3': // Delete
+				if pos < len(line) {
+					line = append(line[:pos], line[pos+1:]...)
+				}
+			}
+		default:
+			if ch < ' ' || ch == utf8.RuneError {
+				continue
+			}
+			line = append(line[:pos], append([]rune{ch}, line[pos:]...)...)
+			pos++
+		}
+		refresh()
+	}
+}
+
+// readEscape reads the rest of an escape sequence after ESC and returns the
+// key: A, B, C, D for the arrows, H and F for Home and End, 3 for Delete,
+// and 0 for others.
+func (e *lineEditor) readEscape(r *bufio.Reader) byte {
+	b, err := r.ReadByte()
+	if err != nil || b != '[' && b != 'O' {
+		return 0
+	}
+	var seq []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0
+		}
+		if c >= 0x40 && c <= 0x7E { // Final byte
+			switch {
+			case len(seq) == 0:
+				return c
+			case c == '~' && (string(seq) == "1" || string(seq) == "7"):
+				return 'H'
+			case c == '~' && (string(seq) == "4" || string(seq) == "8"):
+				return 'F'
+			case c == '~' && string(seq) == "3":
+				return '3'
+			}
+			return 0
+		}
+		seq = append(seq, c)
+	}
+}
+
+// completeLine completes the command name before the cursor: with the name
+// if only one matches, and otherwise with their common prefix, listing them
+// if there is nothing to add.
+func (e *lineEditor) completeLine(line []rune, pos int) ([]rune, int) {
+	word := string(line[:pos])
+	if strings.ContainsAny(word, " \t") || e.complete == nil {
+		return line, pos // Only the command name is completed
+	}
+	names := e.complete(word)
+	if len(names) == 0 {
+		return line, pos
+	}
+	completion := names[0]
+	for _, name := range names[1:] {
+		for !strings.HasPrefix(name, completion) {
+			completion = completion[:len(completion)-1]
+		}
+	}
+	if len(names) == 1 {
+		completion += " "
+	}
+	if len(completion) == len(word) {
+		fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(names, "  "))
+		return line, pos
+	}
+	rest := line[pos:]
+	line = append([]rune(completion), rest...)
+	return line, utf8.RuneCountInString(completion)
+}
+
+// addHistory adds a line to the history, unless it is empty or repeats the
+// last one.
+func (e *lineEditor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" || len(e.history) > 0 && e.history[len(e.history)-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+}
+
+// loadHistory reads the history file, if any.
+func (e *lineEditor) loadHistory() {
+	data, err := os.ReadFile(e.historyPath)
+	if err != nil {
+		return
+	}
+	for line := range strings.Lines(string(data)) {
+		e.addHistory(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+// saveHistory writes the history file, readable by the user only since
+// lines may hold values.
+func (e *lineEditor) saveHistory() {
+	if e.historyPath == "" {
+		return
+	}
+	var b strings.Builder
+	for _, line := range e.history {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	if err := os.WriteFile(e.historyPath, []byte(b.String()), 0o600); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to save the history: %v\n", err)
+	}
+}
@@ -0,0 +1,165 @@
+// Package main implements mini-redis-cli, a command-line client for a
+// mini-redis server, like redis-cli: it runs one command given as arguments,
+// or reads commands at an interactive prompt with line editing, history, and
+// completion of command names. It talks to the HTTP API with the client
+// package.
+//
+// Usage:
+//
+//	mini-redis-cli [-addr host:port] [-token token] [-json] [-timeout d] [command [arg...]]
+//
+// The exit status is 0 on success, 1 if a command failed, and 2 for invalid
+// usage. In interactive mode, it is that of the last command.
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"mini-redis/client"
+)
+
+// historyFile is the file of the interactive history, in the home directory.
+const historyFile = ".mini_redis_cli_history"
+
+// maxHistory is the number of lines of history kept.
+const maxHistory = 1000
+
+// cli holds the settings and connection of a session.
+type cli struct {
+	client  *client.Client
+	json    bool          // Print results as JSON instead of text
+	timeout time.Duration // Timeout of each command
+	out     io.Writer
+}
+
+// main parses the flags, then runs the command of the arguments or the
+// interactive prompt.
+func main() {
+	var c cli
+	addr := flag.String("addr", "localhost:8080", "Server address: host:port, a base URL, or unix:// and a socket path")
+	token := flag.String("token", os.Getenv("MINIREDIS_TOKEN"), "API token (env MINIREDIS_TOKEN)")
+	flag.BoolVar(&c.json, "json", false, "Print results as JSON, for scripts")
+	flag.DurationVar(&c.timeout, "timeout", client.DefaultTimeout, "Timeout of each command")
+	flag.Usage = usage
+	flag.Parse()
+
+	c.client = client.New(*addr, client.WithToken(*token), client.WithTimeout(c.timeout))
+	c.out = os.Stdout
+
+	if flag.NArg() > 0 {
+		os.Exit(c.run(flag.Args()))
+	}
+	os.Exit(c.repl(*addr))
+}
+
+// usage prints the flags and commands.
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: mini-redis-cli [flags] [command [arg...]]\n\nFlags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	printCommands(os.Stderr)
+}
+
+// run runs a command and prints its result or error. It returns the exit
+// status: 0 on success, 1 if the command failed, and 2 for invalid usage.
+func (c *cli) run(args []string) int {
+	if strings.EqualFold(args[0], "help") {
+		printCommands(c.out)
+		return 0
+	}
+	cmd, ok := lookupCommand(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "(error) unknown command %q, see help\n", args[0])
+		return 2
+	}
+	if len(args)-1 < cmd.minArgs || cmd.maxArgs >= 0 && len(args)-1 > cmd.maxArgs {
+		fmt.Fprintf(os.Stderr, "(error) wrong number of arguments, usage: %s %s\n", cmd.name, cmd.args)
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	result, err := cmd.run(ctx, c, args[1:])
+	var usageErr *usageError
+	switch {
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(os.Stderr, "(error) %v, usage: %s %s\n", err, cmd.name, cmd.args)
+		return 2
+	case err != nil:
+		printError(os.Stderr, err)
+		return 1
+	}
+	if c.json {
+		printJSON(c.out, result)
+	} else {
+		printResult(c.out, result)
+	}
+	return 0
+}
+
+// repl reads commands at a prompt until EOF, quit, or exit, and returns the
+// exit status of the last one. On a terminal, lines are edited with the
+// keys of readline and kept in the history file; otherwise, they are read
+// as they come, without a prompt.
+func (c *cli) repl(addr string) int {
+	status := 0
+	var readLine func() (string, error)
+	if isTerminal(os.Stdin) {
+		ed := &lineEditor{in: os.Stdin, out: os.Stdout, complete: completeCommand}
+		home, err := os.UserHomeDir()
+		if err == nil {
+			ed.historyPath = filepath.Join(home, historyFile)
+			ed.loadHistory()
+		}
+		prompt := addr + "> "
+		readLine = func() (string, error) { return ed.readLine(prompt) }
+		defer ed.saveHistory()
+	} else {
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(nil, 64<<20)
+		readLine = func() (string, error) {
+			if !scanner.Scan() {
+				return "", cmp.Or(scanner.Err(), io.EOF)
+			}
+			return scanner.Text(), nil
+		}
+	}
+
+	for {
+		line, err := readLine()
+		if err == errInterrupted {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				return 1
+			}
+			return status
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "(error) %v\n", err)
+			status = 2
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		switch strings.ToLower(args[0]) {
+		case "quit", "exit":
+			return status
+		}
+		status = c.run(args)
+	}
+}
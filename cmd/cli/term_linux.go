@@ -0,0 +1,9 @@
+package main
+
+import "syscall"
+
+// Requests of ioctlTermios.
+const (
+	ioctlGetTermios = syscall.TCGETS
+	ioctlSetTermios = syscall.TCSETS
+)
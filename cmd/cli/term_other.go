@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// isTerminal reports false: without line editing on this system, lines are
+// read as they come, without a prompt.
+func isTerminal(f *os.File) bool {
+	return false
+}
+
+// makeRaw isn't supported on this system.
+func makeRaw(f *os.File) (restore func(), err error) {
+	return nil, errors.New("raw terminal mode not supported")
+}
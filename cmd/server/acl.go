@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// Access control lists.
+//
+// -acl-file (or security.acl_file) loads users from a YAML or JSON file,
+// each with the operations it may run and, optionally, the keys it may
+// touch:
+//
+//	users:
+//	  - name: dashboard
+//	    token: change-me         # Optional bearer token of the user
+//	    allow: [read]            # Operations or categories
+//	    keys: ["stats:*"]        # Key patterns (default: every key)
+//
+// A user is the principal of a request (see requestPrincipal): the user of
+// the token, or the API token, HMAC key, or client certificate of the same
+// name. With an ACL, every request but the health check and /acl/whoami is
+// checked before its handler runs, and every command of a pipeline before
+// it runs: principals without a user, operations not allowed, and keys
+// matching none of the patterns get 403 with the rule that failed. The
+// admin token is allowed everything. Denials are logged with the principal;
+// allowed requests too, at the debug level. SIGHUP reloads the file; if it
+// is invalid, the current ACL stays in effect.
+
+// aclOperations are the operations of an ACL, and the categories grouping
+// them. The commands are those of /pipeline.
+var aclOperations = map[string][]string{
+	"get":    nil, // Read a key
+	"exists": nil, // Whether a key exists
+	"ttl":    nil, // Read the TTL of a key
+	"set":    nil, // Store a key
+	"del":    nil, // Delete a key
+	"incr":   nil, // Increment a key
+	"expire": nil, // Change the TTL of a key
+	"info":   nil, // /info, /stats, /metrics, /cluster/slots, GET /config
+	"admin":  nil, // Admin endpoints, persistence, and runtime configuration
+	"read":   {"get", "exists", "ttl", "info"},
+	"write":  {"set", "del", "incr", "expire"},
+	"all":    {"get", "exists", "ttl", "set", "del", "incr", "expire", "info", "admin"},
+}
+
+// keyOperations are the operations checked against the key patterns.
+var keyOperations = []string{"get", "exists", "ttl", "set", "del", "incr", "expire"}
+
+// routeOperations are the operations of the endpoints, by method and route
+// pattern. Endpoints missing here need "admin"; "" needs nothing.
+var routeOperations = map[string]string{
+	"GET /{$}":              "", // Health check
+	"GET /healthz":          "",
+	"GET /readyz":           "",
+	"GET /get":              "get",
+	"HEAD /get":             "exists",
+	"POST /set":             "set",
+	"POST /del":             "del",
+	"POST /pipeline":        "", // Every command is checked by execute
+	"GET /ws":               "", // Every request is checked by wsSession.run
+	"GET /keys/{key...}":    "get",
+	"HEAD /keys/{key...}":   "exists",
+	"PUT /keys/{key...}":    "set",
+	"DELETE /keys/{key...}": "del",
+	"GET /scan":             "", // Checked by scanHandler, on the prefix
+	"GET /memory/usage":     "get",
+	"GET /info":             "info",
+	"GET /stats":            "info",
+	"GET /metrics":          "info",
+	"GET /cluster/slots":    "info",
+	"GET /config":           "info",
+	"POST /config":          "admin",
+	"GET /acl/whoami":       "",
+}
+
+// aclFile is the content of an ACL file.
+type aclFile struct {
+	Users []aclUserSpec `json:"users"`
+}
+
+// aclUserSpec is a user of an ACL file.
+type aclUserSpec struct {
+	Name  string   `json:"name"`
+	Token string   `json:"token,omitempty"`
+	Allow []string `json:"allow"`
+	Keys  []string `json:"keys,omitempty"`
+}
+
+// aclUser is a user of the ACL in effect.
+type aclUser struct {
+	name      string
+	tokenHash []byte          // SHA-256 of the token (nil = none)
+	ops       map[string]bool // Operations allowed, categories expanded
+	keys      []string        // Key patterns (nil = any key)
+}
+
+// acl holds the users of the ACL in effect.
+type acl struct {
+	users  map[string]*aclUser
+	tokens int // Number of users with a token
+}
+
+var (
+	aclFilePath string              // -acl-file ("" = no ACL)
+	currentACL  atomic.Pointer[acl] // nil without an ACL
+)
+
+// loadACLFile reads and validates an ACL file.
+func loadACLFile(path string) (*acl, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) != ".json" && !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		doc, err := parseYAML(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+	var file aclFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid ACL: %w", err)
+	}
+
+	a := &acl{users: make(map[string]*aclUser)}
+	tokens := make(map[string]string)
+	for i, spec := range file.Users {
+		if spec.Name == "" || spec.Name == adminPrincipal {
+			return nil, fmt.Errorf("users[%d]: missing or reserved name %q", i, spec.Name)
+		}
+		if a.users[spec.Name] != nil {
+			return nil, fmt.Errorf("users[%d]: duplicate user %q", i, spec.Name)
+		}
+		user := &aclUser{name: spec.Name, ops: make(map[string]bool), keys: spec.Keys}
+		if spec.Token != "" {
+			if other, ok := tokens[spec.Token]; ok {
+				return nil, fmt.Errorf("users[%d]: user %q has the token of %q", i, spec.Name, other)
+			}
+			tokens[spec.Token] = spec.Name
+			a.tokens++
+			hash := sha256.Sum256([]byte(spec.Token))
+			user.tokenHash = hash[:]
+		}
+		for _, op := range spec.Allow {
+			ops, ok := aclOperations[op]
+			if !ok {
+				return nil, fmt.Errorf("users[%d]: unknown operation %q (must be one of %s)", i, op, strings.Join(slices.Sorted(maps.Keys(aclOperations)), ", "))
+			}
+			user.ops[op] = true
+			for _, o := range ops {
+				user.ops[o] = true
+			}
+		}
+		for _, pattern := range spec.Keys {
+			if pattern == "" || strings.Contains(strings.TrimSuffix(pattern, "*"), "*") {
+				return nil, fmt.Errorf("users[%d]: invalid key pattern %q (a key, or a prefix followed by *)", i, pattern)
+			}
+		}
+		a.users[spec.Name] = user
+	}
+	return a, nil
+}
+
+// reloadACL reads the ACL file again on SIGHUP.
+func reloadACL() {
+	if aclFilePath == "" {
+		return
+	}
+	a, err := loadACLFile(aclFilePath)
+	if err != nil {
+		slog.Error("ACL reload failed, keeping the current ACL", "path", aclFilePath, "err", err)
+		return
+	}
+	currentACL.Store(a)
+	slog.Info("ACL reloaded", "path", aclFilePath, "users", len(a.users))
+}
+
+// aclTokens returns the number of ACL users with a token.
+func aclTokens() int {
+	if a := currentACL.Load(); a != nil {
+		return a.tokens
+	}
+	return 0
+}
+
+// userForToken returns the name of the ACL user with the token whose hash
+// is hash ("" = none). Every token is compared, in constant time.
+func (a *acl) userForToken(hash []byte) string {
+	name := ""
+	for _, u := range a.users {
+		if u.tokenHash != nil && subtle.ConstantTimeCompare(hash, u.tokenHash) == 1 {
+			name = u.name
+		}
+	}
+	return name
+}
+
+// allows reports whether the user may run op on key ("" = no key), or
+// returns the rule that failed.
+func (u *aclUser) allows(op, key string) (bool, string) {
+	if !u.ops[op] {
+		return false, fmt.Sprintf("operation %q is not allowed", op)
+	}
+	if key == "" || u.keys == nil || !slices.Contains(keyOperations, op) {
+		return true, ""
+	}
+	for _, pattern := range u.keys {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(key, prefix) || key == pattern {
+			return true, ""
+		}
+	}
+	return false, fmt.Sprintf("key %q matches none of %s", key, strings.Join(u.keys, ", "))
+}
+
+// checkACL returns nil if the principal of r may run op on key, or the
+// error of a denial.
+func checkACL(r *http.Request, op, key string) *APIError {
+	a := currentACL.Load()
+	if a == nil || noAuth {
+		return nil
+	}
+	if isAdminRequest(r) {
+		return nil
+	}
+	principal := requestPrincipal(r)
+
+	allowed, rule := false, fmt.Sprintf("principal %q has no ACL user", principal)
+	if principal == "" {
+		rule = "anonymous requests are not allowed"
+	}
+	if u := a.users[principal]; u != nil {
+		allowed, rule = u.allows(op, key)
+	}
+	if !allowed {
+		slog.Warn("ACL denied", "principal", principal, "op", op, "key", key, "rule", rule)
+		return &APIError{Status: http.StatusForbidden, Code: codeForbidden, Message: "Forbidden by ACL: " + rule}
+	}
+	slog.Debug("ACL allowed", "principal", principal, "op", op, "key", key)
+	return nil
+}
+
+// aclAllowsAdmin reports whether the principal of r is an ACL user allowed
+// the admin operation, which requireAdmin accepts like the admin token.
+func aclAllowsAdmin(r *http.Request) bool {
+	a := currentACL.Load()
+	if a == nil || noAuth {
+		return false
+	}
+	u := a.users[requestPrincipal(r)]
+	return u != nil && u.ops["admin"]
+}
+
+// requireACL wraps the handler of a method of a route so the ACL is checked
+// before it runs, with the operation of the route (see routeOperations) and
+// the key of the request.
+func requireACL(method, pattern string, next http.HandlerFunc) http.HandlerFunc {
+	op, ok := routeOperations[method+" "+pattern]
+	if !ok {
+		op = "admin"
+	}
+	if op == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if currentACL.Load() == nil || noAuth {
+			next(w, r)
+			return
+		}
+		key := ""
+		if slices.Contains(keyOperations, op) {
+			var ok bool
+			if key, ok = requestKey(w, r); !ok {
+				return
+			}
+		}
+		if err := checkACL(r, op, key); err != nil {
+			writeError(w, r, err.Status, err.Code, err.Message)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// WhoamiResponse is the JSON response of GET /acl/whoami.
+type WhoamiResponse struct {
+	Principal  string   `json:"principal"`      // Name of the credential or certificate ("" = anonymous)
+	ACL        bool     `json:"acl"`            // Whether an ACL is in effect
+	Operations []string `json:"operations"`     // Operations allowed (categories expanded)
+	Keys       []string `json:"keys,omitempty"` // Key patterns (absent = any key)
+}
+
+// aclWhoamiHandler handles GET requests reporting what the client may do.
+func aclWhoamiHandler(w http.ResponseWriter, r *http.Request) {
+	resp := WhoamiResponse{Principal: requestPrincipal(r), Operations: []string{}}
+	a := currentACL.Load()
+	resp.ACL = a != nil && !noAuth
+	if !resp.ACL || isAdminRequest(r) {
+		resp.Operations = aclOperations["all"]
+	} else if u := a.users[resp.Principal]; u != nil {
+		for _, op := range aclOperations["all"] {
+			if u.ops[op] {
+				resp.Operations = append(resp.Operations, op)
+			}
+		}
+		resp.Keys = u.keys
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
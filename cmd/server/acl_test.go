@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// setACL puts the ACL of a JSON file content in effect for the test.
+func setACL(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "acl.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := loadACLFile(path)
+	if err != nil {
+		t.Fatalf("loadACLFile: %v", err)
+	}
+	prev := currentACL.Swap(a)
+	t.Cleanup(func() { currentACL.Store(prev) })
+}
+
+// certRequest returns a request from a client certificate with the common
+// name cn.
+func certRequest(method, target, cn string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, &clientIdentity{CommonName: cn}))
+}
+
+// tokenRequest returns a request authenticated with the API token name.
+func tokenRequest(method, target, name string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	return r.WithContext(context.WithValue(r.Context(), tokenNameKey{}, name))
+}
+
+// whoami returns the response of GET /acl/whoami to r.
+func whoami(t *testing.T, r *http.Request) WhoamiResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	aclWhoamiHandler(w, r)
+	var resp WhoamiResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid whoami response %q: %v", w.Body, err)
+	}
+	return resp
+}
+
+// TestCertNamedAdminIsNotAdmin checks that a client certificate named like
+// the admin token gets none of its rights: only the token grants them.
+func TestCertNamedAdminIsNotAdmin(t *testing.T) {
+	setACL(t, `{"users": [{"name": "reader", "allow": ["read"]}]}`)
+	prevToken := adminToken
+	adminToken = "admin-secret"
+	t.Cleanup(func() { adminToken = prevToken })
+
+	cert := certRequest(http.MethodPost, "/set", adminPrincipal)
+	if p := requestPrincipal(cert); p != certAdminPrincipal {
+		t.Errorf("principal = %q, want %q", p, certAdminPrincipal)
+	}
+	if err := checkACL(cert, "set", "k"); err == nil || err.Status != http.StatusForbidden {
+		t.Errorf("checkACL of the certificate = %v, want 403", err)
+	}
+	if resp := whoami(t, cert); resp.Principal != certAdminPrincipal || len(resp.Operations) != 0 {
+		t.Errorf("whoami of the certificate = %+v, want %q without operations", resp, certAdminPrincipal)
+	}
+	called := false
+	w := httptest.NewRecorder()
+	requireAdmin(func(http.ResponseWriter, *http.Request) { called = true })(w, certRequest(http.MethodPost, "/admin/reload", adminPrincipal))
+	if called || w.Code != http.StatusUnauthorized {
+		t.Errorf("admin endpoint with the certificate: status %d, handler called %v, want 401", w.Code, called)
+	}
+
+	token := tokenRequest(http.MethodPost, "/set", adminPrincipal)
+	if err := checkACL(token, "set", "k"); err != nil {
+		t.Errorf("checkACL of the admin token = %v, want nil", err)
+	}
+	if resp := whoami(t, token); !slices.Equal(resp.Operations, aclOperations["all"]) {
+		t.Errorf("whoami of the admin token: operations %v, want all", resp.Operations)
+	}
+}
+
+// TestCertAdminUser checks that an ACL user named cert:admin applies to a
+// certificate named admin, with its own rights only.
+func TestCertAdminUser(t *testing.T) {
+	setACL(t, `{"users": [{"name": "cert:admin", "allow": ["get"]}]}`)
+
+	if err := checkACL(certRequest(http.MethodGet, "/get", adminPrincipal), "get", "k"); err != nil {
+		t.Errorf("checkACL of get = %v, want nil", err)
+	}
+	if err := checkACL(certRequest(http.MethodPost, "/set", adminPrincipal), "set", "k"); err == nil {
+		t.Error("checkACL of set = nil, want 403")
+	}
+	if resp := whoami(t, certRequest(http.MethodGet, "/acl/whoami", adminPrincipal)); !slices.Equal(resp.Operations, []string{"get"}) {
+		t.Errorf("whoami: operations %v, want [get]", resp.Operations)
+	}
+}
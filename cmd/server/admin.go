@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// adminToken is the bearer token required by admin endpoints, which are
+// destructive or expose the whole dataset (ADMIN_TOKEN environment variable).
+// If empty, admin endpoints are disabled.
+var adminToken string
+
+// requireAdmin wraps an admin handler so it is only reachable with
+// "Authorization: Bearer <ADMIN_TOKEN>". Without a configured token the
+// endpoint is disabled and returns 403 Forbidden, as it does for requests
+// authenticated with an API token (see auth.go), unless an ACL allows the
+// client admin operations (see acl.go).
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if aclAllowsAdmin(r) {
+			next(w, r)
+			return
+		}
+		if adminToken == "" {
+			writeError(w, r, http.StatusForbidden, codeAdminDisabled, "Admin endpoints are disabled (set ADMIN_TOKEN to enable them)")
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			if name := requestTokenName(r); name != "" {
+				// Authenticated, but not as admin
+				writeError(w, r, http.StatusForbidden, codeForbidden, fmt.Sprintf("API token %q can't use admin endpoints", name))
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mini-redis admin"`)
+			writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// API tokens.
+//
+// With API tokens configured (MINIREDIS_API_TOKENS or security.api_tokens,
+// "name:token" each), every request needs "Authorization: Bearer <token>"
+// with one of them, or with the admin token, except for the health check,
+// which load balancers probe without credentials. Other requests get 401.
+// The name of the token is added to the request context, where
+// requestPrincipal finds it for logs and access rules; the admin token is
+// named "admin". -no-auth turns the checks off, for local development.
+//
+// Clients can also sign requests with an HMAC key instead, see hmac.go, or
+// use the token of an ACL user, see acl.go.
+//
+// Tokens are compared in constant time, as SHA-256 hashes so that their
+// lengths don't leak either, and every token is compared, so the time
+// doesn't tell which one nearly matched.
+
+// apiToken is a named API token.
+type apiToken struct {
+	name string
+	hash [sha256.Size]byte // SHA-256 of the token
+}
+
+// adminPrincipal is the name of the admin token.
+const adminPrincipal = "admin"
+
+// apiTokens are the API tokens accepted (empty = no authentication).
+var apiTokens []apiToken
+
+// noAuth disables API token authentication (-no-auth).
+var noAuth bool
+
+// publicPaths are the paths served without authentication.
+var publicPaths = map[string]bool{
+	"/":                      true, // Health checks
+	"/healthz":               true,
+	"/readyz":                true,
+	apiV1Prefix + "/":        true,
+	apiV1Prefix + "/healthz": true,
+	apiV1Prefix + "/readyz":  true,
+	"/ws":                    true, // Authenticated by the handshake or an auth message, see wsapi.go
+}
+
+// parseAPITokens parses "name:token" API tokens.
+func parseAPITokens(specs []string) ([]apiToken, error) {
+	tokens := make([]apiToken, 0, len(specs))
+	seen := make(map[string]bool)
+	for i, spec := range specs {
+		name, token, ok := strings.Cut(spec, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || token == "" {
+			return nil, fmt.Errorf("API token %d must be \"name:token\"", i+1)
+		}
+		if name == adminPrincipal || seen[name] {
+			return nil, fmt.Errorf("API token name %q is reserved or used twice", name)
+		}
+		seen[name] = true
+		tokens = append(tokens, apiToken{name: name, hash: sha256.Sum256([]byte(token))})
+	}
+	return tokens, nil
+}
+
+// authenticate returns the name of the token of r ("" if it has none or an
+// unknown one).
+func authenticate(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(token))
+	name := ""
+	if adminToken != "" {
+		adminHash := sha256.Sum256([]byte(adminToken))
+		if subtle.ConstantTimeCompare(hash[:], adminHash[:]) == 1 {
+			name = adminPrincipal
+		}
+	}
+	for _, t := range apiTokens {
+		if subtle.ConstantTimeCompare(hash[:], t.hash[:]) == 1 {
+			name = t.name
+		}
+	}
+	if a := currentACL.Load(); a != nil {
+		if user := a.userForToken(hash[:]); user != "" {
+			name = user
+		}
+	}
+	return name
+}
+
+// tokenNameKey is the context key of the name of the request's token or
+// HMAC key.
+type tokenNameKey struct{}
+
+// requireAuth wraps the router so requests need an API token, a signature
+// (see hmac.go), or the token of an ACL user.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authRequired() || publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r, err := authenticateRequest(w, r)
+		if err != nil {
+			writeError(w, r, err.Status, err.Code, err.Message)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authRequired reports whether requests need credentials.
+func authRequired() bool {
+	return !noAuth && len(apiTokens)+len(hmacKeys)+aclTokens() > 0
+}
+
+// authenticateRequest returns r with the name of its API token or HMAC key
+// in its context, or the error of missing or invalid credentials.
+func authenticateRequest(w http.ResponseWriter, r *http.Request) (*http.Request, *APIError) {
+	var name string
+	if r.Header.Get(signatureHeader) != "" && len(hmacKeys) > 0 {
+		var err *APIError
+		if name, err = verifySignedRequest(w, r); err != nil {
+			return r, err
+		}
+	} else if name = authenticate(r); name == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mini-redis"`)
+		return r, &APIError{Status: http.StatusUnauthorized, Code: codeUnauthorized, Message: "Unauthorized (missing or invalid API token)"}
+	}
+	return r.WithContext(context.WithValue(r.Context(), tokenNameKey{}, name)), nil
+}
+
+// requestTokenName returns the name of the API token or HMAC key r was
+// authenticated with ("" = none).
+func requestTokenName(r *http.Request) string {
+	name, _ := r.Context().Value(tokenNameKey{}).(string)
+	return name
+}
+
+// isAdminRequest reports whether r was authenticated with the admin token,
+// the only credential that grants admin rights.
+func isAdminRequest(r *http.Request) bool {
+	return requestTokenName(r) == adminPrincipal
+}
+
+// certAdminPrincipal is the principal of a client certificate named like
+// the admin token, so it can't pass for it.
+const certAdminPrincipal = "cert:" + adminPrincipal
+
+// requestPrincipal returns who sent r: the name of its API token, or the
+// identity of its client certificate ("" = anonymous).
+func requestPrincipal(r *http.Request) string {
+	if name := requestTokenName(r); name != "" {
+		return name
+	}
+	if id := requestIdentity(r); id != nil {
+		if name := id.Principal(); name != adminPrincipal {
+			return name
+		}
+		return certAdminPrincipal
+	}
+	return ""
+}
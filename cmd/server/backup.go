@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// backupHandler handles GET requests streaming a point-in-time snapshot of
+// the dataset, in the configured snapshot format and compression, so the
+// response can be saved and later loaded or uploaded to /restore.
+// The ETag is the snapshot checksum, so If-None-Match skips unchanged data.
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	backup := cacheInstance.NewBackup()
+	etag := `"` + backup.Checksum() + `"`
+	timestamp := backup.Timestamp().UTC()
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", timestamp.Format(http.TimeFormat))
+	w.Header().Set("X-Snapshot-Timestamp", timestamp.Format(time.RFC3339Nano))
+	w.Header().Set("X-Snapshot-Entries", strconv.Itoa(backup.Entries()))
+	w.Header().Set("X-Snapshot-Format", backup.Format().String())
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", backupContentType(backup))
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="dump-%s.rdb"`, timestamp.Format("20060102T150405Z")))
+
+	// Headers are sent with the first write; a failure after that can only be logged
+	if _, err := backup.WriteTo(w); err != nil {
+		slog.Error("Backup failed", "client", r.RemoteAddr, "err", err)
+	}
+}
+
+// backupContentType returns the media type of a backup's encoding.
+func backupContentType(backup *cache.Backup) string {
+	switch {
+	case backup.Compressed():
+		return "application/gzip"
+	case backup.Format() == cache.SnapshotFormatJSON:
+		return "application/json"
+	default:
+		return "application/octet-stream"
+	}
+}
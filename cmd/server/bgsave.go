@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// BGSaveResponse represents the JSON response of POST /bgsave
+type BGSaveResponse struct {
+	JobID uint64 `json:"job_id"` // ID of the snapshot job, reported by /bgsave/status
+}
+
+// BGSaveStatusResponse represents the JSON response of GET /bgsave/status
+type BGSaveStatusResponse struct {
+	InProgress     bool   `json:"in_progress"`                 // Whether a snapshot is being saved
+	CurrentJobID   uint64 `json:"current_job_id,omitempty"`    // ID of the running snapshot
+	LastJobID      uint64 `json:"last_job_id,omitempty"`       // ID of the last finished snapshot
+	LastTrigger    string `json:"last_trigger,omitempty"`      // "scheduled" or "manual"
+	LastStatus     string `json:"last_status"`                 // "ok", "err", or "none"
+	LastError      string `json:"last_error,omitempty"`        // Error of the last snapshot, if it failed
+	LastTime       string `json:"last_time,omitempty"`         // When the last snapshot finished (RFC 3339)
+	LastDurationMS int64  `json:"last_duration_ms"`            // How long the last snapshot took
+	LastSuccess    string `json:"last_success_time,omitempty"` // When the last successful snapshot finished (RFC 3339)
+}
+
+// bgSaveHandler handles POST requests to start a snapshot in the background.
+// Returns the job ID, or 409 Conflict if a snapshot is already in progress.
+func bgSaveHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := snapshotManager.BackgroundSave()
+	if err != nil {
+		if errors.Is(err, cache.ErrSnapshotInProgress) {
+			writeError(w, r, http.StatusConflict, codeInProgress, "Snapshot already in progress")
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Failed to start snapshot: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(BGSaveResponse{JobID: job})
+}
+
+// bgSaveStatusHandler handles GET requests reporting the current and last snapshot.
+func bgSaveStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status := snapshotManager.Status()
+	resp := BGSaveStatusResponse{
+		InProgress:     status.InProgress,
+		CurrentJobID:   status.CurrentJob,
+		LastJobID:      status.LastJob,
+		LastTrigger:    status.LastTrigger,
+		LastStatus:     orNone(status.LastStatus),
+		LastError:      status.LastError,
+		LastDurationMS: status.LastDuration.Milliseconds(),
+	}
+	if !status.LastTime.IsZero() {
+		resp.LastTime = status.LastTime.Format(time.RFC3339)
+	}
+	if !status.LastSuccess.IsZero() {
+		resp.LastSuccess = status.LastSuccess.Format(time.RFC3339)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Request body limits.
+//
+// Every request body is read through limitBody, so a client can't make the
+// server buffer more than a limit: JSON bodies (/set, /del, /pipeline, and
+// the admin endpoints) are limited by -max-body-bytes, raw values of PUT
+// /keys/{key} by -max-value-bytes (see readValue), and snapshots uploaded to
+// /restore by -restore-max-bytes. Larger bodies are answered with 413 and
+// the connection is closed after the response, instead of reading the rest.
+
+// defaultMaxBodyBytes is the default limit for JSON request bodies. JSON
+// bodies are decoded in memory, so the limit stays small: larger values are
+// stored with PUT /keys/{key}, up to -max-value-bytes, or need a higher
+// -max-body-bytes.
+const defaultMaxBodyBytes = 8 << 20
+
+// maxBodyBytes is the largest JSON request body accepted (-max-body-bytes).
+var maxBodyBytes int64 = defaultMaxBodyBytes
+
+// limitBody returns the body of r limited to limit bytes: reading past the
+// limit fails with an *http.MaxBytesError, which is returned right away,
+// before reading anything, if the Content-Length already exceeds it.
+func limitBody(w http.ResponseWriter, r *http.Request, limit int64) (io.ReadCloser, error) {
+	if r.ContentLength > limit {
+		return nil, &http.MaxBytesError{Limit: limit}
+	}
+	return http.MaxBytesReader(w, r.Body, limit), nil
+}
+
+// bodyTooLargeError is the error of a JSON body larger than -max-body-bytes.
+func bodyTooLargeError() *APIError {
+	return &APIError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    codeBodyTooLarge,
+		Message: fmt.Sprintf("Request body too large (limit %d bytes, see -max-body-bytes)", maxBodyBytes),
+	}
+}
+
+// writeJSONBodyError answers a JSON body that couldn't be read or decoded:
+// 413 if it is larger than -max-body-bytes, and 400 invalid_json otherwise.
+func writeJSONBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	e := jsonBodyError(err)
+	writeError(w, r, e.Status, e.Code, e.Message)
+}
+
+// jsonBodyError returns the error answered by writeJSONBodyError.
+func jsonBodyError(err error) *APIError {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return bodyTooLargeError()
+	}
+	return &APIError{Status: http.StatusBadRequest, Code: codeInvalidJSON, Message: "Invalid JSON"}
+}
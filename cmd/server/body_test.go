@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setMaxBodyBytes changes -max-body-bytes for the test.
+func setMaxBodyBytes(t *testing.T, limit int64) {
+	prev := maxBodyBytes
+	maxBodyBytes = limit
+	t.Cleanup(func() { maxBodyBytes = prev })
+}
+
+// TestJSONBodyLimit checks that JSON bodies over -max-body-bytes are
+// answered with 413 body_too_large on every JSON endpoint, with or without
+// a Content-Length, and that the client can go on afterwards.
+func TestJSONBodyLimit(t *testing.T) {
+	srv := newTestServer(t)
+	setMaxBodyBytes(t, 1024)
+	large := `{"key":"k","value":"` + strings.Repeat("x", 4096) + `"}`
+	bodies := map[string]string{
+		"/v1/set":      large,
+		"/v1/del":      large,
+		"/v1/pipeline": `[{"cmd":"set",` + large[1:] + `]`,
+	}
+
+	for path, large := range bodies {
+		for _, chunked := range []bool{false, true} {
+			req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(large))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chunked {
+				req.Body = io.NopCloser(struct{ io.Reader }{strings.NewReader(large)})
+				req.ContentLength = -1
+			}
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatalf("POST %s: %v", path, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusRequestEntityTooLarge || errorCode(t, body) != codeBodyTooLarge {
+				t.Errorf("POST %s (chunked %v) = %d %s, want 413 %s", path, chunked, resp.StatusCode, body, codeBodyTooLarge)
+			}
+			if !strings.Contains(string(body), "limit 1024 bytes") {
+				t.Errorf("error %s doesn't name the limit", body)
+			}
+
+			// The same client goes on with the next request
+			resp, body = doRequest(t, srv, http.MethodPost, "/v1/set", `{"key":"k","value":"small"}`, nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("set after a 413 = %d %s, want 200", resp.StatusCode, body)
+			}
+		}
+	}
+}
+
+// TestBodyLimitConnection checks on a raw connection that a rejected body
+// gets a complete 413 response, after which the connection either serves
+// the next request or is closed, but never hangs or answers garbage.
+func TestBodyLimitConnection(t *testing.T) {
+	srv := newTestServer(t)
+	setMaxBodyBytes(t, 1024)
+
+	for _, size := range []int{2048, 4 << 20} {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := `{"key":"k","value":"` + strings.Repeat("x", size) + `"}`
+		fmt.Fprintf(conn, "POST /v1/set HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n", len(body))
+		go io.WriteString(conn, body) // The server may stop reading it
+
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("reading the 413 response (%d bytes): %v", size, err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusRequestEntityTooLarge || errorCode(t, data) != codeBodyTooLarge {
+			t.Fatalf("response (%d bytes) = %d %s, %v; want a complete 413", size, resp.StatusCode, data, err)
+		}
+		if !resp.Close {
+			// The server read the rest of the body: the connection must still work
+			fmt.Fprint(conn, "GET /v1/get?key=nope HTTP/1.1\r\nHost: test\r\n\r\n")
+			resp, err := http.ReadResponse(r, nil)
+			if err != nil || resp.StatusCode != http.StatusNotFound {
+				t.Errorf("next request on the connection after a 413 (%d bytes) = %v, %v; want 404", size, resp, err)
+			}
+		}
+		conn.Close()
+	}
+
+	// New connections are served as usual
+	resp, body := doRequest(t, srv, http.MethodPost, "/v1/set", `{"key":"k","value":"v"}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("set after the rejected bodies = %d %s", resp.StatusCode, body)
+	}
+}
+
+// TestMaxBodyBytesFromConfigFile checks that max_body_bytes in a config file
+// sets -max-body-bytes.
+func TestMaxBodyBytesFromConfigFile(t *testing.T) {
+	setMaxBodyBytes(t, defaultMaxBodyBytes)
+	if flag.Lookup("max-body-bytes") == nil {
+		flag.Int64Var(&maxBodyBytes, "max-body-bytes", defaultMaxBodyBytes, "")
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("server:\n  max_body_bytes: 2048\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatalf("loadConfigFile: %v", err)
+	}
+	if err := applyConfigFile(cfg); err != nil {
+		t.Fatalf("applyConfigFile: %v", err)
+	}
+	if maxBodyBytes != 2048 {
+		t.Errorf("maxBodyBytes = %d, want 2048", maxBodyBytes)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connected clients.
+//
+// Every connection accepted by the API listener is a client, like in Redis
+// CLIENT LIST: clientListener wraps it in a clientConn, which counts the
+// bytes read and written, and the server hooks attach it to the context of
+// its requests (ConnContext) and track its state (ConnState). A request
+// updates the last command, command count, and principal of its client, and
+// a long transfer marks it as streaming while it runs. GET /clients lists
+// the clients, and POST /clients/kill closes the connection of one.
+//
+// The counters are atomic, so the bookkeeping of a request is a few atomic
+// operations, and the registry is only locked when a connection opens or
+// closes. A client is removed when its connection is closed, by the server,
+// the handler that hijacked it, or a kill, and when the server sees it
+// closed (ConnState), so connections reset by the peer don't linger.
+
+// clientConn is a connection of a client, see above.
+type clientConn struct {
+	net.Conn
+	id          uint64
+	addr        string
+	connectedAt time.Time
+
+	state       atomic.Pointer[string] // State of the connection: "new", "active", "idle", or "hijacked"
+	principal   atomic.Pointer[string] // Principal of the last request ("" = anonymous)
+	lastCommand atomic.Pointer[string] // Method and path of the last request
+	lastActive  atomic.Int64           // Start of the last request (Unix nanoseconds)
+	commands    atomic.Int64           // Requests started
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+	streams     atomic.Int32           // Long transfers running (see longLived)
+	protocol    atomic.Pointer[string] // Protocol of the first request, see protocols.go
+
+	once sync.Once
+}
+
+// clients are the clients connected, by ID.
+var clients = struct {
+	sync.Mutex
+	m      map[uint64]*clientConn
+	nextID uint64
+}{m: make(map[uint64]*clientConn)}
+
+// Connection states reported in ClientInfo.
+var (
+	clientStateNew      = "new"
+	clientStateActive   = "active"
+	clientStateIdle     = "idle"
+	clientStateHijacked = "hijacked"
+)
+
+// clientListener registers the connections it accepts as clients.
+type clientListener struct {
+	net.Listener
+}
+
+// Accept accepts a connection and registers it.
+func (l clientListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	cc := &clientConn{Conn: c, addr: c.RemoteAddr().String(), connectedAt: time.Now()}
+	cc.state.Store(&clientStateNew)
+	clients.Lock()
+	clients.nextID++
+	cc.id = clients.nextID
+	clients.m[cc.id] = cc
+	clients.Unlock()
+	return cc, nil
+}
+
+// Read reads from the connection, counting the bytes.
+func (c *clientConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.bytesIn.Add(int64(n))
+	return n, err
+}
+
+// Write writes to the connection, counting the bytes.
+func (c *clientConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// Close closes the connection and removes the client.
+func (c *clientConn) Close() error {
+	c.remove()
+	return c.Conn.Close()
+}
+
+// remove removes the client from the registry, once.
+func (c *clientConn) remove() {
+	c.once.Do(func() {
+		clients.Lock()
+		delete(clients.m, c.id)
+		clients.Unlock()
+	})
+}
+
+// asClientConn returns the clientConn of a connection of the server (nil
+// if it isn't one, e.g. on the -health-addr listener).
+func asClientConn(c net.Conn) *clientConn {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	cc, _ := c.(*clientConn)
+	return cc
+}
+
+// clientKey is the context key of the clientConn of a request.
+type clientKey struct{}
+
+// trackClients sets the server hooks attaching clients to their requests
+// and tracking their state.
+func trackClients(server *http.Server) {
+	server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if cc := asClientConn(c); cc != nil {
+			return context.WithValue(ctx, clientKey{}, cc)
+		}
+		return ctx
+	}
+	server.ConnState = func(c net.Conn, state http.ConnState) {
+		cc := asClientConn(c)
+		if cc == nil {
+			return
+		}
+		switch state {
+		case http.StateActive:
+			cc.state.Store(&clientStateActive)
+		case http.StateIdle:
+			cc.state.Store(&clientStateIdle)
+		case http.StateHijacked:
+			cc.state.Store(&clientStateHijacked)
+		case http.StateClosed:
+			cc.remove()
+		}
+	}
+}
+
+// requestClient returns the client of r (nil if r didn't come through the
+// API listener).
+func requestClient(r *http.Request) *clientConn {
+	cc, _ := r.Context().Value(clientKey{}).(*clientConn)
+	return cc
+}
+
+// withClientStats counts the requests of clients, and records their last
+// command.
+func withClientStats(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc := requestClient(r)
+		countProtocol(r, cc)
+		if cc != nil {
+			command := r.Method + " " + r.URL.Path
+			cc.lastCommand.Store(&command)
+			cc.lastActive.Store(time.Now().UnixNano())
+			cc.commands.Add(1)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withClientPrincipal records the principal of the requests of clients,
+// once they are authenticated.
+func withClientPrincipal(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recordPrincipal(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recordPrincipal records the principal of r as that of its client, if r
+// is authenticated.
+func recordPrincipal(r *http.Request) {
+	if cc := requestClient(r); cc != nil {
+		if principal := requestPrincipal(r); principal != "" {
+			cc.principal.Store(&principal)
+		}
+	}
+}
+
+// ClientInfo describes a client in the response of GET /clients.
+type ClientInfo struct {
+	ID          uint64 `json:"id"`
+	Addr        string `json:"addr"`                   // Address of the peer (a proxy, if any)
+	Principal   string `json:"principal,omitempty"`    // Principal of the last request (absent = anonymous)
+	State       string `json:"state"`                  // "new", "active", "idle", or "hijacked"
+	ConnectedAt string `json:"connected_at"`           // RFC 3339
+	Age         int64  `json:"age"`                    // Seconds since the connection was accepted
+	Idle        int64  `json:"idle"`                   // Seconds since the last request started (or since connected)
+	LastCommand string `json:"last_command,omitempty"` // Method and path of the last request
+	Commands    int64  `json:"commands"`               // Requests started on the connection
+	BytesIn     int64  `json:"bytes_in"`               // Bytes read, TLS included
+	BytesOut    int64  `json:"bytes_out"`              // Bytes written, TLS included
+	Streaming   bool   `json:"streaming"`              // Whether a long transfer is running (replication, /backup, /restore)
+	Protocol    string `json:"protocol,omitempty"`     // "http/1.0", "http/1.1", "h2", "h2c", or "resp" (absent before the first request)
+}
+
+// ClientsResponse represents the JSON response of GET /clients.
+type ClientsResponse struct {
+	Clients []ClientInfo `json:"clients"` // By ID
+}
+
+// info returns the ClientInfo of the client at now.
+func (c *clientConn) info(now time.Time) ClientInfo {
+	info := ClientInfo{
+		ID:          c.id,
+		Addr:        c.addr,
+		State:       *c.state.Load(),
+		ConnectedAt: c.connectedAt.Format(time.RFC3339),
+		Age:         int64(now.Sub(c.connectedAt).Seconds()),
+		Idle:        int64(now.Sub(c.connectedAt).Seconds()),
+		Commands:    c.commands.Load(),
+		BytesIn:     c.bytesIn.Load(),
+		BytesOut:    c.bytesOut.Load(),
+		Streaming:   c.streams.Load() > 0,
+	}
+	if p := c.principal.Load(); p != nil {
+		info.Principal = *p
+	}
+	if p := c.protocol.Load(); p != nil {
+		info.Protocol = *p
+	}
+	if cmd := c.lastCommand.Load(); cmd != nil {
+		info.LastCommand = *cmd
+		info.Idle = int64(now.Sub(time.Unix(0, c.lastActive.Load())).Seconds())
+	}
+	return info
+}
+
+// clientsHandler handles GET requests listing the connected clients.
+func clientsHandler(w http.ResponseWriter, r *http.Request) {
+	clients.Lock()
+	conns := make([]*clientConn, 0, len(clients.m))
+	for _, cc := range clients.m {
+		conns = append(conns, cc)
+	}
+	clients.Unlock()
+
+	slices.SortFunc(conns, func(a, b *clientConn) int { return cmp.Compare(a.id, b.id) })
+	now := time.Now()
+	resp := ClientsResponse{Clients: make([]ClientInfo, len(conns))}
+	for i, cc := range conns {
+		resp.Clients[i] = cc.info(now)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// KillClientRequest represents the JSON payload for POST /clients/kill.
+type KillClientRequest struct {
+	ID uint64 `json:"id"` // ID of the client, from GET /clients
+}
+
+// KillClientResponse represents the JSON response of POST /clients/kill.
+type KillClientResponse struct {
+	Killed ClientInfo `json:"killed"` // The client, just before its connection was closed
+}
+
+// killClientHandler handles POST requests closing the connection of a
+// client. Its requests in progress fail, like after a network error.
+func killClientHandler(w http.ResponseWriter, r *http.Request) {
+	var req KillClientRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeJSONBodyError(w, r, err)
+		return
+	}
+	if req.ID == 0 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, `Missing "id"`)
+		return
+	}
+	clients.Lock()
+	cc := clients.m[req.ID]
+	clients.Unlock()
+	if cc == nil {
+		writeError(w, r, http.StatusNotFound, codeClientNotFound, "No such client")
+		return
+	}
+
+	info := cc.info(time.Now())
+	slog.Info("Client killed", "id", info.ID, "addr", info.Addr, "client_principal", info.Principal, "principal", requestPrincipal(r))
+	if cc == requestClient(r) {
+		// The connection of this request: answer before closing it
+		writeJSON(w, http.StatusOK, KillClientResponse{Killed: info})
+		http.NewResponseController(w).Flush()
+		cc.Close()
+		return
+	}
+	cc.Close()
+	writeJSON(w, http.StatusOK, KillClientResponse{Killed: info})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"mini-redis/internal/cluster"
+)
+
+// Cluster mode (-cluster-slots or -cluster-config with -cluster-node): every
+// key belongs to a hash slot (cluster.KeySlot), and every slot to one node.
+// A node only serves the keys of its own slots and redirects requests for
+// other keys to their owner.
+var (
+	slotMap     *cluster.SlotMap // nil outside cluster mode
+	clusterNode string           // host:port of this node in the slot map
+)
+
+// ClusterSlotsResponse is the JSON response of GET /cluster/slots.
+type ClusterSlotsResponse struct {
+	Node  string              `json:"node"`  // This node
+	Slots []cluster.SlotRange `json:"slots"` // Owner of every slot range
+}
+
+// configureCluster enables cluster mode from the -cluster-slots or
+// -cluster-config flag values. node is this node's address in the slot map.
+func configureCluster(slots, configPath, node string) error {
+	if slots == "" && configPath == "" {
+		if node != "" {
+			return fmt.Errorf("-cluster-node requires -cluster-slots or -cluster-config")
+		}
+		return nil
+	}
+	if slots != "" && configPath != "" {
+		return fmt.Errorf("-cluster-slots and -cluster-config are mutually exclusive")
+	}
+
+	var m *cluster.SlotMap
+	var err error
+	if slots != "" {
+		m, err = cluster.ParseSlotMap(slots)
+	} else {
+		m, err = cluster.LoadSlotMap(configPath)
+	}
+	if err != nil {
+		return err
+	}
+	if node == "" {
+		return fmt.Errorf("cluster mode requires -cluster-node (this node's host:port in the slot map)")
+	}
+	if m.Slots(node) == 0 {
+		return fmt.Errorf("node %s owns no slots in the slot map", node)
+	}
+
+	slotMap, clusterNode = m, node
+	return nil
+}
+
+// requireSlot wraps a key handler so that, in cluster mode, requests for keys
+// of a slot owned by another node are answered with 307 Temporary Redirect to
+// the same path on the owner and the error message "MOVED <slot> <host:port>",
+// like the Redis Cluster MOVED error. The key is found by requestKey.
+func requireSlot(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if slotMap == nil {
+			next(w, r)
+			return
+		}
+
+		key, ok := requestKey(w, r)
+		if !ok {
+			return
+		}
+		if key == "" {
+			next(w, r) // Let the handler report the missing key or invalid JSON
+			return
+		}
+
+		if owner, err := checkSlot(key); err != nil {
+			scheme := "http://"
+			if r.TLS != nil {
+				scheme = "https://" // Nodes share the TLS settings
+			}
+			w.Header().Set("Location", scheme+owner+r.URL.RequestURI())
+			writeError(w, r, err.Status, err.Code, err.Message)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requestKey returns the key of a key request: the path of /keys/{key}, the
+// "key" query parameter or, for POST requests, the "key" field of the JSON
+// body, which is read and replaced with a copy for the handler. It returns
+// "" if there is none or the body is invalid JSON, which the handler
+// reports, and false after answering a body that can't be read.
+func requestKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := r.PathValue("key") // /keys/{key}
+	if key == "" {
+		key = queryValue(r, "key")
+	}
+	if r.Method != http.MethodPost {
+		return key, true
+	}
+
+	limited, err := limitBody(w, r, maxBodyBytes)
+	if err != nil {
+		writeJSONBodyError(w, r, err)
+		return "", false
+	}
+	body, err := io.ReadAll(limited)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeJSONBodyError(w, r, err)
+			return "", false
+		}
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Failed to read request body")
+		return "", false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var req struct {
+		Key string `json:"key"`
+	}
+	if json.Unmarshal(body, &req) != nil {
+		return "", true
+	}
+	return req.Key, true
+}
+
+// checkSlot returns the owner of key and the MOVED error if, in cluster
+// mode, its slot is owned by another node, or a nil error otherwise.
+func checkSlot(key string) (string, *APIError) {
+	if slotMap == nil {
+		return "", nil
+	}
+	slot := cluster.KeySlot(key)
+	owner := slotMap.Owner(slot)
+	if owner == clusterNode {
+		return "", nil
+	}
+	return owner, &APIError{Status: http.StatusTemporaryRedirect, Code: codeMoved, Message: fmt.Sprintf("MOVED %d %s", slot, owner)}
+}
+
+// clusterSlotsHandler handles GET requests describing the cluster topology:
+// the owner of every slot range, like Redis CLUSTER SLOTS. Returns 404
+// outside cluster mode.
+func clusterSlotsHandler(w http.ResponseWriter, r *http.Request) {
+	if slotMap == nil {
+		writeError(w, r, http.StatusNotFound, codeClusterDisabled, "Cluster mode is disabled")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ClusterSlotsResponse{Node: clusterNode, Slots: slotMap.Ranges()})
+}
+
+// writeClusterInfo writes the fields of the cluster section.
+func writeClusterInfo(b *strings.Builder) {
+	if slotMap == nil {
+		b.WriteString("cluster_enabled:0\n")
+		return
+	}
+	b.WriteString("cluster_enabled:1\n")
+	fmt.Fprintf(b, "cluster_node:%s\n", clusterNode)
+	fmt.Fprintf(b, "cluster_slots_owned:%d\n", slotMap.Slots(clusterNode))
+	nodes := make(map[string]bool)
+	for _, r := range slotMap.Ranges() {
+		nodes[r.Node] = true
+	}
+	fmt.Fprintf(b, "cluster_known_nodes:%d\n", len(nodes))
+}
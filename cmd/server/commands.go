@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// Command dispatch.
+//
+// Commands are the operations of POST /pipeline, run directly against the
+// cache rather than through the HTTP handlers. execute applies the checks of
+// the handlers' middleware to every command: the ACL, the key's cluster slot
+// and, for writes, whether this server accepts writes.
+
+// Command is a command of POST /pipeline, e.g. {"cmd": "set", "key": "k",
+// "value": "v", "ttl": 60}. Only the fields the command uses are read.
+type Command struct {
+	Cmd   string  `json:"cmd"`             // Command name: set, get, del, exists, incr, expire, or ttl
+	Key   string  `json:"key"`             // Key of the command
+	Value *string `json:"value,omitempty"` // Value of set
+	TTL   *TTL    `json:"ttl,omitempty"`   // TTL of set and expire, in seconds or as a duration string
+	By    *int64  `json:"by,omitempty"`    // Increment of incr (default 1)
+
+	expireNow bool // Makes expire delete the key, like Redis EXPIRE with a TTL of 0 or less (RESP)
+}
+
+// command is the implementation of a command name.
+type command struct {
+	write bool                            // Whether the command changes the dataset
+	run   func(cmd *Command) (any, error) // Runs the command and returns its result
+}
+
+// commands maps command names to their implementations.
+var commands = map[string]command{
+	"set":    {write: true, run: runSet},
+	"get":    {run: runGet},
+	"del":    {write: true, run: runDel},
+	"exists": {run: runExists},
+	"incr":   {write: true, run: runIncr},
+	"expire": {write: true, run: runExpire},
+	"ttl":    {run: runTTL},
+}
+
+// execute runs cmd for the client of r and returns its result. Errors are
+// *APIError or errors of the cache, see toAPIError.
+func execute(r *http.Request, cmd *Command) (any, error) {
+	name := strings.ToLower(cmd.Cmd)
+	c, ok := commands[name]
+	if !ok {
+		return nil, &APIError{Status: http.StatusBadRequest, Code: codeUnknownCommand, Message: fmt.Sprintf("Unknown command %q", cmd.Cmd)}
+	}
+	if cmd.Key == "" {
+		return nil, &APIError{Status: http.StatusBadRequest, Code: codeInvalidRequest, Message: "Missing key"}
+	}
+	if cache.IsInternalKey(cmd.Key) {
+		return nil, reservedKeyError()
+	}
+	if err := checkACL(r, name, cmd.Key); err != nil {
+		return nil, err
+	}
+	if _, err := checkSlot(cmd.Key); err != nil {
+		return nil, err
+	}
+	if c.write {
+		if err := checkWritable(); err != nil {
+			return nil, err
+		}
+	}
+	return c.run(cmd)
+}
+
+// commandTTL returns the validated TTL of cmd, 0 if it has none.
+func commandTTL(cmd *Command) (time.Duration, error) {
+	if cmd.TTL == nil {
+		return 0, nil
+	}
+	if err := cmd.TTL.validate(); err != nil {
+		return 0, err
+	}
+	return time.Duration(*cmd.TTL), nil
+}
+
+// runSet stores value under key, like /set. Result: "ok".
+func runSet(cmd *Command) (any, error) {
+	if cmd.Value == nil {
+		return nil, &APIError{Status: http.StatusBadRequest, Code: codeInvalidRequest, Message: "Missing value"}
+	}
+	if err := checkValueSize(int64(len(*cmd.Value))); err != nil {
+		return nil, err
+	}
+	ttl, err := commandTTL(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if err := cacheInstance.Set(cmd.Key, *cmd.Value, ttl); err != nil {
+		return nil, err
+	}
+	return "ok", nil
+}
+
+// runGet returns the GetResponse of key, like /get, or null if it doesn't exist.
+func runGet(cmd *Command) (any, error) {
+	value, stat, ok := cacheInstance.GetBytesWithStat(cmd.Key)
+	if !ok {
+		return nil, nil
+	}
+	return newGetResponse(cmd.Key, value, stat), nil
+}
+
+// runDel deletes key. Result: whether it existed.
+func runDel(cmd *Command) (any, error) {
+	return cacheInstance.Del(cmd.Key), nil
+}
+
+// runExists reports whether key exists.
+func runExists(cmd *Command) (any, error) {
+	_, ok := cacheInstance.MemoryUsage(cmd.Key)
+	return ok, nil
+}
+
+// runIncr adds by (default 1) to the integer value of key. Result: the new value.
+func runIncr(cmd *Command) (any, error) {
+	delta := int64(1)
+	if cmd.By != nil {
+		delta = *cmd.By
+	}
+	return cacheInstance.Incr(cmd.Key, delta)
+}
+
+// runExpire sets the TTL of key (0 or none: remove the TTL), or deletes it
+// with expireNow. Result: whether the key exists.
+func runExpire(cmd *Command) (any, error) {
+	if cmd.expireNow {
+		return cacheInstance.Del(cmd.Key), nil
+	}
+	ttl, err := commandTTL(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return cacheInstance.Expire(cmd.Key, ttl)
+}
+
+// runTTL returns the seconds until key expires, rounded up, like Redis TTL:
+// -1 if it has no TTL and -2 if it doesn't exist.
+func runTTL(cmd *Command) (any, error) {
+	_, expiresAt, ok := cacheInstance.GetBytesWithExpiry(cmd.Key)
+	if !ok {
+		return int64(-2), nil
+	}
+	return ttlRemaining(expiresAt), nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Response compression.
+//
+// The API routes gzip their responses for clients sending "Accept-Encoding:
+// gzip", once the body reaches -gzip-min-bytes: smaller bodies are sent as
+// is, since compressing them saves little and costs CPU on both ends. The
+// size is known from Content-Length if the handler sets one; otherwise the
+// start of the body is buffered until it reaches the threshold or the
+// handler returns. Responses that already have a Content-Encoding, and
+// values stored in compressed formats (see compressedType), are never
+// compressed again. The replication stream isn't compressed.
+
+// defaultGzipMinBytes is the default size from which responses are compressed.
+const defaultGzipMinBytes = 1024
+
+// gzipMinBytes is the smallest response body compressed (-gzip-min-bytes;
+// 0: compression disabled).
+var gzipMinBytes = defaultGzipMinBytes
+
+var (
+	gzipWriterPool = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+	gzipEncoding = []string{"gzip"}
+)
+
+// gzipResponses returns next with its responses compressed for clients
+// accepting gzip. Every response varies by Accept-Encoding, also if it isn't
+// compressed this time, so caches keep the two encodings apart.
+func gzipResponses(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if gzipMinBytes <= 0 {
+			next(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		next(gw, r)
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r accepts gzip
+// (or any encoding with "*"), with a quality value other than 0.
+func acceptsGzip(r *http.Request) bool {
+	for coding := range strings.SplitSeq(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.TrimSpace(name)
+		if !strings.EqualFold(name, "gzip") && name != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		quality, err := strconv.ParseFloat(q, 64)
+		return err == nil && quality > 0
+	}
+	return false
+}
+
+// compressedType reports whether values of the media type contentType are
+// already compressed, so gzip would only make them larger.
+func compressedType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "audio/"):
+		return true
+	}
+	switch mediaType {
+	case "application/gzip", "application/x-gzip", "application/zip", "application/zstd",
+		"application/x-bzip2", "application/x-xz", "application/x-7z-compressed", "font/woff", "font/woff2":
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter compresses a response once it is known to reach
+// gzipMinBytes, see gzipResponses.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int          // Status passed to WriteHeader (0: not called yet)
+	buf     []byte       // Start of the body, held until the decision
+	decided bool         // Whether the body is being sent (compressed or not)
+	gz      *gzip.Writer // Compressor of the body (nil: sent as is)
+}
+
+// WriteHeader records the status. The header is sent once it is decided
+// whether to compress, which is right away if the headers already tell.
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status != 0 || w.decided {
+		return
+	}
+	w.status = status
+
+	h := w.Header()
+	switch {
+	case status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified,
+		h.Get("Content-Encoding") != "", compressedType(h.Get("Content-Type")):
+		w.decide(false)
+	case h.Get("Content-Length") != "":
+		n, err := strconv.Atoi(h.Get("Content-Length"))
+		w.decide(err == nil && n >= gzipMinBytes)
+	}
+}
+
+// Write buffers the start of the body until it reaches gzipMinBytes, and
+// then writes it through the compressor.
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		if len(w.buf)+len(p) < gzipMinBytes {
+			w.buf = append(w.buf, p...)
+			return len(p), nil
+		}
+		// Large writes, e.g. a whole value, aren't copied to the buffer
+		if err := w.decideWith(true, p); err != nil {
+			return 0, err
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// decide sends the header and the buffered body, compressed or as is.
+func (w *gzipResponseWriter) decide(compress bool) error {
+	return w.decideWith(compress, nil)
+}
+
+// decideWith is decide with the next write of the body, used to set the
+// Content-Type of a compressed response if the handler didn't.
+func (w *gzipResponseWriter) decideWith(compress bool, next []byte) error {
+	w.decided = true
+	h := w.Header()
+	if compress {
+		if h.Get("Content-Type") == "" {
+			// net/http would sniff the compressed bytes instead
+			h.Set("Content-Type", http.DetectContentType(append(w.buf, next...)))
+		}
+		h.Del("Content-Length")
+		h["Content-Encoding"] = gzipEncoding
+		w.gz = gzipWriterPool.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush sends the body written so far, compressed if it reached
+// gzipMinBytes.
+func (w *gzipResponseWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close sends a body smaller than gzipMinBytes as is, or ends the
+// compressed body, when the handler has returned.
+func (w *gzipResponseWriter) close() {
+	if !w.decided && w.status != 0 {
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+		w.gz.Reset(nil)
+		gzipWriterPool.Put(w.gz)
+		w.gz = nil
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestGzipResponses checks which responses are compressed, that compressed
+// bodies decompress to the uncompressed ones, and that every response
+// varies by Accept-Encoding.
+func TestGzipResponses(t *testing.T) {
+	srv := newTestServer(t)
+	large := strings.Repeat("mini-redis ", 1000)
+	small := "tiny"
+	for key, value := range map[string]string{"large": large, "small": small} {
+		if err := cacheInstance.Set(key, value, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if resp, body := doRequest(t, srv, http.MethodPut, "/v1/keys/image", large, http.Header{"Content-Type": {"image/png"}}); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT /v1/keys/image = %d %s", resp.StatusCode, body)
+	}
+	gzipHeader := http.Header{"Accept-Encoding": {"gzip"}}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		header     http.Header
+		compressed bool
+	}{
+		{"large JSON", http.MethodGet, "/v1/get?key=large", gzipHeader, true},
+		{"large raw value", http.MethodGet, "/v1/keys/large", gzipHeader, true},
+		{"deprecated alias", http.MethodGet, "/get?key=large", gzipHeader, true},
+		{"any encoding", http.MethodGet, "/v1/keys/large", http.Header{"Accept-Encoding": {"br, *"}}, true},
+		{"small value", http.MethodGet, "/v1/keys/small", gzipHeader, false},
+		{"small JSON", http.MethodGet, "/v1/get?key=small", gzipHeader, false},
+		{"error", http.MethodGet, "/v1/get?key=missing", gzipHeader, false},
+		{"without Accept-Encoding", http.MethodGet, "/v1/keys/large", http.Header{"Accept-Encoding": {"identity"}}, false},
+		{"gzip refused", http.MethodGet, "/v1/keys/large", http.Header{"Accept-Encoding": {"gzip;q=0"}}, false},
+		{"compressed type", http.MethodGet, "/v1/keys/image", gzipHeader, false},
+		{"HEAD", http.MethodHead, "/v1/keys/large", gzipHeader, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := doRequest(t, srv, tt.method, tt.path, "", tt.header)
+			if !strings.Contains(strings.Join(resp.Header.Values("Vary"), ","), "Accept-Encoding") {
+				t.Errorf("Vary = %q, want Accept-Encoding", resp.Header.Values("Vary"))
+			}
+			encoding := resp.Header.Get("Content-Encoding")
+			if tt.compressed != (encoding == "gzip") {
+				t.Fatalf("Content-Encoding = %q, want compressed: %v", encoding, tt.compressed)
+			}
+			if encoding == "gzip" {
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatalf("decompressing: %v", err)
+				}
+			}
+
+			// The same request without compression
+			plain, want := doRequest(t, srv, tt.method, tt.path, "", nil)
+			if !bytes.Equal(body, want) {
+				t.Errorf("body differs from the uncompressed one: %d bytes, want %d", len(body), len(want))
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != plain.Header.Get("Content-Type") {
+				t.Errorf("Content-Type = %q, uncompressed %q", ct, plain.Header.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+// TestGzipResponseWriter checks that a body written in small pieces is
+// compressed once it reaches gzipMinBytes, that a handler's Content-Encoding
+// is kept, and that writers are reused.
+func TestGzipResponseWriter(t *testing.T) {
+	serve := func(handler http.HandlerFunc) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		gzipResponses(handler)(w, r)
+		return w
+	}
+
+	piece := strings.Repeat("x", 100)
+	w := serve(func(w http.ResponseWriter, r *http.Request) {
+		for range 20 {
+			io.WriteString(w, piece)
+		}
+	})
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Type") == "" {
+		t.Fatalf("headers of a body written in pieces: %v", w.Header())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := io.ReadAll(zr); err != nil || string(body) != strings.Repeat(piece, 20) {
+		t.Errorf("decompressed body: %d bytes, %v", len(body), err)
+	}
+
+	w = serve(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		io.WriteString(w, strings.Repeat(piece, 20))
+	})
+	if w.Header().Get("Content-Encoding") != "br" || w.Body.Len() != 2000 {
+		t.Errorf("response with a Content-Encoding: %v, %d bytes", w.Header(), w.Body.Len())
+	}
+
+	// A new compressor allocates about a megabyte, a reused one next to
+	// nothing (the race detector makes sync.Pool drop some)
+	const runs = 100
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for range runs {
+		serve(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, strings.Repeat(piece, 20))
+		})
+	}
+	runtime.ReadMemStats(&after)
+	perResponse := (after.TotalAlloc - before.TotalAlloc) / runs
+	if perResponse > 512<<10 {
+		t.Errorf("%d bytes allocated per compressed response: gzip writers aren't reused", perResponse)
+	}
+}
+
+// TestAcceptsGzip checks the Accept-Encoding headers that accept gzip.
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip", true},
+		{"gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"br, deflate", false},
+		{"x-gzip", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptsGzip(r); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
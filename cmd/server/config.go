@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"mini-redis/internal/cache"
+)
+
+// ConfigResponse represents the runtime configuration returned by GET /config:
+// the effective configuration in the sections of a config file (see
+// configfile.go), followed by the settings that POST /config changes.
+// The AOF settings are omitted without persistence.
+type ConfigResponse struct {
+	*Config
+	AOFEnabled               *bool    `json:"aof_enabled,omitempty"`                 // Whether commands are written to the AOF (see Cache.SetAOFEnabled)
+	AOFRewriteGrowthMultiple *float64 `json:"aof_rewrite_growth_multiple,omitempty"` // Rewrite when the AOF grows past this multiple of its base size
+	AOFRewriteMinSize        *int64   `json:"aof_rewrite_min_size,omitempty"`        // Minimum AOF size in bytes for automatic rewrites
+	MaxKeyLength             int      `json:"max_key_length"`                        // Longest key accepted by writes (0 = unlimited)
+	MaxValueSize             int      `json:"max_value_size"`                        // Largest value accepted by writes (0 = unlimited)
+}
+
+// ConfigRequest represents the JSON payload for POST /config: settings in
+// the sections of a config file, like GET /config returns them, and the
+// settings that only POST /config changes. Only the fields that are present
+// are changed.
+type ConfigRequest struct {
+	*Config
+	AOFEnabled               *bool    `json:"aof_enabled,omitempty"`
+	AOFRewriteGrowthMultiple *float64 `json:"aof_rewrite_growth_multiple,omitempty"`
+	AOFRewriteMinSize        *int64   `json:"aof_rewrite_min_size,omitempty"`
+	MaxKeyLength             *int     `json:"max_key_length,omitempty"`
+	MaxValueSize             *int     `json:"max_value_size,omitempty"`
+	Persist                  bool     `json:"persist,omitempty"` // Also save the settings of the sections in the config file
+}
+
+// getConfigHandler handles GET requests returning the current runtime configuration.
+func getConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeConfig(w)
+}
+
+// setConfigHandler handles POST requests changing the runtime configuration
+// fields present in the JSON body, and returns the new configuration.
+// Changes are all or nothing, see setConfig.
+func setConfigHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeConfigRequest(w, r)
+	if err != nil {
+		writeError(w, r, err.Status, err.Code, err.Message)
+		return
+	}
+	if err := setConfig(r, req); err != nil {
+		writeError(w, r, err.Status, err.Code, err.Message)
+		return
+	}
+	writeConfig(w)
+}
+
+// decodeConfigRequest reads the body of POST /config. The sections are
+// checked like those of a config file, for errors naming the setting.
+func decodeConfigRequest(w http.ResponseWriter, r *http.Request) (*ConfigRequest, *APIError) {
+	buf, err := readBody(w, r)
+	defer putBody(buf)
+	var tree map[string]any
+	if err == nil {
+		dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+		dec.UseNumber()
+		err = dec.Decode(&tree)
+	}
+	if err != nil {
+		return nil, jsonBodyError(err)
+	}
+
+	sections := make(map[string]any)
+	for _, f := range reflect.VisibleFields(reflect.TypeFor[Config]()) {
+		if v, ok := tree[f.Tag.Get("json")]; ok {
+			sections[f.Tag.Get("json")] = v
+		}
+	}
+	if _, err := normalizeConfigValue(sections, reflect.TypeFor[Config](), ""); err != nil {
+		return nil, &APIError{Status: http.StatusBadRequest, Code: codeInvalidConfig, Message: fmt.Sprintf("Invalid configuration: %v", err)}
+	}
+	for name, section := range sections {
+		tree[name] = section
+	}
+	normalized, err := json.Marshal(tree)
+	if err != nil {
+		return nil, jsonBodyError(err)
+	}
+	req := new(ConfigRequest)
+	if err := json.Unmarshal(normalized, req); err != nil {
+		return nil, jsonBodyError(err)
+	}
+	if req.Config != nil {
+		if err := req.Config.validate(); err != nil {
+			return nil, &APIError{Status: http.StatusBadRequest, Code: codeInvalidConfig, Message: fmt.Sprintf("Invalid configuration: %v", err)}
+		}
+	}
+	return req, nil
+}
+
+// setConfig applies a POST /config request. Everything is validated before
+// anything changes, so an invalid request changes nothing:
+//   - Settings of the sections must be in reloadableSettings: the others
+//     need a restart, and are listed in the 400 response.
+//   - Changing the AOF settings without persistence fails with 409, and so
+//     does persist without a config file.
+//
+// Turning the AOF on rewrites it, which can fail, as can saving the config
+// file: the changes made before are then undone.
+//
+// With persist, the settings of the sections are saved in the config file
+// before they are applied, so a later reload keeps them; without it, they
+// last until the restart, or until the file changes them. Every setting
+// changed is logged with the principal of the request.
+func setConfig(r *http.Request, req *ConfigRequest) *APIError {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	limits := cacheInstance.Limits()
+	if req.MaxKeyLength != nil {
+		limits.MaxKeyLength = *req.MaxKeyLength
+	}
+	if req.MaxValueSize != nil {
+		limits.MaxValueSize = *req.MaxValueSize
+	}
+	if limits.MaxKeyLength < 0 || limits.MaxValueSize < 0 {
+		return &APIError{Status: http.StatusBadRequest, Code: codeInvalidConfig, Message: "Invalid configuration: max_key_length and max_value_size must be >= 0"}
+	}
+	setThresholds := req.AOFRewriteGrowthMultiple != nil || req.AOFRewriteMinSize != nil
+	if (setThresholds || req.AOFEnabled != nil) && !cacheInstance.Persistent() {
+		return &APIError{Status: http.StatusConflict, Code: codePersistenceDisabled, Message: "Persistence is disabled"}
+	}
+
+	type pendingSetting struct {
+		setting configSetting
+		values  []string
+		apply   func() int
+	}
+	var pending []pendingSetting
+	var immutable []string
+	patch := req.Config
+	if patch == nil {
+		patch = new(Config)
+	}
+	for _, s := range configSettings(patch) {
+		if s.value.IsNil() {
+			continue
+		}
+		prepare, ok := reloadableSettings[s.path]
+		if !ok {
+			immutable = append(immutable, s.path)
+			continue
+		}
+		values := settingValues(s)
+		apply, err := prepare(values)
+		if err != nil {
+			return &APIError{Status: http.StatusBadRequest, Code: codeInvalidConfig, Message: fmt.Sprintf("Invalid configuration: %s: %v", s.path, err)}
+		}
+		pending = append(pending, pendingSetting{s, values, apply})
+	}
+	if len(immutable) > 0 {
+		return &APIError{Status: http.StatusBadRequest, Code: codeInvalidConfig,
+			Message: "Settings can't be changed at runtime (change them in the config file and restart): " + strings.Join(immutable, ", ")}
+	}
+	if req.Persist && configFilePath == "" {
+		return &APIError{Status: http.StatusConflict, Code: codeNoConfigFile, Message: "No config file to persist to (start the server with -config)"}
+	}
+
+	// Everything is valid. The steps that can still fail go first, and are
+	// undone if a later one fails: the thresholds, which are checked as they
+	// are set, turning the AOF on or off, and saving the config file.
+	principal := requestPrincipal(r)
+	var undo []func()
+	fail := func(err *APIError) *APIError {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		return err
+	}
+	if setThresholds {
+		// Start from the current values so partial updates keep the other threshold
+		oldMultiple, oldMinSize := aofRewriteManager.Thresholds()
+		multiple, minSize := oldMultiple, oldMinSize
+		if req.AOFRewriteGrowthMultiple != nil {
+			multiple = *req.AOFRewriteGrowthMultiple
+		}
+		if req.AOFRewriteMinSize != nil {
+			minSize = *req.AOFRewriteMinSize
+		}
+		if err := aofRewriteManager.SetThresholds(multiple, minSize); err != nil {
+			return &APIError{Status: http.StatusBadRequest, Code: codeInvalidConfig, Message: fmt.Sprintf("Invalid configuration: %v", err)}
+		}
+		undo = append(undo, func() { aofRewriteManager.SetThresholds(oldMultiple, oldMinSize) })
+	}
+	if enabled := req.AOFEnabled; enabled != nil && *enabled != cacheInstance.AOFEnabled() {
+		if err := cacheInstance.SetAOFEnabled(*enabled); err != nil {
+			if errors.Is(err, cache.ErrRewriteInProgress) {
+				return fail(&APIError{Status: http.StatusConflict, Code: codeInProgress, Message: "An AOF rewrite is already in progress, retry later"})
+			}
+			slog.Error("AOF not turned on or off", "enabled", *enabled, "err", err)
+			return fail(&APIError{Status: http.StatusInternalServerError, Code: codeInternal, Message: fmt.Sprintf("AOF not turned on or off: %v", err)})
+		}
+		slog.Info("Config setting changed", "setting", "aof_enabled", "old", !*enabled, "new", *enabled, "principal", principal)
+		undo = append(undo, func() {
+			if err := cacheInstance.SetAOFEnabled(!*enabled); err != nil {
+				slog.Error("AOF change not undone", "enabled", !*enabled, "err", err)
+			}
+		})
+	}
+	if req.Persist && len(pending) > 0 {
+		next := *configFile
+		settings := configSettings(&next)
+		for i, s := range configSettings(patch) {
+			if !s.value.IsNil() {
+				settings[i].value.Set(s.value)
+			}
+		}
+		if err := saveConfigFile(configFilePath, &next); err != nil {
+			slog.Error("Config file not saved", "path", configFilePath, "err", err)
+			return fail(&APIError{Status: http.StatusInternalServerError, Code: codeInternal, Message: fmt.Sprintf("Config file not saved: %v", err)})
+		}
+		configFile = &next
+	}
+
+	for _, p := range pending {
+		old := flag.Lookup(p.setting.flag).Value.String()
+		evicted := p.apply()
+		setFlagValues(p.setting.flag, p.values)
+		slog.Info("Config setting changed", "setting", p.setting.path, "old", old, "new", describeSetting(p.setting),
+			"principal", principal, "persisted", req.Persist, "evicted", evicted)
+	}
+	cacheInstance.SetLimits(limits.MaxKeyLength, limits.MaxValueSize)
+	if setThresholds || req.MaxKeyLength != nil || req.MaxValueSize != nil {
+		slog.Info("Runtime configuration changed", "principal", principal,
+			"max_key_length", limits.MaxKeyLength, "max_value_size", limits.MaxValueSize)
+	}
+	return nil
+}
+
+// writeConfig writes the current runtime configuration as JSON.
+func writeConfig(w http.ResponseWriter) {
+	limits := cacheInstance.Limits()
+	resp := ConfigResponse{
+		Config:       effectiveConfig(),
+		MaxKeyLength: limits.MaxKeyLength,
+		MaxValueSize: limits.MaxValueSize,
+	}
+	if cacheInstance.Persistent() {
+		enabled := cacheInstance.AOFEnabled()
+		resp.AOFEnabled = &enabled
+		multiple, minSize := aofRewriteManager.Thresholds()
+		resp.AOFRewriteGrowthMultiple = &multiple
+		resp.AOFRewriteMinSize = &minSize
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestSetConfigRequiresAdmin checks that POST /config is an admin
+// endpoint: only the admin token and ACL users allowed admin get to the
+// handler.
+func TestSetConfigRequiresAdmin(t *testing.T) {
+	srv := newTestServer(t)
+	// An invalid setting is rejected by the handler with 400 once the
+	// request is allowed, without changing anything
+	const body = `{"cache": {"max_keyz": 1000}}`
+	bearer := func(token string) http.Header { return http.Header{"Authorization": {"Bearer " + token}} }
+
+	prevToken := adminToken
+	adminToken = ""
+	t.Cleanup(func() { adminToken = prevToken })
+	resp, data := doRequest(t, srv, http.MethodPost, "/v1/config", body, nil)
+	if resp.StatusCode != http.StatusForbidden || errorCode(t, data) != codeAdminDisabled {
+		t.Errorf("POST /config without ADMIN_TOKEN: status %d %s, want 403 %s", resp.StatusCode, data, codeAdminDisabled)
+	}
+
+	adminToken = "admin-secret"
+	tokens, err := parseAPITokens([]string{"app:app-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevTokens := apiTokens
+	apiTokens = tokens
+	t.Cleanup(func() { apiTokens = prevTokens })
+
+	for token, want := range map[string]int{"app-token": http.StatusForbidden, "admin-secret": http.StatusBadRequest} {
+		resp, data := doRequest(t, srv, http.MethodPost, "/v1/config", body, bearer(token))
+		if resp.StatusCode != want {
+			t.Errorf("POST /config with %s: status %d %s, want %d", token, resp.StatusCode, data, want)
+		}
+	}
+
+	// With an ACL, users allowed admin may change the configuration too
+	setACL(t, `{"users": [
+		{"name": "ops", "token": "ops-token", "allow": ["admin"]},
+		{"name": "dashboard", "token": "dashboard-token", "allow": ["info"]}
+	]}`)
+	for token, want := range map[string]int{"ops-token": http.StatusBadRequest, "dashboard-token": http.StatusForbidden} {
+		resp, data := doRequest(t, srv, http.MethodPost, "/v1/config", body, bearer(token))
+		if resp.StatusCode != want {
+			t.Errorf("POST /config with %s: status %d %s, want %d", token, resp.StatusCode, data, want)
+		}
+	}
+}
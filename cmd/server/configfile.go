@@ -0,0 +1,729 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// Config file.
+//
+// -config (or MINIREDIS_CONFIG) loads the settings of a YAML or JSON file
+// (.json, or a document starting with "{"), grouped into the sections of
+// Config. Each setting stands for a flag or an environment variable, given
+// in its flag and env struct tags, and the file only fills in what these
+// leave open: a flag given on the command line wins, then the environment
+// variable, then the file, then the default. Unknown settings, values of the
+// wrong type, and invalid values stop the server with the setting's path,
+// e.g. "cache.max_keys", so a typo can't be silently ignored. GET /config
+// returns the effective configuration in the same form, with the secrets
+// redacted.
+//
+// Example:
+//
+//	server:
+//	  addr: ":6380"
+//	cache:
+//	  max_keys: 100000
+//	  eviction_policy: lfu
+//	persistence:
+//	  fsync: everysec
+//	  save: ["900 1", "60 1000"]
+//	security:
+//	  admin_token: change-me
+
+// Config is the content of a config file. Settings that are absent are nil.
+type Config struct {
+	Server      ServerConfig      `json:"server"`
+	Cache       CacheConfig       `json:"cache"`
+	Persistence PersistenceConfig `json:"persistence"`
+	Security    SecurityConfig    `json:"security"`
+	TLS         TLSConfig         `json:"tls"`
+}
+
+// ServerConfig is the "server" section of a config file.
+type ServerConfig struct {
+	Addr         *string `json:"addr,omitempty" flag:"addr" env:"MINIREDIS_ADDR"`
+	LogLevel     *string `json:"log_level,omitempty" flag:"log-level" env:"MINIREDIS_LOG_LEVEL"`
+	MaxBodyBytes *int64  `json:"max_body_bytes,omitempty" flag:"max-body-bytes"`
+	GzipMinBytes *int    `json:"gzip_min_bytes,omitempty" flag:"gzip-min-bytes"`
+
+	ReadHeaderTimeout *Duration `json:"read_header_timeout,omitempty" flag:"read-header-timeout"`
+	ReadTimeout       *Duration `json:"read_timeout,omitempty" flag:"read-timeout"`
+	WriteTimeout      *Duration `json:"write_timeout,omitempty" flag:"write-timeout"`
+	IdleTimeout       *Duration `json:"idle_timeout,omitempty" flag:"idle-timeout"`
+	MaxHeaderBytes    *int      `json:"max_header_bytes,omitempty" flag:"max-header-bytes"`
+	H2C               *bool     `json:"h2c,omitempty" flag:"h2c"`
+	HealthAddr        *string   `json:"health_addr,omitempty" flag:"health-addr"`
+	UnixSocket        *string   `json:"unix_socket,omitempty" flag:"unix-socket"`
+	UnixSocketPerm    *string   `json:"unix_socket_perm,omitempty" flag:"unix-socket-perm"`
+	GRPCAddr          *string   `json:"grpc_addr,omitempty" flag:"grpc-addr"`
+	RESPAddr          *string   `json:"resp_addr,omitempty" flag:"resp-addr"`
+	ReadOnly          *bool     `json:"read_only,omitempty" flag:"read-only"`
+	ShutdownEndpoint  *bool     `json:"shutdown_endpoint,omitempty" flag:"shutdown-endpoint"`
+	ShutdownDelay     *Duration `json:"shutdown_delay,omitempty" flag:"shutdown-delay"`
+	ShutdownDrain     *Duration `json:"shutdown_drain_delay,omitempty" flag:"shutdown-drain-delay"`
+	IdempotencyWindow *Duration `json:"idempotency_window,omitempty" flag:"idempotency-window"`
+
+	MaxConnections      *int      `json:"max_connections,omitempty" flag:"max-connections"`
+	MaxRequests         *int      `json:"max_requests,omitempty" flag:"max-requests"`
+	RequestQueue        *int      `json:"request_queue,omitempty" flag:"request-queue"`
+	RequestQueueTimeout *Duration `json:"request_queue_timeout,omitempty" flag:"request-queue-timeout"`
+	MaxStreams          *int      `json:"max_streams,omitempty" flag:"max-streams"`
+
+	CORSOrigins     []string  `json:"cors_origins,omitempty" flag:"cors-origins"`
+	CORSMethods     []string  `json:"cors_methods,omitempty" flag:"cors-methods"`
+	CORSHeaders     []string  `json:"cors_headers,omitempty" flag:"cors-headers"`
+	CORSMaxAge      *Duration `json:"cors_max_age,omitempty" flag:"cors-max-age"`
+	CORSCredentials *bool     `json:"cors_credentials,omitempty" flag:"cors-credentials"`
+
+	RateLimitRead   *int     `json:"rate_limit_read,omitempty" flag:"rate-limit-read"`
+	RateBurstRead   *int     `json:"rate_burst_read,omitempty" flag:"rate-burst-read"`
+	RateLimitWrite  *int     `json:"rate_limit_write,omitempty" flag:"rate-limit-write"`
+	RateBurstWrite  *int     `json:"rate_burst_write,omitempty" flag:"rate-burst-write"`
+	RateLimitAdmin  *int     `json:"rate_limit_admin,omitempty" flag:"rate-limit-admin"`
+	RateBurstAdmin  *int     `json:"rate_burst_admin,omitempty" flag:"rate-burst-admin"`
+	RateLimitExempt []string `json:"rate_limit_exempt,omitempty" flag:"rate-limit-exempt"`
+}
+
+// CacheConfig is the "cache" section of a config file.
+type CacheConfig struct {
+	MaxKeys         *int      `json:"max_keys,omitempty" flag:"max-keys" env:"MINIREDIS_MAX_KEYS,MAX_KEYS"`
+	MaxMemory       *string   `json:"maxmemory,omitempty" flag:"maxmemory"`
+	EvictionPolicy  *string   `json:"eviction_policy,omitempty" flag:"eviction-policy"`
+	CleanupInterval *Duration `json:"cleanup_interval,omitempty" flag:"cleanup-interval" env:"MINIREDIS_CLEANUP_INTERVAL"`
+	MaxTTL          *Duration `json:"max_ttl,omitempty" flag:"max-ttl"`
+	MaxKeyLength    *int      `json:"max_key_length,omitempty" flag:"max-key-length"`
+	MaxValueSize    *int      `json:"max_value_size,omitempty" flag:"max-value-bytes"`
+	KeyCharset      *string   `json:"key_charset,omitempty" flag:"key-charset"`
+	KeyPrefix       *string   `json:"key_prefix,omitempty" flag:"key-prefix"`
+}
+
+// PersistenceConfig is the "persistence" section of a config file.
+type PersistenceConfig struct {
+	AOF              *string   `json:"aof,omitempty" flag:"aof" env:"MINIREDIS_AOF"`
+	Fsync            *string   `json:"fsync,omitempty" flag:"aof-fsync" env:"MINIREDIS_AOF_FSYNC"`
+	Snapshot         *string   `json:"snapshot,omitempty" flag:"snapshot" env:"MINIREDIS_SNAPSHOT"`
+	SnapshotInterval *Duration `json:"snapshot_interval,omitempty" flag:"snapshot-interval" env:"MINIREDIS_SNAPSHOT_INTERVAL"`
+	Save             []string  `json:"save,omitempty" flag:"save"`
+	SnapshotKeep     *int      `json:"snapshot_keep,omitempty" flag:"snapshot-keep"`
+}
+
+// SecurityConfig is the "security" section of a config file. Its tokens
+// have no flags, so they don't show up in process listings, and are
+// redacted in GET /config.
+type SecurityConfig struct {
+	AdminToken     *string   `json:"admin_token,omitempty" env:"ADMIN_TOKEN"`
+	PrimaryToken   *string   `json:"primary_token,omitempty" env:"PRIMARY_TOKEN"`
+	APITokens      []string  `json:"api_tokens,omitempty" env:"MINIREDIS_API_TOKENS"` // "name:token"
+	HMACKeys       []string  `json:"hmac_keys,omitempty" env:"MINIREDIS_HMAC_KEYS"`   // "name:secret"
+	HMACMaxSkew    *Duration `json:"hmac_max_skew,omitempty" flag:"hmac-max-skew"`
+	NoAuth         *bool     `json:"no_auth,omitempty" flag:"no-auth"`
+	ACLFile        *string   `json:"acl_file,omitempty" flag:"acl-file" env:"MINIREDIS_ACL_FILE"`
+	IPAllowRead    []string  `json:"ip_allow_read,omitempty" flag:"ip-allow-read"`
+	IPDenyRead     []string  `json:"ip_deny_read,omitempty" flag:"ip-deny-read"`
+	IPAllowWrite   []string  `json:"ip_allow_write,omitempty" flag:"ip-allow-write"`
+	IPDenyWrite    []string  `json:"ip_deny_write,omitempty" flag:"ip-deny-write"`
+	IPAllowAdmin   []string  `json:"ip_allow_admin,omitempty" flag:"ip-allow-admin"`
+	IPDenyAdmin    []string  `json:"ip_deny_admin,omitempty" flag:"ip-deny-admin"`
+	TrustedProxies []string  `json:"trusted_proxies,omitempty" flag:"trusted-proxies"`
+}
+
+// TLSConfig is the "tls" section of a config file.
+type TLSConfig struct {
+	Cert       *string `json:"cert,omitempty" flag:"tls-cert" env:"MINIREDIS_TLS_CERT"`
+	Key        *string `json:"key,omitempty" flag:"tls-key" env:"MINIREDIS_TLS_KEY"`
+	SelfSigned *bool   `json:"self_signed,omitempty" flag:"tls-self-signed"`
+
+	ClientCA    *string  `json:"client_ca,omitempty" flag:"tls-client-ca" env:"MINIREDIS_TLS_CLIENT_CA"`
+	ClientAllow []string `json:"client_allow,omitempty" flag:"tls-client-allow"`
+}
+
+// Duration is a duration setting, written as a string such as "30s" or "5m".
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("must be a duration such as \"30s\" or \"5m\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q (e.g. \"30s\" or \"5m\")", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// redacted replaces the value of secret settings in GET /config.
+const redacted = "[redacted]"
+
+var durationType = reflect.TypeFor[Duration]()
+
+// configFilePath is the config file given with -config ("" = none).
+var configFilePath string
+
+// configFile holds the settings of the config file, as of the last load or
+// reload (empty without a config file). Guarded by reloadMu after startup.
+var configFile *Config
+
+// loadConfigFile reads and validates the config file at path.
+func loadConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree any
+	if strings.EqualFold(filepath.Ext(path), ".json") || strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		dec := json.NewDecoder(strings.NewReader(string(data)))
+		dec.UseNumber()
+		if err := dec.Decode(&tree); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+	} else if tree, err = parseYAML(data); err != nil {
+		return nil, fmt.Errorf("invalid YAML: %w", err)
+	}
+
+	// Check names and types first, for errors naming the setting
+	tree, err = normalizeConfigValue(tree, reflect.TypeFor[Config](), "")
+	if err != nil {
+		return nil, err
+	}
+	normalized, err := json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(Config)
+	if err := json.Unmarshal(normalized, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// saveConfigFile replaces the config file at path with cfg, atomically, in
+// the format of the file: JSON or YAML (see formatConfigYAML). The comments
+// and layout of the file aren't kept.
+func saveConfigFile(path string, cfg *Config) error {
+	old, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if strings.EqualFold(filepath.Ext(path), ".json") || strings.HasPrefix(strings.TrimSpace(string(old)), "{") {
+		if data, err = json.MarshalIndent(cfg, "", "  "); err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	} else {
+		data = formatConfigYAML(cfg)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// normalizeConfigValue checks that v, decoded from a config file, fits the
+// type t of the setting at path, and converts scalars to that type where
+// YAML is ambiguous, e.g. maxmemory: 1000 to a string.
+func normalizeConfigValue(v any, t reflect.Type, path string) (any, error) {
+	if v == nil {
+		return nil, nil // Left unset
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == durationType:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: must be a duration such as \"30s\" or \"5m\", not %s", path, describeConfigValue(v))
+		}
+		if _, err := time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("%s: invalid duration %q (e.g. \"30s\" or \"5m\")", path, s)
+		}
+		return s, nil
+
+	case t.Kind() == reflect.Struct:
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: must be a section of settings, not %s", configPathOrRoot(path), describeConfigValue(v))
+		}
+		fields := make(map[string]reflect.StructField)
+		var names []string
+		for _, f := range reflect.VisibleFields(t) {
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			fields[name] = f
+			names = append(names, name)
+		}
+		for _, key := range slices.Sorted(maps.Keys(m)) {
+			f, ok := fields[key]
+			if !ok {
+				return nil, unknownSettingError(path, key, names)
+			}
+			nv, err := normalizeConfigValue(m[key], f.Type, joinConfigPath(path, key))
+			if err != nil {
+				return nil, err
+			}
+			m[key] = nv
+		}
+		return m, nil
+
+	case t.Kind() == reflect.Slice:
+		items, ok := v.([]any)
+		if !ok {
+			// A single save rule doesn't need a list
+			items = []any{v}
+		}
+		for i, item := range items {
+			nv, err := normalizeConfigValue(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			items[i] = nv
+		}
+		return items, nil
+
+	case t.Kind() == reflect.String:
+		switch s := v.(type) {
+		case string:
+			return s, nil
+		case json.Number:
+			return s.String(), nil
+		}
+		return nil, fmt.Errorf("%s: must be a string, not %s", path, describeConfigValue(v))
+
+	case t.Kind() == reflect.Int || t.Kind() == reflect.Int64:
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("%s: must be an integer, not %s", path, describeConfigValue(v))
+		}
+		if _, err := strconv.ParseInt(n.String(), 10, t.Bits()); err != nil {
+			return nil, fmt.Errorf("%s: must be an integer, not %s", path, describeConfigValue(v))
+		}
+		return n, nil
+
+	case t.Kind() == reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			return nil, fmt.Errorf("%s: must be true or false, not %s", path, describeConfigValue(v))
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported setting type %v", path, t)
+}
+
+// unknownSettingError describes an unknown setting or section, with the
+// closest known name if it looks like a typo, or the known names.
+func unknownSettingError(path, key string, names []string) error {
+	what := "setting"
+	if path == "" {
+		what = "section"
+	}
+	best, bestDistance := "", 3 // Suggest names up to 2 edits away
+	for _, name := range names {
+		if d := editDistance(key, name); d < bestDistance {
+			best, bestDistance = name, d
+		}
+	}
+	if best != "" {
+		return fmt.Errorf("%s: unknown %s %q (did you mean %q?)", configPathOrRoot(path), what, key, best)
+	}
+	return fmt.Errorf("%s: unknown %s %q (known: %s)", configPathOrRoot(path), what, key, strings.Join(names, ", "))
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// describeConfigValue describes a decoded value in error messages.
+func describeConfigValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("the string %q", v)
+	case json.Number:
+		return "the number " + v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case map[string]any:
+		return "a section"
+	case []any:
+		return "a list"
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// joinConfigPath returns the path of the setting key in the section path.
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// configPathOrRoot returns path, or "config" for the top level.
+func configPathOrRoot(path string) string {
+	if path == "" {
+		return "config"
+	}
+	return path
+}
+
+// validate checks the values of the settings present in the file, like the
+// flags they stand for are checked.
+func (c *Config) validate() error {
+	var errs []string
+	check := func(path string, ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, path+": "+fmt.Sprintf(format, args...))
+		}
+	}
+	checkErr := func(path string, err error) {
+		if err != nil {
+			errs = append(errs, path+": "+err.Error())
+		}
+	}
+
+	if v := c.Server.LogLevel; v != nil {
+		var level slog.Level
+		checkErr("server.log_level", level.UnmarshalText([]byte(*v)))
+	}
+	if v := c.Server.MaxBodyBytes; v != nil {
+		check("server.max_body_bytes", *v > 0, "must be > 0 (got %d)", *v)
+	}
+	if v := c.Server.GzipMinBytes; v != nil {
+		check("server.gzip_min_bytes", *v >= 0, "must be >= 0 (got %d)", *v)
+	}
+	for _, t := range []struct {
+		path string
+		v    *Duration
+	}{
+		{"server.read_header_timeout", c.Server.ReadHeaderTimeout},
+		{"server.read_timeout", c.Server.ReadTimeout},
+		{"server.write_timeout", c.Server.WriteTimeout},
+		{"server.idle_timeout", c.Server.IdleTimeout},
+	} {
+		if t.v != nil {
+			check(t.path, *t.v >= 0, "must be >= 0, 0 = no timeout (got %v)", time.Duration(*t.v))
+		}
+	}
+	if v := c.Server.MaxHeaderBytes; v != nil {
+		check("server.max_header_bytes", *v > 0, "must be > 0 (got %d)", *v)
+	}
+	if v := c.Server.ShutdownDelay; v != nil {
+		check("server.shutdown_delay", *v >= 0, "must be >= 0 (got %v)", time.Duration(*v))
+	}
+	if v := c.Server.ShutdownDrain; v != nil {
+		check("server.shutdown_drain_delay", *v >= 0, "must be >= 0 (got %v)", time.Duration(*v))
+	}
+	if v := c.Server.UnixSocketPerm; v != nil {
+		_, err := parseSocketPerm(*v)
+		checkErr("server.unix_socket_perm", err)
+	}
+	if v := c.Server.IdempotencyWindow; v != nil {
+		check("server.idempotency_window", *v >= 0, "must be >= 0, 0 = ignore Idempotency-Key (got %v)", time.Duration(*v))
+	}
+	if v := c.Server.HealthAddr; v != nil && *v != "" {
+		checkErr("server.health_addr", checkLoopbackAddr(*v))
+	}
+
+	if v := c.Cache.MaxKeys; v != nil {
+		check("cache.max_keys", *v >= 0, "must be >= 0, 0 = unlimited (got %d)", *v)
+	}
+	if v := c.Cache.MaxMemory; v != nil {
+		_, err := parseMemorySize(*v)
+		checkErr("cache.maxmemory", err)
+	}
+	if v := c.Cache.EvictionPolicy; v != nil {
+		_, err := cache.ParseEvictionPolicy(*v)
+		checkErr("cache.eviction_policy", err)
+	}
+	if v := c.Cache.CleanupInterval; v != nil {
+		check("cache.cleanup_interval", *v > 0, "must be > 0 (got %v)", time.Duration(*v))
+	}
+	if v := c.Cache.MaxTTL; v != nil {
+		check("cache.max_ttl", *v >= 0, "must be >= 0, 0 = no limit (got %v)", time.Duration(*v))
+	}
+	if v := c.Cache.MaxKeyLength; v != nil {
+		check("cache.max_key_length", *v >= 0, "must be >= 0, 0 = unlimited (got %d)", *v)
+	}
+	if v := c.Cache.MaxValueSize; v != nil {
+		check("cache.max_value_size", *v >= 0, "must be >= 0, 0 = unlimited (got %d)", *v)
+	}
+	if c.Cache.KeyCharset != nil || c.Cache.KeyPrefix != nil {
+		_, err := cache.NewKeyPolicy(deref(c.Cache.KeyCharset), deref(c.Cache.KeyPrefix))
+		checkErr("cache.key_charset/key_prefix", err)
+	}
+
+	if v := c.Persistence.Fsync; v != nil {
+		_, err := cache.ParseFsyncPolicy(*v)
+		checkErr("persistence.fsync", err)
+	}
+	if v := c.Persistence.SnapshotInterval; v != nil {
+		check("persistence.snapshot_interval", *v > 0, "must be > 0 (got %v)", time.Duration(*v))
+	}
+	for i, rule := range c.Persistence.Save {
+		_, err := cache.ParseSaveRules(rule)
+		checkErr(fmt.Sprintf("persistence.save[%d]", i), err)
+	}
+	if _, err := parseAPITokens(c.Security.APITokens); err != nil {
+		checkErr("security.api_tokens", err)
+	}
+	if _, err := parseHMACKeys(c.Security.HMACKeys); err != nil {
+		checkErr("security.hmac_keys", err)
+	}
+	if v := c.Security.HMACMaxSkew; v != nil {
+		check("security.hmac_max_skew", *v > 0, "must be > 0 (got %v)", time.Duration(*v))
+	}
+	for _, limit := range []struct {
+		path string
+		n    *int
+	}{
+		{"server.max_connections", c.Server.MaxConnections},
+		{"server.max_requests", c.Server.MaxRequests},
+		{"server.request_queue", c.Server.RequestQueue},
+		{"server.max_streams", c.Server.MaxStreams},
+	} {
+		if limit.n != nil {
+			check(limit.path, *limit.n >= 0, "must be >= 0 (got %d)", *limit.n)
+		}
+	}
+	if v := c.Server.RequestQueueTimeout; v != nil {
+		check("server.request_queue_timeout", *v >= 0, "must be >= 0 (got %v)", time.Duration(*v))
+	}
+	for _, rate := range []struct {
+		path string
+		n    *int
+	}{
+		{"server.rate_limit_read", c.Server.RateLimitRead},
+		{"server.rate_burst_read", c.Server.RateBurstRead},
+		{"server.rate_limit_write", c.Server.RateLimitWrite},
+		{"server.rate_burst_write", c.Server.RateBurstWrite},
+		{"server.rate_limit_admin", c.Server.RateLimitAdmin},
+		{"server.rate_burst_admin", c.Server.RateBurstAdmin},
+	} {
+		if rate.n != nil {
+			check(rate.path, *rate.n >= 0, "must be >= 0, 0 = unlimited (got %d)", *rate.n)
+		}
+	}
+	for _, list := range []struct {
+		path  string
+		specs []string
+	}{
+		{"security.ip_allow_read", c.Security.IPAllowRead},
+		{"security.ip_deny_read", c.Security.IPDenyRead},
+		{"security.ip_allow_write", c.Security.IPAllowWrite},
+		{"security.ip_deny_write", c.Security.IPDenyWrite},
+		{"security.ip_allow_admin", c.Security.IPAllowAdmin},
+		{"security.ip_deny_admin", c.Security.IPDenyAdmin},
+		{"security.trusted_proxies", c.Security.TrustedProxies},
+	} {
+		_, err := parseIPSet(list.specs)
+		checkErr(list.path, err)
+	}
+
+	if v := c.Persistence.SnapshotKeep; v != nil {
+		check("persistence.snapshot_keep", *v >= 0, "must be >= 0 (got %d)", *v)
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// configSetting is a setting of Config, see configSettings.
+type configSetting struct {
+	path  string        // e.g. "cache.max_keys"
+	flag  string        // Flag it stands for ("" = none)
+	env   []string      // Environment variables overriding it
+	value reflect.Value // Field of the setting (a pointer or a slice)
+}
+
+// configSettings returns the settings of c, section by section.
+func configSettings(c *Config) []configSetting {
+	var settings []configSetting
+	sections := reflect.ValueOf(c).Elem()
+	for i := range sections.NumField() {
+		section, _, _ := strings.Cut(sections.Type().Field(i).Tag.Get("json"), ",")
+		fields := sections.Field(i)
+		for j := range fields.NumField() {
+			f := fields.Type().Field(j)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			s := configSetting{
+				path:  section + "." + name,
+				flag:  f.Tag.Get("flag"),
+				value: fields.Field(j),
+			}
+			if env := f.Tag.Get("env"); env != "" {
+				s.env = strings.Split(env, ",")
+			}
+			settings = append(settings, s)
+		}
+	}
+	return settings
+}
+
+// overridden reports whether the setting is given on the command line or by
+// its environment variable, which win over the config file.
+func (s configSetting) overridden() bool {
+	if s.flag != "" && commandLineFlags[s.flag] {
+		return true
+	}
+	for _, name := range s.env {
+		if _, ok := os.LookupEnv(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// applyConfigFile sets the flags of the settings in cfg that are neither
+// given on the command line nor by their environment variable. Settings
+// without a flag are read by main, with envString and the file value.
+func applyConfigFile(cfg *Config) error {
+	for _, s := range configSettings(cfg) {
+		if s.flag == "" || s.value.IsNil() || s.overridden() {
+			continue
+		}
+		var values []string
+		if s.value.Kind() == reflect.Slice {
+			values = s.value.Interface().([]string)
+		} else {
+			values = []string{formatConfigValue(s.value.Elem())}
+		}
+		for _, v := range values {
+			if err := flag.Set(s.flag, v); err != nil {
+				return fmt.Errorf("%s: %w", s.path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// formatConfigValue formats the value of a setting as a flag value.
+func formatConfigValue(v reflect.Value) string {
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// effectiveConfig returns the configuration in effect: the values of the
+// flags, whether given, from the environment, from the file, or defaulted,
+// the settings changed at runtime, and the secrets redacted.
+func effectiveConfig() *Config {
+	reloadMu.Lock() // Reloads change the flags
+	defer reloadMu.Unlock()
+
+	cfg := new(Config)
+	for _, s := range configSettings(cfg) {
+		if s.flag == "" {
+			continue
+		}
+		getter, ok := flag.Lookup(s.flag).Value.(flag.Getter)
+		if !ok {
+			continue
+		}
+		v := reflect.ValueOf(getter.Get())
+		if s.value.Kind() == reflect.Slice {
+			s.value.Set(v)
+			continue
+		}
+		s.value.Set(reflect.New(s.value.Type().Elem()))
+		s.value.Elem().Set(v.Convert(s.value.Type().Elem()))
+	}
+
+	// Limits changed with POST /config
+	limits := cacheInstance.Limits()
+	cfg.Cache.MaxKeyLength = &limits.MaxKeyLength
+	cfg.Cache.MaxValueSize = &limits.MaxValueSize
+
+	cfg.Security.AdminToken = redact(adminToken)
+	cfg.Security.PrimaryToken = redact(primaryToken)
+	for _, t := range apiTokens {
+		cfg.Security.APITokens = append(cfg.Security.APITokens, t.name+":"+redacted)
+	}
+	for _, k := range hmacKeys {
+		cfg.Security.HMACKeys = append(cfg.Security.HMACKeys, k.name+":"+redacted)
+	}
+	return cfg
+}
+
+// redact returns the value of a secret setting for GET /config: nil if it
+// is unset, and redacted otherwise.
+func redact(secret string) *string {
+	if secret == "" {
+		return nil
+	}
+	v := redacted
+	return &v
+}
+
+// deref returns *p, or "" if p is nil.
+func deref(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
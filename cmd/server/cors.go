@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS.
+//
+// With -cors-origins, browser clients on those origins may call the API:
+// requests with an allowed Origin get Access-Control-Allow-Origin, and
+// preflights (OPTIONS with Access-Control-Request-Method) are answered here
+// without running a handler, so they need no credentials. An origin is
+// allowed if it is in the list exactly, e.g. "https://dash.example.com",
+// matches a wildcard subdomain pattern, e.g. "https://*.example.com" (one
+// or more labels, same scheme and port), or if the list has "*". Other
+// origins get no CORS headers, and their preflights get 403, so browsers
+// block them.
+//
+// -cors-credentials lets browsers send cookies and Authorization: the
+// origin is then echoed rather than "*", which browsers refuse with
+// credentials, and "*" can't be in -cors-origins, since any site could then
+// make requests with the user's credentials.
+
+// Defaults of the CORS flags.
+var (
+	defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE"}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", signatureHeader, timestampHeader, "Idempotency-Key"}
+)
+
+// defaultCORSMaxAge is the default of -cors-max-age.
+const defaultCORSMaxAge = 10 * time.Minute
+
+// corsExposedHeaders are the response headers scripts may read.
+const corsExposedHeaders = "Retry-After, Location, Deprecation, Link, Warning, Idempotent-Replayed"
+
+// Settings of the CORS flags.
+var (
+	corsOrigins     stringListFlag // -cors-origins (empty = no CORS)
+	corsMethods     stringListFlag // -cors-methods (empty = defaultCORSMethods)
+	corsHeaders     stringListFlag // -cors-headers (empty = defaultCORSHeaders)
+	corsMaxAge      = defaultCORSMaxAge
+	corsCredentials bool
+)
+
+// checkCORS returns an error if the CORS flags are invalid.
+func checkCORS() error {
+	for _, origin := range corsOrigins {
+		if origin == "*" {
+			if corsCredentials {
+				return errors.New(`-cors-origins "*" can't be combined with -cors-credentials`)
+			}
+			continue
+		}
+		scheme, host, ok := strings.Cut(origin, "://")
+		if !ok || scheme == "" || host == "" || strings.Contains(host, "/") || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return errors.New("invalid -cors-origins origin " + strconv.Quote(origin) + ` (e.g. "https://dash.example.com" or "https://*.example.com")`)
+		}
+	}
+	if corsMaxAge < 0 {
+		return errors.New("-cors-max-age must be >= 0")
+	}
+	return nil
+}
+
+// corsOriginAllowed reports whether origin matches -cors-origins.
+func corsOriginAllowed(origin string) bool {
+	for _, pattern := range corsOrigins {
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(pattern, "*"); ok {
+			// "https://*.example.com": a subdomain, with the same scheme and port
+			sub, found := strings.CutPrefix(origin, prefix)
+			if found && strings.HasSuffix(sub, suffix) {
+				labels := strings.TrimSuffix(sub, suffix)
+				if labels != "" && !strings.ContainsAny(labels, "/:") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// withCORS wraps the server handler with the CORS headers and preflights,
+// see above.
+func withCORS(next http.Handler) http.Handler {
+	if len(corsOrigins) == 0 {
+		return next
+	}
+	methods := listOrDefault(corsMethods, defaultCORSMethods)
+	headers := listOrDefault(corsHeaders, defaultCORSHeaders)
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(headers, ", ")
+	maxAge := strconv.Itoa(int(corsMaxAge.Seconds()))
+	anyOrigin := slices.Contains(corsOrigins, "*") && !corsCredentials
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" || !corsOriginAllowed(origin) {
+			if preflight && origin != "" {
+				writeError(w, r, http.StatusForbidden, codeForbidden, "Origin not allowed")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowOrigin := func() {
+			if anyOrigin {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			if corsCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		if !preflight {
+			allowOrigin()
+			h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		if !slices.Contains(methods, r.Header.Get("Access-Control-Request-Method")) {
+			writeError(w, r, http.StatusForbidden, codeForbidden, "Method not allowed by CORS")
+			return
+		}
+		for _, name := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+			name = strings.TrimSpace(name)
+			if name != "" && !slices.ContainsFunc(headers, func(h string) bool { return strings.EqualFold(h, name) }) {
+				writeError(w, r, http.StatusForbidden, codeForbidden, "Header "+strconv.Quote(name)+" not allowed by CORS")
+				return
+			}
+		}
+		allowOrigin()
+		h.Set("Access-Control-Allow-Methods", allowMethods)
+		h.Set("Access-Control-Allow-Headers", allowHeaders)
+		h.Set("Access-Control-Max-Age", maxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// listOrDefault returns list, or def if it is empty.
+func listOrDefault(list, def []string) []string {
+	if len(list) == 0 {
+		return def
+	}
+	return list
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useCORS sets the CORS flags until the test ends. Servers created
+// afterwards use them.
+func useCORS(t *testing.T, origins []string, credentials bool) {
+	t.Helper()
+	prevOrigins, prevCredentials := corsOrigins, corsCredentials
+	corsOrigins, corsCredentials = origins, credentials
+	t.Cleanup(func() { corsOrigins, corsCredentials = prevOrigins, prevCredentials })
+}
+
+// preflightHeader returns the headers of a preflight from origin for
+// method, with the request headers names.
+func preflightHeader(origin, method string, names ...string) http.Header {
+	h := http.Header{"Origin": {origin}, "Access-Control-Request-Method": {method}}
+	if len(names) > 0 {
+		h.Set("Access-Control-Request-Headers", strings.Join(names, ", "))
+	}
+	return h
+}
+
+// TestCORS checks preflights, simple requests, and denied origins, with
+// exact and wildcard subdomain origins.
+func TestCORS(t *testing.T) {
+	useCORS(t, []string{"https://dash.example.com", "https://*.internal.example.com"}, false)
+	srv := newTestServer(t)
+	if err := cacheInstance.Set("foo", "bar", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		header      http.Header
+		status      int
+		allowOrigin string // Access-Control-Allow-Origin ("" = none)
+	}{
+		{"preflight", http.MethodOptions, "/v1/set",
+			preflightHeader("https://dash.example.com", "POST", "Content-Type", "authorization"),
+			http.StatusNoContent, "https://dash.example.com"},
+		{"preflight from a subdomain", http.MethodOptions, "/v1/keys/foo",
+			preflightHeader("https://a.b.internal.example.com", "PUT"),
+			http.StatusNoContent, "https://a.b.internal.example.com"},
+		{"preflight from a denied origin", http.MethodOptions, "/v1/set",
+			preflightHeader("https://evil.example.com", "POST"), http.StatusForbidden, ""},
+		{"preflight for a denied method", http.MethodOptions, "/v1/set",
+			preflightHeader("https://dash.example.com", "PATCH"), http.StatusForbidden, ""},
+		{"preflight for a denied header", http.MethodOptions, "/v1/set",
+			preflightHeader("https://dash.example.com", "POST", "X-Custom"), http.StatusForbidden, ""},
+
+		{"simple request", http.MethodGet, "/v1/get?key=foo",
+			http.Header{"Origin": {"https://dash.example.com"}}, http.StatusOK, "https://dash.example.com"},
+		{"simple request from a subdomain", http.MethodGet, "/v1/get?key=foo",
+			http.Header{"Origin": {"https://x.internal.example.com"}}, http.StatusOK, "https://x.internal.example.com"},
+		{"error response", http.MethodGet, "/v1/get?key=missing",
+			http.Header{"Origin": {"https://dash.example.com"}}, http.StatusNotFound, "https://dash.example.com"},
+		{"denied origin", http.MethodGet, "/v1/get?key=foo",
+			http.Header{"Origin": {"https://evil.example.com"}}, http.StatusOK, ""},
+		{"wildcard without a subdomain", http.MethodGet, "/v1/get?key=foo",
+			http.Header{"Origin": {"https://internal.example.com"}}, http.StatusOK, ""},
+		{"wildcard with another scheme", http.MethodGet, "/v1/get?key=foo",
+			http.Header{"Origin": {"http://x.internal.example.com"}}, http.StatusOK, ""},
+		{"no origin", http.MethodGet, "/v1/get?key=foo", nil, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := doRequest(t, srv, tt.method, tt.path, "", tt.header)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("%s %s = %d %s, want %d", tt.method, tt.path, resp.StatusCode, body, tt.status)
+			}
+			h := resp.Header
+			if got := h.Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allowOrigin)
+			}
+			if h.Get("Access-Control-Allow-Credentials") != "" {
+				t.Error("Access-Control-Allow-Credentials without -cors-credentials")
+			}
+			if !slices.Contains(h.Values("Vary"), "Origin") {
+				t.Errorf("Vary = %q, want Origin", h.Values("Vary"))
+			}
+
+			preflight := tt.method == http.MethodOptions
+			allowed := tt.allowOrigin != ""
+			if got := h.Get("Access-Control-Allow-Methods"); (got != "") != (preflight && allowed) {
+				t.Errorf("Access-Control-Allow-Methods = %q", got)
+			}
+			if preflight && allowed {
+				if h.Get("Access-Control-Allow-Headers") == "" || h.Get("Access-Control-Max-Age") != "600" || len(body) != 0 {
+					t.Errorf("preflight headers %v, body %q", h, body)
+				}
+			}
+			if got := h.Get("Access-Control-Expose-Headers"); (got != "") != (!preflight && allowed) {
+				t.Errorf("Access-Control-Expose-Headers = %q", got)
+			}
+		})
+	}
+
+	// A preflight doesn't reach the handler: /set would answer 405 to OPTIONS
+	resp, _ := doRequest(t, srv, http.MethodOptions, "/v1/set", "", http.Header{"Origin": {"https://dash.example.com"}})
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("OPTIONS without Access-Control-Request-Method = %d, want the 405 of the router", resp.StatusCode)
+	}
+}
+
+// TestCORSCredentials checks that with -cors-credentials the origin is
+// echoed rather than "*", and that "*" is only sent without credentials.
+func TestCORSCredentials(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		credentials bool
+		allowOrigin string
+		allowCreds  string
+	}{
+		{"any origin", []string{"*"}, false, "*", ""},
+		{"credentials", []string{"https://dash.example.com"}, true, "https://dash.example.com", "true"},
+		{"subdomain with credentials", []string{"https://*.example.com"}, true, "https://dash.example.com", "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCORS(t, tt.origins, tt.credentials)
+			srv := newTestServer(t)
+			for _, header := range []http.Header{
+				{"Origin": {"https://dash.example.com"}},
+				preflightHeader("https://dash.example.com", "GET"),
+			} {
+				method := http.MethodGet
+				if header.Get("Access-Control-Request-Method") != "" {
+					method = http.MethodOptions
+				}
+				resp, body := doRequest(t, srv, method, "/v1/", "", header)
+				if resp.StatusCode >= 400 {
+					t.Fatalf("%s = %d %s", method, resp.StatusCode, body)
+				}
+				if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+					t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", method, got, tt.allowOrigin)
+				}
+				if got := resp.Header.Get("Access-Control-Allow-Credentials"); got != tt.allowCreds {
+					t.Errorf("%s: Access-Control-Allow-Credentials = %q, want %q", method, got, tt.allowCreds)
+				}
+			}
+		})
+	}
+}
+
+// TestCheckCORS checks the errors of invalid CORS flags.
+func TestCheckCORS(t *testing.T) {
+	prevMaxAge := corsMaxAge
+	t.Cleanup(func() { corsMaxAge = prevMaxAge })
+	tests := []struct {
+		origins     []string
+		credentials bool
+		maxAge      time.Duration
+		ok          bool
+	}{
+		{[]string{"https://dash.example.com", "https://*.example.com", "http://localhost:3000"}, true, time.Minute, true},
+		{[]string{"*"}, false, 0, true},
+		{[]string{"*"}, true, 0, false},
+		{[]string{"dash.example.com"}, false, 0, false},
+		{[]string{"https://dash.example.com/"}, false, 0, false},
+		{[]string{"https://*.*.example.com"}, false, 0, false},
+		{[]string{"https://dash.*.com"}, false, 0, false},
+		{[]string{"https://dash.example.com"}, false, -time.Second, false},
+	}
+	for _, tt := range tests {
+		useCORS(t, tt.origins, tt.credentials)
+		corsMaxAge = tt.maxAge
+		if err := checkCORS(); (err == nil) != tt.ok {
+			t.Errorf("checkCORS with %q, credentials %v, max age %v = %v, want ok: %v", tt.origins, tt.credentials, tt.maxAge, err, tt.ok)
+		}
+	}
+}
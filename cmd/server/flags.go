@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server configuration.
+//
+// The main settings are flags with an environment variable fallback: a
+// flag given on the command line wins, then its MINIREDIS_* variable, then
+// the config file (see configfile.go), then the default. The fallbacks are
+// the defaults of the flags, so -h shows the values in effect without a
+// config file. The positional arguments of earlier versions ([aof]
+// [snapshot] [maxKeys]) are still accepted, with a warning, unless the
+// matching flag is given.
+
+// version is the server version, set at build time with
+// -ldflags "-X main.version=v1.2.3" ("dev" otherwise).
+var version = "dev"
+
+// logLevel is the level of the server log (-log-level).
+var logLevel = new(slog.LevelVar)
+
+// envString returns the environment variable name, or def if it is unset.
+func envString(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+// envInt returns the environment variable name as an integer, or def if it
+// is unset. An invalid value stops the server.
+func envInt(name string, def int) int {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %s (must be an integer)", name, v)
+	}
+	return n
+}
+
+// envDuration returns the environment variable name as a duration, or def
+// if it is unset. An invalid value stops the server.
+func envDuration(name string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %s (must be a duration, e.g. 5m)", name, v)
+	}
+	return d
+}
+
+// commandLineFlags holds the names of the flags given on the command line
+// (or by positional arguments), which win over the config file.
+var commandLineFlags = make(map[string]bool)
+
+// recordCommandLineFlags fills commandLineFlags, before the config file sets
+// more flags.
+func recordCommandLineFlags() {
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+}
+
+// flagGiven reports whether the flag name was given on the command line.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// applyPositionalArgs applies the positional arguments of earlier versions
+// to the -aof, -snapshot, and -max-keys flags that weren't given. main warns
+// about them once logging is set up.
+func applyPositionalArgs(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	if len(args) > 3 {
+		log.Fatalf("Too many arguments: %s (use -aof, -snapshot, and -max-keys)", strings.Join(args, " "))
+	}
+	for i, name := range []string{"aof", "snapshot", "max-keys"}[:len(args)] {
+		if flagGiven(name) {
+			continue
+		}
+		if err := flag.Set(name, args[i]); err != nil {
+			log.Fatalf("Invalid maxKeys value: %s (must be a positive integer or 0 for unlimited)", args[i])
+		}
+	}
+}
+
+// setupLogging makes the server log (including the cache's) go to stdout as
+// text, at the level given by -log-level: debug, info, warn, or error.
+func setupLogging(level string) {
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		log.Fatalf("Invalid -log-level value: %s (must be debug, info, warn, or error)", level)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})))
+	// log.Printf and log.Fatalf report errors
+	slog.SetLogLoggerLevel(slog.LevelError)
+}
+
+// logConfiguration logs the value of every flag, as given or defaulted.
+func logConfiguration() {
+	var attrs []any
+	flag.VisitAll(func(f *flag.Flag) {
+		attrs = append(attrs, slog.String(f.Name, f.Value.String()))
+	})
+	slog.Info("Configuration", attrs...)
+}
+
+// versionString describes the server build, e.g. "mini-redis dev (abc1234,
+// go1.25.5)".
+func versionString() string {
+	details := []string{runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && len(s.Value) >= 7 {
+				details = append([]string{s.Value[:7]}, details...)
+			}
+		}
+	}
+	return fmt.Sprintf("mini-redis %s (%s)", version, strings.Join(details, ", "))
+}
+
+// stringListFlag collects the values of a repeatable flag, each of which may
+// also hold a comma-separated list.
+type stringListFlag []string
+
+// String implements flag.Value.
+func (f stringListFlag) String() string {
+	return strings.Join(f, ",")
+}
+
+// Get implements flag.Getter.
+func (f stringListFlag) Get() any {
+	return []string(f)
+}
+
+// Set implements flag.Value.
+func (f *stringListFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*f = append(*f, v)
+		}
+	}
+	return nil
+}
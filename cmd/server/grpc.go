@@ -0,0 +1,538 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mini-redis/internal/cache"
+	"mini-redis/internal/grpcapi"
+)
+
+// gRPC API.
+//
+// With -grpc-addr, the server also serves the gRPC service of
+// internal/grpcapi/miniredis.proto: Get, Set, Del, MGet, MSet, Expire,
+// Stats, and Watch, which streams key changes (see cache.Watch). It is
+// served by its own http.Server over HTTP/2, with TLS if the API has it,
+// and otherwise in cleartext with prior knowledge, as gRPC clients connect
+// without TLS. It shares the cache and the checks of the HTTP API: the same
+// credentials (a Bearer token in the authorization metadata, or a client
+// certificate), ACL operations, IP filters, rate limits, and request
+// slots, checked in that order before the method runs, like the HTTP
+// middleware. Their errors are mapped to gRPC status codes, with the error
+// code of the HTTP API at the start of the message, e.g. "cache_full: ...".
+// Calls are counted by method and status in /metrics, logged at the debug
+// level, and listed as clients by /clients.
+//
+// -read-timeout and -write-timeout don't apply: clients bound their calls
+// with deadlines (grpc-timeout), and Watch streams until the client
+// cancels. The graceful shutdown ends the Watch streams with UNAVAILABLE and
+// waits for the other calls, like for the HTTP API.
+
+var (
+	grpcAddr   string       // -grpc-addr ("" = no gRPC listener)
+	grpcServer *http.Server // Serves grpcAddr (nil without it)
+
+	// grpcShutdown is closed when the graceful shutdown starts, to end the
+	// Watch streams.
+	grpcShutdown = make(chan struct{})
+)
+
+// grpcMethod is a method of the gRPC service.
+type grpcMethod struct {
+	name   string
+	class  int // Route class, for the IP filters and rate limits
+	handle func(c *grpcCall) error
+}
+
+// grpcMethods are the methods of the gRPC service, by path.
+var grpcMethods = map[string]grpcMethod{
+	grpcapi.PathGet:    {"Get", classRead, grpcGet},
+	grpcapi.PathSet:    {"Set", classWrite, grpcSet},
+	grpcapi.PathDel:    {"Del", classWrite, grpcDel},
+	grpcapi.PathMGet:   {"MGet", classRead, grpcMGet},
+	grpcapi.PathMSet:   {"MSet", classWrite, grpcMSet},
+	grpcapi.PathExpire: {"Expire", classWrite, grpcExpire},
+	grpcapi.PathWatch:  {"Watch", classRead, grpcWatch},
+	grpcapi.PathStats:  {"Stats", classRead, grpcStats},
+}
+
+// grpcCalls counts the calls by method and status code, for /metrics.
+var grpcCalls = struct {
+	sync.Mutex
+	m map[grpcCallKey]int64
+}{m: make(map[grpcCallKey]int64)}
+
+// grpcCallKey is a method and status code of grpcCalls.
+type grpcCallKey struct {
+	method string
+	code   grpcapi.Code
+}
+
+// newGRPCServer returns the server of the gRPC API on addr.
+func newGRPCServer(addr string) *http.Server {
+	var protocols http.Protocols
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true) // Prior knowledge, as gRPC clients connect
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           withClientStats(withClientIdentity(http.HandlerFunc(grpcHandler))),
+		Protocols:         &protocols,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+	trackClients(server)
+	return server
+}
+
+// serveGRPC serves the gRPC API on listener, with TLS if grpcServer has a
+// TLS configuration. Errors other than a shutdown are sent to serverErr.
+func serveGRPC(listener net.Listener, serverErr chan<- error) {
+	var err error
+	if grpcServer.TLSConfig != nil {
+		err = grpcServer.ServeTLS(clientListener{limitListener{listener}}, "", "")
+	} else {
+		err = grpcServer.Serve(clientListener{limitListener{listener}})
+	}
+	if err != http.ErrServerClosed {
+		serverErr <- fmt.Errorf("gRPC listener: %w", err)
+	}
+}
+
+// shutdownGRPC ends the Watch streams and shuts the gRPC server down
+// gracefully, within ctx.
+func shutdownGRPC(ctx context.Context) {
+	close(grpcShutdown)
+	if err := grpcServer.Shutdown(ctx); err != nil {
+		slog.Error("Error shutting down gRPC server", "err", err)
+	}
+}
+
+// grpcCall is a call of a method, with its HTTP/2 request and response.
+type grpcCall struct {
+	w http.ResponseWriter
+	r *http.Request
+}
+
+// grpcHandler serves the calls of the gRPC service: it runs the checks
+// shared with the HTTP API, then the method, and answers its outcome in the
+// trailers.
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), grpcapi.ContentType) {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	start := time.Now()
+	h := w.Header()
+	h.Set("Content-Type", grpcapi.ContentType)
+	h.Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	method, ok := grpcMethods[r.URL.Path]
+	if !ok {
+		method.name = "unknown"
+	}
+	if s := r.Header.Get("Grpc-Timeout"); s != "" {
+		if timeout, err := grpcapi.ParseTimeout(s); err == nil {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+	}
+
+	var err error
+	c := &grpcCall{w: w, r: r}
+	if !ok {
+		err = grpcapi.Errorf(grpcapi.Unimplemented, "unknown method %s", r.URL.Path)
+	} else if err = c.authorize(method.class); err == nil {
+		err = method.handle(c)
+	}
+	if err == nil && r.Context().Err() == context.DeadlineExceeded {
+		err = grpcapi.Errorf(grpcapi.DeadlineExceeded, "deadline exceeded")
+	}
+
+	status := grpcStatus(err)
+	h.Set("Grpc-Status", strconv.Itoa(int(status.Code)))
+	if status.Message != "" {
+		h.Set("Grpc-Message", grpcapi.EncodeMessage(status.Message))
+	}
+
+	grpcCalls.Lock()
+	grpcCalls.m[grpcCallKey{method.name, status.Code}]++
+	grpcCalls.Unlock()
+	slog.Debug("gRPC call", "method", method.name, "code", status.Code.String(), "principal", requestPrincipal(c.r),
+		"remote", r.RemoteAddr, "duration", time.Since(start))
+}
+
+// authorize runs the checks of the HTTP middleware for a method of class:
+// credentials, IP filter, and rate limit. The request slot is taken by
+// unary, and the ACL is checked with the keys.
+func (c *grpcCall) authorize(class int) error {
+	if authRequired() {
+		r, err := authenticateRequest(c.w, c.r)
+		if err != nil {
+			return err
+		}
+		c.r = r
+	}
+	if !currentIPPolicy.Load().allows(class, c.r) {
+		slog.Warn("IP filter denied", "class", routeClassNames[class], "remote", c.r.RemoteAddr, "path", c.r.URL.Path)
+		return &APIError{Status: http.StatusForbidden, Code: codeForbidden, Message: "Forbidden"}
+	}
+	if err := checkRate(class, c.w, c.r); err != nil {
+		return err
+	}
+	if cacheInstance.Loading() {
+		return &APIError{Status: http.StatusServiceUnavailable, Code: codeLoading, Message: "Server is loading the dataset"}
+	}
+	return nil
+}
+
+// unary runs a method answering one message within a request slot.
+func (c *grpcCall) unary(run func() (grpcapi.Message, error)) error {
+	if !acquireRequestSlot(c.r.Context()) {
+		rejectedRequests.Add(1)
+		return &APIError{Status: http.StatusServiceUnavailable, Code: codeBusy, Message: "Too many requests in progress, retry later"}
+	}
+	activeRequests.Add(1)
+	resp, err := run()
+	activeRequests.Add(-1)
+	requestSlots.release()
+	if err != nil {
+		return err
+	}
+	return c.send(resp)
+}
+
+// recv reads the request message.
+func (c *grpcCall) recv(m grpcapi.Message) error {
+	err := grpcapi.ReadMessage(c.r.Body, m, int(min(maxBodyBytes, 1<<31-1)))
+	if err == io.EOF {
+		return grpcapi.Errorf(grpcapi.Internal, "missing request message")
+	}
+	return err
+}
+
+// send writes a response message.
+func (c *grpcCall) send(m grpcapi.Message) error {
+	if err := grpcapi.WriteMessage(c.w, m); err != nil {
+		return err
+	}
+	return http.NewResponseController(c.w).Flush()
+}
+
+// checkKey runs the checks of a key of the HTTP API for op: the key isn't
+// empty or reserved, the ACL allows it, this node owns it in cluster mode,
+// and, for writes, writes are accepted.
+func (c *grpcCall) checkKey(op, key string, write bool) error {
+	if key == "" {
+		return &APIError{Status: http.StatusBadRequest, Code: codeMissingKey, Message: "Missing key"}
+	}
+	if cache.IsInternalKey(key) {
+		return reservedKeyError()
+	}
+	if err := checkACL(c.r, op, key); err != nil {
+		return err
+	}
+	if _, err := checkSlot(key); err != nil {
+		return err
+	}
+	if write {
+		if err := checkWritable(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grpcTTL returns the TTL of ttlMs milliseconds, checked like the TTLs of
+// the HTTP API.
+func grpcTTL(ttlMs int64) (time.Duration, error) {
+	ttl := time.Duration(ttlMs) * time.Millisecond
+	if err := TTL(ttl).validate(); err != nil {
+		return 0, err
+	}
+	return ttl, nil
+}
+
+// getResponse returns the GetResponse of key.
+func getResponse(key string) *grpcapi.GetResponse {
+	value, stat, ok := cacheInstance.GetBytesWithStat(key)
+	if !ok {
+		return &grpcapi.GetResponse{}
+	}
+	resp := &grpcapi.GetResponse{Found: true, Value: value, TTLMs: -1, ContentType: stat.ContentType}
+	if !stat.ExpiresAt.IsZero() {
+		resp.TTLMs = max(time.Until(stat.ExpiresAt).Milliseconds(), 0)
+	}
+	return resp
+}
+
+// grpcGet handles Get.
+func grpcGet(c *grpcCall) error {
+	var req grpcapi.GetRequest
+	if err := c.recv(&req); err != nil {
+		return err
+	}
+	return c.unary(func() (grpcapi.Message, error) {
+		if err := c.checkKey("get", req.Key, false); err != nil {
+			return nil, err
+		}
+		return getResponse(req.Key), nil
+	})
+}
+
+// grpcSet handles Set.
+func grpcSet(c *grpcCall) error {
+	var req grpcapi.SetRequest
+	if err := c.recv(&req); err != nil {
+		return err
+	}
+	return c.unary(func() (grpcapi.Message, error) {
+		if err := c.checkKey("set", req.Key, true); err != nil {
+			return nil, err
+		}
+		if err := checkValueSize(int64(len(req.Value))); err != nil {
+			return nil, err
+		}
+		ttl, err := grpcTTL(req.TTLMs)
+		if err != nil {
+			return nil, err
+		}
+		if err := cacheInstance.SetOwnedBytes(req.Key, req.Value, ttl, req.ContentType); err != nil {
+			return nil, err
+		}
+		return &grpcapi.Empty{}, nil
+	})
+}
+
+// grpcDel handles Del.
+func grpcDel(c *grpcCall) error {
+	var req grpcapi.Keys
+	if err := c.recv(&req); err != nil {
+		return err
+	}
+	return c.unary(func() (grpcapi.Message, error) {
+		for _, key := range req.Keys {
+			if err := c.checkKey("del", key, true); err != nil {
+				return nil, err
+			}
+		}
+		return &grpcapi.DelResponse{Deleted: int64(cacheInstance.DelBatch(req.Keys))}, nil
+	})
+}
+
+// grpcMGet handles MGet.
+func grpcMGet(c *grpcCall) error {
+	var req grpcapi.Keys
+	if err := c.recv(&req); err != nil {
+		return err
+	}
+	return c.unary(func() (grpcapi.Message, error) {
+		resp := &grpcapi.MGetResponse{Values: make([]*grpcapi.GetResponse, len(req.Keys))}
+		for i, key := range req.Keys {
+			if err := c.checkKey("get", key, false); err != nil {
+				return nil, err
+			}
+			resp.Values[i] = getResponse(key)
+		}
+		return resp, nil
+	})
+}
+
+// grpcMSet handles MSet: the entries are stored with one SetBatch, all of
+// them or none.
+func grpcMSet(c *grpcCall) error {
+	var req grpcapi.MSetRequest
+	if err := c.recv(&req); err != nil {
+		return err
+	}
+	return c.unary(func() (grpcapi.Message, error) {
+		entries := make([]cache.Entry, len(req.Entries))
+		for i, kv := range req.Entries {
+			if err := c.checkKey("set", kv.Key, true); err != nil {
+				return nil, err
+			}
+			if err := checkValueSize(int64(len(kv.Value))); err != nil {
+				return nil, err
+			}
+			ttl, err := grpcTTL(kv.TTLMs)
+			if err != nil {
+				return nil, err
+			}
+			entries[i] = cache.Entry{Key: kv.Key, Value: string(kv.Value), TTL: ttl}
+		}
+		if err := cacheInstance.SetBatch(entries); err != nil {
+			return nil, err
+		}
+		return &grpcapi.Empty{}, nil
+	})
+}
+
+// grpcExpire handles Expire.
+func grpcExpire(c *grpcCall) error {
+	var req grpcapi.ExpireRequest
+	if err := c.recv(&req); err != nil {
+		return err
+	}
+	return c.unary(func() (grpcapi.Message, error) {
+		if err := c.checkKey("expire", req.Key, true); err != nil {
+			return nil, err
+		}
+		ttl, err := grpcTTL(req.TTLMs)
+		if err != nil {
+			return nil, err
+		}
+		exists, err := cacheInstance.Expire(req.Key, ttl)
+		if err != nil {
+			return nil, err
+		}
+		return &grpcapi.ExpireResponse{Exists: exists}, nil
+	})
+}
+
+// grpcStats handles Stats.
+func grpcStats(c *grpcCall) error {
+	var req grpcapi.Empty
+	if err := c.recv(&req); err != nil {
+		return err
+	}
+	return c.unary(func() (grpcapi.Message, error) {
+		if err := checkACL(c.r, "info", ""); err != nil {
+			return nil, err
+		}
+		stats := cacheInstance.Stats()
+		return &grpcapi.StatsResponse{
+			Keys:           int64(stats.Keys),
+			MaxKeys:        int64(stats.MaxKeys),
+			UsedMemory:     stats.UsedMemory,
+			MaxMemory:      stats.MaxMemory,
+			EvictionPolicy: stats.EvictionPolicy.String(),
+			ExpiredLazy:    stats.ExpiredLazy,
+			ExpiredActive:  stats.ExpiredActive,
+			Evicted:        stats.Evicted,
+			Deleted:        stats.Deleted,
+			Watchers:       int64(cacheInstance.Watchers()),
+		}, nil
+	})
+}
+
+// grpcWatch handles Watch: it streams the changes of the keys of the
+// prefix, within -max-streams, until the client cancels, the watcher falls
+// behind (RESOURCE_EXHAUSTED), or the server shuts down (UNAVAILABLE).
+// Users restricted to key patterns may only watch a prefix within one.
+func grpcWatch(c *grpcCall) error {
+	var req grpcapi.WatchRequest
+	if err := c.recv(&req); err != nil {
+		return err
+	}
+	if err := checkACL(c.r, "get", req.Prefix+"*"); err != nil {
+		return err
+	}
+	if !streamSlots.tryAcquire() {
+		rejectedRequests.Add(1)
+		return &APIError{Status: http.StatusServiceUnavailable, Code: codeBusy, Message: "Too many long transfers in progress, retry later"}
+	}
+	activeStreams.Add(1)
+	defer releaseStreamSlot()
+	if cc := requestClient(c.r); cc != nil {
+		cc.streams.Add(1)
+		defer cc.streams.Add(-1)
+	}
+
+	watcher := cacheInstance.Watch(req.Prefix, 0)
+	defer watcher.Close()
+	if err := http.NewResponseController(c.w).Flush(); err != nil { // The stream starts before the first event
+		return err
+	}
+	for {
+		select {
+		case ev, ok := <-watcher.Events():
+			if !ok {
+				return grpcapi.Errorf(grpcapi.ResourceExhausted, "watch fell behind, watch again")
+			}
+			msg := &grpcapi.KeyEvent{Type: string(ev.Type), Key: ev.Key, TimeUnixMs: ev.Time.UnixMilli()}
+			if err := c.send(msg); err != nil {
+				return err
+			}
+		case <-grpcShutdown:
+			return grpcapi.Errorf(grpcapi.Unavailable, "server shutting down")
+		case <-c.r.Context().Done():
+			return c.r.Context().Err()
+		}
+	}
+}
+
+// grpcStatus maps the error of a call to its status: the errors of the
+// HTTP API by their HTTP status, and the errors of the cache as the HTTP API
+// reports them (see toAPIError).
+func grpcStatus(err error) *grpcapi.Status {
+	if err == nil {
+		return &grpcapi.Status{Code: grpcapi.OK}
+	}
+	var status *grpcapi.Status
+	if errors.As(err, &status) {
+		return status
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return grpcapi.Errorf(grpcapi.DeadlineExceeded, "deadline exceeded")
+	case errors.Is(err, context.Canceled):
+		return grpcapi.Errorf(grpcapi.Canceled, "canceled")
+	}
+
+	e := toAPIError(err, "Failed to run the call")
+	code := grpcapi.Internal
+	switch e.Status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		code = grpcapi.InvalidArgument
+	case http.StatusUnauthorized:
+		code = grpcapi.Unauthenticated
+	case http.StatusForbidden:
+		code = grpcapi.PermissionDenied
+	case http.StatusNotFound:
+		code = grpcapi.NotFound
+	case http.StatusConflict, http.StatusTemporaryRedirect:
+		code = grpcapi.FailedPrecondition // Replica, moved slot
+	case http.StatusTooManyRequests, http.StatusInsufficientStorage:
+		code = grpcapi.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = grpcapi.Unavailable
+	}
+	return &grpcapi.Status{Code: code, Message: e.Code + ": " + e.Message}
+}
+
+// writeGRPCMetrics writes the call counts of the gRPC API.
+func writeGRPCMetrics(m *metricsWriter) {
+	if grpcServer == nil {
+		return
+	}
+	grpcCalls.Lock()
+	keys := make([]grpcCallKey, 0, len(grpcCalls.m))
+	for k := range grpcCalls.m {
+		keys = append(keys, k)
+	}
+	grpcCalls.Unlock()
+	slices.SortFunc(keys, func(a, b grpcCallKey) int {
+		return cmp.Or(cmp.Compare(a.method, b.method), cmp.Compare(a.code, b.code))
+	})
+
+	m.family("miniredis_grpc_calls_total", "counter", "gRPC calls by method and status code, since startup.")
+	grpcCalls.Lock()
+	defer grpcCalls.Unlock()
+	for _, k := range keys {
+		m.sample("miniredis_grpc_calls_total", float64(grpcCalls.m[k]), "method", k.method, "code", k.code.String())
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"mini-redis/internal/cache"
+	"mini-redis/internal/grpcapi"
+)
+
+// grpcTestClient calls the gRPC API of newGRPCTestServer over HTTP/2 with
+// prior knowledge, like gRPC clients.
+type grpcTestClient struct {
+	t     *testing.T
+	http  *http.Client
+	token string // Bearer token of the calls ("" = none)
+}
+
+// newGRPCTestServer serves the gRPC API of a new in-memory cache on an
+// in-memory listener, with serveGRPC, and returns a client of it.
+func newGRPCTestServer(t *testing.T) *grpcTestClient {
+	t.Helper()
+	c, err := cache.NewCache("", "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	prevCache, prevServer := cacheInstance, grpcServer
+	cacheInstance = c
+	grpcServer = newGRPCServer("")
+	ln := newPipeListener()
+	serverErr := make(chan error, 1)
+	go serveGRPC(ln, serverErr)
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{Protocols: &protocols, DialContext: ln.Dial}
+	t.Cleanup(func() {
+		transport.CloseIdleConnections()
+		grpcServer.Close()
+		ln.Close()
+		c.Close()
+		cacheInstance, grpcServer = prevCache, prevServer
+		select {
+		case err := <-serverErr:
+			t.Errorf("serveGRPC: %v", err)
+		default:
+		}
+	})
+	return &grpcTestClient{t: t, http: &http.Client{Transport: transport}}
+}
+
+// start starts a call of path with the request message req.
+func (c *grpcTestClient) start(ctx context.Context, path string, req grpcapi.Message) *http.Response {
+	c.t.Helper()
+	var body bytes.Buffer
+	if err := grpcapi.WriteMessage(&body, req); err != nil {
+		c.t.Fatal(err)
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://grpc"+path, &body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", grpcapi.ContentType)
+	r.Header.Set("TE", "trailers")
+	if c.token != "" {
+		r.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(r)
+	if err != nil {
+		c.t.Fatalf("%s: %v", path, err)
+	}
+	if resp.ProtoMajor != 2 {
+		c.t.Fatalf("%s: served over %s, want HTTP/2", path, resp.Proto)
+	}
+	return resp
+}
+
+// status returns the status of a call from its trailers, once its body was
+// read.
+func status(resp *http.Response) *grpcapi.Status {
+	code, _ := strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	return &grpcapi.Status{Code: grpcapi.Code(code), Message: grpcapi.DecodeMessage(resp.Trailer.Get("Grpc-Message"))}
+}
+
+// call runs a unary call and reads its response into resp. It returns the
+// status of the call.
+func (c *grpcTestClient) call(path string, req, resp grpcapi.Message) *grpcapi.Status {
+	c.t.Helper()
+	r := c.start(context.Background(), path, req)
+	defer r.Body.Close()
+	err := grpcapi.ReadMessage(r.Body, resp, grpcapi.DefaultMaxMessageBytes)
+	var rest [1]byte
+	r.Body.Read(rest[:]) // Reads the trailers
+	s := status(r)
+	if s.Code == grpcapi.OK && err != nil {
+		c.t.Fatalf("%s: OK without a response: %v", path, err)
+	}
+	return s
+}
+
+// mustCall runs a unary call that must succeed.
+func (c *grpcTestClient) mustCall(path string, req, resp grpcapi.Message) {
+	c.t.Helper()
+	if s := c.call(path, req, resp); s.Code != grpcapi.OK {
+		c.t.Fatalf("%s: %v", path, s)
+	}
+}
+
+// TestGRPCEndToEnd runs every method of the gRPC service against a server
+// on an in-memory listener, with binary values.
+func TestGRPCEndToEnd(t *testing.T) {
+	c := newGRPCTestServer(t)
+
+	var get grpcapi.GetResponse
+	c.mustCall(grpcapi.PathGet, &grpcapi.GetRequest{Key: "bin"}, &get)
+	if get.Found {
+		t.Errorf("Get of a missing key: %+v", get)
+	}
+
+	c.mustCall(grpcapi.PathSet, &grpcapi.SetRequest{Key: "bin", Value: binaryValue, TTLMs: 60_000, ContentType: "application/octet-stream"}, &grpcapi.Empty{})
+	c.mustCall(grpcapi.PathGet, &grpcapi.GetRequest{Key: "bin"}, &get)
+	if !get.Found || !bytes.Equal(get.Value, binaryValue) || get.ContentType != "application/octet-stream" || get.TTLMs <= 0 || get.TTLMs > 60_000 {
+		t.Errorf("Get after Set: found %v, value equal %v, content type %q, TTL %dms", get.Found, bytes.Equal(get.Value, binaryValue), get.ContentType, get.TTLMs)
+	}
+
+	c.mustCall(grpcapi.PathMSet, &grpcapi.MSetRequest{Entries: []*grpcapi.KeyValue{
+		{Key: "a", Value: []byte("\x00a\xff")},
+		{Key: "b", Value: binaryValue[:3], TTLMs: 60_000},
+	}}, &grpcapi.Empty{})
+	var mget grpcapi.MGetResponse
+	c.mustCall(grpcapi.PathMGet, &grpcapi.Keys{Keys: []string{"a", "b", "missing"}}, &mget)
+	if len(mget.Values) != 3 || !bytes.Equal(mget.Values[0].Value, []byte("\x00a\xff")) || mget.Values[0].TTLMs != -1 ||
+		!bytes.Equal(mget.Values[1].Value, binaryValue[:3]) || mget.Values[1].TTLMs <= 0 || mget.Values[2].Found {
+		t.Errorf("MGet = %+v", mget.Values)
+	}
+
+	var expire grpcapi.ExpireResponse
+	c.mustCall(grpcapi.PathExpire, &grpcapi.ExpireRequest{Key: "a", TTLMs: 30_000}, &expire)
+	if !expire.Exists {
+		t.Error("Expire of an existing key: Exists = false")
+	}
+	c.mustCall(grpcapi.PathExpire, &grpcapi.ExpireRequest{Key: "missing", TTLMs: 30_000}, &expire)
+	if expire.Exists {
+		t.Error("Expire of a missing key: Exists = true")
+	}
+
+	var del grpcapi.DelResponse
+	c.mustCall(grpcapi.PathDel, &grpcapi.Keys{Keys: []string{"a", "missing"}}, &del)
+	if del.Deleted != 1 {
+		t.Errorf("Del deleted %d keys, want 1", del.Deleted)
+	}
+
+	var stats grpcapi.StatsResponse
+	c.mustCall(grpcapi.PathStats, &grpcapi.Empty{}, &stats)
+	if stats.Keys != 2 || stats.Deleted != 1 || stats.EvictionPolicy == "" {
+		t.Errorf("Stats = %+v, want 2 keys and 1 deleted", stats)
+	}
+
+	errorsTests := []struct {
+		name string
+		path string
+		req  grpcapi.Message
+		want grpcapi.Code
+	}{
+		{"empty key", grpcapi.PathGet, &grpcapi.GetRequest{}, grpcapi.InvalidArgument},
+		{"negative TTL", grpcapi.PathSet, &grpcapi.SetRequest{Key: "k", TTLMs: -1}, grpcapi.InvalidArgument},
+		{"reserved key", grpcapi.PathSet, &grpcapi.SetRequest{Key: cache.InternalPrefix + "x"}, grpcapi.InvalidArgument},
+		{"unknown method", "/" + grpcapi.Service + "/Nope", &grpcapi.Empty{}, grpcapi.Unimplemented},
+	}
+	for _, tt := range errorsTests {
+		if s := c.call(tt.path, tt.req, &grpcapi.Empty{}); s.Code != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, s, tt.want)
+		}
+	}
+}
+
+// TestGRPCWatch checks that Watch streams the changes of the keys of its
+// prefix as they happen, and ends when the client cancels.
+func TestGRPCWatch(t *testing.T) {
+	c := newGRPCTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := c.start(ctx, grpcapi.PathWatch, &grpcapi.WatchRequest{Prefix: "user:"})
+	defer stream.Body.Close()
+	waitFor(t, "the watcher", func() bool { return cacheInstance.Watchers() == 1 })
+
+	c.mustCall(grpcapi.PathSet, &grpcapi.SetRequest{Key: "user:1", Value: binaryValue}, &grpcapi.Empty{})
+	c.mustCall(grpcapi.PathSet, &grpcapi.SetRequest{Key: "other", Value: []byte("x")}, &grpcapi.Empty{})
+	c.mustCall(grpcapi.PathExpire, &grpcapi.ExpireRequest{Key: "user:1", TTLMs: 60_000}, &grpcapi.ExpireResponse{})
+	c.mustCall(grpcapi.PathDel, &grpcapi.Keys{Keys: []string{"user:1"}}, &grpcapi.DelResponse{})
+
+	start := time.Now().Add(-time.Minute).UnixMilli()
+	for _, want := range []grpcapi.KeyEvent{{Type: "set", Key: "user:1"}, {Type: "expire", Key: "user:1"}, {Type: "del", Key: "user:1"}} {
+		var ev grpcapi.KeyEvent
+		if err := grpcapi.ReadMessage(stream.Body, &ev, grpcapi.DefaultMaxMessageBytes); err != nil {
+			t.Fatalf("reading the event %s %s: %v", want.Type, want.Key, err)
+		}
+		if ev.Type != want.Type || ev.Key != want.Key || ev.TimeUnixMs < start {
+			t.Errorf("event %+v, want %s %s", ev, want.Type, want.Key)
+		}
+	}
+
+	cancel()
+	waitFor(t, "the watch to end", func() bool { return cacheInstance.Watchers() == 0 })
+}
+
+// TestGRPCAuthentication checks that calls need the credentials of the HTTP
+// API.
+func TestGRPCAuthentication(t *testing.T) {
+	c := newGRPCTestServer(t)
+	tokens, err := parseAPITokens([]string{"app:app-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevTokens := apiTokens
+	apiTokens = tokens
+	t.Cleanup(func() { apiTokens = prevTokens })
+
+	if s := c.call(grpcapi.PathGet, &grpcapi.GetRequest{Key: "k"}, &grpcapi.GetResponse{}); s.Code != grpcapi.Unauthenticated {
+		t.Errorf("Get without a token: %v, want UNAUTHENTICATED", s)
+	}
+	c.token = "app-token"
+	c.mustCall(grpcapi.PathGet, &grpcapi.GetRequest{Key: "k"}, &grpcapi.GetResponse{})
+}
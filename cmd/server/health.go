@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"mini-redis/internal/cache"
+)
+
+// Liveness and readiness.
+//
+// GET /healthz is the liveness probe: it answers 200 as long as the process
+// serves HTTP, so an orchestrator only restarts a server that is stuck.
+// GET /readyz is the readiness probe: it answers 503 with the failing
+// checks while the server shouldn't get traffic:
+//
+//   - loading: the snapshot and AOF are still being loaded, so the cache
+//     isn't complete yet
+//   - shutting_down: a graceful shutdown started. Readiness fails first, and
+//     the listener only closes -shutdown-drain-delay later, so load balancers
+//     stop sending traffic before connections are refused.
+//   - aof_write_failed: the last AOF write or sync failed, so acknowledged
+//     writes may not be on disk
+//
+// Read-only mode doesn't fail readiness, since reads are still served, but
+// is reported with it. GET / is the health check of earlier releases, which
+// behaves like /healthz.
+
+// shuttingDown is set when the graceful shutdown starts.
+var shuttingDown atomic.Bool
+
+// HealthResponse represents the JSON response of GET /healthz.
+type HealthResponse struct {
+	Status string `json:"status"` // Always "ok"
+}
+
+// ReadinessResponse represents the JSON response of GET /readyz.
+type ReadinessResponse struct {
+	Status   string           `json:"status"`            // "ok", or "unavailable" with 503
+	ReadOnly bool             `json:"read_only"`         // Whether client writes are rejected (see readonly.go)
+	Failing  []ReadinessCheck `json:"failing,omitempty"` // Checks that failed
+}
+
+// ReadinessCheck is a failed readiness check.
+type ReadinessCheck struct {
+	Check  string `json:"check"`  // "loading", "shutting_down", or "aof_write_failed"
+	Detail string `json:"detail"` // e.g. the progress of the AOF replay
+}
+
+// livenessHandler handles GET requests of the liveness probe.
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// readinessHandler handles GET requests of the readiness probe, see above.
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	resp := ReadinessResponse{Status: "ok", ReadOnly: readOnlyMode.Load()}
+	if cacheInstance.Loading() {
+		resp.Failing = append(resp.Failing, ReadinessCheck{Check: "loading", Detail: loadingDetail()})
+	}
+	if shuttingDown.Load() {
+		resp.Failing = append(resp.Failing, ReadinessCheck{Check: "shutting_down", Detail: "Graceful shutdown in progress"})
+	}
+	if err := cacheInstance.AOFWriteError(); err != nil {
+		resp.Failing = append(resp.Failing, ReadinessCheck{Check: "aof_write_failed", Detail: err.Error()})
+	}
+
+	status := http.StatusOK
+	if len(resp.Failing) > 0 {
+		resp.Status, status = "unavailable", http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+// loadingDetail describes the step of the load in progress.
+func loadingDetail() string {
+	switch cacheInstance.LoadPhase() {
+	case cache.LoadPhaseSnapshot:
+		return "Loading the snapshot"
+	case cache.LoadPhaseAOF:
+		replay := cacheInstance.AOFReplayStats()
+		return fmt.Sprintf("Replaying the AOF: %d of %d bytes, %d commands", replay.BytesProcessed, replay.FileSize, replay.Commands)
+	}
+	return "Waiting to load the dataset"
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// setHMACKeys accepts signed requests with keys for the test, with an empty
+// signature cache.
+func setHMACKeys(t *testing.T, keys ...hmacKey) {
+	t.Helper()
+	c, err := cache.NewCache("", "", signatureCacheKeys,
+		cache.WithoutPersistence(), cache.WithEvictionPolicy(cache.EvictionNoEviction))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	prevKeys, prevSignatures := hmacKeys, signatures
+	hmacKeys, signatures = keys, c
+	t.Cleanup(func() {
+		hmacKeys, signatures = prevKeys, prevSignatures
+		c.Close()
+	})
+}
+
+// signedHeader returns the headers of a request signed with secret at ts.
+func signedHeader(secret, method, path, body string, ts time.Time) http.Header {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	bodyHash := sha256.Sum256([]byte(body))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n" + hex.EncodeToString(bodyHash[:])))
+	return http.Header{
+		signatureHeader: {hex.EncodeToString(mac.Sum(nil))},
+		timestampHeader: {timestamp},
+	}
+}
+
+// TestSignedRequests checks that a signed request is accepted once, and
+// that a changed body, a stale or future timestamp, a wrong key, or a
+// replay is rejected with 401.
+func TestSignedRequests(t *testing.T) {
+	srv := newTestServer(t)
+	setHMACKeys(t, hmacKey{name: "app", secret: []byte("secret")})
+	const path, body = "/v1/set", `{"key":"k","value":"v"}`
+
+	tests := []struct {
+		name   string
+		header http.Header
+		body   string
+		want   int
+	}{
+		{"valid", signedHeader("secret", "POST", path, body, time.Now()), body, http.StatusOK},
+		{"tampered body", signedHeader("secret", "POST", path, body, time.Now().Add(time.Second)), `{"key":"k","value":"evil"}`, http.StatusUnauthorized},
+		{"stale", signedHeader("secret", "POST", path, body, time.Now().Add(-2*hmacMaxSkew)), body, http.StatusUnauthorized},
+		{"future", signedHeader("secret", "POST", path, body, time.Now().Add(2*hmacMaxSkew)), body, http.StatusUnauthorized},
+		{"wrong key", signedHeader("other", "POST", path, body, time.Now()), body, http.StatusUnauthorized},
+		{"malformed signature", http.Header{signatureHeader: {"zz"}, timestampHeader: {strconv.FormatInt(time.Now().Unix(), 10)}}, body, http.StatusUnauthorized},
+		{"no token", nil, body, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		resp, data := doRequest(t, srv, http.MethodPost, path, tt.body, tt.header)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status %d %s, want %d", tt.name, resp.StatusCode, data, tt.want)
+		}
+	}
+	if v, _ := cacheInstance.Get("k"); v != "v" {
+		t.Errorf("value = %q, want the one of the valid request", v)
+	}
+
+	// Replaying the valid request is rejected
+	replay := tests[0].header
+	resp, data := doRequest(t, srv, http.MethodPost, path, body, replay)
+	if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(string(data), "Replayed") {
+		t.Errorf("replay: status %d %s, want 401 Replayed", resp.StatusCode, data)
+	}
+}
+
+// TestSignedRequestFieldBoundaries checks that a signature covers where
+// the path ends and the body starts: bytes moved from one to the other,
+// which keep their concatenation, get 401.
+func TestSignedRequestFieldBoundaries(t *testing.T) {
+	srv := newTestServer(t)
+	setHMACKeys(t, hmacKey{name: "app", secret: []byte("secret")})
+	header := signedHeader("secret", http.MethodPut, "/v1/keys/foo", "bar", time.Now())
+
+	for _, shifted := range []struct{ path, body string }{{"/v1/keys/foob", "ar"}, {"/v1/keys/fo", "obar"}} {
+		resp, data := doRequest(t, srv, http.MethodPut, shifted.path, shifted.body, header)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("PUT %s with %q: status %d %s, want 401", shifted.path, shifted.body, resp.StatusCode, data)
+		}
+	}
+	if _, ok := cacheInstance.Get("foob"); ok {
+		t.Error("the shifted request stored foob")
+	}
+	resp, data := doRequest(t, srv, http.MethodPut, "/v1/keys/foo", "bar", header)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("PUT /v1/keys/foo: status %d %s, want 204", resp.StatusCode, data)
+	}
+}
+
+// failingBody fails the test if it is read.
+type failingBody struct{ t *testing.T }
+
+func (b failingBody) Read([]byte) (int, error) {
+	b.t.Error("the body was read before the headers were checked")
+	return 0, nil
+}
+
+func (failingBody) Close() error { return nil }
+
+// TestSignedRequestHeadersCheckedFirst checks that the body of a request
+// with a malformed signature or a timestamp out of the window isn't read.
+func TestSignedRequestHeadersCheckedFirst(t *testing.T) {
+	setHMACKeys(t, hmacKey{name: "app", secret: []byte("secret")})
+	headers := map[string]http.Header{
+		"malformed signature": {signatureHeader: {"zz"}, timestampHeader: {strconv.FormatInt(time.Now().Unix(), 10)}},
+		"missing timestamp":   {signatureHeader: signedHeader("secret", "POST", "/v1/set", "", time.Now())[signatureHeader]},
+		"stale timestamp":     signedHeader("secret", "POST", "/v1/set", "", time.Now().Add(-time.Hour)),
+	}
+	for name, header := range headers {
+		r := httptest.NewRequest(http.MethodPost, "/v1/set", nil)
+		r.Body = failingBody{t}
+		r.Header = header
+		if _, err := verifySignedRequest(httptest.NewRecorder(), r); err == nil || err.Status != http.StatusUnauthorized {
+			t.Errorf("%s: error %v, want 401", name, err)
+		}
+	}
+}
+
+// TestSignedRequestBodyLimit checks that a signed body is limited to
+// -max-body-bytes on every endpoint, including those taking larger bodies
+// with a token.
+func TestSignedRequestBodyLimit(t *testing.T) {
+	srv := newTestServer(t)
+	setHMACKeys(t, hmacKey{name: "app", secret: []byte("secret")})
+	setMaxBodyBytes(t, 1024)
+
+	value := strings.Repeat("x", 4096)
+	for _, method := range []string{http.MethodPut, http.MethodPost} {
+		path := "/v1/keys/large"
+		if method == http.MethodPost {
+			path = "/v1/restore"
+		}
+		resp, data := doRequest(t, srv, method, path, value, signedHeader("secret", method, path, value, time.Now()))
+		if resp.StatusCode != http.StatusRequestEntityTooLarge || errorCode(t, data) != codeBodyTooLarge {
+			t.Errorf("signed %s %s: status %d %s, want 413 %s", method, path, resp.StatusCode, data, codeBodyTooLarge)
+		}
+	}
+
+	small := `{"key":"k","value":"v"}`
+	resp, data := doRequest(t, srv, http.MethodPost, "/v1/set", small, signedHeader("secret", "POST", "/v1/set", small, time.Now()))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("signed small body: status %d %s, want 200", resp.StatusCode, data)
+	}
+}
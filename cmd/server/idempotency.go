@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// Idempotency keys.
+//
+// A client retrying a write after a timeout can't tell whether the first
+// attempt ran, which matters for writes that aren't idempotent, like an
+// incr in a /pipeline. With an Idempotency-Key header, the writes (/set,
+// /del, /pipeline, PUT and DELETE /keys/{key}) run once per key: the
+// response is remembered for -idempotency-window, and a request with the
+// same key gets it again, with "Idempotent-Replayed: true", without running.
+// Concurrent requests with the same key wait for the first one and get its
+// response. A key reused for a different request (method, path and query,
+// or body) is answered with 422.
+//
+// Keys are scoped to the principal of the request, so clients can't see
+// each other's responses. The responses are stored in the internal
+// namespace of the cache (see cache.InternalPrefix), with the window as
+// TTL, so they are persisted and replicated like the dataset, survive a
+// restart, and count against -max-keys and -maxmemory; /stats reports their
+// share. Server errors (5xx) aren't remembered, so the request can be
+// retried, and nothing is stored while writes are rejected (read-only mode,
+// replicas). The body is buffered to compare requests, so with a key PUT
+// /keys/{key} is limited by -max-body-bytes too.
+
+// defaultIdempotencyWindow is the default of -idempotency-window.
+const defaultIdempotencyWindow = 24 * time.Hour
+
+// maxIdempotencyKeyLength is the longest Idempotency-Key accepted, in bytes.
+const maxIdempotencyKeyLength = 255
+
+// idempotencyWindow is the time a response is remembered for its key
+// (-idempotency-window; 0 = Idempotency-Key is ignored).
+var idempotencyWindow = defaultIdempotencyWindow
+
+// idempotencyReplayed counts the responses replayed.
+var idempotencyReplayed atomic.Int64
+
+// idempotencyRecord is a remembered response, stored as JSON.
+type idempotencyRecord struct {
+	Fingerprint string            `json:"fingerprint"` // See idempotencyFingerprint
+	Status      int               `json:"status"`
+	Header      map[string]string `json:"header,omitempty"` // See replayedHeaders
+	Body        []byte            `json:"body,omitempty"`
+}
+
+// replayedHeaders are the response headers remembered with a response.
+var replayedHeaders = []string{"Content-Type", "Location"}
+
+// idempotencyCall is a request running for an idempotency key, which
+// requests with the same key wait for.
+type idempotencyCall struct {
+	done   chan struct{}
+	record *idempotencyRecord // Response, set before done is closed (nil if it panicked)
+}
+
+// idempotencyCalls are the requests running, by storage key.
+var idempotencyCalls = struct {
+	sync.Mutex
+	m map[string]*idempotencyCall
+}{m: make(map[string]*idempotencyCall)}
+
+// idempotent wraps the handler of a write so requests with an
+// Idempotency-Key run once, see above.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || idempotencyWindow <= 0 {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest,
+				"Idempotency-Key too long (limit "+strconv.Itoa(maxIdempotencyKeyLength)+" bytes)")
+			return
+		}
+		fingerprint, ok := idempotencyFingerprint(w, r)
+		if !ok {
+			return
+		}
+		storeKey := cache.InternalPrefix + "idempotency:" + requestPrincipal(r) + "\x00" + key
+
+		idempotencyCalls.Lock()
+		if record := loadIdempotencyRecord(storeKey); record != nil {
+			idempotencyCalls.Unlock()
+			replayIdempotent(w, r, record, fingerprint)
+			return
+		}
+		if call := idempotencyCalls.m[storeKey]; call != nil {
+			idempotencyCalls.Unlock()
+			select {
+			case <-call.done:
+			case <-r.Context().Done():
+				return
+			}
+			if call.record == nil {
+				writeError(w, r, http.StatusConflict, codeInProgress, "The request with this Idempotency-Key failed, retry")
+				return
+			}
+			replayIdempotent(w, r, call.record, fingerprint)
+			return
+		}
+		call := &idempotencyCall{done: make(chan struct{})}
+		idempotencyCalls.m[storeKey] = call
+		idempotencyCalls.Unlock()
+
+		defer func() {
+			idempotencyCalls.Lock()
+			delete(idempotencyCalls.m, storeKey)
+			idempotencyCalls.Unlock()
+			close(call.done)
+		}()
+		rec := &recordingWriter{ResponseWriter: w}
+		next(rec, r)
+		call.record = rec.record(fingerprint)
+		storeIdempotencyRecord(storeKey, call.record)
+	}
+}
+
+// idempotencyFingerprint returns the hash of the method, path and query,
+// and body of r, which identifies the request of an idempotency key. The
+// body is read and replaced with a copy for the handler; it returns false
+// after answering a body that can't be read.
+func idempotencyFingerprint(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		limited, err := limitBody(w, r, maxBodyBytes)
+		if err == nil {
+			body, err = io.ReadAll(limited)
+		}
+		if err != nil {
+			writeJSONBodyError(w, r, err)
+			return "", false
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// loadIdempotencyRecord returns the response remembered under storeKey (nil
+// if none).
+func loadIdempotencyRecord(storeKey string) *idempotencyRecord {
+	data, ok := cacheInstance.GetBytes(storeKey)
+	if !ok {
+		return nil
+	}
+	var record idempotencyRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		slog.Warn("Ignoring an invalid idempotency record", "error", err)
+		return nil
+	}
+	return &record
+}
+
+// storeIdempotencyRecord remembers a response under storeKey, unless it is
+// a server error or writes are rejected. A failure is logged: the response
+// was sent, only a retry would run again.
+func storeIdempotencyRecord(storeKey string, record *idempotencyRecord) {
+	if record.Status >= http.StatusInternalServerError || checkWritable() != nil {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err == nil {
+		err = cacheInstance.SetOwnedBytes(storeKey, data, idempotencyWindow, "application/json")
+	}
+	if err != nil {
+		slog.Warn("Failed to store the response of an idempotency key", "error", err)
+	}
+}
+
+// replayIdempotent answers r with a remembered response, or 422 if it was
+// the response of a different request.
+func replayIdempotent(w http.ResponseWriter, r *http.Request, record *idempotencyRecord, fingerprint string) {
+	if record.Fingerprint != fingerprint {
+		writeError(w, r, http.StatusUnprocessableEntity, codeIdempotencyKeyReused, "Idempotency-Key was already used for a different request")
+		return
+	}
+	idempotencyReplayed.Add(1)
+	h := w.Header()
+	for name, value := range record.Header {
+		h.Set(name, value)
+	}
+	h.Set("Idempotent-Replayed", "true")
+	w.WriteHeader(record.Status)
+	w.Write(record.Body)
+}
+
+// recordingWriter passes a response through, keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader sends the status code, keeping it.
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes to the response, keeping a copy.
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// record returns the response written, for the request of fingerprint.
+func (w *recordingWriter) record(fingerprint string) *idempotencyRecord {
+	record := &idempotencyRecord{Fingerprint: fingerprint, Status: w.status, Body: w.body.Bytes()}
+	if record.Status == 0 {
+		record.Status = http.StatusOK
+	}
+	for _, name := range replayedHeaders {
+		if value := w.Header().Get(name); value != "" {
+			if record.Header == nil {
+				record.Header = make(map[string]string)
+			}
+			record.Header[name] = value
+		}
+	}
+	return record
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// infoHandler handles GET requests reporting server state, similar to Redis INFO.
+// The response is plain text with one "field:value" pair per line, grouped into sections.
+func infoHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+
+	b.WriteString("# Server\n")
+	fmt.Fprintf(&b, "read_only:%d\n", boolToInt(readOnlyMode.Load()))
+	fmt.Fprintf(&b, "log_level:%s\n", levelName(logLevel.Level()))
+	reloadMu.Lock()
+	if r := pendingLogLevelRevert; r != nil {
+		fmt.Fprintf(&b, "log_level_revert_to:%s\n", levelName(r.level))
+		fmt.Fprintf(&b, "log_level_revert_at:%s\n", r.at.Format(time.RFC3339))
+	}
+	reloadMu.Unlock()
+
+	b.WriteString("\n# Persistence\n")
+	if cacheInstance.Persistent() {
+		writePersistenceInfo(&b)
+	} else {
+		b.WriteString("persistence:disabled\n")
+	}
+
+	b.WriteString("\n# Replication\n")
+	writeReplicationInfo(&b)
+
+	b.WriteString("\n# Cluster\n")
+	writeClusterInfo(&b)
+
+	b.WriteString("\n# Limits\n")
+	stats := cacheInstance.Stats()
+	fmt.Fprintf(&b, "keys:%d\n", stats.Keys)
+	fmt.Fprintf(&b, "max_keys:%d\n", stats.MaxKeys)
+	fmt.Fprintf(&b, "used_memory:%d\n", stats.UsedMemory)
+	fmt.Fprintf(&b, "maxmemory:%d\n", stats.MaxMemory)
+	fmt.Fprintf(&b, "eviction_policy:%s\n", stats.EvictionPolicy)
+	fmt.Fprintf(&b, "evicted_keys:%d\n", stats.Evicted)
+	limits := cacheInstance.Limits()
+	fmt.Fprintf(&b, "max_key_length:%d\n", limits.MaxKeyLength)
+	fmt.Fprintf(&b, "max_value_size:%d\n", limits.MaxValueSize)
+	fmt.Fprintf(&b, "load_skipped_oversized:%d\n", limits.LoadSkipped)
+	if policy := cacheInstance.KeyPolicy(); policy != nil {
+		fmt.Fprintf(&b, "key_policy:%s\n", policy)
+	}
+
+	fmt.Fprint(w, b.String())
+}
+
+// writePersistenceInfo writes the fields of the persistence section: AOF
+// rewrites, AOF replay, snapshots, and snapshot uploads.
+func writePersistenceInfo(b *strings.Builder) {
+	// AOF rewrite progress and last rewrite result
+	rw := cacheInstance.AOFRewriteStats()
+	fmt.Fprintf(b, "aof_enabled:%d\n", boolToInt(cacheInstance.AOFEnabled()))
+	fmt.Fprintf(b, "aof_fsync:%s\n", cacheInstance.AOFFsync())
+	if err := cacheInstance.AOFWriteError(); err != nil {
+		fmt.Fprintf(b, "aof_last_write_status:err\naof_last_write_error:%s\n", err)
+	} else {
+		b.WriteString("aof_last_write_status:ok\n")
+	}
+	fmt.Fprintf(b, "aof_current_size:%d\n", rw.CurrentSize)
+	fmt.Fprintf(b, "aof_base_size:%d\n", rw.BaseSize)
+	multiple, minSize := aofRewriteManager.Thresholds()
+	fmt.Fprintf(b, "aof_rewrite_growth_multiple:%g\n", multiple)
+	fmt.Fprintf(b, "aof_rewrite_min_size:%d\n", minSize)
+	fmt.Fprintf(b, "aof_rewrite_in_progress:%d\n", boolToInt(rw.InProgress))
+	if rw.InProgress {
+		fmt.Fprintf(b, "aof_rewrite_progress:%d/%d\n", rw.CurrentWritten, rw.CurrentTotal)
+		fmt.Fprintf(b, "aof_rewrite_buffer_commands:%d\n", rw.CurrentBuffered)
+	}
+	fmt.Fprintf(b, "aof_rewrites:%d\n", rw.Count)
+	fmt.Fprintf(b, "aof_last_rewrite_status:%s\n", orNone(rw.LastStatus))
+	if rw.LastError != "" {
+		fmt.Fprintf(b, "aof_last_rewrite_error:%s\n", rw.LastError)
+	}
+	if !rw.LastTime.IsZero() {
+		fmt.Fprintf(b, "aof_last_rewrite_time:%s\n", rw.LastTime.Format(time.RFC3339))
+		fmt.Fprintf(b, "aof_last_rewrite_duration_ms:%d\n", rw.LastDuration.Milliseconds())
+	}
+	fmt.Fprintf(b, "aof_last_rewrite_size:%d\n", rw.LastSize)
+
+	// AOF replay at startup
+	replay := cacheInstance.AOFReplayStats()
+	fmt.Fprintf(b, "loading:%d\n", boolToInt(cacheInstance.Loading()))
+	if replay.InProgress {
+		fmt.Fprintf(b, "aof_replay_progress:%d/%d\n", replay.BytesProcessed, replay.FileSize)
+		fmt.Fprintf(b, "aof_replay_commands:%d\n", replay.Commands)
+		fmt.Fprintf(b, "aof_replay_elapsed_ms:%d\n", replay.Duration.Milliseconds())
+	} else {
+		fmt.Fprintf(b, "aof_last_replay_duration_ms:%d\n", replay.Duration.Milliseconds())
+		fmt.Fprintf(b, "aof_last_replay_commands:%d\n", replay.Commands)
+		fmt.Fprintf(b, "aof_last_replay_bytes:%d\n", replay.BytesProcessed)
+		fmt.Fprintf(b, "aof_last_replay_errors:%d\n", replay.Errors)
+		fmt.Fprintf(b, "aof_last_replay_discarded_bytes:%d\n", replay.Discarded)
+	}
+
+	// Snapshot policy and last snapshot saved by this process
+	fmt.Fprintf(b, "rdb_changes_since_last_save:%d\n", cacheInstance.ChangesSinceSave())
+	fmt.Fprintf(b, "rdb_last_save_or_startup_time:%s\n", cacheInstance.LastSave().Format(time.RFC3339))
+	if rules := snapshotManager.SaveRules(); len(rules) > 0 {
+		fmt.Fprintf(b, "rdb_save_rules:%s\n", saveRulesFlag(rules))
+	}
+	snap := cacheInstance.SnapshotStats()
+	compression := "none"
+	if snap.Compressed {
+		compression = "gzip"
+	}
+	if !snap.Time.IsZero() {
+		fmt.Fprintf(b, "rdb_last_save_time:%s\n", snap.Time.Format(time.RFC3339))
+		fmt.Fprintf(b, "rdb_last_save_duration_ms:%d\n", snap.Duration.Milliseconds())
+	}
+	fmt.Fprintf(b, "rdb_last_save_keys:%d\n", snap.Entries)
+	fmt.Fprintf(b, "rdb_last_save_disk_size:%d\n", snap.DiskSize)
+	fmt.Fprintf(b, "rdb_last_save_raw_size:%d\n", snap.RawSize)
+	fmt.Fprintf(b, "rdb_last_save_format:%s\n", snap.Format)
+	fmt.Fprintf(b, "rdb_last_save_compression:%s\n", compression)
+
+	// Snapshot uploads to the sink, if configured
+	if upload := cacheInstance.SnapshotUploadStats(); upload.Sink != "" {
+		fmt.Fprintf(b, "rdb_upload_sink:%s\n", upload.Sink)
+		fmt.Fprintf(b, "rdb_uploads:%d\n", upload.Count)
+		fmt.Fprintf(b, "rdb_last_upload_status:%s\n", orNone(upload.LastStatus))
+		if upload.LastError != "" {
+			fmt.Fprintf(b, "rdb_last_upload_error:%s\n", upload.LastError)
+		}
+		if !upload.LastTime.IsZero() {
+			fmt.Fprintf(b, "rdb_last_upload_time:%s\n", upload.LastTime.Format(time.RFC3339))
+			fmt.Fprintf(b, "rdb_last_upload_duration_ms:%d\n", upload.LastDuration.Milliseconds())
+			fmt.Fprintf(b, "rdb_last_upload_attempts:%d\n", upload.LastAttempts)
+		}
+		if !upload.LastSuccess.IsZero() {
+			fmt.Fprintf(b, "rdb_last_upload_success_time:%s\n", upload.LastSuccess.Format(time.RFC3339))
+		}
+	}
+}
+
+// boolToInt converts a boolean to 1 or 0 for INFO output.
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// orNone returns "none" for empty strings so INFO fields always have a value.
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// IP filtering.
+//
+// Every endpoint but the health check belongs to a route class: read, write
+// (including /pipeline), or admin (see routeClass). Each class has its own
+// allow and deny lists of CIDRs or addresses (-ip-allow-read, -ip-deny-read,
+// and so on): a client in the deny list, or missing from a non-empty allow
+// list, gets 403 without further detail, before the ACL is checked. The
+// lists and -trusted-proxies can be changed by a config reload.
+//
+// The client address is the peer of the connection, unless that peer is in
+// -trusted-proxies: then X-Forwarded-For is read from right to left, and
+// the first address that isn't a trusted proxy is the client. Without
+// trusted proxies, X-Forwarded-For is ignored, since any client can send it.
+//
+// The lists are parsed once into sorted, merged address ranges, so a check
+// is a binary search.
+
+// Route classes of the IP filter.
+const (
+	classRead = iota
+	classWrite
+	classAdmin
+	routeClassCount
+
+	classNone = -1 // Not filtered: the health checks
+)
+
+// healthPatterns are the route patterns of the health checks, see health.go.
+var healthPatterns = []string{"/{$}", "/healthz", "/readyz"}
+
+// routeClassNames are the names of the route classes, in logs.
+var routeClassNames = [routeClassCount]string{"read", "write", "admin"}
+
+// Settings of the IP filter flags.
+var (
+	ipAllow        [routeClassCount]stringListFlag // -ip-allow-read, -ip-allow-write, -ip-allow-admin
+	ipDeny         [routeClassCount]stringListFlag // -ip-deny-read, -ip-deny-write, -ip-deny-admin
+	trustedProxies stringListFlag                  // -trusted-proxies
+)
+
+// ipRange is an inclusive range of addresses, IPv4 ones mapped into IPv6.
+type ipRange struct {
+	lo, hi [16]byte
+}
+
+// ipSet is a set of addresses: sorted, non-overlapping ranges.
+type ipSet []ipRange
+
+// ipRule is the policy of a route class.
+type ipRule struct {
+	allow ipSet // Empty = any address not denied
+	deny  ipSet
+}
+
+// ipPolicy is the IP filter in effect.
+type ipPolicy struct {
+	rules   [routeClassCount]ipRule
+	trusted ipSet // Trusted proxies
+}
+
+// currentIPPolicy is the IP filter in effect (nil filters nothing).
+var currentIPPolicy atomic.Pointer[ipPolicy]
+
+// parseIPSet parses CIDRs and addresses into an ipSet.
+func parseIPSet(specs []string) (ipSet, error) {
+	var set ipSet
+	for _, spec := range specs {
+		prefix, err := netip.ParsePrefix(spec)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(spec)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid CIDR or address %q", spec)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		addr, bits := prefix.Addr(), prefix.Bits()
+		if addr.Is4() {
+			bits += 96
+		}
+		r := ipRange{lo: netip.PrefixFrom(netip.AddrFrom16(addr.As16()), bits).Masked().Addr().As16()}
+		r.hi = r.lo
+		for i := bits; i < 128; i++ {
+			r.hi[i/8] |= 0x80 >> (i % 8)
+		}
+		set = append(set, r)
+	}
+
+	slices.SortFunc(set, func(a, b ipRange) int { return bytes.Compare(a.lo[:], b.lo[:]) })
+	merged := set[:0]
+	for _, r := range set {
+		if n := len(merged); n > 0 && bytes.Compare(r.lo[:], merged[n-1].hi[:]) <= 0 {
+			if bytes.Compare(r.hi[:], merged[n-1].hi[:]) > 0 {
+				merged[n-1].hi = r.hi
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged, nil
+}
+
+// contains reports whether addr is in the set.
+func (s ipSet) contains(addr netip.Addr) bool {
+	a := addr.As16()
+	i, _ := slices.BinarySearchFunc(s, a, func(r ipRange, a [16]byte) int { return bytes.Compare(r.hi[:], a[:]) })
+	return i < len(s) && bytes.Compare(s[i].lo[:], a[:]) <= 0
+}
+
+// updateIPPolicy replaces the IP filter in effect with a copy changed by
+// update. Updates are serialized by startup and reloadMu.
+func updateIPPolicy(update func(p *ipPolicy)) {
+	var p ipPolicy
+	if current := currentIPPolicy.Load(); current != nil {
+		p = *current
+	}
+	update(&p)
+	currentIPPolicy.Store(&p)
+}
+
+// ipListSetting returns the reloadableSettings entry of an IP list, which
+// set stores in a policy.
+func ipListSetting(set func(p *ipPolicy, s ipSet)) func(values []string) (func() int, error) {
+	return func(values []string) (func() int, error) {
+		s, err := parseIPSet(values)
+		if err != nil {
+			return nil, err
+		}
+		return func() int {
+			updateIPPolicy(func(p *ipPolicy) { set(p, s) })
+			return 0
+		}, nil
+	}
+}
+
+// configureIPFilter parses the IP filter flags.
+func configureIPFilter() error {
+	var p ipPolicy
+	var err error
+	for class := range routeClassCount {
+		name := routeClassNames[class]
+		if p.rules[class].allow, err = parseIPSet(ipAllow[class]); err != nil {
+			return fmt.Errorf("-ip-allow-%s: %w", name, err)
+		}
+		if p.rules[class].deny, err = parseIPSet(ipDeny[class]); err != nil {
+			return fmt.Errorf("-ip-deny-%s: %w", name, err)
+		}
+	}
+	if p.trusted, err = parseIPSet(trustedProxies); err != nil {
+		return fmt.Errorf("-trusted-proxies: %w", err)
+	}
+	currentIPPolicy.Store(&p)
+	return nil
+}
+
+// clientAddr returns the address of the client of r, see above. A nil
+// policy trusts no proxy.
+func (p *ipPolicy) clientAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if r.RemoteAddr == unixRemoteAddr {
+		host = "127.0.0.1" // Clients of the unix socket are on this host
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 || p == nil || !p.trusted.contains(addr) {
+		return addr, true
+	}
+
+	hops := strings.Split(strings.Join(forwarded, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false // Can't tell who the client is
+		}
+		if addr = hop.Unmap(); !p.trusted.contains(addr) {
+			return addr, true
+		}
+	}
+	return addr, true // Every hop is trusted: the first one is the client
+}
+
+// allows reports whether the client of r may use routes of class.
+func (p *ipPolicy) allows(class int, r *http.Request) bool {
+	if p == nil {
+		return true
+	}
+	rule := p.rules[class]
+	if len(rule.allow)+len(rule.deny) == 0 {
+		return true
+	}
+	addr, ok := p.clientAddr(r)
+	if !ok || rule.deny.contains(addr) {
+		return false
+	}
+	return len(rule.allow) == 0 || rule.allow.contains(addr)
+}
+
+// routeClass returns the route class of a method of a route, from its ACL
+// operation (see routeOperations).
+func routeClass(method, pattern string) int {
+	switch op, ok := routeOperations[method+" "+pattern]; {
+	case slices.Contains(healthPatterns, pattern):
+		return classNone
+	case pattern == "/pipeline":
+		return classWrite
+	case !ok || op == "admin":
+		return classAdmin
+	case slices.Contains(aclOperations["write"], op):
+		return classWrite
+	}
+	return classRead
+}
+
+// requireIPClass wraps the handler of a method of a route so clients the IP
+// filter of its class rejects get 403.
+func requireIPClass(class int, next http.HandlerFunc) http.HandlerFunc {
+	if class == classNone {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !currentIPPolicy.Load().allows(class, r) {
+			slog.Warn("IP filter denied", "class", routeClassNames[class], "remote", r.RemoteAddr, "forwarded_for", r.Header.Get("X-Forwarded-For"), "path", r.URL.Path)
+			writeError(w, r, http.StatusForbidden, codeForbidden, "Forbidden")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// Resource API.
+//
+// /keys/{key} addresses every key as a resource, for API gateways and tools
+// that expect resource-oriented routes, in parallel with /set, /get, and
+// /del. Values are sent and returned as raw bytes instead of JSON.
+//
+// The key is the rest of the path after /keys/, unescaped, so it may contain
+// slashes ("/keys/users/42/name") and any other character as %XX. Empty
+// segments and "." or ".." segments are cleaned from paths by the router,
+// so keys containing them must encode their slashes as %2F.
+
+// Headers of the resource API.
+const (
+	ttlHeader          = "X-TTL"           // TTL of PUT, like the ttl query parameter
+	ttlRemainingHeader = "X-TTL-Remaining" // Seconds until the key expires (-1: no TTL)
+)
+
+// defaultMaxValueBytes is the default limit of values, like the largest
+// string of Redis (proto-max-bulk-len).
+const defaultMaxValueBytes = 512 << 20
+
+// maxContentTypeLength is the longest Content-Type stored with a value.
+const maxContentTypeLength = 256
+
+// headTouches makes HEAD requests for keys count as accesses for eviction
+// (-head-touches-lru). By default they don't, so monitoring probes don't
+// keep keys from being evicted.
+var headTouches bool
+
+// getKeyHandler handles GET requests to /keys/{key}: the raw value bytes
+// with the content type they were stored with (application/octet-stream if
+// none) and the headers of setKeyHeaders (304 if If-None-Match matches).
+func getKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == "" {
+		writeMissingPathKey(w, r)
+		return
+	}
+	if cache.IsInternalKey(key) {
+		writeReservedKey(w, r)
+		return
+	}
+
+	value, stat, ok := cacheInstance.GetBytesWithStat(key)
+	if !ok {
+		writeKeyNotFound(w, r)
+		return
+	}
+
+	h := w.Header()
+	contentLength := setKeyHeaders(h, stat)
+	if writeNotModified(w, r) {
+		return
+	}
+	h["Content-Type"] = valueContentType(stat)
+	h["Content-Length"] = contentLength
+	w.Write(value)
+}
+
+// setKeyHeaders sets the metadata headers of a key's value: the seconds
+// until it expires in X-TTL-Remaining (-1: no TTL), when it was last written
+// in Last-Modified, and its version in ETag. It returns the Content-Length
+// of the raw value, for the handlers that send it. stat must come from the
+// same read as the value, so the headers describe the value sent.
+//
+// The values are formatted into a single string and sliced into a single
+// array, so a raw Get hit allocates twice for all its headers. Every slice
+// has a capacity of 1, so Header.Add appends to a copy (see pool.go).
+func setKeyHeaders(h http.Header, stat cache.KeyStat) (contentLength []string) {
+	var scratch [128]byte
+	buf := strconv.AppendInt(scratch[:0], ttlRemaining(stat.ExpiresAt), 10)
+	ttlEnd := len(buf)
+	buf = stat.ModifiedAt.UTC().AppendFormat(buf, http.TimeFormat)
+	modifiedEnd := len(buf)
+	buf = append(buf, '"')
+	buf = strconv.AppendUint(buf, stat.Version, 16)
+	buf = append(buf, '"')
+	etagEnd := len(buf)
+	buf = strconv.AppendInt(buf, int64(stat.Size), 10)
+	s := string(buf)
+
+	values := []string{s[:ttlEnd], s[ttlEnd:modifiedEnd], s[modifiedEnd:etagEnd], s[etagEnd:]}
+	h[ttlRemainingHeader] = values[0:1:1]
+	h["Last-Modified"] = values[1:2:2]
+	h["Etag"] = values[2:3:3]
+	return values[3:4:4]
+}
+
+// valueContentType returns the Content-Type header of a raw value: the
+// content type it was stored with, or application/octet-stream.
+func valueContentType(stat cache.KeyStat) []string {
+	if stat.ContentType == "" {
+		return octetStreamContentType
+	}
+	return []string{stat.ContentType}
+}
+
+// writeNotModified answers 304 Not Modified, without a body, if the
+// request's If-None-Match header lists the ETag set by setKeyHeaders (or is
+// "*"), and reports whether it did. Weak tags match too, as If-None-Match
+// compares them weakly.
+func writeNotModified(w http.ResponseWriter, r *http.Request) bool {
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag := w.Header()["Etag"][0]
+	for tag := range strings.SplitSeq(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// headKeyHandler handles HEAD requests to /keys/{key}, checking whether the
+// key exists: 200 with the headers of GET, or 404.
+func headKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == "" {
+		writeMissingPathKey(w, r)
+		return
+	}
+	if cache.IsInternalKey(key) {
+		writeReservedKey(w, r)
+		return
+	}
+	writeKeyHead(w, r, key)
+}
+
+// writeKeyHead answers a HEAD request for key with the Content-Length of its
+// value and the headers of setKeyHeaders (304 if If-None-Match matches), or
+// 404 if it doesn't exist. The value itself isn't read.
+func writeKeyHead(w http.ResponseWriter, r *http.Request, key string) {
+	stat, ok := cacheInstance.Stat(key, headTouches)
+	if !ok {
+		writeKeyNotFound(w, r)
+		return
+	}
+
+	h := w.Header()
+	contentLength := setKeyHeaders(h, stat)
+	if writeNotModified(w, r) {
+		return
+	}
+	h["Content-Type"] = valueContentType(stat)
+	h["Content-Length"] = contentLength
+	w.WriteHeader(http.StatusOK)
+}
+
+// putKeyHandler handles PUT requests to /keys/{key}, storing the raw request
+// body as the value, with its Content-Type (if any) for GET to return. The
+// optional TTL is given in the X-TTL header or the ttl query parameter, in
+// seconds or as a duration string (see TTL). The body is read straight into
+// the buffer the cache keeps (see readValue), and bodies larger than
+// -max-value-bytes are rejected with 413 without reading them in full.
+// Responds 204 No Content.
+func putKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == "" {
+		writeMissingPathKey(w, r)
+		return
+	}
+	if cache.IsInternalKey(key) {
+		writeReservedKey(w, r)
+		return
+	}
+
+	// The header takes precedence, so a gateway can set it over the URL
+	var ttl time.Duration
+	s := r.Header.Get(ttlHeader)
+	if s == "" {
+		s = queryValue(r, "ttl")
+	}
+	if s != "" {
+		t, err := parseTTL(s)
+		if err == nil {
+			err = t.validate()
+		}
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidTTL, err.Error())
+			return
+		}
+		ttl = time.Duration(t)
+	}
+
+	contentType, ctErr := parseContentType(r.Header.Get("Content-Type"))
+	if ctErr != nil {
+		writeError(w, r, ctErr.Status, ctErr.Code, ctErr.Message)
+		return
+	}
+
+	value, err := readValue(w, r)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeValueTooLarge(w, r)
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Failed to read request body")
+		return
+	}
+	if err := cacheInstance.SetOwnedBytes(key, value, ttl, contentType); err != nil {
+		writeSetError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteKeyHandler handles DELETE requests to /keys/{key}. Responds 204 No
+// Content if the key existed, and 404 otherwise.
+func deleteKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == "" {
+		writeMissingPathKey(w, r)
+		return
+	}
+	if cache.IsInternalKey(key) {
+		writeReservedKey(w, r)
+		return
+	}
+
+	if !cacheInstance.Del(key) {
+		writeKeyNotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readValue reads the body of a raw value write into a buffer of its own,
+// for the cache to keep without copying it. With a Content-Length, the
+// buffer is allocated once at that size and filled directly; without one
+// (chunked bodies), it grows as the body arrives. Bodies larger than
+// -max-value-bytes fail with an *http.MaxBytesError, before reading them if
+// the Content-Length says so.
+func readValue(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := limitBody(w, r, valueSizeLimit())
+	if err != nil {
+		return nil, err
+	}
+	if r.ContentLength < 0 {
+		return io.ReadAll(body)
+	}
+
+	// The server stops the body at Content-Length, so it can't be longer
+	value := make([]byte, r.ContentLength)
+	if _, err := io.ReadFull(body, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// parseContentType validates the Content-Type of a value and returns it
+// normalized (e.g. "text/plain; charset=utf-8"), or "" if there is none.
+func parseContentType(s string) (string, *APIError) {
+	if s == "" {
+		return "", nil
+	}
+	var contentType string
+	if mediaType, params, err := mime.ParseMediaType(s); err == nil {
+		contentType = mime.FormatMediaType(mediaType, params)
+	}
+	if contentType == "" || len(contentType) > maxContentTypeLength {
+		return "", &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    codeInvalidRequest,
+			Message: fmt.Sprintf("Invalid Content-Type (must be a media type of at most %d bytes)", maxContentTypeLength),
+		}
+	}
+	return contentType, nil
+}
+
+// valueSizeLimit returns the value size limit of the cache (-max-value-bytes,
+// or as changed with POST /config), or math.MaxInt64 if it is unlimited.
+func valueSizeLimit() int64 {
+	if limit := cacheInstance.Limits().MaxValueSize; limit > 0 {
+		return int64(limit)
+	}
+	return math.MaxInt64
+}
+
+// checkValueSize returns an error if a value of n bytes exceeds the value
+// size limit. The cache checks it too, but only once the value is copied.
+func checkValueSize(n int64) *APIError {
+	if n > valueSizeLimit() {
+		return valueTooLargeError()
+	}
+	return nil
+}
+
+// valueTooLargeError is the error of a value larger than the value size limit.
+func valueTooLargeError() *APIError {
+	return &APIError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    codeValueTooLarge,
+		Message: fmt.Sprintf("Value too large (limit %d bytes, see -max-value-bytes)", valueSizeLimit()),
+	}
+}
+
+// writeValueTooLarge answers 413 to a value larger than the value size limit.
+func writeValueTooLarge(w http.ResponseWriter, r *http.Request) {
+	e := valueTooLargeError()
+	writeError(w, r, e.Status, e.Code, e.Message)
+}
+
+// writeMissingPathKey answers 400 to a request for /keys/ without a key.
+func writeMissingPathKey(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusBadRequest, codeMissingKey, "Missing key in path (/keys/{key})")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// TestETagConditionalGet checks the update-then-conditional-get sequence:
+// If-None-Match with the current ETag answers 304 without a body, a write
+// changes the ETag so the old one gets the new value, and a TTL change
+// keeps it.
+func TestETagConditionalGet(t *testing.T) {
+	srv := newTestServer(t)
+	for _, path := range []string{"/v1/get?key=doc", "/v1/keys/doc"} {
+		t.Run(path, func(t *testing.T) {
+			if err := cacheInstance.Set("doc", "v1", 0); err != nil {
+				t.Fatal(err)
+			}
+			resp, _ := doRequest(t, srv, http.MethodGet, path, "", nil)
+			etag := resp.Header.Get("ETag")
+			if resp.StatusCode != http.StatusOK || etag == "" {
+				t.Fatalf("GET = %d with ETag %q", resp.StatusCode, etag)
+			}
+
+			for _, match := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+				resp, body := doRequest(t, srv, http.MethodGet, path, "", http.Header{"If-None-Match": {match}})
+				if resp.StatusCode != http.StatusNotModified || len(body) != 0 {
+					t.Errorf("GET with If-None-Match %s = %d with %d bytes, want 304 without a body", match, resp.StatusCode, len(body))
+				}
+				if resp.Header.Get("ETag") != etag {
+					t.Errorf("304 ETag = %q, want %q", resp.Header.Get("ETag"), etag)
+				}
+			}
+
+			// Changing the TTL keeps the ETag
+			if _, err := cacheInstance.Expire("doc", time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			resp, _ = doRequest(t, srv, http.MethodGet, path, "", http.Header{"If-None-Match": {etag}})
+			if resp.StatusCode != http.StatusNotModified {
+				t.Errorf("GET after expire = %d, want 304", resp.StatusCode)
+			}
+
+			// A write changes it, even with the same value
+			for _, value := range []string{"v2", "v2"} {
+				if err := cacheInstance.Set("doc", value, 0); err != nil {
+					t.Fatal(err)
+				}
+				resp, body := doRequest(t, srv, http.MethodGet, path, "", http.Header{"If-None-Match": {etag}})
+				next := resp.Header.Get("ETag")
+				if resp.StatusCode != http.StatusOK || len(body) == 0 || next == etag {
+					t.Fatalf("GET after set = %d with ETag %s (old %s), want 200 with a new ETag", resp.StatusCode, next, etag)
+				}
+				etag = next
+			}
+
+			if !cacheInstance.Del("doc") {
+				t.Fatal("Del returned false")
+			}
+			resp, _ = doRequest(t, srv, http.MethodGet, path, "", http.Header{"If-None-Match": {etag}})
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("GET after del = %d, want 404", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// filler is an endless reader of 'x' bytes, for request bodies that aren't
+// held in memory.
+type filler struct{}
+
+func (filler) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+// allocatedDuring returns the bytes allocated on the heap while fn ran,
+// which bounds how much its peak memory use grew.
+func allocatedDuring(fn func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// putLarge sends n bytes as the value of key with PUT /v1/keys/{key},
+// without a Content-Length if chunked.
+func putLarge(t *testing.T, srv *httptest.Server, key string, n int64, chunked bool) *http.Response {
+	t.Helper()
+	body := io.LimitReader(filler{}, n)
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/v1/keys/"+key, struct{ io.Reader }{body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !chunked {
+		req.ContentLength = n
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("PUT: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+// TestPutLargeValue stores a 100MB value with PUT /keys/{key} and checks that
+// the server allocates it about once: read into a buffer of the
+// Content-Length, kept by the cache, and written to the AOF without a copy.
+func TestPutLargeValue(t *testing.T) {
+	if testing.Short() {
+		t.Skip("100MB value")
+	}
+	const size = 100 << 20
+	dir := t.TempDir()
+	c, err := cache.NewCache(filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot"), 0, cache.WithMaxValueSize(200<<20))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	srv := newTestServerWithCache(t, c)
+
+	var resp *http.Response
+	allocated := allocatedDuring(func() { resp = putLarge(t, srv, "big", size, false) })
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT = %d, want 204", resp.StatusCode)
+	}
+	t.Logf("allocated %d MB for a %d MB value", allocated>>20, size>>20)
+	if allocated > size*5/4 {
+		t.Errorf("allocated %d bytes for a %d byte value, want about one copy", allocated, size)
+	}
+
+	value, ok := cacheInstance.GetBytes("big")
+	if !ok || len(value) != size || value[0] != 'x' || value[size-1] != 'x' {
+		t.Fatalf("stored value has %d bytes (present %v), want %d", len(value), ok, size)
+	}
+	info, err := os.Stat(filepath.Join(dir, "test.aof"))
+	if err != nil || info.Size() < size {
+		t.Errorf("AOF size = %v, %v; want the value logged", info, err)
+	}
+
+	// Without a Content-Length, the buffer grows as the body is read
+	if resp := putLarge(t, srv, "chunked", 10<<20, true); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("chunked PUT = %d, want 204", resp.StatusCode)
+	}
+	if value, ok := cacheInstance.GetBytes("chunked"); !ok || len(value) != 10<<20 {
+		t.Errorf("chunked value has %d bytes, want %d", len(value), 10<<20)
+	}
+}
+
+// TestPutValueTooLarge checks that a body over -max-value-bytes is rejected
+// with 413 before it is buffered.
+func TestPutValueTooLarge(t *testing.T) {
+	const limit = 1 << 20
+	srv := newTestServer(t, cache.WithMaxValueSize(limit))
+
+	for _, chunked := range []bool{false, true} {
+		var resp *http.Response
+		allocated := allocatedDuring(func() { resp = putLarge(t, srv, "big", 100<<20, chunked) })
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("PUT over the limit (chunked %v) = %d, want 413", chunked, resp.StatusCode)
+		}
+		if allocated > 10*limit {
+			t.Errorf("allocated %d bytes to reject a body over %d (chunked %v)", allocated, limit, chunked)
+		}
+	}
+	if _, ok := cacheInstance.Get("big"); ok {
+		t.Error("value over the limit was stored")
+	}
+}
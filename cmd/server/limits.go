@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Concurrency limits.
+//
+// Under a traffic spike, the server would otherwise accept connections and
+// start goroutines until it runs out of memory:
+//
+//   - -max-connections caps the open connections: beyond it, the server
+//     stops accepting, so new connections wait in the listen backlog of the
+//     kernel until one closes.
+//   - -max-requests caps the requests being handled at once. A request
+//     beyond it waits in a queue of up to -request-queue requests for at
+//     most -request-queue-timeout, then gets 503 busy with Retry-After, as
+//     does a request finding the queue full.
+//   - Long transfers (see longLived: the replication stream, /backup,
+//     /restore) can run for hours, so they have their own budget,
+//     -max-streams, and don't count against -max-requests: a stream beyond
+//     it gets 503 right away.
+//
+// The health check isn't limited, so a busy server isn't taken for a dead
+// one. /stats reports the usage of each limit.
+
+// Defaults of the concurrency limit flags.
+const (
+	defaultRequestQueue        = 100
+	defaultRequestQueueTimeout = 100 * time.Millisecond
+)
+
+// Settings of the concurrency limit flags (0 = unlimited).
+var (
+	maxConnections      int                          // -max-connections
+	maxRequests         int                          // -max-requests
+	requestQueue        = defaultRequestQueue        // -request-queue
+	requestQueueTimeout = defaultRequestQueueTimeout // -request-queue-timeout
+	maxStreams          int                          // -max-streams
+)
+
+// semaphore limits the holders of a resource (nil = unlimited).
+type semaphore chan struct{}
+
+// newSemaphore returns a semaphore of n slots, or nil if n is 0.
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// tryAcquire takes a slot if one is free.
+func (s semaphore) tryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a slot.
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// Semaphores of the concurrency limits, and their usage.
+var (
+	connectionSlots semaphore
+	requestSlots    semaphore
+	streamSlots     semaphore
+
+	openConnections  atomic.Int64
+	activeRequests   atomic.Int64
+	queuedRequests   atomic.Int64
+	activeStreams    atomic.Int64
+	rejectedRequests atomic.Int64 // Requests and streams answered 503 at the limits, since startup
+)
+
+// configureLimits creates the semaphores of the concurrency limit flags.
+func configureLimits() {
+	connectionSlots = newSemaphore(maxConnections)
+	requestSlots = newSemaphore(maxRequests)
+	streamSlots = newSemaphore(maxStreams)
+}
+
+// limitListener limits the connections accepted by a listener to
+// -max-connections.
+type limitListener struct {
+	net.Listener
+}
+
+// Accept waits for a free connection slot, then accepts a connection.
+func (l limitListener) Accept() (net.Conn, error) {
+	if connectionSlots != nil {
+		connectionSlots <- struct{}{}
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		connectionSlots.release()
+		return nil, err
+	}
+	openConnections.Add(1)
+	return &limitConn{Conn: c}, nil
+}
+
+// limitConn frees its connection slot when closed.
+type limitConn struct {
+	net.Conn
+	once sync.Once
+}
+
+// Close closes the connection and frees its slot, once.
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		openConnections.Add(-1)
+		connectionSlots.release()
+	})
+	return err
+}
+
+// requestSlotKey is the context key of the release function of the request
+// slot of a request.
+type requestSlotKey struct{}
+
+// writeBusy answers 503 busy at a concurrency limit.
+func writeBusy(w http.ResponseWriter, r *http.Request, message string) {
+	rejectedRequests.Add(1)
+	w.Header().Set("Retry-After", "1")
+	writeError(w, r, http.StatusServiceUnavailable, codeBusy, message)
+}
+
+// acquireRequestSlot takes a request slot, waiting in the queue if there is
+// room, see above.
+func acquireRequestSlot(ctx context.Context) bool {
+	if requestSlots.tryAcquire() {
+		return true
+	}
+	if queuedRequests.Add(1) > int64(requestQueue) {
+		queuedRequests.Add(-1)
+		return false
+	}
+	defer queuedRequests.Add(-1)
+	timer := time.NewTimer(requestQueueTimeout)
+	defer timer.Stop()
+	select {
+	case requestSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// requireRequestSlot wraps the handler of a method of a route so it runs
+// within -max-requests. Routes of classNone aren't limited.
+func requireRequestSlot(class int, next http.HandlerFunc) http.HandlerFunc {
+	if class == classNone {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !acquireRequestSlot(r.Context()) {
+			writeBusy(w, r, "Too many requests in progress, retry later")
+			return
+		}
+		activeRequests.Add(1)
+		var once sync.Once
+		release := func() {
+			once.Do(func() {
+				activeRequests.Add(-1)
+				requestSlots.release()
+			})
+		}
+		defer release()
+		next(w, r.WithContext(context.WithValue(r.Context(), requestSlotKey{}, release)))
+	}
+}
+
+// acquireStreamSlot takes a slot of -max-streams for a long transfer, and
+// frees the request slot of r, or returns false at the limit.
+func acquireStreamSlot(r *http.Request) bool {
+	if !streamSlots.tryAcquire() {
+		return false
+	}
+	activeStreams.Add(1)
+	if release, ok := r.Context().Value(requestSlotKey{}).(func()); ok {
+		release()
+	}
+	return true
+}
+
+// releaseStreamSlot frees a slot of -max-streams.
+func releaseStreamSlot() {
+	activeStreams.Add(-1)
+	streamSlots.release()
+}
+
+// ConcurrencyStats reports the usage of the concurrency limits in
+// StatsResponse (limits: 0 = unlimited).
+type ConcurrencyStats struct {
+	Connections      int64 `json:"connections"`       // Open connections
+	MaxConnections   int   `json:"max_connections"`   // -max-connections
+	Requests         int64 `json:"requests"`          // Requests being handled, streams excluded
+	MaxRequests      int   `json:"max_requests"`      // -max-requests
+	QueuedRequests   int64 `json:"queued_requests"`   // Requests waiting for a slot
+	RequestQueue     int   `json:"request_queue"`     // -request-queue
+	Streams          int64 `json:"streams"`           // Long transfers in progress
+	MaxStreams       int   `json:"max_streams"`       // -max-streams
+	RejectedRequests int64 `json:"rejected_requests"` // Requests and streams answered 503 at the limits, since startup
+}
+
+// concurrencyStats returns the usage of the concurrency limits.
+func concurrencyStats() ConcurrencyStats {
+	return ConcurrencyStats{
+		Connections:      openConnections.Load(),
+		MaxConnections:   maxConnections,
+		Requests:         activeRequests.Load(),
+		MaxRequests:      maxRequests,
+		QueuedRequests:   queuedRequests.Load(),
+		RequestQueue:     requestQueue,
+		Streams:          activeStreams.Load(),
+		MaxStreams:       maxStreams,
+		RejectedRequests: rejectedRequests.Load(),
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Log level.
+//
+// The level of the server log is logLevel, a LevelVar read by every log
+// call, so changing it takes effect at once. -log-level sets it at startup,
+// a config reload or POST /config changes it for good, and POST
+// /admin/loglevel changes it for good or, with a duration, for a while,
+// e.g. debug logs for ten minutes while chasing an issue: the level then
+// reverts when the duration ends. A change replaces the pending revert, if
+// any: a temporary one reverts to the level in effect before the first
+// temporary change, not to the one it replaces, and a lasting one cancels
+// the revert. /info reports the level and the revert.
+
+// logLevelRevert is a pending revert of a temporary log level change.
+type logLevelRevert struct {
+	timer *time.Timer
+	level slog.Level // Level reverted to
+	at    time.Time  // Time of the revert
+}
+
+// pendingLogLevelRevert is the pending revert (nil = none), guarded by
+// reloadMu.
+var pendingLogLevelRevert *logLevelRevert
+
+// levelName returns the name of a log level, as -log-level accepts it.
+func levelName(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
+
+// setLogLevel sets the log level, reverting it after d if d > 0, see
+// above. reloadMu must be held.
+func setLogLevel(level slog.Level, d time.Duration) {
+	base := logLevel.Level()
+	if r := pendingLogLevelRevert; r != nil {
+		r.timer.Stop()
+		base = r.level
+		pendingLogLevelRevert = nil
+	}
+	logLevel.Set(level)
+	setFlagValues("log-level", []string{levelName(level)})
+	if d > 0 {
+		r := &logLevelRevert{level: base, at: time.Now().Add(d)}
+		r.timer = time.AfterFunc(d, func() { revertLogLevel(r) })
+		pendingLogLevelRevert = r
+	}
+}
+
+// revertLogLevel reverts a temporary log level change, unless a later
+// change replaced r.
+func revertLogLevel(r *logLevelRevert) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if pendingLogLevelRevert != r {
+		return // The timer fired while a change was stopping it
+	}
+	pendingLogLevelRevert = nil
+	old := logLevel.Level()
+	logLevel.Set(r.level)
+	setFlagValues("log-level", []string{levelName(r.level)})
+	slog.Warn("Log level reverted", "old", levelName(old), "new", levelName(r.level))
+}
+
+// LogLevelRequest represents the JSON payload for POST /admin/loglevel.
+type LogLevelRequest struct {
+	Level    string    `json:"level"`              // debug, info, warn, or error
+	Duration *Duration `json:"duration,omitempty"` // Time until the level reverts (absent = for good)
+}
+
+// LogLevelResponse represents the JSON response of POST /admin/loglevel.
+type LogLevelResponse struct {
+	Level    string `json:"level"`
+	RevertTo string `json:"revert_to,omitempty"` // Level reverted to, if the change is temporary
+	RevertAt string `json:"revert_at,omitempty"` // Time of the revert (RFC 3339)
+}
+
+// setLogLevelHandler handles POST requests changing the log level.
+func setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var req LogLevelRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeJSONBodyError(w, r, err)
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(req.Level)); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, `Invalid "level" (must be debug, info, warn, or error)`)
+		return
+	}
+	var d time.Duration
+	if req.Duration != nil {
+		if d = time.Duration(*req.Duration); d <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, `"duration" must be > 0`)
+			return
+		}
+	}
+
+	reloadMu.Lock()
+	old := logLevel.Level()
+	setLogLevel(level, d)
+	resp := LogLevelResponse{Level: levelName(level)}
+	if rv := pendingLogLevelRevert; rv != nil {
+		resp.RevertTo, resp.RevertAt = levelName(rv.level), rv.at.Format(time.RFC3339)
+	}
+	reloadMu.Unlock()
+
+	// Logged at the warn level, so it isn't filtered out by most levels
+	slog.Warn("Log level changed", "old", levelName(old), "new", resp.Level, "duration", d,
+		"revert_to", resp.RevertTo, "principal", requestPrincipal(r))
+	writeJSON(w, http.StatusOK, resp)
+}
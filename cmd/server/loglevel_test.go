@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// setTestLogLevel starts the test at level, without a pending revert, and
+// restores the level when it ends.
+func setTestLogLevel(t *testing.T, level slog.Level) {
+	t.Helper()
+	if flag.Lookup("log-level") == nil {
+		flag.String("log-level", "info", "")
+	}
+	prev := logLevel.Level()
+	reloadMu.Lock()
+	setLogLevel(level, 0)
+	reloadMu.Unlock()
+	t.Cleanup(func() {
+		reloadMu.Lock()
+		setLogLevel(prev, 0)
+		reloadMu.Unlock()
+	})
+}
+
+// waitForLogLevel waits until the log level is want.
+func waitForLogLevel(t *testing.T, want slog.Level) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for logLevel.Level() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("log level = %v, want %v", logLevel.Level(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestTemporaryLogLevel checks that a temporary change reverts when its
+// duration ends.
+func TestTemporaryLogLevel(t *testing.T) {
+	setTestLogLevel(t, slog.LevelInfo)
+
+	reloadMu.Lock()
+	setLogLevel(slog.LevelDebug, 20*time.Millisecond)
+	reloadMu.Unlock()
+	if logLevel.Level() != slog.LevelDebug {
+		t.Fatalf("log level = %v, want debug", logLevel.Level())
+	}
+	waitForLogLevel(t, slog.LevelInfo)
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if pendingLogLevelRevert != nil {
+		t.Error("revert still pending after it ran")
+	}
+}
+
+// TestLogLevelChangeReplacesRevert checks that a second change replaces the
+// timer of the first: a temporary one reverts to the level from before the
+// first change at its own time, and a lasting one cancels the revert.
+func TestLogLevelChangeReplacesRevert(t *testing.T) {
+	setTestLogLevel(t, slog.LevelInfo)
+
+	reloadMu.Lock()
+	setLogLevel(slog.LevelDebug, 20*time.Millisecond)
+	first := pendingLogLevelRevert
+	setLogLevel(slog.LevelWarn, 200*time.Millisecond)
+	second := pendingLogLevelRevert
+	reloadMu.Unlock()
+	if second == first || second.level != slog.LevelInfo {
+		t.Fatalf("second revert %+v, want a new one to info", second)
+	}
+
+	// The first timer is stopped: the level stays warn past its time
+	time.Sleep(50 * time.Millisecond)
+	if logLevel.Level() != slog.LevelWarn {
+		t.Fatalf("log level = %v 50ms in, want warn until the second revert", logLevel.Level())
+	}
+	waitForLogLevel(t, slog.LevelInfo)
+
+	reloadMu.Lock()
+	setLogLevel(slog.LevelDebug, 20*time.Millisecond)
+	setLogLevel(slog.LevelError, 0)
+	pending := pendingLogLevelRevert
+	reloadMu.Unlock()
+	if pending != nil {
+		t.Error("lasting change left a revert pending")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if logLevel.Level() != slog.LevelError {
+		t.Errorf("log level = %v after the cancelled revert's time, want error", logLevel.Level())
+	}
+}
+
+// TestSetLogLevelHandler checks the response of POST /admin/loglevel.
+func TestSetLogLevelHandler(t *testing.T) {
+	srv := newTestServer(t)
+	setTestLogLevel(t, slog.LevelInfo)
+	prevToken := adminToken
+	adminToken = "admin-secret"
+	t.Cleanup(func() { adminToken = prevToken })
+	header := http.Header{"Authorization": {"Bearer admin-secret"}}
+
+	resp, data := doRequest(t, srv, http.MethodPost, "/v1/admin/loglevel", `{"level": "debug", "duration": "10m"}`, header)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d %s, want 200", resp.StatusCode, data)
+	}
+	var got LogLevelResponse
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	revertAt, err := time.Parse(time.RFC3339, got.RevertAt)
+	if got.Level != "debug" || got.RevertTo != "info" || err != nil || time.Until(revertAt) < 9*time.Minute {
+		t.Errorf("response %+v, want debug reverting to info in 10m", got)
+	}
+
+	for _, body := range []string{`{"level": "loud"}`, `{"level": "debug", "duration": "-1m"}`} {
+		if resp, data := doRequest(t, srv, http.MethodPost, "/v1/admin/loglevel", body, header); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d %s, want 400", body, resp.StatusCode, data)
+		}
+	}
+	if resp, data := doRequest(t, srv, http.MethodPost, "/v1/admin/loglevel", `{"level": "debug"}`, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without the admin token: status %d %s, want 401", resp.StatusCode, data)
+	}
+}
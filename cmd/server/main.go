@@ -4,14 +4,20 @@
 package main
 
 import (
-	"encoding/json"
+	"compress/gzip"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -21,12 +27,13 @@ import (
 // Global cache instance shared across all HTTP handlers
 var cacheInstance *cache.Cache
 var snapshotManager *cache.SnapshotManager
+var aofRewriteManager *cache.AOFRewriteManager
 
 // SetRequest represents the JSON payload for the /set endpoint
 type SetRequest struct {
-	Key   string `json:"key"`             // Required: the cache key
-	Value string `json:"value"`           // Required: the value to store
-	TTL   *int   `json:"ttl,omitempty"`  // Optional: time-to-live in seconds
+	Key   string  `json:"key"`           // Required: the cache key
+	Value *string `json:"value"`         // Required: the value to store (may be empty, but not absent)
+	TTL   *TTL    `json:"ttl,omitempty"` // Optional: time-to-live in seconds or as a duration string
 }
 
 // DelRequest represents the JSON payload for the /del endpoint
@@ -34,189 +41,898 @@ type DelRequest struct {
 	Key string `json:"key"` // Required: the key to delete
 }
 
+// DelResponse represents the JSON response of the /del endpoint
+type DelResponse struct {
+	Deleted bool `json:"deleted"` // Whether the key existed and was removed
+}
+
+// ErrorResponse is the JSON body of every error response.
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+// ErrorBody describes the error of an ErrorResponse.
+type ErrorBody struct {
+	Code    string `json:"code"`    // Stable error code, e.g. "cache_full" (see response.go)
+	Message string `json:"message"` // Human-readable description
+}
+
+// saveRulesFlag collects the snapshot save rules given with repeated -save flags.
+type saveRulesFlag []cache.SaveRule
+
+// String implements flag.Value.
+func (f saveRulesFlag) String() string {
+	rules := make([]string, len(f))
+	for i, r := range f {
+		rules[i] = r.String()
+	}
+	return strings.Join(rules, ", ")
+}
+
+// Get implements flag.Getter, returning the rules as "<seconds> <changes>" strings.
+func (f saveRulesFlag) Get() any {
+	rules := make([]string, len(f))
+	for i, r := range f {
+		rules[i] = r.String()
+	}
+	return rules
+}
+
+// Set implements flag.Value. A single flag may hold several pairs, e.g. "900 1 300 100".
+func (f *saveRulesFlag) Set(s string) error {
+	rules, err := cache.ParseSaveRules(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, rules...)
+	return nil
+}
+
 // main initializes the cache server and starts the HTTP server.
 // It also launches a background goroutine that periodically cleans up expired keys.
-// Command-line arguments:
-//   [1] aofPath (default: "data/appendonly.aof")
-//   [2] snapshotPath (default: "data/dump.rdb")
-//   [3] maxKeys (default: 0 = unlimited, or set via MAX_KEYS env var)
+// Main flags, each with an environment variable fallback (see flags.go):
+//   -addr host:port is the address the HTTP server listens on (MINIREDIS_ADDR,
+//   default: ":8080")
+//   -aof path is the append-only file (MINIREDIS_AOF, default:
+//   "data/appendonly.aof")
+//   -snapshot path is the snapshot file (MINIREDIS_SNAPSHOT, default:
+//   "data/dump.rdb")
+//   -snapshot-interval 5m is the time between snapshots without -save rules
+//   (MINIREDIS_SNAPSHOT_INTERVAL)
+//   -cleanup-interval 1s is the longest time between two removals of expired
+//   keys (MINIREDIS_CLEANUP_INTERVAL)
+//   -max-keys N limits the number of keys, enforced by the eviction policy
+//   (MINIREDIS_MAX_KEYS, or MAX_KEYS; default: 0 = unlimited)
+//   -log-level debug, info, warn, or error (MINIREDIS_LOG_LEVEL, default: info)
+//   -aof-fsync always, everysec, or no syncs AOF writes to disk after every
+//   write, once per second, or when the operating system does
+//   (MINIREDIS_AOF_FSYNC, default: always)
+//   -config path loads a YAML or JSON config file, whose settings are
+//   overridden by flags and environment variables (MINIREDIS_CONFIG)
+//   -version prints the version and exits
+// Other flags:
+//   -save "<seconds> <changes>" snapshots once at least <changes> changes were
+//   made and <seconds> passed since the last snapshot (repeatable, like the
+//   Redis "save" directive); without it, snapshots are taken every
+//   -snapshot-interval
+//   -snapshot-keep N keeps N older snapshots as <snapshotPath>.1 ... .N
+//   -strict-snapshot=false starts without the snapshot if it is corrupted,
+//   instead of refusing to start (default: true)
+//   -restore-from path boots from an older snapshot, e.g. data/dump.rdb.2; the
+//   AOF is rewritten from it and the previous AOF kept as <aofPath>.before-restore
+//   -no-persistence keeps the dataset in memory only: no AOF or snapshot is
+//   read or written (-aof and -snapshot are ignored)
+//   -restore-max-bytes N limits the size of snapshots uploaded to POST /restore
+//   (default: 512MB)
+//   -max-body-bytes N limits the size of JSON request bodies (default: 8MB;
+//   larger values are stored with PUT /keys/{key})
+//   -shutdown-endpoint lets admins shut the server down with
+//   POST /admin/shutdown, -shutdown-delay after answering (default: 1s)
+//   -unix-socket path also serves the API on a unix socket, with the file
+//   permissions of -unix-socket-perm (default: 0660)
+//   -idempotency-window d is the time writes with an Idempotency-Key header
+//   are remembered to replay their response to retries (default: 24h)
+//   -replicaof host:port makes the server a read-only replica of that primary
+//   (changed at runtime with POST /replicaof, e.g. to promote it on failover)
+//   -cluster-slots "host1:8080=0-8191,host2:8080=8192-16383" (or
+//   -cluster-config with a slot map file) and -cluster-node host:port enable
+//   cluster mode: keys of slots owned by other nodes are redirected (MOVED)
+//   -min-replicas-to-write N rejects writes with 503 unless N replicas
+//   acknowledged within -min-replicas-max-lag (default: 10s)
+//   -maxmemory 512mb limits the estimated memory of the dataset (bytes, or
+//   with a kb, mb, or gb suffix); keys are evicted by the eviction policy
+//   when a write would exceed it (default: 0 = unlimited)
+//   -eviction-policy lfu evicts the least frequently used keys when maxKeys
+//   is reached instead of the least recently used ones, allkeys-random
+//   evicts random keys, volatile-ttl the keys expiring first, and noeviction
+//   rejects new keys with 507 instead (default: lru)
+// Deprecated command-line arguments, used for the flags that aren't given:
+//   [1] aofPath (-aof)
+//   [2] snapshotPath (-snapshot)
+//   [3] maxKeys (-max-keys)
+// Environment variables:
+//   AOF_LOAD_TRUNCATED=no refuses to start when the AOF has a corrupted tail
+//   instead of truncating it (default: yes)
+//   SHUTDOWN_SNAPSHOT_TIMEOUT limits how long shutdown waits for the final
+//   snapshot, e.g. "30s" (default: 60s)
+//   SNAPSHOT_FORMAT=binary writes snapshots in the binary format (default: json)
+//   SNAPSHOT_COMPRESSION=gzip compresses snapshot files (default: none)
+//   SNAPSHOT_COMPRESSION_LEVEL sets the gzip level, 1 (fastest) to 9 (smallest)
+//   SNAPSHOT_SINK_DIR copies every snapshot to this directory (e.g. a network
+//   file system) and downloads it from there if the local snapshot is missing
+//   SNAPSHOT_S3_BUCKET does the same with an S3-compatible object store, with
+//   SNAPSHOT_S3_ENDPOINT (default: AWS S3 in the region), SNAPSHOT_S3_REGION
+//   (default: us-east-1), SNAPSHOT_S3_PREFIX, AWS_ACCESS_KEY_ID, and
+//   AWS_SECRET_ACCESS_KEY
+//   ADMIN_TOKEN enables admin endpoints (POST /restore, GET /backup,
+//   POST /replicaof), which require
+//   "Authorization: Bearer <ADMIN_TOKEN>" (default: disabled); replicas
+//   connect to the primary's /replication endpoints with the same token
+//   PRIMARY_TOKEN is the ADMIN_TOKEN of the primary, for -replicaof and
+//   POST /replicaof
+//   (default: ADMIN_TOKEN)
 func main() {
-	// Determine file paths (defaults)
-	aofPath := "data/appendonly.aof"
-	snapshotPath := "data/dump.rdb"
-	maxKeys := 0
-
-	if len(os.Args) > 1 {
-		aofPath = os.Args[1]
+	addr := flag.String("addr", envString("MINIREDIS_ADDR", ":8080"), "address the HTTP server listens on, host:port (env MINIREDIS_ADDR)")
+	aofFile := flag.String("aof", envString("MINIREDIS_AOF", "data/appendonly.aof"), "append-only file (env MINIREDIS_AOF)")
+	snapshotFile := flag.String("snapshot", envString("MINIREDIS_SNAPSHOT", "data/dump.rdb"), "snapshot file (env MINIREDIS_SNAPSHOT)")
+	snapshotInterval := flag.Duration("snapshot-interval", envDuration("MINIREDIS_SNAPSHOT_INTERVAL", 5*time.Minute), "time between snapshots without -save rules (env MINIREDIS_SNAPSHOT_INTERVAL)")
+	cleanupInterval := flag.Duration("cleanup-interval", envDuration("MINIREDIS_CLEANUP_INTERVAL", time.Second), "longest time between two removals of expired keys (env MINIREDIS_CLEANUP_INTERVAL)")
+	maxKeys := flag.Int("max-keys", envInt("MINIREDIS_MAX_KEYS", envInt("MAX_KEYS", 0)), "key limit, enforced by the eviction policy (0: unlimited; env MINIREDIS_MAX_KEYS)")
+	logLevelName := flag.String("log-level", envString("MINIREDIS_LOG_LEVEL", "info"), "log level: debug, info, warn, or error (env MINIREDIS_LOG_LEVEL)")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.StringVar(&configFilePath, "config", envString("MINIREDIS_CONFIG", ""), "YAML or JSON config file, overridden by flags and environment variables, reloaded on SIGHUP (env MINIREDIS_CONFIG)")
+	aofFsync := flag.String("aof-fsync", envString("MINIREDIS_AOF_FSYNC", "always"), "when AOF writes are synced to disk: always, everysec, or no (env MINIREDIS_AOF_FSYNC)")
+	var saveRules saveRulesFlag
+	flag.Var(&saveRules, "save", `snapshot after "<seconds> <changes>", e.g. "900 1" (repeatable; replaces the 5 minute interval)`)
+	snapshotKeep := flag.Int("snapshot-keep", 0, "number of older snapshot generations to keep (<snapshot>.1 is the newest)")
+	strictSnapshot := flag.Bool("strict-snapshot", true, "refuse to start if the snapshot is corrupted (false: ignore it and start from the AOF)")
+	restoreFrom := flag.String("restore-from", "", "restore the dataset from this snapshot file instead of the snapshot and AOF")
+	noPersistence := flag.Bool("no-persistence", false, "keep the dataset in memory only (no AOF, no snapshots, no files)")
+	replicaOf := flag.String("replicaof", "", "replicate the primary at host:port (client writes are rejected)")
+	flag.IntVar(&minReplicasToWrite, "min-replicas-to-write", 0, "reject writes unless this many replicas are in sync (0: disabled)")
+	flag.DurationVar(&minReplicasMaxLag, "min-replicas-max-lag", 10*time.Second, "largest acknowledgement age of a replica counted by -min-replicas-to-write")
+	clusterSlots := flag.String("cluster-slots", "", `enable cluster mode with this slot map, e.g. "host1:8080=0-8191,host2:8080=8192-16383"`)
+	clusterConfig := flag.String("cluster-config", "", "enable cluster mode with the slot map in this file")
+	flag.StringVar(&clusterNode, "cluster-node", "", "host:port of this node in the cluster slot map")
+	maxMemory := flag.String("maxmemory", "0", "memory limit of the dataset in bytes, or with a kb, mb, or gb suffix (0: unlimited)")
+	evictionPolicy := flag.String("eviction-policy", "lru", "key evicted when maxKeys is reached: lru, lfu, allkeys-random, volatile-ttl, or noeviction (reject new keys)")
+	flag.DurationVar(&maxTTL, "max-ttl", 0, "longest TTL accepted by /set, e.g. 720h (0: no limit)")
+	flag.BoolVar(&headTouches, "head-touches-lru", false, "count HEAD requests for keys as accesses for eviction (false: probes don't keep keys hot)")
+	maxValueBytes := flag.Int("max-value-bytes", defaultMaxValueBytes, "largest value accepted by writes, in bytes (0: unlimited)")
+	maxKeyLength := flag.Int("max-key-length", 0, "longest key accepted by writes, in bytes (0: unlimited)")
+	keyCharset := flag.String("key-charset", "", `characters accepted in keys by writes: "visible" (printable ASCII without spaces) or a set like "a-zA-Z0-9:_.-" (default: any)`)
+	keyPrefix := flag.String("key-prefix", "", `regular expression every key written must start with, e.g. "(user|session):" (default: any)`)
+	flag.IntVar(&gzipMinBytes, "gzip-min-bytes", defaultGzipMinBytes, "smallest response body gzipped for clients accepting it (0: no compression)")
+	flag.IntVar(&pipelineMaxCommands, "pipeline-max-commands", defaultPipelineMaxCommands, "largest number of commands accepted by POST /pipeline")
+	flag.Int64Var(&maxBodyBytes, "max-body-bytes", defaultMaxBodyBytes, "largest JSON request body accepted by /set, /del, /pipeline, and the admin endpoints, in bytes (larger values: PUT /keys/{key})")
+	flag.Int64Var(&restoreMaxBytes, "restore-max-bytes", defaultRestoreMaxBytes, "largest snapshot accepted by POST /restore, in bytes")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", defaultReadHeaderTimeout, "longest time to read the headers of a request (0: no timeout)")
+	flag.DurationVar(&readTimeout, "read-timeout", defaultReadTimeout, "longest time to read a request, or a chunk of a long upload (0: no timeout)")
+	flag.DurationVar(&writeTimeout, "write-timeout", defaultWriteTimeout, "longest time to write a response, or a chunk of a long download or stream (0: no timeout)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", defaultIdleTimeout, "time a keep-alive connection is kept open without requests (0: -read-timeout)")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "largest request headers accepted, in bytes")
+	flag.BoolVar(&h2c, "h2c", true, "also serve HTTP/2 without TLS to clients that start with it (prior knowledge); with TLS, HTTP/2 is negotiated")
+	flag.StringVar(&tlsCertFile, "tls-cert", envString("MINIREDIS_TLS_CERT", ""), "serve HTTPS with this PEM certificate (chain), reloaded on SIGHUP (env MINIREDIS_TLS_CERT)")
+	flag.StringVar(&tlsKeyFile, "tls-key", envString("MINIREDIS_TLS_KEY", ""), "PEM private key of -tls-cert (env MINIREDIS_TLS_KEY)")
+	flag.BoolVar(&tlsSelfSigned, "tls-self-signed", false, "serve HTTPS with a certificate generated at startup, for development")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", envString("MINIREDIS_TLS_CLIENT_CA", ""), "require client certificates issued by a CA in this PEM bundle (env MINIREDIS_TLS_CLIENT_CA)")
+	flag.Var(&tlsClientAllow, "tls-client-allow", "only accept client certificates with one of these identities, common names or subject alternative names (comma-separated, repeatable)")
+	flag.BoolVar(&noAuth, "no-auth", false, "don't require API tokens or signatures, for local development")
+	flag.StringVar(&aclFilePath, "acl-file", envString("MINIREDIS_ACL_FILE", ""), "YAML or JSON file of ACL users and what they may do, reloaded on SIGHUP (env MINIREDIS_ACL_FILE)")
+	flag.DurationVar(&hmacMaxSkew, "hmac-max-skew", defaultHMACMaxSkew, "largest difference between the X-Timestamp of a signed request and the server clock")
+	for class, name := range routeClassNames {
+		flag.Var(&ipAllow[class], "ip-allow-"+name, "only accept "+name+" requests from these CIDRs or addresses (comma-separated, repeatable)")
+		flag.Var(&ipDeny[class], "ip-deny-"+name, "reject "+name+" requests from these CIDRs or addresses (comma-separated, repeatable)")
 	}
-	if len(os.Args) > 2 {
-		snapshotPath = os.Args[2]
+	for class, name := range routeClassNames {
+		flag.IntVar(&rateLimits[class], "rate-limit-"+name, 0, "largest number of "+name+" requests per second of each client (0: unlimited)")
+		flag.IntVar(&rateBursts[class], "rate-burst-"+name, 0, "largest burst of "+name+" requests of each client (0: -rate-limit-"+name+")")
 	}
-	if len(os.Args) > 3 {
-		if val, err := strconv.Atoi(os.Args[3]); err == nil {
-			maxKeys = val
-		} else {
-			log.Fatalf("Invalid maxKeys value: %s (must be a positive integer or 0 for unlimited)", os.Args[3])
+	flag.Var(&rateLimitExempt, "rate-limit-exempt", "principals (API token, HMAC key, or certificate names) exempt from rate limits (comma-separated, repeatable)")
+	flag.IntVar(&maxConnections, "max-connections", 0, "largest number of open client connections; more wait to be accepted (0: unlimited)")
+	flag.IntVar(&maxRequests, "max-requests", 0, "largest number of requests handled at once, long transfers excluded (0: unlimited)")
+	flag.IntVar(&requestQueue, "request-queue", defaultRequestQueue, "requests waiting for a slot beyond -max-requests before getting 503")
+	flag.DurationVar(&requestQueueTimeout, "request-queue-timeout", defaultRequestQueueTimeout, "longest wait of a request for a slot of -max-requests")
+	flag.IntVar(&maxStreams, "max-streams", 0, "largest number of long transfers at once: replication streams, /backup, and /restore (0: unlimited)")
+	flag.Var(&corsOrigins, "cors-origins", `browser origins allowed to call the API, e.g. https://dash.example.com, https://*.example.com, or * (comma-separated, repeatable)`)
+	flag.Var(&corsMethods, "cors-methods", "methods allowed by CORS preflights (comma-separated, repeatable; default "+strings.Join(defaultCORSMethods, ",")+")")
+	flag.Var(&corsHeaders, "cors-headers", "request headers allowed by CORS preflights (comma-separated, repeatable; default "+strings.Join(defaultCORSHeaders, ",")+")")
+	flag.DurationVar(&corsMaxAge, "cors-max-age", defaultCORSMaxAge, "time browsers may cache CORS preflight results")
+	flag.BoolVar(&corsCredentials, "cors-credentials", false, "let browsers send credentials (cookies, Authorization) with CORS requests")
+	flag.Var(&trustedProxies, "trusted-proxies", "proxies whose X-Forwarded-For header is trusted for IP filtering, CIDRs or addresses (comma-separated, repeatable)")
+	flag.BoolVar(&readOnlyFlag, "read-only", false, "reject client writes with 503 and pause eviction, e.g. during a migration (switched at runtime with POST /admin/readonly)")
+	flag.BoolVar(&shutdownEndpoint, "shutdown-endpoint", false, "let admins shut the server down with POST /admin/shutdown, like SIGTERM")
+	flag.DurationVar(&shutdownDelay, "shutdown-delay", defaultShutdownDelay, "time between a POST /admin/shutdown response and the start of the shutdown")
+	flag.DurationVar(&shutdownDrainDelay, "shutdown-drain-delay", 0, "time the readiness probe fails before a graceful shutdown closes connections, so load balancers drain traffic")
+	flag.DurationVar(&idempotencyWindow, "idempotency-window", defaultIdempotencyWindow, "time the response of a write with an Idempotency-Key header is replayed for retries (0: ignore the header)")
+	flag.StringVar(&unixSocket, "unix-socket", "", "also serve the API on this unix socket, e.g. /var/run/mini-redis.sock")
+	flag.StringVar(&unixSocketPerm, "unix-socket-perm", defaultUnixSocketPerm, "permissions of the -unix-socket file, in octal")
+	flag.StringVar(&healthAddr, "health-addr", "", "also serve the health check over plain HTTP on this loopback address, e.g. 127.0.0.1:8081")
+	flag.StringVar(&grpcAddr, "grpc-addr", "", "also serve the gRPC API on this address, e.g. :9090 (see internal/grpcapi/miniredis.proto)")
+	flag.StringVar(&respAddr, "resp-addr", "", "also serve the Redis protocol (RESP) on this address, e.g. :6379, for Redis clients and redis-benchmark")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	applyPositionalArgs(flag.Args())
+	recordCommandLineFlags()
+	if configFilePath != "" {
+		var err error
+		if configFile, err = loadConfigFile(configFilePath); err != nil {
+			log.Fatalf("Invalid config file %s: %v", configFilePath, err)
 		}
-	} else {
-		// Check environment variable
-		if envMaxKeys := os.Getenv("MAX_KEYS"); envMaxKeys != "" {
-			if val, err := strconv.Atoi(envMaxKeys); err == nil {
-				maxKeys = val
-			}
+		if err := applyConfigFile(configFile); err != nil {
+			log.Fatalf("Invalid config file %s: %v", configFilePath, err)
 		}
+	} else {
+		configFile = new(Config)
+	}
+	setupLogging(*logLevelName)
+	if args := flag.Args(); len(args) > 0 {
+		slog.Warn("Positional arguments are deprecated, use -aof, -snapshot, and -max-keys", "args", strings.Join(args, " "))
 	}
 
-	if maxKeys < 0 {
-		log.Fatalf("maxKeys must be >= 0 (0 = unlimited)")
+	aofPath, snapshotPath := *aofFile, *snapshotFile
+	if *maxKeys < 0 {
+		log.Fatalf("Invalid -max-keys value: %d (must be >= 0, 0 = unlimited)", *maxKeys)
+	}
+	if *snapshotInterval <= 0 {
+		log.Fatalf("Invalid -snapshot-interval value: %v (must be > 0)", *snapshotInterval)
+	}
+	if *cleanupInterval <= 0 {
+		log.Fatalf("Invalid -cleanup-interval value: %v (must be > 0)", *cleanupInterval)
 	}
 
 	// Ensure the directory exists
-	if err := os.MkdirAll(filepath.Dir(aofPath), 0755); err != nil {
+	if *noPersistence {
+		aofPath, snapshotPath = "", ""
+	} else if err := os.MkdirAll(filepath.Dir(aofPath), 0755); err != nil {
 		log.Fatalf("Failed to create data directory: %v", err)
 	}
 
-	// Initialize cache with AOF persistence and snapshot support
-	var err error
-	cacheInstance, err = cache.NewCache(aofPath, snapshotPath, maxKeys)
+	// How long shutdown waits for the final snapshot
+	shutdownSnapshotTimeout := 60 * time.Second
+	if env := os.Getenv("SHUTDOWN_SNAPSHOT_TIMEOUT"); env != "" {
+		val, err := time.ParseDuration(env)
+		if err != nil || val <= 0 {
+			log.Fatalf("Invalid SHUTDOWN_SNAPSHOT_TIMEOUT: %s (must be a positive duration, e.g. 30s)", env)
+		}
+		shutdownSnapshotTimeout = val
+	}
+
+	if restoreMaxBytes <= 0 {
+		log.Fatalf("Invalid -restore-max-bytes value: %d (must be > 0)", restoreMaxBytes)
+	}
+	if gzipMinBytes < 0 {
+		log.Fatalf("Invalid -gzip-min-bytes value: %d (must be >= 0)", gzipMinBytes)
+	}
+	if *maxValueBytes < 0 {
+		log.Fatalf("Invalid -max-value-bytes value: %d (must be >= 0)", *maxValueBytes)
+	}
+	if *maxKeyLength < 0 {
+		log.Fatalf("Invalid -max-key-length value: %d (must be >= 0)", *maxKeyLength)
+	}
+	if maxBodyBytes <= 0 {
+		log.Fatalf("Invalid -max-body-bytes value: %d (must be > 0)", maxBodyBytes)
+	}
+	if readHeaderTimeout < 0 || readTimeout < 0 || writeTimeout < 0 || idleTimeout < 0 {
+		log.Fatalf("Invalid -read-header-timeout, -read-timeout, -write-timeout, or -idle-timeout value (must be >= 0, 0 = no timeout)")
+	}
+	if maxHeaderBytes <= 0 {
+		log.Fatalf("Invalid -max-header-bytes value: %d (must be > 0)", maxHeaderBytes)
+	}
+	if err := checkCORS(); err != nil {
+		log.Fatalf("Invalid CORS configuration: %v", err)
+	}
+	if maxConnections < 0 || maxRequests < 0 || requestQueue < 0 || requestQueueTimeout < 0 || maxStreams < 0 {
+		log.Fatalf("Invalid -max-connections, -max-requests, -request-queue, -request-queue-timeout, or -max-streams value (must be >= 0)")
+	}
+	if shutdownDelay < 0 || shutdownDrainDelay < 0 {
+		log.Fatalf("Invalid -shutdown-delay or -shutdown-drain-delay value (must be >= 0)")
+	}
+	if _, err := parseSocketPerm(unixSocketPerm); err != nil {
+		log.Fatalf("Invalid -unix-socket-perm value: %v", err)
+	}
+	if idempotencyWindow < 0 {
+		log.Fatalf("Invalid -idempotency-window value: %v (must be >= 0)", idempotencyWindow)
+	}
+	if healthAddr != "" {
+		if err := checkLoopbackAddr(healthAddr); err != nil {
+			log.Fatalf("Invalid -health-addr value: %v", err)
+		}
+	}
+
+	if minReplicasToWrite < 0 || minReplicasMaxLag <= 0 {
+		log.Fatalf("Invalid -min-replicas-to-write or -min-replicas-max-lag value (must be >= 0 and > 0)")
+	}
+	if minReplicasToWrite > 0 && *noPersistence {
+		log.Fatalf("-min-replicas-to-write requires persistence, since replicas are fed from the AOF")
+	}
+
+	if err := configureCluster(*clusterSlots, *clusterConfig, clusterNode); err != nil {
+		log.Fatalf("Invalid cluster configuration: %v", err)
+	}
+
+	// Bearer token for admin endpoints such as /restore (disabled without one)
+	adminToken = envString("ADMIN_TOKEN", deref(configFile.Security.AdminToken))
+
+	// Named API tokens required by every endpoint but the health check
+	tokenSpecs := configFile.Security.APITokens
+	if env, ok := os.LookupEnv("MINIREDIS_API_TOKENS"); ok {
+		tokenSpecs = strings.Split(env, ",")
+	}
+	tokens, err := parseAPITokens(tokenSpecs)
+	if err != nil {
+		log.Fatalf("Invalid MINIREDIS_API_TOKENS: %v", err)
+	}
+	apiTokens = tokens
+	keySpecs := configFile.Security.HMACKeys
+	if env, ok := os.LookupEnv("MINIREDIS_HMAC_KEYS"); ok {
+		keySpecs = strings.Split(env, ",")
+	}
+	if hmacKeys, err = parseHMACKeys(keySpecs); err != nil {
+		log.Fatalf("Invalid MINIREDIS_HMAC_KEYS: %v", err)
+	}
+	if len(hmacKeys) > 0 {
+		if hmacMaxSkew <= 0 {
+			log.Fatalf("Invalid -hmac-max-skew value: %v (must be > 0)", hmacMaxSkew)
+		}
+		startSignatureCache()
+	}
+	if err := configureIPFilter(); err != nil {
+		log.Fatalf("Invalid IP filter: %v", err)
+	}
+	if err := configureRateLimits(); err != nil {
+		log.Fatalf("Invalid rate limit: %v", err)
+	}
+	go sweepRateLimiters()
+	if aclFilePath != "" {
+		a, err := loadACLFile(aclFilePath)
+		if err != nil {
+			log.Fatalf("Invalid ACL file %s: %v", aclFilePath, err)
+		}
+		currentACL.Store(a)
+		slog.Info("ACL loaded", "path", aclFilePath, "users", len(a.users))
+	}
+	if noAuth && (len(apiTokens)+len(hmacKeys) > 0 || aclFilePath != "") {
+		slog.Warn("API token, signature, and ACL checks are disabled by -no-auth")
+	}
+
+	// Truncate a corrupted AOF tail on startup unless disabled
+	aofLoadTruncated := os.Getenv("AOF_LOAD_TRUNCATED") != "no"
+
+	opts := []cache.Option{cache.WithAOFLoadTruncated(aofLoadTruncated), cache.WithDeferredLoad()}
+	opts = append(opts, cache.WithCleanupInterval(*cleanupInterval))
+	opts = append(opts, cache.WithStrictSnapshotLoad(*strictSnapshot))
+	if *snapshotKeep < 0 {
+		log.Fatalf("Invalid -snapshot-keep value: %d (must be >= 0)", *snapshotKeep)
+	}
+	if *snapshotKeep > 0 {
+		opts = append(opts, cache.WithSnapshotRetention(*snapshotKeep))
+	}
+	if *restoreFrom != "" {
+		opts = append(opts, cache.WithRestoreFrom(*restoreFrom))
+	}
+	fsync, err := cache.ParseFsyncPolicy(*aofFsync)
+	if err != nil {
+		log.Fatalf("Invalid -aof-fsync value: %v", err)
+	}
+	opts = append(opts, cache.WithAOFFsync(fsync))
+	policy, err := cache.ParseEvictionPolicy(*evictionPolicy)
+	if err != nil {
+		log.Fatalf("Invalid -eviction-policy value: %v", err)
+	}
+	opts = append(opts, cache.WithEvictionPolicy(policy))
+	opts = append(opts, cache.WithMaxKeyLength(*maxKeyLength), cache.WithMaxValueSize(*maxValueBytes))
+	if *keyCharset != "" || *keyPrefix != "" {
+		keyPolicy, err := cache.NewKeyPolicy(*keyCharset, *keyPrefix)
+		if err != nil {
+			log.Fatalf("Invalid key policy: %v", err)
+		}
+		opts = append(opts, cache.WithKeyPolicy(keyPolicy))
+		slog.Info("Key policy", "policy", keyPolicy.String())
+	}
+	maxMemoryBytes, err := parseMemorySize(*maxMemory)
+	if err != nil {
+		log.Fatalf("Invalid -maxmemory value: %v", err)
+	}
+	if maxMemoryBytes > 0 {
+		opts = append(opts, cache.WithMaxMemory(maxMemoryBytes))
+	}
+
+	// Snapshot encoding (both formats are always readable)
+	switch format := os.Getenv("SNAPSHOT_FORMAT"); format {
+	case "", "json":
+	case "binary":
+		opts = append(opts, cache.WithSnapshotFormat(cache.SnapshotFormatBinary))
+	default:
+		log.Fatalf("Invalid SNAPSHOT_FORMAT: %s (must be json or binary)", format)
+	}
+
+	// Optional snapshot compression
+	switch compression := os.Getenv("SNAPSHOT_COMPRESSION"); compression {
+	case "", "none":
+	case "gzip":
+		level := gzip.DefaultCompression
+		if envLevel := os.Getenv("SNAPSHOT_COMPRESSION_LEVEL"); envLevel != "" {
+			val, err := strconv.Atoi(envLevel)
+			if err != nil || val < gzip.BestSpeed || val > gzip.BestCompression {
+				log.Fatalf("Invalid SNAPSHOT_COMPRESSION_LEVEL: %s (must be 1-9)", envLevel)
+			}
+			level = val
+		}
+		opts = append(opts, cache.WithSnapshotCompression(level))
+	default:
+		log.Fatalf("Invalid SNAPSHOT_COMPRESSION: %s (must be gzip or none)", compression)
+	}
+
+	// Optional remote copy of snapshots
+	sink, err := snapshotSinkFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid snapshot sink: %v", err)
+	}
+	if sink != nil {
+		opts = append(opts, cache.WithSnapshotSink(sink))
+		slog.Info("Snapshots are uploaded", "sink", sink.String())
+	}
+
+	slog.Info("Starting "+versionString())
+	logConfiguration()
+
+	// Initialize cache with AOF persistence and snapshot support.
+	// Loading is deferred so the HTTP server can report the loading state
+	// (503 on data endpoints) while a large AOF is replayed.
+	cacheInstance, err = cache.NewCache(aofPath, snapshotPath, *maxKeys, opts...)
 	if err != nil {
 		log.Fatalf("Failed to initialize cache: %v", err)
 	}
 	defer cacheInstance.Close()
 
-	if maxKeys > 0 {
-		fmt.Printf("Cache initialized with AOF: %s, Snapshot: %s, MaxKeys: %d\n", aofPath, snapshotPath, maxKeys)
-	} else {
-		fmt.Printf("Cache initialized with AOF: %s, Snapshot: %s, MaxKeys: unlimited\n", aofPath, snapshotPath)
+	// Replicate the primary instead of accepting writes
+	primaryToken = envString("PRIMARY_TOKEN", deref(configFile.Security.PrimaryToken))
+	if primaryToken == "" {
+		primaryToken = adminToken
 	}
-
-	// Start snapshot manager (creates snapshots every 5 minutes and clears AOF)
-	snapshotInterval := 5 * time.Minute
-	snapshotManager = cache.NewSnapshotManager(cacheInstance, snapshotPath, snapshotInterval)
-	if err := snapshotManager.Start(); err != nil {
-		log.Fatalf("Failed to start snapshot manager: %v", err)
+	if *replicaOf != "" {
+		replica, err = cache.NewReplica(cacheInstance, *replicaOf, primaryToken)
+		if err != nil {
+			log.Fatalf("Invalid -replicaof value: %v", err)
+		}
 	}
-	defer snapshotManager.Stop()
 
-	fmt.Printf("Snapshot manager started (interval: %v)\n", snapshotInterval)
+	// Create background managers (started once the dataset is loaded)
+	if !*noPersistence {
+		snapshotManager = cache.NewSnapshotManager(cacheInstance, snapshotPath, *snapshotInterval)
+		if len(saveRules) > 0 {
+			if err := snapshotManager.SetSaveRules(saveRules); err != nil {
+				log.Fatalf("Invalid save rules: %v", err)
+			}
+		}
+		aofRewriteManager = cache.NewAOFRewriteManager(cacheInstance, 1*time.Second)
+	}
 
-	// Start background cleaner goroutine that runs every second
-	// This proactively removes expired keys, simulating real cache behavior
+	// Start serving before loading, so clients see 503 instead of an empty cache
+	server := newServer(*addr, withClientStats(withCORS(withClientIdentity(requireAuth(withClientPrincipal(newRouter()))))))
+	trackClients(server)
+	server.RegisterOnShutdown(cacheInstance.DisconnectReplicas) // Replication streams never finish on their own
+	if tlsEnabled() {
+		tlsConfig, err := newTLSConfig()
+		if err != nil {
+			log.Fatalf("Invalid TLS configuration: %v", err)
+		}
+		server.TLSConfig = tlsConfig
+	}
+	if readOnlyFlag {
+		setReadOnly(true)
+		slog.Warn("Read-only mode: client writes are rejected")
+	}
+	configureLimits()
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", server.Addr, err)
+	}
+	serverErr := make(chan error, 1)
 	go func() {
-		ticker := time.NewTicker(1 * time.Second)
-		defer ticker.Stop()
-		for range ticker.C {
-			cacheInstance.Cleanup()
+		if server.TLSConfig != nil {
+			serverErr <- server.ServeTLS(clientListener{limitListener{listener}}, "", "")
+		} else {
+			serverErr <- server.Serve(clientListener{limitListener{listener}})
 		}
 	}()
+	slog.Info("Server running", "addr", *addr, "tls", server.TLSConfig != nil)
+	if unixSocket != "" {
+		perm, _ := parseSocketPerm(unixSocketPerm) // Checked with the flags
+		socketListener, err := listenUnix(unixSocket, perm)
+		if err != nil {
+			log.Fatalf("Failed to listen on unix socket %s: %v", unixSocket, err)
+		}
+		go func() {
+			serverErr <- server.Serve(clientListener{limitListener{socketListener}})
+		}()
+		slog.Info("Unix socket listener running", "path", unixSocket, "perm", unixSocketPerm)
+	}
+	if healthAddr != "" {
+		healthServer := newHealthServer(healthAddr)
+		server.RegisterOnShutdown(func() { healthServer.Close() })
+		go func() {
+			if err := healthServer.ListenAndServe(); err != http.ErrServerClosed {
+				serverErr <- fmt.Errorf("health check listener: %w", err)
+			}
+		}()
+		slog.Info("Health check listener running", "addr", healthAddr)
+	}
+	if grpcAddr != "" {
+		grpcServer = newGRPCServer(grpcAddr)
+		if server.TLSConfig != nil {
+			grpcServer.TLSConfig = server.TLSConfig.Clone()
+		}
+		grpcListener, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", grpcAddr, err)
+		}
+		go serveGRPC(grpcListener, serverErr)
+		slog.Info("gRPC listener running", "addr", grpcAddr, "tls", grpcServer.TLSConfig != nil)
+	}
+	if respAddr != "" {
+		respListener, err := net.Listen("tcp", respAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", respAddr, err)
+		}
+		respAPI = newRESPServer(respListener, server.TLSConfig)
+		go respAPI.serve(serverErr)
+		slog.Info("RESP listener running", "addr", respAddr, "tls", respAPI.tlsConfig != nil)
+	}
+
+	// Load snapshot and replay AOF
+	if err := cacheInstance.Load(); err != nil {
+		log.Fatalf("Failed to load cache: %v", err)
+	}
+
+	if *noPersistence {
+		slog.Info("Cache initialized without persistence", "max_keys", maxKeysString(*maxKeys, policy))
+	} else {
+		slog.Info("Cache initialized", "aof", aofPath, "snapshot", snapshotPath, "max_keys", maxKeysString(*maxKeys, policy))
+	}
+
+	if !*noPersistence {
+		// Start snapshot manager (creates snapshots every -snapshot-interval and compacts AOF)
+		if err := snapshotManager.Start(); err != nil {
+			log.Fatalf("Failed to start snapshot manager: %v", err)
+		}
+		defer snapshotManager.Stop()
+
+		if len(saveRules) > 0 {
+			slog.Info("Snapshot manager started", "save_rules", saveRules.String())
+		} else {
+			slog.Info("Snapshot manager started", "interval", *snapshotInterval)
+		}
+
+		// Start automatic AOF rewrite manager (checks the AOF size every second)
+		if err := aofRewriteManager.Start(); err != nil {
+			log.Fatalf("Failed to start AOF rewrite manager: %v", err)
+		}
+		defer aofRewriteManager.Stop()
+	}
+
+	if replica := currentReplica(); replica != nil {
+		if err := replica.Start(); err != nil {
+			log.Fatalf("Failed to start replication: %v", err)
+		}
+		slog.Info("Replicating (writes are rejected)", "primary", *replicaOf)
+	}
+
+	// Start background cleaner goroutine that runs whenever a key is due
+	// This proactively removes expired keys, simulating real cache behavior
+	go cacheInstance.RunCleanup(nil)
 
-	// Setup graceful shutdown
+	// Reload the config file on SIGHUP
+	go reloadOnSIGHUP()
+
+	// Wait for a shutdown signal, then shut down gracefully
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-sigChan
-		fmt.Println("\nShutting down gracefully...")
-		snapshotManager.Stop()
-		if err := cacheInstance.Close(); err != nil {
-			log.Printf("Error closing cache: %v", err)
+	select {
+	case err := <-serverErr:
+		log.Fatalf("Server failed: %v", err)
+	case <-sigChan:
+		shutdown(server, shutdownSnapshotTimeout)
+	case <-shutdownRequests:
+		shutdown(server, shutdownSnapshotTimeout)
+	}
+}
+
+// requireLoaded wraps a data handler so it returns 503 Service Unavailable
+// while the dataset is still being loaded from disk.
+func requireLoaded(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cacheInstance.Loading() {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, codeLoading, "Loading dataset in memory")
+			return
 		}
-		os.Exit(0)
-	}()
+		next(w, r)
+	}
+}
 
-	// Register HTTP route handlers
-	http.HandleFunc("/", healthHandler)    // Health check endpoint
-	http.HandleFunc("/set", setHandler)   // POST: Set a key-value pair
-	http.HandleFunc("/get", getHandler)   // GET: Retrieve a value by key
-	http.HandleFunc("/del", delHandler)   // POST: Delete a key
+// requirePersistence wraps a persistence handler so it returns 409 Conflict
+// when the server runs with -no-persistence.
+func requirePersistence(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cacheInstance.Persistent() {
+			writeError(w, r, http.StatusConflict, codePersistenceDisabled, "Persistence is disabled")
+			return
+		}
+		next(w, r)
+	}
+}
 
-	fmt.Println("Server running on http://localhost:8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatalf("Server failed: %v", err)
+// parseMemorySize parses a memory size in bytes, optionally with a kb, mb,
+// or gb suffix (powers of 1024, like Redis), e.g. "512mb".
+func parseMemorySize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}}
+
+	num, scale := strings.ToLower(strings.TrimSpace(s)), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, scale = strings.TrimSuffix(num, u.suffix), u.scale
+			break
+		}
+	}
+	val, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || val < 0 || val > math.MaxInt64/scale {
+		return 0, fmt.Errorf("%q is not a valid size (e.g. 1048576, 100mb, or 2gb)", s)
+	}
+	return val * scale, nil
+}
+
+// maxKeysString formats the key limit and eviction policy for the startup log.
+func maxKeysString(maxKeys int, policy cache.EvictionPolicy) string {
+	if maxKeys > 0 {
+		return fmt.Sprintf("%d (eviction policy: %s)", maxKeys, policy)
 	}
+	return "unlimited"
 }
 
-// healthHandler responds to health check requests.
+// healthHandler responds to health check requests (see health.go for the
+// liveness and readiness probes).
 func healthHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "Mini Redis Server Running")
+	writeOK(w, r, healthResponse)
 }
 
 // setHandler handles POST requests to set a key-value pair in the cache.
 // Expected JSON body: {"key": "string", "value": "string", "ttl": int (optional)}
 func setHandler(w http.ResponseWriter, r *http.Request) {
-	// Only allow POST method
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// Decode JSON request body into a pooled request
+	req := setRequestPool.Get().(*SetRequest)
+	defer func() {
+		*req = SetRequest{}
+		setRequestPool.Put(req)
+	}()
+	if err := decodeJSONBody(w, r, req); err != nil {
+		var ttlErr *TTLError
+		if errors.As(err, &ttlErr) {
+			writeError(w, r, http.StatusBadRequest, codeInvalidTTL, ttlErr.Reason)
+			return
+		}
+		writeJSONBodyError(w, r, err)
 		return
 	}
 
-	// Decode JSON request body
-	var req SetRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	// Validate required fields; an empty value is valid (e.g. a presence-only flag)
+	if req.Key == "" || req.Value == nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Missing key or value")
 		return
 	}
-
-	// Validate required fields
-	if req.Key == "" || req.Value == "" {
-		http.Error(w, "Missing key or value", http.StatusBadRequest)
+	if cache.IsInternalKey(req.Key) {
+		writeReservedKey(w, r)
+		return
+	}
+	if err := checkValueSize(int64(len(*req.Value))); err != nil {
+		writeError(w, r, err.Status, err.Code, err.Message)
 		return
 	}
 
-	// Parse optional TTL (time-to-live in seconds)
+	// Check the optional TTL (seconds or a duration string, see TTL)
 	var ttl time.Duration
 	if req.TTL != nil {
-		if *req.TTL < 0 {
-			http.Error(w, "Invalid TTL (must be a non-negative integer in seconds)", http.StatusBadRequest)
+		if err := req.TTL.validate(); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidTTL, err.Error())
 			return
 		}
-		ttl = time.Duration(*req.TTL) * time.Second
+		ttl = time.Duration(*req.TTL)
 	}
 
 	// Store the key-value pair in the cache
-	cacheInstance.Set(req.Key, req.Value, ttl)
-	fmt.Fprintln(w, "OK key set")
+	if err := cacheInstance.Set(req.Key, *req.Value, ttl); err != nil {
+		writeSetError(w, r, err)
+		return
+	}
+	writeOK(w, r, okKeySetResponse)
+}
+
+// writeSetError maps an error of Cache.Set to an error response.
+func writeSetError(w http.ResponseWriter, r *http.Request, err error) {
+	e := toAPIError(err, "Failed to set key")
+	writeError(w, r, e.Status, e.Code, e.Message)
+}
+
+// toAPIError maps an error of a cache write to an APIError; errors
+// without a code are reported as internal errors, prefixed with failure.
+func toAPIError(err error, failure string) *APIError {
+	var apiErr *APIError
+	var ttlErr *TTLError
+	var limitErr *cache.LimitError
+	var keyErr *cache.KeyPolicyError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.As(err, &keyErr):
+		return &APIError{Status: http.StatusBadRequest, Code: codeInvalidKey, Message: "Invalid key: " + strings.Join(keyErr.Violations, "; ")}
+	case errors.As(err, &ttlErr):
+		return &APIError{Status: http.StatusBadRequest, Code: codeInvalidTTL, Message: ttlErr.Reason}
+	case errors.Is(err, cache.ErrCacheFull):
+		return &APIError{Status: http.StatusInsufficientStorage, Code: codeCacheFull, Message: "Key or memory limit reached and the eviction policy is noeviction"}
+	case errors.As(err, &limitErr):
+		if errors.Is(limitErr, cache.ErrKeyTooLong) {
+			return &APIError{Status: http.StatusBadRequest, Code: codeKeyTooLong, Message: fmt.Sprintf("Key too long (%d bytes, limit %d, see -max-key-length)", limitErr.Size, limitErr.Limit)}
+		}
+		return valueTooLargeError()
+	case errors.Is(err, cache.ErrValueTooLarge):
+		return &APIError{Status: http.StatusRequestEntityTooLarge, Code: codeValueTooLarge, Message: "The key and value are larger than the memory limit"}
+	case errors.Is(err, cache.ErrInvalidTTL):
+		return &APIError{Status: http.StatusBadRequest, Code: codeInvalidTTL, Message: "Invalid TTL (must not be negative or end after 2262)"}
+	case errors.Is(err, cache.ErrNotInteger):
+		return &APIError{Status: http.StatusBadRequest, Code: codeNotInteger, Message: "Value is not an integer or out of range"}
+	case errors.Is(err, cache.ErrIntegerOverflow):
+		return &APIError{Status: http.StatusBadRequest, Code: codeIntegerOverflow, Message: "Increment would overflow"}
+	default:
+		return &APIError{Status: http.StatusInternalServerError, Code: codeInternal, Message: fmt.Sprintf("%s: %v", failure, err)}
+	}
 }
 
 // getHandler handles GET requests to retrieve a value by key.
-// Expected query parameter: ?key=<key>
+// Expected query parameter: ?key=<key> (400 missing_key if absent or empty)
+// Response: {"key": "string", "value": "string", "ttl_remaining": int}, or
+// the raw value bytes for "Accept: text/plain" or "Accept:
+// application/octet-stream", with the content type the value was stored with
+// (application/octet-stream if none); both with the X-TTL-Remaining,
+// Last-Modified, and ETag headers of setKeyHeaders, or 304 Not Modified if
+// the If-None-Match header matches the ETag
 func getHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract key from query parameter
-	key := r.URL.Query().Get("key")
+	// Extract key from query parameter; without one (or with only
+	// whitespace), a 404 would wrongly suggest a key was looked up
+	key := queryValue(r, "key")
+	if strings.TrimSpace(key) == "" {
+		writeMissingKey(w, r)
+		return
+	}
+	if cache.IsInternalKey(key) {
+		writeReservedKey(w, r)
+		return
+	}
 
-	// Retrieve value from cache (automatically checks expiration)
-	value, ok := cacheInstance.Get(key)
+	// Retrieve value from cache (automatically checks expiration), without
+	// copying it, with the metadata of the same read for the headers
+	value, stat, ok := cacheInstance.GetBytesWithStat(key)
 	if !ok {
-		http.Error(w, "Key not found", http.StatusNotFound)
+		writeKeyNotFound(w, r)
+		return
+	}
+
+	h := w.Header()
+	contentLength := setKeyHeaders(h, stat)
+	if writeNotModified(w, r) {
+		return
+	}
+	if !wantsText(r, "application/octet-stream") {
+		writeJSON(w, http.StatusOK, newGetResponse(key, value, stat))
 		return
 	}
 
-	// Return the value
-	fmt.Fprintln(w, value)
+	// Return the value as is, so binary values arrive unchanged
+	h["Content-Type"] = valueContentType(stat)
+	h["Content-Length"] = contentLength
+	w.Write(value)
+}
+
+// headHandler handles HEAD requests checking whether a key exists.
+// Expected query parameter: ?key=<key>
+// Response: 200 with the Content-Length of the raw value (as returned for
+// "Accept: application/octet-stream") and X-TTL-Remaining, or 404
+func headHandler(w http.ResponseWriter, r *http.Request) {
+	key := queryValue(r, "key")
+	if strings.TrimSpace(key) == "" {
+		writeMissingKey(w, r)
+		return
+	}
+	if cache.IsInternalKey(key) {
+		writeReservedKey(w, r)
+		return
+	}
+	writeKeyHead(w, r, key)
 }
 
 // delHandler handles POST requests to delete a key from the cache.
 // Expected JSON body: {"key": "string"}
+// Response: {"deleted": bool}
 func delHandler(w http.ResponseWriter, r *http.Request) {
-	// Only allow POST method
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// Decode JSON request body into a pooled request
+	req := delRequestPool.Get().(*DelRequest)
+	defer func() {
+		*req = DelRequest{}
+		delRequestPool.Put(req)
+	}()
+	if err := decodeJSONBody(w, r, req); err != nil {
+		writeJSONBodyError(w, r, err)
 		return
 	}
 
-	// Decode JSON request body
-	var req DelRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	// Validate required field
+	if req.Key == "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Missing key")
+		return
+	}
+	if cache.IsInternalKey(req.Key) {
+		writeReservedKey(w, r)
 		return
 	}
 
-	// Validate required field
-	if req.Key == "" {
-		http.Error(w, "Missing key", http.StatusBadRequest)
+	// Delete the key from the cache and report whether it existed
+	// The response is one of two constant DelResponse encodings
+	w.Header()["Content-Type"] = jsonContentType
+	if cacheInstance.Del(req.Key) {
+		w.Write(deletedResponse)
+	} else {
+		w.Write(notDeletedResponse)
+	}
+}
+
+// bgRewriteAOFHandler handles POST requests to start an AOF rewrite in the background.
+// Returns 409 Conflict if a rewrite is already in progress.
+func bgRewriteAOFHandler(w http.ResponseWriter, r *http.Request) {
+	if err := cacheInstance.BackgroundRewriteAOF(); err != nil {
+		if errors.Is(err, cache.ErrRewriteInProgress) {
+			writeError(w, r, http.StatusConflict, codeInProgress, "AOF rewrite already in progress")
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Failed to start AOF rewrite: %v", err))
 		return
 	}
 
-	// Delete the key from the cache
-	cacheInstance.Del(req.Key)
-	fmt.Fprintln(w, "OK Key Deleted")
+	writeOK(w, r, rewriteStartedResponse)
+}
+
+// snapshotSinkFromEnv returns the snapshot sink configured by the
+// SNAPSHOT_SINK_DIR or SNAPSHOT_S3_* environment variables, or nil if none is.
+func snapshotSinkFromEnv() (cache.SnapshotSink, error) {
+	dir, bucket := os.Getenv("SNAPSHOT_SINK_DIR"), os.Getenv("SNAPSHOT_S3_BUCKET")
+	switch {
+	case dir != "" && bucket != "":
+		return nil, fmt.Errorf("SNAPSHOT_SINK_DIR and SNAPSHOT_S3_BUCKET can't be used together")
+	case dir != "":
+		return cache.NewFileSink(dir)
+	case bucket != "":
+		region := os.Getenv("SNAPSHOT_S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		endpoint := os.Getenv("SNAPSHOT_S3_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		return cache.NewS3Sink(cache.S3Config{
+			Endpoint:  endpoint,
+			Bucket:    bucket,
+			Prefix:    os.Getenv("SNAPSHOT_S3_PREFIX"),
+			Region:    region,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+	default:
+		return nil, nil
+	}
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// newTestServer serves the API of a new in-memory cache, with the handler
+// chain of main, and restores the previous cache when the test ends.
+func newTestServer(t *testing.T, opts ...cache.Option) *httptest.Server {
+	t.Helper()
+	c, err := cache.NewCache("", "", 0, opts...)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	return newTestServerWithCache(t, c)
+}
+
+// newTestServerWithCache is newTestServer for a cache created by the test,
+// which is closed when the test ends.
+func newTestServerWithCache(t *testing.T, c *cache.Cache) *httptest.Server {
+	t.Helper()
+	prev := cacheInstance
+	cacheInstance = c
+	srv := httptest.NewServer(withClientStats(withCORS(withClientIdentity(requireAuth(withClientPrincipal(newRouter()))))))
+	t.Cleanup(func() {
+		srv.Close()
+		c.Close()
+		cacheInstance = prev
+	})
+	return srv
+}
+
+// doRequest sends a request to srv and returns the response with its body.
+func doRequest(t *testing.T, srv *httptest.Server, method, path, body string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// errorCode returns the code of an error response body.
+func errorCode(t *testing.T, body []byte) string {
+	t.Helper()
+	var resp struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("invalid error response %q: %v", body, err)
+	}
+	return resp.Error.Code
+}
+
+// TestGetHandlerKeyParameter checks that a missing, empty, or blank key
+// parameter is a 400, distinct from the 404 of a missing key, and that
+// URL-encoded keys with special characters are found.
+func TestGetHandlerKeyParameter(t *testing.T) {
+	srv := newTestServer(t)
+	special := "a b&c=d/é?%+#"
+	if err := cacheInstance.Set(special, "special", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		code   string
+	}{
+		{"no parameter", "", http.StatusBadRequest, codeMissingKey},
+		{"empty parameter", "?key=", http.StatusBadRequest, codeMissingKey},
+		{"whitespace only", "?key=%20%09", http.StatusBadRequest, codeMissingKey},
+		{"plus-encoded spaces", "?key=++", http.StatusBadRequest, codeMissingKey},
+		{"missing key", "?key=nope", http.StatusNotFound, codeKeyNotFound},
+		{"special characters", "?key=" + url.QueryEscape(special), http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, path := range []string{"/v1/get", "/v1/memory/usage"} {
+				resp, body := doRequest(t, srv, http.MethodGet, path+tt.query, "", nil)
+				if resp.StatusCode != tt.status {
+					t.Fatalf("GET %s%s = %d %s, want %d", path, tt.query, resp.StatusCode, body, tt.status)
+				}
+				if tt.code != "" && errorCode(t, body) != tt.code {
+					t.Errorf("GET %s%s code = %s, want %s", path, tt.query, errorCode(t, body), tt.code)
+				}
+			}
+			resp, _ := doRequest(t, srv, http.MethodHead, "/v1/get"+tt.query, "", nil)
+			if resp.StatusCode != tt.status {
+				t.Errorf("HEAD /v1/get%s = %d, want %d", tt.query, resp.StatusCode, tt.status)
+			}
+		})
+	}
+
+	_, body := doRequest(t, srv, http.MethodGet, "/v1/get?key="+url.QueryEscape(special), "", nil)
+	var got GetResponse
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Key != special || got.Value != "special" {
+		t.Errorf("GET of a special key = %+v", got)
+	}
+}
+
+// TestSetEmptyValue checks that /set stores an empty value, unlike an
+// absent one, and that it is read back as present after an AOF replay.
+func TestSetEmptyValue(t *testing.T) {
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot")
+	c, err := cache.NewCache(aofPath, snapshotPath, 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	srv := newTestServerWithCache(t, c)
+
+	resp, body := doRequest(t, srv, http.MethodPost, "/v1/set", `{"key":"flag:x","value":""}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("set of an empty value = %d %s", resp.StatusCode, body)
+	}
+	for _, req := range []string{`{"key":"flag:y"}`, `{"key":"flag:y","value":null}`, `{"value":"v"}`} {
+		resp, body := doRequest(t, srv, http.MethodPost, "/v1/set", req, nil)
+		if resp.StatusCode != http.StatusBadRequest || errorCode(t, body) != codeInvalidRequest {
+			t.Errorf("set %s = %d %s, want 400 %s", req, resp.StatusCode, body, codeInvalidRequest)
+		}
+	}
+
+	checkEmpty := func(srv *httptest.Server, when string) {
+		t.Helper()
+		resp, body := doRequest(t, srv, http.MethodGet, "/v1/get?key=flag:x", "", nil)
+		var got GetResponse
+		if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &got) != nil || got.Value != "" {
+			t.Errorf("%s: GET = %d %s, want 200 with an empty value", when, resp.StatusCode, body)
+		}
+		resp, body = doRequest(t, srv, http.MethodGet, "/v1/keys/flag:x", "", nil)
+		if resp.StatusCode != http.StatusOK || len(body) != 0 || resp.Header.Get("Content-Length") != "0" {
+			t.Errorf("%s: GET /keys = %d %q (Content-Length %q), want 200 and no body", when, resp.StatusCode, body, resp.Header.Get("Content-Length"))
+		}
+		resp, body = doRequest(t, srv, http.MethodGet, "/v1/get?key=flag:y", "", nil)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: GET of the rejected key = %d %s, want 404", when, resp.StatusCode, body)
+		}
+	}
+	checkEmpty(srv, "before restart")
+	srv.Close()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = cache.NewCache(aofPath, snapshotPath, 0)
+	if err != nil {
+		t.Fatalf("NewCache after restart: %v", err)
+	}
+	checkEmpty(newTestServerWithCache(t, c), "after AOF replay")
+}
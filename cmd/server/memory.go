@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"mini-redis/internal/cache"
+)
+
+// MemoryUsageResponse is the JSON response of GET /memory/usage.
+type MemoryUsageResponse struct {
+	Key   string `json:"key"`
+	Bytes int64  `json:"bytes"` // Estimated memory used by the key and its value
+}
+
+// memoryUsageHandler handles GET requests for the estimated memory used by a
+// key, like Redis MEMORY USAGE. Expected query parameter: ?key=<key>
+// The estimate is the one counted for -maxmemory; reading it doesn't change
+// the key's eviction order.
+func memoryUsageHandler(w http.ResponseWriter, r *http.Request) {
+	key := queryValue(r, "key")
+	if strings.TrimSpace(key) == "" {
+		writeMissingKey(w, r)
+		return
+	}
+	if cache.IsInternalKey(key) {
+		writeReservedKey(w, r)
+		return
+	}
+
+	bytes, ok := cacheInstance.MemoryUsage(key)
+	if !ok {
+		writeKeyNotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MemoryUsageResponse{Key: key, Bytes: bytes})
+}
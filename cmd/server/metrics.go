@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// metricsHandler handles GET requests for metrics in the Prometheus text
+// exposition format, for scraping by Prometheus or compatible agents.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	m := &metricsWriter{}
+	writeCacheMetrics(m)
+	writeReplicationMetrics(m)
+	writeRateLimitMetrics(m)
+	writeGRPCMetrics(m)
+	writeProtocolMetrics(m)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(w, m.b.String())
+}
+
+// metricsWriter builds a response in the Prometheus text format. Every metric
+// starts with family, followed by all of its samples.
+type metricsWriter struct {
+	b strings.Builder
+}
+
+// family writes the HELP and TYPE lines of a metric ("gauge" or "counter").
+func (m *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(&m.b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(&m.b, "# TYPE %s %s\n", name, typ)
+}
+
+// sample writes a sample of a metric; labels are name, value pairs.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.b.WriteString(name)
+	if len(labels) > 0 {
+		m.b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.b.WriteByte(',')
+			}
+			fmt.Fprintf(&m.b, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		m.b.WriteByte('}')
+	}
+	m.b.WriteByte(' ')
+	m.b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	m.b.WriteByte('\n')
+}
+
+// metric writes a metric with a single unlabeled sample.
+func (m *metricsWriter) metric(name, typ, help string, value float64) {
+	m.family(name, typ, help)
+	m.sample(name, value)
+}
+
+// labelEscaper escapes label values as required by the text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value.
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+)
+
+// Client certificates.
+//
+// With -tls-client-ca, clients must present a certificate issued by one of
+// the CAs in that PEM bundle: the TLS handshake fails without one, so an
+// unauthenticated client never gets to send a request. -tls-client-allow
+// further restricts the accepted certificates to a list of identities, each
+// matched against the subject common name and the subject alternative
+// names (DNS names, email addresses, URIs such as SPIFFE IDs, and IP
+// addresses) of the certificate; others are rejected at the handshake too.
+//
+// The identity of the client certificate is added to the request context,
+// where requestIdentity finds it: its principal names the client in logs
+// and access rules.
+
+// Settings of the client certificate flags.
+var (
+	tlsClientCA    string         // -tls-client-ca ("" = no client certificates)
+	tlsClientAllow stringListFlag // -tls-client-allow (empty = any identity)
+)
+
+// clientIdentity is the identity of a client certificate.
+type clientIdentity struct {
+	CommonName string   // Subject common name
+	Names      []string // Subject alternative names: DNS names, emails, URIs, and IPs
+}
+
+// Principal returns the name of the client: the common name, or the first
+// subject alternative name without one.
+func (id *clientIdentity) Principal() string {
+	if id.CommonName != "" || len(id.Names) == 0 {
+		return id.CommonName
+	}
+	return id.Names[0]
+}
+
+// matches reports whether the common name or a subject alternative name is
+// one of names.
+func (id *clientIdentity) matches(names []string) bool {
+	if id.CommonName != "" && slices.Contains(names, id.CommonName) {
+		return true
+	}
+	for _, n := range id.Names {
+		if slices.Contains(names, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// certIdentity returns the identity of a certificate.
+func certIdentity(cert *x509.Certificate) *clientIdentity {
+	id := &clientIdentity{CommonName: cert.Subject.CommonName}
+	id.Names = append(id.Names, cert.DNSNames...)
+	id.Names = append(id.Names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		id.Names = append(id.Names, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		id.Names = append(id.Names, ip.String())
+	}
+	return id
+}
+
+// configureClientAuth makes config require client certificates issued by
+// -tls-client-ca, with an identity in -tls-client-allow if it isn't empty.
+func configureClientAuth(config *tls.Config) error {
+	if tlsClientCA == "" {
+		if len(tlsClientAllow) > 0 {
+			return errors.New("-tls-client-allow requires -tls-client-ca")
+		}
+		return nil
+	}
+
+	pem, err := os.ReadFile(tlsClientCA)
+	if err != nil {
+		return fmt.Errorf("failed to read the client CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in the client CA bundle %s", tlsClientCA)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+
+	if allowed := slices.Clone(tlsClientAllow); len(allowed) > 0 {
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			id := certIdentity(cs.PeerCertificates[0])
+			if !id.matches(allowed) {
+				return fmt.Errorf("client certificate identity %q is not allowed", id.Principal())
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// identityKey is the context key of the client identity.
+type identityKey struct{}
+
+// withClientIdentity adds the identity of the client certificate, if any, to
+// the context of requests.
+func withClientIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			ctx := context.WithValue(r.Context(), identityKey{}, certIdentity(r.TLS.PeerCertificates[0]))
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestIdentity returns the identity of the client certificate of r, or
+// nil without one.
+func requestIdentity(r *http.Request) *clientIdentity {
+	id, _ := r.Context().Value(identityKey{}).(*clientIdentity)
+	return id
+}
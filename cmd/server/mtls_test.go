@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// testCA is a certificate authority issuing client certificates in tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA returns a new CA named name.
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// writePEM writes the certificate of the CA to a PEM file and returns its
+// path.
+func (ca *testCA) writePEM(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// issue returns a client certificate with the common name cn and the URI
+// subject alternative names uris.
+func (ca *testCA) issue(t *testing.T, cn string, uris ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, s := range uris {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newMTLSServer serves the API over HTTPS with the TLS configuration of
+// main, requiring client certificates issued by the CA in caFile with an
+// identity in allow (if any).
+func newMTLSServer(t *testing.T, caFile string, allow ...string) *httptest.Server {
+	t.Helper()
+	prevCA, prevAllow, prevSelfSigned := tlsClientCA, tlsClientAllow, tlsSelfSigned
+	tlsClientCA, tlsClientAllow, tlsSelfSigned = caFile, allow, true
+	defer func() { tlsClientCA, tlsClientAllow, tlsSelfSigned = prevCA, prevAllow, prevSelfSigned }()
+	config, err := newTLSConfig()
+	if err != nil {
+		t.Fatalf("newTLSConfig: %v", err)
+	}
+
+	c, err := cache.NewCache("", "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	prev := cacheInstance
+	cacheInstance = c
+	srv := httptest.NewUnstartedServer(withClientStats(withCORS(withClientIdentity(requireAuth(withClientPrincipal(newRouter()))))))
+	srv.TLS = config
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // Rejected handshakes
+	srv.StartTLS()
+	t.Cleanup(func() {
+		srv.Close()
+		c.Close()
+		cacheInstance = prev
+	})
+	return srv
+}
+
+// mtlsClient returns a client of srv presenting cert, if any, even if the
+// server doesn't list its CA.
+func mtlsClient(t *testing.T, srv *httptest.Server, cert *tls.Certificate) *http.Client {
+	t.Helper()
+	roots := x509.NewCertPool()
+	serverCert, err := x509.ParseCertificate(srv.TLS.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots.AddCert(serverCert)
+	config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	if cert != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return cert, nil }
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+// certPrincipal returns the principal reported by /v1/acl/whoami to
+// client, or the error of the request.
+func certPrincipal(t *testing.T, srv *httptest.Server, client *http.Client) (string, error) {
+	t.Helper()
+	resp, err := client.Get(srv.URL + "/v1/acl/whoami")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	var got WhoamiResponse
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &got) != nil {
+		t.Fatalf("whoami = %d %s", resp.StatusCode, body)
+	}
+	return got.Principal, nil
+}
+
+// TestClientCertificates starts the server with a test CA and checks that
+// certificates it issued are accepted, with their identity as the
+// principal, and that connections without one, with one issued by another
+// CA, or with an identity outside -tls-client-allow fail at the handshake.
+func TestClientCertificates(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	caFile := ca.writePEM(t)
+	svcA := ca.issue(t, "svc-a")
+	svcB := ca.issue(t, "", "spiffe://test/svc-b")
+	other := newTestCA(t, "other CA").issue(t, "svc-a")
+
+	t.Run("any identity", func(t *testing.T) {
+		srv := newMTLSServer(t, caFile)
+		for cert, want := range map[*tls.Certificate]string{&svcA: "svc-a", &svcB: "spiffe://test/svc-b"} {
+			if got, err := certPrincipal(t, srv, mtlsClient(t, srv, cert)); err != nil || got != want {
+				t.Errorf("principal = %q, %v, want %q", got, err, want)
+			}
+		}
+		for name, cert := range map[string]*tls.Certificate{"no certificate": nil, "other CA": &other} {
+			if _, err := certPrincipal(t, srv, mtlsClient(t, srv, cert)); err == nil || !strings.Contains(err.Error(), "tls:") {
+				t.Errorf("%s: request error = %v, want a TLS handshake error", name, err)
+			}
+		}
+	})
+
+	t.Run("allowlist", func(t *testing.T) {
+		srv := newMTLSServer(t, caFile, "spiffe://test/svc-b")
+		if got, err := certPrincipal(t, srv, mtlsClient(t, srv, &svcB)); err != nil || got != "spiffe://test/svc-b" {
+			t.Errorf("allowed certificate: principal = %q, %v", got, err)
+		}
+		if _, err := certPrincipal(t, srv, mtlsClient(t, srv, &svcA)); err == nil || !strings.Contains(err.Error(), "tls:") {
+			t.Errorf("certificate outside the allowlist: request error = %v, want a TLS handshake error", err)
+		}
+	})
+}
+
+// TestConfigureClientAuth checks the errors of invalid client certificate
+// settings.
+func TestConfigureClientAuth(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	prevCA, prevAllow := tlsClientCA, tlsClientAllow
+	defer func() { tlsClientCA, tlsClientAllow = prevCA, prevAllow }()
+
+	tests := []struct {
+		name  string
+		ca    string
+		allow stringListFlag
+	}{
+		{"allowlist without CA", "", stringListFlag{"svc-a"}},
+		{"missing bundle", filepath.Join(t.TempDir(), "missing.pem"), nil},
+		{"bundle without certificates", empty, nil},
+	}
+	for _, tt := range tests {
+		tlsClientCA, tlsClientAllow = tt.ca, tt.allow
+		if err := configureClientAuth(&tls.Config{}); err == nil {
+			t.Errorf("%s: configureClientAuth succeeded", tt.name)
+		}
+	}
+
+	tlsClientCA, tlsClientAllow = "", nil
+	config := &tls.Config{}
+	if err := configureClientAuth(config); err != nil || config.ClientAuth != tls.NoClientCert {
+		t.Errorf("without -tls-client-ca: %v, ClientAuth %v", err, config.ClientAuth)
+	}
+}
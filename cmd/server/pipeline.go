@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// defaultPipelineMaxCommands is the default limit of commands per pipeline.
+const defaultPipelineMaxCommands = 1000
+
+// pipelineMaxCommands is the largest number of commands accepted by
+// /pipeline (-pipeline-max-commands).
+var pipelineMaxCommands = defaultPipelineMaxCommands
+
+// PipelineResult is the result of a command in the JSON response of POST
+// /pipeline: its result, or its error.
+type PipelineResult struct {
+	Result any        `json:"result"`          // Result of the command (null on error)
+	Error  *ErrorBody `json:"error,omitempty"` // Error of the command, with the codes of error responses
+}
+
+// pipelineHandler handles POST requests running a JSON array of commands
+// (see Command) in order, and responds with a PipelineResult per command,
+// in the same order. The commands aren't atomic: other requests may run
+// between them, and a failed command doesn't stop the ones after it.
+// The whole array is decoded before any command runs, so a malformed one
+// fails the request without running anything. More than
+// -pipeline-max-commands commands are rejected with 413.
+func pipelineHandler(w http.ResponseWriter, r *http.Request) {
+	cmds, err := decodePipeline(w, r)
+	if err != nil {
+		var apiErr *APIError
+		var ttlErr *TTLError
+		if !errors.As(err, &apiErr) && !errors.As(err, &ttlErr) {
+			writeJSONBodyError(w, r, err)
+			return
+		}
+		e := toAPIError(err, "Invalid pipeline")
+		writeError(w, r, e.Status, e.Code, e.Message)
+		return
+	}
+
+	results := make([]PipelineResult, len(cmds))
+	for i := range cmds {
+		result, err := execute(r, &cmds[i])
+		if err != nil {
+			e := toAPIError(err, "Command failed")
+			results[i].Error = &ErrorBody{Code: e.Code, Message: e.Message}
+			continue
+		}
+		results[i].Result = result
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// decodePipeline decodes the commands of a /pipeline request, stopping with
+// an *APIError as soon as there are more than pipelineMaxCommands.
+func decodePipeline(w http.ResponseWriter, r *http.Request) ([]Command, error) {
+	body, err := limitBody(w, r, maxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(body)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != json.Delim('[') {
+		return nil, fmt.Errorf("pipeline must be a JSON array")
+	}
+
+	var cmds []Command
+	for dec.More() {
+		if len(cmds) == pipelineMaxCommands {
+			return nil, &APIError{
+				Status:  http.StatusRequestEntityTooLarge,
+				Code:    codePipelineTooLarge,
+				Message: fmt.Sprintf("Too many commands (limit %d, see -pipeline-max-commands)", pipelineMaxCommands),
+			}
+		}
+		cmds = append(cmds, Command{})
+		if err := dec.Decode(&cmds[len(cmds)-1]); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return cmds, nil
+}
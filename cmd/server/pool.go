@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Allocation savings for the hot path of /set, /get, /del, and /keys/{key}.
+//
+// JSON request bodies are read into pooled buffers and decoded with
+// json.Unmarshal into pooled request structs, instead of a json.Decoder per
+// request (raw values of /keys/{key} are read into buffers of their own,
+// which the cache keeps, see readValue); the constant responses and header
+// values are built once; and the key is read from the raw query without
+// building the map of all parameters.
+
+// maxPooledBodySize is the largest buffer returned to bodyPool, so a single
+// huge value doesn't stay pinned in the pool.
+const maxPooledBodySize = 64 << 10
+
+var (
+	bodyPool       = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+	setRequestPool = sync.Pool{New: func() any { return new(SetRequest) }}
+	delRequestPool = sync.Pool{New: func() any { return new(DelRequest) }}
+)
+
+// Constant responses and header values. Header values are assigned to the
+// header map directly, which is safe because net/http never modifies them
+// (Header.Add would append to a copy, as their capacity is 1).
+var (
+	okResponse         = []byte("{\"status\":\"ok\"}\n")
+	deletedResponse    = []byte("{\"deleted\":true}\n")
+	notDeletedResponse = []byte("{\"deleted\":false}\n")
+
+	// Plain text responses, for "Accept: text/plain"
+	healthResponse         = []byte("Mini Redis Server Running\n")
+	okKeySetResponse       = []byte("OK key set\n")
+	rewriteStartedResponse = []byte("Background AOF rewrite started\n")
+
+	textContentType        = []string{"text/plain; charset=utf-8"}
+	jsonContentType        = []string{"application/json"}
+	octetStreamContentType = []string{"application/octet-stream"}
+	deprecationHeader      = []string{"true"}
+)
+
+// decodeJSONBody reads the request body into a pooled buffer and decodes it
+// into v with json.Unmarshal. Bodies larger than -max-body-bytes fail with an
+// *http.MaxBytesError, see writeJSONBodyError.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v any) error {
+	buf, err := readBody(w, r)
+	defer putBody(buf)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf.Bytes(), v)
+}
+
+// readBody reads the request body, up to -max-body-bytes, into a pooled
+// buffer, which must be returned with putBody, also if reading fails.
+func readBody(w http.ResponseWriter, r *http.Request) (*bytes.Buffer, error) {
+	buf := bodyPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	body, err := limitBody(w, r, maxBodyBytes)
+	if err != nil {
+		return buf, err
+	}
+	_, err = buf.ReadFrom(body)
+	return buf, err
+}
+
+// putBody returns a buffer from readBody to bodyPool, unless it is too large.
+func putBody(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBodySize {
+		bodyPool.Put(buf)
+	}
+}
+
+// queryValue returns the first value of the query parameter name, like
+// r.URL.Query().Get(name). Values without escapes are returned without
+// copying.
+func queryValue(r *http.Request, name string) string {
+	query := r.URL.RawQuery
+	for query != "" {
+		var param string
+		param, query, _ = strings.Cut(query, "&")
+		if strings.Contains(param, ";") {
+			continue // Rejected by url.ParseQuery too
+		}
+		key, value, _ := strings.Cut(param, "=")
+		if strings.ContainsAny(key, "%+") {
+			var err error
+			if key, err = url.QueryUnescape(key); err != nil {
+				continue
+			}
+		}
+		if key != name {
+			continue
+		}
+		if strings.ContainsAny(value, "%+") {
+			var err error
+			if value, err = url.QueryUnescape(value); err != nil {
+				continue
+			}
+		}
+		return value
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// discardWriter is a ResponseWriter that reuses its header map and drops
+// the body, so allocation counts only include the handler's own.
+type discardWriter struct {
+	header http.Header
+	status int
+	body   int
+}
+
+// Header implements http.ResponseWriter.
+func (w *discardWriter) Header() http.Header { return w.header }
+
+// Write implements http.ResponseWriter.
+func (w *discardWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body += len(p)
+	return len(p), nil
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *discardWriter) WriteHeader(status int) { w.status = status }
+
+// reset prepares the writer for the next response.
+func (w *discardWriter) reset() {
+	clear(w.header)
+	w.status, w.body = 0, 0
+}
+
+// useTestCache makes c the cache of the handlers until the test ends.
+func useTestCache(tb testing.TB, c *cache.Cache) {
+	tb.Helper()
+	prev := cacheInstance
+	cacheInstance = c
+	tb.Cleanup(func() {
+		c.Close()
+		cacheInstance = prev
+	})
+}
+
+// TestGetHitAllocs checks that a raw Get hit allocates at most twice, for
+// all its headers, through /get, /keys/{key}, and HEAD.
+func TestGetHitAllocs(t *testing.T) {
+	c, err := cache.NewCache("", "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	useTestCache(t, c)
+	value := strings.Repeat("v", 1000)
+	if err := c.Set("foo", value, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	get := httptest.NewRequest(http.MethodGet, "/v1/get?key=foo", nil)
+	get.Header.Set("Accept", "application/octet-stream")
+	getKey := httptest.NewRequest(http.MethodGet, "/v1/keys/foo", nil)
+	getKey.SetPathValue("key", "foo")
+	headKey := httptest.NewRequest(http.MethodHead, "/v1/keys/foo", nil)
+	headKey.SetPathValue("key", "foo")
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		r       *http.Request
+		body    int
+	}{
+		{"/get", getHandler, get, len(value)},
+		{"/keys/{key}", getKeyHandler, getKey, len(value)},
+		{"HEAD /keys/{key}", headKeyHandler, headKey, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &discardWriter{header: http.Header{}}
+			tt.handler(w, tt.r)
+			h := w.header
+			if w.status != http.StatusOK || w.body != tt.body {
+				t.Fatalf("status %d with %d bytes, want 200 with %d", w.status, w.body, tt.body)
+			}
+			if h.Get("Content-Length") != "1000" || h[ttlRemainingHeader][0] != "3600" ||
+				h.Get("Etag") == "" || h.Get("Last-Modified") == "" {
+				t.Errorf("headers: %v", h)
+			}
+			// The values share an array: adding one mustn't overwrite another
+			h.Add("Etag", "x")
+			if h.Get("Content-Length") != "1000" {
+				t.Error("Header.Add overwrote Content-Length")
+			}
+
+			allocs := testing.AllocsPerRun(1000, func() {
+				w.reset()
+				tt.handler(w, tt.r)
+			})
+			if allocs > 2 {
+				t.Errorf("%v allocations per hit, want at most 2", allocs)
+			}
+		})
+	}
+}
+
+// BenchmarkHandlers measures the time and allocations of every endpoint
+// of the hot path, called directly (run with -benchmem).
+func BenchmarkHandlers(b *testing.B) {
+	c, err := cache.NewCache("", "", 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	useTestCache(b, c)
+	if err := c.Set("foo", "bar", 0); err != nil {
+		b.Fatal(err)
+	}
+
+	rawGet := httptest.NewRequest(http.MethodGet, "/v1/get?key=foo", nil)
+	rawGet.Header.Set("Accept", "application/octet-stream")
+	getKey := httptest.NewRequest(http.MethodGet, "/v1/keys/foo", nil)
+	getKey.SetPathValue("key", "foo")
+	benchmarks := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		path    string
+		body    string
+		r       *http.Request // Reused if it has no body
+	}{
+		{name: "get", handler: getHandler, r: httptest.NewRequest(http.MethodGet, "/v1/get?key=foo", nil)},
+		{name: "get raw", handler: getHandler, r: rawGet},
+		{name: "get miss", handler: getHandler, r: httptest.NewRequest(http.MethodGet, "/v1/get?key=missing", nil)},
+		{name: "keys get", handler: getKeyHandler, r: getKey},
+		{name: "set", handler: setHandler, method: http.MethodPost, path: "/v1/set", body: `{"key":"foo","value":"bar"}`},
+		{name: "del", handler: delHandler, method: http.MethodPost, path: "/v1/del", body: `{"key":"missing"}`},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			w := &discardWriter{header: http.Header{}}
+			r := bm.r
+			var body *bytes.Reader
+			if r == nil {
+				body = bytes.NewReader([]byte(bm.body))
+				r = httptest.NewRequest(bm.method, bm.path, body)
+			}
+			b.ReportAllocs()
+			for range b.N {
+				if body != nil {
+					body.Seek(0, io.SeekStart)
+					r.Body = io.NopCloser(body)
+				}
+				w.reset()
+				bm.handler(w, r)
+			}
+		})
+	}
+}
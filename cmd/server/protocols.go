@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// HTTP versions.
+//
+// The API listeners serve HTTP/1.1 and HTTP/2: over TLS, HTTP/2 is
+// negotiated with ALPN ("h2"), and without TLS, with -h2c (on by default),
+// clients that start with the HTTP/2 preface get HTTP/2 in cleartext
+// ("h2c" with prior knowledge), as service meshes and gRPC clients do. The
+// Upgrade: h2c mechanism of HTTP/1.1, deprecated by RFC 9113, isn't
+// supported; such requests are served over HTTP/1.1.
+//
+// Over HTTP/2, every request is a stream of a shared connection with its
+// own flow control, so a long transfer (see longLived) only holds its own
+// stream: its per-read and per-write deadlines apply to the stream, and the
+// other requests of the connection go on. WebSocket connections (/ws) need
+// HTTP/1.1.
+//
+// The connections and requests are counted by protocol for /stats, and
+// /clients shows the protocol of every client.
+
+// h2c is whether cleartext listeners accept HTTP/2 with prior knowledge
+// (-h2c).
+var h2c = true
+
+// Protocols counted: "http/1.0", "http/1.1", "h2" (HTTP/2 over TLS), and
+// "h2c" (HTTP/2 in cleartext).
+var protocolNames = []string{"http/1.0", "http/1.1", "h2", "h2c"}
+
+// protocolCounts are the connections and requests by protocol since
+// startup, for /stats.
+var protocolCounts = struct {
+	connections map[string]*atomic.Int64
+	requests    map[string]*atomic.Int64
+}{
+	connections: make(map[string]*atomic.Int64),
+	requests:    make(map[string]*atomic.Int64),
+}
+
+func init() {
+	for _, name := range protocolNames {
+		protocolCounts.connections[name] = new(atomic.Int64)
+		protocolCounts.requests[name] = new(atomic.Int64)
+	}
+}
+
+// serverProtocols returns the protocols of the API listeners.
+func serverProtocols() *http.Protocols {
+	var p http.Protocols
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(h2c)
+	return &p
+}
+
+// requestProtocol returns the protocol of r, one of protocolNames.
+func requestProtocol(r *http.Request) string {
+	switch {
+	case r.ProtoMajor == 2 && r.TLS != nil:
+		return "h2"
+	case r.ProtoMajor == 2:
+		return "h2c"
+	case r.ProtoMinor == 0:
+		return "http/1.0"
+	}
+	return "http/1.1"
+}
+
+// countProtocol counts r by protocol, and its connection once, with its
+// first request.
+func countProtocol(r *http.Request, cc *clientConn) {
+	name := requestProtocol(r)
+	protocolCounts.requests[name].Add(1)
+	if cc != nil && cc.protocol.Load() == nil && cc.protocol.CompareAndSwap(nil, &name) {
+		protocolCounts.connections[name].Add(1)
+	}
+}
+
+// ProtocolStats counts the connections and requests by protocol in
+// StatsResponse: "http/1.0", "http/1.1", "h2", and "h2c".
+type ProtocolStats struct {
+	Connections map[string]int64 `json:"connections"` // Connections since startup, by the protocol of their first request
+	Requests    map[string]int64 `json:"requests"`    // Requests since startup
+}
+
+// protocolStats returns the ProtocolStats of StatsResponse.
+func protocolStats() ProtocolStats {
+	stats := ProtocolStats{Connections: make(map[string]int64), Requests: make(map[string]int64)}
+	for _, name := range protocolNames {
+		stats.Connections[name] = protocolCounts.connections[name].Load()
+		stats.Requests[name] = protocolCounts.requests[name].Load()
+	}
+	return stats
+}
+
+// writeProtocolMetrics writes the request counts by protocol.
+func writeProtocolMetrics(m *metricsWriter) {
+	m.family("miniredis_http_requests_by_protocol_total", "counter", "HTTP requests by protocol (http/1.0, http/1.1, h2, h2c), since startup.")
+	for _, name := range protocolNames {
+		m.sample("miniredis_http_requests_by_protocol_total", float64(protocolCounts.requests[name].Load()), "protocol", name)
+	}
+}
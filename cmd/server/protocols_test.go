@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// startPlaintextServer serves the API of c on a TCP listener without TLS,
+// like main, and returns its base URL.
+func startPlaintextServer(t *testing.T, c *cache.Cache) string {
+	t.Helper()
+	prev := cacheInstance
+	cacheInstance = c
+	server := newServer("", withClientStats(withCORS(withClientIdentity(requireAuth(withClientPrincipal(newRouter()))))))
+	trackClients(server)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(clientListener{limitListener{listener}})
+	t.Cleanup(func() {
+		server.Close()
+		c.Close()
+		cacheInstance = prev
+	})
+	return "http://" + listener.Addr().String()
+}
+
+// h2cClient returns a client speaking HTTP/2 in cleartext with prior
+// knowledge, as service meshes do.
+func h2cClient() *http.Client {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+}
+
+// getJSON sends a GET request with client and decodes the JSON response.
+func getJSON(t *testing.T, client *http.Client, url string, header http.Header, v any) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: invalid JSON: %v", url, err)
+	}
+	return resp
+}
+
+// TestH2C checks that the plaintext listener serves HTTP/2 with prior
+// knowledge next to HTTP/1.1, multiplexing the requests of a client on one
+// connection, and that /stats counts both.
+func TestH2C(t *testing.T) {
+	c, err := cache.NewCache("", "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	base := startPlaintextServer(t, c)
+	if err := c.Set("k", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	before := protocolStats()
+
+	client := h2cClient()
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Go(func() {
+			var got GetResponse
+			resp := getJSON(t, client, base+"/v1/get?key=k", nil, &got)
+			if resp.Proto != "HTTP/2.0" || got.Value != "v" {
+				t.Errorf("GET over h2c: %s %+v, want HTTP/2.0 and v", resp.Proto, got)
+			}
+		})
+	}
+	wg.Wait()
+
+	var got GetResponse
+	if resp := getJSON(t, http.DefaultClient, base+"/v1/get?key=k", nil, &got); resp.Proto != "HTTP/1.1" {
+		t.Errorf("GET with an HTTP/1.1 client: %s", resp.Proto)
+	}
+
+	var stats StatsResponse
+	getJSON(t, client, base+"/v1/stats", nil, &stats)
+	p := stats.Protocols
+	if n := p.Requests["h2c"] - before.Requests["h2c"]; n != 21 {
+		t.Errorf("%d h2c requests counted, want 21", n)
+	}
+	if n := p.Connections["h2c"] - before.Connections["h2c"]; n != 1 {
+		t.Errorf("%d h2c connections counted, want 1: the requests are multiplexed", n)
+	}
+	if n := p.Requests["http/1.1"] - before.Requests["http/1.1"]; n != 1 {
+		t.Errorf("%d http/1.1 requests counted, want 1", n)
+	}
+}
+
+// TestH2CStreamFlowControl checks that a long download the client doesn't
+// read only stalls its own stream: the other requests of the connection go
+// on, and the download completes once it is read.
+func TestH2CStreamFlowControl(t *testing.T) {
+	c, err := cache.NewCache("", "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	base := startPlaintextServer(t, c)
+	prevToken := adminToken
+	adminToken = "admin-secret"
+	t.Cleanup(func() { adminToken = prevToken })
+
+	// Random values, so the backup is larger than the stream window of the
+	// client (4MB) whatever its compression
+	const keys = 64
+	value := make([]byte, 256<<10)
+	rng := rand.NewChaCha8([32]byte{})
+	for i := range keys {
+		rng.Read(value)
+		if err := c.Set("key"+strconv.Itoa(i), string(value), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := protocolStats()
+
+	client := h2cClient()
+	req, err := http.NewRequest(http.MethodGet, base+"/v1/backup", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	backup, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("GET /backup: %v", err)
+	}
+	defer backup.Body.Close()
+	if backup.StatusCode != http.StatusOK || backup.Proto != "HTTP/2.0" {
+		t.Fatalf("GET /backup: %s %s", backup.Proto, backup.Status)
+	}
+
+	// The backup is stalled by its stream window, not the connection
+	time.Sleep(50 * time.Millisecond)
+	for i := range 10 {
+		var got GetResponse
+		getJSON(t, client, base+"/v1/get?key=key"+strconv.Itoa(i), nil, &got)
+		if got.Key != "key"+strconv.Itoa(i) || base64.StdEncoding.DecodedLen(len(got.ValueBase64)) < len(value) {
+			t.Fatalf("GET during the backup: %s with %d base64 bytes, want the value of %d bytes", got.Key, len(got.ValueBase64), len(value))
+		}
+	}
+
+	n, err := io.Copy(io.Discard, backup.Body)
+	if err != nil || n < keys*int64(len(value)) {
+		t.Errorf("backup: %d bytes, %v, want at least %d", n, err, keys*len(value))
+	}
+	if entries := backup.Header.Get("X-Snapshot-Entries"); entries != strconv.Itoa(keys) {
+		t.Errorf("backup of %s entries, want %d", entries, keys)
+	}
+	if n := protocolStats().Connections["h2c"] - before.Connections["h2c"]; n != 1 {
+		t.Errorf("%d h2c connections, want the download and the requests on 1", n)
+	}
+}
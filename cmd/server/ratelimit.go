@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate limiting.
+//
+// -rate-limit-read, -rate-limit-write, and -rate-limit-admin limit the
+// requests per second of each client to the routes of a class (see
+// routeClass), with bursts of up to -rate-burst-<class> requests (default:
+// the rate). A client is the principal of its request (see
+// requestPrincipal), or its address (see ipPolicy.clientAddr) without one,
+// and has a token bucket per class, so a client in a loop only uses up its
+// own requests. Requests beyond the limit get 429 with Retry-After, the
+// seconds until the bucket has a token again. Principals in
+// -rate-limit-exempt aren't limited. The limits can be changed by a config
+// reload, which starts every client with a full bucket.
+//
+// A bucket left idle until it is full again is no different from a new one,
+// so full buckets are dropped every rateSweepInterval. To bound memory when
+// many clients are active at once, the clients beyond maxRateBuckets per
+// class share a single bucket.
+
+// maxRateBuckets is the largest number of clients with a bucket of their
+// own, per class.
+const maxRateBuckets = 100_000
+
+// rateSweepInterval is the interval of the removal of idle buckets.
+const rateSweepInterval = time.Minute
+
+// Settings of the rate limit flags.
+var (
+	rateLimits      [routeClassCount]int // -rate-limit-read, -rate-limit-write, -rate-limit-admin (0 = unlimited)
+	rateBursts      [routeClassCount]int // -rate-burst-read, -rate-burst-write, -rate-burst-admin (0 = the rate)
+	rateLimitExempt stringListFlag       // -rate-limit-exempt
+)
+
+// tokenBucket holds the tokens of a client: a request takes one, and they
+// are refilled at the rate of the limiter, up to its burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // Time tokens was computed
+}
+
+// rateLimiter limits the requests of each client to the routes of a class.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // Tokens per second (0 = unlimited)
+	burst   float64
+	exempt  []string
+	buckets map[string]*tokenBucket
+	allowed uint64 // Requests allowed, since startup
+	limited uint64 // Requests rejected, since startup
+}
+
+// rateLimiters are the limiters of the route classes.
+var rateLimiters [routeClassCount]rateLimiter
+
+// configure sets the limit, and starts every client with a full bucket.
+func (l *rateLimiter) configure(rate, burst int, exempt []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if burst <= 0 {
+		burst = rate
+	}
+	l.rate, l.burst, l.exempt = float64(rate), float64(burst), exempt
+	l.buckets = make(map[string]*tokenBucket)
+}
+
+// allow takes a token from the bucket of client, or returns the time until
+// there is one.
+func (l *rateLimiter) allow(client, principal string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 || principal != "" && slices.Contains(l.exempt, principal) {
+		return true, 0
+	}
+
+	b := l.buckets[client]
+	if b == nil {
+		if len(l.buckets) >= maxRateBuckets {
+			l.sweep(now)
+		}
+		if len(l.buckets) >= maxRateBuckets {
+			client = "" // Overflow: share a bucket
+		}
+		if b = l.buckets[client]; b == nil {
+			b = &tokenBucket{tokens: l.burst, last: now}
+			l.buckets[client] = b
+		}
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		l.limited++
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	l.allowed++
+	return true, 0
+}
+
+// sweep drops the buckets that are full again. l.mu must be held.
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// stats returns the requests allowed and rejected, and the number of
+// buckets.
+func (l *rateLimiter) stats() (allowed, limited uint64, buckets int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.allowed, l.limited, len(l.buckets)
+}
+
+// configureRateLimits applies the rate limit flags.
+func configureRateLimits() error {
+	for class, name := range routeClassNames {
+		if rateLimits[class] < 0 || rateBursts[class] < 0 {
+			return fmt.Errorf("-rate-limit-%s and -rate-burst-%s must be >= 0", name, name)
+		}
+		rateLimiters[class].configure(rateLimits[class], rateBursts[class], rateLimitExempt)
+	}
+	return nil
+}
+
+// rateLimitExemptSetting is the reloadableSettings entry of the exempt
+// principals.
+func rateLimitExemptSetting(values []string) (func() int, error) {
+	return func() int {
+		rateLimitExempt = stringListFlag(slices.Clone(values))
+		configureRateLimits()
+		return 0
+	}, nil
+}
+
+// rateLimitSetting returns the reloadableSettings entry of the limit or
+// burst of class, which set stores in the rate limit flags.
+func rateLimitSetting(class int, set func(n int)) func(values []string) (func() int, error) {
+	return func(values []string) (func() int, error) {
+		n, err := strconv.Atoi(values[0])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid rate %s (must be >= 0)", values[0])
+		}
+		return func() int {
+			set(n)
+			rateLimiters[class].configure(rateLimits[class], rateBursts[class], rateLimitExempt)
+			return 0
+		}, nil
+	}
+}
+
+// sweepRateLimiters drops idle buckets every rateSweepInterval.
+func sweepRateLimiters() {
+	for now := range time.Tick(rateSweepInterval) {
+		for class := range rateLimiters {
+			l := &rateLimiters[class]
+			l.mu.Lock()
+			l.sweep(now)
+			l.mu.Unlock()
+		}
+	}
+}
+
+// requireRate wraps the handler of a method of a route so clients over the
+// rate limit of its class get 429.
+func requireRate(class int, next http.HandlerFunc) http.HandlerFunc {
+	if class == classNone {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkRate(class, w, r); err != nil {
+			writeError(w, r, err.Status, err.Code, err.Message)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// checkRate takes a token of the rate limit of class for the client of r,
+// or returns the error of a client over the limit, with the Retry-After
+// header set.
+func checkRate(class int, w http.ResponseWriter, r *http.Request) *APIError {
+	principal := requestPrincipal(r)
+	client := "principal:" + principal
+	if principal == "" {
+		addr, _ := currentIPPolicy.Load().clientAddr(r)
+		client = "addr:" + addr.String()
+	}
+	ok, wait := rateLimiters[class].allow(client, principal, time.Now())
+	if ok {
+		return nil
+	}
+	retryAfter := max(int(math.Ceil(wait.Seconds())), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	slog.Debug("Rate limited", "class", routeClassNames[class], "client", client, "retry_after", retryAfter)
+	return &APIError{Status: http.StatusTooManyRequests, Code: codeRateLimited,
+		Message: fmt.Sprintf("Too many %s requests, retry in %ds", routeClassNames[class], retryAfter)}
+}
+
+// writeRateLimitMetrics writes the rate limiter metrics.
+func writeRateLimitMetrics(m *metricsWriter) {
+	m.family("miniredis_rate_limit_allowed_total", "counter", "Requests allowed by the rate limiter of a route class, since startup.")
+	for class, name := range routeClassNames {
+		allowed, _, _ := rateLimiters[class].stats()
+		m.sample("miniredis_rate_limit_allowed_total", float64(allowed), "class", name)
+	}
+	m.family("miniredis_rate_limited_total", "counter", "Requests rejected with 429 by the rate limiter of a route class, since startup.")
+	for class, name := range routeClassNames {
+		_, limited, _ := rateLimiters[class].stats()
+		m.sample("miniredis_rate_limited_total", float64(limited), "class", name)
+	}
+	m.family("miniredis_rate_limit_clients", "gauge", "Clients with a token bucket for a route class.")
+	for class, name := range routeClassNames {
+		_, _, buckets := rateLimiters[class].stats()
+		m.sample("miniredis_rate_limit_clients", float64(buckets), "class", name)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// setRateLimit limits the read routes to rate requests per second, with
+// the burst of the rate, for the test.
+func setRateLimit(t *testing.T, rate int, exempt ...string) {
+	t.Helper()
+	prevLimits, prevBursts, prevExempt := rateLimits, rateBursts, rateLimitExempt
+	rateLimits[classRead], rateBursts[classRead], rateLimitExempt = rate, 0, exempt
+	if err := configureRateLimits(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		rateLimits, rateBursts, rateLimitExempt = prevLimits, prevBursts, prevExempt
+		configureRateLimits()
+	})
+}
+
+// TestRateLimiterFairness checks that a client sending far more requests
+// than the limit only uses up its own bucket: a client under the limit
+// gets every request through, and the fast one gets the rate plus the
+// burst.
+func TestRateLimiterFairness(t *testing.T) {
+	var l rateLimiter
+	l.configure(10, 10, nil)
+
+	start := time.Now()
+	var fast, slow, slowSent int
+	for ms := range 10_000 { // 10s: the fast client sends every 1ms, the slow one every 200ms
+		now := start.Add(time.Duration(ms) * time.Millisecond)
+		if ok, _ := l.allow("fast", "fast", now); ok {
+			fast++
+		}
+		if ms%200 == 0 {
+			slowSent++
+			if ok, _ := l.allow("slow", "slow", now); ok {
+				slow++
+			}
+		}
+	}
+	if slow != slowSent {
+		t.Errorf("slow client: %d of %d requests allowed, want all", slow, slowSent)
+	}
+	if want := 10 + 10*10; fast < want-1 || fast > want+1 {
+		t.Errorf("fast client: %d requests allowed, want about %d", fast, want)
+	}
+}
+
+// TestRateLimitHTTP checks that a client over the limit gets 429 with
+// Retry-After while another client and an exempt principal don't.
+func TestRateLimitHTTP(t *testing.T) {
+	srv := newTestServer(t)
+	tokens, err := parseAPITokens([]string{"fast:fast-token", "slow:slow-token", "batch:batch-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevTokens := apiTokens
+	apiTokens = tokens
+	t.Cleanup(func() { apiTokens = prevTokens })
+	setRateLimit(t, 5, "batch")
+
+	get := func(token string) *http.Response {
+		resp, _ := doRequest(t, srv, http.MethodGet, "/v1/get?key=k", "", http.Header{"Authorization": {"Bearer " + token}})
+		return resp
+	}
+	var limited *http.Response
+	for range 50 {
+		if resp := get("fast-token"); resp.StatusCode == http.StatusTooManyRequests {
+			limited = resp
+		}
+	}
+	if limited == nil {
+		t.Fatal("50 requests at a limit of 5/s were never rate limited")
+	}
+	if limited.Header.Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+
+	var statuses []int
+	for range 3 {
+		statuses = append(statuses, get("slow-token").StatusCode)
+	}
+	if slices.Contains(statuses, http.StatusTooManyRequests) {
+		t.Errorf("another client was rate limited: statuses %v", statuses)
+	}
+	for i := range 50 {
+		if resp := get("batch-token"); resp.StatusCode == http.StatusTooManyRequests {
+			t.Fatalf("exempt principal rate limited at request %d", i+1)
+		}
+	}
+}
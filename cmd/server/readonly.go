@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// Read-only mode.
+//
+// -read-only (server.read_only in a config file) freezes the dataset for
+// maintenance, e.g. during a migration, and POST /admin/readonly switches it
+// at runtime: every client write (/set, /del, PUT and DELETE /keys/{key},
+// the write commands of /pipeline, and /restore) gets 503 read_only_mode,
+// while reads, /stats, /backup, and the health check keep working. Eviction
+// is paused too, since it writes to the AOF (see cache.SetEvictionPaused);
+// the keys over the limits are evicted when the mode is switched off. /info
+// reports the mode as read_only.
+
+var (
+	readOnlyFlag bool        // -read-only
+	readOnlyMode atomic.Bool // Read-only mode in effect
+)
+
+// setReadOnly switches read-only mode on or off, and returns the keys
+// evicted when eviction resumes.
+func setReadOnly(on bool) int {
+	readOnlyMode.Store(on)
+	return cacheInstance.SetEvictionPaused(on)
+}
+
+// readOnlySetting is the reloadableSettings entry of server.read_only.
+func readOnlySetting(values []string) (func() int, error) {
+	on, err := strconv.ParseBool(values[0])
+	if err != nil {
+		return nil, err
+	}
+	return func() int { return setReadOnly(on) }, nil
+}
+
+// ReadOnlyRequest represents the JSON payload for POST /admin/readonly.
+type ReadOnlyRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// ReadOnlyResponse represents the JSON response of /admin/readonly.
+type ReadOnlyResponse struct {
+	ReadOnly bool `json:"read_only"`
+	Evicted  int  `json:"evicted,omitempty"` // Keys evicted to fit the limits when switching it off
+}
+
+// readOnlyHandler handles GET requests reporting whether the server is
+// read-only.
+func readOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ReadOnlyResponse{ReadOnly: readOnlyMode.Load()})
+}
+
+// setReadOnlyHandler handles POST requests switching read-only mode on or
+// off.
+func setReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	var req ReadOnlyRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeJSONBodyError(w, r, err)
+		return
+	}
+	if req.Enabled == nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, `Missing "enabled"`)
+		return
+	}
+
+	reloadMu.Lock() // The flag is reported by GET /config
+	old := readOnlyMode.Load()
+	evicted := setReadOnly(*req.Enabled)
+	setFlagValues("read-only", []string{strconv.FormatBool(*req.Enabled)})
+	reloadMu.Unlock()
+
+	if old != *req.Enabled {
+		slog.Info("Read-only mode switched", "read_only", *req.Enabled, "principal", requestPrincipal(r), "evicted", evicted)
+	}
+	writeJSON(w, http.StatusOK, ReadOnlyResponse{ReadOnly: *req.Enabled, Evicted: evicted})
+}
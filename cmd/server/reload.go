@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// Config reload.
+//
+// SIGHUP and POST /admin/reload read the config file again and apply the
+// settings that changed since it was last loaded. The settings in
+// reloadableSettings take effect right away; changes of the others, such as
+// server.addr or persistence.aof, need a restart: they are logged with a
+// warning, reported, and keep being reported by later reloads until the
+// server is restarted. A setting given by a flag or an environment variable
+// still wins over the file, so its file changes are reported as overridden.
+// A setting removed from the file goes back to its default.
+//
+// Reloads are all or nothing: the whole file is validated, and every new
+// value parsed, before anything is applied, so an invalid file changes
+// nothing. Reloads are serialized, and so are they with GET /config.
+
+// reloadMu serializes reloads, and guards configFile and the flags they set.
+var reloadMu sync.Mutex
+
+// errNoConfigFile is returned by reloadConfig without -config.
+var errNoConfigFile = errors.New("no config file (start the server with -config)")
+
+// ReloadResponse represents the JSON response of POST /admin/reload.
+type ReloadResponse struct {
+	Changed         []SettingChange `json:"changed"`          // Settings applied
+	RestartRequired []SettingChange `json:"restart_required"` // Changes ignored until a restart
+	Overridden      []SettingChange `json:"overridden"`       // Changes ignored, since a flag or environment variable sets the setting
+	Evicted         int             `json:"evicted"`          // Keys evicted to fit lower key or memory limits
+}
+
+// SettingChange describes a setting changed in the config file.
+type SettingChange struct {
+	Setting string `json:"setting"` // e.g. "cache.max_keys"
+	Old     string `json:"old"`     // Value before the reload ("" = unset)
+	New     string `json:"new"`     // Value in the file ("" = unset: the default)
+}
+
+// reloadableSettings apply the settings that can change at runtime. Each
+// gets the new flag values of the setting (several for save rules, none
+// for no rules) and returns the function applying them, which returns the
+// keys evicted, or an error if the values are invalid.
+var reloadableSettings = map[string]func(values []string) (func() int, error){
+	"server.log_level": func(values []string) (func() int, error) {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(values[0])); err != nil {
+			return nil, err
+		}
+		return func() int { setLogLevel(level, 0); return 0 }, nil
+	},
+	"cache.max_keys": func(values []string) (func() int, error) {
+		n, err := strconv.Atoi(values[0])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid key limit %s (must be >= 0)", values[0])
+		}
+		return func() int {
+			evicted, _ := cacheInstance.SetMaxKeys(n)
+			return evicted
+		}, nil
+	},
+	"cache.maxmemory": func(values []string) (func() int, error) {
+		bytes, err := parseMemorySize(values[0])
+		if err != nil {
+			return nil, err
+		}
+		return func() int {
+			evicted, _ := cacheInstance.SetMaxMemory(bytes)
+			return evicted
+		}, nil
+	},
+	"cache.cleanup_interval": func(values []string) (func() int, error) {
+		interval, err := time.ParseDuration(values[0])
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid cleanup interval %s (must be > 0)", values[0])
+		}
+		return func() int { cacheInstance.SetCleanupInterval(interval); return 0 }, nil
+	},
+	"cache.eviction_policy": func(values []string) (func() int, error) {
+		policy, err := cache.ParseEvictionPolicy(values[0])
+		if err != nil {
+			return nil, err
+		}
+		return func() int { cacheInstance.SetEvictionPolicy(policy); return 0 }, nil
+	},
+	"cache.max_key_length": func(values []string) (func() int, error) {
+		n, err := strconv.Atoi(values[0])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid key length limit %s (must be >= 0)", values[0])
+		}
+		return func() int {
+			cacheInstance.SetLimits(n, cacheInstance.Limits().MaxValueSize)
+			return 0
+		}, nil
+	},
+	"cache.max_value_size": func(values []string) (func() int, error) {
+		n, err := strconv.Atoi(values[0])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid value size limit %s (must be >= 0)", values[0])
+		}
+		return func() int {
+			cacheInstance.SetLimits(cacheInstance.Limits().MaxKeyLength, n)
+			return 0
+		}, nil
+	},
+	"persistence.snapshot_interval": func(values []string) (func() int, error) {
+		interval, err := time.ParseDuration(values[0])
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid snapshot interval %s (must be > 0)", values[0])
+		}
+		return func() int {
+			if snapshotManager != nil {
+				snapshotManager.SetInterval(interval)
+			}
+			return 0
+		}, nil
+	},
+	"server.rate_limit_read":   rateLimitSetting(classRead, func(n int) { rateLimits[classRead] = n }),
+	"server.rate_burst_read":   rateLimitSetting(classRead, func(n int) { rateBursts[classRead] = n }),
+	"server.rate_limit_write":  rateLimitSetting(classWrite, func(n int) { rateLimits[classWrite] = n }),
+	"server.rate_burst_write":  rateLimitSetting(classWrite, func(n int) { rateBursts[classWrite] = n }),
+	"server.rate_limit_admin":  rateLimitSetting(classAdmin, func(n int) { rateLimits[classAdmin] = n }),
+	"server.rate_burst_admin":  rateLimitSetting(classAdmin, func(n int) { rateBursts[classAdmin] = n }),
+	"server.rate_limit_exempt": rateLimitExemptSetting,
+	"server.read_only":         readOnlySetting,
+	"security.ip_allow_read":   ipListSetting(func(p *ipPolicy, s ipSet) { p.rules[classRead].allow = s }),
+	"security.ip_deny_read":    ipListSetting(func(p *ipPolicy, s ipSet) { p.rules[classRead].deny = s }),
+	"security.ip_allow_write":  ipListSetting(func(p *ipPolicy, s ipSet) { p.rules[classWrite].allow = s }),
+	"security.ip_deny_write":   ipListSetting(func(p *ipPolicy, s ipSet) { p.rules[classWrite].deny = s }),
+	"security.ip_allow_admin":  ipListSetting(func(p *ipPolicy, s ipSet) { p.rules[classAdmin].allow = s }),
+	"security.ip_deny_admin":   ipListSetting(func(p *ipPolicy, s ipSet) { p.rules[classAdmin].deny = s }),
+	"security.trusted_proxies": ipListSetting(func(p *ipPolicy, s ipSet) { p.trusted = s }),
+	"persistence.fsync": func(values []string) (func() int, error) {
+		policy, err := cache.ParseFsyncPolicy(values[0])
+		if err != nil {
+			return nil, err
+		}
+		return func() int {
+			if cacheInstance.Persistent() {
+				if err := cacheInstance.SetAOFFsync(policy); err != nil {
+					slog.Error("AOF fsync policy change failed", "err", err)
+				}
+			}
+			return 0
+		}, nil
+	},
+	"persistence.save": func(values []string) (func() int, error) {
+		var rules []cache.SaveRule
+		for _, v := range values {
+			r, err := cache.ParseSaveRules(v)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, r...)
+		}
+		return func() int {
+			if snapshotManager != nil {
+				snapshotManager.SetSaveRules(rules)
+			}
+			return 0
+		}, nil
+	},
+}
+
+// reloadConfig reads the config file again and applies the changed
+// settings, see above.
+func reloadConfig() (*ReloadResponse, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if configFilePath == "" {
+		return nil, errNoConfigFile
+	}
+	next, err := loadConfigFile(configFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", configFilePath, err)
+	}
+
+	resp := &ReloadResponse{Changed: []SettingChange{}, RestartRequired: []SettingChange{}, Overridden: []SettingChange{}}
+	type pendingSetting struct {
+		flag   string
+		values []string
+		apply  func() int
+	}
+	var pending []pendingSetting
+	current := configSettings(configFile)
+	for i, s := range configSettings(next) {
+		old := current[i]
+		if reflect.DeepEqual(old.value.Interface(), s.value.Interface()) {
+			continue
+		}
+		change := SettingChange{Setting: s.path, Old: describeSetting(old), New: describeSetting(s)}
+
+		switch prepare, ok := reloadableSettings[s.path]; {
+		case s.overridden():
+			resp.Overridden = append(resp.Overridden, change)
+		case !ok:
+			resp.RestartRequired = append(resp.RestartRequired, change)
+			s.value.Set(old.value) // Reported again until the restart
+		default:
+			values := settingValues(s)
+			apply, err := prepare(values)
+			if err != nil {
+				return nil, fmt.Errorf("invalid config file %s: %s: %w", configFilePath, s.path, err)
+			}
+			pending = append(pending, pendingSetting{s.flag, values, apply})
+			resp.Changed = append(resp.Changed, change)
+		}
+	}
+
+	// Everything is valid: apply it
+	for _, p := range pending {
+		resp.Evicted += p.apply()
+		setFlagValues(p.flag, p.values)
+	}
+	configFile = next
+
+	for _, c := range resp.Changed {
+		slog.Info("Config setting changed", "setting", c.Setting, "old", c.Old, "new", c.New)
+	}
+	for _, c := range resp.RestartRequired {
+		slog.Warn("Config setting change requires a restart", "setting", c.Setting, "old", c.Old, "new", c.New)
+	}
+	for _, c := range resp.Overridden {
+		slog.Info("Config setting change overridden by a flag or environment variable", "setting", c.Setting)
+	}
+	slog.Info("Config reloaded", "path", configFilePath, "changed", len(resp.Changed),
+		"restart_required", len(resp.RestartRequired), "overridden", len(resp.Overridden), "evicted", resp.Evicted)
+	return resp, nil
+}
+
+// settingValues returns the new flag values of a reloadable setting: its
+// value in the file, or the flag's default if it was removed from the file.
+func settingValues(s configSetting) []string {
+	switch {
+	case s.value.Kind() == reflect.Slice:
+		return s.value.Interface().([]string)
+	case !s.value.IsNil():
+		return []string{formatConfigValue(s.value.Elem())}
+	}
+	def := flag.Lookup(s.flag).DefValue
+	if s.flag == "save" && def == "" {
+		return nil
+	}
+	return []string{def}
+}
+
+// setFlagValues sets the flag name to values, so GET /config reports them.
+func setFlagValues(name string, values []string) {
+	f := flag.Lookup(name)
+	switch v := f.Value.(type) { // Repeatable flags add values
+	case *saveRulesFlag:
+		*v = nil
+	case *stringListFlag:
+		*v = nil
+	}
+	for _, v := range values {
+		f.Value.Set(v)
+	}
+}
+
+// describeSetting formats the value of a setting in the config file for
+// reload reports, with secrets redacted.
+func describeSetting(s configSetting) string {
+	switch {
+	case s.value.IsNil():
+		return ""
+	case s.flag == "":
+		return redacted // Only the tokens have no flag
+	case s.value.Kind() == reflect.Slice:
+		return fmt.Sprint(s.value.Interface())
+	}
+	return formatConfigValue(s.value.Elem())
+}
+
+// reloadOnSIGHUP reloads the TLS certificate, the ACL file, and the config
+// file on every SIGHUP.
+func reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		slog.Info("SIGHUP received, reloading")
+		reloadCertificate()
+		reloadACL()
+		if configFilePath == "" {
+			continue
+		}
+		if _, err := reloadConfig(); err != nil {
+			slog.Error("Config reload failed, nothing changed", "err", err)
+		}
+	}
+}
+
+// reloadHandler handles POST requests reloading the config file, and
+// reports the settings that changed.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	resp, err := reloadConfig()
+	if errors.Is(err, errNoConfigFile) {
+		writeError(w, r, http.StatusConflict, codeNoConfigFile, "No config file (start the server with -config)")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidConfig, fmt.Sprintf("Config not reloaded: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
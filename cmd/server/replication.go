@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// Replication role of the server.
+var (
+	replicaMu    sync.Mutex     // Serializes role changes
+	replica      *cache.Replica // Replicates the primary given with -replicaof or POST /replicaof; nil on a primary
+	primaryToken string         // Bearer token for the primary's replication endpoints (PRIMARY_TOKEN)
+)
+
+// Write guard of a primary, like Redis min-replicas-to-write: writes are
+// rejected unless at least minReplicasToWrite replicas are online and
+// acknowledged within minReplicasMaxLag.
+var (
+	minReplicasToWrite int           // 0 disables the guard
+	minReplicasMaxLag  time.Duration // Acknowledgement age up to which a replica counts
+	noReplicasWrites   atomic.Int64  // Writes rejected by the guard
+)
+
+// currentReplica returns the running replica, or nil on a primary.
+func currentReplica() *cache.Replica {
+	replicaMu.Lock()
+	defer replicaMu.Unlock()
+	return replica
+}
+
+// ReplicaOfRequest is the JSON body of POST /replicaof: a null host promotes
+// the server to primary, otherwise it follows the primary at host:port.
+type ReplicaOfRequest struct {
+	Host *string `json:"host"`
+	Port int     `json:"port"`
+}
+
+// ReplicaOfResponse is the JSON response of POST /replicaof.
+type ReplicaOfResponse struct {
+	Role    string `json:"role"`              // "primary" or "replica"
+	Primary string `json:"primary,omitempty"` // host:port of the primary, on a replica
+	ReplID  string `json:"replid,omitempty"`  // Replication ID of a primary
+}
+
+// replicaOfHandler handles POST requests changing the replication role, like
+// Redis REPLICAOF, e.g. for a failover:
+//   - {"host": null} promotes a replica to primary: it stops replicating,
+//     accepts writes, and starts a new replication history (new replication
+//     ID) that its own replicas fully resync to
+//   - {"host": "10.0.0.5", "port": 8080} makes the server a replica of that
+//     primary (or switches to it), which starts with a full resync
+func replicaOfHandler(w http.ResponseWriter, r *http.Request) {
+	var req ReplicaOfRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeJSONBodyError(w, r, err)
+		return
+	}
+
+	var resp ReplicaOfResponse
+	if req.Host == nil {
+		promote()
+		resp = ReplicaOfResponse{Role: "primary", ReplID: cacheInstance.ReplicationStats().ID}
+	} else {
+		if *req.Host == "" || req.Port < 1 || req.Port > 65535 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid primary: host must not be empty and port must be 1-65535")
+			return
+		}
+		addr := net.JoinHostPort(*req.Host, strconv.Itoa(req.Port))
+		if err := follow(addr); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Failed to replicate %s: %v", addr, err))
+			return
+		}
+		resp = ReplicaOfResponse{Role: "replica", Primary: addr}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// promote stops replicating and makes the server a primary. Promoting a
+// primary does nothing.
+func promote() {
+	replicaMu.Lock()
+	defer replicaMu.Unlock()
+
+	if replica == nil {
+		return
+	}
+	status := replica.Status()
+	replica.Stop()
+	replica = nil
+	cacheInstance.ResetReplicationID()
+	slog.Info("Promoted to primary", "primary", status.Primary, "offset", status.Offset)
+}
+
+// follow makes the server a replica of the primary at addr, replacing the
+// current replica, if any.
+func follow(addr string) error {
+	replicaMu.Lock()
+	defer replicaMu.Unlock()
+
+	next, err := cache.NewReplica(cacheInstance, addr, primaryToken)
+	if err != nil {
+		return err
+	}
+	if replica != nil {
+		replica.Stop()
+	}
+	replica = next
+	if err := replica.Start(); err != nil {
+		return err
+	}
+	slog.Info("Replicating (writes are rejected)", "primary", addr)
+	return nil
+}
+
+// replicationSyncHandler handles GET requests from replicas: the response
+// streams a full or partial resync followed by every write, until the
+// replica or the server disconnects (see cache.NewReplicationStream).
+// Query parameters: id (replica ID), replid and offset (to resume).
+func replicationSyncHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	replicaID := query.Get("id")
+	if replicaID == "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Missing replica id")
+		return
+	}
+	var offset uint64
+	if s := query.Get("offset"); s != "" {
+		val, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid offset")
+			return
+		}
+		offset = val
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Streaming not supported")
+		return
+	}
+
+	stream, err := cacheInstance.NewReplicationStream(replicaID, r.RemoteAddr, query.Get("replid"), offset)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Failed to start replication: %v", err))
+		return
+	}
+
+	mode := "partial"
+	if stream.Full() {
+		mode = "full"
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(cache.ReplicationIDHeader, stream.ID())
+	w.Header().Set(cache.ReplicationOffsetHeader, strconv.FormatUint(stream.Offset(), 10))
+	w.Header().Set(cache.ReplicationModeHeader, mode)
+	w.WriteHeader(http.StatusOK)
+
+	slog.Info("Replica connected", "replica", replicaID, "addr", r.RemoteAddr, "resync", mode, "offset", stream.Offset())
+	err = stream.Serve(r.Context(), w, flusher.Flush)
+	slog.Info("Replica disconnected", "replica", replicaID, "addr", r.RemoteAddr, "err", err)
+}
+
+// replicationAckHandler handles POST requests acknowledging the offset a
+// replica has applied. Expected JSON body: {"id": "string", "offset": int}
+// Returns 404 if the replica isn't connected, so it reconnects.
+func replicationAckHandler(w http.ResponseWriter, r *http.Request) {
+	var req cache.ReplicationAck
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeJSONBodyError(w, r, err)
+		return
+	}
+
+	if err := cacheInstance.AckReplica(req.ID, req.Offset); err != nil {
+		if errors.Is(err, cache.ErrReplicaNotFound) {
+			writeError(w, r, http.StatusNotFound, codeReplicaNotConnected, "Replica not connected")
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requirePrimary wraps a write handler so it returns 409 Conflict on a
+// replica, whose dataset must only change through replication, and 503
+// Service Unavailable if fewer than -min-replicas-to-write replicas are in sync.
+func requirePrimary(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkWritable(); err != nil {
+			writeError(w, r, err.Status, err.Code, err.Message)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// checkWritable returns the error rejecting client writes in read-only
+// mode, on a replica, or without enough good replicas, or nil if writes are
+// accepted.
+func checkWritable() *APIError {
+	if readOnlyMode.Load() {
+		return &APIError{Status: http.StatusServiceUnavailable, Code: codeReadOnlyMode, Message: "Server is in read-only mode for maintenance"}
+	}
+	if replica := currentReplica(); replica != nil {
+		return &APIError{Status: http.StatusConflict, Code: codeReadOnly, Message: "READONLY: this server is a replica of " + replica.Status().Primary}
+	}
+	if minReplicasToWrite > 0 && cacheInstance.GoodReplicas(minReplicasMaxLag) < minReplicasToWrite {
+		noReplicasWrites.Add(1)
+		return &APIError{Status: http.StatusServiceUnavailable, Code: codeNoReplicas, Message: "NOREPLICAS: not enough good replicas to write"}
+	}
+	return nil
+}
+
+// writeReplicationInfo writes the fields of the replication section: the
+// link to the primary on a replica, and the connected replicas and backlog.
+func writeReplicationInfo(b *strings.Builder) {
+	if replica := currentReplica(); replica == nil {
+		b.WriteString("role:primary\n")
+	} else {
+		status := replica.Status()
+		b.WriteString("role:replica\n")
+		fmt.Fprintf(b, "primary_addr:%s\n", status.Primary)
+		linkStatus := "down"
+		if status.State == "online" {
+			linkStatus = "up"
+		}
+		fmt.Fprintf(b, "primary_link_status:%s\n", linkStatus)
+		fmt.Fprintf(b, "primary_sync_in_progress:%d\n", boolToInt(status.State == "sync"))
+		if !status.LastIO.IsZero() {
+			fmt.Fprintf(b, "primary_last_io_seconds_ago:%d\n", int(time.Since(status.LastIO).Seconds()))
+		}
+		if !status.LinkDownSince.IsZero() {
+			fmt.Fprintf(b, "primary_link_down_since_seconds:%d\n", int(time.Since(status.LinkDownSince).Seconds()))
+		}
+		fmt.Fprintf(b, "primary_replid:%s\n", orNone(status.ReplID))
+		fmt.Fprintf(b, "primary_repl_offset:%d\n", status.Offset)
+		fmt.Fprintf(b, "primary_full_syncs:%d\n", status.FullSyncs)
+		fmt.Fprintf(b, "primary_partial_syncs:%d\n", status.PartialSyncs)
+		if status.LastError != "" {
+			fmt.Fprintf(b, "primary_last_error:%s\n", status.LastError)
+		}
+	}
+
+	if !cacheInstance.Persistent() {
+		return // Replicas are fed from the AOF
+	}
+	stats := cacheInstance.ReplicationStats()
+	fmt.Fprintf(b, "connected_replicas:%d\n", len(stats.Replicas))
+	for i, ri := range stats.Replicas {
+		ackAge := "none"
+		if !ri.AckTime.IsZero() {
+			ackAge = strconv.FormatInt(time.Since(ri.AckTime).Milliseconds(), 10)
+		}
+		fmt.Fprintf(b, "replica%d:id=%s,addr=%s,state=%s,offset=%d,lag=%d,lag_bytes=%d,ack_age_ms=%s,buffered=%d\n",
+			i, ri.ID, ri.Addr, ri.State, ri.AckOffset, ri.Lag, ri.LagBytes, ackAge, ri.Buffered)
+	}
+	if minReplicasToWrite > 0 {
+		fmt.Fprintf(b, "min_replicas_to_write:%d\n", minReplicasToWrite)
+		fmt.Fprintf(b, "min_replicas_max_lag_seconds:%g\n", minReplicasMaxLag.Seconds())
+		fmt.Fprintf(b, "min_replicas_good:%d\n", cacheInstance.GoodReplicas(minReplicasMaxLag))
+		fmt.Fprintf(b, "min_replicas_rejected_writes:%d\n", noReplicasWrites.Load())
+	}
+	fmt.Fprintf(b, "replid:%s\n", stats.ID)
+	fmt.Fprintf(b, "repl_offset:%d\n", stats.Offset)
+	fmt.Fprintf(b, "repl_backlog_active:%d\n", boolToInt(stats.BacklogActive))
+	fmt.Fprintf(b, "repl_backlog_size:%d\n", stats.BacklogSize)
+	fmt.Fprintf(b, "repl_backlog_first_offset:%d\n", stats.BacklogFirst)
+	fmt.Fprintf(b, "repl_backlog_commands:%d\n", stats.BacklogCommands)
+}
+
+// writeReplicationMetrics writes the replication metrics: the link to the
+// primary on a replica, and the connected replicas and backlog.
+func writeReplicationMetrics(m *metricsWriter) {
+	replica := currentReplica()
+	m.metric("miniredis_replication_is_replica", "gauge",
+		"Whether the server is a replica (1) or a primary (0).", float64(boolToInt(replica != nil)))
+
+	if replica != nil {
+		status := replica.Status()
+		m.family("miniredis_replication_primary_link_up", "gauge", "Whether the link to the primary is up.")
+		m.sample("miniredis_replication_primary_link_up", float64(boolToInt(status.State == "online")), "primary", status.Primary)
+		m.metric("miniredis_replication_primary_sync_in_progress", "gauge",
+			"Whether a full resync from the primary is being received.", float64(boolToInt(status.State == "sync")))
+		m.metric("miniredis_replication_applied_offset", "gauge",
+			"Offset of the last command applied from the primary.", float64(status.Offset))
+		if !status.LastIO.IsZero() {
+			m.metric("miniredis_replication_primary_last_io_seconds", "gauge",
+				"Seconds since data was last received from the primary.", time.Since(status.LastIO).Seconds())
+		}
+		m.metric("miniredis_replication_full_syncs_total", "counter",
+			"Full resyncs from the primary since startup.", float64(status.FullSyncs))
+		m.metric("miniredis_replication_partial_syncs_total", "counter",
+			"Partial resyncs from the primary since startup.", float64(status.PartialSyncs))
+	}
+
+	if !cacheInstance.Persistent() {
+		return // Replicas are fed from the AOF
+	}
+	stats := cacheInstance.ReplicationStats()
+	m.metric("miniredis_replication_offset", "gauge",
+		"Offset of the last command logged.", float64(stats.Offset))
+	m.metric("miniredis_replication_backlog_bytes", "gauge",
+		"Approximate size of the replication backlog.", float64(stats.BacklogSize))
+	m.metric("miniredis_replication_backlog_commands", "gauge",
+		"Commands in the replication backlog.", float64(stats.BacklogCommands))
+	m.metric("miniredis_replication_connected_replicas", "gauge",
+		"Replicas connected to this server.", float64(len(stats.Replicas)))
+	if minReplicasToWrite > 0 {
+		m.metric("miniredis_replication_good_replicas", "gauge",
+			"Online replicas that acknowledged within -min-replicas-max-lag.", float64(cacheInstance.GoodReplicas(minReplicasMaxLag)))
+		m.metric("miniredis_replication_rejected_writes_total", "counter",
+			"Writes rejected because of -min-replicas-to-write.", float64(noReplicasWrites.Load()))
+	}
+
+	if len(stats.Replicas) == 0 {
+		return
+	}
+	replicaMetrics := []struct {
+		name, help string
+		value      func(ri cache.ReplicaInfo) float64
+	}{
+		{"miniredis_replica_online", "Whether the replica is online (1) or receiving a full resync (0).",
+			func(ri cache.ReplicaInfo) float64 { return float64(boolToInt(ri.State == "online")) }},
+		{"miniredis_replica_ack_offset", "Last offset acknowledged by the replica.",
+			func(ri cache.ReplicaInfo) float64 { return float64(ri.AckOffset) }},
+		{"miniredis_replica_lag_commands", "Commands logged but not acknowledged by the replica.",
+			func(ri cache.ReplicaInfo) float64 { return float64(ri.Lag) }},
+		{"miniredis_replica_lag_bytes", "Approximate size of the unacknowledged commands in the backlog.",
+			func(ri cache.ReplicaInfo) float64 { return float64(ri.LagBytes) }},
+		{"miniredis_replica_ack_age_seconds", "Seconds since the replica last acknowledged (-1 if never).",
+			func(ri cache.ReplicaInfo) float64 {
+				if ri.AckTime.IsZero() {
+					return -1
+				}
+				return time.Since(ri.AckTime).Seconds()
+			}},
+	}
+	for _, rm := range replicaMetrics {
+		m.family(rm.name, "gauge", rm.help)
+		for _, ri := range stats.Replicas {
+			m.sample(rm.name, rm.value(ri), "replica", ri.ID, "addr", ri.Addr)
+		}
+	}
+}
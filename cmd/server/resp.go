@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RESP framing.
+//
+// The RESP listener (see respapi.go) speaks RESP2, the protocol of Redis
+// clients: a command is an array of bulk strings,
+//
+//	*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n
+//
+// and replies are simple strings (+OK), errors (-ERR ...), integers (:1),
+// bulk strings ($3\r\nbar\r\n, or $-1\r\n for nil), and arrays of those.
+// Commands are read from a bufio.Reader, so a frame may arrive in any
+// number of reads, and pipelined commands are read from the same buffer.
+//
+// A line not starting with '*' is an inline command, as typed in telnet or
+// nc: GET foo. Its arguments are separated by whitespace, and may be
+// quoted like in redis-cli: "a b\n\x00" with the escapes \n, \r, \t, \b,
+// \a, \xHH, and \ before any other character, or 'a b' with only \'.
+// Both forms give the same arguments, run by the same commands.
+//
+// A frame that breaks the framing, e.g. a bulk length that isn't a number,
+// leaves no way to find the next command: it is answered with a protocol
+// error and the connection is closed, like Redis does. An inline command
+// with unbalanced quotes ends at its line, so the connection stays open.
+// Lines are limited to respMaxLineBytes.
+
+// Limits of RESP commands.
+const (
+	respMaxLineBytes = 64 << 10 // Longest array header or bulk length line
+	respMaxArgs      = 1 << 20  // Most arguments of a command
+	respBulkChunk    = 64 << 10 // Bulk strings grow by this as they arrive
+)
+
+// respProtocolError is a command that isn't valid RESP. Fatal errors leave
+// the connection out of sync with the framing, so it is closed after the
+// error reply.
+type respProtocolError struct {
+	msg   string
+	fatal bool
+}
+
+// Error implements the error interface.
+func (e *respProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+// readRESPCommand reads a command, an array or an inline one, and returns
+// its arguments, the name first, or none for an empty array or line. maxBytes bounds the sum of the
+// argument lengths. Errors are *respProtocolError, or errors of the
+// connection.
+func readRESPCommand(in *bufio.Reader, maxBytes int64) ([][]byte, error) {
+	line, err := readRESPLine(in)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return splitInlineArgs(line)
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > respMaxArgs {
+		return nil, &respProtocolError{msg: "invalid multibulk length", fatal: true}
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	args := make([][]byte, 0, min(n, 64))
+	for range n {
+		line, err := readRESPLine(in)
+		if err != nil {
+			return nil, noEOF(err)
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, &respProtocolError{msg: fmt.Sprintf("expected '$', got %q", firstByte(line)), fatal: true}
+		}
+		size, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil || size < 0 {
+			return nil, &respProtocolError{msg: "invalid bulk length", fatal: true}
+		}
+		if size > maxBytes {
+			return nil, &respProtocolError{msg: "command too large", fatal: true}
+		}
+		maxBytes -= size
+		arg, err := readRESPBulk(in, int(size))
+		if err != nil {
+			return nil, noEOF(err)
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// splitInlineArgs returns the arguments of an inline command, see above.
+func splitInlineArgs(line []byte) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && isInlineSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		arg := []byte{}
+		inDouble, inSingle := false, false
+		for done := false; !done; i++ {
+			if i == len(line) {
+				if inDouble || inSingle {
+					return nil, &respProtocolError{msg: "unbalanced quotes in request"}
+				}
+				break
+			}
+			c := line[i]
+			switch {
+			case inDouble:
+				switch {
+				case c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					arg = append(arg, unhex(line[i+2])<<4|unhex(line[i+3]))
+					i += 3
+				case c == '\\' && i+1 < len(line):
+					i++
+					arg = append(arg, inlineEscape(line[i]))
+				case c == '"':
+					// The closing quote must end the argument
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, &respProtocolError{msg: "unbalanced quotes in request"}
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			case inSingle:
+				switch {
+				case c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					arg = append(arg, '\'')
+				case c == '\'':
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, &respProtocolError{msg: "unbalanced quotes in request"}
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			case isInlineSpace(c):
+				done = true
+			case c == '"':
+				inDouble = true
+			case c == '\'':
+				inSingle = true
+			default:
+				arg = append(arg, c)
+			}
+		}
+		args = append(args, arg)
+	}
+}
+
+// isInlineSpace reports whether c separates inline arguments.
+func isInlineSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// isHex reports whether c is a hexadecimal digit.
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// unhex returns the value of the hexadecimal digit c.
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
+}
+
+// inlineEscape returns the byte of the escape sequence \c in double
+// quotes.
+func inlineEscape(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+	return c
+}
+
+// readRESPLine reads a line, without its \r\n (or \n).
+func readRESPLine(in *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := in.ReadSlice('\n')
+		if len(line)+len(chunk) > respMaxLineBytes {
+			return nil, &respProtocolError{msg: "too big request line", fatal: true}
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			if len(line) > 0 {
+				err = noEOF(err)
+			}
+			return nil, err
+		}
+	}
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
+
+// readRESPBulk reads a bulk string of size bytes and its \r\n. The buffer
+// grows as the data arrives, so a length announced by a client only takes
+// memory once it is sent.
+func readRESPBulk(in *bufio.Reader, size int) ([]byte, error) {
+	arg := make([]byte, min(size, respBulkChunk))
+	read := 0
+	for {
+		n, err := io.ReadFull(in, arg[read:])
+		if read += n; err != nil {
+			return nil, err
+		}
+		if read == size {
+			break
+		}
+		arg = append(arg, make([]byte, min(size-read, len(arg)))...)
+	}
+	var crlf [2]byte
+	if _, err := io.ReadFull(in, crlf[:]); err != nil {
+		return nil, err
+	}
+	if crlf != [2]byte{'\r', '\n'} {
+		return nil, &respProtocolError{msg: "expected CRLF after bulk string", fatal: true}
+	}
+	return arg, nil
+}
+
+// noEOF returns io.ErrUnexpectedEOF for io.EOF: the connection ended
+// within a command.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// firstByte returns the first byte of line, as a string for error
+// messages.
+func firstByte(line []byte) string {
+	if len(line) == 0 {
+		return ""
+	}
+	return string(line[:1])
+}
+
+// respWriter writes RESP replies to a buffer, sent by the session once per
+// batch of commands (see respSession.read).
+type respWriter struct {
+	*bufio.Writer
+	scratch [20]byte
+}
+
+// simple writes a simple string reply, e.g. +OK.
+func (w *respWriter) simple(s string) {
+	w.WriteByte('+')
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+// respLineBreaks replaces the line breaks of error messages.
+var respLineBreaks = strings.NewReplacer("\r", " ", "\n", " ")
+
+// error writes an error reply, e.g. -ERR unknown command. Line breaks,
+// which would end the reply early, are replaced with spaces.
+func (w *respWriter) error(msg string) {
+	w.WriteByte('-')
+	w.WriteString(respLineBreaks.Replace(msg))
+	w.WriteString("\r\n")
+}
+
+// integer writes an integer reply, e.g. :1.
+func (w *respWriter) integer(n int64) {
+	w.WriteByte(':')
+	w.Write(strconv.AppendInt(w.scratch[:0], n, 10))
+	w.WriteString("\r\n")
+}
+
+// bulk writes a bulk string reply.
+func (w *respWriter) bulk(b []byte) {
+	w.WriteByte('$')
+	w.Write(strconv.AppendInt(w.scratch[:0], int64(len(b)), 10))
+	w.WriteString("\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+// null writes the nil bulk string, $-1.
+func (w *respWriter) null() {
+	w.WriteString("$-1\r\n")
+}
+
+// array writes the header of an array reply of n elements, to be followed
+// by them.
+func (w *respWriter) array(n int) {
+	w.WriteByte('*')
+	w.Write(strconv.AppendInt(w.scratch[:0], int64(n), 10))
+	w.WriteString("\r\n")
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// newRESPTestServer serves the RESP API of a new in-memory cache on
+// listener, and shuts it down when the test ends.
+func newRESPTestServer(t testing.TB, listener net.Listener) *respServer {
+	t.Helper()
+	c, err := cache.NewCache("", "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	prev := cacheInstance
+	cacheInstance = c
+	srv := newRESPServer(listener, nil)
+	serverErr := make(chan error, 1)
+	go srv.serve(serverErr)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		c.Close()
+		cacheInstance = prev
+		select {
+		case err := <-serverErr:
+			t.Errorf("serve: %v", err)
+		default:
+		}
+	})
+	return srv
+}
+
+// pipeListener is an in-memory listener: Dial returns one end of a
+// net.Pipe, and Accept the other.
+type pipeListener struct {
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+// Dial connects to the listener.
+func (l *pipeListener) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pipeAddr is the address of both ends of a pipeListener connection.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "127.0.0.1:1" }
+
+// binaryValue is a value with every byte, including NUL and invalid UTF-8.
+var binaryValue = func() []byte {
+	b := make([]byte, 512)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}()
+
+// respTestClient sends commands to a RESP connection and reads the replies.
+type respTestClient struct {
+	t    testing.TB
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+// dialRESP connects to a pipeListener of newRESPTestServer.
+func dialRESP(t testing.TB, ln *pipeListener) *respTestClient {
+	t.Helper()
+	conn, err := ln.Dial(context.Background(), "pipe", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &respTestClient{t: t, conn: conn, in: bufio.NewReader(conn)}
+}
+
+// respFrame returns the RESP array of args.
+func respFrame(args ...string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return b.String()
+}
+
+// send writes raw bytes to the connection.
+func (c *respTestClient) send(raw string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, raw); err != nil {
+		c.t.Fatalf("sending %q: %v", raw, err)
+	}
+}
+
+// do sends a command and returns its reply.
+func (c *respTestClient) do(args ...string) string {
+	c.t.Helper()
+	c.send(respFrame(args...))
+	return c.reply()
+}
+
+// reply reads a reply: simple strings, errors, and integers with their
+// prefix (+OK, -ERR ..., :1), bulk strings as they are, nil as (nil), and
+// arrays as [a b].
+func (c *respTestClient) reply() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.in.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("reading a reply: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.in, data); err != nil {
+			c.t.Fatalf("reading a bulk string: %v", err)
+		}
+		return string(data[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		elems := make([]string, n)
+		for i := range elems {
+			elems[i] = c.reply()
+		}
+		return "[" + strings.Join(elems, " ") + "]"
+	}
+	return line
+}
+
+// closed reports whether the server closed the connection.
+func (c *respTestClient) closed() bool {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.in.ReadByte()
+	return err == io.EOF
+}
+
+// TestRESPCommands runs every command over a RESP connection.
+func TestRESPCommands(t *testing.T) {
+	ln := newPipeListener()
+	newRESPTestServer(t, ln)
+	c := dialRESP(t, ln)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"ping", "hello"}, "hello"},
+		{[]string{"ECHO", "a\r\nb"}, "a\r\nb"},
+		{[]string{"GET", "k"}, "(nil)"},
+		{[]string{"SET", "k", "v"}, "+OK"},
+		{[]string{"GET", "k"}, "v"},
+		{[]string{"SET", "bin", string(binaryValue)}, "+OK"},
+		{[]string{"GET", "bin"}, string(binaryValue)},
+		{[]string{"SET", "ttl", "v", "EX", "100"}, "+OK"},
+		{[]string{"TTL", "ttl"}, ":100"},
+		{[]string{"SET", "ttl", "v", "px", "5000"}, "+OK"},
+		{[]string{"TTL", "ttl"}, ":5"},
+		{[]string{"TTL", "k"}, ":-1"},
+		{[]string{"TTL", "missing"}, ":-2"},
+		{[]string{"EXPIRE", "k", "60"}, ":1"},
+		{[]string{"EXPIRE", "missing", "60"}, ":0"},
+		{[]string{"MGET", "k", "missing", "bin"}, "[v (nil) " + string(binaryValue) + "]"},
+		{[]string{"EXISTS", "k", "missing", "bin"}, ":2"},
+		{[]string{"INCR", "n"}, ":1"},
+		{[]string{"INCRBY", "n", "10"}, ":11"},
+		{[]string{"DECR", "n"}, ":10"},
+		{[]string{"DECRBY", "n", "4"}, ":6"},
+		{[]string{"INCR", "k"}, "-ERR not_integer: Value is not an integer or out of range"},
+		{[]string{"DEL", "k", "missing", "n"}, ":2"},
+		{[]string{"EXPIRE", "bin", "0"}, ":1"},
+		{[]string{"EXISTS", "bin"}, ":0"},
+		{[]string{"SET", "k", "v", "EX", "0"}, "-ERR invalid expire time in 'set' command"},
+		{[]string{"SET", "k", "v", "NX"}, "-ERR syntax error"},
+		{[]string{"INCRBY", "n", "x"}, "-ERR value is not an integer or out of range"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"GET", cache.InternalPrefix + "x"}, "-ERR invalid_key: "},
+		{[]string{"FLUSHALL"}, "-ERR unknown command 'FLUSHALL'"},
+	}
+	for _, tt := range tests {
+		got := c.do(tt.args...)
+		if got != tt.want && !(strings.HasSuffix(tt.want, ": ") && strings.HasPrefix(got, tt.want)) {
+			t.Errorf("%.40q = %.60q, want %.60q", tt.args, got, tt.want)
+		}
+	}
+	if got := c.do("QUIT"); got != "+OK" || !c.closed() {
+		t.Errorf("QUIT = %q, want +OK and the connection closed", got)
+	}
+}
+
+// countingListener counts the writes to the connections it accepts.
+type countingListener struct {
+	net.Listener
+	writes *atomic.Int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{c, l.writes}, nil
+}
+
+// countingConn counts its writes.
+type countingConn struct {
+	net.Conn
+	writes *atomic.Int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+// TestRESPPipeline checks that the replies to pipelined commands come in
+// order, in one write for the commands of one read.
+func TestRESPPipeline(t *testing.T) {
+	ln := newPipeListener()
+	var writes atomic.Int64
+	newRESPTestServer(t, countingListener{ln, &writes})
+	c := dialRESP(t, ln)
+
+	const commands = 100
+	var batch strings.Builder
+	for i := range commands {
+		key := "key" + strconv.Itoa(i/2%10)
+		if i%2 == 0 {
+			batch.WriteString(respFrame("INCR", key))
+		} else {
+			batch.WriteString(respFrame("GET", key))
+		}
+	}
+	c.send(batch.String()) // Read at once: net.Pipe hands a write to one read
+	counts := make(map[string]int)
+	for i := range commands {
+		key := "key" + strconv.Itoa(i/2%10)
+		if i%2 == 0 {
+			counts[key]++
+		}
+		want := strconv.Itoa(counts[key])
+		if i%2 == 0 {
+			want = ":" + want
+		}
+		if got := c.reply(); got != want {
+			t.Fatalf("reply %d = %q, want %q", i, got, want)
+		}
+	}
+	if n := writes.Load(); n != 1 {
+		t.Errorf("%d writes for the replies to one batch, want 1", n)
+	}
+}
+
+// TestRESPPartialFrames checks that commands split across reads, at every
+// byte, run once they are complete.
+func TestRESPPartialFrames(t *testing.T) {
+	ln := newPipeListener()
+	newRESPTestServer(t, ln)
+	stream := respFrame("SET", "k", "line\r\nbreak") + respFrame("GET", "k") + respFrame("SET", "bin", string(binaryValue)) +
+		respFrame("GET", "bin") + "*0\r\n" + respFrame("DEL", "k", "bin")
+	want := []string{"+OK", "line\r\nbreak", "+OK", string(binaryValue), ":2"}
+
+	for _, size := range []int{1, 2, 3, 7, 100} {
+		c := dialRESP(t, ln)
+		go func() {
+			for rest := stream; rest != ""; {
+				n := min(size, len(rest))
+				if _, err := io.WriteString(c.conn, rest[:n]); err != nil {
+					return
+				}
+				rest = rest[n:]
+			}
+		}()
+		for i, w := range want {
+			if got := c.reply(); got != w {
+				t.Fatalf("reads of %d bytes: reply %d = %.40q, want %.40q", size, i, got, w)
+			}
+		}
+	}
+}
+
+// TestRESPRepliesBeforePartialCommand checks that the replies to the
+// complete commands of a read are sent while the session waits for the
+// rest of the next one.
+func TestRESPRepliesBeforePartialCommand(t *testing.T) {
+	ln := newPipeListener()
+	newRESPTestServer(t, ln)
+	c := dialRESP(t, ln)
+
+	frame := respFrame("GET", "k")
+	c.send(respFrame("SET", "k", "v") + frame[:9])
+	if got := c.reply(); got != "+OK" {
+		t.Fatalf("reply = %q, want +OK before the rest of the next command", got)
+	}
+	c.send(frame[9:])
+	if got := c.reply(); got != "v" {
+		t.Errorf("reply = %q, want v", got)
+	}
+}
+
+// TestRESPFramingErrors checks that a frame breaking the framing is
+// answered with a protocol error, and closes the connection.
+func TestRESPFramingErrors(t *testing.T) {
+	ln := newPipeListener()
+	newRESPTestServer(t, ln)
+	prevMax := maxBodyBytes
+	maxBodyBytes = 1024
+	t.Cleanup(func() { maxBodyBytes = prevMax })
+
+	tests := []struct {
+		frame string
+		want  string
+	}{
+		{"*x\r\n", "-ERR Protocol error: invalid multibulk length"},
+		{"*1\r\n$x\r\n", "-ERR Protocol error: invalid bulk length"},
+		{"*1\r\n$-1\r\n", "-ERR Protocol error: invalid bulk length"},
+		{"*1\r\n:1\r\n", `-ERR Protocol error: expected '$', got ":"`},
+		{"*1\r\n$4\r\nPINGxx", "-ERR Protocol error: expected CRLF after bulk string"},
+		{"*2\r\n$3\r\nGET\r\n$2000\r\n", "-ERR Protocol error: command too large"},
+		{"*1\r\n$" + strings.Repeat("1", respMaxLineBytes+1) + "\r\n", "-ERR Protocol error: too big request line"},
+	}
+	for _, tt := range tests {
+		c := dialRESP(t, ln)
+		go io.WriteString(c.conn, tt.frame)
+		if got := c.reply(); got != tt.want {
+			t.Errorf("%.20q: reply %q, want %q", tt.frame, got, tt.want)
+		}
+		if !c.closed() {
+			t.Errorf("%.20q: connection still open", tt.frame)
+		}
+	}
+}
+
+// TestRESPAuth checks that with API tokens, commands on keys need AUTH
+// first.
+func TestRESPAuth(t *testing.T) {
+	tokens, err := parseAPITokens([]string{"app:app-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevTokens := apiTokens
+	apiTokens = tokens
+	t.Cleanup(func() { apiTokens = prevTokens })
+	ln := newPipeListener()
+	newRESPTestServer(t, ln)
+	c := dialRESP(t, ln)
+
+	steps := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GET", "k"}, "-NOAUTH Authentication required."},
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"AUTH", "wrong"}, "-WRONGPASS invalid username-password pair or user is disabled."},
+		{[]string{"AUTH", "other", "app-token"}, "-WRONGPASS invalid username-password pair or user is disabled."},
+		{[]string{"GET", "k"}, "-NOAUTH Authentication required."},
+		{[]string{"AUTH", "app", "app-token"}, "+OK"},
+		{[]string{"GET", "k"}, "(nil)"},
+	}
+	for _, s := range steps {
+		if got := c.do(s.args...); got != s.want {
+			t.Errorf("%q = %q, want %q", s.args, got, s.want)
+		}
+	}
+}
+
+// TestRESPExpireACL checks that EXPIRE with a TTL of 0, which deletes the
+// key, is checked as expire: a user allowed expire but not del may run it.
+func TestRESPExpireACL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	spec := `{"users": [{"name": "ttl", "token": "ttl-token", "allow": ["set", "get", "expire"]}]}`
+	if err := os.WriteFile(path, []byte(spec), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := loadACLFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := currentACL.Load()
+	currentACL.Store(a)
+	t.Cleanup(func() { currentACL.Store(prev) })
+	ln := newPipeListener()
+	newRESPTestServer(t, ln)
+	c := dialRESP(t, ln)
+
+	steps := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"AUTH", "ttl-token"}, "+OK"},
+		{[]string{"SET", "k", "v"}, "+OK"},
+		{[]string{"DEL", "k"}, "-NOPERM "},
+		{[]string{"EXPIRE", "k", "60"}, ":1"},
+		{[]string{"EXPIRE", "k", "0"}, ":1"},
+		{[]string{"GET", "k"}, "(nil)"},
+		{[]string{"EXPIRE", "k", "-1"}, ":0"},
+	}
+	for _, s := range steps {
+		if got := c.do(s.args...); got != s.want && !(strings.HasSuffix(s.want, " ") && strings.HasPrefix(got, s.want)) {
+			t.Errorf("%q = %q, want %q", s.args, got, s.want)
+		}
+	}
+}
+
+// TestRESPShutdown checks that the graceful shutdown answers the commands
+// already sent, then closes the connections.
+func TestRESPShutdown(t *testing.T) {
+	ln := newPipeListener()
+	srv := newRESPTestServer(t, ln)
+	c := dialRESP(t, ln)
+	if got := c.do("SET", "k", "v"); got != "+OK" {
+		t.Fatalf("SET = %q", got)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.Shutdown(context.Background())
+		close(done)
+	}()
+	if !c.closed() {
+		t.Error("connection still open after the shutdown")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+	if _, err := ln.Dial(context.Background(), "pipe", ""); err == nil {
+		t.Error("connected after the shutdown")
+	}
+}
+
+// BenchmarkRESPPipeline runs GET commands over TCP, one at a time (P1) and
+// in batches of 16 (P16), like redis-benchmark -P 16. One op is a batch;
+// commands/s compares the two.
+func BenchmarkRESPPipeline(b *testing.B) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	newRESPTestServer(b, ln)
+	if err := cacheInstance.Set("key", "value", 0); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, p := range []int{1, 16} {
+		b.Run("P"+strconv.Itoa(p), func(b *testing.B) {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			c := &respTestClient{t: b, conn: conn, in: bufio.NewReader(conn)}
+			batch := strings.Repeat(respFrame("GET", "key"), p)
+			for b.Loop() {
+				c.send(batch)
+				for range p {
+					if got := c.reply(); got != "value" {
+						b.Fatalf("GET = %q", got)
+					}
+				}
+			}
+			b.ReportMetric(float64(b.N*p)/b.Elapsed().Seconds(), "commands/s")
+		})
+	}
+}
+
+// TestSplitInlineArgs checks the splitting and unquoting of inline
+// commands, like redis-cli.
+func TestSplitInlineArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"GET foo", []string{"GET", "foo"}},
+		{"  SET\tfoo   bar  ", []string{"SET", "foo", "bar"}},
+		{"", nil},
+		{"   ", nil},
+		{`SET k "hello world"`, []string{"SET", "k", "hello world"}},
+		{`SET k "a\nb\r\t\"\\\x41\x7a\xff\q"`, []string{"SET", "k", "a\nb\r\t\"\\Az\xffq"}},
+		{`SET k "\x4"`, []string{"SET", "k", "x4"}},
+		{`SET k 'it\'s "raw" \n'`, []string{"SET", "k", `it's "raw" \n`}},
+		{`SET k ""`, []string{"SET", "k", ""}},
+		{`SET k''`, []string{"SET", "k"}},
+		{`SET k ab"c d"`, []string{"SET", "k", "abc d"}},
+		{`SET k "\x00\xFF\xaB"`, []string{"SET", "k", "\x00\xff\xab"}},
+		{`SET k "\xZZ\x"`, []string{"SET", "k", "xZZx"}}, // Not an \xHH escape
+		{`SET k "a b"` + "\t'c d'\t", []string{"SET", "k", "a b", "c d"}},
+		{`"GET"`, []string{"GET"}},
+	}
+	for _, tt := range tests {
+		args, err := splitInlineArgs([]byte(tt.line))
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		got := make([]string, len(args))
+		for i, arg := range args {
+			got[i] = string(arg)
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("%q = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+
+	for _, line := range []string{
+		`GET "foo`, `GET 'foo`, `GET "foo\"`, `GET 'foo\'`, `GET "foo\`, `GET "\x4`, // Unclosed
+		`GET "foo"bar`, `GET 'foo'bar`, `GET "foo""bar"`, `GET 'foo'"bar"`, `GET "\x41"x`, // Closing quote not followed by a space
+	} {
+		_, err := splitInlineArgs([]byte(line))
+		var perr *respProtocolError
+		if !errors.As(err, &perr) || perr.fatal || perr.msg != "unbalanced quotes in request" {
+			t.Errorf("%q: error %v, want a non-fatal unbalanced quotes error", line, err)
+		}
+	}
+}
+
+// TestRESPInlineCommands checks that inline commands, as sent by telnet
+// and nc, run like arrays and get RESP replies, and that unbalanced quotes
+// are answered with an error without closing the connection.
+func TestRESPInlineCommands(t *testing.T) {
+	ln := newPipeListener()
+	newRESPTestServer(t, ln)
+	c := dialRESP(t, ln)
+
+	steps := []struct {
+		line string
+		want string
+	}{
+		{"PING\r\n", "+PONG"},
+		{"set greeting \"hello world\" EX 100\r\n", "+OK"},
+		{"GET greeting\n", "hello world"}, // nc sends \n
+		{"\r\n", ""},                      // Empty lines get no reply
+		{`SET bin "\x00\xff"` + "\r\n", "+OK"},
+		{"GET bin\r\n", "\x00\xff"},
+		{"GET \"greeting\r\n", "-ERR Protocol error: unbalanced quotes in request"},
+		{"GET \"greeting\"x\r\n", "-ERR Protocol error: unbalanced quotes in request"},
+		{"GET \"\\x67reeting\"\r\n", "hello world"},
+		{"MGET greeting missing\r\n", "[hello world (nil)]"},
+		{"GET\r\n", "-ERR wrong number of arguments for 'get' command"},
+		{"NOPE a b\r\n", "-ERR unknown command 'NOPE'"},
+	}
+	for _, s := range steps {
+		c.send(s.line)
+		if s.want == "" {
+			continue
+		}
+		if got := c.reply(); got != s.want {
+			t.Errorf("%q: reply %q, want %q", s.line, got, s.want)
+		}
+	}
+
+	// Inline and array commands pipelined together, split at every byte
+	stream := "INCR n\r\n" + respFrame("INCR", "n") + "INCRBY n 'x'\r\nDECRBY n 2\r\n"
+	go func() {
+		for i := range len(stream) {
+			if _, err := io.WriteString(c.conn, stream[i:i+1]); err != nil {
+				return
+			}
+		}
+	}()
+	for _, want := range []string{":1", ":2", "-ERR value is not an integer or out of range", ":0"} {
+		if got := c.reply(); got != want {
+			t.Errorf("pipelined reply %q, want %q", got, want)
+		}
+	}
+}
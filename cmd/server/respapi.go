@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RESP API.
+//
+// With -resp-addr, the server also speaks the Redis protocol (see resp.go),
+// so Redis clients and tools like redis-cli and redis-benchmark, or telnet
+// with inline commands, can use it for the commands of /pipeline: GET, SET
+// (with EX or PX), DEL, EXISTS, MGET, INCR, INCRBY, DECR, DECRBY, EXPIRE,
+// and TTL, plus PING, ECHO, AUTH, and QUIT. Array and inline commands are
+// dispatched by the same table, respCommands. They run like the commands of /pipeline (see execute),
+// after the checks of the HTTP API: the credentials (AUTH with an API
+// token, or a client certificate), IP filter and rate limit of their
+// class, and a request slot. Their errors are RESP errors with the prefixes
+// Redis clients know, NOAUTH, NOPERM, READONLY, LOADING, and MOVED, and
+// otherwise ERR and the error code of the HTTP API, e.g. "ERR cache_full:
+// ...". The listener uses the TLS certificate of the API, if any.
+//
+// Clients pipeline: they send many commands without waiting for the
+// replies. A session reads commands from its buffer and writes the replies
+// to another, in order, and sends them when it needs to read from the
+// connection again: the replies to all the commands of a read, however
+// many, go out in one write. A client waiting for a reply to send its next
+// command gets it as soon as it is written, as the session then reads.
+//
+// A connection is closed after -idle-timeout (or -read-timeout) without a
+// command, or if replies take longer than -write-timeout to send. The
+// graceful shutdown stops the listener, answers the commands already read,
+// and closes the connections.
+
+var (
+	respAddr string      // -resp-addr ("" = no RESP listener)
+	respAPI  *respServer // Serves respAddr (nil without it)
+)
+
+// respServer serves the RESP API on a listener.
+type respServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config   // nil = plaintext
+	shutdown  chan struct{} // Closed when the graceful shutdown starts
+	served    chan struct{} // Closed when serve returns
+	sessions  sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// newRESPServer returns a server of the RESP API on listener, with a copy
+// of tlsConfig if it isn't nil.
+func newRESPServer(listener net.Listener, tlsConfig *tls.Config) *respServer {
+	s := &respServer{listener: listener, shutdown: make(chan struct{}), served: make(chan struct{})}
+	if tlsConfig != nil {
+		s.tlsConfig = tlsConfig.Clone()
+		s.tlsConfig.NextProtos = nil // Not HTTP: clients offering other protocols would be refused
+	}
+	return s
+}
+
+// serve accepts connections and serves them until the server shuts down.
+// Other errors are sent to serverErr.
+func (s *respServer) serve(serverErr chan<- error) {
+	defer close(s.served)
+	var listener net.Listener = clientListener{limitListener{s.listener}}
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-s.shutdown:
+			default:
+				serverErr <- fmt.Errorf("RESP listener: %w", err)
+			}
+			return
+		}
+		s.sessions.Go(func() { s.serveConn(conn) })
+	}
+}
+
+// Shutdown stops the listener and waits for the connections to close, or
+// ctx to be done.
+func (s *respServer) Shutdown(ctx context.Context) {
+	s.closeOnce.Do(func() { close(s.shutdown) })
+	s.listener.Close()
+	done := make(chan struct{})
+	go func() {
+		<-s.served // No session starts after this
+		s.sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("RESP connections did not close in time")
+	}
+}
+
+// respSession is the state of a RESP connection.
+type respSession struct {
+	server *respServer
+	conn   net.Conn
+	cc     *clientConn // nil if the connection isn't a client's
+	in     *bufio.Reader
+	out    respWriter
+	w      respHeaders   // For the headers set by checks
+	r      *http.Request // Of the connection, with the credentials once authenticated
+	authed bool
+}
+
+// respHeaders is the http.ResponseWriter of the checks shared with the
+// HTTP API, which only set headers.
+type respHeaders http.Header
+
+func (h respHeaders) Header() http.Header         { return http.Header(h) }
+func (h respHeaders) Write(p []byte) (int, error) { return len(p), nil }
+func (h respHeaders) WriteHeader(int)             {}
+
+// serveConn serves the commands of a connection until it closes.
+func (s *respServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r, err := http.NewRequest("RESP", "/", nil)
+	if err != nil {
+		return
+	}
+	r.RemoteAddr = conn.RemoteAddr().String()
+	ctx := context.Background()
+	if tc, ok := conn.(*tls.Conn); ok {
+		if timeout := cmp.Or(readHeaderTimeout, readTimeout); timeout > 0 {
+			tc.SetDeadline(time.Now().Add(timeout))
+		}
+		if err := tc.Handshake(); err != nil {
+			slog.Debug("RESP TLS handshake failed", "remote", r.RemoteAddr, "err", err)
+			return
+		}
+		tc.SetDeadline(time.Time{})
+		state := tc.ConnectionState()
+		r.TLS = &state
+		if len(state.PeerCertificates) > 0 {
+			ctx = context.WithValue(ctx, identityKey{}, certIdentity(state.PeerCertificates[0]))
+		}
+	}
+	sess := &respSession{server: s, conn: conn, w: respHeaders{}, authed: !authRequired()}
+	if sess.cc = asClientConn(conn); sess.cc != nil {
+		ctx = context.WithValue(ctx, clientKey{}, sess.cc)
+		protocol := "resp"
+		sess.cc.protocol.Store(&protocol)
+	}
+	sess.r = r.WithContext(ctx)
+	sess.in = bufio.NewReader(respReader{sess})
+	sess.out = respWriter{Writer: bufio.NewWriter(conn)}
+	recordPrincipal(sess.r)
+
+	// Wakes the session waiting for a command on shutdown
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.shutdown:
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	slog.Debug("RESP connected", "remote", r.RemoteAddr, "principal", requestPrincipal(sess.r))
+	err = sess.serve()
+	sess.flush()
+	slog.Debug("RESP disconnected", "remote", r.RemoteAddr, "err", err)
+}
+
+// serve reads and runs commands until the connection ends, the client
+// quits, or a protocol error leaves the connection out of sync.
+func (s *respSession) serve() error {
+	for {
+		args, err := readRESPCommand(s.in, maxBodyBytes)
+		var perr *respProtocolError
+		switch {
+		case errors.As(err, &perr):
+			s.out.error("ERR " + perr.Error())
+			if perr.fatal {
+				return err
+			}
+			continue
+		case err != nil:
+			return err
+		case len(args) == 0:
+			continue
+		}
+		if !s.dispatch(args) {
+			return nil
+		}
+	}
+}
+
+// respReader reads from the connection of a session, after sending the
+// replies written so far: the replies to the commands of a read go out
+// together, before the session waits for more.
+type respReader struct {
+	s *respSession
+}
+
+// Read sends the pending replies, then reads from the connection.
+func (rr respReader) Read(p []byte) (int, error) {
+	s := rr.s
+	if err := s.flush(); err != nil {
+		return 0, err
+	}
+	if s.cc != nil {
+		s.cc.state.Store(&clientStateIdle)
+	}
+	if timeout := cmp.Or(idleTimeout, readTimeout); timeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		s.conn.SetReadDeadline(time.Time{})
+	}
+	select {
+	case <-s.server.shutdown: // After setting the deadline, see serveConn
+		return 0, net.ErrClosed
+	default:
+	}
+	n, err := s.conn.Read(p)
+	if s.cc != nil {
+		s.cc.state.Store(&clientStateActive)
+	}
+	if writeTimeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	return n, err
+}
+
+// flush sends the pending replies.
+func (s *respSession) flush() error {
+	if s.out.Buffered() == 0 {
+		return nil
+	}
+	return s.out.Flush()
+}
+
+// respCommand is the implementation of a RESP command.
+type respCommand struct {
+	arity int                                       // Arguments, the name included; -n: at least n
+	class int                                       // Route class, for the checks; classNone: a connection command, which needs none
+	run   func(s *respSession, args [][]byte) error // Writes the reply of the arguments after the name, or returns the error
+}
+
+// respCommands maps lower case command names to their implementations.
+var respCommands = map[string]respCommand{
+	"ping":   {-1, classNone, respPing},
+	"echo":   {2, classNone, respEcho},
+	"auth":   {-2, classNone, respAuth},
+	"quit":   {1, classNone, respQuit},
+	"get":    {2, classRead, respGet},
+	"set":    {-3, classWrite, respSet},
+	"del":    {-2, classWrite, respCount("del")},
+	"exists": {-2, classRead, respCount("exists")},
+	"mget":   {-2, classRead, respMGet},
+	"incr":   {2, classWrite, respIncr(1)},
+	"decr":   {2, classWrite, respIncr(-1)},
+	"incrby": {3, classWrite, respIncrBy(1)},
+	"decrby": {3, classWrite, respIncrBy(-1)},
+	"expire": {3, classWrite, respExpire},
+	"ttl":    {2, classRead, respTTL},
+}
+
+// errRESPQuit ends the session after the reply of QUIT.
+var errRESPQuit = errors.New("quit")
+
+// respError is an error reply with its prefix, e.g. "WRONGPASS ...".
+type respError string
+
+// Error implements the error interface.
+func (e respError) Error() string {
+	return string(e)
+}
+
+// respWrongArgs returns the error of a command with a wrong number of
+// arguments.
+func respWrongArgs(name string) error {
+	return respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+}
+
+// dispatch runs a command and writes its reply. It returns false once the
+// client quits.
+func (s *respSession) dispatch(args [][]byte) bool {
+	name := strings.ToLower(string(args[0]))
+	c, ok := respCommands[name]
+	if s.cc != nil {
+		command := "RESP " + name
+		if !ok {
+			command = "RESP unknown" // Names of any length aren't kept
+		}
+		s.cc.lastCommand.Store(&command)
+		s.cc.lastActive.Store(time.Now().UnixNano())
+		s.cc.commands.Add(1)
+	}
+	var err error
+	switch {
+	case !ok:
+		err = respError(fmt.Sprintf("ERR unknown command '%.128s'", args[0]))
+	case c.arity > 0 && len(args) != c.arity, len(args) < -c.arity:
+		err = respWrongArgs(name)
+	case c.class == classNone:
+		err = c.run(s, args[1:])
+	default:
+		err = s.runChecked(c, args[1:])
+	}
+	if err == errRESPQuit {
+		return false
+	}
+	if err != nil {
+		s.out.error(respErrorMessage(err))
+	}
+	return true
+}
+
+// runChecked runs a command on keys after the checks of the HTTP API for
+// its class, within a request slot.
+func (s *respSession) runChecked(c respCommand, args [][]byte) error {
+	if !s.authed {
+		return &APIError{Status: http.StatusUnauthorized, Code: codeUnauthorized, Message: "Authentication required."}
+	}
+	if !currentIPPolicy.Load().allows(c.class, s.r) {
+		return &APIError{Status: http.StatusForbidden, Code: codeForbidden, Message: "Forbidden"}
+	}
+	if err := checkRate(c.class, s.w, s.r); err != nil {
+		return err
+	}
+	if cacheInstance.Loading() {
+		return &APIError{Status: http.StatusServiceUnavailable, Code: codeLoading, Message: "Server is loading the dataset"}
+	}
+	if !acquireRequestSlot(s.r.Context()) {
+		rejectedRequests.Add(1)
+		return &APIError{Status: http.StatusServiceUnavailable, Code: codeBusy, Message: "Too many requests in progress, retry later"}
+	}
+	activeRequests.Add(1)
+	defer func() {
+		activeRequests.Add(-1)
+		requestSlots.release()
+	}()
+	return c.run(s, args)
+}
+
+// respErrorMessage returns the error reply of err: its own for a
+// respError, and otherwise that of its APIError, with the prefix Redis
+// clients expect if there is one.
+func respErrorMessage(err error) string {
+	var re respError
+	if errors.As(err, &re) {
+		return string(re)
+	}
+	e := toAPIError(err, "Command failed")
+	switch e.Code {
+	case codeUnauthorized:
+		return "NOAUTH " + e.Message
+	case codeForbidden:
+		return "NOPERM " + e.Message
+	case codeReadOnly, codeReadOnlyMode:
+		return "READONLY " + e.Message
+	case codeLoading:
+		return "LOADING " + e.Message
+	case codeMoved:
+		return e.Message // MOVED <slot> <node>
+	}
+	return "ERR " + e.Code + ": " + e.Message
+}
+
+// respPing answers PONG, or its argument.
+func respPing(s *respSession, args [][]byte) error {
+	switch len(args) {
+	case 0:
+		s.out.simple("PONG")
+	case 1:
+		s.out.bulk(args[0])
+	default:
+		return respWrongArgs("ping")
+	}
+	return nil
+}
+
+// respEcho answers its argument.
+func respEcho(s *respSession, args [][]byte) error {
+	s.out.bulk(args[0])
+	return nil
+}
+
+// respAuth authenticates the connection with an API token, like the
+// Authorization header of a request would: AUTH token, or AUTH name token
+// with the name of the token (or "default").
+func respAuth(s *respSession, args [][]byte) error {
+	if len(args) > 2 {
+		return respWrongArgs("auth")
+	}
+	if !authRequired() {
+		s.out.simple("OK")
+		return nil
+	}
+	r := s.r.Clone(s.r.Context())
+	r.Header.Set("Authorization", "Bearer "+string(args[len(args)-1]))
+	r, err := authenticateRequest(s.w, r)
+	if err != nil || len(args) == 2 && string(args[0]) != "default" && string(args[0]) != requestTokenName(r) {
+		return respError("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	s.r, s.authed = r, true
+	recordPrincipal(r)
+	s.out.simple("OK")
+	return nil
+}
+
+// respQuit answers OK and ends the session.
+func respQuit(s *respSession, args [][]byte) error {
+	s.out.simple("OK")
+	return errRESPQuit
+}
+
+// respGet answers the value of a key, or nil.
+func respGet(s *respSession, args [][]byte) error {
+	result, err := execute(s.r, &Command{Cmd: "get", Key: string(args[0])})
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		s.out.null()
+		return nil
+	}
+	value, err := respValue(result.(GetResponse))
+	if err != nil {
+		return err
+	}
+	s.out.bulk(value)
+	return nil
+}
+
+// respValue returns the value of a GetResponse, decoding binary values.
+func respValue(resp GetResponse) ([]byte, error) {
+	if resp.ValueBase64 != "" {
+		return base64.StdEncoding.DecodeString(resp.ValueBase64)
+	}
+	return []byte(resp.Value), nil
+}
+
+// respSet stores a value: SET key value [EX seconds | PX milliseconds].
+func respSet(s *respSession, args [][]byte) error {
+	cmd := &Command{Cmd: "set", Key: string(args[0])}
+	value := string(args[1])
+	cmd.Value = &value
+	for opts := args[2:]; len(opts) > 0; opts = opts[2:] {
+		unit := time.Duration(0)
+		switch strings.ToUpper(string(opts[0])) {
+		case "EX":
+			unit = time.Second
+		case "PX":
+			unit = time.Millisecond
+		}
+		if unit == 0 || len(opts) < 2 || cmd.TTL != nil {
+			return respError("ERR syntax error")
+		}
+		n, err := strconv.ParseInt(string(opts[1]), 10, 64)
+		if err != nil {
+			return respError("ERR value is not an integer or out of range")
+		}
+		if n <= 0 || n > int64(math.MaxInt64/unit) {
+			return respError("ERR invalid expire time in 'set' command")
+		}
+		ttl := TTL(time.Duration(n) * unit)
+		cmd.TTL = &ttl
+	}
+	if _, err := execute(s.r, cmd); err != nil {
+		return err
+	}
+	s.out.simple("OK")
+	return nil
+}
+
+// respCount returns the implementation of DEL or EXISTS, which run a
+// command of /pipeline on every key and answer how many returned true.
+func respCount(name string) func(s *respSession, args [][]byte) error {
+	return func(s *respSession, args [][]byte) error {
+		var n int64
+		for _, key := range args {
+			result, err := execute(s.r, &Command{Cmd: name, Key: string(key)})
+			if err != nil {
+				return err
+			}
+			if result.(bool) {
+				n++
+			}
+		}
+		s.out.integer(n)
+		return nil
+	}
+}
+
+// respMGet answers the values of keys, nil for missing ones.
+func respMGet(s *respSession, args [][]byte) error {
+	values := make([][]byte, len(args))
+	for i, key := range args {
+		result, err := execute(s.r, &Command{Cmd: "get", Key: string(key)})
+		if err != nil {
+			return err
+		}
+		if result != nil {
+			if values[i], err = respValue(result.(GetResponse)); err != nil {
+				return err
+			}
+		}
+	}
+	s.out.array(len(values))
+	for _, value := range values {
+		if value == nil {
+			s.out.null()
+		} else {
+			s.out.bulk(value)
+		}
+	}
+	return nil
+}
+
+// respIncr returns the implementation of INCR (by 1) or DECR (by -1).
+func respIncr(by int64) func(s *respSession, args [][]byte) error {
+	return func(s *respSession, args [][]byte) error {
+		return s.incr(args[0], by)
+	}
+}
+
+// respIncrBy returns the implementation of INCRBY (sign 1) or DECRBY (sign
+// -1).
+func respIncrBy(sign int64) func(s *respSession, args [][]byte) error {
+	return func(s *respSession, args [][]byte) error {
+		by, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil || sign < 0 && by == math.MinInt64 {
+			return respError("ERR value is not an integer or out of range")
+		}
+		return s.incr(args[0], sign*by)
+	}
+}
+
+// incr adds by to the integer value of key and answers the new value.
+func (s *respSession) incr(key []byte, by int64) error {
+	result, err := execute(s.r, &Command{Cmd: "incr", Key: string(key), By: &by})
+	if err != nil {
+		return err
+	}
+	s.out.integer(result.(int64))
+	return nil
+}
+
+// respExpire sets the TTL of a key in seconds, and answers 1 if it exists
+// and 0 otherwise. Like in Redis, a TTL of 0 or less deletes the key.
+func respExpire(s *respSession, args [][]byte) error {
+	n, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return respError("ERR value is not an integer or out of range")
+	}
+	if n > int64(math.MaxInt64/time.Second) {
+		return respError("ERR invalid expire time in 'expire' command")
+	}
+	cmd := &Command{Cmd: "expire", Key: string(args[0])}
+	if n <= 0 {
+		cmd.expireNow = true // Checked as expire by the ACL, not del
+	} else {
+		ttl := TTL(time.Duration(n) * time.Second)
+		cmd.TTL = &ttl
+	}
+	result, err := execute(s.r, cmd)
+	if err != nil {
+		return err
+	}
+	s.out.integer(respBool(result.(bool)))
+	return nil
+}
+
+// respTTL answers the seconds until a key expires: -1 if it has no TTL and
+// -2 if it doesn't exist.
+func respTTL(s *respSession, args [][]byte) error {
+	result, err := execute(s.r, &Command{Cmd: "ttl", Key: string(args[0])})
+	if err != nil {
+		return err
+	}
+	s.out.integer(result.(int64))
+	return nil
+}
+
+// respBool returns the integer reply of a boolean, 1 or 0.
+func respBool(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
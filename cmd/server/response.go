@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"mini-redis/internal/cache"
+)
+
+// Response formats.
+//
+// Every endpoint answers in JSON: successes with the endpoint's response
+// type, or {"status": "ok"} when there is nothing else to report, and
+// errors with an ErrorResponse carrying one of the error codes below. The
+// codes are stable, so clients can branch on them rather than on messages.
+//
+// For one release, a request with "Accept: text/plain" still gets the plain
+// text responses of earlier versions ("OK key set", the raw value, and error
+// messages as text). /info, /metrics, /backup, and /replication/sync keep
+// their own formats, except for their errors.
+
+// Error codes of ErrorResponse.
+const (
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeInvalidJSON          = "invalid_json"
+	codeInvalidRequest       = "invalid_request"
+	codeMissingKey           = "missing_key"
+	codeInvalidTTL           = "invalid_ttl"
+	codeKeyNotFound          = "key_not_found"
+	codeCacheFull            = "cache_full"
+	codeValueTooLarge        = "value_too_large"
+	codeKeyTooLong           = "key_too_long"
+	codeInvalidKey           = "invalid_key"
+	codeNotInteger           = "not_integer"
+	codeIntegerOverflow      = "integer_overflow"
+	codeUnknownCommand       = "unknown_command"
+	codePipelineTooLarge     = "pipeline_too_large"
+	codeLoading              = "loading"
+	codeReadOnly             = "readonly"
+	codeReadOnlyMode         = "read_only_mode"
+	codeNoReplicas           = "noreplicas"
+	codeMoved                = "moved"
+	codeAdminDisabled        = "admin_disabled"
+	codeShutdownDisabled     = "shutdown_disabled"
+	codeUnauthorized         = "unauthorized"
+	codeForbidden            = "forbidden"
+	codeBusy                 = "busy"
+	codeRateLimited          = "rate_limited"
+	codePersistenceDisabled  = "persistence_disabled"
+	codeClusterDisabled      = "cluster_disabled"
+	codeInProgress           = "in_progress"
+	codeInvalidConfig        = "invalid_config"
+	codeNoConfigFile         = "no_config_file"
+	codeInvalidSnapshot      = "invalid_snapshot"
+	codeSnapshotTooLarge     = "snapshot_too_large"
+	codeBodyTooLarge         = "body_too_large"
+	codeReplicaNotConnected  = "replica_not_connected"
+	codeClientNotFound       = "client_not_found"
+	codeIdempotencyKeyReused = "idempotency_key_reused"
+	codeWatchOverflow        = "watch_overflow"
+	codeInternal             = "internal_error"
+)
+
+// APIError is an error with the status code, error code, and message of
+// its error response.
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+// Error implements the error interface.
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// StatusResponse is the JSON response of endpoints that only report success.
+type StatusResponse struct {
+	Status string `json:"status"` // Always "ok"
+}
+
+// GetResponse is the JSON response of GET /get.
+type GetResponse struct {
+	Key          string `json:"key"`
+	Value        string `json:"value"`                  // The value, if it is valid UTF-8 (empty otherwise)
+	ValueBase64  string `json:"value_base64,omitempty"` // The value base64-encoded, if it isn't valid UTF-8
+	TTLRemaining int64  `json:"ttl_remaining"`          // Seconds until the key expires, rounded up (-1: no TTL)
+	ContentType  string `json:"content_type,omitempty"` // Content type the value was stored with (PUT /keys/{key})
+}
+
+// newGetResponse builds the GetResponse of key with the metadata of its
+// value in stat.
+func newGetResponse(key string, value []byte, stat cache.KeyStat) GetResponse {
+	resp := GetResponse{Key: key, ContentType: stat.ContentType}
+	if utf8.Valid(value) {
+		resp.Value = string(value)
+	} else {
+		resp.ValueBase64 = base64.StdEncoding.EncodeToString(value)
+	}
+	resp.TTLRemaining = ttlRemaining(stat.ExpiresAt)
+	return resp
+}
+
+// ttlRemaining returns the seconds until expiresAt, rounded up, or -1 for
+// the zero time of a key without a TTL.
+func ttlRemaining(expiresAt time.Time) int64 {
+	if expiresAt.IsZero() {
+		return -1
+	}
+	return int64((max(time.Until(expiresAt), 0) + time.Second - 1) / time.Second)
+}
+
+// wantsText reports whether the request prefers the plain text responses of
+// earlier versions: the first of text/plain and application/json in its
+// Accept header (ignoring quality values) is text/plain. offers lists other
+// media types that also select plain text, e.g. application/octet-stream
+// for the raw value of /get.
+func wantsText(r *http.Request, offers ...string) bool {
+	accept := r.Header.Get("Accept")
+	for accept != "" {
+		var mediaRange string
+		mediaRange, accept, _ = strings.Cut(accept, ",")
+		mediaType, _, _ := strings.Cut(mediaRange, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		switch {
+		case mediaType == "application/json":
+			return false
+		case mediaType == "text/plain":
+			return true
+		}
+		for _, offer := range offers {
+			if mediaType == offer {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header()["Content-Type"] = jsonContentType
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeOK answers a successful request with {"status": "ok"}, or with text
+// for a request that wants plain text.
+func writeOK(w http.ResponseWriter, r *http.Request, text []byte) {
+	if wantsText(r) {
+		w.Header()["Content-Type"] = textContentType
+		w.Write(text)
+		return
+	}
+	w.Header()["Content-Type"] = jsonContentType
+	w.Write(okResponse)
+}
+
+// writeError writes an ErrorResponse with the given status code and error
+// code, or only the message as text for a request that wants plain text.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if wantsText(r) {
+		http.Error(w, message, status)
+		return
+	}
+	// Drop headers set for a successful response, as http.Error does
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, status, ErrorResponse{Error: ErrorBody{Code: code, Message: message}})
+}
+
+// writeMethodNotAllowed answers 405 to a request with an unsupported method.
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+}
+
+// writeInvalidJSON answers 400 to a request whose body isn't valid JSON.
+func writeInvalidJSON(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
+}
+
+// writeMissingKey answers 400 to a request without a key query parameter.
+func writeMissingKey(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusBadRequest, codeMissingKey, "Missing, empty, or blank key query parameter")
+}
+
+// reservedKeyError is the error of a client key in the internal namespace
+// of the cache, which holds data of the server (see idempotency.go).
+func reservedKeyError() *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: codeInvalidKey, Message: "Invalid key: the prefix is reserved for the server"}
+}
+
+// writeReservedKey answers 400 to a request for a key in the internal
+// namespace of the cache.
+func writeReservedKey(w http.ResponseWriter, r *http.Request) {
+	e := reservedKeyError()
+	writeError(w, r, e.Status, e.Code, e.Message)
+}
+
+// writeKeyNotFound answers 404 to a request for a key that doesn't exist.
+func writeKeyNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, codeKeyNotFound, "Key not found")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestJSONResponses checks the JSON bodies, error codes, and Content-Type
+// of the responses, and the plain text of "Accept: text/plain".
+func TestJSONResponses(t *testing.T) {
+	srv := newTestServer(t)
+	if err := cacheInstance.Set("ttl", "v", 42*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	text := http.Header{"Accept": {"text/plain"}}
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		body        string
+		header      http.Header
+		status      int
+		contentType string
+		want        string // Exact body
+	}{
+		{"set", http.MethodPost, "/v1/set", `{"key":"k","value":"v "}`, nil,
+			http.StatusOK, "application/json", `{"status":"ok"}` + "\n"},
+		{"get", http.MethodGet, "/v1/get?key=k", "", nil,
+			http.StatusOK, "application/json", `{"key":"k","value":"v ","ttl_remaining":-1}` + "\n"},
+		{"get with TTL", http.MethodGet, "/v1/get?key=ttl", "", nil,
+			http.StatusOK, "application/json", `{"key":"ttl","value":"v","ttl_remaining":42}` + "\n"},
+		{"get missing", http.MethodGet, "/v1/get?key=missing", "", nil,
+			http.StatusNotFound, "application/json", `{"error":{"code":"key_not_found","message":"Key not found"}}` + "\n"},
+		{"invalid JSON", http.MethodPost, "/v1/set", `{"key":`, nil,
+			http.StatusBadRequest, "application/json", `{"error":{"code":"invalid_json","message":"Invalid JSON"}}` + "\n"},
+		{"del", http.MethodPost, "/v1/del", `{"key":"missing"}`, nil,
+			http.StatusOK, "application/json", `{"deleted":false}` + "\n"},
+
+		{"text set", http.MethodPost, "/v1/set", `{"key":"k","value":"v "}`, text,
+			http.StatusOK, "text/plain; charset=utf-8", "OK key set\n"},
+		{"text get", http.MethodGet, "/v1/get?key=k", "", text,
+			http.StatusOK, "application/octet-stream", "v "},
+		{"text get missing", http.MethodGet, "/v1/get?key=missing", "", text,
+			http.StatusNotFound, "text/plain; charset=utf-8", "Key not found\n"},
+		{"text invalid JSON", http.MethodPost, "/v1/set", `{"key":`, text,
+			http.StatusBadRequest, "text/plain; charset=utf-8", "Invalid JSON\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := doRequest(t, srv, tt.method, tt.path, tt.body, tt.header)
+			if resp.StatusCode != tt.status || string(body) != tt.want {
+				t.Errorf("%s %s = %d %q, want %d %q", tt.method, tt.path, resp.StatusCode, body, tt.status, tt.want)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.contentType)
+			}
+		})
+	}
+
+	// A value that isn't valid UTF-8 is returned base64-encoded
+	if err := cacheInstance.SetBytes("binary", []byte{0xff, 0x00}, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, body := doRequest(t, srv, http.MethodGet, "/v1/get?key=binary", "", nil)
+	var got GetResponse
+	if err := json.Unmarshal(body, &got); err != nil || got.Value != "" || got.ValueBase64 != "/wA=" {
+		t.Errorf("GET of a binary value = %s", body)
+	}
+}
+
+// TestWantsText checks the Accept headers that select the plain text
+// responses.
+func TestWantsText(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", false},
+		{"text/plain", true},
+		{"Text/Plain; charset=utf-8", true},
+		{"text/plain;q=0.5, application/json", true},
+		{"application/json, text/plain", false},
+		{"text/html, text/plain", true},
+		{"application/octet-stream", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/v1/get", nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := wantsText(r); got != tt.want {
+			t.Errorf("wantsText(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/v1/get", nil)
+	r.Header.Set("Accept", "application/octet-stream")
+	if !wantsText(r, "application/octet-stream") {
+		t.Error("wantsText with an offer doesn't select it")
+	}
+}
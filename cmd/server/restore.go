@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+
+	"mini-redis/internal/cache"
+)
+
+// defaultRestoreMaxBytes is the default limit for snapshots uploaded to /restore.
+const defaultRestoreMaxBytes = 512 << 20
+
+// restoreMaxBytes is the largest request body accepted by /restore (-restore-max-bytes).
+var restoreMaxBytes int64 = defaultRestoreMaxBytes
+
+// RestoreResponse represents the JSON response of POST /restore
+type RestoreResponse struct {
+	Restored         int `json:"restored"`          // Keys loaded into the cache
+	SkippedExpired   int `json:"skipped_expired"`   // Entries skipped because they had already expired
+	SkippedOversized int `json:"skipped_oversized"` // Entries skipped because they exceed the key length or value size limit
+}
+
+// restoreHandler handles POST requests replacing the whole dataset with an
+// uploaded snapshot, either as the raw request body or as the first file of a
+// multipart/form-data upload. The snapshot may be in any format the server
+// saves (JSON or binary, optionally gzip-compressed) and is verified before
+// the current dataset is replaced.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	limitedBody, err := limitBody(w, r, restoreMaxBytes)
+	if err != nil {
+		writeRestoreError(w, r, err, err, http.StatusBadRequest)
+		return
+	}
+	limited := &readErrorBody{ReadCloser: limitedBody}
+	r.Body = limited
+
+	body, err := restoreBody(r)
+	if err != nil {
+		writeRestoreError(w, r, err, limited.err, http.StatusBadRequest)
+		return
+	}
+
+	result, err := cacheInstance.RestoreSnapshot(body)
+	if err != nil {
+		writeRestoreError(w, r, err, limited.err, http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Restored uploaded snapshot", "principal", requestPrincipal(r), "keys", result.Restored, "skipped_expired", result.Expired, "skipped_oversized", result.Oversized)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RestoreResponse{
+		Restored:         result.Restored,
+		SkippedExpired:   result.Expired,
+		SkippedOversized: result.Oversized,
+	})
+}
+
+// restoreBody returns the snapshot data of a /restore request.
+func restoreBody(r *http.Request) (io.Reader, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.Body, nil
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("no snapshot file in multipart upload")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" {
+			return part, nil
+		}
+	}
+}
+
+// readErrorBody remembers the last error returned while reading a request
+// body, because the snapshot decoder reports read errors as corruption.
+type readErrorBody struct {
+	io.ReadCloser
+	err error
+}
+
+// Read implements io.Reader.
+func (b *readErrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// writeRestoreError maps a /restore failure to an HTTP status. readErr is the
+// error reading the request body, if any; other errors get status.
+func writeRestoreError(w http.ResponseWriter, r *http.Request, err, readErr error, status int) {
+	var maxBytesErr *http.MaxBytesError
+	var corruptErr *cache.SnapshotCorruptionError
+	switch {
+	case errors.As(readErr, &maxBytesErr):
+		writeError(w, r, http.StatusRequestEntityTooLarge, codeSnapshotTooLarge, fmt.Sprintf("Snapshot too large (limit %d bytes)", maxBytesErr.Limit))
+	case errors.As(err, &corruptErr):
+		writeError(w, r, http.StatusBadRequest, codeInvalidSnapshot, fmt.Sprintf("Invalid snapshot: %v", err))
+	case errors.Is(err, cache.ErrRewriteInProgress):
+		writeError(w, r, http.StatusConflict, codeInProgress, "AOF rewrite in progress, try again later")
+	default:
+		writeError(w, r, status, codeInternal, fmt.Sprintf("Failed to restore snapshot: %v", err))
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"mini-redis/internal/cache"
+)
+
+// Routing.
+//
+// The API is versioned by path prefix: the endpoints of version 1 are
+// mounted under /v1/, and the unprefixed paths of earlier releases remain as
+// deprecated aliases of them, answered with Deprecation, Link, and Warning
+// headers pointing at the /v1 path. A future version gets its own route
+// table mounted under its own prefix, with handlers sharing the same cache.
+//
+// Every route lists the methods it accepts, so handlers don't check the
+// method: other methods get 405 with an Allow header from the router. The
+// replication endpoints are a protocol between servers with its own
+// versioning (see internal/cache), so they aren't mounted under /v1, nor
+// compressed (see compress.go).
+
+// apiV1Prefix is the path prefix of version 1 of the API.
+const apiV1Prefix = "/v1"
+
+// route is an endpoint of an API version.
+type route struct {
+	pattern  string  // ServeMux pattern of the path below the version prefix, without a method
+	handlers methods // Handler of each accepted method
+}
+
+// methods maps the methods accepted by a route to their handlers. The GET
+// handler also serves HEAD, unless HEAD has its own.
+type methods map[string]http.HandlerFunc
+
+// methodOrder is the order of the methods in Allow headers.
+var methodOrder = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete}
+
+// v1Routes returns the endpoints of version 1 of the API.
+func v1Routes() []route {
+	return []route{
+		{"/{$}", methods{"GET": healthHandler}},                                                       // Health check endpoint
+		{"/healthz", methods{"GET": livenessHandler}},                                                 // Liveness probe: the process is up
+		{"/readyz", methods{"GET": readinessHandler}},                                                 // Readiness probe: ready for traffic
+		{"/set", methods{"POST": idempotent(requireSlot(requirePrimary(requireLoaded(setHandler))))}}, // Set a key-value pair
+		{"/get", methods{ // Retrieve a value by key (HEAD: whether it exists)
+			"GET":  requireSlot(requireLoaded(getHandler)),
+			"HEAD": requireSlot(requireLoaded(headHandler)),
+		}},
+		{"/del", methods{"POST": idempotent(requireSlot(requirePrimary(requireLoaded(delHandler))))}}, // Delete a key
+		{"/pipeline", methods{"POST": idempotent(requireLoaded(pipelineHandler))}},                    // Run a batch of commands in order
+		{"/keys/{key...}", methods{
+			"GET":    requireSlot(requireLoaded(getKeyHandler)),                                // Raw value of a key
+			"HEAD":   requireSlot(requireLoaded(headKeyHandler)),                               // Whether a key exists
+			"PUT":    idempotent(requireSlot(requirePrimary(requireLoaded(putKeyHandler)))),    // Store the body as the value
+			"DELETE": idempotent(requireSlot(requirePrimary(requireLoaded(deleteKeyHandler)))), // Delete a key
+		}},
+		{"/scan", methods{"GET": requireLoaded(scanHandler)}},                                                 // Iterate over the keys
+		{"/bgrewriteaof", methods{"POST": requirePersistence(requireLoaded(bgRewriteAOFHandler))}},            // Compact the AOF in the background
+		{"/bgsave", methods{"POST": requirePersistence(requireLoaded(bgSaveHandler))}},                        // Create a snapshot in the background
+		{"/bgsave/status", methods{"GET": requirePersistence(bgSaveStatusHandler)}},                           // Status of the current and last snapshot
+		{"/restore", methods{"POST": requireAdmin(requirePrimary(requireLoaded(longLived(restoreHandler))))}}, // Replace the dataset with an uploaded snapshot
+		{"/backup", methods{"GET": requireAdmin(requireLoaded(longLived(backupHandler)))}},                    // Download a snapshot of the dataset
+		{"/info", methods{"GET": infoHandler}},                                                                // Server and persistence information
+		{"/stats", methods{"GET": requireLoaded(statsHandler)}},                                               // Dataset size, memory used, and limits
+		{"/memory/usage", methods{"GET": requireSlot(requireLoaded(memoryUsageHandler))}},                     // Estimated memory used by a key
+		{"/metrics", methods{"GET": metricsHandler}},                                                          // Metrics in the Prometheus text format
+		{"/cluster/slots", methods{"GET": clusterSlotsHandler}},                                               // Owner of every hash slot in cluster mode
+		{"/config", methods{ // Runtime configuration
+			"GET":  getConfigHandler,
+			"POST": requireAdmin(setConfigHandler),
+		}},
+		{"/replicaof", methods{"POST": requireAdmin(requireLoaded(replicaOfHandler))}}, // Promote to primary or follow another primary
+		{"/admin/reload", methods{"POST": requireAdmin(reloadHandler)}},                // Reload the config file
+		{"/acl/whoami", methods{"GET": aclWhoamiHandler}},                              // Operations and keys the client is allowed
+		{"/admin/readonly", methods{ // Read-only mode for maintenance
+			"GET":  requireAdmin(readOnlyHandler),
+			"POST": requireAdmin(setReadOnlyHandler),
+		}},
+		{"/admin/shutdown", methods{"POST": requireAdmin(shutdownHandler)}},    // Shut down gracefully, like SIGTERM
+		{"/admin/loglevel", methods{"POST": requireAdmin(setLogLevelHandler)}}, // Change the log level, for good or for a while
+		{"/clients", methods{"GET": requireAdmin(clientsHandler)}},             // Connected clients
+		{"/clients/kill", methods{"POST": requireAdmin(killClientHandler)}},    // Close the connection of a client
+	}
+}
+
+// newRouter returns the handler serving every endpoint.
+func newRouter() *http.ServeMux {
+	mux := http.NewServeMux()
+	mount(mux, apiV1Prefix, v1Routes(), gzipResponses)
+	alias := deprecatedAlias(apiV1Prefix)
+	mount(mux, "", v1Routes(), func(next http.HandlerFunc) http.HandlerFunc { return gzipResponses(alias(next)) })
+	mount(mux, "", []route{
+		{cache.ReplicationSyncPath, methods{"GET": requireAdmin(requirePersistence(requireLoaded(longLived(replicationSyncHandler))))}}, // Stream writes to a replica
+		{cache.ReplicationAckPath, methods{"POST": requireAdmin(requirePersistence(replicationAckHandler))}},                            // Offset applied by a replica
+		{"/ws", methods{"GET": requireLoaded(longLived(wsHandler))}},                                                                    // WebSocket API
+	}, nil)
+	mux.HandleFunc("/", notFoundHandler)
+	return mux
+}
+
+// mount registers routes on mux under prefix, with the IP filter, rate
+// limit, concurrency limit, and ACL checks of their methods (see
+// ipfilter.go, ratelimit.go, limits.go, and acl.go), wrapping their
+// handlers with wrap if it isn't nil.
+func mount(mux *http.ServeMux, prefix string, routes []route, wrap func(http.HandlerFunc) http.HandlerFunc) {
+	for _, rt := range routes {
+		checked := make(methods, len(rt.handlers))
+		for method, h := range rt.handlers {
+			class := routeClass(method, rt.pattern)
+			checked[method] = requireIPClass(class, requireRate(class, requireRequestSlot(class, requireACL(method, rt.pattern, h))))
+		}
+		handler := checked.handler()
+		if wrap != nil {
+			handler = wrap(handler)
+		}
+		mux.HandleFunc(prefix+rt.pattern, handler)
+	}
+}
+
+// handler returns a handler calling the handler of the request's method, or
+// answering 405 with the accepted methods in the Allow header.
+func (m methods) handler() http.HandlerFunc {
+	var allowed []string
+	for _, method := range methodOrder {
+		if m[method] != nil || method == http.MethodHead && m[http.MethodGet] != nil {
+			allowed = append(allowed, method)
+		}
+	}
+	allow := []string{strings.Join(allowed, ", ")}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		next := m[r.Method]
+		if next == nil && r.Method == http.MethodHead {
+			next = m[http.MethodGet]
+		}
+		if next == nil {
+			w.Header()["Allow"] = allow
+			writeMethodNotAllowed(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// deprecatedAlias returns a wrapper for the handlers of deprecated paths,
+// which points clients at the same path under prefix.
+func deprecatedAlias(prefix string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			successor := prefix + r.URL.EscapedPath()
+			h := w.Header()
+			h["Deprecation"] = deprecationHeader
+			h.Set("Link", "<"+successor+`>; rel="successor-version"`)
+			h.Set("Warning", `299 mini-redis "Deprecated API path, use `+successor+`"`)
+			next(w, r)
+		}
+	}
+}
+
+// notFoundHandler answers 404 to paths without an endpoint.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, codeNotFound, "Not found")
+}
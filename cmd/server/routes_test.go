@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestRoutes checks that the endpoints are served under /v1 and at their
+// deprecated unprefixed paths, and that the router answers 404 to unknown
+// paths and 405 with an Allow header to unsupported methods.
+func TestRoutes(t *testing.T) {
+	srv := newTestServer(t)
+	if err := cacheInstance.Set("foo", "bar", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		status     int
+		code       string // Error code, if any
+		allow      string // Allow header of a 405
+		deprecated bool
+	}{
+		{"v1 get", http.MethodGet, "/v1/get?key=foo", "", http.StatusOK, "", "", false},
+		{"v1 head", http.MethodHead, "/v1/get?key=foo", "", http.StatusOK, "", "", false},
+		{"v1 set", http.MethodPost, "/v1/set", `{"key":"a","value":"b"}`, http.StatusOK, "", "", false},
+		{"v1 health", http.MethodGet, "/v1/", "", http.StatusOK, "", "", false},
+		{"v1 keys put", http.MethodPut, "/v1/keys/a/b", "value", http.StatusNoContent, "", "", false},
+		{"alias get", http.MethodGet, "/get?key=foo", "", http.StatusOK, "", "", true},
+		{"alias set", http.MethodPost, "/set", `{"key":"a","value":"b"}`, http.StatusOK, "", "", true},
+		{"alias health", http.MethodGet, "/", "", http.StatusOK, "", "", true},
+		{"alias error", http.MethodGet, "/get?key=missing", "", http.StatusNotFound, codeKeyNotFound, "", true},
+
+		{"get with POST", http.MethodPost, "/v1/get", "", http.StatusMethodNotAllowed, codeMethodNotAllowed, "GET, HEAD", false},
+		{"set with GET", http.MethodGet, "/v1/set", "", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST", false},
+		{"keys with POST", http.MethodPost, "/v1/keys/a", "", http.StatusMethodNotAllowed, codeMethodNotAllowed, "GET, HEAD, PUT, DELETE", false},
+		{"config with DELETE", http.MethodDelete, "/v1/config", "", http.StatusMethodNotAllowed, codeMethodNotAllowed, "GET, HEAD, POST", false},
+		{"alias with PUT", http.MethodPut, "/del", "", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST", true},
+
+		{"unknown path", http.MethodGet, "/v1/nope", "", http.StatusNotFound, codeNotFound, "", false},
+		{"unknown version", http.MethodGet, "/v2/get?key=foo", "", http.StatusNotFound, codeNotFound, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := doRequest(t, srv, tt.method, tt.path, tt.body, nil)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("%s %s = %d %s, want %d", tt.method, tt.path, resp.StatusCode, body, tt.status)
+			}
+			if tt.code != "" && errorCode(t, body) != tt.code {
+				t.Errorf("code = %s, want %s", errorCode(t, body), tt.code)
+			}
+			if allow := resp.Header.Get("Allow"); allow != tt.allow {
+				t.Errorf("Allow = %q, want %q", allow, tt.allow)
+			}
+
+			h := resp.Header
+			if !tt.deprecated {
+				if h.Get("Deprecation") != "" || h.Get("Link") != "" || h.Get("Warning") != "" {
+					t.Errorf("deprecation headers on a /v1 path: %v", h)
+				}
+				return
+			}
+			successor := "/v1" + resp.Request.URL.EscapedPath()
+			if h.Get("Deprecation") != "true" {
+				t.Errorf("Deprecation = %q, want true", h.Get("Deprecation"))
+			}
+			if want := "<" + successor + `>; rel="successor-version"`; h.Get("Link") != want {
+				t.Errorf("Link = %q, want %q", h.Get("Link"), want)
+			}
+			if want := `299 mini-redis "Deprecated API path, use ` + successor + `"`; h.Get("Warning") != want {
+				t.Errorf("Warning = %q, want %q", h.Get("Warning"), want)
+			}
+		})
+	}
+
+	// The versions share the cache
+	doRequest(t, srv, http.MethodPost, "/set", `{"key":"shared","value":"v"}`, nil)
+	if resp, body := doRequest(t, srv, http.MethodGet, "/v1/keys/shared", "", nil); resp.StatusCode != http.StatusOK || string(body) != "v" {
+		t.Errorf("GET /v1/keys/shared after an unprefixed set = %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Limits of the count query parameter of /scan.
+const (
+	defaultScanCount = 100
+	maxScanCount     = 1000
+)
+
+// ScanResponse is the JSON response of GET /scan.
+type ScanResponse struct {
+	Keys   []string `json:"keys"`   // Keys of the page, by shard and then in byte order
+	Cursor string   `json:"cursor"` // Cursor of the next page (empty: every key was visited)
+}
+
+// scanHandler handles GET requests iterating over the keys, like Redis SCAN.
+// Query parameters: ?prefix=<prefix>&cursor=<cursor>&count=<n>, all
+// optional. The ACL must allow get on prefix*. In cluster mode only the keys
+// of this node are listed.
+func scanHandler(w http.ResponseWriter, r *http.Request) {
+	prefix, cursor := queryValue(r, "prefix"), queryValue(r, "cursor")
+	count := defaultScanCount
+	if v := queryValue(r, "count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxScanCount {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid count: must be an integer between 1 and "+strconv.Itoa(maxScanCount))
+			return
+		}
+		count = n
+	}
+	if err := checkACL(r, "get", prefix+"*"); err != nil {
+		writeError(w, r, err.Status, err.Code, err.Message)
+		return
+	}
+
+	keys, next := cacheInstance.Scan(cursor, prefix, count)
+	if keys == nil {
+		keys = []string{}
+	}
+	writeJSON(w, http.StatusOK, ScanResponse{Keys: keys, Cursor: next})
+}
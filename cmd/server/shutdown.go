@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// httpShutdownTimeout is how long shutdown waits for in-flight requests to finish.
+const httpShutdownTimeout = 10 * time.Second
+
+// defaultShutdownDelay is the default of -shutdown-delay.
+const defaultShutdownDelay = time.Second
+
+// Remote shutdown.
+//
+// Orchestrators can't always deliver signals, so with -shutdown-endpoint
+// (server.shutdown_endpoint in a config file), POST /admin/shutdown shuts
+// the server down like SIGTERM. The request is logged with its principal
+// before anything else happens, then answered 202, and the shutdown starts
+// -shutdown-delay later, so the response reaches the client before the
+// listener closes. Without the flag, the endpoint answers 403 to admins too.
+var (
+	shutdownEndpoint   bool                   // -shutdown-endpoint
+	shutdownDelay      = defaultShutdownDelay // -shutdown-delay
+	shutdownDrainDelay time.Duration          // -shutdown-drain-delay (see health.go)
+
+	shutdownRequested atomic.Bool           // POST /admin/shutdown was accepted
+	shutdownRequests  = make(chan struct{}) // Closed when the remote shutdown starts
+)
+
+// ShutdownResponse represents the JSON response of POST /admin/shutdown.
+type ShutdownResponse struct {
+	Delay string `json:"delay"` // Time until the shutdown starts, e.g. "1s"
+}
+
+// shutdownHandler handles POST requests shutting the server down, see
+// above.
+func shutdownHandler(w http.ResponseWriter, r *http.Request) {
+	if !shutdownEndpoint {
+		writeError(w, r, http.StatusForbidden, codeShutdownDisabled, "Remote shutdown is disabled (start the server with -shutdown-endpoint to enable it)")
+		return
+	}
+	if !shutdownRequested.CompareAndSwap(false, true) {
+		writeError(w, r, http.StatusConflict, codeInProgress, "Shutdown already in progress")
+		return
+	}
+
+	slog.Warn("Shutdown requested", "principal", requestPrincipal(r), "remote", r.RemoteAddr, "delay", shutdownDelay)
+	time.AfterFunc(shutdownDelay, func() { close(shutdownRequests) })
+	writeJSON(w, http.StatusAccepted, ShutdownResponse{Delay: shutdownDelay.String()})
+}
+
+// shutdown stops the server gracefully on SIGINT/SIGTERM or POST
+// /admin/shutdown:
+//  0. Fail the readiness probe, and keep serving for -shutdown-drain-delay
+//     so load balancers stop sending traffic first
+//  1. Stop accepting connections, HTTP, gRPC, and RESP, and wait for in-flight
+//     requests, so no write is acknowledged after this point
+//  2. Stop replicating from the primary, if this is a replica
+//  3. Stop the background snapshot and AOF rewrite managers
+//  4. Save a final snapshot, so nothing since the last periodic snapshot is lost
+//  5. Close the AOF
+//
+// Steps 3-4 are skipped without persistence.
+//
+// If the final snapshot takes longer than snapshotTimeout, shutdown proceeds
+// without it; the AOF still holds every acknowledged write.
+func shutdown(server *http.Server, snapshotTimeout time.Duration) {
+	slog.Info("Shutting down gracefully")
+	shuttingDown.Store(true)
+	if shutdownDrainDelay > 0 {
+		slog.Info("Draining traffic before closing connections", "delay", shutdownDrainDelay)
+		time.Sleep(shutdownDrainDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	var listeners sync.WaitGroup
+	if grpcServer != nil {
+		listeners.Go(func() { shutdownGRPC(ctx) })
+	}
+	if respAPI != nil {
+		listeners.Go(func() { respAPI.Shutdown(ctx) })
+	}
+	closeWebSockets()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Error shutting down HTTP server", "err", err)
+	}
+	listeners.Wait()
+	waitWebSockets(ctx)
+
+	if replica := currentReplica(); replica != nil {
+		replica.Stop()
+	}
+
+	if snapshotManager != nil {
+		snapshotManager.Stop()
+		aofRewriteManager.Stop()
+		// At startup the AOF, which has a preamble while turned off, wins over
+		// the final snapshot: turn it on so writes made since aren't lost
+		if !cacheInstance.AOFEnabled() {
+			if err := cacheInstance.SetAOFEnabled(true); err != nil {
+				slog.Error("Error turning the AOF back on", "err", err)
+			}
+		}
+		saveFinalSnapshot(snapshotTimeout)
+	}
+
+	if err := cacheInstance.Close(); err != nil {
+		slog.Error("Error closing cache", "err", err)
+	}
+}
+
+// saveFinalSnapshot saves the shutdown snapshot, giving up after timeout.
+// It waits for a running manual or scheduled snapshot first.
+func saveFinalSnapshot(timeout time.Duration) {
+	done := make(chan error, 1)
+	go func() {
+		done <- snapshotManager.Save("shutdown")
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			slog.Error("Error saving final snapshot", "err", err)
+		}
+	case <-time.After(timeout):
+		slog.Warn("Final snapshot did not finish in time, shutting down without it", "timeout", timeout)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// StatsResponse is the JSON response of GET /stats.
+type StatsResponse struct {
+	Keys           int    `json:"keys"`            // Keys in the cache, including expired keys not removed yet
+	MaxKeys        int    `json:"max_keys"`        // Key limit (0 = unlimited)
+	UsedMemory     int64  `json:"used_memory"`     // Estimated memory used by the dataset in bytes
+	MaxMemory      int64  `json:"max_memory"`      // Memory limit in bytes (0 = unlimited)
+	EvictionPolicy string `json:"eviction_policy"` // Eviction policy applied at the limits
+	Shards         int    `json:"shards"`          // Partitions of the dataset
+	ExpiredLazy    int64  `json:"expired_lazy"`    // Expired keys removed when accessed
+	ExpiredActive  int64  `json:"expired_active"`  // Expired keys removed by the periodic cleanup
+	Evicted        int64  `json:"evicted"`         // Keys evicted by the eviction policy
+	Deleted        int64  `json:"deleted"`         // Keys deleted by clients
+
+	LastExpireCycle        ExpireCycleResponse `json:"last_expire_cycle"`        // Last periodic cleanup
+	CleanupCyclesTruncated int64               `json:"cleanup_cycles_truncated"` // Cleanups that ran out of time with keys still due
+	Concurrency            ConcurrencyStats    `json:"concurrency"`              // Connections, requests, and streams versus their limits
+	Idempotency            IdempotencyStats    `json:"idempotency"`              // Responses remembered for Idempotency-Key
+	Protocols              ProtocolStats       `json:"protocols"`                // Connections and requests by HTTP version
+}
+
+// IdempotencyStats describes the responses remembered for idempotency keys
+// in StatsResponse. Their keys and memory are included in Keys and
+// UsedMemory.
+type IdempotencyStats struct {
+	Keys     int   `json:"keys"`     // Responses remembered
+	Memory   int64 `json:"memory"`   // Estimated memory they use in bytes
+	Replayed int64 `json:"replayed"` // Responses replayed since startup
+	Window   int64 `json:"window"`   // Seconds a response is remembered (-idempotency-window, 0 = disabled)
+}
+
+// ExpireCycleResponse describes a periodic cleanup cycle in StatsResponse.
+type ExpireCycleResponse struct {
+	Expired   int   `json:"expired"`    // Expired keys removed
+	ElapsedUs int64 `json:"elapsed_us"` // Time spent in microseconds
+	Truncated bool  `json:"truncated"`  // Ran out of time with keys still due
+}
+
+// statsHandler handles GET requests for the size of the dataset, its limits,
+// and the number of keys removed since startup by reason.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := cacheInstance.Stats()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StatsResponse{
+		Keys:           stats.Keys,
+		MaxKeys:        stats.MaxKeys,
+		UsedMemory:     stats.UsedMemory,
+		MaxMemory:      stats.MaxMemory,
+		EvictionPolicy: stats.EvictionPolicy.String(),
+		Shards:         stats.Shards,
+		ExpiredLazy:    stats.ExpiredLazy,
+		ExpiredActive:  stats.ExpiredActive,
+		Evicted:        stats.Evicted,
+		Deleted:        stats.Deleted,
+		LastExpireCycle: ExpireCycleResponse{
+			Expired:   stats.LastExpireCycle.Expired,
+			ElapsedUs: stats.LastExpireCycle.Elapsed.Microseconds(),
+			Truncated: stats.LastExpireCycle.Truncated,
+		},
+		CleanupCyclesTruncated: stats.CleanupCyclesTruncated,
+		Concurrency:            concurrencyStats(),
+		Idempotency: IdempotencyStats{
+			Keys:     stats.InternalKeys,
+			Memory:   stats.InternalMemory,
+			Replayed: idempotencyReplayed.Load(),
+			Window:   int64(idempotencyWindow.Seconds()),
+		},
+		Protocols: protocolStats(),
+	})
+}
+
+// writeCacheMetrics writes the metrics of the dataset: its size, memory, and
+// removed keys. Nothing is written while the dataset is loading.
+func writeCacheMetrics(m *metricsWriter) {
+	if cacheInstance.Loading() {
+		return
+	}
+	stats := cacheInstance.Stats()
+	m.metric("miniredis_keys", "gauge",
+		"Keys in the cache, including expired keys not removed yet.", float64(stats.Keys))
+	m.metric("miniredis_used_memory_bytes", "gauge",
+		"Estimated memory used by the dataset.", float64(stats.UsedMemory))
+	m.metric("miniredis_max_memory_bytes", "gauge",
+		"Memory limit of the dataset (0: unlimited).", float64(stats.MaxMemory))
+	m.family("miniredis_expired_keys_total", "counter", "Expired keys removed, by how they were found.")
+	m.sample("miniredis_expired_keys_total", float64(stats.ExpiredLazy), "mode", "lazy")
+	m.sample("miniredis_expired_keys_total", float64(stats.ExpiredActive), "mode", "active")
+	m.family("miniredis_evicted_keys_total", "counter", "Keys evicted at the key or memory limit.")
+	m.sample("miniredis_evicted_keys_total", float64(stats.Evicted), "policy", stats.EvictionPolicy.String())
+	m.metric("miniredis_deleted_keys_total", "counter",
+		"Keys deleted by clients.", float64(stats.Deleted))
+	m.metric("miniredis_cleanup_cycles_truncated_total", "counter",
+		"Expiration cycles that ran out of time with keys still due.", float64(stats.CleanupCyclesTruncated))
+}
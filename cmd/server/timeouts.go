@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// Connection timeouts.
+//
+// The server disconnects clients that are too slow, so a slow-loris client
+// can't hold connections open and a stalled response doesn't block a
+// goroutine forever: sending the request headers must take less than
+// -read-header-timeout, the whole request less than -read-timeout, and the
+// response less than -write-timeout, and a keep-alive connection is closed
+// after -idle-timeout without a request. Headers are limited to
+// -max-header-bytes.
+//
+// Endpoints transferring more data than fits in these timeouts (the
+// replication stream, /backup, /restore) opt out with longLived: they get a
+// deadline per read and write instead, so they can take as long as they
+// keep making progress, but a stalled client is still disconnected.
+
+// Defaults of the timeout flags.
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = time.Minute
+	defaultWriteTimeout      = time.Minute
+	defaultIdleTimeout       = 2 * time.Minute
+)
+
+// Connection limits (0 = no timeout).
+var (
+	readHeaderTimeout = defaultReadHeaderTimeout   // -read-header-timeout
+	readTimeout       = defaultReadTimeout         // -read-timeout
+	writeTimeout      = defaultWriteTimeout        // -write-timeout
+	idleTimeout       = defaultIdleTimeout         // -idle-timeout
+	maxHeaderBytes    = http.DefaultMaxHeaderBytes // -max-header-bytes
+)
+
+// newServer returns the HTTP server serving handler on addr, with the
+// connection timeouts and limits and the protocols of protocols.go.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+		Protocols:         serverProtocols(),
+	}
+}
+
+// longLived wraps the handler of a long transfer: the request deadlines of
+// the server are replaced with deadlines per read (-read-timeout) and per
+// write (-write-timeout), see above. It runs within -max-streams rather
+// than -max-requests, see limits.go.
+func longLived(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !acquireStreamSlot(r) {
+			writeBusy(w, r, "Too many long transfers in progress, retry later")
+			return
+		}
+		defer releaseStreamSlot()
+		if cc := requestClient(r); cc != nil {
+			cc.streams.Add(1)
+			defer cc.streams.Add(-1)
+		}
+
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &deadlineReader{ReadCloser: r.Body, rc: rc}
+		}
+		next(&deadlineWriter{ResponseWriter: w, rc: rc}, r)
+	}
+}
+
+// deadlineReader extends the read deadline of the connection before every
+// read of a request body, and removes it once the body was read.
+type deadlineReader struct {
+	io.ReadCloser
+	rc *http.ResponseController
+}
+
+// Read reads from the body, within -read-timeout.
+func (b *deadlineReader) Read(p []byte) (int, error) {
+	if readTimeout > 0 {
+		b.rc.SetReadDeadline(time.Now().Add(readTimeout))
+	}
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		// The server keeps reading to notice a disconnect, which must not
+		// time out while the handler processes the body
+		b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// deadlineWriter extends the write deadline of the connection before every
+// write of a response.
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// extend moves the write deadline -write-timeout ahead.
+func (w *deadlineWriter) extend() {
+	if writeTimeout > 0 {
+		w.rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+}
+
+// Write writes to the response, within -write-timeout.
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.extend()
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush sends the response written so far, within -write-timeout.
+func (w *deadlineWriter) Flush() {
+	w.extend()
+	w.rc.Flush()
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (w *deadlineWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTimeouts sets the connection timeouts until the test ends.
+func useTimeouts(t *testing.T, header, read, write, idle time.Duration) {
+	t.Helper()
+	prev := [4]time.Duration{readHeaderTimeout, readTimeout, writeTimeout, idleTimeout}
+	readHeaderTimeout, readTimeout, writeTimeout, idleTimeout = header, read, write, idle
+	t.Cleanup(func() {
+		readHeaderTimeout, readTimeout, writeTimeout, idleTimeout = prev[0], prev[1], prev[2], prev[3]
+	})
+}
+
+// newTimeoutServer serves handler with the server of newServer.
+func newTimeoutServer(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config = newServer("", handler)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// slowClient connects to srv and sends the lines of a request one at a
+// time, pausing between them. It returns the connection and the response,
+// or an error if the server closed the connection first.
+func slowClient(t *testing.T, srv *httptest.Server, pause time.Duration, lines ...string) (net.Conn, *http.Response, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	for i, line := range lines {
+		if i > 0 {
+			time.Sleep(pause)
+		}
+		if _, err := io.WriteString(conn, line); err != nil {
+			return conn, nil, err
+		}
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	return conn, resp, err
+}
+
+// closedByServer reports whether the server closed conn, reading what it
+// sent until then, and waiting for it at most a few seconds.
+func closedByServer(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.Copy(io.Discard, conn)
+	var ne net.Error
+	return !errors.As(err, &ne) || !ne.Timeout()
+}
+
+// TestServerTimeouts checks that slow clients are disconnected: headers
+// sent too slowly, a body sent too slowly, and an idle keep-alive
+// connection, and that oversized headers are rejected.
+func TestServerTimeouts(t *testing.T) {
+	useTimeouts(t, 200*time.Millisecond, 500*time.Millisecond, 5*time.Second, 300*time.Millisecond)
+	srv := newTimeoutServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+
+	t.Run("slow headers", func(t *testing.T) {
+		conn, resp, err := slowClient(t, srv, 100*time.Millisecond,
+			"GET / HTTP/1.1\r\n", "Host: test\r\n", "X-A: a\r\n", "X-B: b\r\n", "X-C: c\r\n", "\r\n")
+		if err == nil && resp.StatusCode == http.StatusOK {
+			t.Fatal("request with slow headers was served")
+		}
+		if !closedByServer(conn) {
+			t.Error("connection still open")
+		}
+	})
+
+	t.Run("slow body", func(t *testing.T) {
+		conn, resp, err := slowClient(t, srv, 200*time.Millisecond,
+			"POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\n\r\n", "a", "b", "c", "d", "e")
+		if err == nil && resp.StatusCode == http.StatusOK {
+			t.Fatal("request with a slow body was served")
+		}
+		if !closedByServer(conn) {
+			t.Error("connection still open")
+		}
+	})
+
+	t.Run("idle connection", func(t *testing.T) {
+		conn, resp, err := slowClient(t, srv, 0, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("request = %v, %v", resp, err)
+		}
+		start := time.Now()
+		if !closedByServer(conn) {
+			t.Fatal("idle connection still open")
+		}
+		if d := time.Since(start); d < 200*time.Millisecond {
+			t.Errorf("idle connection closed after %v, before the idle timeout", d)
+		}
+	})
+
+	t.Run("large headers", func(t *testing.T) {
+		prev := maxHeaderBytes
+		maxHeaderBytes = 1024
+		defer func() { maxHeaderBytes = prev }()
+		srv := newTimeoutServer(t, http.NotFoundHandler())
+		_, resp, err := slowClient(t, srv, 0, "GET / HTTP/1.1\r\nHost: test\r\nX-Big: "+strings.Repeat("x", 8192)+"\r\n\r\n")
+		if err != nil || resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+			t.Errorf("request with large headers = %v, %v, want 431", resp, err)
+		}
+	})
+}
+
+// TestLongLivedTimeouts checks that a long-lived handler can take longer
+// than the request timeouts while the client keeps sending, but that a
+// client stalling for longer than -read-timeout is still disconnected.
+func TestLongLivedTimeouts(t *testing.T) {
+	useTimeouts(t, time.Second, 300*time.Millisecond, 300*time.Millisecond, time.Second)
+	srv := newTimeoutServer(t, longLived(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// A response written slowly, in all longer than -write-timeout
+		for range 4 {
+			time.Sleep(100 * time.Millisecond)
+			w.Write(body)
+			w.(http.Flusher).Flush()
+		}
+	}))
+
+	// 8 chunks 100ms apart: 800ms, longer than -read-timeout
+	chunks := []string{"POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 8\r\n\r\n"}
+	for range 8 {
+		chunks = append(chunks, "x")
+	}
+	_, resp, err := slowClient(t, srv, 100*time.Millisecond, chunks...)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("long transfer = %v, %v, want 200", resp, err)
+	}
+
+	conn, resp, err := slowClient(t, srv, 600*time.Millisecond,
+		"POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 2\r\n\r\n", "x", "y")
+	if err == nil && resp.StatusCode == http.StatusOK {
+		t.Fatal("long transfer of a stalled client was served")
+	}
+	if !closedByServer(conn) {
+		t.Error("connection of a stalled client still open")
+	}
+}
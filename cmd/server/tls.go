@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// TLS.
+//
+// With -tls-cert and -tls-key, the server only accepts HTTPS: TLS 1.2 or
+// later, with forward-secret AEAD cipher suites. The certificate is read
+// again on SIGHUP and swapped atomically, so it can be rotated without a
+// restart; handshakes in progress keep the certificate they started with,
+// and if the new files are invalid, the old certificate stays in use.
+// -tls-self-signed generates a certificate for localhost at startup instead,
+// for development: clients must skip verification or pin its fingerprint,
+// which is logged.
+//
+// -health-addr serves the health check over plain HTTP on a second,
+// loopback-only listener, for probes that can't speak TLS.
+
+// Settings of the TLS flags.
+var (
+	tlsCertFile   string // -tls-cert
+	tlsKeyFile    string // -tls-key
+	tlsSelfSigned bool   // -tls-self-signed
+	healthAddr    string // -health-addr ("" = none)
+)
+
+// serverCert is the certificate loaded from -tls-cert and -tls-key (nil
+// without them).
+var serverCert *certReloader
+
+// tlsCipherSuites are the TLS 1.2 cipher suites accepted: ECDHE key exchange
+// and AEAD ciphers only. TLS 1.3 suites aren't configurable; all qualify.
+var tlsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// tlsEnabled reports whether TLS is configured.
+func tlsEnabled() bool {
+	return tlsCertFile != "" || tlsKeyFile != "" || tlsSelfSigned || tlsClientCA != ""
+}
+
+// newTLSConfig returns the TLS configuration of the server, loading or
+// generating its certificate.
+func newTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CipherSuites:     tlsCipherSuites,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+	}
+
+	switch {
+	case tlsSelfSigned && (tlsCertFile != "" || tlsKeyFile != ""):
+		return nil, errors.New("-tls-self-signed can't be combined with -tls-cert and -tls-key")
+	case tlsSelfSigned:
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate a self-signed certificate: %w", err)
+		}
+		sum := sha256.Sum256(cert.Certificate[0])
+		slog.Warn("Using a self-signed TLS certificate, for development only", "sha256", hex.EncodeToString(sum[:]))
+		config.Certificates = []tls.Certificate{cert}
+	case tlsCertFile == "" || tlsKeyFile == "":
+		return nil, errors.New("HTTPS requires -tls-cert and -tls-key, or -tls-self-signed")
+	default:
+		r := &certReloader{certFile: tlsCertFile, keyFile: tlsKeyFile}
+		if err := r.reload(); err != nil {
+			return nil, err
+		}
+		serverCert = r
+		config.GetCertificate = r.getCertificate
+	}
+	if err := configureClientAuth(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// certReloader serves a certificate read from files, which reload reads
+// again.
+type certReloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+// reload reads the certificate files and swaps in the certificate, or keeps
+// the current one if they are invalid.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	r.cert.Store(&cert)
+	if leaf := cert.Leaf; leaf != nil {
+		slog.Info("TLS certificate loaded", "file", r.certFile, "subject", leaf.Subject.String(), "expires", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// reloadCertificate reads the certificate files again on SIGHUP.
+func reloadCertificate() {
+	if serverCert == nil {
+		return
+	}
+	if err := serverCert.reload(); err != nil {
+		slog.Error("TLS certificate reload failed, keeping the current certificate", "err", err)
+	}
+}
+
+// selfSignedCertificate generates a certificate for localhost, 127.0.0.1,
+// ::1, and the host name, valid for a year.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	names := []string{"localhost"}
+	if host, err := os.Hostname(); err == nil && host != "localhost" {
+		names = append(names, host)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "mini-redis self-signed"},
+		DNSNames:     names,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    now.Add(-time.Hour), // Tolerate clock skew
+		NotAfter:     now.AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// checkLoopbackAddr returns an error unless addr listens on a loopback
+// address only.
+func checkLoopbackAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%s is not a loopback address (use e.g. 127.0.0.1:8081)", addr)
+	}
+	return nil
+}
+
+// newHealthServer returns the plain HTTP server of -health-addr, which only
+// serves the health checks.
+func newHealthServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	for _, prefix := range []string{"", apiV1Prefix} {
+		mux.HandleFunc("GET "+prefix+"/{$}", healthHandler)
+		mux.HandleFunc("GET "+prefix+"/healthz", livenessHandler)
+		mux.HandleFunc("GET "+prefix+"/readyz", readinessHandler)
+	}
+	mux.HandleFunc("/", notFoundHandler)
+	return newServer(addr, mux)
+}
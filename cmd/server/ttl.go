@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// maxTTL is the longest TTL accepted in requests, set by -max-ttl
+// (0: only limited by cache.MaxExpiry, the latest expiration time that can
+// be persisted, in 2262).
+var maxTTL time.Duration
+
+// TTL is the ttl field of requests: either a number of seconds (60) or a Go
+// duration string ("90s", "2h30m").
+type TTL time.Duration
+
+// TTLError describes a ttl field that isn't a valid TTL.
+type TTLError struct {
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *TTLError) Error() string {
+	return e.Reason
+}
+
+// UnmarshalJSON parses a number of seconds or a duration string.
+func (t *TTL) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return &TTLError{Reason: fmt.Sprintf(`Invalid TTL %q (must be a number of seconds or a duration such as "90s" or "2h30m")`, s)}
+		}
+		*t = TTL(d)
+		return nil
+	}
+
+	var seconds int64
+	if err := json.Unmarshal(data, &seconds); err != nil {
+		return &TTLError{Reason: fmt.Sprintf(`Invalid TTL %s (must be a whole number of seconds or a duration such as "90s" or "2h30m")`, data)}
+	}
+	ttl, err := ttlFromSeconds(seconds)
+	if err != nil {
+		return err
+	}
+	*t = ttl
+	return nil
+}
+
+// parseTTL parses a TTL given as text, e.g. in a header or a query
+// parameter: a whole number of seconds ("60") or a duration string ("90s").
+func parseTTL(s string) (TTL, error) {
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ttlFromSeconds(seconds)
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, &TTLError{Reason: fmt.Sprintf(`Invalid TTL %q (must be a whole number of seconds or a duration such as "90s" or "2h30m")`, s)}
+	}
+	return TTL(d), nil
+}
+
+// ttlFromSeconds converts a number of seconds to a TTL, rejecting numbers
+// a time.Duration can't hold.
+func ttlFromSeconds(seconds int64) (TTL, error) {
+	if seconds > math.MaxInt64/int64(time.Second) || seconds < math.MinInt64/int64(time.Second) {
+		return 0, &TTLError{Reason: fmt.Sprintf("Invalid TTL %d seconds (too large)", seconds)}
+	}
+	return TTL(time.Duration(seconds) * time.Second), nil
+}
+
+// validate checks that the TTL isn't negative, doesn't exceed maxTTL, and
+// doesn't end after cache.MaxExpiry, which can't be persisted.
+func (t TTL) validate() error {
+	d := time.Duration(t)
+	if d < 0 {
+		return &TTLError{Reason: "Invalid TTL (must not be negative)"}
+	}
+	if maxTTL > 0 && d > maxTTL {
+		return &TTLError{Reason: fmt.Sprintf("Invalid TTL %v (must be at most %v, see -max-ttl)", d, maxTTL)}
+	}
+	if time.Now().Add(d).After(cache.MaxExpiry) {
+		return &TTLError{Reason: fmt.Sprintf("Invalid TTL %v (must end by %d, the latest expiration time that can be stored)", d, cache.MaxExpiry.Year())}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// TestTTLUnmarshalJSON checks the accepted forms of the ttl field and the
+// errors for others.
+func TestTTLUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		json string
+		want time.Duration
+		ok   bool
+	}{
+		{`60`, time.Minute, true},
+		{`0`, 0, true},
+		{`"90s"`, 90 * time.Second, true},
+		{`"2h30m"`, 150 * time.Minute, true},
+		{`"5 minutes"`, 0, false},
+		{`1.5`, 0, false},
+		{`true`, 0, false},
+		{`99999999999999999`, 0, false}, // Doesn't fit a time.Duration
+	}
+	for _, tt := range tests {
+		var ttl TTL
+		err := json.Unmarshal([]byte(tt.json), &ttl)
+		var ttlErr *TTLError
+		if tt.ok && (err != nil || time.Duration(ttl) != tt.want) {
+			t.Errorf("%s = %v, %v; want %v", tt.json, time.Duration(ttl), err, tt.want)
+		}
+		if !tt.ok && !errors.As(err, &ttlErr) {
+			t.Errorf("%s error = %v, want a *TTLError", tt.json, err)
+		}
+	}
+}
+
+// TestSetTTLAfterMaxExpiry checks that a TTL ending after the latest
+// expiration time that can be persisted is rejected with 400 instead of
+// being stored and lost on restart.
+func TestSetTTLAfterMaxExpiry(t *testing.T) {
+	srv := newTestServer(t)
+	for _, ttl := range []string{`8000000000`, `"2400000h"`} {
+		resp, body := doRequest(t, srv, http.MethodPost, "/v1/set", `{"key":"t253y","value":"v","ttl":`+ttl+`}`, nil)
+		if resp.StatusCode != http.StatusBadRequest || errorCode(t, body) != codeInvalidTTL {
+			t.Errorf("set with ttl %s = %d %s, want 400 %s", ttl, resp.StatusCode, body, codeInvalidTTL)
+		}
+	}
+	if _, ok := cacheInstance.Get("t253y"); ok {
+		t.Error("key with an out-of-range TTL was stored")
+	}
+
+	resp, body := doRequest(t, srv, http.MethodPost, "/v1/set", `{"key":"t100y","value":"v","ttl":"876000h"}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("set with a 100-year TTL = %d %s, want 200", resp.StatusCode, body)
+	}
+}
+
+// TestKeyHeaders checks X-TTL-Remaining, Last-Modified, and ETag across
+// TTL updates and writes, on /get and /keys/{key}: a TTL change only
+// changes X-TTL-Remaining, and a write changes all three.
+func TestKeyHeaders(t *testing.T) {
+	// The clock of the cache runs ahead by skew, for writes at a later time
+	var skew atomic.Int64
+	c, err := cache.NewCache("", "", 0, cache.WithClock(func() time.Time {
+		return time.Now().Add(time.Duration(skew.Load()))
+	}))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	srv := newTestServerWithCache(t, c)
+
+	type headers struct{ ttl, modified, etag string }
+	get := func(when string) headers {
+		t.Helper()
+		var got headers
+		for _, path := range []string{"/v1/get?key=k", "/v1/keys/k"} {
+			resp, body := doRequest(t, srv, http.MethodGet, path, "", nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s: GET %s = %d %s", when, path, resp.StatusCode, body)
+			}
+			h := headers{resp.Header.Get(ttlRemainingHeader), resp.Header.Get("Last-Modified"), resp.Header.Get("Etag")}
+			if got != (headers{}) && h != got {
+				t.Errorf("%s: headers of %s %+v differ from /get %+v", when, path, h, got)
+			}
+			got = h
+		}
+		stat, _ := c.Stat("k", false)
+		if got.modified != stat.ModifiedAt.UTC().Format(http.TimeFormat) {
+			t.Errorf("%s: Last-Modified %s, stored %v", when, got.modified, stat.ModifiedAt)
+		}
+		return got
+	}
+	set := func(body string) {
+		t.Helper()
+		if resp, data := doRequest(t, srv, http.MethodPost, "/v1/set", body, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("set %s = %d %s", body, resp.StatusCode, data)
+		}
+	}
+
+	set(`{"key":"k","value":"v","ttl":100}`)
+	first := get("after set with a TTL")
+	if first.ttl != "100" || first.etag == "" {
+		t.Errorf("after set with a TTL: %+v, want X-TTL-Remaining 100", first)
+	}
+
+	// TTL updates keep Last-Modified and the ETag
+	if _, err := c.Expire("k", 50*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("after Expire"); got != (headers{"50", first.modified, first.etag}) {
+		t.Errorf("after Expire: %+v, want X-TTL-Remaining 50 and the rest unchanged from %+v", got, first)
+	}
+	if _, err := c.Expire("k", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("after removing the TTL"); got != (headers{"-1", first.modified, first.etag}) {
+		t.Errorf("after removing the TTL: %+v, want X-TTL-Remaining -1 and the rest unchanged from %+v", got, first)
+	}
+
+	// A later write with a new TTL changes all three
+	skew.Store(int64(time.Hour))
+	set(`{"key":"k","value":"v","ttl":"2h"}`)
+	second := get("after a second set")
+	if second.ttl != "10800" || second.etag == first.etag {
+		t.Errorf("after a second set: %+v, want X-TTL-Remaining 10800 (2h ahead of the clock) and a new ETag", second)
+	}
+	before, _ := http.ParseTime(first.modified)
+	after, _ := http.ParseTime(second.modified)
+	if d := after.Sub(before); d < time.Hour || d > time.Hour+time.Minute {
+		t.Errorf("Last-Modified moved by %v, want an hour", d)
+	}
+
+	// A write without a TTL removes it
+	set(`{"key":"k","value":"v"}`)
+	if got := get("after a set without a TTL"); got.ttl != "-1" || got.etag == second.etag {
+		t.Errorf("after a set without a TTL: %+v, want X-TTL-Remaining -1 and a new ETag", got)
+	}
+}
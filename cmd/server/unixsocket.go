@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Unix domain socket.
+//
+// With -unix-socket, the API is also served on a unix socket, for clients
+// on the same host, e.g. sidecars, that would rather skip TCP. It is the
+// same server as the TCP listener: the same endpoints, authentication, and
+// limits, and the graceful shutdown closes both. The socket serves plain
+// HTTP even with TLS, since its traffic never leaves the host; access is
+// controlled by the permissions of the socket file (-unix-socket-perm).
+// Clients of the socket count as loopback (127.0.0.1) for the IP filter
+// and the rate limits.
+//
+// A socket file left by a server that crashed is removed at startup, after
+// checking that no server answers on it; a socket with a live server, or a
+// file that isn't a socket, stops the startup instead. The listener removes
+// the file when it is closed on shutdown.
+
+// defaultUnixSocketPerm is the default of -unix-socket-perm.
+const defaultUnixSocketPerm = "0660"
+
+// unixRemoteAddr is the RemoteAddr of the requests over the unix socket.
+const unixRemoteAddr = "unix"
+
+var (
+	unixSocket     string                  // -unix-socket ("" = none)
+	unixSocketPerm = defaultUnixSocketPerm // -unix-socket-perm (octal)
+)
+
+// parseSocketPerm parses the octal permissions of -unix-socket-perm.
+func parseSocketPerm(s string) (fs.FileMode, error) {
+	perm, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || perm > 0o777 {
+		return 0, fmt.Errorf("invalid permissions %q (must be octal, e.g. 0660)", s)
+	}
+	return fs.FileMode(perm), nil
+}
+
+// listenUnix listens on the unix socket at path with permissions perm,
+// removing a stale socket file first (see above).
+func listenUnix(path string, perm fs.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return unixListener{l}, nil
+}
+
+// removeStaleSocket removes the socket file at path if no server answers on
+// it. A missing file is fine.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another server", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("checking %s: %w", path, err)
+	}
+	return os.Remove(path)
+}
+
+// unixListener marks the connections of the unix socket, see unixConn.
+type unixListener struct {
+	net.Listener
+}
+
+// Accept accepts a connection of the unix socket.
+func (l unixListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return unixConn{c}, nil
+}
+
+// unixConn is a connection of the unix socket, whose RemoteAddr is
+// unixRemoteAddr: peers of a unix socket have no address of their own.
+type unixConn struct {
+	net.Conn
+}
+
+// RemoteAddr returns unixRemoteAddr.
+func (c unixConn) RemoteAddr() net.Addr {
+	return &net.UnixAddr{Name: unixRemoteAddr, Net: "unix"}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket protocol (RFC 6455), server side.
+//
+// Only what /ws needs is implemented: the opening handshake over HTTP/1.1,
+// text and binary messages, possibly fragmented, pings and pongs, and the
+// closing handshake. Extensions such as permessage-deflate and subprotocols
+// aren't negotiated, so browsers don't use them.
+
+// wsGUID is appended to Sec-WebSocket-Key to compute Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes of frames.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// Status codes of close frames.
+const (
+	wsCloseNormal        = 1000
+	wsCloseGoingAway     = 1001 // Server shutting down
+	wsCloseProtocolError = 1002
+	wsCloseTooBig        = 1009
+)
+
+// wsCloseError is the error of a connection closed with a status code,
+// by the client or because it broke the protocol.
+type wsCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// wsConn is an upgraded connection. Messages are read by one goroutine;
+// frames may be written by several, each written whole.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	wmu       sync.Mutex // Serializes frames
+	closeSent bool       // Whether a close frame was sent
+}
+
+// errWSClosing is returned by writes after a close frame.
+var errWSClosing = errors.New("websocket connection closing")
+
+// wsCloseTimeout is how long the client has to answer a close frame.
+const wsCloseTimeout = 2 * time.Second
+
+// upgradeWebSocket answers the opening handshake of r and takes over its
+// connection. If r isn't a valid handshake, it answers with an error and
+// returns nil.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) *wsConn {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case r.ProtoMajor != 1:
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "WebSocket connections need HTTP/1.1")
+		return nil
+	case !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket"):
+		w.Header().Set("Upgrade", "websocket")
+		writeError(w, r, http.StatusUpgradeRequired, codeInvalidRequest, "Not a WebSocket handshake (Connection: Upgrade and Upgrade: websocket)")
+		return nil
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, r, http.StatusUpgradeRequired, codeInvalidRequest, "Unsupported WebSocket version (must be 13)")
+		return nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid Sec-WebSocket-Key")
+		return nil
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to take over the connection")
+		return nil
+	}
+	conn.SetDeadline(time.Time{}) // The deadlines of the server don't apply anymore
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: ")
+	rw.WriteString(base64.StdEncoding.EncodeToString(sum[:]))
+	rw.WriteString("\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil
+	}
+	return &wsConn{conn: conn, br: rw.Reader}
+}
+
+// headerHasToken reports whether a comma-separated header of h has token,
+// ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readMessage returns the next text or binary message, up to limit bytes.
+// Pings are answered with pongs, and pongs ignored, within timeout: every
+// frame must arrive within it, so a client that neither sends nor answers
+// pings times out. A close frame from the client is answered and returned as
+// a *wsCloseError.
+func (c *wsConn) readMessage(limit int64, timeout time.Duration) ([]byte, error) {
+	var msg []byte
+	fragmented := false
+	for {
+		c.wmu.Lock()
+		if !c.closeSent { // Otherwise the client has wsCloseTimeout to answer
+			c.conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		c.wmu.Unlock()
+		fin, opcode, payload, err := c.readFrame(limit - int64(len(msg)))
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil && err != errWSClosing {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			e := &wsCloseError{Code: wsCloseNormal}
+			if len(payload) >= 2 {
+				e.Code, e.Reason = int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+			}
+			c.close(e.Code, "")
+			return nil, e
+		case wsText, wsBinary:
+			if fragmented {
+				return nil, c.fail(wsCloseProtocolError, "new message within a fragmented message")
+			}
+		case wsContinuation:
+			if !fragmented {
+				return nil, c.fail(wsCloseProtocolError, "continuation frame without a message")
+			}
+		default:
+			return nil, c.fail(wsCloseProtocolError, fmt.Sprintf("unknown opcode %d", opcode))
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+		fragmented = true
+	}
+}
+
+// readFrame reads a frame, unmasking its payload. Data frames larger than
+// limit bytes fail the connection.
+func (c *wsConn) readFrame(limit int64) (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0F
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(wsCloseProtocolError, "reserved bits set without an extension")
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, c.fail(wsCloseProtocolError, "unmasked client frame")
+	}
+	n := int64(header[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+	}
+	control := opcode&0x8 != 0
+	switch {
+	case control && (n > 125 || !fin):
+		return false, 0, nil, c.fail(wsCloseProtocolError, "invalid control frame")
+	case !control && n > limit:
+		return false, 0, nil, c.fail(wsCloseTooBig, "message too large")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes an unfragmented frame within -write-timeout.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return errWSClosing // Nothing may follow a close frame
+	}
+	c.closeSent = opcode == wsClose
+	if writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// startClose sends a close frame with code and reason, unless one was
+// sent already. The client answers with its own, which readMessage returns
+// as a *wsCloseError; it is given wsCloseTimeout to do so.
+func (c *wsConn) startClose(code int, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason[:min(len(reason), 123)]...)
+	c.writeFrame(wsClose, payload)
+	c.conn.SetReadDeadline(time.Now().Add(wsCloseTimeout))
+}
+
+// close sends a close frame with code and reason, unless one was sent
+// already, and closes the connection.
+func (c *wsConn) close(code int, reason string) {
+	c.startClose(code, reason)
+	c.conn.Close()
+}
+
+// fail closes the connection for a protocol error and returns it.
+func (c *wsConn) fail(code int, reason string) error {
+	c.close(code, reason)
+	return &wsCloseError{Code: code, Reason: reason}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// WebSocket API.
+//
+// GET /ws upgrades to a WebSocket connection (see websocket.go) on which a
+// client, typically a browser dashboard, runs commands and receives key
+// changes without polling. Every message is a JSON object. Requests carry
+// an "id" of the client's choosing, echoed by their response, and are the
+// commands of /pipeline, run the same way (see execute), plus:
+//
+//	{"id":1,"op":"auth","token":"..."}         → {"id":1,"result":{"principal":"app"}}
+//	{"id":2,"op":"subscribe","prefix":"user:"} → {"id":2,"result":{"subscription":1}}
+//	{"id":3,"op":"unsubscribe","subscription":1}
+//	{"id":4,"op":"ping"}                       → {"id":4,"result":"pong"}
+//
+// A failed request gets {"id":1,"error":{"code":...,"message":...}}, with
+// the codes of the HTTP API. Subscriptions push the changes of the keys
+// starting with their prefix, from cache.Watch, between the responses:
+// {"subscription":1,"event":"set","key":"user:1","time":"..."}.
+//
+// Browsers can't set headers on WebSocket connections, so with API tokens
+// the connection may be opened without credentials and authenticated with
+// "auth" before any other request; a client that can send an Authorization
+// header is authenticated by the handshake. Requests from browsers must
+// come from the server's own origin or one of -cors-origins, so other sites
+// can't use the credentials of their users (cross-site WebSocket
+// hijacking). Every request is checked like the HTTP request doing the same:
+// ACL, IP filter, and rate limit of its class. The connection itself takes
+// a slot of -max-streams rather than -max-requests.
+//
+// Slow consumers: messages to send wait in a queue of wsSendQueue; while it
+// is full, requests aren't read, and a subscription falling behind by more
+// than cache.DefaultWatchBuffer events is dropped with a watch_overflow
+// error. A write that takes longer than -write-timeout closes the
+// connection. The server pings every wsPingInterval, and closes connections
+// on which nothing, pongs included, arrived for wsReadTimeout. The
+// graceful shutdown closes the connections with status 1001.
+
+// Limits of WebSocket connections.
+const (
+	wsMaxMessageBytes  = 1 << 20          // Largest request message; larger values go through /set
+	wsSendQueue        = 256              // Messages waiting to be sent
+	wsMaxSubscriptions = 64               // Subscriptions per connection
+	wsPingInterval     = 30 * time.Second // Time between pings of the server
+	wsReadTimeout      = 2 * wsPingInterval
+)
+
+// WSRequest is a request message of /ws. Only the fields the operation uses
+// are read.
+type WSRequest struct {
+	ID           json.RawMessage `json:"id,omitempty"`           // Echoed by the response
+	Op           string          `json:"op"`                     // A command of /pipeline, auth, subscribe, unsubscribe, or ping
+	Key          string          `json:"key,omitempty"`          // Key of the command
+	Value        *string         `json:"value,omitempty"`        // Value of set
+	TTL          *TTL            `json:"ttl,omitempty"`          // TTL of set and expire
+	By           *int64          `json:"by,omitempty"`           // Increment of incr
+	Token        string          `json:"token,omitempty"`        // API token of auth
+	Prefix       string          `json:"prefix,omitempty"`       // Key prefix of subscribe (empty: every key)
+	Subscription int64           `json:"subscription,omitempty"` // Subscription of unsubscribe
+}
+
+// WSResponse is the response message of a request of /ws.
+type WSResponse struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Result any             `json:"result"`          // Result of the request (null on error)
+	Error  *ErrorBody      `json:"error,omitempty"` // Error of the request
+}
+
+// WSEvent is a message of a subscription of /ws: a key change, or the error
+// that ended the subscription.
+type WSEvent struct {
+	Subscription int64      `json:"subscription"`
+	Event        string     `json:"event,omitempty"` // set, del, expire, expired, or evicted
+	Key          string     `json:"key,omitempty"`
+	Time         time.Time  `json:"time,omitzero"`
+	Error        *ErrorBody `json:"error,omitempty"`
+}
+
+// WebSocket connections aren't tracked by http.Server.Shutdown once
+// upgraded: the graceful shutdown closes them with closeWebSockets, and
+// waits for them with waitWebSockets.
+var (
+	wsShutdown = make(chan struct{}) // Closed when the graceful shutdown starts
+	wsSessions sync.WaitGroup        // Open connections
+)
+
+// closeWebSockets starts the closing handshake of the WebSocket
+// connections, on shutdown.
+func closeWebSockets() {
+	close(wsShutdown)
+}
+
+// waitWebSockets waits until the WebSocket connections are closed, or ctx
+// is done.
+func waitWebSockets(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		wsSessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("WebSocket connections did not close in time")
+	}
+}
+
+// wsSession is the state of a WebSocket connection.
+type wsSession struct {
+	conn   *wsConn
+	w      http.ResponseWriter // Of the handshake, for the headers set by checks
+	r      *http.Request       // Of the handshake, with the credentials once authenticated
+	authed bool
+	out    chan []byte   // Messages to send
+	done   chan struct{} // Closed when the connection ends
+
+	mu      sync.Mutex
+	subs    map[int64]*cache.Watcher // Subscriptions by ID
+	lastSub int64
+}
+
+// wsHandler handles GET /ws: it checks the origin and the credentials of
+// the handshake, upgrades the connection, and serves its requests until it
+// closes.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	if !wsOriginAllowed(r) {
+		slog.Warn("WebSocket origin denied", "origin", r.Header.Get("Origin"), "remote", r.RemoteAddr)
+		writeError(w, r, http.StatusForbidden, codeForbidden, "Origin not allowed")
+		return
+	}
+	authed := !authRequired()
+	if !authed && (r.Header.Get("Authorization") != "" || r.Header.Get(signatureHeader) != "") {
+		var err *APIError
+		if r, err = authenticateRequest(w, r); err != nil {
+			writeError(w, r, err.Status, err.Code, err.Message)
+			return
+		}
+		authed = true
+		recordPrincipal(r)
+	}
+	conn := upgradeWebSocket(w, r)
+	if conn == nil {
+		return
+	}
+	wsSessions.Add(1)
+	defer wsSessions.Done()
+
+	s := &wsSession{
+		conn:   conn,
+		w:      w,
+		r:      r,
+		authed: authed,
+		out:    make(chan []byte, wsSendQueue),
+		done:   make(chan struct{}),
+		subs:   make(map[int64]*cache.Watcher),
+	}
+	slog.Debug("WebSocket connected", "remote", r.RemoteAddr, "principal", requestPrincipal(r))
+	var writer sync.WaitGroup
+	writer.Go(s.writeLoop)
+	err := s.readLoop()
+	close(s.done)
+	s.unsubscribeAll()
+	conn.conn.Close()
+	writer.Wait()
+	slog.Debug("WebSocket disconnected", "remote", r.RemoteAddr, "err", err)
+}
+
+// wsOriginAllowed reports whether a WebSocket handshake may come from its
+// origin: requests without one aren't from browsers, and browsers must be
+// on the server's own origin or one of -cors-origins.
+func wsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return corsOriginAllowed(origin)
+}
+
+// readLoop serves the requests of the connection until it closes.
+func (s *wsSession) readLoop() error {
+	for {
+		msg, err := s.conn.readMessage(wsMaxMessageBytes, wsReadTimeout)
+		if err != nil {
+			return err
+		}
+		var req WSRequest
+		var resp WSResponse
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = &ErrorBody{Code: codeInvalidJSON, Message: "Invalid JSON message: " + err.Error()}
+		} else {
+			resp = s.handle(&req)
+		}
+		if !s.send(resp) {
+			return nil
+		}
+	}
+}
+
+// writeLoop sends the queued messages and the pings, until the connection
+// ends or the server shuts down.
+func (s *wsSession) writeLoop() {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case msg := <-s.out:
+			err = s.conn.writeFrame(wsText, msg)
+		case <-ping.C:
+			err = s.conn.writeFrame(wsPing, nil)
+		case <-wsShutdown:
+			s.conn.startClose(wsCloseGoingAway, "server shutting down")
+			return
+		case <-s.done:
+			return
+		}
+		if err != nil { // Slow or gone: the read fails and ends the session
+			s.conn.conn.Close()
+			return
+		}
+	}
+}
+
+// send queues a message, waiting while the queue is full. It returns false
+// once the connection has ended or is closing.
+func (s *wsSession) send(v any) bool {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Failed to encode WebSocket message", "err", err)
+		return true
+	}
+	select {
+	case s.out <- msg:
+		return true
+	case <-s.done:
+		return false
+	case <-wsShutdown:
+		return false
+	}
+}
+
+// handle runs a request and returns its response.
+func (s *wsSession) handle(req *WSRequest) WSResponse {
+	op := strings.ToLower(req.Op)
+	if cc := requestClient(s.r); cc != nil {
+		command := "WS " + op
+		cc.lastCommand.Store(&command)
+		cc.lastActive.Store(time.Now().UnixNano())
+		cc.commands.Add(1)
+	}
+	result, err := s.run(op, req)
+	resp := WSResponse{ID: req.ID, Result: result}
+	if err != nil {
+		e := toAPIError(err, "Request failed")
+		resp.Result, resp.Error = nil, &ErrorBody{Code: e.Code, Message: e.Message}
+	}
+	return resp
+}
+
+// run runs a request after the checks of its class.
+func (s *wsSession) run(op string, req *WSRequest) (any, error) {
+	switch {
+	case op == "ping":
+		return "pong", nil
+	case op == "auth":
+		return s.auth(req.Token)
+	case !s.authed:
+		return nil, &APIError{Status: http.StatusUnauthorized, Code: codeUnauthorized, Message: `Unauthorized (authenticate first with {"op":"auth","token":"..."})`}
+	}
+
+	class := classRead
+	if c, ok := commands[op]; ok && c.write {
+		class = classWrite
+	}
+	if !currentIPPolicy.Load().allows(class, s.r) {
+		return nil, &APIError{Status: http.StatusForbidden, Code: codeForbidden, Message: "Forbidden"}
+	}
+	if err := checkRate(class, s.w, s.r); err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "subscribe":
+		return s.subscribe(req.Prefix)
+	case "unsubscribe":
+		return s.unsubscribe(req.Subscription), nil
+	}
+	return execute(s.r, &Command{Cmd: op, Key: req.Key, Value: req.Value, TTL: req.TTL, By: req.By})
+}
+
+// auth authenticates the connection with an API token, like the
+// Authorization header of a request would.
+func (s *wsSession) auth(token string) (any, error) {
+	if !authRequired() {
+		return map[string]string{"principal": requestPrincipal(s.r)}, nil
+	}
+	r := s.r.Clone(s.r.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Del(signatureHeader)
+	r, err := authenticateRequest(s.w, r)
+	if err != nil {
+		return nil, err
+	}
+	s.r, s.authed = r, true
+	recordPrincipal(r)
+	return map[string]string{"principal": requestPrincipal(r)}, nil
+}
+
+// subscribe starts pushing the changes of the keys starting with prefix.
+// Users restricted to key patterns may only subscribe to a prefix within
+// one.
+func (s *wsSession) subscribe(prefix string) (any, error) {
+	if err := checkACL(s.r, "get", prefix+"*"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subs) == wsMaxSubscriptions {
+		return nil, &APIError{Status: http.StatusBadRequest, Code: codeInvalidRequest, Message: "Too many subscriptions on this connection"}
+	}
+	s.lastSub++
+	id := s.lastSub
+	watcher := cacheInstance.Watch(prefix, 0)
+	s.subs[id] = watcher
+	go s.forward(id, watcher)
+	return map[string]int64{"subscription": id}, nil
+}
+
+// forward sends the events of a subscription until it ends. A watcher
+// that fell behind ends the subscription with an error message.
+func (s *wsSession) forward(id int64, watcher *cache.Watcher) {
+	for ev := range watcher.Events() {
+		if !s.send(WSEvent{Subscription: id, Event: string(ev.Type), Key: ev.Key, Time: ev.Time}) {
+			return
+		}
+	}
+	if errors.Is(watcher.Err(), cache.ErrWatchOverflow) {
+		s.mu.Lock()
+		delete(s.subs, id)
+		s.mu.Unlock()
+		s.send(WSEvent{Subscription: id, Error: &ErrorBody{Code: codeWatchOverflow, Message: "Subscription fell behind and was dropped, subscribe again"}})
+	}
+}
+
+// unsubscribe ends a subscription and reports whether it existed.
+func (s *wsSession) unsubscribe(id int64) bool {
+	s.mu.Lock()
+	watcher, ok := s.subs[id]
+	delete(s.subs, id)
+	s.mu.Unlock()
+	if ok {
+		watcher.Close()
+	}
+	return ok
+}
+
+// unsubscribeAll ends the subscriptions, once the connection has ended.
+func (s *wsSession) unsubscribeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, watcher := range s.subs {
+		watcher.Close()
+		delete(s.subs, id)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// YAML subset of config files.
+//
+// parseYAML reads the part of YAML that config files need, without a
+// dependency: nested block mappings and sequences (including sequences of
+// mappings, "- name: x"), flow sequences of scalars ("[a, b]"), empty flow
+// mappings ("{}"), plain, single-quoted, and double-quoted scalars, and
+// comments. Anchors, aliases, tags, block scalars ("|", ">"), and multi-line
+// flow collections are rejected with the line number, rather than being
+// misread. Plain scalars are resolved like in the YAML core schema: null,
+// booleans, and numbers (as json.Number), strings otherwise.
+
+// formatConfigYAML writes the settings of cfg that are set as a config file
+// parseYAML reads back: a mapping per section, with strings quoted and lists
+// as flow sequences.
+func formatConfigYAML(cfg *Config) []byte {
+	var b strings.Builder
+	section := ""
+	for _, s := range configSettings(cfg) {
+		if s.value.IsNil() {
+			continue
+		}
+		name, key, _ := strings.Cut(s.path, ".")
+		if name != section {
+			fmt.Fprintf(&b, "%s:\n", name)
+			section = name
+		}
+		fmt.Fprintf(&b, "  %s: %s\n", key, formatYAMLValue(s.value))
+	}
+	return []byte(b.String())
+}
+
+// formatYAMLValue formats the value of a setting (a pointer or a slice) as
+// a YAML scalar or flow sequence.
+func formatYAMLValue(v reflect.Value) string {
+	if v.Kind() == reflect.Slice {
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = strconv.Quote(v.Index(i).String())
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	v = v.Elem()
+	if v.Type() == durationType || v.Kind() == reflect.String {
+		return strconv.Quote(formatConfigValue(v))
+	}
+	return formatConfigValue(v)
+}
+
+// yamlLine is a line of a YAML document that holds content.
+type yamlLine struct {
+	num    int    // Line number, from 1
+	indent int    // Leading spaces
+	text   string // Content without indentation, comment, and trailing spaces
+}
+
+// yamlParser parses the lines of a document into maps, slices, and scalars.
+type yamlParser struct {
+	lines []yamlLine
+	pos   int // Next line to parse
+}
+
+// parseYAML parses a YAML document into map[string]any, []any, string, bool,
+// json.Number, and nil values. An empty document is an empty mapping.
+func parseYAML(data []byte) (any, error) {
+	lines, err := yamlLines(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return map[string]any{}, nil
+	}
+
+	p := &yamlParser{lines: lines}
+	v, err := p.parseBlock(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[p.pos].num)
+	}
+	return v, nil
+}
+
+// yamlLines splits a document into its lines with content.
+func yamlLines(doc string) ([]yamlLine, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(doc, "\n") {
+		num := i + 1
+		raw = strings.TrimSuffix(raw, "\r")
+		text := strings.TrimLeft(raw, " ")
+		indent := len(raw) - len(text)
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't be used for indentation", num)
+		}
+		text = strings.TrimRight(stripYAMLComment(text), " \t")
+		if text == "" || (indent == 0 && text == "---") {
+			continue
+		}
+		if indent == 0 && text == "..." {
+			break // End of the document
+		}
+		if strings.HasPrefix(text, "---") && indent == 0 {
+			return nil, fmt.Errorf("line %d: only one document is supported", num)
+		}
+		lines = append(lines, yamlLine{num: num, indent: indent, text: text})
+	}
+	return lines, nil
+}
+
+// stripYAMLComment removes a "#" comment from a line. A "#" only starts a
+// comment at the start of the line or after whitespace, outside quotes.
+func stripYAMLComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++ // Escaped character
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			// A quote only opens a quoted scalar at the start of a token
+			if startsYAMLToken(text[:i]) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// startsYAMLToken reports whether a scalar starting after before starts a
+// token: at the start of the line, after "- ", ": ", "[", or ",".
+func startsYAMLToken(before string) bool {
+	before = strings.TrimRight(before, " ")
+	return before == "" || strings.HasSuffix(before, ":") || strings.HasSuffix(before, "-") ||
+		strings.HasSuffix(before, "[") || strings.HasSuffix(before, ",")
+}
+
+// isYAMLSeqItem reports whether text is a block sequence item.
+func isYAMLSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// parseBlock parses the mapping or sequence starting at the current line,
+// whose entries are indented by indent spaces.
+func (p *yamlParser) parseBlock(indent int) (any, error) {
+	if isYAMLSeqItem(p.lines[p.pos].text) {
+		return p.parseSeq(indent)
+	}
+	return p.parseMap(indent)
+}
+
+// parseMap parses a block mapping with keys indented by indent spaces.
+func (p *yamlParser) parseMap(indent int) (map[string]any, error) {
+	m := make(map[string]any)
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+		if isYAMLSeqItem(l.text) {
+			return nil, fmt.Errorf("line %d: expected \"key: value\", found a list item", l.num)
+		}
+		key, rest, err := splitYAMLKey(l)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := m[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %q", l.num, key)
+		}
+		p.pos++
+
+		if rest != "" {
+			v, err := parseYAMLFlow(rest, l.num)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+			continue
+		}
+		// A nested block, which may be a sequence at the same indentation
+		m[key] = nil
+		if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			if next.indent > indent || (next.indent == indent && isYAMLSeqItem(next.text)) {
+				v, err := p.parseBlock(next.indent)
+				if err != nil {
+					return nil, err
+				}
+				m[key] = v
+			}
+		}
+	}
+	return m, nil
+}
+
+// parseSeq parses a block sequence with "-" indented by indent spaces.
+func (p *yamlParser) parseSeq(indent int) ([]any, error) {
+	s := []any{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent || (l.indent == indent && !isYAMLSeqItem(l.text)) {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+
+		rest := strings.TrimLeft(l.text[1:], " ")
+		if rest == "" {
+			// The item is a nested block on the next lines, or null
+			p.pos++
+			var v any
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				var err error
+				if v, err = p.parseBlock(p.lines[p.pos].indent); err != nil {
+					return nil, err
+				}
+			}
+			s = append(s, v)
+			continue
+		}
+
+		// "- key: value" and "- - item" start a block at the item's column:
+		// the line is parsed again as its first line
+		itemIndent := indent + len(l.text) - len(rest)
+		if isYAMLSeqItem(rest) || isYAMLKey(rest) {
+			p.lines[p.pos] = yamlLine{num: l.num, indent: itemIndent, text: rest}
+			v, err := p.parseBlock(itemIndent)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, v)
+			continue
+		}
+
+		p.pos++
+		v, err := parseYAMLFlow(rest, l.num)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, v)
+	}
+	return s, nil
+}
+
+// isYAMLKey reports whether text starts with a mapping key.
+func isYAMLKey(text string) bool {
+	_, _, err := splitYAMLKey(yamlLine{text: text})
+	return err == nil
+}
+
+// splitYAMLKey splits a "key: value" line into the key and the value,
+// which is empty if the line only holds the key.
+func splitYAMLKey(l yamlLine) (string, string, error) {
+	text := l.text
+	if text[0] == '"' || text[0] == '\'' {
+		end := quotedYAMLEnd(text)
+		if end < 0 {
+			return "", "", fmt.Errorf("line %d: unterminated quoted key", l.num)
+		}
+		after := text[end:]
+		if after != ":" && !strings.HasPrefix(after, ": ") {
+			return "", "", fmt.Errorf("line %d: expected \":\" after the key", l.num)
+		}
+		key, err := parseYAMLScalar(text[:end], l.num)
+		if err != nil {
+			return "", "", err
+		}
+		return fmt.Sprint(key), strings.TrimSpace(after[1:]), nil
+	}
+
+	i := strings.Index(text, ": ")
+	if i < 0 {
+		if !strings.HasSuffix(text, ":") {
+			return "", "", fmt.Errorf("line %d: expected \"key: value\", found %q", l.num, text)
+		}
+		i = len(text) - 1
+	}
+	key := strings.TrimSpace(text[:i])
+	if key == "" || strings.ContainsAny(key[:1], "[{&*!|>%@`") {
+		return "", "", fmt.Errorf("line %d: unsupported key %q", l.num, key)
+	}
+	return key, strings.TrimSpace(text[i+1:]), nil
+}
+
+// quotedYAMLEnd returns the index after the quoted scalar text starts with,
+// or -1 if the quote isn't closed.
+func quotedYAMLEnd(text string) int {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case text[i] == quote:
+			if quote == '\'' && i+1 < len(text) && text[i+1] == '\'' {
+				i++ // Escaped single quote
+				continue
+			}
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// parseYAMLFlow parses the value of a key or sequence item: a flow
+// sequence of scalars, an empty flow mapping, or a scalar.
+func parseYAMLFlow(text string, num int) (any, error) {
+	switch text[0] {
+	case '[':
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("line %d: flow sequences must end on the same line", num)
+		}
+		items := []any{}
+		inner := strings.TrimSpace(text[1 : len(text)-1])
+		for inner != "" {
+			var item string
+			if inner[0] == '"' || inner[0] == '\'' {
+				end := quotedYAMLEnd(inner)
+				if end < 0 {
+					return nil, fmt.Errorf("line %d: unterminated quoted string", num)
+				}
+				item, inner = inner[:end], strings.TrimSpace(inner[end:])
+				if inner != "" && inner[0] != ',' {
+					return nil, fmt.Errorf("line %d: expected \",\" after %s", num, item)
+				}
+			} else {
+				i := strings.IndexByte(inner, ',')
+				if i < 0 {
+					i = len(inner)
+				}
+				item, inner = strings.TrimSpace(inner[:i]), inner[i:]
+			}
+			if strings.ContainsAny(item[:min(1, len(item))], "[{") {
+				return nil, fmt.Errorf("line %d: nested flow collections are not supported", num)
+			}
+			v, err := parseYAMLScalar(item, num)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+			inner = strings.TrimSpace(strings.TrimPrefix(inner, ","))
+		}
+		return items, nil
+	case '{':
+		if text != "{}" {
+			return nil, fmt.Errorf("line %d: flow mappings are not supported, use an indented block", num)
+		}
+		return map[string]any{}, nil
+	}
+	return parseYAMLScalar(text, num)
+}
+
+// parseYAMLScalar parses a quoted or plain scalar.
+func parseYAMLScalar(text string, num int) (any, error) {
+	if text == "" {
+		return nil, nil
+	}
+	switch text[0] {
+	case '"':
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid double-quoted string %s", num, text)
+		}
+		return s, nil
+	case '\'':
+		if len(text) < 2 || quotedYAMLEnd(text) != len(text) {
+			return nil, fmt.Errorf("line %d: invalid single-quoted string %s", num, text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	case '&', '*', '!':
+		return nil, fmt.Errorf("line %d: anchors, aliases, and tags are not supported (quote the value if it is a string)", num)
+	case '|', '>':
+		return nil, fmt.Errorf("line %d: block scalars are not supported, use a quoted string", num)
+	}
+
+	switch text {
+	case "null", "Null", "NULL", "~":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if (text[0] == '-' || text[0] >= '0' && text[0] <= '9') && json.Valid([]byte(text)) {
+		return json.Number(text), nil
+	}
+	return text, nil
+}
@@ -0,0 +1,436 @@
+// Package main implements snapshot-inspect, a command-line tool for examining
+// mini-redis snapshot files without starting the server, e.g. before
+// restoring one. Snapshots are read entry by entry, in any format and
+// compressed or not, so large files are never loaded into memory as a whole.
+//
+// Usage:
+//
+//	snapshot-inspect stats <file>
+//	snapshot-inspect grep [-values] <pattern> <file>
+//	snapshot-inspect verify <file>
+//	snapshot-inspect diff [-q] <a> <b>
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"mini-redis/internal/cache"
+)
+
+// main dispatches to the subcommand named by the first argument.
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "stats":
+		err = runStats(os.Args[2:])
+	case "grep":
+		err = runGrep(os.Args[2:])
+	case "verify":
+		err = runVerify(os.Args[2:])
+	case "diff":
+		err = runDiff(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// usage prints the list of subcommands.
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: snapshot-inspect <command> [flags] <file>...
+
+Commands:
+  stats   Show entry count, keys with TTL, value sizes, and when the snapshot was taken
+  grep    List keys matching a glob pattern (*, ?, [abc]) with value size and expiry
+  verify  Check the format and checksums and report the first corruption
+  diff    List keys added, removed, or changed between two snapshots`)
+}
+
+// parseArgs parses subcommand flags and returns the n positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string, n int, what string) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != n {
+		return nil, fmt.Errorf("expected %s", what)
+	}
+	return fs.Args(), nil
+}
+
+// snapshotFile is an open snapshot file and its reader.
+type snapshotFile struct {
+	*cache.SnapshotReader
+	file *os.File
+	path string
+	size int64
+}
+
+// openSnapshot opens a snapshot file and reads its header.
+func openSnapshot(path string) (*snapshotFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader, err := cache.NewSnapshotReader(file)
+	if err != nil {
+		file.Close()
+		return nil, withPath(err, path)
+	}
+	return &snapshotFile{SnapshotReader: reader, file: file, path: path, size: info.Size()}, nil
+}
+
+// Close closes the reader and the file.
+func (f *snapshotFile) Close() error {
+	f.SnapshotReader.Close()
+	return f.file.Close()
+}
+
+// each calls fn for every entry, stopping at the first error.
+func (f *snapshotFile) each(fn func(entry cache.SnapshotEntry)) error {
+	for {
+		entry, err := f.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return withPath(err, f.path)
+		}
+		fn(entry)
+	}
+}
+
+// withPath fills in the file path of a *cache.SnapshotCorruptionError.
+func withPath(err error, path string) error {
+	var corruptErr *cache.SnapshotCorruptionError
+	if errors.As(err, &corruptErr) {
+		corruptErr.Path = path
+	}
+	return err
+}
+
+// describe returns the format of a snapshot, e.g. "binary, gzip".
+func describe(f *snapshotFile) string {
+	if f.Compressed() {
+		return f.Format().String() + ", gzip"
+	}
+	return f.Format().String()
+}
+
+// expiry formats an expiration time for listings.
+func expiry(t time.Time, now time.Time) string {
+	switch {
+	case t.IsZero():
+		return "never"
+	case now.After(t):
+		return t.Format(time.RFC3339) + " (expired)"
+	default:
+		return t.Format(time.RFC3339) + " (in " + t.Sub(now).Round(time.Second).String() + ")"
+	}
+}
+
+// runStats prints entry counts and sizes.
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	paths, err := parseArgs(fs, args, 1, "exactly one snapshot file argument")
+	if err != nil {
+		return err
+	}
+
+	f, err := openSnapshot(paths[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	var entries, withTTL, expired int
+	var keyBytes, valueBytes int64
+	err = f.each(func(entry cache.SnapshotEntry) {
+		entries++
+		keyBytes += int64(len(entry.Key))
+		valueBytes += int64(len(entry.Value))
+		if !entry.ExpiresAt.IsZero() {
+			withTTL++
+			if now.After(entry.ExpiresAt) {
+				expired++
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("File:          %s\n", paths[0])
+	fmt.Printf("Format:        %s\n", describe(f))
+	fmt.Printf("Version:       %s\n", f.Version())
+	fmt.Printf("Size:          %d bytes\n", f.size)
+	fmt.Printf("Created:       %s (%s ago)\n", f.Timestamp().Format(time.RFC3339), now.Sub(f.Timestamp()).Round(time.Second))
+	fmt.Printf("Entries:       %d\n", entries)
+	fmt.Printf("  with TTL:    %d\n", withTTL)
+	fmt.Printf("  expired:     %d (skipped when loaded)\n", expired)
+	fmt.Printf("Key bytes:     %d\n", keyBytes)
+	fmt.Printf("Value bytes:   %d\n", valueBytes)
+	if f.Checksum() == "" {
+		fmt.Printf("Checksum:      none\n")
+	} else {
+		fmt.Printf("Checksum:      %s (ok)\n", f.Checksum())
+	}
+	return nil
+}
+
+// runGrep lists the keys matching a glob pattern.
+func runGrep(args []string) error {
+	fs := flag.NewFlagSet("grep", flag.ExitOnError)
+	values := fs.Bool("values", false, "print values too")
+	paths, err := parseArgs(fs, args, 2, "a pattern and a snapshot file argument")
+	if err != nil {
+		return err
+	}
+	pattern := paths[0]
+
+	f, err := openSnapshot(paths[1])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	matches := 0
+	err = f.each(func(entry cache.SnapshotEntry) {
+		if !globMatch(pattern, entry.Key) {
+			return
+		}
+		matches++
+		line := fmt.Sprintf("%s  %d bytes  expires %s", strconv.Quote(entry.Key), len(entry.Value), expiry(entry.ExpiresAt, now))
+		if entry.ContentType != "" {
+			line += "  type " + strconv.Quote(entry.ContentType)
+		}
+		if *values {
+			line += "  " + strconv.Quote(entry.Value)
+		}
+		fmt.Println(line)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "%d matching keys\n", matches)
+	return nil
+}
+
+// runVerify checks the format and checksums of every entry.
+// It exits with status 1 if the file is corrupted.
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	paths, err := parseArgs(fs, args, 1, "exactly one snapshot file argument")
+	if err != nil {
+		return err
+	}
+
+	f, err := openSnapshot(paths[0])
+	if err == nil {
+		defer f.Close()
+		entries := 0
+		err = f.each(func(cache.SnapshotEntry) { entries++ })
+		if err == nil {
+			checksum := "checksum ok"
+			if f.Checksum() == "" {
+				checksum = "no checksum (written before checksums were added)"
+			}
+			fmt.Printf("OK: %d entries, version %s, %s, %s\n", entries, f.Version(), describe(f), checksum)
+			return nil
+		}
+	}
+
+	var corruptErr *cache.SnapshotCorruptionError
+	if !errors.As(err, &corruptErr) {
+		return err // I/O error, not corruption
+	}
+	fmt.Printf("CORRUPT: %v\n", corruptErr)
+	os.Exit(1)
+	return nil
+}
+
+// runDiff lists the keys added, removed, or changed (value or expiry) from a
+// to b. Only a digest of each entry of a is kept in memory; b is streamed.
+// It exits with status 1 if the snapshots differ, like diff(1).
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	quiet := fs.Bool("q", false, "only print the summary")
+	paths, err := parseArgs(fs, args, 2, "two snapshot file arguments")
+	if err != nil {
+		return err
+	}
+
+	a, err := openSnapshot(paths[0])
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	before := make(map[string]uint64)
+	if err := a.each(func(entry cache.SnapshotEntry) { before[entry.Key] = digest(entry) }); err != nil {
+		return err
+	}
+
+	b, err := openSnapshot(paths[1])
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	var added, changed int
+	err = b.each(func(entry cache.SnapshotEntry) {
+		old, ok := before[entry.Key]
+		delete(before, entry.Key)
+		switch {
+		case !ok:
+			added++
+			if !*quiet {
+				fmt.Printf("+ %s\n", strconv.Quote(entry.Key))
+			}
+		case old != digest(entry):
+			changed++
+			if !*quiet {
+				fmt.Printf("~ %s\n", strconv.Quote(entry.Key))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Whatever is left of a is missing from b
+	removed := make([]string, 0, len(before))
+	for key := range before {
+		removed = append(removed, key)
+	}
+	sort.Strings(removed)
+	if !*quiet {
+		for _, key := range removed {
+			fmt.Printf("- %s\n", strconv.Quote(key))
+		}
+	}
+
+	fmt.Printf("%d added, %d removed, %d changed\n", added, len(removed), changed)
+	if added+len(removed)+changed > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// digest returns a hash of an entry's value, expiration time, and content type.
+func digest(entry cache.SnapshotEntry) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, entry.Value)
+	fmt.Fprintf(h, "\x00%d\x00%s", entry.ExpiresAt.UnixNano(), entry.ContentType)
+	return h.Sum64()
+}
+
+// globMatch reports whether key matches a Redis-style glob pattern:
+// * matches any sequence, ? any single byte, [abc] / [a-z] / [^a] a set,
+// and \ escapes the next character. Unlike path.Match, * also matches "/".
+func globMatch(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if globMatch(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if key == "" {
+				return false
+			}
+		case '[':
+			if key == "" {
+				return false
+			}
+			end, ok := matchSet(pattern, key[0])
+			if !ok {
+				return false
+			}
+			pattern, key = pattern[end:], key[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if key == "" || pattern[0] != key[0] {
+				return false
+			}
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return key == ""
+}
+
+// matchSet matches c against the set starting at pattern[0] == '['. It
+// returns the length of the set in the pattern and whether c is in it. An
+// unterminated set matches a literal '['.
+func matchSet(pattern string, c byte) (int, bool) {
+	i := 1
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+
+	found := false
+	for first := true; i < len(pattern) && (first || pattern[i] != ']'); first = false {
+		lo := pattern[i]
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		hi := lo
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			found = true
+		}
+		i++
+	}
+	if i >= len(pattern) {
+		return 1, c == '['
+	}
+	return i + 1, found != negate
+}
@@ -2,11 +2,13 @@ package cache
 
 import (
 	"bufio"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,16 +21,102 @@ type AOF struct {
 	mu       sync.Mutex
 	cache    *Cache
 	enabled  bool
+	paused   bool // Turned off by SetAOFEnabled: commands aren't written (see aof_toggle.go)
+	closed   bool
+	fsync    FsyncPolicy   // When writes are synced to disk (see aof_fsync.go)
+	unsynced bool          // Writes were flushed since the last sync (FsyncEverySec)
+	syncStop chan struct{} // Closed by Close to stop syncLoop (nil without it)
+	seq      uint64        // Sequence number of the last logged command
+	size     int64         // Current size of the AOF file in bytes
+	baseSize int64         // Size of the AOF file after the last rewrite or startup
+	writeErr error         // Error of the last write or sync, nil once one succeeds
+
+	needsConversion bool // Replayed file uses the legacy JSON format
+
+	rewrite     *aofRewrite     // Running rewrite, nil if none
+	lastRewrite AOFRewriteStats // Statistics about finished rewrites
+
+	replay aofReplayProgress // Progress of the replay at startup
+}
+
+// aofReplayLogInterval is how often replay progress is logged.
+const aofReplayLogInterval = 5 * time.Second
+
+// aofReplayProgress tracks the replay at startup. The counters are atomic so
+// they can be read while the replay is running; the other fields are guarded by AOF.mu.
+type aofReplayProgress struct {
+	bytes     atomic.Int64
+	commands  atomic.Int64
+	logged    atomic.Int64 // Commands replayed after the preamble, i.e. not part of a snapshot
+	errors    atomic.Int64
+	running   bool
+	start     time.Time
+	duration  time.Duration
+	fileSize  int64
+	discarded int64
+}
+
+// AOFReplayStats describes the progress and result of the AOF replay at startup.
+type AOFReplayStats struct {
+	InProgress     bool          // Whether the replay is still running
+	FileSize       int64         // Size of the AOF file being replayed
+	BytesProcessed int64         // Bytes replayed so far
+	Commands       int64         // Commands applied so far
+	Errors         int64         // Corrupted records and unknown operations encountered
+	Discarded      int64         // Bytes discarded after a corrupted record
+	Duration       time.Duration // Time spent so far, or the total time once finished
+}
+
+// AOFCorruptionError describes a corrupted or incomplete record found during replay.
+type AOFCorruptionError struct {
+	Path      string // AOF file path
+	Record    int    // Number of the bad record (line number for legacy JSON files)
+	Offset    int64  // Byte offset of the bad record (end of the last good record)
+	Discarded int64  // Number of bytes from the bad record to the end of the file
+	Reason    string // Why the record was rejected
+
+	// The bad record is in the preamble, or the preamble ends early. The
+	// preamble holds the dataset, so the file is never truncated then.
+	Preamble bool
+}
+
+// Error implements the error interface.
+func (e *AOFCorruptionError) Error() string {
+	if e.Preamble {
+		return fmt.Sprintf("AOF %s corrupted in its preamble at record %d (offset %d): %s, file left as is since the preamble holds the dataset",
+			e.Path, e.Record, e.Offset, e.Reason)
+	}
+	return fmt.Sprintf("AOF %s corrupted at record %d (offset %d): %s, %d bytes discarded",
+		e.Path, e.Record, e.Offset, e.Reason, e.Discarded)
 }
 
 // AOFCommand represents a command logged in the AOF file.
 type AOFCommand struct {
-	Op    string `json:"op"`    // Operation: "SET" or "DEL"
-	Key   string `json:"key"`   // Cache key
-	Value string `json:"value"` // Value (for SET operations)
-	TTL   int    `json:"ttl"`   // TTL in seconds (for SET operations, 0 means no expiry)
+	Seq   uint64 `json:"seq,omitempty"` // Sequence number (0 for records written by a rewrite)
+	Op    string `json:"op"`            // Operation: "SET" or "DEL"
+	Key   string `json:"key"`           // Cache key
+	Value string `json:"value"`         // Value (for SET operations)
+	TTL   int    `json:"ttl"`           // Relative TTL in seconds written by older versions (0 means no expiry)
+
+	// Absolute expiration time for SET operations (zero time means no expiry).
+	// Replaces TTL, which made keys live longer after every restart.
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+
+	// Last access time for LRU, only stored in SET records written by a
+	// rewrite (zero time means unknown: the key counts as accessed at replay).
+	LastAccess time.Time `json:"last_access,omitzero"`
+
+	// Why a DEL record was written if not by a client, e.g. DelReasonEvicted.
+	Reason string `json:"reason,omitempty"`
+
+	// Content type of the value of a SET operation (empty: none), see
+	// Cache.SetBytesWithContentType.
+	ContentType string `json:"content_type,omitempty"`
 }
 
+// DelReasonEvicted is the Reason of the DEL records of evicted keys.
+const DelReasonEvicted = "evicted"
+
 // NewAOF creates and initializes a new AOF instance.
 // If the file exists, it will be opened in append mode.
 // If it doesn't exist, it will be created.
@@ -45,13 +133,20 @@ func NewAOF(filePath string, cache *Cache) (*AOF, error) {
 		filePath: filePath,
 		cache:    cache,
 		enabled:  true,
+		fsync:    cache.aofFsync,
+	}
+	if aof.fsync == FsyncEverySec {
+		aof.syncStop = make(chan struct{})
+		go aof.syncLoop(aof.syncStop)
 	}
 
 	return aof, nil
 }
 
 // LogSet logs a SET operation to the AOF file.
-func (a *AOF) LogSet(key, value string, ttl time.Duration) {
+// expiresAt is the absolute expiration time (zero time means no expiry), and
+// contentType the content type of the value (empty: none).
+func (a *AOF) LogSet(key, value string, expiresAt time.Time, contentType string) {
 	if !a.enabled {
 		return
 	}
@@ -59,26 +154,21 @@ func (a *AOF) LogSet(key, value string, ttl time.Duration) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	ttlSeconds := 0
-	if ttl > 0 {
-		ttlSeconds = int(ttl.Seconds())
-	}
-
 	cmd := AOFCommand{
-		Op:    "SET",
-		Key:   key,
-		Value: value,
-		TTL:   ttlSeconds,
+		Op:          "SET",
+		Key:         key,
+		Value:       value,
+		ExpiresAt:   expiresAt,
+		ContentType: contentType,
 	}
 
-	if err := a.writeCommand(cmd); err != nil {
-		// Log error but don't fail the operation
-		fmt.Printf("AOF write error: %v\n", err)
-	}
+	// Log error but don't fail the operation
+	a.recordWrite(a.writeCommand(cmd))
 }
 
-// LogDel logs a DEL operation to the AOF file.
-func (a *AOF) LogDel(key string) {
+// LogDel logs a DEL operation to the AOF file. reason tells why the key was
+// removed if it wasn't deleted by a client (e.g. DelReasonEvicted), or is empty.
+func (a *AOF) LogDel(key, reason string) {
 	if !a.enabled {
 		return
 	}
@@ -87,47 +177,124 @@ func (a *AOF) LogDel(key string) {
 	defer a.mu.Unlock()
 
 	cmd := AOFCommand{
-		Op:  "DEL",
-		Key: key,
+		Op:     "DEL",
+		Key:    key,
+		Reason: reason,
+	}
+
+	// Log error but don't fail the operation
+	a.recordWrite(a.writeCommand(cmd))
+}
+
+// LogBatch logs several SET and DEL commands with a single flush and fsync,
+// for Cache.SetBatch and Cache.DelBatch.
+func (a *AOF) LogBatch(cmds []AOFCommand) {
+	if !a.enabled || len(cmds) == 0 {
+		return
 	}
 
-	if err := a.writeCommand(cmd); err != nil {
-		// Log error but don't fail the operation
-		fmt.Printf("AOF write error: %v\n", err)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, cmd := range cmds {
+		if err := a.appendCommand(cmd); err != nil {
+			// Log error but don't fail the operation
+			a.recordWrite(err)
+			return
+		}
 	}
+	a.recordWrite(a.syncCommands())
 }
 
-// writeCommand writes a command to the AOF file in JSON format, one per line.
-func (a *AOF) writeCommand(cmd AOFCommand) error {
-	data, err := json.Marshal(cmd)
+// recordWrite logs the error of a write, if any, and keeps it for
+// Cache.AOFWriteError. Must be called with a.mu held.
+func (a *AOF) recordWrite(err error) {
 	if err != nil {
-		return fmt.Errorf("failed to marshal command: %w", err)
+		slog.Error("AOF write error", "err", err)
+	}
+	a.writeErr = err
+}
+
+// writeCommand writes a command to the AOF file and syncs it to disk.
+// Must be called with a.mu held.
+func (a *AOF) writeCommand(cmd AOFCommand) error {
+	if err := a.appendCommand(cmd); err != nil {
+		return err
+	}
+	return a.syncCommands()
+}
+
+// appendCommand numbers a command, hands it to the running rewrite and the
+// replicas, and writes it to the AOF buffer. Must be called with a.mu held.
+func (a *AOF) appendCommand(cmd AOFCommand) error {
+	a.seq++
+	cmd.Seq = a.seq
+
+	// Keep the command for the running rewrite, if any
+	if a.rewrite != nil {
+		a.rewrite.buffer = append(a.rewrite.buffer, cmd)
+	}
+
+	// Stream the command to replicas, if any
+	if a.cache.replication != nil {
+		a.cache.replication.feed(cmd)
+	}
+
+	if a.paused {
+		return nil
 	}
 
-	// Write JSON line followed by newline
-	if _, err := a.writer.Write(data); err != nil {
-		return fmt.Errorf("failed to write to AOF: %w", err)
+	n, err := encodeCommand(a.writer, cmd)
+	if err != nil {
+		return err
 	}
+	a.size += int64(n)
+	return nil
+}
 
-	if err := a.writer.WriteByte('\n'); err != nil {
-		return fmt.Errorf("failed to write newline to AOF: %w", err)
+// syncCommands flushes the AOF buffer and, depending on the fsync policy,
+// syncs the file to disk. Must be called with a.mu held.
+func (a *AOF) syncCommands() error {
+	if a.paused {
+		return nil
 	}
 
-	// Flush to ensure data is written to disk immediately
+	// Flush to hand the data to the operating system immediately
 	if err := a.writer.Flush(); err != nil {
 		return fmt.Errorf("failed to flush AOF: %w", err)
 	}
 
-	// Sync to ensure data is persisted to disk
-	if err := a.file.Sync(); err != nil {
-		return fmt.Errorf("failed to sync AOF: %w", err)
+	switch a.fsync {
+	case FsyncAlways:
+		// Sync to ensure data is persisted to disk
+		if err := a.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync AOF: %w", err)
+		}
+	case FsyncEverySec:
+		a.unsynced = true // Synced by syncLoop
 	}
 
 	return nil
 }
 
+// currentSeq returns the sequence number of the last logged command.
+func (a *AOF) currentSeq() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.seq
+}
+
 // Replay reads the AOF file and replays all commands to restore the cache state.
 // This is called on startup to recover data from disk.
+//
+// Replay stops at the first record that is incomplete, fails its checksum, or
+// has an out-of-order sequence number, because everything after it can no
+// longer be trusted. By default the file is then truncated to the end of the
+// last good record and startup continues; if loading truncated AOFs is
+// disabled (WithAOFLoadTruncated(false)) an *AOFCorruptionError is returned.
+// A bad record in the preamble, or a preamble ending early, always returns an
+// *AOFCorruptionError and leaves the file alone: the snapshot isn't loaded
+// with a preamble, so truncating it would lose the dataset.
 func (a *AOF) Replay() error {
 	// Temporarily disable logging during replay to avoid infinite loops
 	a.enabled = false
@@ -154,59 +321,235 @@ func (a *AOF) Replay() error {
 	}
 	defer file.Close()
 
-	// Read and replay commands
-	scanner := bufio.NewScanner(file)
-	lineNum := 0
-	for scanner.Scan() {
-		lineNum++
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue // Skip empty lines
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat AOF file: %w", err)
+	}
+
+	reader, err := NewAOFReader(file)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	a.mu.Lock()
+	a.replay.running = true
+	a.replay.start = start
+	a.replay.fileSize = info.Size()
+	a.mu.Unlock()
+	defer a.finishReplay()
+
+	slog.Info("Loading AOF", "path", a.filePath, "bytes", info.Size())
+	lastLog := start
+
+	// A preamble holds the full dataset: start from it instead of the snapshot
+	var corruption *AOFCorruptionError
+	if reader.HasPreamble() {
+		count, createdAt, err := reader.Preamble()
+		var recErr *AOFRecordError
+		if errors.As(err, &recErr) {
+			a.replay.errors.Add(1)
+			corruption = &AOFCorruptionError{Record: 1, Offset: reader.offset, Reason: recErr.Reason}
+		} else if err != nil {
+			return fmt.Errorf("error reading AOF preamble: %w", err)
+		} else {
+			slog.Info("AOF preamble", "entries", count, "written_at", createdAt.Format(time.RFC3339))
+			a.cache.resetLocked()
+		}
+	}
+
+	// Read and replay commands until the end of the file or the first bad record
+	var lastSeq uint64
+	for corruption == nil {
+		offset, record := reader.offset, reader.records+1
+		cmd, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		var recErr *AOFRecordError
+		if errors.As(err, &recErr) {
+			a.replay.errors.Add(1)
+			corruption = &AOFCorruptionError{Record: record, Offset: offset, Reason: recErr.Reason}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading AOF file: %w", err)
 		}
 
-		var cmd AOFCommand
-		if err := json.Unmarshal([]byte(line), &cmd); err != nil {
-			fmt.Printf("Warning: Failed to parse AOF line %d: %v\n", lineNum, err)
-			continue
+		// Sequence numbers must increase; records from a rewrite's dataset have none
+		if cmd.Seq != 0 {
+			if cmd.Seq <= lastSeq {
+				a.replay.errors.Add(1)
+				corruption = &AOFCorruptionError{
+					Record: record,
+					Offset: offset,
+					Reason: fmt.Sprintf("sequence number %d after %d", cmd.Seq, lastSeq),
+				}
+				break
+			}
+			lastSeq = cmd.Seq
 		}
 
 		// Replay the command
 		switch cmd.Op {
 		case "SET":
-			ttl := time.Duration(cmd.TTL) * time.Second
-			a.cache.setInternal(cmd.Key, cmd.Value, ttl)
+			expiresAt := cmd.ExpiresAt
+			if expiresAt.IsZero() && cmd.TTL != 0 {
+				// Old records only have a relative TTL; the original write time is
+				// unknown. A negative TTL is already expired, like a past expiration time
+				expiresAt = a.cache.now().Add(time.Duration(cmd.TTL) * time.Second)
+			}
+			if !expiresAt.IsZero() && !a.cache.now().Before(expiresAt) {
+				// Already expired: the key must not come back, and any older value is gone too
+				a.cache.delInternal(cmd.Key)
+				continue
+			}
+			if !a.cache.loadWithinLimits(cmd.Key, len(cmd.Value)) {
+				// Over the limits: skipped, and the older value it replaced is gone too
+				a.cache.delInternal(cmd.Key)
+				continue
+			}
+			a.cache.setInternal(cmd.Key, []byte(cmd.Value), expiresAt, cmd.ContentType)
+			if !cmd.LastAccess.IsZero() {
+				a.cache.addKey(cmd.Key, cmd.LastAccess)
+			}
 		case "DEL":
 			a.cache.delInternal(cmd.Key)
 		default:
-			fmt.Printf("Warning: Unknown AOF operation '%s' on line %d\n", cmd.Op, lineNum)
+			a.replay.errors.Add(1)
+			slog.Warn("Unknown AOF operation", "op", cmd.Op, "record", reader.records)
+		}
+
+		a.replay.bytes.Store(reader.offset)
+		a.replay.commands.Add(1)
+		if !reader.InPreamble() {
+			a.replay.logged.Add(1)
+		}
+
+		// Log progress periodically so a long replay doesn't look stuck
+		if reader.records%1024 == 0 && time.Since(lastLog) >= aofReplayLogInterval {
+			lastLog = time.Now()
+			slog.Info("Loading AOF", "bytes", reader.offset, "total", info.Size(),
+				"percent", fmt.Sprintf("%.1f", 100*float64(reader.offset)/float64(max(info.Size(), 1))),
+				"commands", reader.records, "elapsed", time.Since(start).Round(time.Second))
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading AOF file: %w", err)
+	// The preamble restores saved access times in dataset order
+	a.cache.sortByAccessLocked()
+
+	if lastSeq > a.seq {
+		a.seq = lastSeq
+	}
+
+	if corruption != nil {
+		corruption.Path = a.filePath
+		if corruption.Preamble = !reader.PreambleDone(); corruption.Preamble {
+			return corruption
+		}
+		corruption.Discarded = info.Size() - corruption.Offset
+
+		a.mu.Lock()
+		a.replay.discarded = corruption.Discarded
+		a.mu.Unlock()
+
+		if !a.cache.aofLoadTruncated {
+			return corruption
+		}
+
+		slog.Warn("Truncating corrupted AOF", "err", corruption, "size", corruption.Offset)
+		file.Close()
+		if err := os.Truncate(a.filePath, corruption.Offset); err != nil {
+			return fmt.Errorf("failed to truncate corrupted AOF: %w", err)
+		}
 	}
 
+	// Legacy JSON files can't be appended to in the binary format; NewCache
+	// converts them with a rewrite once replay has finished
+	a.needsConversion = reader.legacy && (corruption == nil || corruption.Offset > 0)
+
 	// Reopen file for writing
 	return a.reopenForWriting()
 }
 
+// finishReplay records the end of the replay and logs a summary.
+func (a *AOF) finishReplay() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.replay.running = false
+	a.replay.duration = time.Since(a.replay.start)
+	slog.Info("AOF loaded", "commands", a.replay.commands.Load(), "bytes", a.replay.bytes.Load(),
+		"duration", a.replay.duration.Round(time.Millisecond), "errors", a.replay.errors.Load())
+}
+
+// replayStats returns a copy of the replay progress.
+func (a *AOF) replayStats() AOFReplayStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats := AOFReplayStats{
+		InProgress:     a.replay.running,
+		FileSize:       a.replay.fileSize,
+		BytesProcessed: a.replay.bytes.Load(),
+		Commands:       a.replay.commands.Load(),
+		Errors:         a.replay.errors.Load(),
+		Discarded:      a.replay.discarded,
+		Duration:       a.replay.duration,
+	}
+	if a.replay.running {
+		stats.Duration = time.Since(a.replay.start)
+	}
+	return stats
+}
+
 // reopenForWriting reopens the AOF file in append mode for writing.
+// The current file size becomes the new base size for automatic rewrites.
 func (a *AOF) reopenForWriting() error {
 	file, err := os.OpenFile(a.filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to reopen AOF file for writing: %w", err)
 	}
 
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat AOF file: %w", err)
+	}
+
 	a.file = file
 	a.writer = bufio.NewWriter(file)
+	a.size = info.Size()
+
+	// A new or truncated file starts with the format header
+	if a.size == 0 {
+		if _, err := a.writer.WriteString(aofMagic); err != nil {
+			return fmt.Errorf("failed to write AOF header: %w", err)
+		}
+		if err := a.writer.Flush(); err != nil {
+			return fmt.Errorf("failed to write AOF header: %w", err)
+		}
+		a.size = int64(len(aofMagic))
+	}
+
+	a.baseSize = a.size
 	return nil
 }
 
-// Close gracefully closes the AOF file.
+// Close gracefully closes the AOF file, syncing what syncLoop hasn't yet.
 func (a *AOF) Close() error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
+	if a.closed {
+		return nil // Already closed (e.g. by shutdown, then by a deferred Close)
+	}
+	a.closed = true
+
+	if a.syncStop != nil {
+		close(a.syncStop) // syncLoop returns once it sees closed
+	}
+
 	if a.writer != nil {
 		if err := a.writer.Flush(); err != nil {
 			return err
@@ -214,6 +557,12 @@ func (a *AOF) Close() error {
 	}
 
 	if a.file != nil {
+		if a.unsynced {
+			if err := a.file.Sync(); err != nil {
+				a.file.Close()
+				return fmt.Errorf("failed to sync AOF: %w", err)
+			}
+		}
 		return a.file.Close()
 	}
 
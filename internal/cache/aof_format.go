@@ -0,0 +1,662 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"time"
+	"unsafe"
+)
+
+// AOF file format.
+//
+// The AOF starts with the magic header aofMagic, followed by length-prefixed
+// binary records, so keys and values may contain arbitrary bytes (newlines,
+// NUL bytes, invalid UTF-8) and have no size limit other than maxAOFRecordSize:
+//
+//	uvarint  payload length
+//	uint32   CRC32 (IEEE, big endian) of the payload
+//	payload  uvarint seq, byte op, uvarint key length, key,
+//	         and for SET: uvarint value length, value, varint expiration time
+//	         (Unix nanoseconds, 0 = no expiry)
+//
+// SET records written by a rewrite use the SETACCESS operation code and also
+// store the key's last access time (varint Unix nanoseconds) after the
+// expiration time, so LRU order survives recovery from the AOF alone.
+//
+// SET records of values with a content type use the SETTYPE operation code
+// and store the last access time (varint Unix nanoseconds, 0 = unknown) and
+// the content type (uvarint length, content type) after the expiration time.
+//
+// DEL records of keys that weren't deleted by a client use the DELREASON
+// operation code and store the reason (uvarint length, reason) after the key,
+// e.g. "evicted", so an AOF shows why keys disappeared.
+//
+// Records with the older SETTTL operation code store a relative TTL in
+// seconds instead of the expiration time; they are still read, but never written.
+//
+// A file written by a rewrite starts with a preamble: the full dataset at the
+// time of the rewrite, so the file is self-contained and replay doesn't need
+// the separate snapshot file. The preamble consists of aofPreambleMagic, a
+// framed header record (uvarint entry count, varint creation time in Unix
+// nanoseconds), and that many SET records with sequence number 0. Commands
+// logged after the rewrite follow as normal records.
+//
+// Files without the magic header are legacy line-delimited JSON files, either
+// plain ("{...}") or with a checksum prefix ("<crc32 hex> {...}"). They are
+// still replayed and then converted by rewriting the AOF on startup.
+
+// aofMagic is the header identifying a binary AOF file.
+const aofMagic = "MRAOF2\n"
+
+// aofPreambleMagic marks the start of a dataset preamble right after aofMagic.
+const aofPreambleMagic = "MRPREAMBLE\n"
+
+// maxAOFRecordSize bounds the payload length read from disk, so a corrupted
+// length prefix can't trigger a huge allocation.
+const maxAOFRecordSize = 1 << 30
+
+// Binary operation codes.
+const (
+	aofOpSetTTL    byte = 1 // SET with a relative TTL in seconds (read only)
+	aofOpDel       byte = 2 // DEL
+	aofOpSet       byte = 3 // SET with an absolute expiration time
+	aofOpSetAccess byte = 4 // SET with an absolute expiration time and the last access time
+	aofOpDelReason byte = 5 // DEL with the reason the key was removed
+	aofOpSetType   byte = 6 // SET with an absolute expiration time, the last access time, and the content type
+)
+
+// aofChecksumLen is the length of the hex-encoded CRC32 prefix of legacy checksummed lines.
+const aofChecksumLen = 8
+
+// AOFRecordError describes a record that can't be trusted (incomplete, corrupted, or malformed).
+type AOFRecordError struct {
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *AOFRecordError) Error() string {
+	return e.Reason
+}
+
+// badRecord returns an *AOFRecordError with a formatted reason.
+func badRecord(format string, args ...any) error {
+	return &AOFRecordError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// encodeCommand writes a single command as a checksummed binary record to w.
+// The value is written from cmd as is, without copying it into the payload,
+// so logging a large value doesn't hold a second copy of it in memory.
+// Returns the number of bytes written.
+func encodeCommand(w *bufio.Writer, cmd AOFCommand) (int, error) {
+	head, value, tail, err := marshalCommand(cmd)
+	if err != nil {
+		return 0, err
+	}
+	return writeRecord(w, head, value, tail)
+}
+
+// writePreamble writes the preamble magic and header for count entries.
+// Returns the number of bytes written.
+func writePreamble(w *bufio.Writer, count int, createdAt time.Time) (int, error) {
+	if _, err := w.WriteString(aofPreambleMagic); err != nil {
+		return 0, fmt.Errorf("failed to write AOF preamble: %w", err)
+	}
+
+	payload := binary.AppendUvarint(nil, uint64(count))
+	payload = binary.AppendVarint(payload, createdAt.UnixNano())
+	n, err := writeFrame(w, payload)
+	if err != nil {
+		return 0, err
+	}
+	return len(aofPreambleMagic) + n, nil
+}
+
+// writeFrame writes a payload with its length prefix and checksum.
+// Returns the number of bytes written.
+func writeFrame(w *bufio.Writer, payload []byte) (int, error) {
+	return writeRecord(w, payload, "", nil)
+}
+
+// writeRecord writes the payload head, value, tail with its length prefix
+// and checksum, computed over the three parts in turn. Returns the number
+// of bytes written.
+func writeRecord(w *bufio.Writer, head []byte, value string, tail []byte) (int, error) {
+	length := len(head) + len(value) + len(tail)
+	crc := crc32.ChecksumIEEE(head)
+	crc = crc32.Update(crc, crc32.IEEETable, unsafe.Slice(unsafe.StringData(value), len(value)))
+	crc = crc32.Update(crc, crc32.IEEETable, tail)
+
+	var header [binary.MaxVarintLen64 + 4]byte
+	n := binary.PutUvarint(header[:], uint64(length))
+	binary.BigEndian.PutUint32(header[n:], crc)
+	n += 4
+
+	if _, err := w.Write(header[:n]); err != nil {
+		return 0, fmt.Errorf("failed to write record header to AOF: %w", err)
+	}
+
+	if _, err := w.Write(head); err != nil {
+		return 0, fmt.Errorf("failed to write to AOF: %w", err)
+	}
+	if _, err := w.WriteString(value); err != nil {
+		return 0, fmt.Errorf("failed to write to AOF: %w", err)
+	}
+	if _, err := w.Write(tail); err != nil {
+		return 0, fmt.Errorf("failed to write to AOF: %w", err)
+	}
+
+	return n + length, nil
+}
+
+// marshalCommand encodes the payload of a binary record in three parts:
+// the fields before the value, the value (empty without one), and the
+// fields after it.
+func marshalCommand(cmd AOFCommand) (head []byte, value string, tail []byte, err error) {
+	var op byte
+	switch cmd.Op {
+	case "SET":
+		op = aofOpSet
+		if cmd.ContentType != "" {
+			op = aofOpSetType
+		} else if !cmd.LastAccess.IsZero() {
+			op = aofOpSetAccess
+		}
+	case "DEL":
+		op = aofOpDel
+		if cmd.Reason != "" {
+			op = aofOpDelReason
+		}
+	default:
+		return nil, "", nil, fmt.Errorf("unknown AOF operation '%s'", cmd.Op)
+	}
+
+	buf := make([]byte, 0, 6*binary.MaxVarintLen64+1+len(cmd.Key)+len(cmd.ContentType)+len(cmd.Reason))
+	buf = binary.AppendUvarint(buf, cmd.Seq)
+	buf = append(buf, op)
+	buf = appendBytes(buf, cmd.Key)
+	if op == aofOpDelReason {
+		buf = appendBytes(buf, cmd.Reason)
+	}
+	if op == aofOpDel || op == aofOpDelReason {
+		return buf, "", nil, nil
+	}
+
+	// SET: the value's length ends the head, and the fields after it
+	// start the tail, in the same buffer
+	buf = binary.AppendUvarint(buf, uint64(len(cmd.Value)))
+	head = buf
+	buf = buf[len(buf):]
+	var expiresAt int64
+	if !cmd.ExpiresAt.IsZero() {
+		expiresAt = cmd.ExpiresAt.UnixNano()
+	}
+	buf = binary.AppendVarint(buf, expiresAt)
+	if op == aofOpSetAccess {
+		buf = binary.AppendVarint(buf, cmd.LastAccess.UnixNano())
+	}
+	if op == aofOpSetType {
+		buf = binary.AppendVarint(buf, unixNano(cmd.LastAccess))
+		buf = appendBytes(buf, cmd.ContentType)
+	}
+	return head, cmd.Value, buf, nil
+}
+
+// unmarshalCommand decodes the payload of a binary record.
+func unmarshalCommand(payload []byte) (AOFCommand, error) {
+	var cmd AOFCommand
+	d := payloadDecoder{buf: payload}
+
+	cmd.Seq = d.uvarint()
+	op := d.byte()
+	cmd.Key = d.string()
+
+	switch op {
+	case aofOpSet:
+		cmd.Op = "SET"
+		cmd.Value = d.string()
+		if expiresAt := d.varint(); expiresAt != 0 {
+			cmd.ExpiresAt = time.Unix(0, expiresAt)
+		}
+	case aofOpSetAccess:
+		cmd.Op = "SET"
+		cmd.Value = d.string()
+		if expiresAt := d.varint(); expiresAt != 0 {
+			cmd.ExpiresAt = time.Unix(0, expiresAt)
+		}
+		cmd.LastAccess = time.Unix(0, d.varint())
+	case aofOpSetType:
+		cmd.Op = "SET"
+		cmd.Value = d.string()
+		if expiresAt := d.varint(); expiresAt != 0 {
+			cmd.ExpiresAt = time.Unix(0, expiresAt)
+		}
+		cmd.LastAccess = fromUnixNano(d.varint())
+		cmd.ContentType = d.string()
+	case aofOpSetTTL:
+		cmd.Op = "SET"
+		cmd.Value = d.string()
+		cmd.TTL = int(d.varint())
+	case aofOpDel:
+		cmd.Op = "DEL"
+	case aofOpDelReason:
+		cmd.Op = "DEL"
+		cmd.Reason = d.string()
+	default:
+		if d.err == nil {
+			return cmd, badRecord("unknown operation code %d", op)
+		}
+	}
+
+	if d.err != nil {
+		return cmd, d.err
+	}
+	if len(d.buf) != 0 {
+		return cmd, badRecord("%d trailing bytes in record", len(d.buf))
+	}
+
+	return cmd, nil
+}
+
+// appendBytes appends a length-prefixed string to buf.
+func appendBytes(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// payloadDecoder reads fields from a record payload, remembering the first error.
+type payloadDecoder struct {
+	buf []byte
+	err error
+}
+
+// uvarint reads an unsigned varint.
+func (d *payloadDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = badRecord("malformed varint in record")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// varint reads a signed varint.
+func (d *payloadDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = badRecord("malformed varint in record")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// byte reads a single byte.
+func (d *payloadDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) == 0 {
+		d.err = badRecord("record too short")
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+// string reads a length-prefixed string.
+func (d *payloadDecoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = badRecord("field length %d exceeds record", n)
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+// AOFReader reads AOF records sequentially from either format, tracking the
+// byte offset of the next record so callers can truncate after a bad record.
+// It is used by Replay and by tools that inspect AOF files offline.
+type AOFReader struct {
+	r          *bufio.Reader
+	legacy     bool  // File uses the legacy JSON line format
+	tornHeader bool  // File contains an incomplete binary header
+	offset     int64 // Offset of the next record (end of the last good record)
+	records    int   // Number of records read successfully
+
+	hasPreamble   bool      // File starts with a dataset preamble
+	preambleRead  bool      // Preamble header has been read
+	preambleCount int       // Number of entries in the preamble
+	preambleTime  time.Time // When the preamble was written
+	preambleLeft  int       // Preamble entries not yet returned by Next
+	inPreamble    bool      // Last record returned by Next belongs to the preamble
+}
+
+// NewAOFReader detects the file format and returns a reader positioned at the first record.
+// r must be positioned at the start of the file.
+func NewAOFReader(r io.Reader) (*AOFReader, error) {
+	ar := &AOFReader{r: bufio.NewReader(r)}
+
+	head, err := ar.r.Peek(len(aofMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read AOF header: %w", err)
+	}
+
+	switch {
+	case string(head) == aofMagic:
+		ar.r.Discard(len(aofMagic))
+		ar.offset = int64(len(aofMagic))
+
+		// Detect a dataset preamble written by a rewrite
+		pre, err := ar.r.Peek(len(aofPreambleMagic))
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read AOF header: %w", err)
+		}
+		if string(pre) == aofPreambleMagic {
+			ar.r.Discard(len(aofPreambleMagic))
+			ar.hasPreamble = true
+		}
+	case len(head) == 0:
+		// Empty file
+	case bytes.HasPrefix([]byte(aofMagic), head):
+		// The header write itself was interrupted
+		ar.tornHeader = true
+	default:
+		ar.legacy = true
+	}
+
+	return ar, nil
+}
+
+// newAOFStreamReader returns a reader for a live stream of records, such as a
+// replication stream, which starts with aofMagic. Unlike NewAOFReader it
+// never reads ahead of the header, so it doesn't block while the stream is idle.
+func newAOFStreamReader(r io.Reader) (*AOFReader, error) {
+	ar := &AOFReader{r: bufio.NewReader(r)}
+
+	head := make([]byte, len(aofMagic))
+	if _, err := io.ReadFull(ar.r, head); err != nil {
+		return nil, readError(err)
+	}
+	if string(head) != aofMagic {
+		return nil, badRecord("invalid stream header")
+	}
+
+	ar.offset = int64(len(aofMagic))
+	return ar, nil
+}
+
+// Next returns the next command. It returns io.EOF at the clean end of the
+// file and an *AOFRecordError for a record that can't be trusted.
+func (ar *AOFReader) Next() (AOFCommand, error) {
+	if ar.tornHeader {
+		return AOFCommand{}, badRecord("incomplete file header")
+	}
+	if ar.legacy {
+		return ar.nextLegacy()
+	}
+
+	if ar.hasPreamble && !ar.preambleRead {
+		if _, _, err := ar.Preamble(); err != nil {
+			return AOFCommand{}, err
+		}
+	}
+
+	cmd, err := ar.nextBinary()
+	if err == io.EOF && ar.preambleLeft > 0 {
+		return cmd, badRecord("incomplete preamble (%d entries missing)", ar.preambleLeft)
+	}
+	if err != nil {
+		return cmd, err
+	}
+
+	ar.inPreamble = ar.preambleLeft > 0
+	if ar.inPreamble {
+		ar.preambleLeft--
+	}
+	return cmd, nil
+}
+
+// HasPreamble reports whether the file starts with a dataset preamble.
+func (ar *AOFReader) HasPreamble() bool {
+	return ar.hasPreamble
+}
+
+// Preamble reads the preamble header and returns the number of entries and
+// when the preamble was written. The entries themselves are then returned by
+// Next as SET commands. It returns zero values if the file has no preamble.
+func (ar *AOFReader) Preamble() (int, time.Time, error) {
+	if !ar.hasPreamble || ar.preambleRead {
+		return ar.preambleCount, ar.preambleTime, nil
+	}
+
+	payload, n, err := ar.readFrame()
+	if err == io.EOF {
+		return 0, time.Time{}, badRecord("incomplete preamble")
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	d := payloadDecoder{buf: payload}
+	count := d.uvarint()
+	createdAt := d.varint()
+	if d.err != nil {
+		return 0, time.Time{}, d.err
+	}
+
+	ar.preambleRead = true
+	ar.preambleCount = int(count)
+	ar.preambleLeft = int(count)
+	ar.preambleTime = time.Unix(0, createdAt)
+	ar.offset += int64(len(aofPreambleMagic) + n)
+	return ar.preambleCount, ar.preambleTime, nil
+}
+
+// PreambleDone reports whether the preamble header and all its entries have
+// been read, or the file has no preamble.
+func (ar *AOFReader) PreambleDone() bool {
+	return !ar.hasPreamble || ar.preambleRead && ar.preambleLeft == 0
+}
+
+// InPreamble reports whether the last record returned by Next belongs to the preamble.
+func (ar *AOFReader) InPreamble() bool {
+	return ar.inPreamble
+}
+
+// Offset returns the byte offset of the next record, i.e. the end of the last good record.
+func (ar *AOFReader) Offset() int64 {
+	return ar.offset
+}
+
+// Records returns the number of records read successfully.
+func (ar *AOFReader) Records() int {
+	return ar.records
+}
+
+// Legacy reports whether the file uses the legacy line-delimited JSON format.
+func (ar *AOFReader) Legacy() bool {
+	return ar.legacy
+}
+
+// Reset discards buffered data and continues reading from r, which must be
+// positioned at Offset(). This allows following a file that is still being
+// written: after io.EOF or an incomplete record, seek back to Offset() and retry.
+func (ar *AOFReader) Reset(r io.Reader) {
+	ar.r.Reset(r)
+}
+
+// nextBinary reads a length-prefixed binary record.
+func (ar *AOFReader) nextBinary() (AOFCommand, error) {
+	payload, n, err := ar.readFrame()
+	if err != nil {
+		return AOFCommand{}, err
+	}
+
+	cmd, err := unmarshalCommand(payload)
+	if err != nil {
+		return cmd, err
+	}
+
+	ar.offset += int64(n)
+	ar.records++
+	return cmd, nil
+}
+
+// readFrame reads a length-prefixed, checksummed payload and returns it
+// together with the total number of bytes read. It returns io.EOF only if
+// the file ends exactly before the frame.
+func (ar *AOFReader) readFrame() ([]byte, int, error) {
+	// Read the payload length, counting the bytes of the varint
+	var length uint64
+	var shift uint
+	headerLen := 0
+	for {
+		b, err := ar.r.ReadByte()
+		if err == io.EOF {
+			if headerLen == 0 {
+				return nil, 0, io.EOF
+			}
+			return nil, 0, badRecord("incomplete record")
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		headerLen++
+		if headerLen > binary.MaxVarintLen64 {
+			return nil, 0, badRecord("malformed record length")
+		}
+		length |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			break
+		}
+		shift += 7
+	}
+
+	if length > maxAOFRecordSize {
+		return nil, 0, badRecord("record length %d exceeds limit", length)
+	}
+
+	var sum [4]byte
+	if _, err := io.ReadFull(ar.r, sum[:]); err != nil {
+		return nil, 0, readError(err)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ar.r, payload); err != nil {
+		return nil, 0, readError(err)
+	}
+
+	want := binary.BigEndian.Uint32(sum[:])
+	if got := crc32.ChecksumIEEE(payload); got != want {
+		return nil, 0, badRecord("checksum mismatch (expected %08x, got %08x)", want, got)
+	}
+
+	return payload, headerLen + len(sum) + len(payload), nil
+}
+
+// nextLegacy reads a JSON line, skipping empty lines.
+func (ar *AOFReader) nextLegacy() (AOFCommand, error) {
+	for {
+		line, err := ar.r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return AOFCommand{}, io.EOF
+		}
+		if err == io.EOF {
+			// The last line has no newline: the write was interrupted
+			return AOFCommand{}, badRecord("incomplete record")
+		}
+		if err != nil {
+			return AOFCommand{}, err
+		}
+
+		trimmed := bytes.TrimSpace(line)
+		if len(trimmed) == 0 {
+			ar.offset += int64(len(line))
+			continue // Skip empty lines
+		}
+
+		cmd, err := decodeLegacyCommand(trimmed)
+		if err != nil {
+			return cmd, err
+		}
+
+		ar.offset += int64(len(line))
+		ar.records++
+		return cmd, nil
+	}
+}
+
+// readError converts an unexpected end of file into a bad record error.
+func readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return badRecord("incomplete record")
+	}
+	return err
+}
+
+// decodeLegacyCommand parses a legacy JSON AOF line (without the trailing newline).
+// Lines starting with '{' were written before checksums were added and are
+// accepted without verification.
+func decodeLegacyCommand(line []byte) (AOFCommand, error) {
+	var cmd AOFCommand
+
+	payload := line
+	if line[0] != '{' {
+		if len(line) < aofChecksumLen+1 || line[aofChecksumLen] != ' ' {
+			return cmd, badRecord("malformed record")
+		}
+		want, err := strconv.ParseUint(string(line[:aofChecksumLen]), 16, 32)
+		if err != nil {
+			return cmd, badRecord("malformed checksum: %v", err)
+		}
+		payload = line[aofChecksumLen+1:]
+		if got := crc32.ChecksumIEEE(payload); got != uint32(want) {
+			return cmd, badRecord("checksum mismatch (expected %08x, got %08x)", want, got)
+		}
+	}
+
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		return cmd, badRecord("invalid JSON: %v", err)
+	}
+
+	return cmd, nil
+}
+
+// aofHasPreamble reports whether the AOF file at path starts with a dataset preamble.
+// A missing file has no preamble.
+func aofHasPreamble(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to open AOF file: %w", err)
+	}
+	defer file.Close()
+
+	reader, err := NewAOFReader(file)
+	if err != nil {
+		return false, err
+	}
+	return reader.HasPreamble(), nil
+}
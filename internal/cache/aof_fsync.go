@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// AOF fsync policy.
+//
+// Like the Redis "appendfsync" directive, the fsync policy (WithAOFFsync)
+// trades durability for write throughput. Every write is handed to the
+// operating system before it is acknowledged, so a crash of the server
+// process loses nothing with any policy; the policy decides what a crash or
+// power loss of the machine can lose:
+//   - FsyncAlways syncs the file after every write (or batch): nothing.
+//   - FsyncEverySec syncs it once per second in the background: up to a
+//     second of writes.
+//   - FsyncNo leaves syncing to the operating system, typically every 30
+//     seconds on Linux.
+//
+// SetAOFFsync changes the policy of a running cache; the writes not synced
+// under the old policy are synced right away.
+
+// FsyncPolicy selects when AOF writes are synced to disk.
+type FsyncPolicy int
+
+const (
+	FsyncAlways   FsyncPolicy = iota // Sync after every write (default)
+	FsyncEverySec                    // Sync once per second
+	FsyncNo                          // Let the operating system sync
+)
+
+// aofSyncInterval is how often the AOF is synced with FsyncEverySec.
+const aofSyncInterval = time.Second
+
+// String returns the name of the policy, as accepted by ParseFsyncPolicy.
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncAlways:
+		return "always"
+	case FsyncEverySec:
+		return "everysec"
+	case FsyncNo:
+		return "no"
+	default:
+		return fmt.Sprintf("FsyncPolicy(%d)", int(p))
+	}
+}
+
+// ParseFsyncPolicy parses a policy name: "always", "everysec", or "no".
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch s {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec":
+		return FsyncEverySec, nil
+	case "no":
+		return FsyncNo, nil
+	default:
+		return 0, fmt.Errorf("unknown fsync policy %q (must be always, everysec, or no)", s)
+	}
+}
+
+// AOFFsync returns the fsync policy of the AOF.
+func (c *Cache) AOFFsync() FsyncPolicy {
+	if c.aof == nil {
+		return c.aofFsync
+	}
+	c.aof.mu.Lock()
+	defer c.aof.mu.Unlock()
+	return c.aof.fsync
+}
+
+// SetAOFFsync changes the fsync policy of the AOF. It fails without
+// persistence.
+func (c *Cache) SetAOFFsync(policy FsyncPolicy) error {
+	if policy < FsyncAlways || policy > FsyncNo {
+		return fmt.Errorf("invalid fsync policy %v", policy)
+	}
+	if c.aof == nil {
+		return ErrPersistenceDisabled
+	}
+	a := c.aof
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.fsync == policy || a.closed {
+		return nil
+	}
+
+	if a.syncStop != nil {
+		close(a.syncStop)
+		a.syncStop = nil
+	}
+	a.fsync = policy
+	if policy == FsyncEverySec {
+		a.syncStop = make(chan struct{})
+		go a.syncLoop(a.syncStop)
+	}
+	if err := a.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush AOF: %w", err)
+	}
+	if a.file != nil {
+		if err := a.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync AOF: %w", err)
+		}
+	}
+	a.unsynced = false
+	return nil
+}
+
+// syncLoop syncs the file once per aofSyncInterval if anything was written
+// since the last sync, until stop is closed by Close or SetAOFFsync. It runs
+// with FsyncEverySec.
+func (a *AOF) syncLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(aofSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		a.mu.Lock()
+		if a.unsynced && !a.closed && a.file != nil {
+			if err := a.file.Sync(); err != nil {
+				slog.Error("AOF sync error", "err", err)
+				a.writeErr = err
+			} else {
+				a.unsynced = false
+				a.writeErr = nil
+			}
+		}
+		a.mu.Unlock()
+	}
+}
@@ -0,0 +1,476 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRewriteInProgress is returned when an AOF rewrite is requested while another one is running.
+var ErrRewriteInProgress = errors.New("AOF rewrite already in progress")
+
+// AOF rewrite (compaction), similar to Redis BGREWRITEAOF.
+//
+// Over time the AOF accumulates commands for keys that were later overwritten
+// or deleted. A rewrite replaces the file with a preamble holding the current
+// live dataset (see aof_format.go), followed by the commands logged since, so
+// the new file is self-contained and replay ignores the snapshot file:
+// - The live dataset is copied under a brief cache read lock, and at the same
+//   moment the AOF starts collecting new commands into a rewrite buffer
+// - The copy is written to a temporary file without holding any cache lock,
+//   so Set/Get/Del keep running while the (slow) disk writes happen
+// - Commands logged during the rewrite still go to the old file (so a failed
+//   rewrite loses nothing) and are also kept in the rewrite buffer
+// - Finally, under the AOF lock, the buffer is appended to the temporary file,
+//   which is then atomically renamed over the old AOF and the writer is swapped
+
+// aofRewrite holds the state of a rewrite that is currently running.
+type aofRewrite struct {
+	buffer  []AOFCommand // Commands logged since the dataset copy was taken
+	start   time.Time    // When the rewrite started
+	total   int64        // Number of entries in the dataset copy
+	written atomic.Int64 // Number of entries written to the temporary file so far
+	toggle  bool         // Turn the AOF on or off once the files are swapped (see aof_toggle.go)
+	enable  bool         // Whether toggle turns it on
+}
+
+// AOFRewriteStats describes the current and last AOF rewrite.
+type AOFRewriteStats struct {
+	InProgress      bool          // Whether a rewrite is currently running
+	CurrentWritten  int64         // Entries written so far by the running rewrite
+	CurrentTotal    int64         // Total entries to write in the running rewrite
+	CurrentBuffered int           // Commands buffered while the running rewrite writes the dataset
+	Count           int           // Number of successful rewrites since startup
+	LastStatus      string        // "ok", "err", or empty if no rewrite has finished yet
+	LastError       string        // Error message of the last failed rewrite
+	LastTime        time.Time     // When the last rewrite finished
+	LastDuration    time.Duration // How long the last rewrite took
+	LastSize        int64         // Size of the AOF file produced by the last successful rewrite
+	CurrentSize     int64         // Current size of the AOF file
+	BaseSize        int64         // Size of the AOF file after the last rewrite or startup
+}
+
+// rewriteEntry is a point-in-time copy of a single live key used by the rewrite.
+type rewriteEntry struct {
+	key         string
+	value       string
+	expiresAt   time.Time
+	lastAccess  time.Time
+	contentType string
+}
+
+// RewriteAOF compacts the AOF file by rewriting it from the current live dataset.
+// Writers are only blocked while the dataset is copied and while the final
+// buffered commands are appended, not for the whole duration of the rewrite.
+func (c *Cache) RewriteAOF() error {
+	if c.aof == nil {
+		return nil
+	}
+
+	entries, err := c.beginAOFRewrite()
+	if err != nil {
+		return err
+	}
+
+	return c.aof.finishRewrite(entries)
+}
+
+// BackgroundRewriteAOF starts an AOF rewrite in a background goroutine.
+// It returns ErrRewriteInProgress if a rewrite is already running; the result
+// of the rewrite itself is reported through AOFRewriteStats.
+func (c *Cache) BackgroundRewriteAOF() error {
+	if c.aof == nil {
+		return nil
+	}
+
+	entries, err := c.beginAOFRewrite()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := c.aof.finishRewrite(entries); err != nil {
+			slog.Error("AOF rewrite failed", "err", err)
+		}
+	}()
+
+	return nil
+}
+
+// AOFRewriteStats returns progress and statistics about AOF rewrites.
+func (c *Cache) AOFRewriteStats() AOFRewriteStats {
+	if c.aof == nil {
+		return AOFRewriteStats{}
+	}
+	return c.aof.rewriteStats()
+}
+
+// beginAOFRewrite copies the live dataset and starts buffering new AOF commands.
+// The read locks on all shards guarantee that no write can slip in between the
+// copy and the start of buffering, because every write logs to the AOF while
+// holding its shard's write lock. The read buffers are drained first, so the
+// copy has the latest access times.
+func (c *Cache) beginAOFRewrite() ([]rewriteEntry, error) {
+	c.drainAccesses()
+	c.rlockAll()
+	defer c.runlockAll()
+
+	entries := c.rewriteEntriesLocked()
+	if err := c.aof.startRewrite(int64(len(entries))); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// rewriteEntriesLocked copies the live dataset (must be called with all
+// shards locked).
+func (c *Cache) rewriteEntriesLocked() []rewriteEntry {
+	entries := make([]rewriteEntry, 0, c.keyCountLocked())
+	for _, s := range c.shards {
+		for key, value := range s.data {
+			if s.isExpired(key) {
+				continue // Skip expired keys, they are not part of the live dataset
+			}
+			entries = append(entries, rewriteEntry{
+				key:         key,
+				value:       valueString(value),
+				expiresAt:   s.expires[key],
+				lastAccess:  s.lru.lastAccess(key),
+				contentType: s.meta[key].contentTypeString(),
+			})
+		}
+	}
+	return entries
+}
+
+// startRewrite marks a rewrite as running so that new commands get buffered.
+func (a *AOF) startRewrite(total int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rewrite != nil {
+		return ErrRewriteInProgress
+	}
+
+	a.rewrite = &aofRewrite{
+		start: time.Now(),
+		total: total,
+	}
+	return nil
+}
+
+// finishRewrite writes the dataset copy to a temporary file, appends the
+// commands buffered in the meantime, and atomically replaces the AOF file.
+func (a *AOF) finishRewrite(entries []rewriteEntry) error {
+	err := a.writeRewrite(entries)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rw := a.rewrite
+	a.rewrite = nil
+	a.lastRewrite.LastTime = time.Now()
+	a.lastRewrite.LastDuration = time.Since(rw.start)
+
+	if err != nil {
+		a.lastRewrite.LastStatus = "err"
+		a.lastRewrite.LastError = err.Error()
+		return err
+	}
+
+	a.lastRewrite.LastStatus = "ok"
+	a.lastRewrite.LastError = ""
+	a.lastRewrite.Count++
+	return nil
+}
+
+// writeRewrite performs the actual file work of a rewrite.
+// The dataset is written without holding the AOF lock; the lock is only taken
+// to append the buffered commands and swap the files.
+func (a *AOF) writeRewrite(entries []rewriteEntry) error {
+	tmpPath := a.filePath + ".rewrite.tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create AOF rewrite file: %w", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+
+	a.mu.Lock()
+	rw := a.rewrite
+	a.mu.Unlock()
+
+	if _, err := writer.WriteString(aofMagic); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write AOF rewrite header: %w", err)
+	}
+
+	// Write the dataset copy as a preamble of SET commands, including the
+	// access times so LRU order survives recovery from the AOF alone
+	if _, err := writePreamble(writer, len(entries), rw.start); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	for _, entry := range entries {
+		cmd := AOFCommand{
+			Op:          "SET",
+			Key:         entry.key,
+			Value:       entry.value,
+			ExpiresAt:   entry.expiresAt,
+			LastAccess:  entry.lastAccess,
+			ContentType: entry.contentType,
+		}
+		if _, err := encodeCommand(writer, cmd); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		rw.written.Add(1)
+	}
+
+	// Append commands buffered during the rewrite and swap the files
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		os.Remove(tmpPath)
+		return fmt.Errorf("AOF was closed during rewrite")
+	}
+
+	for _, cmd := range rw.buffer {
+		if _, err := encodeCommand(writer, cmd); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to flush AOF rewrite file: %w", err)
+	}
+
+	if err := file.Sync(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync AOF rewrite file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to stat AOF rewrite file: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close AOF rewrite file: %w", err)
+	}
+
+	// Flush the old file so nothing is left in its buffer before it is replaced
+	if a.writer != nil {
+		a.writer.Flush()
+	}
+
+	if err := os.Rename(tmpPath, a.filePath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename AOF rewrite file: %w", err)
+	}
+
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+
+	if err := a.reopenForWriting(); err != nil {
+		return err
+	}
+	if rw.toggle {
+		a.paused = !rw.enable
+	}
+
+	a.lastRewrite.LastSize = info.Size()
+	return nil
+}
+
+// rewriteStats returns a copy of the rewrite statistics.
+func (a *AOF) rewriteStats() AOFRewriteStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats := a.lastRewrite
+	stats.CurrentSize = a.size
+	stats.BaseSize = a.baseSize
+	if a.rewrite != nil {
+		stats.InProgress = true
+		stats.CurrentWritten = a.rewrite.written.Load()
+		stats.CurrentTotal = a.rewrite.total
+		stats.CurrentBuffered = len(a.rewrite.buffer)
+	}
+	return stats
+}
+
+// Default thresholds for automatic AOF rewrites.
+const (
+	DefaultAOFRewriteGrowthMultiple = 2.0      // Rewrite when the AOF is twice its size after the last rewrite
+	DefaultAOFRewriteMinSize        = 16 << 20 // Never rewrite automatically below 16MB
+
+	aofRewriteMinBackoff = 10 * time.Second // Wait after the first failed automatic rewrite
+	aofRewriteMaxBackoff = 10 * time.Minute // Upper bound for the backoff after repeated failures
+)
+
+// AOFRewriteManager triggers AOF rewrites automatically when the file has grown
+// too much since the last rewrite (or startup), similar to Redis
+// auto-aof-rewrite-percentage and auto-aof-rewrite-min-size.
+type AOFRewriteManager struct {
+	cache          *Cache
+	interval       time.Duration // How often the AOF size is checked
+	mu             sync.Mutex
+	growthMultiple float64       // Rewrite when size > growthMultiple * base size
+	minSize        int64         // Rewrite only when size >= minSize
+	backoff        time.Duration // Current backoff after failed rewrites (0 = none)
+	nextAttempt    time.Time     // Earliest time for the next automatic rewrite
+	stopChan       chan struct{}
+	running        bool
+}
+
+// NewAOFRewriteManager creates a new automatic AOF rewrite manager with default thresholds.
+func NewAOFRewriteManager(cache *Cache, interval time.Duration) *AOFRewriteManager {
+	return &AOFRewriteManager{
+		cache:          cache,
+		interval:       interval,
+		growthMultiple: DefaultAOFRewriteGrowthMultiple,
+		minSize:        DefaultAOFRewriteMinSize,
+		stopChan:       make(chan struct{}),
+	}
+}
+
+// SetThresholds changes the rewrite thresholds at runtime.
+// growthMultiple must be greater than 1 and minSize must not be negative.
+func (m *AOFRewriteManager) SetThresholds(growthMultiple float64, minSize int64) error {
+	if growthMultiple <= 1 {
+		return fmt.Errorf("growth multiple must be greater than 1, got %v", growthMultiple)
+	}
+	if minSize < 0 {
+		return fmt.Errorf("minimum size must be >= 0, got %d", minSize)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.growthMultiple = growthMultiple
+	m.minSize = minSize
+	return nil
+}
+
+// Thresholds returns the current growth multiple and minimum size.
+func (m *AOFRewriteManager) Thresholds() (float64, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.growthMultiple, m.minSize
+}
+
+// Start begins monitoring the AOF size in a background goroutine.
+func (m *AOFRewriteManager) Start() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.running {
+		return fmt.Errorf("AOF rewrite manager is already running")
+	}
+
+	m.running = true
+	go m.run()
+
+	return nil
+}
+
+// Stop stops monitoring the AOF size.
+func (m *AOFRewriteManager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.running {
+		return
+	}
+
+	close(m.stopChan)
+	m.running = false
+}
+
+// run executes the AOF size monitoring loop.
+func (m *AOFRewriteManager) run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.check()
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+// check starts a rewrite if the AOF has grown past the thresholds.
+// The rewrite runs synchronously in the monitor goroutine so that its result
+// can drive the backoff; a manual rewrite already running is left alone.
+func (m *AOFRewriteManager) check() {
+	if !m.shouldRewrite() {
+		return
+	}
+
+	stats := m.cache.AOFRewriteStats()
+	slog.Info("Starting automatic AOF rewrite", "size", stats.CurrentSize, "base_size", stats.BaseSize)
+
+	err := m.cache.RewriteAOF()
+	if errors.Is(err, ErrRewriteInProgress) {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		// Back off exponentially so a persistent failure (e.g. disk full) doesn't spin
+		if m.backoff == 0 {
+			m.backoff = aofRewriteMinBackoff
+		} else if m.backoff < aofRewriteMaxBackoff {
+			m.backoff *= 2
+			if m.backoff > aofRewriteMaxBackoff {
+				m.backoff = aofRewriteMaxBackoff
+			}
+		}
+		m.nextAttempt = time.Now().Add(m.backoff)
+		slog.Error("Automatic AOF rewrite failed", "retry_in", m.backoff, "err", err)
+		return
+	}
+
+	m.backoff = 0
+	m.nextAttempt = time.Time{}
+	slog.Info("Automatic AOF rewrite completed")
+}
+
+// shouldRewrite reports whether the AOF size exceeds the thresholds and no backoff is pending.
+func (m *AOFRewriteManager) shouldRewrite() bool {
+	m.mu.Lock()
+	growthMultiple, minSize, nextAttempt := m.growthMultiple, m.minSize, m.nextAttempt
+	m.mu.Unlock()
+
+	if time.Now().Before(nextAttempt) {
+		return false
+	}
+
+	stats := m.cache.AOFRewriteStats()
+	if stats.InProgress || stats.CurrentSize < minSize {
+		return false
+	}
+
+	return float64(stats.CurrentSize) > growthMultiple*float64(stats.BaseSize)
+}
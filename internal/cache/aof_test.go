@@ -0,0 +1,387 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestAOF creates a cache in dir, sets key0..key<n-1>, and returns the
+// AOF path and the end offset of each record. Every write is flushed, so the
+// file size after a Set is where its record ends.
+func writeTestAOF(t *testing.T, dir string, n int) (string, []int64) {
+	t.Helper()
+	aofPath := filepath.Join(dir, "test.aof")
+	c, err := NewCache(aofPath, filepath.Join(dir, "test.snapshot"), 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	var ends []int64
+	for i := range n {
+		if err := c.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i), 0); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		info, err := os.Stat(aofPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, info.Size())
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return aofPath, ends
+}
+
+// TestAOFReplayCorruption corrupts the AOF at various offsets and checks that
+// replay keeps the records before the damage, drops the rest, and truncates
+// the file to the end of the last good record.
+func TestAOFReplayCorruption(t *testing.T) {
+	const n = 5
+	tests := []struct {
+		name    string
+		corrupt func(data []byte, ends []int64) []byte
+		good    int // Records expected to survive
+	}{
+		{"torn last record", func(data []byte, ends []int64) []byte {
+			return data[:ends[n-1]-3]
+		}, n - 1},
+		{"length prefix only", func(data []byte, ends []int64) []byte {
+			return data[:ends[n-2]+1]
+		}, n - 1},
+		{"flipped byte in the middle", func(data []byte, ends []int64) []byte {
+			data[ends[1]+6] ^= 0xff
+			return data
+		}, 2},
+		{"flipped byte in the first record", func(data []byte, ends []int64) []byte {
+			data[len(aofMagic)+6] ^= 0xff
+			return data
+		}, 0},
+		{"garbage after the last record", func(data []byte, ends []int64) []byte {
+			return append(data, "garbage"...)
+		}, n},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			aofPath, ends := writeTestAOF(t, dir, n)
+			data, err := os.ReadFile(aofPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = tt.corrupt(data, ends)
+			if err := os.WriteFile(aofPath, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := NewCache(aofPath, filepath.Join(dir, "test.snapshot"), 0)
+			if err != nil {
+				t.Fatalf("NewCache: %v", err)
+			}
+			defer c.Close()
+
+			for i := range n {
+				_, ok := c.Get(fmt.Sprintf("key%d", i))
+				if want := i < tt.good; ok != want {
+					t.Errorf("key%d present = %v, want %v", i, ok, want)
+				}
+			}
+
+			wantSize := int64(len(aofMagic))
+			if tt.good > 0 {
+				wantSize = ends[tt.good-1]
+			}
+			stats := c.AOFReplayStats()
+			if tt.good < n || len(data) > int(ends[n-1]) {
+				if stats.Errors != 1 {
+					t.Errorf("replay errors = %d, want 1", stats.Errors)
+				}
+				if want := int64(len(data)) - wantSize; stats.Discarded != want {
+					t.Errorf("discarded = %d bytes, want %d", stats.Discarded, want)
+				}
+			}
+			info, err := os.Stat(aofPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != wantSize {
+				t.Errorf("AOF size after replay = %d, want %d", info.Size(), wantSize)
+			}
+
+			// Appending after the truncation must replay cleanly
+			if err := c.Set("after", "x", 0); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+			c.Close()
+			c2, err := NewCache(aofPath, filepath.Join(dir, "test.snapshot"), 0, WithAOFLoadTruncated(false))
+			if err != nil {
+				t.Fatalf("NewCache after truncation: %v", err)
+			}
+			defer c2.Close()
+			if v, ok := c2.Get("after"); !ok || v != "x" {
+				t.Errorf("Get(after) = %q, %v after restart", v, ok)
+			}
+		})
+	}
+}
+
+// TestAOFReplayCorruptionStrict checks that WithAOFLoadTruncated(false)
+// refuses to start from a corrupted AOF and leaves the file alone.
+func TestAOFReplayCorruptionStrict(t *testing.T) {
+	dir := t.TempDir()
+	aofPath, ends := writeTestAOF(t, dir, 3)
+	data, err := os.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[ends[0]+6] ^= 0xff
+	if err := os.WriteFile(aofPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewCache(aofPath, filepath.Join(dir, "test.snapshot"), 0, WithAOFLoadTruncated(false))
+	var corruption *AOFCorruptionError
+	if !errors.As(err, &corruption) {
+		t.Fatalf("NewCache error = %v, want an *AOFCorruptionError", err)
+	}
+	if corruption.Record != 2 || corruption.Offset != ends[0] || corruption.Discarded != int64(len(data))-ends[0] {
+		t.Errorf("corruption = record %d, offset %d, discarded %d; want record 2, offset %d, discarded %d",
+			corruption.Record, corruption.Offset, corruption.Discarded, ends[0], int64(len(data))-ends[0])
+	}
+	info, err := os.Stat(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Errorf("AOF size = %d, want %d (untouched)", info.Size(), len(data))
+	}
+}
+
+// TestAOFReplayPreambleCorruption checks that a corrupted or incomplete
+// preamble, which holds the dataset instead of the snapshot, fails the load
+// even when truncation is allowed, and leaves the file as it was, while a bad
+// record after the preamble is still truncated.
+func TestAOFReplayPreambleCorruption(t *testing.T) {
+	const n = 5
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot")
+	c, err := NewCache(aofPath, snapshotPath, 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	for i := range n {
+		if err := c.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i), 0); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := c.RewriteAOF(); err != nil {
+		t.Fatalf("RewriteAOF: %v", err)
+	}
+	if err := c.Set("tail", "x", 0); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	orig, err := os.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Offsets of the preamble header and of the end of each record
+	f, err := os.Open(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewAOFReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := reader.Preamble(); err != nil || !reader.HasPreamble() {
+		t.Fatalf("Preamble: %v, has preamble %v", err, reader.HasPreamble())
+	}
+	header := int64(len(aofMagic) + len(aofPreambleMagic))
+	ends := []int64{reader.offset}
+	for {
+		if _, err := reader.Next(); err != nil {
+			break
+		}
+		ends = append(ends, reader.offset)
+	}
+	f.Close()
+	if len(ends) != n+2 {
+		t.Fatalf("%d records after the header, want %d", len(ends)-1, n+1)
+	}
+
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+	}{
+		{"flipped byte in the header", func(data []byte) []byte {
+			data[header+2] ^= 0xff
+			return data
+		}},
+		{"torn header", func(data []byte) []byte {
+			return data[:header+1]
+		}},
+		{"flipped byte in an entry", func(data []byte) []byte {
+			data[ends[2]+6] ^= 0xff
+			return data
+		}},
+		{"entries missing", func(data []byte) []byte {
+			return data[:ends[n-1]]
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.corrupt(bytes.Clone(orig))
+			if err := os.WriteFile(aofPath, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := NewCache(aofPath, snapshotPath, 0)
+			var corruption *AOFCorruptionError
+			if !errors.As(err, &corruption) || !corruption.Preamble {
+				t.Fatalf("NewCache error = %v, want an *AOFCorruptionError in the preamble", err)
+			}
+			if got, err := os.ReadFile(aofPath); err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("AOF changed by the failed load (%d bytes, was %d)", len(got), len(data))
+			}
+
+			// Nothing is lost: once repaired, the file loads every key
+			if err := os.WriteFile(aofPath, orig, 0644); err != nil {
+				t.Fatal(err)
+			}
+			c, err := NewCache(aofPath, snapshotPath, 0, WithAOFLoadTruncated(false))
+			if err != nil {
+				t.Fatalf("NewCache after repair: %v", err)
+			}
+			defer c.Close()
+			for _, key := range []string{"key0", fmt.Sprintf("key%d", n-1), "tail"} {
+				if _, ok := c.Get(key); !ok {
+					t.Errorf("%s missing after repair", key)
+				}
+			}
+		})
+	}
+
+	// A bad record after the preamble is truncated, keeping the preamble
+	data := bytes.Clone(orig)
+	data[ends[n]+6] ^= 0xff
+	if err := os.WriteFile(aofPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewCache(aofPath, snapshotPath, 0)
+	if err != nil {
+		t.Fatalf("NewCache with a bad tail: %v", err)
+	}
+	defer c.Close()
+	if _, ok := c.Get(fmt.Sprintf("key%d", n-1)); !ok {
+		t.Error("preamble entry missing after truncating the tail")
+	}
+	if _, ok := c.Get("tail"); ok {
+		t.Error("bad tail record replayed")
+	}
+	info, err := os.Stat(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != ends[n] {
+		t.Errorf("AOF size after truncating the tail = %d, want %d", info.Size(), ends[n])
+	}
+}
+
+// TestAOFBinarySafeValues checks that values over 1MB and values with
+// newlines, NUL bytes, and invalid UTF-8 replay byte for byte, from logged
+// records and from the preamble of a rewrite.
+func TestAOFBinarySafeValues(t *testing.T) {
+	large := make([]byte, 3<<20)
+	for i := range large {
+		large[i] = byte(i * 7)
+	}
+	values := map[string]string{
+		"large":              string(large),
+		"newlines":           "line1\nline2\r\n\n",
+		"nul":                "\x00a\x00\x00b",
+		"binary":             "\xff\xfe\x00\n\x80",
+		"empty":              "",
+		"key\nwith\x00bytes": "v",
+	}
+
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot")
+	c, err := NewCache(aofPath, snapshotPath, 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	for k, v := range values {
+		if err := c.Set(k, v, 0); err != nil {
+			t.Fatalf("Set(%q): %v", k, err)
+		}
+	}
+	c.Close()
+
+	check := func(stage string) {
+		t.Helper()
+		c, err := NewCache(aofPath, snapshotPath, 0, WithAOFLoadTruncated(false))
+		if err != nil {
+			t.Fatalf("NewCache %s: %v", stage, err)
+		}
+		defer c.Close()
+		for k, want := range values {
+			if got, ok := c.Get(k); !ok || got != want {
+				t.Errorf("%s: Get(%q) = %d bytes (present %v), want %d bytes", stage, k, len(got), ok, len(want))
+			}
+		}
+		if stage == "after replay" {
+			if err := c.RewriteAOF(); err != nil {
+				t.Fatalf("RewriteAOF: %v", err)
+			}
+		}
+	}
+	check("after replay")
+	check("after a rewrite")
+}
+
+// TestAOFReplayLegacyJSON checks that line-delimited JSON AOFs, with and
+// without checksums, still replay, including escaped newlines and NUL bytes,
+// and are converted to the binary format.
+func TestAOFReplayLegacyJSON(t *testing.T) {
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot")
+	checked := `{"op":"SET","key":"checked","value":"a\nb\u0000c"}`
+	legacy := `{"op":"SET","key":"plain","value":"line1\nline2"}` + "\n" +
+		fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE([]byte(checked)), checked) +
+		`{"op":"SET","key":"gone","value":"v"}` + "\n" +
+		`{"op":"DEL","key":"gone"}` + "\n"
+	if err := os.WriteFile(aofPath, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stage := range []string{"legacy", "converted"} {
+		c, err := NewCache(aofPath, snapshotPath, 0, WithAOFLoadTruncated(false))
+		if err != nil {
+			t.Fatalf("NewCache (%s): %v", stage, err)
+		}
+		for k, want := range map[string]string{"plain": "line1\nline2", "checked": "a\nb\x00c"} {
+			if got, ok := c.Get(k); !ok || got != want {
+				t.Errorf("%s: Get(%q) = %q, %v, want %q", stage, k, got, ok, want)
+			}
+		}
+		if _, ok := c.Get("gone"); ok {
+			t.Errorf("%s: deleted key replayed", stage)
+		}
+		c.Close()
+
+		data, err := os.ReadFile(aofPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, []byte(aofMagic)) {
+			t.Errorf("%s: AOF not converted to the binary format: %.40q", stage, data)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package cache
+
+import "log/slog"
+
+// Turning the AOF off and on.
+//
+// SetAOFEnabled(false) stops writing commands to the AOF, e.g. for a bulk
+// load that shouldn't pay for a write and fsync per key: the file is
+// flushed and synced, then left as it is. Commands are still numbered and
+// streamed to replicas. Until the AOF is turned on again, a restart
+// recovers the dataset as it was when it was turned off. That needs a file
+// with a preamble, which makes startup ignore the snapshot (see Load): a
+// snapshot taken while the AOF is off would otherwise be loaded under the
+// commands of the file, so a file without one is rewritten first.
+//
+// Appending again after the gap would make the file replay into a state
+// that never existed, so SetAOFEnabled(true) rewrites the file from the
+// current dataset (see aof_rewrite.go) and only resumes appending once the
+// rewritten file has replaced the old one. Commands logged during the
+// rewrite are kept in its buffer as usual.
+
+// AOFEnabled reports whether commands are written to the AOF: false
+// without persistence, and while it is turned off.
+func (c *Cache) AOFEnabled() bool {
+	if c.aof == nil {
+		return false
+	}
+	c.aof.mu.Lock()
+	defer c.aof.mu.Unlock()
+	return !c.aof.paused
+}
+
+// SetAOFEnabled turns writing commands to the AOF off or on, see above.
+// Turning it on rewrites the file and returns once that is done, or
+// ErrRewriteInProgress if another rewrite is running. It fails with
+// ErrPersistenceDisabled without persistence.
+func (c *Cache) SetAOFEnabled(enabled bool) error {
+	if c.aof == nil {
+		return ErrPersistenceDisabled
+	}
+	a := c.aof
+	if !enabled {
+		hasPreamble, err := aofHasPreamble(a.filePath)
+		if err != nil {
+			return err
+		}
+		if !hasPreamble && c.AOFEnabled() {
+			return c.rewriteAOFToggling(false)
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.paused {
+			return nil
+		}
+		a.paused = true
+		if err := a.writer.Flush(); err != nil {
+			return err
+		}
+		if err := a.file.Sync(); err != nil {
+			return err
+		}
+		a.unsynced = false
+		slog.Info("AOF turned off")
+		return nil
+	}
+
+	if c.AOFEnabled() {
+		return nil
+	}
+	return c.rewriteAOFToggling(true)
+}
+
+// rewriteAOFToggling rewrites the AOF, and turns it on or off once the
+// rewritten file has replaced the old one.
+func (c *Cache) rewriteAOFToggling(enabled bool) error {
+	entries, err := c.beginAOFRewrite()
+	if err != nil {
+		return err
+	}
+	a := c.aof
+	a.mu.Lock()
+	a.rewrite.toggle, a.rewrite.enable = true, enabled
+	a.mu.Unlock()
+	if err := a.finishRewrite(entries); err != nil {
+		return err
+	}
+	if enabled {
+		slog.Info("AOF turned on", "keys", len(entries))
+	} else {
+		slog.Info("AOF turned off")
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// dataset returns every key of c with its value and expiration time.
+func dataset(t *testing.T, c *Cache) map[string]string {
+	t.Helper()
+	data := make(map[string]string)
+	cursor := ""
+	for {
+		keys, next := c.Scan(cursor, "", 1000)
+		for _, key := range keys {
+			value, expiresAt, ok := c.GetBytesWithExpiry(key)
+			if !ok {
+				t.Fatalf("key %q listed by Scan is missing", key)
+			}
+			data[key] = string(value) + "@" + expiresAt.Format(time.RFC3339Nano)
+		}
+		if next == "" {
+			return data
+		}
+		cursor = next
+	}
+}
+
+// TestSetAOFEnabled checks that writes made while the AOF is off are
+// persisted by turning it back on, exactly as they are then, and that a
+// crash while it is off recovers the dataset from before.
+func TestSetAOFEnabled(t *testing.T) {
+	dir := t.TempDir()
+	aofPath := filepath.Join(dir, "test.aof")
+	c, err := NewCache(aofPath, "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	for i := range 100 {
+		if err := c.Set("key"+strconv.Itoa(i), "before", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Set("ttl", "before", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	before := dataset(t, c)
+
+	if err := c.SetAOFEnabled(false); err != nil {
+		t.Fatalf("SetAOFEnabled(false): %v", err)
+	}
+	if c.AOFEnabled() {
+		t.Fatal("AOFEnabled() = true after turning it off")
+	}
+	info, err := os.Stat(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := info.Size()
+
+	// Bulk load: overwrites, deletes, new keys, and TTL changes
+	for i := range 100 {
+		switch i % 3 {
+		case 0:
+			c.Del("key" + strconv.Itoa(i))
+		case 1:
+			if err := c.Set("key"+strconv.Itoa(i), "during", 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := c.Set("new"+strconv.Itoa(i), "during", time.Duration(i+1)*time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Expire("ttl", 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(aofPath); err != nil || info.Size() != size {
+		t.Fatalf("AOF changed while off: %v bytes, %v (was %d)", info.Size(), err, size)
+	}
+
+	// A crash now recovers the dataset from before the AOF was turned off
+	crashed := filepath.Join(dir, "crashed.aof")
+	data, err := os.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(crashed, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := NewCache(crashed, "", 0)
+	if err != nil {
+		t.Fatalf("NewCache of the AOF while off: %v", err)
+	}
+	if got := dataset(t, recovered); !maps.Equal(got, before) {
+		t.Errorf("recovered %d keys while off, want the %d from before", len(got), len(before))
+	}
+	recovered.Close()
+
+	if err := c.SetAOFEnabled(true); err != nil {
+		t.Fatalf("SetAOFEnabled(true): %v", err)
+	}
+	if !c.AOFEnabled() {
+		t.Fatal("AOFEnabled() = false after turning it on")
+	}
+	want := dataset(t, c)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewCache(aofPath, "", 0)
+	if err != nil {
+		t.Fatalf("NewCache after restart: %v", err)
+	}
+	defer c.Close()
+	got := dataset(t, c)
+	if !maps.Equal(got, want) {
+		for key, value := range want {
+			if got[key] != value {
+				t.Errorf("after restart %s = %q, want %q", key, got[key], value)
+			}
+		}
+		for key := range got {
+			if _, ok := want[key]; !ok {
+				t.Errorf("after restart %s exists, want deleted", key)
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package cache
+
+import (
+	"slices"
+	"time"
+)
+
+// Batches.
+//
+// SetBatch and DelBatch apply many writes for the cost of one: the shards
+// of the keys are locked once, in index order like lockAll, eviction runs
+// once per shard after all entries are stored, and the AOF records,
+// including the DELs of the evicted keys, are written with a single flush
+// and fsync (see AOF.LogBatch). They are meant for bulk loads, where a Set
+// per key spends most of its time waiting for the disk.
+
+// Entry is a key to store with SetBatch. A TTL of 0 means no expiry.
+type Entry struct {
+	Key   string
+	Value string
+	TTL   time.Duration
+}
+
+// SetBatch stores all entries as Set would, in order, so the last entry
+// wins if a key appears twice. The batch is applied entirely or not at all:
+// it returns ErrInvalidTTL if an entry has an invalid TTL (see Set), a *KeyPolicyError
+// if the key policy rejects its key, a *LimitError if it exceeds the key
+// length or value size limit, ErrValueTooLarge if an
+// entry is larger than its shard's memory limit, and ErrCacheFull with EvictionNoEviction if the entries don't fit,
+// before storing anything. Otherwise keys are evicted once all entries are
+// stored, which may evict entries of the batch itself if it is larger than
+// the limits.
+func (c *Cache) SetBatch(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	groups := make(map[int][]Entry)
+	for _, e := range entries {
+		if err := c.checkTTL(e.TTL); err != nil {
+			return err
+		}
+		if err := c.checkKey(e.Key); err != nil {
+			return err
+		}
+		if err := c.checkLimits(e.Key, len(e.Value)); err != nil {
+			return err
+		}
+		i := c.shardIndex(e.Key)
+		groups[i] = append(groups[i], e)
+	}
+	shards := lockShards(c, groups)
+	defer c.unlockShards(shards)
+
+	// The shares of the limits change with SetMaxMemory, so they are read
+	// under the shard locks
+	for _, i := range shards {
+		if limit := c.shards[i].maxMemory; limit > 0 {
+			for _, e := range groups[i] {
+				if entrySize(e.Key, e.Value) > limit {
+					return ErrValueTooLarge
+				}
+			}
+		}
+	}
+
+	for _, i := range shards {
+		s := c.shards[i]
+		s.drainAccessesLocked()
+		s.expireDueLocked(c.expireBatchSize)
+		if c.policy() == EvictionNoEviction && !s.fits(groups[i]) {
+			return ErrCacheFull
+		}
+	}
+
+	cmds := make([]AOFCommand, 0, len(entries))
+	now := c.now()
+	for _, i := range shards {
+		s := c.shards[i]
+		for _, e := range groups[i] {
+			s.expireKeyLocked(e.Key) // Replaced as a new key, see Set
+			s.putLocked(e.Key, []byte(e.Value), "")
+			s.randomKeys.add(e.Key)
+			s.touch(e.Key, now)
+
+			var expiresAt time.Time
+			if e.TTL > 0 {
+				expiresAt = now.Add(e.TTL)
+			}
+			s.setExpiryLocked(e.Key, expiresAt)
+			c.dirty.Add(1)
+			cmds = append(cmds, AOFCommand{Op: "SET", Key: e.Key, Value: e.Value, ExpiresAt: expiresAt})
+		}
+
+		// Evict once for the whole batch, logging after the SETs so replay
+		// doesn't bring the evicted keys back
+		s.evictLog = &cmds
+		s.evictToFit()
+		s.evictLog = nil
+	}
+
+	if c.aof != nil {
+		c.aof.LogBatch(cmds)
+	}
+	return nil
+}
+
+// DelBatch deletes keys as Del would and returns how many valid keys were
+// deleted. Keys that don't exist or have expired aren't counted.
+func (c *Cache) DelBatch(keys []string) int {
+	if len(keys) == 0 {
+		return 0
+	}
+
+	groups := make(map[int][]string)
+	for _, key := range keys {
+		i := c.shardIndex(key)
+		groups[i] = append(groups[i], key)
+	}
+	shards := lockShards(c, groups)
+	defer c.unlockShards(shards)
+
+	var cmds []AOFCommand
+	for _, i := range shards {
+		s := c.shards[i]
+		for _, key := range groups[i] {
+			if !s.hasKey(key) {
+				continue
+			}
+			expired := s.isExpired(key)
+			if expired {
+				s.notifyRemoved(key, EvictionReasonExpired)
+			}
+			s.removeLocked(key)
+			c.dirty.Add(1)
+
+			if expired {
+				c.expiredLazy.Add(1)
+				continue // Replay drops the key anyway, since its expiry has passed
+			}
+			c.deleted.Add(1)
+			c.notifyWatchers(KeyEventDel, key)
+			cmds = append(cmds, AOFCommand{Op: "DEL", Key: key})
+		}
+	}
+
+	if c.aof != nil {
+		c.aof.LogBatch(cmds)
+	}
+	return len(cmds)
+}
+
+// lockShards locks the shards whose indexes are the keys of groups, in
+// ascending order so that batches and lockAll can't deadlock, and returns
+// the indexes in that order.
+func lockShards[T any](c *Cache, groups map[int][]T) []int {
+	shards := make([]int, 0, len(groups))
+	for i := range groups {
+		shards = append(shards, i)
+	}
+	slices.Sort(shards)
+	for _, i := range shards {
+		c.shards[i].mu.Lock()
+	}
+	return shards
+}
+
+// unlockShards unlocks the shards locked by lockShards.
+func (c *Cache) unlockShards(shards []int) {
+	for _, i := range shards {
+		c.shards[i].mu.Unlock()
+	}
+}
+
+// fits reports whether entries can be stored in the shard without evicting
+// any key. Expired keys are removed first, as makeRoom would. Must be called
+// with lock held.
+func (s *shard) fits(entries []Entry) bool {
+	if s.maxKeys == 0 && s.maxMemory == 0 {
+		return true
+	}
+	s.expireDueLocked(0)
+
+	// The last entry of a key is the one stored
+	seen := make(map[string]bool, len(entries))
+	newKeys := 0
+	var delta int64
+	for _, e := range slices.Backward(entries) {
+		if seen[e.Key] {
+			continue
+		}
+		seen[e.Key] = true
+		if !s.hasKey(e.Key) {
+			newKeys++
+		}
+		delta += s.memoryDelta(e.Key, len(e.Value))
+	}
+
+	if s.maxKeys > 0 && newKeys > 0 && len(s.data)+newKeys > s.maxKeys {
+		return false
+	}
+	return s.maxMemory == 0 || delta <= 0 || s.usedMemory+delta <= s.maxMemory
+}
+
+// evictToFit evicts keys by the eviction policy until the shard is within
+// its shares of maxKeys and maxMemory, removing expired keys first.
+// Must be called with lock held.
+func (s *shard) evictToFit() {
+	for s.maxKeys > 0 && len(s.data) > s.maxKeys || s.maxMemory > 0 && s.usedMemory > s.maxMemory {
+		if s.expireDueLocked(1) > 0 {
+			continue // An expired key is the first to go
+		}
+		if !s.evict() {
+			return // Nothing left to evict
+		}
+	}
+}
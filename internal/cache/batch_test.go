@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestSetBatch checks that SetBatch stores entries like Set, with the last
+// entry winning for a duplicate key, and that replay restores them.
+func TestSetBatch(t *testing.T) {
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot")
+	clock := newFakeClock()
+	c, err := NewCache(aofPath, snapshotPath, 0, WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	if err := c.Set("old", "value", 0); err != nil {
+		t.Fatal(err)
+	}
+	err = c.SetBatch([]Entry{
+		{Key: "a", Value: "1"},
+		{Key: "b", Value: "2", TTL: time.Hour},
+		{Key: "a", Value: "3"},
+		{Key: "old", Value: "new"},
+		{Key: "short", Value: "4", TTL: time.Second},
+	})
+	if err != nil {
+		t.Fatalf("SetBatch: %v", err)
+	}
+	if err := c.SetBatch(nil); err != nil {
+		t.Errorf("SetBatch(nil): %v", err)
+	}
+	check := func(c *Cache, when string) {
+		t.Helper()
+		want := map[string]string{"a": "3", "b": "2", "old": "new", "short": "4"}
+		for key, value := range want {
+			if got, ok := c.Get(key); !ok || got != value {
+				t.Errorf("%s: %s = %q, %v, want %q", when, key, got, ok, value)
+			}
+		}
+		if _, expiresAt, _ := c.GetBytesWithExpiry("b"); !expiresAt.Equal(clock.Now().Add(time.Hour)) {
+			t.Errorf("%s: b expires at %v", when, expiresAt)
+		}
+		if n := c.Stats().Keys; n != len(want) {
+			t.Errorf("%s: %d keys, want %d", when, n, len(want))
+		}
+	}
+	check(c, "after SetBatch")
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewCache(aofPath, snapshotPath, 0, WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("NewCache after restart: %v", err)
+	}
+	defer c.Close()
+	check(c, "after replay")
+	clock.Advance(2 * time.Second)
+	if _, ok := c.Get("short"); ok {
+		t.Error("short didn't expire")
+	}
+}
+
+// TestSetBatchAllOrNothing checks that an invalid entry, or a batch that
+// doesn't fit without eviction, stores nothing.
+func TestSetBatchAllOrNothing(t *testing.T) {
+	c, err := NewCache("", "", 3, WithShards(1), WithEvictionPolicy(EvictionNoEviction))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.SetBatch([]Entry{{Key: "a", Value: "1"}, {Key: "b", Value: "2", TTL: -time.Second}}); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("SetBatch with a negative TTL error = %v, want ErrInvalidTTL", err)
+	}
+	entries := make([]Entry, 4)
+	for i := range entries {
+		entries[i] = Entry{Key: "key" + strconv.Itoa(i), Value: "value"}
+	}
+	if err := c.SetBatch(entries); !errors.Is(err, ErrCacheFull) {
+		t.Errorf("SetBatch over the limit error = %v, want ErrCacheFull", err)
+	}
+	if n := c.Stats().Keys; n != 0 {
+		t.Errorf("%d keys stored by failed batches", n)
+	}
+	if err := c.SetBatch(entries[:3]); err != nil {
+		t.Errorf("SetBatch within the limit: %v", err)
+	}
+}
+
+// TestSetBatchEviction checks that a batch larger than maxKeys evicts once
+// all entries are stored, and that replay gives the same keys: the DELs of
+// the evicted keys are logged after the SETs.
+func TestSetBatchEviction(t *testing.T) {
+	const maxKeys = 10
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot")
+	c, err := NewCache(aofPath, snapshotPath, maxKeys, WithShards(1))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	entries := make([]Entry, 25)
+	for i := range entries {
+		entries[i] = Entry{Key: "key" + strconv.Itoa(i), Value: "value"}
+	}
+	if err := c.SetBatch(entries); err != nil {
+		t.Fatalf("SetBatch: %v", err)
+	}
+	stats := c.Stats()
+	if stats.Keys != maxKeys || stats.Evicted != 25-maxKeys {
+		t.Errorf("%d keys and %d evicted, want %d and %d", stats.Keys, stats.Evicted, maxKeys, 25-maxKeys)
+	}
+	before := dataset(t, c)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewCache(aofPath, snapshotPath, maxKeys, WithShards(1))
+	if err != nil {
+		t.Fatalf("NewCache after restart: %v", err)
+	}
+	defer c.Close()
+	after := dataset(t, c)
+	if len(after) != len(before) {
+		t.Errorf("%d keys after replay, want %d", len(after), len(before))
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			t.Errorf("%s is missing after replay", key)
+		}
+	}
+}
+
+// TestDelBatch checks that DelBatch counts the valid keys it deletes, and
+// that replay doesn't bring them back.
+func TestDelBatch(t *testing.T) {
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot")
+	clock := newFakeClock()
+	c, err := NewCache(aofPath, snapshotPath, 0, WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.Set(key, "value", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Set("ttl", "value", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Second)
+
+	if n := c.DelBatch([]string{"a", "missing", "b", "a", "ttl"}); n != 2 {
+		t.Errorf("DelBatch = %d, want 2", n)
+	}
+	if n := c.DelBatch(nil); n != 0 {
+		t.Errorf("DelBatch(nil) = %d", n)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewCache(aofPath, snapshotPath, 0, WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("NewCache after restart: %v", err)
+	}
+	defer c.Close()
+	if got := dataset(t, c); len(got) != 1 || got["c"] == "" {
+		t.Errorf("dataset after replay: %v, want only c", got)
+	}
+}
+
+// BenchmarkBulkLoad loads 10k keys into a cache with an AOF synced after
+// every write, with a Set per key and with one SetBatch.
+func BenchmarkBulkLoad(b *testing.B) {
+	const keys = 10_000
+	entries := make([]Entry, keys)
+	for i := range entries {
+		entries[i] = Entry{Key: "key" + strconv.Itoa(i), Value: "value"}
+	}
+	load := map[string]func(c *Cache) error{
+		"Set": func(c *Cache) error {
+			for _, e := range entries {
+				if err := c.Set(e.Key, e.Value, e.TTL); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		"SetBatch": func(c *Cache) error {
+			return c.SetBatch(entries)
+		},
+	}
+	for _, name := range []string{"Set", "SetBatch"} {
+		b.Run(name, func(b *testing.B) {
+			for range b.N {
+				b.StopTimer()
+				dir := b.TempDir()
+				c, err := NewCache(filepath.Join(dir, "test.aof"), "", 0, WithAOFFsync(FsyncAlways))
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				if err := load[name](c); err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				c.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -1,299 +1,729 @@
 package cache
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 // Cache represents an in-memory key-value store with expiration support.
-// It uses a read-write mutex for thread-safe concurrent access.
+// The keys are partitioned into shards, each with its own read-write mutex,
+// so operations on different shards run concurrently (see shard.go).
 type Cache struct {
-	data            map[string]string   // Main storage: key -> value mapping
-	expires         map[string]time.Time // Expiration tracking: key -> expiration time
-	lastAccess      map[string]time.Time // LRU tracking: key -> last access time
-	mu              sync.RWMutex         // Read-write mutex for thread-safe operations
+	shards          []*shard             // Partitions of the dataset, by key hash
+	shardMask       uint64               // len(shards) - 1 (the count is a power of two)
+	numShards       int                  // Shard count set by WithShards (0 = default)
+	expiryWake      chan struct{}        // Wakes RunCleanup when the next expiration time moves earlier
 	aof             *AOF                 // Append-only file for persistence
 	snapshotManager *SnapshotManager   // Snapshot manager for periodic snapshots
-	maxKeys         int                 // Maximum number of keys allowed (0 = unlimited)
+	maxKeys         atomic.Int64        // Maximum number of keys allowed (0 = unlimited, see SetMaxKeys)
+	maxMemory       atomic.Int64        // Maximum estimated memory of the dataset in bytes (0 = unlimited)
+	resizeMu        sync.Mutex          // Serializes SetMaxKeys, SetMaxMemory, and SetEvictionPaused
+	evictionPaused  atomic.Bool         // Eviction is paused (see SetEvictionPaused)
+	evictionPolicy  atomic.Int32        // Key evicted when maxKeys is reached (an EvictionPolicy, see SetEvictionPolicy)
+	maxKeyLength    atomic.Int64        // Longest key accepted by writes (0 = unlimited, see limits.go)
+	maxValueSize    atomic.Int64        // Largest value accepted by writes (0 = unlimited)
+	limitSkipped    atomic.Int64        // Entries skipped at load for exceeding the limits
+	keyPolicy       *KeyPolicy          // Keys accepted by writes (nil = any, see keypolicy.go)
+
+	snapshotPath    string              // Snapshot file loaded at startup
+	loading         atomic.Bool         // True while the dataset is being loaded from disk
+	loadPhase       atomic.Value        // Step of the load in progress (a LoadPhase)
+
+	snapshotMu      sync.Mutex          // Protects lastSnapshot, lastSave, and lastUpload
+	lastSnapshot    SnapshotStats       // Statistics about the last saved snapshot
+	lastUpload      SnapshotUploadStats // Statistics about snapshot uploads to the sink
+	lastSave        time.Time           // When the last successful snapshot was taken (startup if none)
+	dirty           atomic.Int64        // Changes (sets, deletes, evictions, expirations) since the last snapshot
+	lastVersion     atomic.Uint64       // Last key version handed out (see keyMeta)
+
+	expiredLazy     atomic.Int64        // Expired keys removed when accessed (Get, Del)
+	expiredActive   atomic.Int64        // Expired keys removed by Cleanup (or by Set before counting keys)
+	evicted         atomic.Int64        // Keys evicted by the eviction policy
+	deleted         atomic.Int64        // Keys deleted by clients (Del)
+	cleanupMu       sync.Mutex          // Serializes Cleanup; protects cleanupNext
+	cleanupNext     int                 // Shard where the next Cleanup starts
+	lastExpireCycle atomic.Pointer[ExpireCycleStats] // Last Cleanup cycle (nil before the first)
+	fullScanExpiration bool             // Cleanup scans every key instead of using ttlKeys
+	expireBatchSize    int              // Expired keys removed per lock hold by Cleanup
+	expireCycleBudget  time.Duration    // Longest time spent in one Cleanup cycle
+	cleanupInterval    atomic.Int64     // Longest sleep of RunCleanup between cycles (a time.Duration)
+	cleanupTruncated   atomic.Int64     // Cleanup cycles that ran out of budget
+	onEvictFn       func(key, value string, reason EvictionReason) // Callback set by WithOnEvict
+	onEvict         *evictDispatcher    // Runs onEvictFn outside the lock (nil without a callback)
+	watchers        watchers            // Watchers of key changes, see watch.go
+	loadMu            sync.Mutex           // Protects loads, loadErrors, and loadErrorsSweepAt
+	loads             map[string]*loadCall // GetOrLoad loader calls in progress, by key
+	loadErrors        map[string]loadError // Loader errors cached by WithNegativeCacheTTL, by key
+	loadErrorsSweepAt int                  // Size of loadErrors at which expired errors are removed
+	negativeCacheTTL  time.Duration        // How long GetOrLoad returns a loader error without retrying (0 = not cached)
+
+	aofLoadTruncated   bool             // Truncate a corrupted AOF tail on replay instead of failing
+	aofFsync           FsyncPolicy      // When AOF writes are synced to disk
+	snapshotFormat     SnapshotFormat   // Encoding of snapshot files
+	snapshotGzip       bool             // Compress snapshots with gzip
+	snapshotGzipLevel  int              // gzip compression level for snapshots
+	strictSnapshotLoad bool             // Fail loading on a corrupted snapshot instead of ignoring it
+	snapshotKeep       int              // Older snapshot generations to keep (0 = none)
+	restorePath        string           // Snapshot to restore from instead of loading the snapshot and AOF
+	snapshotSink       SnapshotSink     // Remote copy of snapshots (nil = none)
+	replication        *replicationSource // Backlog and replicas of this primary (nil without an AOF)
+	noPersistence      bool             // Keep the dataset in memory only: no AOF, no snapshot
+	deferLoad          bool             // Don't load the dataset in NewCache (see Load)
+	copyOnRead         bool             // GetBytes returns a copy instead of the stored value
+	now                func() time.Time // Clock used for expiration (time.Now unless overridden)
 }
 
 // NewCache creates and returns a new Cache instance with initialized maps.
 // It also initializes the AOF persistence layer and loads snapshot if available.
-// maxKeys: Maximum number of keys allowed (0 = unlimited). When limit is reached, least recently used keys are evicted (LRU).
-func NewCache(aofPath, snapshotPath string, maxKeys int) (*Cache, error) {
+// maxKeys: Maximum number of keys allowed (0 = unlimited). When limit is reached, keys are evicted
+// by the eviction policy: least recently used keys (LRU) unless WithEvictionPolicy selects another.
+// opts: Optional settings, see Option. With WithDeferredLoad, the data is not
+// loaded until Load is called.
+// An empty aofPath (or WithoutPersistence) disables persistence: no files
+// are opened or created, and the cache starts empty.
+func NewCache(aofPath, snapshotPath string, maxKeys int, opts ...Option) (*Cache, error) {
 	c := &Cache{
-		data:       make(map[string]string),
-		expires:    make(map[string]time.Time),
-		lastAccess: make(map[string]time.Time),
-		maxKeys:    maxKeys,
+		expiryWake:   make(chan struct{}, 1),
+		snapshotPath: snapshotPath,
+
+		aofLoadTruncated:  true,
+		expireBatchSize:   defaultExpireBatchSize,
+		expireCycleBudget: defaultExpireCycleBudget,
+		now:               time.Now,
 	}
+	c.maxKeys.Store(int64(maxKeys))
+	c.cleanupInterval.Store(int64(defaultCleanupInterval))
 
-	// Load snapshot first (if it exists)
-	loaded, err := c.LoadSnapshot(snapshotPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load snapshot: %w", err)
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.lastSave = c.now()
+	c.lastVersion.Store(uint64(c.lastSave.UnixNano()))
+
+	if aofPath == "" {
+		c.noPersistence = true
+	}
+	if c.noPersistence {
+		if c.restorePath != "" || c.snapshotSink != nil {
+			return nil, fmt.Errorf("restoring or uploading snapshots requires persistence")
+		}
+		c.snapshotPath = ""
+	}
+
+	if c.snapshotFormat != SnapshotFormatJSON && c.snapshotFormat != SnapshotFormatBinary {
+		return nil, fmt.Errorf("invalid snapshot format %v", c.snapshotFormat)
+	}
+	if c.policy() < EvictionLRU || c.policy() > EvictionNoEviction {
+		return nil, fmt.Errorf("invalid eviction policy %v", c.policy())
 	}
-	if loaded {
-		fmt.Printf("Loaded snapshot from %s\n", snapshotPath)
+	if c.aofFsync < FsyncAlways || c.aofFsync > FsyncNo {
+		return nil, fmt.Errorf("invalid fsync policy %v", c.aofFsync)
+	}
+	if c.expireBatchSize <= 0 || c.expireCycleBudget <= 0 {
+		return nil, fmt.Errorf("invalid cleanup budget %d keys, %v (must be > 0)", c.expireBatchSize, c.expireCycleBudget)
+	}
+	if c.CleanupInterval() <= 0 {
+		return nil, fmt.Errorf("invalid cleanup interval %v (must be > 0)", c.CleanupInterval())
+	}
+	if c.maxKeys.Load() < 0 {
+		return nil, fmt.Errorf("invalid key limit %d (must be >= 0)", c.maxKeys.Load())
+	}
+	if c.maxMemory.Load() < 0 {
+		return nil, fmt.Errorf("invalid memory limit %d (must be >= 0)", c.maxMemory.Load())
+	}
+	if c.maxKeyLength.Load() < 0 || c.maxValueSize.Load() < 0 {
+		return nil, fmt.Errorf("invalid limits %d, %d (must be >= 0)", c.maxKeyLength.Load(), c.maxValueSize.Load())
+	}
+	if c.numShards < 0 || c.numShards&(c.numShards-1) != 0 {
+		return nil, fmt.Errorf("invalid shard count %d (must be a power of two)", c.numShards)
+	}
+	c.initShards()
+	if c.snapshotKeep < 0 {
+		return nil, fmt.Errorf("invalid snapshot retention %d (must be >= 0)", c.snapshotKeep)
+	}
+	if c.snapshotGzip {
+		if _, err := gzip.NewWriterLevel(io.Discard, c.snapshotGzipLevel); err != nil {
+			return nil, fmt.Errorf("invalid snapshot compression level: %w", err)
+		}
 	}
 
 	// Initialize AOF
-	aof, err := NewAOF(aofPath, c)
-	if err != nil {
-		return nil, err
+	if !c.noPersistence {
+		aof, err := NewAOF(aofPath, c)
+		if err != nil {
+			return nil, err
+		}
+		c.aof = aof
+		c.replication = newReplicationSource(DefaultReplicationBacklogSize)
+	}
+	if c.onEvictFn != nil {
+		c.onEvict = newEvictDispatcher(c.onEvictFn)
+	}
+
+	c.loading.Store(true)
+	c.loadPhase.Store(LoadPhasePending)
+	if c.deferLoad {
+		return c, nil
 	}
-	c.aof = aof
 
-	// Replay AOF to restore any operations after snapshot
-	if err := aof.Replay(); err != nil {
+	if err := c.Load(); err != nil {
+		c.Close()
 		return nil, err
 	}
 
 	return c, nil
 }
 
-// Close gracefully shuts down the cache and closes the AOF file.
+// Load restores the dataset from the snapshot and the AOF, or from the
+// snapshot given with WithRestoreFrom.
+// NewCache calls it automatically unless WithDeferredLoad is used; in that
+// case Loading reports true until Load returns, and the cache must not be
+// used for reads or writes in the meantime.
+func (c *Cache) Load() error {
+	defer func() {
+		c.loadPhase.Store(LoadPhaseNone)
+		c.loading.Store(false)
+	}()
+
+	if c.noPersistence {
+		return nil // Nothing to load
+	}
+
+	c.loadPhase.Store(LoadPhaseSnapshot)
+	if c.restorePath != "" {
+		return c.restoreFrom(c.restorePath)
+	}
+
+	// An AOF with a preamble already contains the full dataset, and it is
+	// never older than the snapshot, so the snapshot is only needed without one
+	hasPreamble, err := aofHasPreamble(c.aof.filePath)
+	if err != nil {
+		return err
+	}
+
+	// Load snapshot first (if it exists)
+	if hasPreamble {
+		slog.Info("AOF has a preamble, not loading snapshot", "path", c.aof.filePath)
+	} else {
+		// Without a local snapshot (e.g. on a new instance), use the sink's copy
+		if c.snapshotSink != nil {
+			if err := c.fetchSnapshot(); err != nil {
+				return err
+			}
+		}
+		loaded, err := c.LoadSnapshot(c.snapshotPath)
+		if err != nil {
+			return fmt.Errorf("failed to load snapshot: %w", err)
+		}
+		if loaded {
+			slog.Info("Loaded snapshot", "path", c.snapshotPath)
+		}
+	}
+
+	// Replay AOF to restore any operations after snapshot.
+	// The locks keep concurrent readers (e.g. stats) away from the maps.
+	c.loadPhase.Store(LoadPhaseAOF)
+	c.lockAll()
+	err = c.aof.Replay()
+	c.unlockAll()
+	if err != nil {
+		return err
+	}
+
+	// Commands logged to the AOF since the last snapshot count as changes;
+	// the preamble holds the dataset of the last snapshot
+	c.dirty.Add(c.aof.replay.logged.Load())
+	if skipped := c.limitSkipped.Load(); skipped > 0 {
+		slog.Warn("Skipped entries exceeding the key length or value size limit", "entries", skipped)
+	}
+
+	// Convert a legacy JSON AOF to the binary format before accepting writes
+	if c.aof.needsConversion {
+		slog.Info("Converting AOF to binary format", "path", c.aof.filePath)
+		if err := c.RewriteAOF(); err != nil {
+			return fmt.Errorf("failed to convert AOF: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Persistent reports whether the cache persists its data (AOF and snapshots),
+// i.e. it wasn't created with WithoutPersistence or an empty AOF path.
+func (c *Cache) Persistent() bool {
+	return !c.noPersistence
+}
+
+// Loading reports whether the dataset is still being loaded from disk.
+func (c *Cache) Loading() bool {
+	return c.loading.Load()
+}
+
+// LoadPhase is the step of Load in progress.
+type LoadPhase string
+
+// Steps of Load.
+const (
+	LoadPhaseNone     LoadPhase = ""         // Not loading
+	LoadPhasePending  LoadPhase = "pending"  // Load wasn't called yet (WithDeferredLoad)
+	LoadPhaseSnapshot LoadPhase = "snapshot" // Loading the snapshot, or fetching it from the sink
+	LoadPhaseAOF      LoadPhase = "aof"      // Replaying the AOF (see AOFReplayStats for its progress)
+)
+
+// LoadPhase returns the step of Load in progress, LoadPhaseNone once the
+// dataset is loaded.
+func (c *Cache) LoadPhase() LoadPhase {
+	phase, _ := c.loadPhase.Load().(LoadPhase)
+	return phase
+}
+
+// AOFReplayStats returns progress and statistics of the AOF replay at startup.
+func (c *Cache) AOFReplayStats() AOFReplayStats {
+	if c.aof == nil {
+		return AOFReplayStats{}
+	}
+	return c.aof.replayStats()
+}
+
+// AOFWriteError returns the error of the last AOF write or sync, or nil if
+// it succeeded (or without persistence). Writes don't fail on AOF errors,
+// so this tells whether acknowledged writes are reaching the disk.
+func (c *Cache) AOFWriteError() error {
+	if c.aof == nil {
+		return nil
+	}
+	c.aof.mu.Lock()
+	defer c.aof.mu.Unlock()
+	return c.aof.writeErr
+}
+
+// Close gracefully shuts down the cache and closes the AOF file. It waits
+// for the OnEvict callbacks already queued to return.
 func (c *Cache) Close() error {
+	c.onEvict.close()
 	if c.aof != nil {
 		return c.aof.Close()
 	}
 	return nil
 }
 
+// ErrInvalidTTL is returned by Set for a negative TTL, like Redis rejects a
+// negative expire time in SET. Nothing is stored: a computed TTL that has
+// already run out must not turn into a key that never expires. It is also
+// returned for a TTL ending after MaxExpiry.
+var ErrInvalidTTL = errors.New("invalid TTL (must not be negative or end after 2262)")
+
+// MaxExpiry is the latest expiration time: the AOF and binary snapshots store
+// expiration times as int64 Unix nanoseconds, so a later one would be lost or
+// corrupted on restart.
+var MaxExpiry = time.Unix(0, math.MaxInt64)
+
+// checkTTL returns ErrInvalidTTL if ttl is negative or ends after MaxExpiry.
+func (c *Cache) checkTTL(ttl time.Duration) error {
+	if ttl < 0 || ttl > 0 && c.now().Add(ttl).After(MaxExpiry) {
+		return ErrInvalidTTL
+	}
+	return nil
+}
+
 // Set stores a key-value pair in the cache.
 // If ttl > 0, the key will expire after the specified duration.
-// If ttl == 0, the key will never expire (zero time is used as a marker).
-// If maxKeys is set and limit is reached, the least recently used key is evicted (LRU).
-func (c *Cache) Set(key, value string, ttl time.Duration) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// If ttl == 0, the key will never expire.
+// If ttl < 0 or ends after MaxExpiry, nothing is stored and ErrInvalidTTL is returned.
+// If maxKeys is set and limit is reached, a key is evicted by the eviction policy (LRU by default);
+// with EvictionNoEviction, a new key is rejected with ErrCacheFull instead.
+// If maxMemory is set, as many keys are evicted as needed to stay within it
+// (see makeRoom); an entry larger than the whole limit is rejected with
+// ErrValueTooLarge. The limits apply per shard, see shard.go.
+// A key rejected by WithKeyPolicy fails with a *KeyPolicyError, and a key or
+// value exceeding WithMaxKeyLength or WithMaxValueSize with a *LimitError.
+func (c *Cache) Set(key, value string, ttl time.Duration) error {
+	return c.setBytes(key, []byte(value), ttl, "")
+}
 
-	// Check if this is an update to an existing key
-	isNewKey := !c.hasKey(key)
+// SetBytes stores a copy of value under key, as Set does. value may contain
+// arbitrary bytes, and the caller may reuse it afterwards.
+func (c *Cache) SetBytes(key string, value []byte, ttl time.Duration) error {
+	return c.setBytes(key, bytes.Clone(value), ttl, "")
+}
 
-	// Clean up expired keys first to ensure accurate count
-	c.cleanupExpiredLocked()
+// SetBytesWithContentType stores a copy of value under key as SetBytes
+// does, along with the media type of the value (e.g. "image/png"), which is
+// returned in its KeyStat and persisted with it. Set and SetBytes store
+// values without one.
+func (c *Cache) SetBytesWithContentType(key string, value []byte, ttl time.Duration, contentType string) error {
+	return c.setBytes(key, bytes.Clone(value), ttl, contentType)
+}
+
+// SetOwnedBytes stores value under key as SetBytesWithContentType does, but
+// without copying it: the cache takes ownership of value, which the caller
+// must not modify or reuse afterwards. It saves a copy of large values read
+// into a buffer of their own, e.g. request bodies.
+func (c *Cache) SetOwnedBytes(key string, value []byte, ttl time.Duration, contentType string) error {
+	return c.setBytes(key, value, ttl, contentType)
+}
 
-	// If we're at the limit and this is a new key, evict the least recently used key
-	// Only count valid (non-expired) keys
-	if c.maxKeys > 0 && isNewKey && c.countValidKeys() >= c.maxKeys {
-		c.evictLRU()
+// setBytes stores value for Set, SetBytes, SetBytesWithContentType, and
+// SetOwnedBytes. The cache takes ownership of value, which must not be
+// modified afterwards.
+func (c *Cache) setBytes(key string, value []byte, ttl time.Duration, contentType string) error {
+	if err := c.checkTTL(ttl); err != nil {
+		return err
 	}
 
-	c.data[key] = value
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
+	s.beginWriteLocked(key)
+
+	var expiresAt time.Time
 	if ttl > 0 {
 		// Set expiration time to current time + TTL
-		c.expires[key] = time.Now().Add(ttl)
-	} else {
-		// No expiry - set to zero time (IsZero() check in Get/cleanup)
-		c.expires[key] = time.Time{}
+		expiresAt = c.now().Add(ttl)
 	}
+	// No expiry - zero time is stored (IsZero() check in Get/cleanup)
+	return s.storeLocked(key, value, expiresAt, contentType)
+}
+
+// beginWriteLocked prepares the shard for a write of key. Must be called
+// with lock held.
+func (s *shard) beginWriteLocked(key string) {
+	// Apply the reads since the last write, so eviction sees them
+	s.drainAccessesLocked()
+
+	// Clean up a batch of expired keys first; a larger burst is left to
+	// Cleanup, and makeRoom removes expired keys before evicting valid ones
+	s.expireDueLocked(s.cache.expireBatchSize)
+
+	// Overwriting an expired key adds a new live key: remove the expired one
+	// first, so makeRoom counts the write as a new key, and the old value is
+	// reported as expired rather than silently replaced
+	s.expireKeyLocked(key)
+}
+
+// storeLocked stores value under key with the given expiration time (zero:
+// no expiry) and content type (empty: none), evicting keys if needed, and
+// logs it to the AOF. The shard takes ownership of value. Must be called
+// with lock held, after beginWriteLocked.
+func (s *shard) storeLocked(key string, value []byte, expiresAt time.Time, contentType string) error {
+	if err := s.cache.checkKey(key); err != nil {
+		return err
+	}
+	if err := s.cache.checkLimits(key, len(value)); err != nil {
+		return err
+	}
+
+	// Evict keys by the eviction policy if the key or memory limit is reached
+	if err := s.makeRoom(key, value); err != nil {
+		return err
+	}
+
+	s.putLocked(key, value, contentType)
+	s.randomKeys.add(key)
 
 	// Update last access time (mark as recently used)
-	now := time.Now()
-	c.lastAccess[key] = now
+	s.touch(key, s.cache.now())
+	s.setExpiryLocked(key, expiresAt)
 
-	// Log to AOF
-	if c.aof != nil {
-		c.aof.LogSet(key, value, ttl)
+	s.cache.dirty.Add(1)
+
+	// Log to AOF with the absolute expiration time, so replay restores the exact expiry.
+	// Logging under the shard lock keeps the commands for a key in order.
+	if s.cache.aof != nil {
+		s.cache.aof.LogSet(key, valueString(value), expiresAt, contentType)
 	}
+	return nil
 }
 
-// hasKey checks if a key exists in the cache (must be called with lock held).
-func (c *Cache) hasKey(key string) bool {
-	_, exists := c.data[key]
+// hasKey checks if a key exists in the shard (must be called with lock held).
+func (s *shard) hasKey(key string) bool {
+	_, exists := s.data[key]
 	return exists
 }
 
 // isExpired checks if a key is expired (must be called with lock held).
-func (c *Cache) isExpired(key string) bool {
-	expiresAt, hasExpiry := c.expires[key]
+func (s *shard) isExpired(key string) bool {
+	expiresAt, hasExpiry := s.expires[key]
 	if !hasExpiry {
 		return false // No expiration set
 	}
-	if expiresAt.IsZero() {
-		return false // Zero time means no expiry
-	}
-	return time.Now().After(expiresAt)
+	return s.cache.now().After(expiresAt)
 }
 
-// countValidKeys returns the number of non-expired keys in the cache (must be called with lock held).
-func (c *Cache) countValidKeys() int {
-	if len(c.data) == 0 {
-		return 0
-	}
-	
-	now := time.Now()
-	count := 0
-	for key := range c.data {
-		expiresAt, hasExpiry := c.expires[key]
-		if !hasExpiry {
-			count++ // No expiration, key is valid
-			continue
-		}
-		if expiresAt.IsZero() {
-			count++ // Zero time means no expiry, key is valid
-			continue
-		}
-		if !now.After(expiresAt) {
-			count++ // Not expired yet, key is valid
-		}
-	}
-	return count
+// Get retrieves a value by key from the cache.
+// Returns the value and true if the key exists and is not expired.
+// Returns empty string and false if the key doesn't exist or has expired.
+// Expired keys are automatically deleted during the Get operation.
+// This operation marks the key as recently used (LRU).
+// Get only takes the shard's read lock, so reads run in parallel; the
+// access is recorded for the LRU list later (see accessBuffer), and the
+// write lock is only taken to delete an expired key.
+func (c *Cache) Get(key string) (string, bool) {
+	value, _, ok := c.get(key)
+	return string(value), ok
 }
 
-// evictLRU removes the least recently used key from the cache (LRU eviction).
-// Only considers valid (non-expired) keys for eviction.
-// Must be called with lock held.
-func (c *Cache) evictLRU() {
-	if len(c.lastAccess) == 0 {
-		return // Nothing to evict
+// GetBytes retrieves a value by key, as Get does, without copying it: the
+// returned slice is the stored value, shared with other readers, the
+// snapshots, and the AOF, so it must not be modified. A later Set replaces
+// the stored slice rather than writing into it, so the returned slice stays
+// valid. With WithCopyOnRead, GetBytes returns a copy instead.
+func (c *Cache) GetBytes(key string) ([]byte, bool) {
+	value, _, ok := c.get(key)
+	if ok && c.copyOnRead {
+		value = bytes.Clone(value)
 	}
+	return value, ok
+}
 
-	// Find the valid (non-expired) key with the oldest access time
-	var lruKey string
-	var oldestTime time.Time
-	first := true
-
-	for key, accessTime := range c.lastAccess {
-		// Skip expired keys - they should not affect LRU order
-		if c.isExpired(key) {
-			continue
-		}
+// GetBytesWithExpiry retrieves a value by key as GetBytes does, along with
+// its expiration time (zero if the key has no TTL), read atomically with the
+// value.
+func (c *Cache) GetBytesWithExpiry(key string) ([]byte, time.Time, bool) {
+	value, stat, ok := c.GetBytesWithStat(key)
+	return value, stat.ExpiresAt, ok
+}
 
-		// Only consider valid keys for LRU eviction
-		if first || accessTime.Before(oldestTime) {
-			lruKey = key
-			oldestTime = accessTime
-			first = false
-		}
+// GetBytesWithStat retrieves a value by key as GetBytes does, along with
+// its KeyStat, read atomically with the value.
+func (c *Cache) GetBytesWithStat(key string) ([]byte, KeyStat, bool) {
+	value, stat, ok := c.get(key)
+	if ok && c.copyOnRead {
+		value = bytes.Clone(value)
 	}
+	return value, stat, ok
+}
 
-	if lruKey == "" {
-		return // No valid key found to evict
+// KeyStat describes a key without its value, see Stat.
+type KeyStat struct {
+	Size        int       // Length of the value in bytes
+	ExpiresAt   time.Time // Expiration time (zero if the key has no TTL)
+	ModifiedAt  time.Time // Last time the value was written (not persisted: keys loaded from disk or a primary get the time they were loaded)
+	Version     uint64    // Changes with every write of the value, e.g. for ETags (see keyMeta)
+	ContentType string    // Media type given with SetBytesWithContentType ("" if none)
+}
+
+// Stat returns the value length and expiration time of key, and false if
+// the key doesn't exist or has expired, without copying the value. If access
+// is true, it counts as an access for eviction, as Get does; otherwise the
+// key's eviction order is unchanged, e.g. for monitoring probes that
+// shouldn't keep keys from being evicted.
+func (c *Cache) Stat(key string, access bool) (KeyStat, bool) {
+	if access {
+		_, stat, ok := c.get(key)
+		return stat, ok
 	}
 
-	// Remove from all maps
-	delete(c.data, lruKey)
-	delete(c.expires, lruKey)
-	delete(c.lastAccess, lruKey)
+	s := c.shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	// Log deletion to AOF
-	if c.aof != nil {
-		c.aof.LogDel(lruKey)
+	value, ok := s.data[key]
+	if !ok || s.isExpired(key) {
+		return KeyStat{}, false
 	}
+	return s.statLocked(key, value, s.expires[key]), true
 }
 
-// Get retrieves a value by key from the cache.
-// Returns the value and true if the key exists and is not expired.
-// Returns empty string and false if the key doesn't exist or has expired.
-// Expired keys are automatically deleted during the Get operation.
-// This operation marks the key as recently used (LRU).
-func (c *Cache) Get(key string) (string, bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// statLocked returns the KeyStat of key with the given value and expiration
+// time (must be called with lock held).
+func (s *shard) statLocked(key string, value []byte, expiresAt time.Time) KeyStat {
+	meta := s.meta[key]
+	return KeyStat{
+		Size:        len(value),
+		ExpiresAt:   expiresAt,
+		ModifiedAt:  time.Unix(0, meta.modified),
+		Version:     meta.version,
+		ContentType: meta.contentTypeString(),
+	}
+}
+
+// valueString returns a stored value as a string without copying it, for
+// the AOF, snapshots, and callbacks. Stored values are never modified (see
+// GetBytes), which is what makes sharing their memory safe.
+func valueString(value []byte) string {
+	return unsafe.String(unsafe.SliceData(value), len(value))
+}
+
+// get returns the stored value of key and its KeyStat for Get, GetBytes,
+// GetBytesWithStat, and Stat.
+func (c *Cache) get(key string) ([]byte, KeyStat, bool) {
+	s := c.shardFor(key)
+	s.mu.RLock()
 
 	// Check if key exists in the data map
-	value, ok := c.data[key]
+	value, ok := s.data[key]
 	if !ok {
-		return "", false
+		s.mu.RUnlock()
+		return nil, KeyStat{}, false
 	}
 
 	// Check if the key has expired
-	expiresAt, hasExpiry := c.expires[key]
-	if hasExpiry && !expiresAt.IsZero() {
-		// Key has an expiration time set, check if it's expired
-		if time.Now().After(expiresAt) {
-			// Key expired - delete it from all maps
-			delete(c.data, key)
-			delete(c.expires, key)
-			delete(c.lastAccess, key)
-			return "", false
-		}
+	now := c.now()
+	expiresAt := s.expires[key]
+	if !expiresAt.IsZero() && now.After(expiresAt) {
+		s.mu.RUnlock()
+		s.expireLazy(key)
+		return nil, KeyStat{}, false
 	}
 
-	// Update last access time (mark as recently used for LRU)
-	c.lastAccess[key] = time.Now()
+	// Record the access (mark as recently used for LRU)
+	stat := s.statLocked(key, value, expiresAt)
+	full := s.recordAccess(key, now)
+	s.mu.RUnlock()
 
-	return value, true
+	if full {
+		s.mu.Lock()
+		s.drainAccessesLocked()
+		s.mu.Unlock()
+	}
+	return value, stat, true
+}
+
+// expireLazy deletes key from all maps if it has expired, after Get found it
+// expired under the read lock. The key may have been set again in between.
+func (s *shard) expireLazy(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireKeyLocked(key)
+}
+
+// expireKeyLocked deletes key from all maps if it has expired and reports
+// whether it did. Must be called with lock held.
+func (s *shard) expireKeyLocked(key string) bool {
+	if !s.hasKey(key) || !s.isExpired(key) {
+		return false
+	}
+	s.notifyRemoved(key, EvictionReasonExpired)
+	s.removeLocked(key)
+	s.cache.dirty.Add(1)
+	s.cache.expiredLazy.Add(1)
+	return true
 }
 
 // Del removes a key-value pair from the cache.
 // Also removes the associated expiration entry if it exists.
-func (c *Cache) Del(key string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	
+// Returns true if a live key was removed. Deleting a missing or already
+// expired key is a no-op and is not logged to the AOF, so repeated
+// deletes don't make the AOF grow.
+func (c *Cache) Del(key string) bool {
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.hasKey(key) {
+		return false
+	}
+	expired := s.isExpired(key)
+	if expired {
+		s.notifyRemoved(key, EvictionReasonExpired)
+	}
+
 	// Remove from all maps
-	delete(c.data, key)
-	delete(c.expires, key)
-	delete(c.lastAccess, key)
+	s.removeLocked(key)
+
+	c.dirty.Add(1)
+
+	if expired {
+		c.expiredLazy.Add(1)
+		return false // Replay drops the key anyway, since its expiry has passed
+	}
+	c.deleted.Add(1)
+	c.notifyWatchers(KeyEventDel, key)
 
 	// Log to AOF
 	if c.aof != nil {
-		c.aof.LogDel(key)
+		c.aof.LogDel(key, "")
 	}
+	return true
 }
 
-// cleanupExpiredLocked removes expired keys from the cache.
+// cleanupExpiredLocked removes expired keys from the shard by scanning every
+// key (see WithFullScanExpiration) and returns how many were removed.
 // Must be called with lock held.
-func (c *Cache) cleanupExpiredLocked() {
-	now := time.Now()
-	for key, expiresAt := range c.expires {
-		// Only check keys with non-zero expiration time
-		// Zero time means the key never expires
-		if !expiresAt.IsZero() && now.After(expiresAt) {
+func (s *shard) cleanupExpiredLocked() int {
+	removed := 0
+	now := s.cache.now()
+	for key, expiresAt := range s.expires {
+		// Only keys with a TTL have an entry, so keys without one aren't scanned
+		if now.After(expiresAt) {
 			// Key has expired - remove it from all maps immediately
 			// This ensures expired keys don't affect LRU order
-			delete(c.data, key)
-			delete(c.expires, key)
-			delete(c.lastAccess, key)
+			s.notifyRemoved(key, EvictionReasonExpired)
+			s.removeLocked(key)
+			s.cache.dirty.Add(1)
+			s.cache.expiredActive.Add(1)
+			removed++
 		}
 	}
-}
-
-// Cleanup scans the cache and removes all expired keys.
-// This method is called periodically by the background goroutine.
-// Keys with zero expiration time (no expiry) are never removed.
-// Expired keys are removed immediately to prevent them from affecting LRU order.
-func (c *Cache) Cleanup() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.cleanupExpiredLocked()
+	return removed
 }
 
 // setInternal is used by AOF replay to set values without logging to AOF.
 // This prevents infinite loops during replay.
-func (c *Cache) setInternal(key, value string, ttl time.Duration) {
-	isNewKey := !c.hasKey(key)
-	
+// expiresAt is the absolute expiration time (zero time means no expiry).
+// Must be called with the key's shard locked.
+func (c *Cache) setInternal(key string, value []byte, expiresAt time.Time, contentType string) {
+	c.shardFor(key).setLocked(key, value, expiresAt, contentType)
+}
+
+// setLocked stores a key for setInternal (must be called with lock held).
+func (s *shard) setLocked(key string, value []byte, expiresAt time.Time, contentType string) {
+	s.drainAccessesLocked()
+
 	// Clean up expired keys first
-	c.cleanupExpiredLocked()
-	
-	// If we're at the limit and this is a new key, evict the least recently used key
-	// Only count valid (non-expired) keys
-	if c.maxKeys > 0 && isNewKey && c.countValidKeys() >= c.maxKeys {
-		c.evictLRU()
-	}
+	s.expireDueLocked(s.cache.expireBatchSize)
 
-	c.data[key] = value
+	// Evict keys by the eviction policy if the key or memory limit is reached.
+	// If that isn't possible, the key is kept anyway: it was accepted by the
+	// primary or before a restart.
+	s.makeRoom(key, value)
 
-	if ttl > 0 {
-		c.expires[key] = time.Now().Add(ttl)
-	} else {
-		c.expires[key] = time.Time{}
-	}
+	s.putLocked(key, value, contentType)
+	s.setExpiryLocked(key, expiresAt)
+	s.randomKeys.add(key)
 
 	// Update last access time
-	now := time.Now()
-	c.lastAccess[key] = now
+	s.touch(key, s.cache.now())
+}
+
+// resetLocked removes all keys without logging to AOF.
+// Must be called with all shards locked.
+func (c *Cache) resetLocked() {
+	for _, s := range c.shards {
+		s.reset()
+	}
 }
 
 // delInternal is used by AOF replay to delete values without logging to AOF.
+// Must be called with the key's shard locked.
 func (c *Cache) delInternal(key string) {
-	delete(c.data, key)
-	delete(c.expires, key)
-	delete(c.lastAccess, key)
+	c.shardFor(key).removeLocked(key)
+	c.notifyWatchers(KeyEventDel, key)
+}
+
+// removeLocked removes key from the maps, the eviction state, and the memory used.
+// Must be called with lock held.
+func (s *shard) removeLocked(key string) {
+	if value, ok := s.data[key]; ok {
+		s.usedMemory -= entrySize(key, value)
+		s.trackInternal(key, -1, -entrySize(key, value))
+	}
+	delete(s.data, key)
+	delete(s.expires, key)
+	delete(s.meta, key)
+	s.lru.remove(key)
+	s.randomKeys.remove(key)
+	s.ttlKeys.remove(key)
 }
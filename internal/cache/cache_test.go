@@ -0,0 +1,196 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestDelMissingKeyNotLogged checks that deleting keys that don't exist
+// doesn't append to the AOF, however often it is done.
+func TestDelMissingKeyNotLogged(t *testing.T) {
+	dir := t.TempDir()
+	aofPath := filepath.Join(dir, "test.aof")
+	c, err := NewCache(aofPath, filepath.Join(dir, "test.snapshot"), 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Set("key", "value", 0); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Del("key") {
+		t.Fatal("Del of an existing key returned false")
+	}
+	info, err := os.Stat(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := info.Size()
+
+	for range 1_000_000 {
+		if c.Del("key") {
+			t.Fatal("Del of a deleted key returned true")
+		}
+	}
+	if c.Del("never-set") {
+		t.Fatal("Del of a missing key returned true")
+	}
+
+	if info, err = os.Stat(aofPath); err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != size {
+		t.Errorf("AOF grew from %d to %d bytes after redundant deletes", size, info.Size())
+	}
+}
+
+// TestWithoutPersistenceWritesNoFiles checks that a cache without
+// persistence never touches the filesystem, whether it is disabled with an
+// empty AOF path or with WithoutPersistence.
+func TestWithoutPersistenceWritesNoFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		aof  string
+		opts []Option
+	}{
+		{"empty AOF path", "", nil},
+		{"WithoutPersistence", "test.aof", []Option{WithoutPersistence()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Chdir(dir) // Relative paths would land here
+
+			c, err := NewCache(tt.aof, "test.snapshot", 0, tt.opts...)
+			if err != nil {
+				t.Fatalf("NewCache: %v", err)
+			}
+			if c.Persistent() {
+				t.Error("Persistent() = true")
+			}
+			for i := range 100 {
+				if err := c.Set("key", "value", 0); err != nil {
+					t.Fatal(err)
+				}
+				c.Del("key")
+				if err := c.Set("ttl", "value", time.Duration(i+1)*time.Second); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.ClearAOF(); err != nil {
+				t.Errorf("ClearAOF: %v", err)
+			}
+			if _, err := c.CreateSnapshotAndClearAOF("test.snapshot"); !errors.Is(err, ErrPersistenceDisabled) {
+				t.Errorf("CreateSnapshotAndClearAOF error = %v, want ErrPersistenceDisabled", err)
+			}
+			if err := c.Close(); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				t.Errorf("file %s was created", e.Name())
+			}
+		})
+	}
+}
+
+// TestSetExpiredKeyRespectsMaxKeys fills the cache to maxKeys, lets a key
+// expire, and sets it again plus a new key: overwriting an expired key adds
+// a live key, so it must not let the cache go over the limit.
+func TestSetExpiredKeyRespectsMaxKeys(t *testing.T) {
+	const maxKeys = 3
+	clock := newFakeClock()
+	c, err := NewCache("", "", maxKeys, WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	set := func(key string, ttl time.Duration) {
+		t.Helper()
+		if err := c.Set(key, "value", ttl); err != nil {
+			t.Fatalf("Set(%s): %v", key, err)
+		}
+		if n := c.Stats().Keys; n > maxKeys {
+			t.Fatalf("%d keys after Set(%s), limit %d", n, key, maxKeys)
+		}
+	}
+	set("a", 0)
+	set("b", 0)
+	set("ttl", time.Second)
+	clock.Advance(2 * time.Second)
+
+	set("ttl", 0)
+	set("d", 0)
+	if _, ok := c.Get("ttl"); !ok {
+		t.Error("key set again after it expired is missing")
+	}
+	if stats := c.Stats(); stats.Keys != maxKeys || stats.Evicted != 1 {
+		t.Errorf("%d keys and %d evicted, want %d and 1", stats.Keys, stats.Evicted, maxKeys)
+	}
+}
+
+// TestEmptyValue checks that an empty value is stored as present, and
+// stays so through AOF replay, AOF rewrites, and both snapshot formats.
+func TestEmptyValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		persist func(c *Cache, snapshotPath string) error
+		opts    []Option
+	}{
+		{"AOF", nil, nil},
+		{"AOF rewrite", func(c *Cache, _ string) error { return c.RewriteAOF() }, nil},
+		{"JSON snapshot", func(c *Cache, path string) error {
+			_, err := c.CreateSnapshotAndClearAOF(path)
+			return err
+		}, []Option{WithSnapshotFormat(SnapshotFormatJSON)}},
+		{"binary snapshot", func(c *Cache, path string) error {
+			_, err := c.CreateSnapshotAndClearAOF(path)
+			return err
+		}, []Option{WithSnapshotFormat(SnapshotFormatBinary)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			aofPath, snapshotPath := filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot")
+			c, err := NewCache(aofPath, snapshotPath, 0, tt.opts...)
+			if err != nil {
+				t.Fatalf("NewCache: %v", err)
+			}
+			if err := c.Set("empty", "", 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.SetBytes("nil", nil, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if tt.persist != nil {
+				if err := tt.persist(c, snapshotPath); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c.Close()
+
+			c, err = NewCache(aofPath, snapshotPath, 0, tt.opts...)
+			if err != nil {
+				t.Fatalf("NewCache after restart: %v", err)
+			}
+			defer c.Close()
+			for _, key := range []string{"empty", "nil"} {
+				if value, ok := c.Get(key); !ok || value != "" {
+					t.Errorf("%s = %q (present %v), want present and empty", key, value, ok)
+				}
+			}
+			if n := c.Stats().Keys; n != 2 {
+				t.Errorf("%d keys, want 2", n)
+			}
+		})
+	}
+}
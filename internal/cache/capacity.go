@@ -0,0 +1,122 @@
+package cache
+
+import "fmt"
+
+// Runtime key and memory limits.
+//
+// SetMaxKeys and SetMaxMemory change the limits of a running cache, e.g.
+// after observing production, without a restart and its AOF replay. The
+// shards' shares change right away. When a limit is lowered below the size
+// of the dataset, keys are evicted by the eviction policy down to it, shard
+// by shard and evictBatchSize keys per lock hold, so reads and writes of
+// the shard aren't held up for long. The shard count stays the one chosen
+// for the limits at startup (see defaultShardCount), so a limit set far
+// lower than at startup is enforced more approximately: every shard keeps a
+// share of at least one key or byte, so a limit below the shard count allows
+// up to one key per shard. With
+// EvictionNoEviction nothing is evicted: new keys are rejected until enough
+// keys are deleted or expire.
+//
+// SetEvictionPaused stops eviction, e.g. while the server is read-only for
+// maintenance, so the AOF isn't written: writes still accepted (e.g. from
+// a primary) go over the limits, and the keys over them are evicted once
+// eviction resumes.
+
+// evictBatchSize is the largest number of keys evicted per shard lock hold
+// when a limit is lowered.
+const evictBatchSize = 256
+
+// MaxKeys returns the key limit (0 = unlimited).
+func (c *Cache) MaxKeys() int {
+	return int(c.maxKeys.Load())
+}
+
+// MaxMemory returns the memory limit in bytes (0 = unlimited).
+func (c *Cache) MaxMemory() int64 {
+	return c.maxMemory.Load()
+}
+
+// SetMaxKeys changes the key limit (0 = unlimited) and evicts keys down to
+// it. It returns the number of keys evicted.
+func (c *Cache) SetMaxKeys(n int) (int, error) {
+	if n < 0 {
+		return 0, fmt.Errorf("invalid key limit %d (must be >= 0)", n)
+	}
+	c.resizeMu.Lock()
+	defer c.resizeMu.Unlock()
+	c.maxKeys.Store(int64(n))
+	return c.applyLimits(), nil
+}
+
+// SetMaxMemory changes the memory limit in bytes (0 = unlimited) and evicts
+// keys down to it. It returns the number of keys evicted.
+func (c *Cache) SetMaxMemory(bytes int64) (int, error) {
+	if bytes < 0 {
+		return 0, fmt.Errorf("invalid memory limit %d (must be >= 0)", bytes)
+	}
+	c.resizeMu.Lock()
+	defer c.resizeMu.Unlock()
+	c.maxMemory.Store(bytes)
+	return c.applyLimits(), nil
+}
+
+// EvictionPaused reports whether eviction is paused.
+func (c *Cache) EvictionPaused() bool {
+	return c.evictionPaused.Load()
+}
+
+// SetEvictionPaused pauses or resumes eviction, see above. Resuming evicts
+// the keys over the limits, and returns the number of keys evicted.
+func (c *Cache) SetEvictionPaused(paused bool) int {
+	c.resizeMu.Lock()
+	defer c.resizeMu.Unlock()
+	if c.evictionPaused.Swap(paused) == paused || paused {
+		return 0
+	}
+	return c.applyLimits()
+}
+
+// applyLimits splits the current limits between the shards and evicts the
+// keys over them, in batches. Must be called with resizeMu held.
+func (c *Cache) applyLimits() int {
+	maxKeys, maxMemory := c.MaxKeys(), c.MaxMemory()
+	evicted := 0
+	for i, s := range c.shards {
+		s.mu.Lock()
+		s.maxKeys = splitLimit(maxKeys, len(c.shards), i)
+		s.maxMemory = splitLimit(maxMemory, len(c.shards), i)
+		for {
+			n, done := s.evictToFitBatch(evictBatchSize)
+			evicted += n
+			if done {
+				break
+			}
+			// Let the shard's readers and writers in between batches
+			s.mu.Unlock()
+			s.mu.Lock()
+		}
+		s.mu.Unlock()
+	}
+	return evicted
+}
+
+// evictToFitBatch is evictToFit limited to batch removals. It returns the
+// number of keys evicted (expired keys removed on the way aren't counted),
+// and whether the shard is within its limits or has nothing left to evict.
+// Must be called with lock held.
+func (s *shard) evictToFitBatch(batch int) (int, bool) {
+	evicted := 0
+	for range batch {
+		if !(s.maxKeys > 0 && len(s.data) > s.maxKeys || s.maxMemory > 0 && s.usedMemory > s.maxMemory) {
+			return evicted, true
+		}
+		if s.expireDueLocked(1) > 0 {
+			continue // An expired key is the first to go
+		}
+		if !s.evict() {
+			return evicted, true // Nothing left to evict
+		}
+		evicted++
+	}
+	return evicted, false
+}
@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestSplitLimit checks that the shares of a limit add up to it, and that
+// a limit below the shard count leaves no shard with a share of 0, which
+// would mean no limit.
+func TestSplitLimit(t *testing.T) {
+	tests := []struct {
+		limit, n int
+		want     []int
+	}{
+		{0, 4, []int{0, 0, 0, 0}},
+		{8, 4, []int{2, 2, 2, 2}},
+		{10, 4, []int{3, 3, 2, 2}},
+		{2, 4, []int{1, 1, 1, 1}},
+		{1, 16, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		for i, want := range tt.want {
+			if got := splitLimit(tt.limit, tt.n, i); got != want {
+				t.Errorf("splitLimit(%d, %d, %d) = %d, want %d", tt.limit, tt.n, i, got, want)
+			}
+		}
+	}
+}
+
+// TestSetMaxKeysBelowShardCount checks that a key limit lowered below the
+// shard count still bounds the dataset, to one key per shard.
+func TestSetMaxKeysBelowShardCount(t *testing.T) {
+	const shards = 16
+	c, err := NewCache("", "", 0, WithShards(shards))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	for i := range 100 {
+		if err := c.Set("key"+strconv.Itoa(i), "value", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.SetMaxKeys(2); err != nil {
+		t.Fatal(err)
+	}
+	if keys := c.Stats().Keys; keys > shards {
+		t.Errorf("%d keys after SetMaxKeys(2), want at most %d", keys, shards)
+	}
+	for i := range 1000 {
+		if err := c.Set("new"+strconv.Itoa(i), "value", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := c.Stats().Keys; keys > shards {
+		t.Errorf("%d keys after 1000 more sets, want at most %d", keys, shards)
+	}
+}
+
+// TestSetBatchDuringLimitChanges runs batches while the limits change, for
+// the race detector: the shares of the limits are read under the shard
+// locks.
+func TestSetBatchDuringLimitChanges(t *testing.T) {
+	c, err := NewCache("", "", 0, WithShards(8))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Go(func() {
+			for i := range 200 {
+				entries := make([]Entry, 10)
+				for j := range entries {
+					entries[j] = Entry{Key: "w" + strconv.Itoa(w) + "-" + strconv.Itoa(i*10+j), Value: "value"}
+				}
+				if err := c.SetBatch(entries); err != nil && !errors.Is(err, ErrValueTooLarge) {
+					t.Error(err)
+					return
+				}
+			}
+		})
+	}
+	for i := range 200 {
+		if _, err := c.SetMaxMemory(int64(i%5) * 4096); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.SetMaxKeys(i % 7 * 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+// TestSetMaxKeys checks that lowering the key limit evicts down to it and
+// returns how many keys were evicted, and that 0 removes the limit.
+func TestSetMaxKeys(t *testing.T) {
+	c, err := NewCache("", "", 0, WithShards(1))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	for i := range 5000 {
+		if err := c.Set("key"+strconv.Itoa(i), "value", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	evicted, err := c.SetMaxKeys(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := c.Stats().Keys; keys != 1000 || evicted != 4000 {
+		t.Errorf("SetMaxKeys(1000): %d keys left, %d evicted, want 1000 and 4000", keys, evicted)
+	}
+	if _, err := c.SetMaxKeys(-1); err == nil {
+		t.Error("SetMaxKeys(-1) succeeded")
+	}
+
+	if _, err := c.SetMaxKeys(0); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 5000 {
+		if err := c.Set("new"+strconv.Itoa(i), "value", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := c.Stats().Keys; keys != 6000 {
+		t.Errorf("%d keys after SetMaxKeys(0), want 6000", keys)
+	}
+}
+
+// TestSetMaxMemoryBelowShardCount checks that a memory limit lowered below
+// the shard count still limits every shard, rather than leaving shards
+// with a share of 0, which would mean no limit.
+func TestSetMaxMemoryBelowShardCount(t *testing.T) {
+	c, err := NewCache("", "", 0, WithShards(16))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	for i := range 100 {
+		if err := c.Set("key"+strconv.Itoa(i), "value", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.SetMaxMemory(10); err != nil {
+		t.Fatal(err)
+	}
+	if stats := c.Stats(); stats.Keys != 0 || stats.UsedMemory != 0 {
+		t.Errorf("%d keys and %d bytes left under a limit of 10 bytes, want none", stats.Keys, stats.UsedMemory)
+	}
+	if err := c.Set("key", "value", 0); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Set under a limit of 10 bytes: %v, want ErrValueTooLarge", err)
+	}
+	if err := c.SetBatch([]Entry{{Key: "a", Value: "value"}, {Key: "b", Value: "value"}}); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("SetBatch under a limit of 10 bytes: %v, want ErrValueTooLarge", err)
+	}
+}
@@ -0,0 +1,359 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// ErrCacheFull is returned by Set for a new key when maxKeys is reached, or
+// for a write that doesn't fit in maxMemory, and the eviction policy is
+// EvictionNoEviction.
+var ErrCacheFull = errors.New("cache is full")
+
+// EvictionPolicy selects the key evicted when maxKeys is reached.
+type EvictionPolicy int
+
+const (
+	EvictionLRU         EvictionPolicy = iota // Least recently used key (default)
+	EvictionLFU                               // Least frequently used key (approximate)
+	EvictionRandom                            // Random key, without tracking accesses
+	EvictionVolatileTTL                       // Key expiring first, or LRU if no key has a TTL
+	EvictionNoEviction                        // No key: new keys are rejected with ErrCacheFull
+)
+
+// String returns the name of the policy, as accepted by ParseEvictionPolicy.
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictionLRU:
+		return "lru"
+	case EvictionLFU:
+		return "lfu"
+	case EvictionRandom:
+		return "allkeys-random"
+	case EvictionVolatileTTL:
+		return "volatile-ttl"
+	case EvictionNoEviction:
+		return "noeviction"
+	default:
+		return fmt.Sprintf("EvictionPolicy(%d)", int(p))
+	}
+}
+
+// ParseEvictionPolicy parses a policy name: "lru", "lfu", or "random" (also
+// accepted with the Redis "allkeys-" prefix), "volatile-ttl", or "noeviction".
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch s {
+	case "lru", "allkeys-lru":
+		return EvictionLRU, nil
+	case "lfu", "allkeys-lfu":
+		return EvictionLFU, nil
+	case "random", "allkeys-random":
+		return EvictionRandom, nil
+	case "volatile-ttl":
+		return EvictionVolatileTTL, nil
+	case "noeviction":
+		return EvictionNoEviction, nil
+	default:
+		return 0, fmt.Errorf("unknown eviction policy %q (must be lru, lfu, allkeys-random, volatile-ttl, or noeviction)", s)
+	}
+}
+
+// policy returns the eviction policy in effect.
+func (c *Cache) policy() EvictionPolicy {
+	return EvictionPolicy(c.evictionPolicy.Load())
+}
+
+// SetEvictionPolicy changes the eviction policy of a running cache. The
+// shards are locked while it changes, so every eviction uses a single
+// policy. The access history is kept between the LRU, LFU, and volatile-ttl
+// policies; the random policy doesn't track accesses, so switching to it
+// drops the history, and switching from it starts every key as accessed now.
+func (c *Cache) SetEvictionPolicy(policy EvictionPolicy) error {
+	if policy < EvictionLRU || policy > EvictionNoEviction {
+		return fmt.Errorf("invalid eviction policy %v", policy)
+	}
+	c.lockAll()
+	defer c.unlockAll()
+	old := c.policy()
+	if old == policy {
+		return nil
+	}
+	c.evictionPolicy.Store(int32(policy))
+	if old != EvictionRandom && policy != EvictionRandom {
+		return nil
+	}
+	now := c.now()
+	for _, s := range c.shards {
+		s.drainAccessesLocked()
+		s.resetEviction()
+		for key := range s.data {
+			s.addKey(key, now)
+		}
+	}
+	return nil
+}
+
+// LFU (Least Frequently Used) eviction approximates access frequency like
+// Redis: every key has an 8-bit counter that is incremented with a
+// probability that falls as the counter grows, so 255 stands for about a
+// million accesses, and that is decremented once per lfuDecayPeriod without
+// access, so keys that were hot a while ago can be evicted too. New keys start
+// at lfuInitValue so they aren't evicted before their first reads.
+//
+// On eviction, lfuSamples valid keys are sampled and the one with the lowest
+// counter (the least recently used one on ties) is evicted. A scan that reads
+// many keys once then evicts its own keys instead of the working set, which
+// LRU would evict.
+const (
+	lfuInitValue   = 5           // Counter of a new key
+	lfuLogFactor   = 10          // Higher values need more accesses to increment the counter
+	lfuDecayPeriod = time.Minute // Time without access per counter decrement
+	lfuSamples     = 10          // Keys compared per eviction (Redis maxmemory-samples)
+)
+
+// resetEviction clears the eviction state, e.g. when the dataset is replaced.
+// Must be called with lock held.
+func (s *shard) resetEviction() {
+	s.lru = newLRUList()
+	s.randomKeys = nil
+	if s.cache.policy() == EvictionRandom {
+		s.randomKeys = newKeySet()
+	}
+}
+
+// touch records an access to key at now for the eviction policy (must be
+// called with lock held). The random policy doesn't track accesses, which
+// saves Get the list update.
+func (s *shard) touch(key string, now time.Time) {
+	switch s.cache.policy() {
+	case EvictionRandom:
+		return
+	case EvictionLFU:
+		if e, ok := s.lru.entries[key]; ok {
+			e.freq = lfuIncrement(lfuDecay(e.freq, now.Sub(e.lastAccess)))
+		}
+	}
+	s.lru.touch(key, now)
+}
+
+// addKey records key for the eviction policy with the last access time t,
+// e.g. one saved in a snapshot (must be called with lock held).
+func (s *shard) addKey(key string, t time.Time) {
+	if s.randomKeys != nil {
+		s.randomKeys.add(key)
+		return
+	}
+	s.lru.touch(key, t)
+}
+
+// makeRoom evicts keys by the eviction policy so that value can be stored
+// under key within the shard's share of maxKeys and maxMemory (must be
+// called with lock held). It returns ErrValueTooLarge if the entry alone
+// exceeds the memory share, and
+// ErrCacheFull instead of evicting with EvictionNoEviction. A write that
+// doesn't grow the dataset (e.g. replacing a value by a shorter one) always
+// fits.
+//
+// The key limit is checked against len(s.data), which every write and
+// removal keeps up to date, rather than by counting the valid keys. Expired
+// keys that are still stored are removed first, so a valid key is only
+// evicted when all stored keys are valid and the count is exact.
+func (s *shard) makeRoom(key string, value []byte) error {
+	if s.maxMemory > 0 && entrySize(key, value) > s.maxMemory {
+		return ErrValueTooLarge
+	}
+
+	// If we're at the limit and this is a new key, make room for one key
+	if s.maxKeys > 0 && !s.hasKey(key) {
+		for len(s.data) >= s.maxKeys {
+			if s.expireDueLocked(1) > 0 {
+				continue // An expired key is the first to go
+			}
+			if s.cache.policy() == EvictionNoEviction {
+				return ErrCacheFull
+			}
+			if !s.evict() {
+				break // Nothing left to evict
+			}
+		}
+	}
+
+	// A large value may need several keys evicted
+	for s.maxMemory > 0 && s.usedMemory+s.memoryDelta(key, len(value)) > s.maxMemory {
+		if s.expireDueLocked(1) > 0 {
+			continue // An expired key is the first to go
+		}
+		if s.cache.policy() == EvictionNoEviction {
+			return ErrCacheFull
+		}
+		if !s.evict() {
+			break // Nothing left to evict
+		}
+	}
+	return nil
+}
+
+// evict removes one valid (non-expired) key chosen by the eviction policy
+// and logs its deletion to the AOF. It returns false if there was no key to
+// evict, or eviction is paused (see SetEvictionPaused). Must be called with
+// lock held.
+func (s *shard) evict() bool {
+	c := s.cache
+	if c.evictionPaused.Load() {
+		return false
+	}
+	var key string
+	switch c.policy() {
+	case EvictionLFU:
+		key = s.lfuCandidate()
+	case EvictionRandom:
+		key = s.randomCandidate()
+	case EvictionVolatileTTL:
+		// A key about to expire is the cheapest loss; without any, use LRU.
+		// Keys already expired aren't counted as valid, so they are removed
+		// as expired and don't make room.
+		for key = s.ttlKeys.next(); key != "" && s.isExpired(key); key = s.ttlKeys.next() {
+			s.expireDueLocked(1)
+		}
+		if key == "" {
+			key = s.lruCandidate()
+		}
+	case EvictionNoEviction:
+		return false
+	default:
+		key = s.lruCandidate()
+	}
+
+	if key == "" {
+		return false // No valid key found to evict
+	}
+
+	// Remove from all maps
+	_, existed := s.data[key]
+	s.notifyRemoved(key, EvictionReasonEvicted)
+	s.removeLocked(key)
+
+	// Log deletion to AOF (only if there was actually a value to remove)
+	if existed {
+		c.dirty.Add(1)
+		c.evicted.Add(1)
+		if s.evictLog != nil {
+			*s.evictLog = append(*s.evictLog, AOFCommand{Op: "DEL", Key: key, Reason: DelReasonEvicted})
+		} else if c.aof != nil {
+			c.aof.LogDel(key, DelReasonEvicted)
+		}
+	}
+	return true
+}
+
+// lfuCandidate returns the key with the lowest access frequency among
+// lfuSamples valid keys, or "" if there is none.
+func (s *shard) lfuCandidate() string {
+	now := s.cache.now()
+	var best *lruEntry
+	var bestFreq uint8
+	sampled := 0
+	// Map iteration starts at a random position, which makes the sample
+	for key, e := range s.lru.entries {
+		if s.isExpired(key) {
+			continue
+		}
+		freq := lfuDecay(e.freq, now.Sub(e.lastAccess))
+		if best == nil || freq < bestFreq || freq == bestFreq && e.lastAccess.Before(best.lastAccess) {
+			best, bestFreq = e, freq
+		}
+		if sampled++; sampled == lfuSamples {
+			break
+		}
+	}
+
+	if best == nil {
+		return ""
+	}
+	return best.key
+}
+
+// randomCandidate returns a uniformly random valid key, or "" if there is
+// none. Set removes expired keys first, so the first pick is normally valid.
+func (s *shard) randomCandidate() string {
+	keys := s.randomKeys.keys
+	if len(keys) == 0 {
+		return ""
+	}
+	start := rand.IntN(len(keys))
+	for i := range keys {
+		key := keys[(start+i)%len(keys)]
+		if !s.isExpired(key) {
+			return key
+		}
+	}
+	return ""
+}
+
+// keySet is a set of keys that supports picking a random key in constant
+// time: the keys are kept in a slice, and a removed key is replaced by the
+// last one.
+type keySet struct {
+	keys  []string
+	index map[string]int // Position of every key in keys
+}
+
+// newKeySet creates an empty key set.
+func newKeySet() *keySet {
+	return &keySet{index: make(map[string]int)}
+}
+
+// add adds key to the set (no-op on a nil set or if it is already in it).
+func (s *keySet) add(key string) {
+	if s == nil {
+		return
+	}
+	if _, ok := s.index[key]; !ok {
+		s.index[key] = len(s.keys)
+		s.keys = append(s.keys, key)
+	}
+}
+
+// remove removes key from the set (no-op on a nil set or if it isn't in it).
+func (s *keySet) remove(key string) {
+	if s == nil {
+		return
+	}
+	i, ok := s.index[key]
+	if !ok {
+		return
+	}
+	last := len(s.keys) - 1
+	s.keys[i] = s.keys[last]
+	s.index[s.keys[i]] = i
+	s.keys[last] = ""
+	s.keys = s.keys[:last]
+	delete(s.index, key)
+}
+
+// lfuIncrement increments an LFU counter logarithmically: the higher the
+// counter, the lower the probability.
+func lfuIncrement(freq uint8) uint8 {
+	if freq == 255 {
+		return freq
+	}
+	base := float64(max(int(freq)-lfuInitValue, 0))
+	if rand.Float64() < 1/(base*lfuLogFactor+1) {
+		freq++
+	}
+	return freq
+}
+
+// lfuDecay decrements an LFU counter for every lfuDecayPeriod of idle time.
+func lfuDecay(freq uint8, idle time.Duration) uint8 {
+	if idle < lfuDecayPeriod {
+		return freq
+	}
+	periods := idle / lfuDecayPeriod
+	if periods >= time.Duration(freq) {
+		return 0
+	}
+	return freq - uint8(periods)
+}
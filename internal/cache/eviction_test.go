@@ -0,0 +1,350 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// readAOFCommands returns the commands of the AOF file at path.
+func readAOFCommands(t *testing.T, path string) []AOFCommand {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader, err := NewAOFReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cmds []AOFCommand
+	for {
+		cmd, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return cmds
+		}
+		if err != nil {
+			t.Fatalf("reading %s: %v", path, err)
+		}
+		cmds = append(cmds, cmd)
+	}
+}
+
+// TestParseEvictionPolicy checks the accepted policy names, and that String
+// gives a name ParseEvictionPolicy accepts.
+func TestParseEvictionPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		want EvictionPolicy
+	}{
+		{"lru", EvictionLRU},
+		{"allkeys-lru", EvictionLRU},
+		{"lfu", EvictionLFU},
+		{"allkeys-lfu", EvictionLFU},
+		{"random", EvictionRandom},
+		{"allkeys-random", EvictionRandom},
+		{"volatile-ttl", EvictionVolatileTTL},
+	}
+	for _, tt := range tests {
+		got, err := ParseEvictionPolicy(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseEvictionPolicy(%q) = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+		if back, err := ParseEvictionPolicy(got.String()); err != nil || back != got {
+			t.Errorf("ParseEvictionPolicy(%q) = %v, %v, want %v", got.String(), back, err, got)
+		}
+	}
+	for _, name := range []string{"", "LRU", "volatile-lru"} {
+		if _, err := ParseEvictionPolicy(name); err == nil {
+			t.Errorf("ParseEvictionPolicy(%q) succeeded", name)
+		}
+	}
+}
+
+// TestLFUDecay checks that a counter loses one per lfuDecayPeriod without
+// access, down to 0.
+func TestLFUDecay(t *testing.T) {
+	tests := []struct {
+		freq uint8
+		idle time.Duration
+		want uint8
+	}{
+		{10, 0, 10},
+		{10, lfuDecayPeriod - time.Second, 10},
+		{10, lfuDecayPeriod, 9},
+		{10, 3*lfuDecayPeriod + time.Second, 7},
+		{10, 10 * lfuDecayPeriod, 0},
+		{10, 1000 * lfuDecayPeriod, 0},
+		{0, lfuDecayPeriod, 0},
+	}
+	for _, tt := range tests {
+		if got := lfuDecay(tt.freq, tt.idle); got != tt.want {
+			t.Errorf("lfuDecay(%d, %v) = %d, want %d", tt.freq, tt.idle, got, tt.want)
+		}
+	}
+}
+
+// TestLFUIncrement checks that the counter grows logarithmically: the first
+// access past lfuInitValue always counts, and a million accesses don't
+// saturate it by far.
+func TestLFUIncrement(t *testing.T) {
+	if got := lfuIncrement(lfuInitValue); got != lfuInitValue+1 {
+		t.Errorf("lfuIncrement(%d) = %d, want %d", lfuInitValue, got, lfuInitValue+1)
+	}
+	if got := lfuIncrement(255); got != 255 {
+		t.Errorf("lfuIncrement(255) = %d", got)
+	}
+	freq := uint8(lfuInitValue)
+	for range 1000 {
+		freq = lfuIncrement(freq)
+	}
+	if freq <= lfuInitValue+5 || freq >= 100 {
+		t.Errorf("counter is %d after 1000 accesses", freq)
+	}
+}
+
+// TestEvictionScanWorkload reads a working set many times, then scans many
+// keys once: LFU keeps the working set, which LRU evicts for the scan.
+func TestEvictionScanWorkload(t *testing.T) {
+	const (
+		maxKeys = 100
+		hot     = 10
+		scan    = 1000
+	)
+	tests := []struct {
+		policy    EvictionPolicy
+		survivors int // Hot keys left after the scan
+	}{
+		{EvictionLFU, hot},
+		{EvictionLRU, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			clock := newFakeClock()
+			c, err := NewCache("", "", maxKeys, WithShards(1), WithClock(clock.Now), WithEvictionPolicy(tt.policy))
+			if err != nil {
+				t.Fatalf("NewCache: %v", err)
+			}
+			defer c.Close()
+
+			for i := range hot {
+				if err := c.Set("hot"+strconv.Itoa(i), "value", 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for range 100 {
+				clock.Advance(time.Millisecond)
+				for i := range hot {
+					if _, ok := c.Get("hot" + strconv.Itoa(i)); !ok {
+						t.Fatalf("hot%d is missing", i)
+					}
+				}
+			}
+
+			for i := range scan {
+				clock.Advance(time.Millisecond)
+				key := "scan" + strconv.Itoa(i)
+				if err := c.Set(key, "value", 0); err != nil {
+					t.Fatal(err)
+				}
+				c.Get(key)
+			}
+
+			survivors := 0
+			for i := range hot {
+				if _, ok := c.Get("hot" + strconv.Itoa(i)); ok {
+					survivors++
+				}
+			}
+			if survivors != tt.survivors {
+				t.Errorf("%d of %d hot keys left after the scan, want %d", survivors, hot, tt.survivors)
+			}
+			if keys := c.Stats().Keys; keys != maxKeys {
+				t.Errorf("%d keys, want %d", keys, maxKeys)
+			}
+		})
+	}
+}
+
+// TestRandomEviction checks that the random policy evicts valid keys,
+// counts and logs the evictions like LRU, and doesn't track accesses.
+func TestRandomEviction(t *testing.T) {
+	const maxKeys = 10
+	dir := t.TempDir()
+	aofPath := filepath.Join(dir, "test.aof")
+	clock := newFakeClock()
+	c, err := NewCache(aofPath, filepath.Join(dir, "test.snapshot"), maxKeys,
+		WithShards(1), WithClock(clock.Now), WithEvictionPolicy(EvictionRandom))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	if err := c.Set("ttl", "value", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Second) // Expired keys go first, not counted as evicted
+	for i := range 100 {
+		key := "key" + strconv.Itoa(i)
+		if err := c.Set(key, "value", 0); err != nil {
+			t.Fatal(err)
+		}
+		c.Get(key)
+	}
+	stats := c.Stats()
+	if stats.Keys != maxKeys || stats.Evicted != 100-maxKeys {
+		t.Errorf("%d keys and %d evicted, want %d and %d", stats.Keys, stats.Evicted, maxKeys, 100-maxKeys)
+	}
+	s := c.shards[0]
+	if n := len(s.lru.entries); n != 0 {
+		t.Errorf("%d keys in the LRU list, want none", n)
+	}
+	if n := len(s.randomKeys.keys); n != maxKeys {
+		t.Errorf("%d keys in the random key set, want %d", n, maxKeys)
+	}
+
+	// Switching to LRU lists the keys again
+	if err := c.SetEvictionPolicy(EvictionLRU); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.lru.entries); n != maxKeys || s.randomKeys != nil {
+		t.Errorf("%d keys in the LRU list after switching to LRU, want %d", n, maxKeys)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	evicted := map[string]bool{}
+	for _, cmd := range readAOFCommands(t, aofPath) {
+		if cmd.Op == "DEL" && cmd.Reason == DelReasonEvicted {
+			evicted[cmd.Key] = true
+		}
+	}
+	if len(evicted) != 100-maxKeys || evicted["ttl"] {
+		t.Errorf("AOF logs %d evictions (ttl: %v), want %d of the other keys", len(evicted), evicted["ttl"], 100-maxKeys)
+	}
+}
+
+// BenchmarkGetEvictionPolicy reads keys under each policy: the random
+// policy doesn't record the accesses, which LRU applies to its list.
+func BenchmarkGetEvictionPolicy(b *testing.B) {
+	const keys = 100_000
+	for _, policy := range []EvictionPolicy{EvictionLRU, EvictionRandom} {
+		b.Run(policy.String(), func(b *testing.B) {
+			c, err := NewCache("", "", keys, WithEvictionPolicy(policy))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			names := make([]string, keys)
+			for i := range names {
+				names[i] = "key" + strconv.Itoa(i)
+				if err := c.Set(names[i], "value", 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for i := range b.N {
+				if _, ok := c.Get(names[i%keys]); !ok {
+					b.Fatal("missing key")
+				}
+			}
+		})
+	}
+}
+
+// TestVolatileTTLEviction checks that volatile-ttl evicts the key expiring
+// first, following TTL changes, and the least recently used key when no key
+// has a TTL.
+func TestVolatileTTLEviction(t *testing.T) {
+	clock := newFakeClock()
+	newCache := func() *Cache {
+		c, err := NewCache("", "", 4, WithShards(1), WithClock(clock.Now), WithEvictionPolicy(EvictionVolatileTTL))
+		if err != nil {
+			t.Fatalf("NewCache: %v", err)
+		}
+		return c
+	}
+	set := func(c *Cache, key string, ttl time.Duration) {
+		t.Helper()
+		clock.Advance(time.Millisecond)
+		if err := c.Set(key, "value", ttl); err != nil {
+			t.Fatalf("Set(%s): %v", key, err)
+		}
+	}
+	keys := func(c *Cache, names ...string) []string {
+		var present []string
+		for _, key := range names {
+			if _, ok := c.Get(key); ok {
+				present = append(present, key)
+			}
+		}
+		return present
+	}
+
+	t.Run("nearest expiry", func(t *testing.T) {
+		c := newCache()
+		defer c.Close()
+		set(c, "permanent", 0)
+		set(c, "ttl10", 10*time.Second)
+		set(c, "ttl3", 3*time.Second)
+		set(c, "ttl20", 20*time.Second)
+		all := []string{"permanent", "ttl10", "ttl3", "ttl20", "new1", "new2", "new3"}
+
+		set(c, "new1", 0)
+		if got := keys(c, all...); !slices.Equal(got, []string{"permanent", "ttl10", "ttl20", "new1"}) {
+			t.Errorf("keys after the first eviction: %v", got)
+		}
+		if _, err := c.Expire("ttl20", time.Second); err != nil {
+			t.Fatal(err)
+		}
+		set(c, "new2", 0)
+		if got := keys(c, all...); !slices.Equal(got, []string{"permanent", "ttl10", "new1", "new2"}) {
+			t.Errorf("keys after shortening the TTL of ttl20: %v", got)
+		}
+		set(c, "new3", 0)
+		if got := keys(c, all...); !slices.Equal(got, []string{"permanent", "new1", "new2", "new3"}) {
+			t.Errorf("keys after the third eviction: %v", got)
+		}
+		if evicted := c.Stats().Evicted; evicted != 3 {
+			t.Errorf("Evicted = %d, want 3", evicted)
+		}
+	})
+
+	t.Run("all keys permanent", func(t *testing.T) {
+		c := newCache()
+		defer c.Close()
+		for _, key := range []string{"a", "b", "c", "d"} {
+			set(c, key, 0)
+		}
+		clock.Advance(time.Millisecond)
+		c.Get("a")
+		set(c, "e", 0)
+		if got := keys(c, "a", "b", "c", "d", "e"); !slices.Equal(got, []string{"a", "c", "d", "e"}) {
+			t.Errorf("keys after eviction: %v, want the least recently used b evicted", got)
+		}
+	})
+
+	t.Run("expired key", func(t *testing.T) {
+		c := newCache()
+		defer c.Close()
+		set(c, "short", time.Second)
+		set(c, "long", time.Hour)
+		set(c, "a", 0)
+		set(c, "b", 0)
+		clock.Advance(2 * time.Second)
+		set(c, "c", 0)
+		if got := keys(c, "short", "long", "a", "b", "c"); !slices.Equal(got, []string{"long", "a", "b", "c"}) {
+			t.Errorf("keys: %v, want only the expired key removed", got)
+		}
+		if evicted := c.Stats().Evicted; evicted != 0 {
+			t.Errorf("Evicted = %d, want 0 (the key expired)", evicted)
+		}
+	})
+}
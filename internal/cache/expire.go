@@ -0,0 +1,195 @@
+package cache
+
+import (
+	"fmt"
+	"time"
+)
+
+// Active expiration.
+//
+// Expired keys are removed lazily when accessed, and actively in expiration
+// order: the keys with a TTL of every shard are kept in a min-heap by
+// expiration time (ttlKeys), so Cleanup only pops the keys that are due, and
+// RunCleanup sleeps until the next one is. Cleanup costs O(log n) per expired key, and
+// nothing for the keys that aren't due, however many there are.
+//
+// A burst of keys expiring together (e.g. set with the same TTL) is removed
+// incrementally: in batches of expireBatchSize keys, releasing the lock in
+// between so requests wait for one batch at most, and for at most
+// expireCycleBudget per cycle. A cycle that runs out of budget is counted as
+// truncated, and the next one resumes after minCleanupInterval, starting
+// from the shard where it stopped.
+// WithCleanupBudget changes both limits, and WithCleanupInterval the longest
+// sleep between cycles.
+//
+// WithFullScanExpiration makes Cleanup scan every key instead, as before the
+// heap, holding the lock for the whole scan.
+const (
+	defaultExpireBatchSize   = 64                    // Keys removed per lock hold
+	defaultExpireCycleBudget = 25 * time.Millisecond // Longest time spent in one cycle
+
+	defaultCleanupInterval = time.Second           // Longest sleep of RunCleanup (always used with a full scan)
+	minCleanupInterval     = 10 * time.Millisecond // Shortest sleep of RunCleanup, so a burst doesn't monopolize the lock
+)
+
+// ExpireCycleStats describes a Cleanup cycle.
+type ExpireCycleStats struct {
+	Expired   int           // Expired keys removed
+	Elapsed   time.Duration // Time spent in the cycle
+	Truncated bool          // The budget ran out with keys still due
+}
+
+// Cleanup removes the expired keys, in expiration order (see expireDueLocked),
+// or by scanning every key with WithFullScanExpiration. RunCleanup calls it
+// whenever a key is due. Keys with zero expiration time (no expiry) are
+// never removed.
+func (c *Cache) Cleanup() {
+	c.cleanupMu.Lock()
+	defer c.cleanupMu.Unlock()
+
+	start := time.Now()
+	var stats ExpireCycleStats
+	for i := range c.shards {
+		s := c.shards[(c.cleanupNext+i)%len(c.shards)]
+		if c.fullScanExpiration {
+			s.mu.Lock()
+			s.drainAccessesLocked()
+			stats.Expired += s.cleanupExpiredLocked()
+			s.mu.Unlock()
+			continue
+		}
+		if !s.expireDue(start, &stats) {
+			stats.Truncated = true // Resumed by the next cycle, from this shard
+			c.cleanupTruncated.Add(1)
+			c.cleanupNext = (c.cleanupNext + i) % len(c.shards)
+			break
+		}
+	}
+	stats.Elapsed = time.Since(start)
+	c.lastExpireCycle.Store(&stats)
+
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.checkInvariantsLocked()
+		s.mu.Unlock()
+	}
+}
+
+// expireDue removes the due keys of the shard in batches, locking it for
+// each batch, and adds them to stats. It returns false if the cycle that
+// started at start ran out of budget with keys still due.
+func (s *shard) expireDue(start time.Time, stats *ExpireCycleStats) bool {
+	batch := s.cache.expireBatchSize
+	for {
+		s.mu.Lock()
+		s.drainAccessesLocked() // Keeps the LRU order fresh without writes
+		n := s.expireDueLocked(batch)
+		s.mu.Unlock()
+
+		stats.Expired += n
+		if n < batch {
+			return true // No more keys due
+		}
+		if time.Since(start) >= s.cache.expireCycleBudget {
+			return false
+		}
+	}
+}
+
+// RunCleanup calls Cleanup whenever the next key is due, until stop is
+// closed. It sleeps until the next expiration time (at most
+// the cleanup interval, see WithCleanupInterval), and Set wakes it up early when it adds a key
+// expiring sooner.
+func (c *Cache) RunCleanup(stop <-chan struct{}) {
+	timer := time.NewTimer(c.cleanupDelay())
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		case <-c.expiryWake:
+			timer.Stop()
+		}
+		c.Cleanup()
+		timer.Reset(c.cleanupDelay())
+	}
+}
+
+// CleanupInterval returns the longest time RunCleanup sleeps between two
+// cycles, see WithCleanupInterval.
+func (c *Cache) CleanupInterval() time.Duration {
+	return time.Duration(c.cleanupInterval.Load())
+}
+
+// SetCleanupInterval changes the longest time RunCleanup sleeps between two
+// cycles. RunCleanup is woken up, so a shorter interval applies right away.
+func (c *Cache) SetCleanupInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid cleanup interval %v (must be > 0)", interval)
+	}
+	c.cleanupInterval.Store(int64(interval))
+	select {
+	case c.expiryWake <- struct{}{}:
+	default: // Already pending
+	}
+	return nil
+}
+
+// cleanupDelay returns how long RunCleanup can sleep before the next key is
+// due.
+func (c *Cache) cleanupDelay() time.Duration {
+	if c.fullScanExpiration {
+		return c.CleanupInterval()
+	}
+	delay := c.CleanupInterval()
+	now := c.now()
+	for _, s := range c.shards {
+		s.mu.RLock()
+		_, expiresAt, ok := s.ttlKeys.peek()
+		s.mu.RUnlock()
+		if ok {
+			delay = min(delay, expiresAt.Sub(now))
+		}
+	}
+	return max(delay, minCleanupInterval)
+}
+
+// expireDueLocked removes up to limit keys whose expiration time has passed
+// (all of them if limit is 0), earliest first, and returns how many it
+// removed. Must be called with lock held.
+func (s *shard) expireDueLocked(limit int) int {
+	now := s.cache.now()
+	removed := 0
+	for limit == 0 || removed < limit {
+		key, expiresAt, ok := s.ttlKeys.peek()
+		if !ok || !now.After(expiresAt) {
+			break
+		}
+		s.notifyRemoved(key, EvictionReasonExpired)
+		s.removeLocked(key)
+		s.cache.dirty.Add(1)
+		s.cache.expiredActive.Add(1)
+		removed++
+	}
+	return removed
+}
+
+// setExpiryLocked records the expiration time of key (zero time: no expiry).
+// Only keys with a TTL have an expires entry, so permanent keys cost no
+// expiration tracking. If key is now the next to expire in its shard,
+// RunCleanup is woken up to reschedule. Must be called with lock held.
+func (s *shard) setExpiryLocked(key string, expiresAt time.Time) {
+	if expiresAt.IsZero() {
+		delete(s.expires, key)
+	} else {
+		s.expires[key] = expiresAt
+	}
+	s.ttlKeys.set(key, expiresAt)
+	if !expiresAt.IsZero() && s.ttlKeys.next() == key {
+		select {
+		case s.cache.expiryWake <- struct{}{}:
+		default: // Already pending
+		}
+	}
+}
@@ -0,0 +1,593 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock for WithClock that only moves when advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// newFakeClock returns a fake clock set to a fixed time.
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+// Now returns the current time of the clock.
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Advance moves the clock forward by d.
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// TestAOFReplayKeepsAbsoluteExpiry checks that replay restores the exact
+// expiration time instead of restarting the TTL, and drops keys whose
+// expiration time passed while the cache was down.
+func TestAOFReplayKeepsAbsoluteExpiry(t *testing.T) {
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot")
+	clock := newFakeClock()
+
+	c, err := NewCache(aofPath, snapshotPath, 0, WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	if err := c.Set("short", "v", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("long", "v", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("forever", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	longExpiry := clock.Now().Add(time.Hour)
+	c.Close()
+
+	// Restart ten minutes later
+	clock.Advance(10 * time.Minute)
+	c, err = NewCache(aofPath, snapshotPath, 0, WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("NewCache after restart: %v", err)
+	}
+	defer c.Close()
+
+	if _, ok := c.Get("short"); ok {
+		t.Error("key with a 1m TTL is alive 10m later after replay")
+	}
+	if _, expiresAt, ok := c.GetBytesWithExpiry("long"); !ok || !expiresAt.Equal(longExpiry) {
+		t.Errorf("long expires at %v (present %v), want %v", expiresAt, ok, longExpiry)
+	}
+	if _, expiresAt, ok := c.GetBytesWithExpiry("forever"); !ok || !expiresAt.IsZero() {
+		t.Errorf("forever expires at %v (present %v), want no expiry", expiresAt, ok)
+	}
+}
+
+// TestAOFReplayLegacyTTL checks that records of older versions, which only
+// have a relative TTL, are still replayed.
+func TestAOFReplayLegacyTTL(t *testing.T) {
+	dir := t.TempDir()
+	aofPath := filepath.Join(dir, "test.aof")
+	legacy := `{"op":"SET","key":"ttl","value":"v","ttl":60}` + "\n" +
+		`{"op":"SET","key":"expired","value":"v","ttl":-1}` + "\n"
+	if err := os.WriteFile(aofPath, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+
+	c, err := NewCache(aofPath, filepath.Join(dir, "test.snapshot"), 0, WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	if _, expiresAt, ok := c.GetBytesWithExpiry("ttl"); !ok || !expiresAt.Equal(clock.Now().Add(time.Minute)) {
+		t.Errorf("ttl expires at %v (present %v), want %v", expiresAt, ok, clock.Now().Add(time.Minute))
+	}
+	if _, ok := c.Get("expired"); ok {
+		t.Error("key with a negative legacy TTL was replayed")
+	}
+}
+
+// TestSetRejectsTTLAfterMaxExpiry checks that TTLs ending after MaxExpiry
+// are rejected, and that the longest accepted TTL survives a restart.
+func TestSetRejectsTTLAfterMaxExpiry(t *testing.T) {
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot")
+	clock := newFakeClock()
+	c, err := NewCache(aofPath, snapshotPath, 0, WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	longest := MaxExpiry.Sub(clock.Now())
+	if err := c.Set("too-long", "v", longest+time.Second); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("Set with a TTL after MaxExpiry error = %v, want ErrInvalidTTL", err)
+	}
+	if err := c.Set("longest", "v", longest); err != nil {
+		t.Fatalf("Set with the longest TTL: %v", err)
+	}
+	if err := c.Set("expire", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Expire("expire", longest+time.Second); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("Expire after MaxExpiry error = %v, want ErrInvalidTTL", err)
+	}
+	if err := c.SetBatch([]Entry{{Key: "batch", Value: "v", TTL: longest + time.Second}}); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("SetBatch with a TTL after MaxExpiry error = %v, want ErrInvalidTTL", err)
+	}
+	c.Close()
+
+	c, err = NewCache(aofPath, snapshotPath, 0, WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("NewCache after restart: %v", err)
+	}
+	defer c.Close()
+	if _, expiresAt, ok := c.GetBytesWithExpiry("longest"); !ok || !expiresAt.Equal(MaxExpiry) {
+		t.Errorf("longest expires at %v (present %v) after restart, want %v", expiresAt, ok, MaxExpiry)
+	}
+	for _, key := range []string{"too-long", "batch"} {
+		if _, ok := c.Get(key); ok {
+			t.Errorf("%s was stored", key)
+		}
+	}
+	if _, expiresAt, ok := c.GetBytesWithExpiry("expire"); !ok || !expiresAt.IsZero() {
+		t.Errorf("expire expires at %v (present %v), want no expiry", expiresAt, ok)
+	}
+}
+
+// TestCleanupExpiresDueKeys checks that Cleanup removes exactly the keys
+// that are due, following TTL changes and deletions.
+func TestCleanupExpiresDueKeys(t *testing.T) {
+	clock := newFakeClock()
+	c, err := NewCache("", "", 0, WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	for i := 1; i <= 10; i++ {
+		if err := c.Set("ttl"+strconv.Itoa(i), "v", time.Duration(i)*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Set("permanent", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("ttl1", "v", 0); err != nil { // Made permanent
+		t.Fatal(err)
+	}
+	c.Del("ttl2")
+	if _, err := c.Expire("ttl9", 2*time.Second); err != nil { // Due sooner
+		t.Fatal(err)
+	}
+	if _, err := c.Expire("ttl3", time.Hour); err != nil { // Due later
+		t.Fatal(err)
+	}
+
+	clock.Advance(5*time.Second + time.Millisecond)
+	c.Cleanup()
+	stats := c.Stats()
+	// ttl4, ttl5, and ttl9 are due
+	if stats.LastExpireCycle.Expired != 3 || stats.ExpiredActive != 3 {
+		t.Errorf("cycle expired %d keys (%d in total), want 3", stats.LastExpireCycle.Expired, stats.ExpiredActive)
+	}
+	if stats.Keys != 7 {
+		t.Errorf("%d keys left, want 7", stats.Keys)
+	}
+	for _, key := range []string{"permanent", "ttl1", "ttl3", "ttl6", "ttl10"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s was removed", key)
+		}
+	}
+
+	c.Cleanup()
+	if n := c.Stats().LastExpireCycle.Expired; n != 0 {
+		t.Errorf("second cycle expired %d keys, want 0", n)
+	}
+}
+
+// TestRunCleanupWakesUp checks that RunCleanup removes a key when it is due
+// rather than after the cleanup interval, including when a key expiring
+// sooner is added while it sleeps.
+func TestRunCleanupWakesUp(t *testing.T) {
+	c, err := NewCache("", "", 0, WithCleanupInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.RunCleanup(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	if err := c.Set("later", "v", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond) // RunCleanup sleeps until later is due
+	if err := c.Set("soon", "v", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "soon to be removed", func() bool { return c.Stats().ExpiredActive == 1 })
+	if keys := c.Stats().Keys; keys != 1 {
+		t.Errorf("%d keys left, want 1", keys)
+	}
+}
+
+// BenchmarkCleanup runs cleanup cycles on 1M keys of which 100 are due in
+// each cycle. With the expiry index the cost depends on the due keys only,
+// where the full scan visits every key.
+func BenchmarkCleanup(b *testing.B) {
+	const (
+		keys = 1_000_000
+		due  = 100
+	)
+	for _, bench := range []struct {
+		name string
+		opts []Option
+	}{
+		{"index", nil},
+		{"full scan", []Option{WithFullScanExpiration()}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			clock := newFakeClock()
+			c, err := NewCache("", "", 0, append(bench.opts, WithClock(clock.Now))...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			for i := range keys {
+				if err := c.Set("key"+strconv.Itoa(i), "v", time.Duration(i+1)*time.Hour); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for range b.N {
+				b.StopTimer()
+				for i := range due {
+					if err := c.Set("due"+strconv.Itoa(i), "v", time.Second); err != nil {
+						b.Fatal(err)
+					}
+				}
+				clock.Advance(2 * time.Second)
+				b.StartTimer()
+
+				c.Cleanup()
+				if n := c.Stats().LastExpireCycle.Expired; n != due {
+					b.Fatalf("cycle expired %d keys, want %d", n, due)
+				}
+			}
+		})
+	}
+}
+
+// TestCleanupBudget checks that a cycle stops after its budget, is counted
+// as truncated, and that the next cycles remove the rest.
+func TestCleanupBudget(t *testing.T) {
+	const (
+		keys  = 1000
+		batch = 10
+	)
+	clock := newFakeClock()
+	// A budget of 1ns ends every cycle after its first batch
+	c, err := NewCache("", "", 0, WithClock(clock.Now), WithCleanupBudget(batch, time.Nanosecond))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+	for i := range keys {
+		if err := c.Set("key"+strconv.Itoa(i), "v", time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(2 * time.Second)
+
+	c.Cleanup()
+	stats := c.Stats()
+	if !stats.LastExpireCycle.Truncated || stats.LastExpireCycle.Expired != batch || stats.CleanupCyclesTruncated != 1 {
+		t.Fatalf("first cycle: %+v, %d truncated, want %d keys expired and truncated", stats.LastExpireCycle, stats.CleanupCyclesTruncated, batch)
+	}
+	for cycles := 1; c.Stats().LastExpireCycle.Truncated; cycles++ {
+		if cycles > keys {
+			t.Fatal("cleanup doesn't make progress")
+		}
+		c.Cleanup()
+	}
+	stats = c.Stats()
+	if stats.Keys != 0 || stats.ExpiredActive != keys {
+		t.Errorf("%d keys left, %d expired, want 0 and %d", stats.Keys, stats.ExpiredActive, keys)
+	}
+	if stats.CleanupCyclesTruncated < keys/batch-1 {
+		t.Errorf("%d cycles truncated, want at least %d", stats.CleanupCyclesTruncated, keys/batch-1)
+	}
+}
+
+// TestCleanupGetLatency expires 500k keys at once, all in the shard of a
+// key read concurrently: each Get waits for one batch at most, not for the
+// whole burst.
+func TestCleanupGetLatency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sets 500k keys")
+	}
+	const keys = 500_000
+	clock := newFakeClock()
+	c, err := NewCache("", "", 0, WithShards(1), WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+	for i := range keys {
+		if err := c.Set("key"+strconv.Itoa(i), "v", time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Set("permanent", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Second)
+
+	done := make(chan struct{})
+	latency := make(chan time.Duration)
+	go func() {
+		var worst time.Duration
+		for {
+			select {
+			case <-done:
+				latency <- worst
+				return
+			default:
+			}
+			start := time.Now()
+			if _, ok := c.Get("permanent"); !ok {
+				panic("permanent key is missing")
+			}
+			worst = max(worst, time.Since(start))
+		}
+	}()
+
+	start := time.Now()
+	for c.Stats().Keys > 1 {
+		c.Cleanup()
+	}
+	elapsed := time.Since(start)
+	close(done)
+	worst := <-latency
+
+	t.Logf("removed %d keys in %v, slowest Get %v", keys, elapsed, worst)
+	if worst > 100*time.Millisecond {
+		t.Errorf("slowest Get took %v while keys expired", worst)
+	}
+	if n := c.Stats().ExpiredActive; n != keys {
+		t.Errorf("%d keys expired, want %d", n, keys)
+	}
+}
+
+// TestPermanentKeysHaveNoExpiry checks that only keys with a TTL have an
+// expires entry, whichever way their TTL is removed or they are loaded.
+func TestPermanentKeysHaveNoExpiry(t *testing.T) {
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot")
+	c, err := NewCache(aofPath, snapshotPath, 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	expiries := func(c *Cache) (n int) {
+		for _, s := range c.shards {
+			s.mu.RLock()
+			n += len(s.expires)
+			if s.ttlKeys.Len() != len(s.expires) {
+				t.Errorf("%d keys in the expiry index, %d expires entries", s.ttlKeys.Len(), len(s.expires))
+			}
+			s.mu.RUnlock()
+		}
+		return n
+	}
+
+	for i := range 100 {
+		if err := c.Set("key"+strconv.Itoa(i), "v", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Set("ttl", "v", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("made-permanent", "v", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("persisted", "v", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if n := expiries(c); n != 3 {
+		t.Errorf("%d expires entries, want 3", n)
+	}
+	if err := c.Set("made-permanent", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Expire("persisted", 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := expiries(c); n != 1 {
+		t.Errorf("%d expires entries after removing two TTLs, want 1", n)
+	}
+	if _, err := c.CreateSnapshotAndClearAOF(snapshotPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("after-snapshot", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c, err = NewCache(aofPath, snapshotPath, 0)
+	if err != nil {
+		t.Fatalf("NewCache after restart: %v", err)
+	}
+	defer c.Close()
+	if n := expiries(c); n != 1 {
+		t.Errorf("%d expires entries after loading the snapshot and AOF, want 1", n)
+	}
+}
+
+// TestPermanentKeysMemory loads 1M permanent keys and 1M keys with a TTL,
+// and checks that the permanent ones don't pay for expiration tracking.
+func TestPermanentKeysMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sets 2M keys")
+	}
+	const keys = 1_000_000
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = "key" + strconv.Itoa(i)
+	}
+	heapFor := func(ttl time.Duration) uint64 {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		c, err := NewCache("", "", 0)
+		if err != nil {
+			t.Fatalf("NewCache: %v", err)
+		}
+		for _, key := range names {
+			if err := c.Set(key, "v", ttl); err != nil {
+				t.Fatal(err)
+			}
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(c)
+		c.Close()
+		return after.HeapAlloc - before.HeapAlloc
+	}
+
+	permanent := heapFor(0)
+	withTTL := heapFor(time.Hour)
+	t.Logf("1M keys: %d MB permanent, %d MB with a TTL", permanent>>20, withTTL>>20)
+	// An expires entry alone holds a 24-byte time.Time
+	if withTTL < permanent || withTTL-permanent < keys*24 {
+		t.Errorf("permanent keys use %d bytes, keys with a TTL %d: want at least %d bytes saved", permanent, withTTL, keys*24)
+	}
+}
+
+// TestSetTTL checks the TTL semantics of every write: 0 stores the key
+// without expiry, a positive TTL expires it, and a negative one fails with
+// ErrInvalidTTL without changing the key, also after a restart.
+func TestSetTTL(t *testing.T) {
+	writes := []struct {
+		name  string
+		write func(c *Cache, key string, ttl time.Duration) error
+	}{
+		{"Set", func(c *Cache, key string, ttl time.Duration) error {
+			return c.Set(key, "new", ttl)
+		}},
+		{"SetBytes", func(c *Cache, key string, ttl time.Duration) error {
+			return c.SetBytes(key, []byte("new"), ttl)
+		}},
+		{"SetBatch", func(c *Cache, key string, ttl time.Duration) error {
+			return c.SetBatch([]Entry{{Key: key, Value: "new", TTL: ttl}})
+		}},
+	}
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		err     error
+		value   string // Value after the write ("" = missing)
+		expires bool
+	}{
+		{"zero", 0, nil, "new", false},
+		{"positive", time.Minute, nil, "new", true},
+		{"negative", -time.Second, ErrInvalidTTL, "old", false},
+		{"negative nanosecond", -1, ErrInvalidTTL, "old", false},
+	}
+	for _, w := range writes {
+		for _, tt := range tests {
+			t.Run(w.name+"/"+tt.name, func(t *testing.T) {
+				dir := t.TempDir()
+				aofPath, snapshotPath := filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot")
+				clock := newFakeClock()
+				c, err := NewCache(aofPath, snapshotPath, 0, WithClock(clock.Now))
+				if err != nil {
+					t.Fatalf("NewCache: %v", err)
+				}
+				if err := c.Set("existing", "old", 0); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.write(c, "existing", tt.ttl); !errors.Is(err, tt.err) {
+					t.Errorf("error = %v, want %v", err, tt.err)
+				}
+				if err := w.write(c, "new", tt.ttl); !errors.Is(err, tt.err) {
+					t.Errorf("error for a new key = %v, want %v", err, tt.err)
+				}
+				check := func(c *Cache, when string) {
+					t.Helper()
+					value, expiresAt, ok := c.GetBytesWithExpiry("existing")
+					if !ok || string(value) != tt.value || expiresAt.IsZero() == tt.expires {
+						t.Errorf("%s: existing = %q (present %v), expires at %v", when, value, ok, expiresAt)
+					}
+					if _, ok := c.Get("new"); ok != (tt.err == nil) {
+						t.Errorf("%s: new key present: %v", when, ok)
+					}
+				}
+				check(c, "after the write")
+				c.Close()
+
+				c, err = NewCache(aofPath, snapshotPath, 0, WithClock(clock.Now))
+				if err != nil {
+					t.Fatalf("NewCache after restart: %v", err)
+				}
+				defer c.Close()
+				check(c, "after replay")
+				if tt.expires {
+					clock.Advance(tt.ttl + time.Second)
+					if _, ok := c.Get("existing"); ok {
+						t.Error("key didn't expire")
+					}
+				}
+			})
+		}
+	}
+
+	t.Run("Expire", func(t *testing.T) {
+		c, err := NewCache("", "", 0)
+		if err != nil {
+			t.Fatalf("NewCache: %v", err)
+		}
+		defer c.Close()
+		if err := c.Set("key", "v", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Expire("key", -time.Second); !errors.Is(err, ErrInvalidTTL) {
+			t.Errorf("Expire with a negative TTL error = %v, want ErrInvalidTTL", err)
+		}
+		if _, expiresAt, ok := c.GetBytesWithExpiry("key"); !ok || expiresAt.IsZero() {
+			t.Errorf("key after a rejected Expire: present %v, expires at %v", ok, expiresAt)
+		}
+		if ok, err := c.Expire("key", 0); err != nil || !ok {
+			t.Errorf("Expire(0) = %v, %v", ok, err)
+		}
+		if _, expiresAt, _ := c.GetBytesWithExpiry("key"); !expiresAt.IsZero() {
+			t.Errorf("key expires at %v after Expire(0), want no expiry", expiresAt)
+		}
+	})
+}
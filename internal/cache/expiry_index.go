@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryIndex orders the keys that have an expiration time by that time, in
+// a min-heap, so the key expiring next is found in constant time and updated
+// in O(log n). It drives active expiration (see expire.go) and the
+// volatile-ttl eviction policy. It is protected by the cache lock. Like
+// keySet, its methods do nothing on a nil index.
+type expiryIndex struct {
+	items []expiryItem
+	index map[string]int // Position of every key in items
+}
+
+// expiryItem is a key in the expiry index.
+type expiryItem struct {
+	key       string
+	expiresAt time.Time
+}
+
+// newExpiryIndex creates an empty expiry index.
+func newExpiryIndex() *expiryIndex {
+	return &expiryIndex{index: make(map[string]int)}
+}
+
+// set records the expiration time of key; a zero time removes it.
+func (x *expiryIndex) set(key string, expiresAt time.Time) {
+	if x == nil {
+		return
+	}
+	if expiresAt.IsZero() {
+		x.remove(key)
+		return
+	}
+	if i, ok := x.index[key]; ok {
+		x.items[i].expiresAt = expiresAt
+		heap.Fix(x, i)
+		return
+	}
+	heap.Push(x, expiryItem{key: key, expiresAt: expiresAt})
+}
+
+// remove takes key out of the index.
+func (x *expiryIndex) remove(key string) {
+	if x == nil {
+		return
+	}
+	if i, ok := x.index[key]; ok {
+		heap.Remove(x, i)
+	}
+}
+
+// next returns the key expiring first, or "" if no key has an expiration.
+func (x *expiryIndex) next() string {
+	if x == nil || len(x.items) == 0 {
+		return ""
+	}
+	return x.items[0].key
+}
+
+// peek returns the key expiring first and its expiration time, and false if
+// no key has an expiration.
+func (x *expiryIndex) peek() (string, time.Time, bool) {
+	if x == nil || len(x.items) == 0 {
+		return "", time.Time{}, false
+	}
+	return x.items[0].key, x.items[0].expiresAt, true
+}
+
+// Len implements heap.Interface.
+func (x *expiryIndex) Len() int { return len(x.items) }
+
+// Less implements heap.Interface.
+func (x *expiryIndex) Less(i, j int) bool {
+	return x.items[i].expiresAt.Before(x.items[j].expiresAt)
+}
+
+// Swap implements heap.Interface.
+func (x *expiryIndex) Swap(i, j int) {
+	x.items[i], x.items[j] = x.items[j], x.items[i]
+	x.index[x.items[i].key] = i
+	x.index[x.items[j].key] = j
+}
+
+// Push implements heap.Interface.
+func (x *expiryIndex) Push(item any) {
+	it := item.(expiryItem)
+	x.index[it.key] = len(x.items)
+	x.items = append(x.items, it)
+}
+
+// Pop implements heap.Interface.
+func (x *expiryIndex) Pop() any {
+	last := len(x.items) - 1
+	it := x.items[last]
+	x.items[last] = expiryItem{}
+	x.items = x.items[:last]
+	delete(x.index, it.key)
+	return it
+}
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestExpiryIndex checks that the index returns keys in expiration order
+// through updates and removals, and that its position map stays in sync.
+func TestExpiryIndex(t *testing.T) {
+	x := newExpiryIndex()
+	base := time.Unix(1000, 0)
+	want := map[string]time.Time{}
+	for i := range 1000 {
+		key := "key" + strconv.Itoa(rand.IntN(300))
+		switch rand.IntN(4) {
+		case 0:
+			x.remove(key)
+			delete(want, key)
+		case 1:
+			x.set(key, time.Time{}) // No expiry: removed too
+			delete(want, key)
+		default:
+			at := base.Add(time.Duration(i*7%500) * time.Second)
+			x.set(key, at)
+			want[key] = at
+		}
+	}
+	if x.Len() != len(want) || len(x.index) != len(want) {
+		t.Fatalf("index has %d items and %d positions, want %d", x.Len(), len(x.index), len(want))
+	}
+	for i, it := range x.items {
+		if x.index[it.key] != i {
+			t.Fatalf("position of %s is %d, want %d", it.key, x.index[it.key], i)
+		}
+	}
+
+	var times []time.Time
+	for {
+		key, at, ok := x.peek()
+		if !ok {
+			break
+		}
+		if x.next() != key {
+			t.Fatalf("next() = %s, peek() = %s", x.next(), key)
+		}
+		if !at.Equal(want[key]) {
+			t.Errorf("%s expires at %v, want %v", key, at, want[key])
+		}
+		times = append(times, at)
+		x.remove(key)
+	}
+	if len(times) != len(want) {
+		t.Errorf("popped %d keys, want %d", len(times), len(want))
+	}
+	if !slices.IsSortedFunc(times, time.Time.Compare) {
+		t.Error("keys were not popped in expiration order")
+	}
+
+	var nilIndex *expiryIndex
+	nilIndex.set("key", base)
+	nilIndex.remove("key")
+	if _, _, ok := nilIndex.peek(); ok || nilIndex.next() != "" {
+		t.Error("nil index is not empty")
+	}
+}
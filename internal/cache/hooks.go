@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// EvictionReason tells why the cache dropped a key, for WithOnEvict.
+type EvictionReason int
+
+const (
+	EvictionReasonEvicted EvictionReason = iota // Evicted by the eviction policy at maxKeys or maxMemory
+	EvictionReasonExpired                       // Expired, found by Get, Del, or the periodic cleanup
+)
+
+// String returns the name of the reason.
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionReasonEvicted:
+		return "evicted"
+	case EvictionReasonExpired:
+		return "expired"
+	default:
+		return fmt.Sprintf("EvictionReason(%d)", int(r))
+	}
+}
+
+// evictQueueSize is the number of removed keys buffered for the OnEvict
+// callback. Removals beyond it are dropped and counted rather than making
+// writers wait for the callback.
+const evictQueueSize = 4096
+
+// evictEvent is a key removed by the cache, waiting for the callback.
+type evictEvent struct {
+	key    string
+	value  string
+	reason EvictionReason
+}
+
+// evictDispatcher runs the OnEvict callback in its own goroutine. The cache
+// queues removals under its lock without ever blocking, so a slow callback,
+// or one that calls back into the cache, can't stall or deadlock it.
+type evictDispatcher struct {
+	fn       func(key, value string, reason EvictionReason)
+	queue    chan evictEvent
+	dropped  atomic.Int64  // Removals not delivered because the queue was full
+	stop     chan struct{} // Closed by close
+	done     chan struct{} // Closed when the goroutine exits
+	stopOnce sync.Once
+}
+
+// newEvictDispatcher starts a dispatcher calling fn.
+func newEvictDispatcher(fn func(key, value string, reason EvictionReason)) *evictDispatcher {
+	d := &evictDispatcher{
+		fn:    fn,
+		queue: make(chan evictEvent, evictQueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// notify queues a removed key for the callback, or counts it as dropped if
+// the queue is full. It never blocks and does nothing on a nil dispatcher.
+func (d *evictDispatcher) notify(key, value string, reason EvictionReason) {
+	if d == nil {
+		return
+	}
+	select {
+	case d.queue <- evictEvent{key: key, value: value, reason: reason}:
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+// run calls the callback for every queued removal until close, then
+// delivers the removals still queued.
+func (d *evictDispatcher) run() {
+	defer close(d.done)
+	for {
+		select {
+		case ev := <-d.queue:
+			d.fn(ev.key, ev.value, ev.reason)
+		case <-d.stop:
+			for {
+				select {
+				case ev := <-d.queue:
+					d.fn(ev.key, ev.value, ev.reason)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// close stops the dispatcher after the queued removals are delivered. Later
+// removals are counted as dropped.
+func (d *evictDispatcher) close() {
+	if d == nil {
+		return
+	}
+	d.stopOnce.Do(func() { close(d.stop) })
+	<-d.done
+}
+
+// droppedCount returns the number of removals not delivered.
+func (d *evictDispatcher) droppedCount() int64 {
+	if d == nil {
+		return 0
+	}
+	return d.dropped.Load()
+}
+
+// notifyRemoved passes key and its value to the OnEvict callback, and its
+// removal to the watchers (see watch.go), before the key is removed (must
+// be called with lock held).
+func (s *shard) notifyRemoved(key string, reason EvictionReason) {
+	if reason == EvictionReasonEvicted {
+		s.cache.notifyWatchers(KeyEventEvicted, key)
+	} else {
+		s.cache.notifyWatchers(KeyEventExpired, key)
+	}
+	if s.cache.onEvict == nil {
+		return
+	}
+	s.cache.onEvict.notify(key, valueString(s.data[key]), reason)
+}
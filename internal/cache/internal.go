@@ -0,0 +1,32 @@
+package cache
+
+import "strings"
+
+// Internal namespace.
+//
+// Keys starting with InternalPrefix hold data of the server itself next to
+// the dataset, e.g. the responses remembered for idempotency keys. They are
+// persisted, replicated, expired, and evicted like any key, and count
+// against the key and memory limits, but the key policy and the key and
+// value size limits, which are meant for client data, don't apply to them.
+// Stats reports their share as InternalKeys and InternalMemory. The cache
+// doesn't keep clients away from them: servers must reject client keys for
+// which IsInternalKey is true.
+
+// InternalPrefix is the prefix of the keys of the internal namespace.
+const InternalPrefix = "\x00mini-redis:"
+
+// IsInternalKey reports whether key is in the internal namespace.
+func IsInternalKey(key string) bool {
+	return strings.HasPrefix(key, InternalPrefix)
+}
+
+// trackInternal updates the internal namespace counters of the shard for a
+// change of memoryDelta bytes of key, which was added (keys: 1), removed
+// (-1), or overwritten (0). Must be called with lock held.
+func (s *shard) trackInternal(key string, keys int, memoryDelta int64) {
+	if IsInternalKey(key) {
+		s.internalKeys += keys
+		s.internalMemory += memoryDelta
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !cachedebug
+
+package cache
+
+// checkInvariantsLocked does nothing without the cachedebug build tag (see
+// invariants_debug.go).
+func (s *shard) checkInvariantsLocked() {}
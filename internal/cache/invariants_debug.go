@@ -0,0 +1,52 @@
+//go:build cachedebug
+
+package cache
+
+import "fmt"
+
+// checkInvariantsLocked recomputes the counts that writes and removals keep
+// up to date, and panics if any of them drifted. It is only compiled with
+// the cachedebug build tag (go test -tags cachedebug), since it scans every
+// key of the shard; Cleanup runs it on every shard after every cycle. Must be called with lock held.
+func (s *shard) checkInvariantsLocked() {
+	var memory, internalMemory int64
+	withTTL, internalKeys := 0, 0
+	for key, value := range s.data {
+		memory += entrySize(key, value)
+		if IsInternalKey(key) {
+			internalKeys++
+			internalMemory += entrySize(key, value)
+		}
+		if _, ok := s.expires[key]; ok {
+			withTTL++
+		}
+	}
+	for key, expiresAt := range s.expires {
+		if !s.hasKey(key) {
+			panic(fmt.Sprintf("cache: expires entry for missing key %q", key))
+		}
+		if expiresAt.IsZero() {
+			panic(fmt.Sprintf("cache: key %q has a zero expires entry", key))
+		}
+	}
+	if len(s.meta) != len(s.data) {
+		panic(fmt.Sprintf("cache: %d metadata entries for %d keys", len(s.meta), len(s.data)))
+	}
+	if memory != s.usedMemory {
+		panic(fmt.Sprintf("cache: used memory is %d, keys use %d", s.usedMemory, memory))
+	}
+	if internalKeys != s.internalKeys || internalMemory != s.internalMemory {
+		panic(fmt.Sprintf("cache: internal namespace counted as %d keys and %d bytes, has %d keys and %d bytes",
+			s.internalKeys, s.internalMemory, internalKeys, internalMemory))
+	}
+	if s.ttlKeys.Len() != withTTL {
+		panic(fmt.Sprintf("cache: %d keys in the expiry index, %d keys with a TTL", s.ttlKeys.Len(), withTTL))
+	}
+	if s.randomKeys != nil {
+		if len(s.randomKeys.keys) != len(s.data) {
+			panic(fmt.Sprintf("cache: %d keys in the random key set for %d keys", len(s.randomKeys.keys), len(s.data)))
+		}
+	} else if len(s.lru.entries) != len(s.data) {
+		panic(fmt.Sprintf("cache: %d keys in the LRU list for %d keys", len(s.lru.entries), len(s.data)))
+	}
+}
@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Key naming policy.
+//
+// A KeyPolicy (WithKeyPolicy) restricts the names of keys written from now
+// on: the characters they may contain and a pattern they must start with,
+// e.g. "user:" or "(session|cart):". It is checked by every write that can
+// create a key (Set and its variants, SetBatch, and Incr), before the key
+// length and value size limits. Deletes and TTL changes of existing keys
+// aren't checked, so invalid keys can be cleaned up, and neither are the
+// AOF and snapshots at load or commands from a primary: existing data keeps
+// working after the policy is enabled. Neither are keys of the internal
+// namespace (see internal.go).
+
+// DefaultKeyCharset is the character set of a KeyPolicy given as
+// "visible": printable ASCII, without spaces and control characters.
+const DefaultKeyCharset = "visible"
+
+// ErrInvalidKey is matched by the *KeyPolicyError of a key rejected by the
+// key policy.
+var ErrInvalidKey = errors.New("key violates the key policy")
+
+// KeyPolicyError is returned by writes of a key the key policy rejects.
+// errors.Is matches it to ErrInvalidKey.
+type KeyPolicyError struct {
+	Key        string   // Rejected key
+	Violations []string // Every rule the key breaks, e.g. "contains ' ' at byte 4, ..."
+}
+
+// Error implements the error interface.
+func (e *KeyPolicyError) Error() string {
+	return fmt.Sprintf("invalid key %q: %s", e.Key, strings.Join(e.Violations, "; "))
+}
+
+// Unwrap returns ErrInvalidKey, for errors.Is.
+func (e *KeyPolicyError) Unwrap() error {
+	return ErrInvalidKey
+}
+
+// KeyPolicy describes the keys accepted by writes, see NewKeyPolicy.
+type KeyPolicy struct {
+	charset    string         // Character set as given ("" = any character)
+	ranges     []runeRange    // Characters allowed by charset
+	prefix     string         // Prefix pattern as given ("" = any key)
+	prefixExpr *regexp.Regexp // prefix anchored at the start of the key
+}
+
+// runeRange is an inclusive range of allowed characters.
+type runeRange struct {
+	lo, hi rune
+}
+
+// NewKeyPolicy returns a policy accepting keys made of the characters of
+// charset that start with a match of the regular expression prefix. An
+// empty charset or prefix leaves that rule out.
+//
+// charset is either "visible" (DefaultKeyCharset) or a list of characters
+// and ranges, like a regular expression class without the brackets, e.g.
+// "a-zA-Z0-9:_.-"; a '-' at the start or end stands for itself.
+func NewKeyPolicy(charset, prefix string) (*KeyPolicy, error) {
+	p := &KeyPolicy{charset: charset, prefix: prefix}
+	if charset != "" {
+		ranges, err := parseKeyCharset(charset)
+		if err != nil {
+			return nil, err
+		}
+		p.ranges = ranges
+	}
+	if prefix != "" {
+		expr, err := regexp.Compile(`^(?:` + prefix + `)`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key prefix pattern: %w", err)
+		}
+		p.prefixExpr = expr
+	}
+	return p, nil
+}
+
+// parseKeyCharset parses the charset of NewKeyPolicy.
+func parseKeyCharset(charset string) ([]runeRange, error) {
+	if charset == DefaultKeyCharset {
+		return []runeRange{{'!', '~'}}, nil
+	}
+	if !utf8.ValidString(charset) {
+		return nil, fmt.Errorf("invalid key charset %q: not valid UTF-8", charset)
+	}
+
+	chars := []rune(charset)
+	var ranges []runeRange
+	for i := 0; i < len(chars); i++ {
+		r := runeRange{chars[i], chars[i]}
+		if i+2 < len(chars) && chars[i+1] == '-' {
+			r.hi = chars[i+2]
+			if r.hi < r.lo {
+				return nil, fmt.Errorf("invalid key charset %q: range %c-%c is reversed", charset, r.lo, r.hi)
+			}
+			i += 2
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// String describes the policy, e.g. `charset "visible", prefix "user:"`.
+func (p *KeyPolicy) String() string {
+	var rules []string
+	if p.charset != "" {
+		rules = append(rules, fmt.Sprintf("charset %q", p.charset))
+	}
+	if p.prefix != "" {
+		rules = append(rules, fmt.Sprintf("prefix %q", p.prefix))
+	}
+	if len(rules) == 0 {
+		return "any key"
+	}
+	return strings.Join(rules, ", ")
+}
+
+// Check returns a *KeyPolicyError listing every rule key breaks, or nil.
+func (p *KeyPolicy) Check(key string) error {
+	var violations []string
+	if p.ranges != nil {
+		bad, first, at := 0, rune(0), 0
+		for i, c := range key {
+			if c == utf8.RuneError || !p.allows(c) {
+				if bad == 0 {
+					first, at = c, i
+				}
+				bad++
+			}
+		}
+		switch {
+		case bad == 1:
+			violations = append(violations, fmt.Sprintf("contains %q at byte %d, outside the key charset %q", first, at, p.charset))
+		case bad > 1:
+			violations = append(violations, fmt.Sprintf("contains %d characters outside the key charset %q, the first %q at byte %d", bad, p.charset, first, at))
+		}
+	}
+	if p.prefixExpr != nil && !p.prefixExpr.MatchString(key) {
+		violations = append(violations, fmt.Sprintf("doesn't start with a match of the key prefix pattern %q", p.prefix))
+	}
+	if violations == nil {
+		return nil
+	}
+	return &KeyPolicyError{Key: key, Violations: violations}
+}
+
+// allows reports whether the charset of p contains c.
+func (p *KeyPolicy) allows(c rune) bool {
+	for _, r := range p.ranges {
+		if c >= r.lo && c <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyPolicy returns the policy set with WithKeyPolicy, or nil if keys
+// aren't restricted.
+func (c *Cache) KeyPolicy() *KeyPolicy {
+	return c.keyPolicy
+}
+
+// checkKey returns a *KeyPolicyError if the key policy rejects key.
+func (c *Cache) checkKey(key string) error {
+	if c.keyPolicy == nil || IsInternalKey(key) {
+		return nil
+	}
+	return c.keyPolicy.Check(key)
+}
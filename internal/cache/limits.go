@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Key and value size limits.
+//
+// WithMaxKeyLength and WithMaxValueSize bound the size of a single client
+// entry (keys of the internal namespace are exempt, see internal.go),
+// independently of maxMemory, so one misbehaving client can't fill the
+// cache with huge values and evict everything else. Writes of larger
+// entries fail with a *LimitError before anything is stored. Entries that
+// predate the limits are kept, but those read from the AOF or a snapshot at
+// load are skipped and counted (see Limits), so a lowered limit also
+// applies to the data of a restart. A replica applies everything received
+// from its primary, commands and full resyncs alike, since it must hold the
+// primary's dataset. SetLimits changes both limits at runtime.
+
+// ErrKeyTooLong is matched by the *LimitError of a key longer than the
+// WithMaxKeyLength limit.
+var ErrKeyTooLong = errors.New("key is longer than the key length limit")
+
+// ErrValueTooLong is matched by the *LimitError of a value larger than the
+// WithMaxValueSize limit.
+var ErrValueTooLong = errors.New("value is larger than the value size limit")
+
+// LimitError is returned by writes of an entry exceeding the key length or
+// value size limit. errors.Is matches it to ErrKeyTooLong or ErrValueTooLong.
+type LimitError struct {
+	Err   error // ErrKeyTooLong or ErrValueTooLong
+	Size  int   // Length of the key or value in bytes
+	Limit int   // Limit it exceeds
+}
+
+// Error implements the error interface.
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v (%d bytes, limit %d)", e.Err, e.Size, e.Limit)
+}
+
+// Unwrap returns ErrKeyTooLong or ErrValueTooLong, for errors.Is.
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// Limits describes the key length and value size limits, see Cache.Limits.
+type Limits struct {
+	MaxKeyLength int   // Longest key in bytes (0 = unlimited)
+	MaxValueSize int   // Largest value in bytes (0 = unlimited)
+	LoadSkipped  int64 // Entries of the AOF or snapshots skipped at load for exceeding the limits
+}
+
+// Limits returns the current key length and value size limits.
+func (c *Cache) Limits() Limits {
+	return Limits{
+		MaxKeyLength: int(c.maxKeyLength.Load()),
+		MaxValueSize: int(c.maxValueSize.Load()),
+		LoadSkipped:  c.limitSkipped.Load(),
+	}
+}
+
+// SetLimits changes the key length and value size limits (0 = unlimited).
+// Keys already stored are kept, also if they exceed the new limits.
+func (c *Cache) SetLimits(maxKeyLength, maxValueSize int) error {
+	if maxKeyLength < 0 || maxValueSize < 0 {
+		return fmt.Errorf("invalid limits %d, %d (must be >= 0)", maxKeyLength, maxValueSize)
+	}
+	c.maxKeyLength.Store(int64(maxKeyLength))
+	c.maxValueSize.Store(int64(maxValueSize))
+	return nil
+}
+
+// checkLimits returns a *LimitError if key or a value of valueSize bytes
+// exceeds the limits. Keys of the internal namespace have no limits.
+func (c *Cache) checkLimits(key string, valueSize int) error {
+	if IsInternalKey(key) {
+		return nil
+	}
+	if limit := int(c.maxKeyLength.Load()); limit > 0 && len(key) > limit {
+		return &LimitError{Err: ErrKeyTooLong, Size: len(key), Limit: limit}
+	}
+	if limit := int(c.maxValueSize.Load()); limit > 0 && valueSize > limit {
+		return &LimitError{Err: ErrValueTooLong, Size: valueSize, Limit: limit}
+	}
+	return nil
+}
+
+// loadWithinLimits reports whether an entry read from the AOF or a snapshot
+// is within the limits, and counts it as skipped otherwise.
+func (c *Cache) loadWithinLimits(key string, valueSize int) bool {
+	if c.checkLimits(key, valueSize) == nil {
+		return true
+	}
+	c.limitSkipped.Add(1)
+	return false
+}
@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Read-through loading.
+//
+// GetOrLoad fills misses from a slower source of truth (e.g. a database) with
+// a loader function. Concurrent misses for the same key share a single
+// loader call, like golang.org/x/sync/singleflight, so a popular key that
+// expires causes one load rather than a thundering herd of them.
+//
+// The loader runs in its own goroutine with a context that is only canceled
+// once every caller waiting for it has given up, so one caller's timeout
+// doesn't fail the others. Errors are returned to every waiting caller and
+// aren't cached, unless WithNegativeCacheTTL is set: the error is then
+// returned without calling the loader again until the TTL has passed.
+
+// negativeCacheSweepSize is the smallest number of cached load errors at
+// which the expired ones are removed when a new one is added. The next sweep
+// waits until the count has doubled, so sweeps cost O(1) per error amortized.
+const negativeCacheSweepSize = 1024
+
+// loadCall is a loader call in progress, shared by the callers that missed
+// the same key.
+type loadCall struct {
+	done    chan struct{}      // Closed when value and err are set
+	value   string             // Loaded value
+	err     error              // Loader error
+	waiters int                // Callers waiting for the call (protected by loadMu)
+	cancel  context.CancelFunc // Cancels the loader once no caller waits
+}
+
+// loadError is a loader error cached by WithNegativeCacheTTL.
+type loadError struct {
+	err       error
+	expiresAt time.Time
+}
+
+// GetOrLoad returns the value of key, or on a miss calls loader to load it
+// and stores it with ttl (0 = no expiry; invalid, see Set: ErrInvalidTTL, without
+// calling loader). Concurrent misses for the same key
+// share one loader call. A loader error is returned to every caller waiting
+// for the call and isn't stored (see WithNegativeCacheTTL). A loaded value
+// that can't be stored, e.g. ErrCacheFull, is still returned. If ctx is done
+// before the load finishes, GetOrLoad returns ctx.Err(); the loader's context
+// is canceled once no caller waits for it anymore.
+func (c *Cache) GetOrLoad(ctx context.Context, key string, ttl time.Duration, loader func(ctx context.Context, key string) (string, error)) (string, error) {
+	if err := c.checkTTL(ttl); err != nil {
+		return "", err
+	}
+	if value, ok := c.Get(key); ok {
+		return value, nil
+	}
+
+	c.loadMu.Lock()
+	call, ok := c.loads[key]
+	if !ok {
+		// The key may have been loaded since the miss
+		if value, ok := c.Get(key); ok {
+			c.loadMu.Unlock()
+			return value, nil
+		}
+		if err, ok := c.loadErrorLocked(key); ok {
+			c.loadMu.Unlock()
+			return "", err
+		}
+
+		loadCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &loadCall{done: make(chan struct{}), cancel: cancel}
+		if c.loads == nil {
+			c.loads = make(map[string]*loadCall)
+		}
+		c.loads[key] = call
+		go c.load(loadCtx, call, key, ttl, loader)
+	}
+	call.waiters++
+	c.loadMu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		c.loadMu.Lock()
+		if call.waiters--; call.waiters == 0 {
+			call.cancel()
+		}
+		c.loadMu.Unlock()
+		return "", ctx.Err()
+	}
+}
+
+// load runs loader for call, stores the value, and wakes up the callers
+// waiting for it.
+func (c *Cache) load(ctx context.Context, call *loadCall, key string, ttl time.Duration, loader func(ctx context.Context, key string) (string, error)) {
+	defer call.cancel()
+
+	value, err := callLoader(ctx, key, loader)
+	if err == nil {
+		// Stored before the call is removed, so a later miss finds the value
+		c.Set(key, value, ttl)
+	}
+
+	c.loadMu.Lock()
+	delete(c.loads, key)
+	if err != nil && c.negativeCacheTTL > 0 && ctx.Err() == nil {
+		c.storeLoadErrorLocked(key, err)
+	}
+	call.value, call.err = value, err
+	close(call.done)
+	c.loadMu.Unlock()
+}
+
+// callLoader calls loader, turning a panic into an error: the loader runs in
+// its own goroutine, where a panic would crash the program.
+func callLoader(ctx context.Context, key string, loader func(ctx context.Context, key string) (string, error)) (value string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			value, err = "", fmt.Errorf("loader panicked for key %q: %v", key, r)
+		}
+	}()
+	return loader(ctx, key)
+}
+
+// loadErrorLocked returns the cached loader error of key, if it hasn't
+// expired. Must be called with loadMu held.
+func (c *Cache) loadErrorLocked(key string) (error, bool) {
+	e, ok := c.loadErrors[key]
+	if !ok {
+		return nil, false
+	}
+	if c.now().After(e.expiresAt) {
+		delete(c.loadErrors, key)
+		return nil, false
+	}
+	return e.err, true
+}
+
+// storeLoadErrorLocked caches a loader error of key for negativeCacheTTL,
+// first removing the expired errors if there are many. Must be called with
+// loadMu held.
+func (c *Cache) storeLoadErrorLocked(key string, err error) {
+	now := c.now()
+	if c.loadErrors == nil {
+		c.loadErrors = make(map[string]loadError)
+	}
+	if len(c.loadErrors) >= max(c.loadErrorsSweepAt, negativeCacheSweepSize) {
+		for k, e := range c.loadErrors {
+			if now.After(e.expiresAt) {
+				delete(c.loadErrors, k)
+			}
+		}
+		c.loadErrorsSweepAt = 2 * len(c.loadErrors)
+	}
+	c.loadErrors[key] = loadError{err: err, expiresAt: now.Add(c.negativeCacheTTL)}
+}
@@ -0,0 +1,195 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waiters returns the number of callers waiting for the load of key.
+func waiters(c *Cache, key string) int {
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+	if call, ok := c.loads[key]; ok {
+		return call.waiters
+	}
+	return 0
+}
+
+// TestGetOrLoadThunderingHerd checks that concurrent misses for a key share
+// a single loader call, whose value is stored with the TTL.
+func TestGetOrLoadThunderingHerd(t *testing.T) {
+	const callers = 100
+	c, err := NewCache("", "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	loader := func(ctx context.Context, key string) (string, error) {
+		calls.Add(1)
+		<-release
+		return "loaded " + key, nil
+	}
+
+	var wg sync.WaitGroup
+	for range callers {
+		wg.Go(func() {
+			value, err := c.GetOrLoad(context.Background(), "key", time.Hour, loader)
+			if err != nil || value != "loaded key" {
+				t.Errorf("GetOrLoad = %q, %v", value, err)
+			}
+		})
+	}
+	waitFor(t, "every caller to wait for the load", func() bool { return waiters(c, "key") == callers })
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("loader called %d times, want 1", n)
+	}
+	if _, expiresAt, ok := c.GetBytesWithExpiry("key"); !ok || expiresAt.IsZero() {
+		t.Errorf("loaded value stored: %v, expires at %v, want a TTL", ok, expiresAt)
+	}
+	if value, err := c.GetOrLoad(context.Background(), "key", time.Hour, loader); err != nil || value != "loaded key" || calls.Load() != 1 {
+		t.Errorf("GetOrLoad of a stored key = %q, %v, with %d loader calls", value, err, calls.Load())
+	}
+}
+
+// TestGetOrLoadErrors checks that loader errors and panics are returned
+// without being stored, and that an invalid TTL fails before loading.
+func TestGetOrLoadErrors(t *testing.T) {
+	c, err := NewCache("", "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	errDown := errors.New("database down")
+	var calls int
+	failing := func(ctx context.Context, key string) (string, error) {
+		calls++
+		return "", errDown
+	}
+	for range 2 {
+		if _, err := c.GetOrLoad(context.Background(), "key", 0, failing); !errors.Is(err, errDown) {
+			t.Errorf("GetOrLoad error = %v, want the loader's", err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("loader called %d times, want 2 (errors aren't cached by default)", calls)
+	}
+	if _, ok := c.Get("key"); ok {
+		t.Error("failed load stored a value")
+	}
+
+	panicking := func(ctx context.Context, key string) (string, error) { panic("boom") }
+	if _, err := c.GetOrLoad(context.Background(), "key", 0, panicking); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("GetOrLoad with a panicking loader error = %v", err)
+	}
+
+	if _, err := c.GetOrLoad(context.Background(), "key", -time.Second, failing); !errors.Is(err, ErrInvalidTTL) || calls != 2 {
+		t.Errorf("GetOrLoad with a negative TTL error = %v after %d loader calls, want ErrInvalidTTL without a call", err, calls)
+	}
+}
+
+// TestGetOrLoadNegativeCache checks that WithNegativeCacheTTL returns a
+// loader error without calling the loader again until the TTL has passed.
+func TestGetOrLoadNegativeCache(t *testing.T) {
+	clock := newFakeClock()
+	c, err := NewCache("", "", 0, WithClock(clock.Now), WithNegativeCacheTTL(time.Minute))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	errNotFound := errors.New("not found")
+	var calls int
+	loader := func(ctx context.Context, key string) (string, error) {
+		calls++
+		if calls == 1 {
+			return "", errNotFound
+		}
+		return "value", nil
+	}
+	for range 3 {
+		if _, err := c.GetOrLoad(context.Background(), "key", 0, loader); !errors.Is(err, errNotFound) {
+			t.Errorf("GetOrLoad error = %v, want the cached one", err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("loader called %d times within the negative TTL, want 1", calls)
+	}
+
+	clock.Advance(time.Minute + time.Second)
+	if value, err := c.GetOrLoad(context.Background(), "key", 0, loader); err != nil || value != "value" || calls != 2 {
+		t.Errorf("GetOrLoad after the negative TTL = %q, %v, with %d loader calls", value, err, calls)
+	}
+}
+
+// TestGetOrLoadCancel checks that a caller giving up doesn't fail the
+// others, and that the loader's context is canceled once none waits.
+func TestGetOrLoadCancel(t *testing.T) {
+	c, err := NewCache("", "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	release := make(chan struct{})
+	canceled := make(chan struct{})
+	loader := func(ctx context.Context, key string) (string, error) {
+		select {
+		case <-release:
+			return "value", nil
+		case <-ctx.Done():
+			close(canceled)
+			return "", ctx.Err()
+		}
+	}
+
+	// The first caller gives up, the second gets the value
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := c.GetOrLoad(ctx, "shared", 0, loader)
+		first <- err
+	}()
+	waitFor(t, "the first caller to wait", func() bool { return waiters(c, "shared") == 1 })
+	second := make(chan string)
+	go func() {
+		value, _ := c.GetOrLoad(context.Background(), "shared", 0, loader)
+		second <- value
+	}()
+	waitFor(t, "the second caller to wait", func() bool { return waiters(c, "shared") == 2 })
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled caller error = %v", err)
+	}
+	close(release)
+	if value := <-second; value != "value" {
+		t.Errorf("second caller got %q", value)
+	}
+
+	// A lone caller giving up cancels the loader
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.GetOrLoad(ctx, "alone", 0, func(ctx context.Context, key string) (string, error) {
+		<-ctx.Done()
+		close(canceled)
+		return "", ctx.Err()
+	}); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetOrLoad error = %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("loader context wasn't canceled")
+	}
+}
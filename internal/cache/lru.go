@@ -1,20 +1,210 @@
 package cache
 
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
 // LRU (Least Recently Used) eviction policy implementation.
 //
-// The cache uses LRU eviction when maxKeys is set:
-// - Each key tracks its last access time in the lastAccess map
-// - Get() operations update the last access time (marking the key as recently used)
-// - Set() operations also update the last access time
-// - When the cache is full and a new key is added, the key with the oldest
-//   last access time is evicted
+// The cache uses LRU eviction when maxKeys is set (unless WithEvictionPolicy
+// selects another policy, see eviction.go):
+// - Keys are kept in a doubly-linked list ordered by last access, most
+//   recently used first, along with their last access time
+// - Get() operations move the key to the front (marking it as recently used).
+//   Get only holds the shard's read lock, so it records the access in the
+//   shard's accessBuffer, and the buffered accesses are applied to the list
+//   by the next write (Set, eviction, Cleanup), or by the Get that fills the
+//   buffer. The order is thus up to accessBufferSize reads behind.
+// - Set() operations also move the key to the front
+// - When the cache is full and a new key is added, the key at the back of
+//   the list is evicted, so eviction takes constant time regardless of the
+//   number of keys
 //
 // TTL + LRU Coordination:
 // - Expired keys are removed immediately when detected (in Get(), Set(), Cleanup())
-// - Expired keys are NOT considered when counting keys for maxKeys limit
+// - Expired keys are removed before any valid key is evicted for the maxKeys limit
 // - Expired keys are NOT considered when finding the LRU candidate for eviction
 // - Only valid (non-expired) keys affect LRU order
 // - This ensures state consistency: expired keys don't interfere with LRU eviction
 //
 // This ensures that frequently accessed keys stay in the cache while
 // rarely used keys are removed first when memory is limited.
+
+// lruEntry is a key in the LRU list.
+type lruEntry struct {
+	key        string
+	lastAccess time.Time
+	freq       uint8     // LFU access counter (see lfuIncrement)
+	prev, next *lruEntry // Towards the front (more recent) and the back (less recent)
+}
+
+// lruList orders keys by last access. It is protected by the cache lock.
+type lruList struct {
+	entries map[string]*lruEntry
+	front   *lruEntry // Most recently used
+	back    *lruEntry // Least recently used
+}
+
+// newLRUList creates an empty LRU list.
+func newLRUList() *lruList {
+	return &lruList{entries: make(map[string]*lruEntry)}
+}
+
+// touch marks key as accessed at t, moving it to the front of the list.
+func (l *lruList) touch(key string, t time.Time) {
+	e, ok := l.entries[key]
+	if ok {
+		l.unlink(e)
+	} else {
+		e = &lruEntry{key: key, freq: lfuInitValue}
+		l.entries[key] = e
+	}
+	e.lastAccess = t
+	l.pushFront(e)
+}
+
+// remove takes key off the list.
+func (l *lruList) remove(key string) {
+	if e, ok := l.entries[key]; ok {
+		l.unlink(e)
+		delete(l.entries, key)
+	}
+}
+
+// lastAccess returns the last access time of key (zero if it isn't listed).
+func (l *lruList) lastAccess(key string) time.Time {
+	if e, ok := l.entries[key]; ok {
+		return e.lastAccess
+	}
+	return time.Time{}
+}
+
+// sortByAccess reorders the list by last access time. Loading a snapshot or
+// an AOF preamble sets the saved access times in no particular order, so the
+// list is sorted once after loading.
+func (l *lruList) sortByAccess() {
+	sorted := true
+	for e := l.front; e != nil && e.next != nil; e = e.next {
+		if e.lastAccess.Before(e.next.lastAccess) {
+			sorted = false
+			break
+		}
+	}
+	if sorted {
+		return
+	}
+
+	entries := make([]*lruEntry, 0, len(l.entries))
+	for e := l.front; e != nil; e = e.next {
+		entries = append(entries, e)
+	}
+	// Most recent first; the stable sort keeps list order for equal times
+	slices.SortStableFunc(entries, func(a, b *lruEntry) int {
+		return b.lastAccess.Compare(a.lastAccess)
+	})
+
+	l.front, l.back = nil, nil
+	for i := len(entries) - 1; i >= 0; i-- {
+		l.pushFront(entries[i])
+	}
+}
+
+// pushFront inserts an unlinked entry at the front.
+func (l *lruList) pushFront(e *lruEntry) {
+	e.prev, e.next = nil, l.front
+	if l.front != nil {
+		l.front.prev = e
+	} else {
+		l.back = e
+	}
+	l.front = e
+}
+
+// unlink removes an entry from the list, keeping it in the map.
+func (l *lruList) unlink(e *lruEntry) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		l.front = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		l.back = e.prev
+	}
+	e.prev, e.next = nil, nil
+}
+
+// accessBufferSize is the number of reads buffered per shard between two
+// writes (see accessBuffer).
+const accessBufferSize = 256
+
+// accessBuffer records the keys read under the shard's read lock. Readers
+// claim a slot with an atomic increment, so they never write the same slot,
+// and the buffer is only drained under the write lock, which excludes them.
+// Reads beyond the last slot are dropped until the next drain.
+type accessBuffer struct {
+	next  atomic.Int64 // Next free slot (may exceed the size when full)
+	slots [accessBufferSize]access
+}
+
+// access is a read of a key.
+type access struct {
+	key string
+	at  time.Time
+}
+
+// recordAccess records a read of key at t (must be called with the read lock
+// held). It returns true if it filled the buffer: the caller should then
+// drain it under the write lock. The random policy doesn't track accesses.
+func (s *shard) recordAccess(key string, t time.Time) bool {
+	if s.cache.policy() == EvictionRandom {
+		return false
+	}
+	i := s.accesses.next.Add(1) - 1
+	if i < accessBufferSize {
+		s.accesses.slots[i] = access{key: key, at: t}
+	}
+	return i == accessBufferSize-1
+}
+
+// drainAccessesLocked applies the buffered reads to the eviction state, in
+// the order they were recorded, and empties the buffer (must be called with
+// the write lock held). Keys removed since their read are skipped.
+func (s *shard) drainAccessesLocked() {
+	n := min(s.accesses.next.Load(), accessBufferSize)
+	for i := range n {
+		a := &s.accesses.slots[i]
+		if s.hasKey(a.key) {
+			s.touch(a.key, a.at)
+		}
+		*a = access{}
+	}
+	s.accesses.next.Store(0)
+}
+
+// drainAccesses drains the read buffers of all shards, one at a time, so
+// that copies of the dataset taken under read locks (snapshots, AOF
+// rewrites) persist the latest access times.
+func (c *Cache) drainAccesses() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.drainAccessesLocked()
+		s.mu.Unlock()
+	}
+}
+
+// lruCandidate returns the valid (non-expired) key closest to the back of
+// the LRU list, or "" if there is none (must be called with lock held). Set
+// removes expired keys first, so this is normally the last entry.
+func (s *shard) lruCandidate() string {
+	for e := s.lru.back; e != nil; e = e.prev {
+		// Skip expired keys - they should not affect LRU order
+		if !s.isExpired(e.key) {
+			return e.key
+		}
+	}
+	return ""
+}
@@ -0,0 +1,316 @@
+package cache
+
+import (
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listKeys returns the keys of l from the front (most recent) to the back,
+// checking that the back-to-front links agree.
+func listKeys(t *testing.T, l *lruList) []string {
+	t.Helper()
+	var keys []string
+	for e := l.front; e != nil; e = e.next {
+		keys = append(keys, e.key)
+	}
+	var back []string
+	for e := l.back; e != nil; e = e.prev {
+		back = append(back, e.key)
+	}
+	slices.Reverse(back)
+	if !slices.Equal(keys, back) {
+		t.Fatalf("list is %v from the front but %v from the back", keys, back)
+	}
+	if len(keys) != len(l.entries) {
+		t.Fatalf("list has %d keys, map %d", len(keys), len(l.entries))
+	}
+	return keys
+}
+
+// TestLRUList checks the order kept by touch, remove, and sortByAccess.
+func TestLRUList(t *testing.T) {
+	l := newLRUList()
+	base := time.Unix(1000, 0)
+	for i, key := range []string{"a", "b", "c"} {
+		l.touch(key, base.Add(time.Duration(i)*time.Second))
+	}
+	if got := listKeys(t, l); !slices.Equal(got, []string{"c", "b", "a"}) {
+		t.Errorf("after touching a, b, c: %v", got)
+	}
+
+	l.touch("a", base.Add(10*time.Second))
+	if got := listKeys(t, l); !slices.Equal(got, []string{"a", "c", "b"}) {
+		t.Errorf("after touching a again: %v", got)
+	}
+	if got := l.lastAccess("a"); !got.Equal(base.Add(10 * time.Second)) {
+		t.Errorf("lastAccess(a) = %v", got)
+	}
+
+	l.remove("c")
+	l.remove("missing")
+	if got := listKeys(t, l); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("after removing c: %v", got)
+	}
+	l.remove("a")
+	l.remove("b")
+	if got := listKeys(t, l); len(got) != 0 || l.front != nil || l.back != nil {
+		t.Errorf("after removing all keys: %v", got)
+	}
+
+	// Loading sets the saved times in any order
+	for i, key := range []string{"x", "y", "z", "w"} {
+		l.touch(key, base.Add(time.Duration([]int{3, 1, 4, 2}[i])*time.Second))
+	}
+	l.sortByAccess()
+	if got := listKeys(t, l); !slices.Equal(got, []string{"z", "x", "w", "y"}) {
+		t.Errorf("after sortByAccess: %v", got)
+	}
+}
+
+// TestLRUEviction checks that a full cache evicts the least recently used
+// key, after any expired one, and logs the eviction to the AOF.
+func TestLRUEviction(t *testing.T) {
+	dir := t.TempDir()
+	aofPath := filepath.Join(dir, "test.aof")
+	snapshotPath := filepath.Join(dir, "test.snapshot")
+	clock := newFakeClock()
+	c, err := NewCache(aofPath, snapshotPath, 3, WithShards(1), WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	set := func(key string, ttl time.Duration) {
+		t.Helper()
+		clock.Advance(time.Second)
+		if err := c.Set(key, "value", ttl); err != nil {
+			t.Fatalf("Set(%s): %v", key, err)
+		}
+	}
+	set("a", 0)
+	set("b", 0)
+	set("c", 0)
+	clock.Advance(time.Second)
+	c.Get("a") // b is now the least recently used
+
+	set("d", 0)
+	if _, ok := c.Get("b"); ok {
+		t.Error("b, the least recently used key, was not evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+	if evicted := c.Stats().Evicted; evicted != 1 {
+		t.Errorf("Evicted = %d, want 1", evicted)
+	}
+
+	// An expired key goes first, even if it was used last
+	set("ttl", 2*time.Second) // Evicts a, read before c and d above
+	clock.Advance(5 * time.Second)
+	set("e", 0)
+	if _, ok := c.Get("ttl"); ok {
+		t.Error("expired key is still there")
+	}
+	if evicted := c.Stats().Evicted; evicted != 2 {
+		t.Errorf("Evicted = %d, want 2 (the expired key is not evicted)", evicted)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := NewCache(aofPath, snapshotPath, 3, WithShards(1), WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("NewCache after restart: %v", err)
+	}
+	defer c2.Close()
+	var keys []string
+	for _, key := range []string{"a", "b", "c", "d", "ttl", "e"} {
+		if _, ok := c2.Get(key); ok {
+			keys = append(keys, key)
+		}
+	}
+	if !slices.Equal(keys, []string{"c", "d", "e"}) {
+		t.Errorf("keys after replay: %v, want [c d e]", keys)
+	}
+}
+
+// BenchmarkLRUEviction sets new keys in a full cache, evicting a key with
+// each Set. The cost per Set doesn't depend on the number of keys.
+func BenchmarkLRUEviction(b *testing.B) {
+	for _, size := range []int{100_000, 1_000_000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			c, err := NewCache("", "", size, WithShards(1))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			for i := range size {
+				if err := c.Set("key"+strconv.Itoa(i), "value", 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for i := range b.N {
+				if err := c.Set("new"+strconv.Itoa(i), "value", 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			if evicted := c.Stats().Evicted; evicted != int64(b.N) {
+				b.Fatalf("%d keys evicted, want %d", evicted, b.N)
+			}
+		})
+	}
+}
+
+// TestAccessBuffer checks that Get records accesses under the read lock and
+// that they reach the LRU list with the next write, or when the buffer is
+// full, and that Get removes an expired key.
+func TestAccessBuffer(t *testing.T) {
+	clock := newFakeClock()
+	c, err := NewCache("", "", 0, WithShards(1), WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+	s := c.shards[0]
+
+	for _, key := range []string{"a", "b"} {
+		clock.Advance(time.Second)
+		if err := c.Set(key, "value", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(time.Second)
+	c.Get("a")
+	if n := s.accesses.next.Load(); n != 1 {
+		t.Errorf("%d accesses buffered, want 1", n)
+	}
+	if got := listKeys(t, s.lru); !slices.Equal(got, []string{"b", "a"}) {
+		t.Errorf("LRU list before the next write: %v, want [b a]", got)
+	}
+	if err := c.Set("c", "value", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := listKeys(t, s.lru); !slices.Equal(got, []string{"c", "a", "b"}) {
+		t.Errorf("LRU list after the next write: %v, want [c a b]", got)
+	}
+	if n := s.accesses.next.Load(); n != 0 {
+		t.Errorf("%d accesses buffered after a write, want 0", n)
+	}
+
+	// The Get that fills the buffer drains it
+	for range accessBufferSize - 1 {
+		c.Get("b")
+	}
+	if got := listKeys(t, s.lru); got[0] != "c" {
+		t.Errorf("LRU list before the buffer is full: %v", got)
+	}
+	c.Get("b")
+	if got := listKeys(t, s.lru); !slices.Equal(got, []string{"b", "c", "a"}) {
+		t.Errorf("LRU list after the buffer filled: %v, want [b c a]", got)
+	}
+	if n := s.accesses.next.Load(); n != 0 {
+		t.Errorf("%d accesses buffered after the buffer filled, want 0", n)
+	}
+
+	if err := c.Set("ttl", "value", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Second)
+	if _, ok := c.Get("ttl"); ok {
+		t.Error("Get returned an expired key")
+	}
+	if _, ok := s.data["ttl"]; ok || c.Stats().ExpiredLazy != 1 {
+		t.Errorf("expired key still stored after Get, ExpiredLazy = %d", c.Stats().ExpiredLazy)
+	}
+	if _, ok := s.lru.entries["ttl"]; ok {
+		t.Error("expired key still in the LRU list")
+	}
+}
+
+// TestConcurrentGetAndWrite runs Gets concurrently with writes that evict
+// and expire keys (run it with -race), and checks that the LRU list matches
+// the dataset afterwards.
+func TestConcurrentGetAndWrite(t *testing.T) {
+	const (
+		maxKeys = 100
+		keys    = 500
+	)
+	c, err := NewCache("", "", maxKeys, WithShards(2))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Go(func() {
+			for i := range 20_000 {
+				key := "key" + strconv.Itoa((i*31+g*7)%keys)
+				switch {
+				case g < 6:
+					c.Get(key)
+				case i%10 == 0:
+					c.Del(key)
+				case i%10 == 1:
+					c.Set(key, "value", time.Millisecond)
+				default:
+					c.Set(key, "value", 0)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	if n := c.Stats().Keys; n > maxKeys {
+		t.Errorf("%d keys, limit %d", n, maxKeys)
+	}
+	for i, s := range c.shards {
+		s.mu.Lock()
+		s.drainAccessesLocked()
+		if len(s.lru.entries) != len(s.data) {
+			t.Errorf("shard %d: %d keys in the LRU list, %d stored", i, len(s.lru.entries), len(s.data))
+		}
+		listKeys(t, s.lru)
+		s.mu.Unlock()
+	}
+}
+
+// BenchmarkReadHeavy runs a 95% Get, 5% Set workload on all cores. Gets
+// only take read locks, so they scale with the cores.
+func BenchmarkReadHeavy(b *testing.B) {
+	const keys = 100_000
+	c, err := NewCache("", "", 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = "key" + strconv.Itoa(i)
+		if err := c.Set(names[i], "value", 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := names[i*7919%keys]
+			if i%20 == 0 {
+				c.Set(key, "value", 0)
+			} else {
+				c.Get(key)
+			}
+			i++
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"errors"
+	"unique"
+)
+
+// ErrValueTooLarge is returned by Set when a single entry is larger than the
+// whole memory limit, so no amount of eviction could make room for it.
+var ErrValueTooLarge = errors.New("entry is larger than the memory limit")
+
+// Memory accounting.
+//
+// The memory used by the dataset is estimated per entry as the length of the
+// key and the value plus entryOverhead, which approximates the map entries,
+// the expiration and modification times, and the eviction bookkeeping of a
+// key. The total is kept up to date by every write and removal, so checking
+// WithMaxMemory doesn't scan the keys. MemoryUsage reports the same estimate
+// for one key; container types would add their per-element costs to it.
+const (
+	dataEntryOverhead   = 64 // data map slot with the key and value string headers
+	expiryEntryOverhead = 48 // expires map slot with the expiration time (keys with a TTL only, counted for all)
+	metaEntryOverhead   = 56 // meta map slot with the modification time, version, and content type handle
+	accessEntryOverhead = 88 // LRU list entry (or key set slot) and its map slot
+
+	entryOverhead = dataEntryOverhead + expiryEntryOverhead + metaEntryOverhead + accessEntryOverhead
+)
+
+// entrySize returns the estimated memory used by an entry, in bytes.
+func entrySize[V string | []byte](key string, value V) int64 {
+	return int64(len(key)+len(value)) + entryOverhead
+}
+
+// MemoryUsage returns the estimated memory used by key and its value, in
+// bytes, as counted for WithMaxMemory, and false if the key doesn't exist
+// or has expired. It doesn't count as an access to the key.
+func (c *Cache) MemoryUsage(key string) (int64, bool) {
+	s := c.shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.data[key]
+	if !ok || s.isExpired(key) {
+		return 0, false
+	}
+	return entrySize(key, value), true
+}
+
+// memoryDelta returns how much storing a value of valueLen bytes under key
+// would change the memory used (must be called with lock held).
+func (s *shard) memoryDelta(key string, valueLen int) int64 {
+	if old, ok := s.data[key]; ok {
+		return int64(valueLen - len(old))
+	}
+	return int64(len(key)+valueLen) + entryOverhead
+}
+
+// putLocked stores value under key with its content type (empty: none),
+// updates the memory used, and records the modification time and a new
+// version. Must be called with lock held.
+func (s *shard) putLocked(key string, value []byte, contentType string) {
+	delta := s.memoryDelta(key, len(value))
+	s.usedMemory += delta
+	if _, ok := s.data[key]; ok {
+		s.trackInternal(key, 0, delta)
+	} else {
+		s.trackInternal(key, 1, delta)
+	}
+	s.data[key] = value
+	meta := keyMeta{
+		modified: s.cache.now().UnixNano(),
+		version:  s.cache.lastVersion.Add(1),
+	}
+	if contentType != "" {
+		meta.contentType = unique.Make(contentType)
+	}
+	s.meta[key] = meta
+	s.cache.notifyWatchers(KeyEventSet, key)
+}
+
+// keyMeta is the metadata recorded by every write of a key's value, and
+// kept when only its TTL changes. Versions come from a counter of the whole
+// cache, so a key that is deleted and set again doesn't reuse one. The
+// counter starts at the startup time in Unix nanoseconds, so versions keep
+// increasing across restarts (as long as the writes don't outpace the
+// clock), even though they aren't persisted: loaded keys get new versions.
+// Content types are persisted with the value. They are interned, as most
+// keys share a few of them, so they are covered by the fixed overhead.
+type keyMeta struct {
+	modified    int64                 // Last write, in Unix nanoseconds
+	version     uint64                // Version of the value
+	contentType unique.Handle[string] // Content type of the value (zero: none)
+}
+
+// contentTypeString returns the content type of the value, or "" if it has none.
+func (m keyMeta) contentTypeString() string {
+	if m.contentType == (unique.Handle[string]{}) {
+		return ""
+	}
+	return m.contentType.Value()
+}
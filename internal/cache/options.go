@@ -0,0 +1,232 @@
+package cache
+
+import "time"
+
+// Option configures optional Cache behavior in NewCache.
+type Option func(*Cache)
+
+// WithAOFLoadTruncated controls what happens when AOF replay finds a corrupted
+// or incomplete record. If allow is true (the default), the AOF is truncated to
+// the last good record and startup continues; if false, NewCache fails with an
+// *AOFCorruptionError so an operator can inspect the file first. A corrupted
+// preamble fails either way, see AOF.Replay.
+func WithAOFLoadTruncated(allow bool) Option {
+	return func(c *Cache) {
+		c.aofLoadTruncated = allow
+	}
+}
+
+// WithAOFFsync sets when AOF writes are synced to disk (FsyncAlways by
+// default), see aof_fsync.go.
+func WithAOFFsync(policy FsyncPolicy) Option {
+	return func(c *Cache) {
+		c.aofFsync = policy
+	}
+}
+
+// WithClock replaces time.Now as the source of the current time for expiration,
+// LRU access times, and snapshots. It is mainly useful for tests that need to
+// advance time without sleeping.
+func WithClock(now func() time.Time) Option {
+	return func(c *Cache) {
+		c.now = now
+	}
+}
+
+// WithMaxMemory limits the estimated memory used by the dataset to bytes (0,
+// the default, means unlimited). Keys are evicted by the eviction policy
+// when a write would exceed it, in addition to the maxKeys limit. The
+// estimate counts the key and value lengths plus a fixed overhead per key.
+func WithMaxMemory(bytes int64) Option {
+	return func(c *Cache) {
+		c.maxMemory.Store(bytes)
+	}
+}
+
+// WithMaxKeyLength rejects writes of keys longer than n bytes with a
+// *LimitError matching ErrKeyTooLong (0, the default, means unlimited).
+// Longer keys in the AOF or a snapshot are skipped at load, see limits.go.
+func WithMaxKeyLength(n int) Option {
+	return func(c *Cache) {
+		c.maxKeyLength.Store(int64(n))
+	}
+}
+
+// WithMaxValueSize rejects writes of values larger than bytes with a
+// *LimitError matching ErrValueTooLong (0, the default, means unlimited).
+// Larger values in the AOF or a snapshot are skipped at load, see limits.go.
+func WithMaxValueSize(bytes int) Option {
+	return func(c *Cache) {
+		c.maxValueSize.Store(int64(bytes))
+	}
+}
+
+// WithKeyPolicy rejects writes of keys that policy doesn't accept with a
+// *KeyPolicyError matching ErrInvalidKey. Keys are unrestricted by default,
+// and existing keys aren't checked, see keypolicy.go.
+func WithKeyPolicy(policy *KeyPolicy) Option {
+	return func(c *Cache) {
+		c.keyPolicy = policy
+	}
+}
+
+// WithEvictionPolicy selects the key evicted when maxKeys is reached: the
+// least recently used one (EvictionLRU, the default), the least frequently
+// used one (EvictionLFU), a random one (EvictionRandom), which saves the
+// access tracking on every Get, or the one expiring first (EvictionVolatileTTL,
+// falling back to LRU when no key has a TTL). With EvictionNoEviction, no key
+// is evicted: Set rejects new keys with ErrCacheFull.
+func WithEvictionPolicy(policy EvictionPolicy) Option {
+	return func(c *Cache) {
+		c.evictionPolicy.Store(int32(policy))
+	}
+}
+
+// WithOnEvict registers fn to be called with every key the cache drops on
+// its own, with its last value: keys evicted at maxKeys or maxMemory, and
+// expired keys, whether found by Get, Del, or the periodic cleanup (also
+// while loading the dataset). Keys deleted by Del aren't reported.
+//
+// fn runs in a separate goroutine, one key at a time and in removal order,
+// so it may call the cache. Removals are queued without blocking writers;
+// when fn can't keep up and the queue is full, they are dropped and counted
+// in Stats.EvictCallbacksDropped.
+func WithOnEvict(fn func(key, value string, reason EvictionReason)) Option {
+	return func(c *Cache) {
+		c.onEvictFn = fn
+	}
+}
+
+// WithShards partitions the dataset into n shards (a power of two), each
+// with its own lock and its share of maxKeys and maxMemory. The default is
+// 4 shards per GOMAXPROCS, or fewer with small limits, so that each shard
+// keeps at least 1024 keys or 1MB; WithShards(1) makes eviction exactly
+// global at the cost of a single lock.
+func WithShards(n int) Option {
+	return func(c *Cache) {
+		c.numShards = n
+	}
+}
+
+// WithFullScanExpiration makes Cleanup scan every key for expired ones,
+// instead of taking the due keys from the expiration index, and RunCleanup
+// run it every second. The scan holds the lock for the whole cycle and
+// costs O(n) even when nothing expires, so it only suits small caches.
+func WithFullScanExpiration() Option {
+	return func(c *Cache) {
+		c.fullScanExpiration = true
+	}
+}
+
+// WithCleanupBudget sets how Cleanup removes a burst of expired keys: batch
+// keys per lock hold (64 by default), so that requests wait for one batch at
+// most, and for at most budget per cycle (25ms by default), the rest being
+// left to the next cycle. Smaller values bound latency more tightly but take
+// longer to remove a large burst.
+func WithCleanupBudget(batch int, budget time.Duration) Option {
+	return func(c *Cache) {
+		c.expireBatchSize = batch
+		c.expireCycleBudget = budget
+	}
+}
+
+// WithCleanupInterval sets the longest time RunCleanup sleeps between two
+// cycles (1s by default), which is how often expired keys are removed with
+// WithFullScanExpiration. Otherwise RunCleanup wakes up earlier when a key
+// is due, and the interval only bounds the sleep.
+func WithCleanupInterval(interval time.Duration) Option {
+	return func(c *Cache) {
+		c.cleanupInterval.Store(int64(interval))
+	}
+}
+
+// WithDeferredLoad makes NewCache return without loading the snapshot and AOF,
+// so the caller can start serving (e.g. a 503 "loading" response) and call
+// Load itself, possibly in another goroutine.
+func WithDeferredLoad() Option {
+	return func(c *Cache) {
+		c.deferLoad = true
+	}
+}
+
+// WithSnapshotCompression enables gzip compression of snapshot files at the
+// given level (gzip.DefaultCompression, or 1 to 9). LoadSnapshot detects
+// compressed files automatically, so switching this on or off at any time is safe.
+func WithSnapshotCompression(level int) Option {
+	return func(c *Cache) {
+		c.snapshotGzip = true
+		c.snapshotGzipLevel = level
+	}
+}
+
+// WithSnapshotFormat selects the encoding of snapshot files. SnapshotFormatBinary
+// is much faster to save and load than the default SnapshotFormatJSON for large
+// datasets. LoadSnapshot reads both formats regardless of this setting.
+func WithSnapshotFormat(format SnapshotFormat) Option {
+	return func(c *Cache) {
+		c.snapshotFormat = format
+	}
+}
+
+// WithSnapshotRetention keeps the keep most recent older snapshots next to the
+// current one (<path>.1 is the newest, <path>.<keep> the oldest), so a bad
+// dataset doesn't overwrite the last good copy. The default is 0 (none).
+func WithSnapshotRetention(keep int) Option {
+	return func(c *Cache) {
+		c.snapshotKeep = keep
+	}
+}
+
+// WithRestoreFrom makes Load restore the dataset from the snapshot at path
+// (e.g. an older generation kept by WithSnapshotRetention) instead of the
+// regular snapshot and AOF. The AOF is then rewritten from the restored
+// dataset; the previous AOF is kept as <aof>.before-restore.
+func WithRestoreFrom(path string) Option {
+	return func(c *Cache) {
+		c.restorePath = path
+	}
+}
+
+// WithStrictSnapshotLoad makes loading fail with a *SnapshotCorruptionError
+// when the snapshot is empty, can't be decoded, has an unsupported version, or
+// fails its checksum. By default such a snapshot is ignored with a warning and
+// the cache starts from the AOF alone.
+func WithStrictSnapshotLoad(strict bool) Option {
+	return func(c *Cache) {
+		c.strictSnapshotLoad = strict
+	}
+}
+
+// WithSnapshotSink uploads every snapshot saved by a SnapshotManager to sink,
+// and makes Load download the snapshot from sink if the local file is missing.
+func WithSnapshotSink(sink SnapshotSink) Option {
+	return func(c *Cache) {
+		c.snapshotSink = sink
+	}
+}
+
+// WithoutPersistence keeps the dataset in memory only, e.g. for tests: no
+// AOF or snapshot file is opened or created, and Close does nothing.
+// Passing an empty AOF path to NewCache has the same effect.
+func WithoutPersistence() Option {
+	return func(c *Cache) {
+		c.noPersistence = true
+	}
+}
+
+// WithCopyOnRead makes GetBytes return a copy of the value, which the caller
+// may modify, instead of the stored value. Get always returns a copy.
+func WithCopyOnRead() Option {
+	return func(c *Cache) {
+		c.copyOnRead = true
+	}
+}
+
+// WithNegativeCacheTTL makes GetOrLoad remember a loader error for ttl, and
+// return it for the key without calling the loader again until then. By
+// default errors aren't cached, and every miss calls the loader.
+func WithNegativeCacheTTL(ttl time.Duration) Option {
+	return func(c *Cache) {
+		c.negativeCacheTTL = ttl
+	}
+}
@@ -0,0 +1,442 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replication protocol between a Replica and the primary's HTTP server.
+//
+// The replica opens GET ReplicationSyncPath?id=<replica ID>&replid=<ID>&offset=<n>
+// and keeps reading the response, an AOF stream preceded by a snapshot for a
+// full resync (see ReplicationStream.Serve), described by the
+// ReplicationIDHeader, ReplicationOffsetHeader, and ReplicationModeHeader headers. Every second it POSTs a ReplicationAck to
+// ReplicationAckPath; the primary answers 404 if it no longer knows the replica.
+// Both endpoints require "Authorization: Bearer <token>" if the primary has one.
+const (
+	ReplicationSyncPath = "/replication/sync"
+	ReplicationAckPath  = "/replication/ack"
+
+	ReplicationIDHeader     = "X-Replication-Id"     // Replication ID of the stream
+	ReplicationOffsetHeader = "X-Replication-Offset" // Offset the stream continues after
+	ReplicationModeHeader   = "X-Replication-Mode"   // "full" or "partial"
+)
+
+// ReplicationAck is the body of an acknowledgement sent to ReplicationAckPath.
+type ReplicationAck struct {
+	ID     string `json:"id"`     // Replica ID
+	Offset uint64 `json:"offset"` // Last offset applied by the replica
+}
+
+// Replica connection settings.
+const (
+	replicaAckInterval    = 1 * time.Second  // How often the applied offset is acknowledged
+	replicaAckAttempts    = 5                // Consecutive failed acknowledgements before reconnecting
+	replicaRetryMinDelay  = 1 * time.Second  // Wait before the first reconnection attempt
+	replicaRetryMaxDelay  = 30 * time.Second // Upper bound for the wait between attempts
+	replicaConnectTimeout = 10 * time.Second // Bound for connecting and for the response headers
+)
+
+// Replica keeps the cache in sync with a primary (see replication.go): it
+// connects to the primary, loads the full resync or continues after its
+// offset, applies every command the primary streams, acknowledges what it
+// applied, and reconnects with its offset whenever the connection drops.
+//
+// Commands are applied with setInternal and delInternal, like AOF replay, and
+// logged to the replica's own AOF, so the replica can restart or take over
+// from its local files. The cache must not accept writes from clients while
+// the replica runs, or it would diverge from the primary.
+type Replica struct {
+	cache   *Cache
+	primary string // host:port of the primary
+	baseURL string
+	token   string // Bearer token for the primary's replication endpoints
+	id      string // Replica ID, new for every process
+	client  *http.Client
+	ackHTTP *http.Client
+
+	mu            sync.Mutex
+	replID        string    // Replication ID of the applied history
+	offset        uint64    // Offset of the last applied command
+	state         string    // "connecting", "sync", or "online"
+	lastIO        time.Time // When data was last received from the primary
+	linkDownSince time.Time // When the link went down (zero while online)
+	fullSyncs     int
+	partialSyncs  int
+	lastError     string
+	cancel        context.CancelFunc
+	done          chan struct{}
+}
+
+// ReplicaStatus describes the state of a Replica.
+type ReplicaStatus struct {
+	Primary       string    // host:port of the primary
+	State         string    // "connecting", "sync" (receiving a full resync), or "online"
+	ReplID        string    // Replication ID of the applied history
+	Offset        uint64    // Offset of the last applied command
+	LastIO        time.Time // When data was last received from the primary
+	LinkDownSince time.Time // When the link went down (zero while online)
+	FullSyncs     int       // Full resyncs since startup
+	PartialSyncs  int       // Partial resyncs (reconnections) since startup
+	LastError     string    // Why the link last went down
+}
+
+// NewReplica creates a replica of the primary at addr ("host:port") for the
+// cache. token is sent as a bearer token to the primary, if not empty.
+func NewReplica(cache *Cache, addr, token string) (*Replica, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid primary address %q (expected host:port): %w", addr, err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: replicaConnectTimeout}).DialContext
+	transport.ResponseHeaderTimeout = replicaConnectTimeout
+
+	return &Replica{
+		cache:   cache,
+		primary: addr,
+		baseURL: "http://" + addr,
+		token:   token,
+		id:      newReplicationID()[:16],
+		client:  &http.Client{Transport: transport}, // No timeout: the stream never ends
+		ackHTTP: &http.Client{Transport: transport, Timeout: replicaConnectTimeout},
+		state:   "connecting",
+	}, nil
+}
+
+// Start begins replicating in a background goroutine.
+func (r *Replica) Start() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancel != nil {
+		return fmt.Errorf("replica is already running")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	r.linkDownSince = time.Now()
+	go r.run(ctx)
+
+	return nil
+}
+
+// Stop disconnects from the primary and waits until no command is applied
+// anymore. The command being applied completes; data received but not
+// applied yet is discarded, and a full resync still being received leaves the
+// previous dataset in place, so the cache always holds a prefix of the
+// primary's history.
+func (r *Replica) Stop() {
+	r.mu.Lock()
+	cancel, done := r.cancel, r.done
+	r.cancel = nil
+	r.mu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Status returns the state of the replica.
+func (r *Replica) Status() ReplicaStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return ReplicaStatus{
+		Primary:       r.primary,
+		State:         r.state,
+		ReplID:        r.replID,
+		Offset:        r.offset,
+		LastIO:        r.lastIO,
+		LinkDownSince: r.linkDownSince,
+		FullSyncs:     r.fullSyncs,
+		PartialSyncs:  r.partialSyncs,
+		LastError:     r.lastError,
+	}
+}
+
+// run syncs with the primary until ctx is done, reconnecting with backoff.
+func (r *Replica) run(ctx context.Context) {
+	defer close(r.done)
+
+	delay := replicaRetryMinDelay
+	for {
+		start := time.Now()
+		err := r.sync(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		r.mu.Lock()
+		if r.state == "online" {
+			r.linkDownSince = time.Now()
+		}
+		r.state = "connecting"
+		r.lastError = err.Error()
+		r.mu.Unlock()
+
+		// A connection that lasted a while resets the backoff
+		if time.Since(start) > replicaRetryMaxDelay {
+			delay = replicaRetryMinDelay
+		}
+		slog.Warn("Replication interrupted", "primary", r.primary, "retry_in", delay, "err", err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay = min(delay*2, replicaRetryMaxDelay)
+	}
+}
+
+// sync performs a single connection: the resync, then the command stream
+// until the connection fails.
+func (r *Replica) sync(ctx context.Context) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	r.mu.Lock()
+	replID, offset := r.replID, r.offset
+	r.mu.Unlock()
+
+	query := url.Values{
+		"id":     {r.id},
+		"replid": {replID},
+		"offset": {strconv.FormatUint(offset, 10)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.baseURL+ReplicationSyncPath+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	r.authorize(req)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	streamID := resp.Header.Get(ReplicationIDHeader)
+	streamOffset, err := strconv.ParseUint(resp.Header.Get(ReplicationOffsetHeader), 10, 64)
+	if streamID == "" || err != nil {
+		return fmt.Errorf("invalid replication headers from primary")
+	}
+	body := bufio.NewReader(resp.Body)
+	if resp.Header.Get(ReplicationModeHeader) == "full" {
+		if err := r.loadFullResync(body, streamID, streamOffset); err != nil {
+			return r.streamError(ctx, err)
+		}
+	} else {
+		if streamID != replID || streamOffset != offset {
+			return fmt.Errorf("primary continued at %s:%d instead of %s:%d", streamID, streamOffset, replID, offset)
+		}
+		slog.Info("Partial resync", "primary", r.primary, "offset", offset)
+		r.mu.Lock()
+		r.partialSyncs++
+		r.mu.Unlock()
+	}
+
+	reader, err := newAOFStreamReader(body)
+	if err != nil {
+		return r.streamError(ctx, err)
+	}
+
+	r.mu.Lock()
+	r.state = "online"
+	r.lastIO = time.Now()
+	r.linkDownSince = time.Time{}
+	r.mu.Unlock()
+
+	go r.ackLoop(ctx, cancel)
+
+	for {
+		cmd, err := reader.Next()
+		if err == io.EOF {
+			return errors.New("primary closed the connection")
+		}
+		if err != nil {
+			return r.streamError(ctx, err)
+		}
+
+		r.mu.Lock()
+		expected := r.offset + 1
+		r.mu.Unlock()
+		if cmd.Seq != expected {
+			return fmt.Errorf("replication stream out of order: offset %d instead of %d", cmd.Seq, expected)
+		}
+
+		if err := r.cache.applyReplicated(cmd); err != nil {
+			return err
+		}
+
+		r.mu.Lock()
+		r.offset = cmd.Seq
+		r.lastIO = time.Now()
+		r.mu.Unlock()
+	}
+}
+
+// loadFullResync reads the snapshot of a full resync and replaces the cache
+// contents with it. The snapshot is fully received and verified first, so
+// an interrupted transfer leaves the current dataset in place.
+func (r *Replica) loadFullResync(body *bufio.Reader, replID string, offset uint64) error {
+	r.mu.Lock()
+	r.state = "sync"
+	r.mu.Unlock()
+
+	slog.Info("Full resync: receiving snapshot", "primary", r.primary, "offset", offset)
+	chunks := &chunkReader{r: body}
+	snapshot, err := readSnapshot("from "+r.primary, chunks)
+	if err != nil {
+		return err
+	}
+	// The decoder may stop before the empty chunk ending the snapshot
+	if _, err := io.Copy(io.Discard, chunks); err != nil {
+		return err
+	}
+
+	// The replica holds the primary's dataset, whatever its own limits
+	n, _, err := r.cache.replaceDataset(&snapshot, false)
+	if err != nil {
+		return fmt.Errorf("failed to load full resync: %w", err)
+	}
+	slog.Info("Full resync: loaded snapshot", "primary", r.primary, "keys", n, "offset", offset)
+
+	r.mu.Lock()
+	r.replID = replID
+	r.offset = offset
+	r.fullSyncs++
+	r.mu.Unlock()
+	return nil
+}
+
+// streamError returns the reason the connection was cancelled, if it was
+// (e.g. by a failed acknowledgement), instead of the resulting read error.
+func (r *Replica) streamError(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+	return err
+}
+
+// ackLoop acknowledges the applied offset every replicaAckInterval until ctx
+// is done. If the primary doesn't know the replica anymore or can't be
+// reached several times in a row, it cancels the connection so it is reopened.
+func (r *Replica) ackLoop(ctx context.Context, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(replicaAckInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		err := r.ack(ctx)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		if errors.Is(err, ErrReplicaNotFound) || failures >= replicaAckAttempts {
+			cancel(fmt.Errorf("failed to acknowledge offset: %w", err))
+			return
+		}
+	}
+}
+
+// ack sends the applied offset to the primary.
+func (r *Replica) ack(ctx context.Context) error {
+	r.mu.Lock()
+	body, _ := json.Marshal(ReplicationAck{ID: r.id, Offset: r.offset})
+	r.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.baseURL+ReplicationAckPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	r.authorize(req)
+
+	resp, err := r.ackHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return ErrReplicaNotFound
+	default:
+		return responseError(resp)
+	}
+}
+
+// authorize adds the bearer token to a request to the primary.
+func (r *Replica) authorize(req *http.Request) {
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+}
+
+// responseError returns an error describing an unexpected response from the primary.
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("primary responded %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// applyReplicated applies a command received from the primary and logs it to
+// the local AOF. A SET whose expiration time has already passed deletes the
+// key, as in AOF replay.
+func (c *Cache) applyReplicated(cmd AOFCommand) error {
+	s := c.shardFor(cmd.Key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch cmd.Op {
+	case "SET":
+		if !cmd.ExpiresAt.IsZero() && !c.now().Before(cmd.ExpiresAt) {
+			c.delInternal(cmd.Key)
+		} else {
+			c.setInternal(cmd.Key, []byte(cmd.Value), cmd.ExpiresAt, cmd.ContentType)
+		}
+		if c.aof != nil {
+			c.aof.LogSet(cmd.Key, cmd.Value, cmd.ExpiresAt, cmd.ContentType)
+		}
+	case "DEL":
+		c.delInternal(cmd.Key)
+		if c.aof != nil {
+			c.aof.LogDel(cmd.Key, cmd.Reason)
+		}
+	default:
+		return fmt.Errorf("unknown replicated operation '%s'", cmd.Op)
+	}
+
+	c.dirty.Add(1)
+	return nil
+}
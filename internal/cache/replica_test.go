@@ -0,0 +1,287 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPrimary serves the replication endpoints of a primary cache, like
+// cmd/server does. Each sync response pauses after holdAfter bytes until the
+// gate of its connection is closed, so tests can act while a full resync is
+// being transferred (a negative holdAfter never pauses).
+type testPrimary struct {
+	cache     *Cache
+	server    *httptest.Server
+	holdAfter int
+
+	mu      sync.Mutex
+	gates   []chan struct{} // Gate of each sync connection, in order
+	reached chan int        // Receives the number of a connection once it pauses
+}
+
+// newTestPrimary starts a primary serving c.
+func newTestPrimary(t *testing.T, c *Cache, holdAfter int) *testPrimary {
+	p := &testPrimary{cache: c, holdAfter: holdAfter, reached: make(chan int, 16)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+ReplicationSyncPath, p.sync)
+	mux.HandleFunc("POST "+ReplicationAckPath, p.ack)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// addr returns the host:port of the primary.
+func (p *testPrimary) addr() string {
+	return strings.TrimPrefix(p.server.URL, "http://")
+}
+
+// release lets sync connection n (from 0) continue.
+func (p *testPrimary) release(n int) {
+	close(p.gate(n))
+}
+
+// gate returns the gate of sync connection n, creating it if needed.
+func (p *testPrimary) gate(n int) chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.gates) <= n {
+		p.gates = append(p.gates, make(chan struct{}))
+	}
+	return p.gates[n]
+}
+
+// sync serves a replication stream, like replicationSyncHandler.
+func (p *testPrimary) sync(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	conn := len(p.gates)
+	p.mu.Unlock()
+	gate := p.gate(conn)
+
+	query := r.URL.Query()
+	offset, _ := strconv.ParseUint(query.Get("offset"), 10, 64)
+	stream, err := p.cache.NewReplicationStream(query.Get("id"), r.RemoteAddr, query.Get("replid"), offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mode := "partial"
+	if stream.Full() {
+		mode = "full"
+	}
+	w.Header().Set(ReplicationIDHeader, stream.ID())
+	w.Header().Set(ReplicationOffsetHeader, strconv.FormatUint(stream.Offset(), 10))
+	w.Header().Set(ReplicationModeHeader, mode)
+	w.WriteHeader(http.StatusOK)
+
+	held := &holdingWriter{w: w, left: p.holdAfter, hold: func() error {
+		p.reached <- conn
+		select {
+		case <-gate:
+			return nil
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}}
+	stream.Serve(r.Context(), held, w.(http.Flusher).Flush)
+}
+
+// ack records an acknowledgement, like replicationAckHandler.
+func (p *testPrimary) ack(w http.ResponseWriter, r *http.Request) {
+	var req ReplicationAck
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.cache.AckReplica(req.ID, req.Offset); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// holdingWriter calls hold once left bytes have been written, and fails
+// the write if hold does.
+type holdingWriter struct {
+	w    io.Writer
+	left int
+	hold func() error
+}
+
+func (h *holdingWriter) Write(p []byte) (int, error) {
+	if h.left >= 0 && len(p) > h.left {
+		n, err := h.w.Write(p[:h.left])
+		if err != nil {
+			return n, err
+		}
+		h.left = -1
+		if err := h.hold(); err != nil {
+			return n, err
+		}
+		m, err := h.w.Write(p[n:])
+		return n + m, err
+	}
+	if h.left >= 0 {
+		h.left -= len(p)
+	}
+	return h.w.Write(p)
+}
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestReplicaFullResync checks a full resync of a replica with unrelated
+// data: a replica stopped in the middle of the snapshot transfer keeps its
+// previous dataset, and a new one replaces it with the primary's, followed by
+// the writes made during the transfer and after it.
+func TestReplicaFullResync(t *testing.T) {
+	const keys = 2000
+	primary, err := NewCache(filepath.Join(t.TempDir(), "primary.aof"), "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer primary.Close()
+	value := strings.Repeat("v", 1024)
+	for i := range keys {
+		if err := primary.Set(fmt.Sprintf("key%d", i), value, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Hold each transfer after the first chunk of the snapshot
+	p := newTestPrimary(t, primary, snapshotChunkSize)
+
+	replicaCache, err := NewCache("", "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer replicaCache.Close()
+	if err := replicaCache.Set("stale", "x", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Kill the first replica in the middle of the transfer
+	r1, err := NewReplica(replicaCache, p.addr(), "")
+	if err != nil {
+		t.Fatalf("NewReplica: %v", err)
+	}
+	if err := r1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if conn := <-p.reached; conn != 0 {
+		t.Fatalf("connection %d paused, want 0", conn)
+	}
+	r1.Stop()
+	if _, ok := replicaCache.Get("stale"); !ok {
+		t.Error("interrupted full resync removed the previous dataset")
+	}
+	if _, ok := replicaCache.Get("key0"); ok {
+		t.Error("interrupted full resync loaded part of the snapshot")
+	}
+
+	// A restarted replica resyncs fully; writes made during the transfer are
+	// buffered and follow the snapshot
+	r2, err := NewReplica(replicaCache, p.addr(), "")
+	if err != nil {
+		t.Fatalf("NewReplica: %v", err)
+	}
+	if err := r2.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Stop()
+	if conn := <-p.reached; conn != 1 {
+		t.Fatalf("connection %d paused, want 1", conn)
+	}
+	if err := primary.Set("during", "transfer", 0); err != nil {
+		t.Fatal(err)
+	}
+	primary.Del("key1")
+	p.release(1)
+
+	waitFor(t, "the write made during the transfer", func() bool {
+		_, ok := replicaCache.Get("during")
+		return ok
+	})
+	if err := primary.Set("after", "sync", 0); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the write made after the transfer", func() bool {
+		_, ok := replicaCache.Get("after")
+		return ok
+	})
+
+	if _, ok := replicaCache.Get("stale"); ok {
+		t.Error("full resync kept a key the primary doesn't have")
+	}
+	if _, ok := replicaCache.Get("key1"); ok {
+		t.Error("key deleted during the transfer is still on the replica")
+	}
+	for i := range keys {
+		if i == 1 {
+			continue
+		}
+		if v, ok := replicaCache.Get(fmt.Sprintf("key%d", i)); !ok || v != value {
+			t.Fatalf("key%d missing or wrong on the replica", i)
+		}
+	}
+	if status := r2.Status(); status.FullSyncs != 1 || status.State != "online" {
+		t.Errorf("replica status = %+v, want online after 1 full resync", status)
+	}
+}
+
+// TestReplicaPartialResync checks that a replica reconnecting within the
+// backlog continues after its offset instead of resyncing fully.
+func TestReplicaPartialResync(t *testing.T) {
+	primary, err := NewCache(filepath.Join(t.TempDir(), "primary.aof"), "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer primary.Close()
+	p := newTestPrimary(t, primary, -1)
+
+	replicaCache, err := NewCache("", "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer replicaCache.Close()
+	r, err := NewReplica(replicaCache, p.addr(), "")
+	if err != nil {
+		t.Fatalf("NewReplica: %v", err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	if err := primary.Set("a", "1", 0); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the first write", func() bool { _, ok := replicaCache.Get("a"); return ok })
+
+	// Disconnecting the replica makes it reconnect with its offset
+	primary.DisconnectReplicas()
+	if err := primary.Set("b", "2", 0); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the write made while disconnected", func() bool { _, ok := replicaCache.Get("b"); return ok })
+
+	if status := r.Status(); status.FullSyncs != 1 || status.PartialSyncs != 1 {
+		t.Errorf("replica status = %+v, want 1 full and 1 partial resync", status)
+	}
+}
@@ -0,0 +1,657 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Primary→replica replication.
+//
+// A primary streams its writes to replicas over long-lived connections in the
+// AOF record format (see aof_format.go), so replicas read them with AOFReader:
+// - A replica connects with the replication ID and the offset it has applied,
+//   i.e. the AOF sequence number of the last command it received
+// - If the ID matches and the backlog still holds every command after that
+//   offset, the stream resumes right there (partial resync)
+// - Otherwise the primary sends a full resync: a snapshot of the live
+//   dataset, copied under the cache read lock at a known offset and encoded
+//   like a snapshot file, followed by the commands logged after that offset.
+//   Commands logged while the snapshot is transferred are buffered for the
+//   replica, so a slow transfer doesn't depend on the backlog
+// - Replicas acknowledge the offset they applied (AckReplica), which the
+//   primary reports per replica in ReplicationStats
+//
+// The replication ID changes on every start and whenever the dataset is
+// replaced as a whole (RestoreSnapshot), because the sequence numbers then no
+// longer describe the same history; replicas fully resync after either.
+//
+// The backlog is a bounded buffer of the most recent commands, only kept once
+// a replica has connected. A replica that falls further behind than the
+// backlog, or whose full resync buffer exceeds replicaSyncBufferLimit, is
+// disconnected and resyncs when it reconnects.
+
+// Replication defaults.
+const (
+	DefaultReplicationBacklogSize = 1 << 20 // Bytes of recent commands kept for partial resyncs
+
+	replicaTimeout         = 60 * time.Second // Disconnect online replicas that haven't acknowledged for this long
+	replicaCheckInterval   = 1 * time.Second  // How often idle streams check the replica timeout
+	replicaSyncBufferLimit = 64 << 20         // Bytes of commands buffered for a replica during a full resync
+	snapshotChunkSize      = 64 * 1024        // Size of the chunks a full resync snapshot is sent in
+)
+
+// Replication errors.
+var (
+	ErrReplicaTooSlow      = errors.New("replica fell too far behind the primary")
+	ErrReplicaTimeout      = errors.New("replica stopped acknowledging")
+	ErrReplicaDisconnected = errors.New("replica disconnected by the primary")
+	ErrReplicaNotFound     = errors.New("replica is not connected")
+)
+
+// replicationSource keeps the backlog and the replicas connected to a primary.
+type replicationSource struct {
+	mu       sync.Mutex
+	id       string                  // Replication ID of the current history
+	seq      uint64                  // Sequence number of the last command logged
+	active   atomic.Bool             // Commands are kept in the backlog (a replica has connected)
+	backlog  []AOFCommand            // Most recent commands, in sequence order without gaps
+	first    uint64                  // Sequence number of backlog[0]
+	size     int64                   // Approximate size of the backlog in bytes
+	limit    int64                   // Maximum size of the backlog in bytes
+	notify   chan struct{}           // Closed (and replaced) when commands are added
+	replicas map[string]*replicaLink // Connected replicas by replica ID
+}
+
+// replicaLink is a replica connected to the primary.
+type replicaLink struct {
+	id        string
+	addr      string        // Remote address of the connection
+	state     string        // "sync" while the full resync is sent, then "online"
+	connected time.Time     // When the replica connected
+	ackOffset uint64        // Last offset acknowledged by the replica
+	ackTime   time.Time     // When the replica last acknowledged (or went online)
+	done      chan struct{} // Closed to disconnect the replica
+	err       error         // Why the replica was disconnected by the primary
+
+	pending     []AOFCommand // Commands logged during the full resync, sent after the snapshot
+	pendingSize int64        // Approximate size of pending in bytes
+}
+
+// ReplicaInfo describes a replica connected to the primary.
+type ReplicaInfo struct {
+	ID        string    // Replica ID chosen by the replica
+	Addr      string    // Remote address of the replication connection
+	State     string    // "sync" while receiving a full resync, then "online"
+	Connected time.Time // When the replica connected
+	AckOffset uint64    // Last offset acknowledged by the replica
+	AckTime   time.Time // When the replica last acknowledged
+	Lag       uint64    // Commands logged by the primary but not acknowledged yet
+	LagBytes  int64     // Approximate size of the unacknowledged commands still in the backlog
+	Buffered  int       // Commands buffered while the full resync is sent
+}
+
+// ReplicationStats describes the replication state of a primary.
+type ReplicationStats struct {
+	ID              string        // Replication ID
+	Offset          uint64        // Sequence number of the last command logged
+	BacklogActive   bool          // Whether the backlog is kept
+	BacklogSize     int64         // Approximate size of the backlog in bytes
+	BacklogFirst    uint64        // Oldest offset a replica can resume from
+	BacklogCommands int           // Commands in the backlog
+	Replicas        []ReplicaInfo // Connected replicas, by connection time
+}
+
+// newReplicationSource creates a replication source with a new replication
+// ID and a backlog of at most limit bytes.
+func newReplicationSource(limit int64) *replicationSource {
+	return &replicationSource{
+		id:       newReplicationID(),
+		limit:    limit,
+		notify:   make(chan struct{}),
+		replicas: make(map[string]*replicaLink),
+	}
+}
+
+// newReplicationID returns a random 40 character hex ID.
+func newReplicationID() string {
+	var b [20]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// feed adds a logged command to the backlog and wakes up the replica streams.
+// It is called by the AOF for every command, with the AOF lock held.
+func (rs *replicationSource) feed(cmd AOFCommand) {
+	if !rs.active.Load() {
+		return // No replica ever connected; NewReplicationStream reads the AOF sequence number
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.seq = cmd.Seq
+	if len(rs.backlog) == 0 {
+		rs.first = cmd.Seq
+	}
+	rs.backlog = append(rs.backlog, cmd)
+	rs.size += backlogSize(cmd)
+
+	// Drop the oldest commands, always keeping the newest one
+	drop := 0
+	for rs.size > rs.limit && drop < len(rs.backlog)-1 {
+		rs.size -= backlogSize(rs.backlog[drop])
+		drop++
+	}
+	if drop > 0 {
+		clear(rs.backlog[:drop]) // Release the keys and values
+		rs.backlog = rs.backlog[drop:]
+		rs.first += uint64(drop)
+	}
+
+	// Replicas receiving a full resync get the command after the snapshot
+	for _, link := range rs.replicas {
+		if link.state != "sync" {
+			continue
+		}
+		link.pending = append(link.pending, cmd)
+		link.pendingSize += backlogSize(cmd)
+		if link.pendingSize > replicaSyncBufferLimit {
+			rs.disconnect(link, ErrReplicaTooSlow)
+		}
+	}
+
+	if len(rs.replicas) > 0 {
+		close(rs.notify)
+		rs.notify = make(chan struct{})
+	}
+}
+
+// backlogSize approximates the memory used by a command in the backlog.
+func backlogSize(cmd AOFCommand) int64 {
+	return int64(len(cmd.Key) + len(cmd.Value) + 64)
+}
+
+// reset starts a new history: the backlog is dropped, the replication ID
+// changes, and every replica is disconnected so it resyncs fully.
+// Must be called with the cache lock held, so no command is logged meanwhile.
+func (rs *replicationSource) reset() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.id = newReplicationID()
+	clear(rs.backlog)
+	rs.backlog = nil
+	rs.size = 0
+	for _, link := range rs.replicas {
+		rs.disconnect(link, ErrReplicaDisconnected)
+	}
+}
+
+// disconnect closes a replica's stream and unregisters it; err is returned
+// by its Serve. Must be called with rs.mu held.
+func (rs *replicationSource) disconnect(link *replicaLink, err error) {
+	link.err = err
+	link.pending = nil
+	close(link.done)
+	delete(rs.replicas, link.id)
+}
+
+// next returns the commands after offset for a replica stream, or, if there
+// are none yet, a channel that is closed once there are.
+func (rs *replicationSource) next(offset uint64) ([]AOFCommand, <-chan struct{}, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if offset == rs.seq {
+		return nil, rs.notify, nil
+	}
+	if len(rs.backlog) == 0 || offset+1 < rs.first {
+		return nil, nil, ErrReplicaTooSlow
+	}
+	return append([]AOFCommand(nil), rs.backlog[offset+1-rs.first:]...), nil, nil
+}
+
+// ReplicationStream is a connection of a replica to the primary, created by
+// NewReplicationStream and written by Serve.
+type ReplicationStream struct {
+	cache    *Cache
+	source   *replicationSource
+	link     *replicaLink
+	id       string    // Replication ID
+	offset   uint64    // Offset the stream starts after
+	full     bool      // Full resync: the snapshot is sent first
+	snapshot *Snapshot // Dataset copy of a full resync
+	start    time.Time
+}
+
+// NewReplicationStream registers a replica and decides how it resyncs. If
+// replID matches the current replication ID and the backlog holds every
+// command after offset, the stream continues after offset; otherwise the
+// live dataset is copied for a full resync, and the commands logged from now
+// on are buffered for the replica until the copy has been sent. A replica reconnecting with the
+// same replicaID replaces its previous connection.
+// Returns ErrPersistenceDisabled without an AOF, which feeds the streams.
+func (c *Cache) NewReplicationStream(replicaID, addr, replID string, offset uint64) (*ReplicationStream, error) {
+	if c.replication == nil {
+		return nil, ErrPersistenceDisabled
+	}
+	rs := c.replication
+
+	// The read locks keep writes (and so AOF commands) out until the stream
+	// is registered, so its offset matches the dataset copy exactly
+	c.rlockAll()
+	defer c.runlockAll()
+
+	seq := c.aof.currentSeq()
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.seq = seq
+	rs.active.Store(true)
+
+	stream := &ReplicationStream{cache: c, source: rs, id: rs.id, offset: offset, start: time.Now()}
+	canResume := replID == rs.id && offset <= seq &&
+		(offset == seq || (len(rs.backlog) > 0 && rs.first <= offset+1))
+	if !canResume {
+		stream.full = true
+		stream.offset = seq
+		snapshot := c.buildSnapshotLocked()
+		stream.snapshot = &snapshot
+	}
+
+	if old, ok := rs.replicas[replicaID]; ok {
+		rs.disconnect(old, ErrReplicaDisconnected)
+	}
+	stream.link = &replicaLink{
+		id:        replicaID,
+		addr:      addr,
+		state:     "sync",
+		connected: stream.start,
+		ackOffset: offset,
+		done:      make(chan struct{}),
+	}
+	if !stream.full {
+		stream.link.state = "online"
+		stream.link.ackTime = stream.start
+	}
+	rs.replicas[replicaID] = stream.link
+
+	return stream, nil
+}
+
+// ID returns the replication ID the stream belongs to.
+func (s *ReplicationStream) ID() string {
+	return s.id
+}
+
+// Offset returns the offset the stream starts after: the offset of the
+// dataset for a full resync, or the replica's offset for a partial one.
+func (s *ReplicationStream) Offset() uint64 {
+	return s.offset
+}
+
+// Full reports whether the stream starts with a full resync.
+func (s *ReplicationStream) Full() bool {
+	return s.full
+}
+
+// Serve writes the stream to w until ctx is done, the replica is disconnected
+// or times out, or a write fails. flush is called whenever buffered data has
+// been written, e.g. to flush an HTTP response. A full resync starts with the
+// snapshot (see sendSnapshot). Then the AOF header follows, and every command
+// logged after Offset: first those buffered during the full resync, then the
+// ones from the backlog.
+func (s *ReplicationStream) Serve(ctx context.Context, w io.Writer, flush func()) error {
+	defer s.Close()
+
+	bw := bufio.NewWriterSize(w, 64*1024)
+	if s.full {
+		if err := s.sendSnapshot(bw); err != nil {
+			return s.linkError(err)
+		}
+	}
+	if _, err := bw.WriteString(aofMagic); err != nil {
+		return err
+	}
+
+	sent := s.offset
+	if s.full {
+		var err error
+		if sent, err = s.sendPending(bw, flush); err != nil {
+			return err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	flush()
+
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		cmds, notify, err := s.source.next(sent)
+		if err != nil {
+			return err
+		}
+
+		if len(cmds) > 0 {
+			if err := writeCommands(bw, cmds); err != nil {
+				return err
+			}
+			flush()
+			sent = cmds[len(cmds)-1].Seq
+			continue
+		}
+
+		select {
+		case <-notify:
+		case <-ticker.C:
+			if s.timedOut() {
+				return ErrReplicaTimeout
+			}
+		case <-s.link.done:
+			return s.linkError(ErrReplicaDisconnected)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sendSnapshot writes the dataset copy of a full resync, encoded like a
+// snapshot file in the configured format and compression. The encoding is
+// split into length-prefixed chunks ending with an empty one (see
+// chunkWriter), so the replica knows where the snapshot ends and the AOF
+// records begin.
+func (s *ReplicationStream) sendSnapshot(w io.Writer) error {
+	sealSnapshot(s.snapshot)
+
+	chunks := &chunkWriter{w: w, done: s.link.done}
+	bw := bufio.NewWriterSize(chunks, snapshotChunkSize)
+	if _, err := s.cache.writeSnapshotData(bw, s.snapshot); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	s.snapshot = nil
+	return chunks.Close()
+}
+
+// sendPending writes the commands buffered during the full resync until none
+// are left, then marks the replica online, so the following commands are read
+// from the backlog. Returns the offset of the last command written.
+func (s *ReplicationStream) sendPending(bw *bufio.Writer, flush func()) (uint64, error) {
+	sent := s.offset
+	for {
+		cmds, err := s.takePending()
+		if err != nil {
+			return sent, err
+		}
+		if len(cmds) == 0 {
+			return sent, nil
+		}
+		if err := writeCommands(bw, cmds); err != nil {
+			return sent, err
+		}
+		flush()
+		sent = cmds[len(cmds)-1].Seq
+	}
+}
+
+// takePending removes and returns the commands buffered for the replica. If
+// there are none, the replica is marked online, which stops the buffering.
+func (s *ReplicationStream) takePending() ([]AOFCommand, error) {
+	rs := s.source
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.replicas[s.link.id] != s.link {
+		return nil, s.link.err
+	}
+
+	cmds := s.link.pending
+	s.link.pending = nil
+	s.link.pendingSize = 0
+	if len(cmds) == 0 {
+		s.link.state = "online"
+		s.link.ackTime = time.Now()
+	}
+	return cmds, nil
+}
+
+// writeCommands writes commands to bw and flushes it.
+func writeCommands(bw *bufio.Writer, cmds []AOFCommand) error {
+	for _, cmd := range cmds {
+		if _, err := encodeCommand(bw, cmd); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// linkError returns why the replica was disconnected by the primary, if it
+// was, instead of err.
+func (s *ReplicationStream) linkError(err error) error {
+	s.source.mu.Lock()
+	defer s.source.mu.Unlock()
+
+	if s.link.err != nil {
+		return s.link.err
+	}
+	return err
+}
+
+// timedOut reports whether the replica hasn't acknowledged for replicaTimeout.
+func (s *ReplicationStream) timedOut() bool {
+	s.source.mu.Lock()
+	defer s.source.mu.Unlock()
+
+	return time.Since(s.link.ackTime) > replicaTimeout
+}
+
+// Close unregisters the replica, unless it has already reconnected.
+func (s *ReplicationStream) Close() {
+	rs := s.source
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.replicas[s.link.id] == s.link {
+		rs.disconnect(s.link, ErrReplicaDisconnected)
+	}
+}
+
+// AckReplica records the offset a replica has applied.
+// Returns ErrReplicaNotFound if the replica isn't connected.
+func (c *Cache) AckReplica(replicaID string, offset uint64) error {
+	if c.replication == nil {
+		return ErrReplicaNotFound
+	}
+	rs := c.replication
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	link, ok := rs.replicas[replicaID]
+	if !ok {
+		return ErrReplicaNotFound
+	}
+	link.ackOffset = offset
+	link.ackTime = time.Now()
+	return nil
+}
+
+// DisconnectReplicas closes every replica stream, e.g. at shutdown so the
+// HTTP server doesn't wait for them. Replicas reconnect on their own.
+func (c *Cache) DisconnectReplicas() {
+	if c.replication == nil {
+		return
+	}
+	rs := c.replication
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, link := range rs.replicas {
+		rs.disconnect(link, ErrReplicaDisconnected)
+	}
+}
+
+// GoodReplicas returns the number of online replicas that acknowledged
+// within maxLag, like the replicas counted by Redis min-replicas-to-write.
+func (c *Cache) GoodReplicas(maxLag time.Duration) int {
+	if c.replication == nil {
+		return 0
+	}
+	rs := c.replication
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	good := 0
+	for _, link := range rs.replicas {
+		if link.state == "online" && time.Since(link.ackTime) <= maxLag {
+			good++
+		}
+	}
+	return good
+}
+
+// ResetReplicationID starts a new replication history, as when the dataset
+// is replaced: the replication ID changes and connected replicas are
+// disconnected, so they fully resync. Used when a replica is promoted to
+// primary, since its offsets don't continue the old primary's.
+func (c *Cache) ResetReplicationID() {
+	if c.replication == nil {
+		return
+	}
+
+	c.lockAll()
+	defer c.unlockAll()
+	c.replication.reset()
+}
+
+// ReplicationStats returns the replication state of the cache as a primary.
+func (c *Cache) ReplicationStats() ReplicationStats {
+	if c.replication == nil {
+		return ReplicationStats{}
+	}
+	seq := c.aof.currentSeq()
+	rs := c.replication
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	stats := ReplicationStats{
+		ID:              rs.id,
+		Offset:          seq,
+		BacklogActive:   rs.active.Load(),
+		BacklogSize:     rs.size,
+		BacklogFirst:    rs.first,
+		BacklogCommands: len(rs.backlog),
+	}
+	for _, link := range rs.replicas {
+		info := ReplicaInfo{
+			ID:        link.id,
+			Addr:      link.addr,
+			State:     link.state,
+			Connected: link.connected,
+			AckOffset: link.ackOffset,
+			AckTime:   link.ackTime,
+			Buffered:  len(link.pending),
+		}
+		if seq > link.ackOffset {
+			info.Lag = seq - link.ackOffset
+		}
+		for i := len(rs.backlog) - 1; i >= 0 && rs.backlog[i].Seq > link.ackOffset; i-- {
+			info.LagBytes += backlogSize(rs.backlog[i])
+		}
+		stats.Replicas = append(stats.Replicas, info)
+	}
+	sort.Slice(stats.Replicas, func(i, j int) bool {
+		return stats.Replicas[i].Connected.Before(stats.Replicas[j].Connected)
+	})
+	return stats
+}
+
+// chunkWriter splits a stream into chunks, each prefixed with its length as
+// a 4-byte big-endian integer, and ends it with an empty chunk on Close, so
+// the stream can be followed by other data. Writes fail once done is closed.
+type chunkWriter struct {
+	w    io.Writer
+	done <-chan struct{}
+}
+
+// Write implements io.Writer, writing p as a single chunk.
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	select {
+	case <-cw.done:
+		return 0, ErrReplicaDisconnected
+	default:
+	}
+	if len(p) == 0 {
+		return 0, nil // An empty chunk would end the stream
+	}
+
+	var head [4]byte
+	binary.BigEndian.PutUint32(head[:], uint32(len(p)))
+	if _, err := cw.w.Write(head[:]); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
+
+// Close writes the empty chunk ending the stream.
+func (cw *chunkWriter) Close() error {
+	_, err := cw.w.Write(make([]byte, 4))
+	return err
+}
+
+// chunkReader reads a stream written by chunkWriter and returns io.EOF at its
+// end, without reading anything after it.
+type chunkReader struct {
+	r    io.Reader
+	left uint32 // Bytes left in the current chunk
+	end  bool   // The empty chunk has been read
+}
+
+// Read implements io.Reader.
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for cr.left == 0 {
+		if cr.end {
+			return 0, io.EOF
+		}
+		var head [4]byte
+		if _, err := io.ReadFull(cr.r, head[:]); err != nil {
+			return 0, noEOF(err)
+		}
+		cr.left = binary.BigEndian.Uint32(head[:])
+		cr.end = cr.left == 0
+	}
+
+	if uint32(len(p)) > cr.left {
+		p = p[:cr.left]
+	}
+	n, err := cr.r.Read(p)
+	cr.left -= uint32(n)
+	return n, noEOF(err)
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF: the stream ended inside a chunk.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
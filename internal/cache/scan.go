@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"slices"
+	"strings"
+)
+
+// Scanning.
+//
+// Scan iterates over the keys without holding more than one shard lock at a
+// time, so it doesn't block the dataset like a snapshot does. Keys are
+// visited by shard, and within a shard in byte order; the cursor is the last
+// key returned, whose shard says where to resume. Like Redis SCAN, a key
+// that exists during the whole iteration is returned exactly once, while
+// keys set or deleted meanwhile may or may not be.
+//
+// Every call sorts the keys of the shard it resumes in that are after the
+// cursor, so a page costs time in the size of a shard rather than the page:
+// it is meant for tools and debugging, not for the request path.
+
+// Scan returns up to count keys starting with prefix (every key if empty)
+// that come after cursor (from the start if empty), and the cursor of the
+// next page, empty once every key was visited. Expired keys and those of the
+// internal namespace are skipped, and nothing counts as an access. A page may
+// hold fewer than count keys, or none, before the last one.
+func (c *Cache) Scan(cursor, prefix string, count int) (keys []string, next string) {
+	count = max(count, 1)
+	start := 0
+	if cursor != "" {
+		start = c.shardIndex(cursor)
+	}
+	for i := start; i < len(c.shards); i++ {
+		if len(keys) == count {
+			return keys, keys[len(keys)-1]
+		}
+		after := ""
+		if i == start {
+			after = cursor
+		}
+		keys, next = c.shards[i].scan(keys, after, prefix, count-len(keys))
+		if next != "" {
+			return keys, next
+		}
+	}
+	return keys, ""
+}
+
+// scan appends to keys up to count (> 0) keys of the shard starting with
+// prefix that come after after, and returns the last key appended if some
+// keys of the shard remain, empty otherwise.
+func (s *shard) scan(keys []string, after, prefix string, count int) ([]string, string) {
+	s.mu.RLock()
+	var found []string
+	for key := range s.data {
+		if key > after && strings.HasPrefix(key, prefix) && !IsInternalKey(key) && !s.isExpired(key) {
+			found = append(found, key)
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.Sort(found)
+	if len(found) <= count {
+		return append(keys, found...), ""
+	}
+	keys = append(keys, found[:count]...)
+	return keys, keys[len(keys)-1]
+}
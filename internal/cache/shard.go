@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Sharding.
+//
+// The dataset is partitioned into a power-of-two number of shards by a hash
+// of the key. Every shard has its own maps, eviction state, expiration index,
+// memory count, and mutex, so operations on keys of different shards don't
+// wait for each other. An operation on one key only locks its shard, and
+// logs to the AOF while holding it, so the commands for a key are logged in
+// order. Operations on the whole dataset (snapshots, AOF rewrites, replay,
+// restores) lock every shard, in order, for a consistent copy.
+//
+// maxKeys and maxMemory are split evenly between the shards, and every
+// shard evicts from its own keys when it reaches its share. Eviction is then
+// only approximately global, so small limits use fewer shards (see
+// defaultShardCount); with one shard it is exact.
+const (
+	shardsPerProc  = 4       // Default shards per GOMAXPROCS
+	minShardKeys   = 1024    // Smallest key limit share of a default shard
+	minShardMemory = 1 << 20 // Smallest memory limit share of a default shard, in bytes
+)
+
+// shard is a partition of the dataset. Its fields are protected by mu.
+type shard struct {
+	mu             sync.RWMutex
+	cache          *Cache               // Settings and counters shared by the shards
+	data           map[string][]byte    // Main storage: key -> value mapping (never modified in place, see GetBytes)
+	expires        map[string]time.Time // Expiration tracking: key -> expiration time (keys with a TTL only)
+	meta           map[string]keyMeta   // Modification time and version of each key, set by every write
+	lru            *lruList             // LRU tracking: keys ordered by last access (all policies but random)
+	randomKeys     *keySet              // Keys to pick from for random eviction (random policy only)
+	ttlKeys        *expiryIndex         // Keys with a TTL by expiration time (for Cleanup and volatile-ttl)
+	usedMemory     int64                // Estimated memory of the shard in bytes (see entrySize)
+	internalKeys   int                  // Keys of the internal namespace (see internal.go)
+	internalMemory int64                // Share of usedMemory of the internal namespace
+	accesses       accessBuffer         // Reads not applied to lru yet
+	maxKeys        int                  // Share of maxKeys (0 = unlimited)
+	maxMemory      int64                // Share of maxMemory in bytes (0 = unlimited)
+	evictLog       *[]AOFCommand        // DEL records of evicted keys held for a batch (nil = log each eviction)
+}
+
+// initShards creates the shards and splits the limits between them.
+func (c *Cache) initShards() {
+	n := c.numShards
+	if n == 0 {
+		n = defaultShardCount(c.MaxKeys(), c.MaxMemory())
+	}
+	c.shards = make([]*shard, n)
+	c.shardMask = uint64(n - 1)
+	for i := range c.shards {
+		s := &shard{
+			cache:     c,
+			maxKeys:   splitLimit(c.MaxKeys(), n, i),
+			maxMemory: splitLimit(c.MaxMemory(), n, i),
+		}
+		s.reset()
+		c.shards[i] = s
+	}
+}
+
+// defaultShardCount returns shardsPerProc shards per GOMAXPROCS, rounded up
+// to a power of two, or fewer if a shard's share of the limits would be
+// smaller than minShardKeys or minShardMemory.
+func defaultShardCount(maxKeys int, maxMemory int64) int {
+	n := 1
+	for n < runtime.GOMAXPROCS(0)*shardsPerProc {
+		n <<= 1
+	}
+	for n > 1 && (maxKeys > 0 && maxKeys/n < minShardKeys || maxMemory > 0 && maxMemory/int64(n) < minShardMemory) {
+		n >>= 1
+	}
+	return n
+}
+
+// splitLimit returns shard i's share of limit split between n shards. The
+// shares add up to limit, except that every share of a limit is at least 1,
+// since a share of 0 would leave the shard unlimited: a limit below the
+// shard count allows one key (or byte) per shard. A limit of 0 (unlimited)
+// stays 0.
+func splitLimit[T int | int64](limit T, n, i int) T {
+	share := limit / T(n)
+	if T(i) < limit%T(n) {
+		share++
+	}
+	if limit > 0 {
+		share = max(share, 1)
+	}
+	return share
+}
+
+// reset removes all keys of the shard (must be called with lock held).
+func (s *shard) reset() {
+	s.data = make(map[string][]byte)
+	s.expires = make(map[string]time.Time)
+	s.meta = make(map[string]keyMeta)
+	s.ttlKeys = newExpiryIndex()
+	s.usedMemory = 0
+	s.internalKeys, s.internalMemory = 0, 0
+	s.resetEviction()
+	s.drainAccessesLocked() // Nothing left to touch: just empties the buffer
+}
+
+// shardFor returns the shard of key.
+func (c *Cache) shardFor(key string) *shard {
+	return c.shards[c.shardIndex(key)]
+}
+
+// shardIndex returns the index of the shard of key, by its FNV-1a hash.
+func (c *Cache) shardIndex(key string) int {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return int(h & c.shardMask)
+}
+
+// lockAll locks every shard for writing, in order.
+func (c *Cache) lockAll() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+	}
+}
+
+// unlockAll unlocks the shards locked by lockAll.
+func (c *Cache) unlockAll() {
+	for _, s := range c.shards {
+		s.mu.Unlock()
+	}
+}
+
+// rlockAll locks every shard for reading, in order.
+func (c *Cache) rlockAll() {
+	for _, s := range c.shards {
+		s.mu.RLock()
+	}
+}
+
+// runlockAll unlocks the shards locked by rlockAll.
+func (c *Cache) runlockAll() {
+	for _, s := range c.shards {
+		s.mu.RUnlock()
+	}
+}
+
+// addKey records key for the eviction policy of its shard with the last
+// access time t (must be called with the shard locked).
+func (c *Cache) addKey(key string, t time.Time) {
+	c.shardFor(key).addKey(key, t)
+}
+
+// sortByAccessLocked sorts the LRU list of every shard after loading (must
+// be called with all shards locked).
+func (c *Cache) sortByAccessLocked() {
+	for _, s := range c.shards {
+		s.lru.sortByAccess()
+	}
+}
+
+// keyCountLocked returns the number of keys in all shards, including expired keys
+// not removed yet (must be called with all shards locked).
+func (c *Cache) keyCountLocked() int {
+	n := 0
+	for _, s := range c.shards {
+		n += len(s.data)
+	}
+	return n
+}
@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestShardCount checks the shard count option and the default count.
+func TestShardCount(t *testing.T) {
+	for _, n := range []int{-1, 3, 6} {
+		if _, err := NewCache("", "", 0, WithShards(n)); err == nil {
+			t.Errorf("NewCache with %d shards succeeded", n)
+		}
+	}
+
+	n := defaultShardCount(0, 0)
+	if n&(n-1) != 0 || n < runtime.GOMAXPROCS(0)*shardsPerProc || n >= 2*runtime.GOMAXPROCS(0)*shardsPerProc {
+		t.Errorf("defaultShardCount(0, 0) = %d with GOMAXPROCS %d", n, runtime.GOMAXPROCS(0))
+	}
+	if got := defaultShardCount(minShardKeys, 0); got != 1 {
+		t.Errorf("defaultShardCount(%d, 0) = %d, want 1", minShardKeys, got)
+	}
+	if got := defaultShardCount(0, minShardMemory); got != 1 {
+		t.Errorf("defaultShardCount(0, %d) = %d, want 1", minShardMemory, got)
+	}
+
+	c, err := NewCache("", "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+	if len(c.shards) != n {
+		t.Errorf("%d shards by default, want %d", len(c.shards), n)
+	}
+}
+
+// TestShardedCache checks that the operations on single keys and on the
+// whole dataset see every shard.
+func TestShardedCache(t *testing.T) {
+	const keys = 10_000
+	c, err := NewCache("", "", 0, WithShards(16))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	for i := range keys {
+		if err := c.Set("key"+strconv.Itoa(i), strconv.Itoa(i), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, s := range c.shards {
+		if len(s.data) == 0 {
+			t.Errorf("shard %d has no keys", i)
+		}
+	}
+	if n := c.Stats().Keys; n != keys {
+		t.Errorf("Stats().Keys = %d, want %d", n, keys)
+	}
+
+	seen := map[string]bool{}
+	for cursor := ""; ; {
+		var page []string
+		page, cursor = c.Scan(cursor, "", 1000)
+		for _, key := range page {
+			if seen[key] {
+				t.Fatalf("Scan returned %s twice", key)
+			}
+			seen[key] = true
+		}
+		if cursor == "" {
+			break
+		}
+	}
+	if len(seen) != keys {
+		t.Errorf("Scan returned %d keys, want %d", len(seen), keys)
+	}
+
+	for i := range keys {
+		key := "key" + strconv.Itoa(i)
+		if v, ok := c.Get(key); !ok || v != strconv.Itoa(i) {
+			t.Fatalf("Get(%s) = %q, %v", key, v, ok)
+		}
+		if i%2 == 0 && !c.Del(key) {
+			t.Fatalf("Del(%s) = false", key)
+		}
+	}
+	if n := c.Stats().Keys; n != keys/2 {
+		t.Errorf("Stats().Keys = %d after deleting half, want %d", n, keys/2)
+	}
+}
+
+// TestShardedAOFOrder writes every key many times from concurrent
+// goroutines, and checks that the AOF logs the writes of each key in order.
+func TestShardedAOFOrder(t *testing.T) {
+	const (
+		writers = 8
+		keys    = 50
+		writes  = 20
+	)
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot")
+	c, err := NewCache(aofPath, snapshotPath, 0, WithShards(16))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Go(func() {
+			for i := range writes {
+				for k := range keys {
+					key := fmt.Sprintf("w%d-k%d", w, k)
+					if err := c.Set(key, strconv.Itoa(i), 0); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		})
+	}
+	wg.Wait()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	last := map[string]int{}
+	for _, cmd := range readAOFCommands(t, aofPath) {
+		i, _ := strconv.Atoi(cmd.Value)
+		if prev, ok := last[cmd.Key]; ok && i != prev+1 {
+			t.Fatalf("AOF logs %s = %d after %d", cmd.Key, i, prev)
+		}
+		last[cmd.Key] = i
+	}
+	if len(last) != writers*keys {
+		t.Errorf("AOF logs %d keys, want %d", len(last), writers*keys)
+	}
+
+	c, err = NewCache(aofPath, snapshotPath, 0, WithShards(4))
+	if err != nil {
+		t.Fatalf("NewCache after restart: %v", err)
+	}
+	defer c.Close()
+	for key := range last {
+		if v, ok := c.Get(key); !ok || v != strconv.Itoa(writes-1) {
+			t.Errorf("%s = %q after replay, want %d", key, v, writes-1)
+		}
+	}
+}
+
+// BenchmarkShardedMixed runs 8 writers and 8 readers on 100k keys, with a
+// single shard (one lock for all) and with the default count.
+func BenchmarkShardedMixed(b *testing.B) {
+	const keys = 100_000
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = "key" + strconv.Itoa(i)
+	}
+	for _, shards := range []int{1, 0} {
+		name := "default shards"
+		if shards == 1 {
+			name = "1 shard"
+		}
+		b.Run(name, func(b *testing.B) {
+			c, err := NewCache("", "", 0, WithShards(shards))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			for _, key := range names {
+				if err := c.Set(key, "value", 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for g := range 16 {
+				wg.Go(func() {
+					for i := g; i < b.N; i += 16 {
+						key := names[i*7919%keys]
+						if g < 8 {
+							c.Set(key, "value", 0)
+						} else {
+							c.Get(key)
+						}
+					}
+				})
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -1,63 +1,96 @@
 package cache
 
 import (
-	"bufio"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // SnapshotEntry represents a single key-value pair with expiration info in a snapshot.
 type SnapshotEntry struct {
-	Key       string    `json:"key"`
-	Value     string    `json:"value"`
-	ExpiresAt time.Time `json:"expires_at"` // Zero time means no expiration
+	Key         string    `json:"key"`
+	Value       string    `json:"value"`
+	ExpiresAt   time.Time `json:"expires_at"`             // Zero time means no expiration
+	LastAccess  time.Time `json:"last_access,omitzero"`   // Last access for LRU (2.0; zero = unknown)
+	Checksum    uint32    `json:"checksum,omitempty"`     // CRC32 of the entry (2.0, see snapshotEntryCRC)
+	ContentType string    `json:"content_type,omitempty"` // Content type of the value (2.1; empty = none)
 }
 
-// Snapshot represents the full cache state saved to disk.
-type Snapshot struct {
-	Version   string          `json:"version"`   // Snapshot format version
-	Timestamp time.Time       `json:"timestamp"` // When snapshot was created
-	Entries   []SnapshotEntry `json:"entries"`   // All key-value pairs
+// snapshotEntryJSON is the JSON encoding of a SnapshotEntry. JSON strings
+// can only hold valid UTF-8, so a value that isn't is stored base64-encoded
+// in value_base64 instead, with an empty value.
+type snapshotEntryJSON struct {
+	Key         string    `json:"key"`
+	Value       string    `json:"value"`
+	ValueBase64 []byte    `json:"value_base64,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	LastAccess  time.Time `json:"last_access,omitzero"`
+	Checksum    uint32    `json:"checksum,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
 }
 
-// SaveSnapshot saves the current cache state to disk as a snapshot.
-// This creates a point-in-time backup of all data.
-func (c *Cache) SaveSnapshot(snapshotPath string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	// Create snapshot structure
-	snapshot := Snapshot{
-		Version:   "1.0",
-		Timestamp: time.Now(),
-		Entries:   make([]SnapshotEntry, 0, len(c.data)),
+// MarshalJSON encodes the entry, base64-encoding a value that isn't valid UTF-8.
+func (e SnapshotEntry) MarshalJSON() ([]byte, error) {
+	j := snapshotEntryJSON{
+		Key:         e.Key,
+		Value:       e.Value,
+		ExpiresAt:   e.ExpiresAt,
+		LastAccess:  e.LastAccess,
+		Checksum:    e.Checksum,
+		ContentType: e.ContentType,
+	}
+	if !utf8.ValidString(e.Value) {
+		j.Value, j.ValueBase64 = "", []byte(e.Value)
 	}
+	return json.Marshal(j)
+}
 
-	// Copy all non-expired entries to snapshot
-	now := time.Now()
-	for key, value := range c.data {
-		expiresAt, hasExpiry := c.expires[key]
-		
-		// Skip expired keys
-		if hasExpiry && !expiresAt.IsZero() && now.After(expiresAt) {
-			continue
-		}
+// UnmarshalJSON decodes an entry encoded by MarshalJSON.
+func (e *SnapshotEntry) UnmarshalJSON(data []byte) error {
+	var j snapshotEntryJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*e = SnapshotEntry{
+		Key:         j.Key,
+		Value:       j.Value,
+		ExpiresAt:   j.ExpiresAt,
+		LastAccess:  j.LastAccess,
+		Checksum:    j.Checksum,
+		ContentType: j.ContentType,
+	}
+	if j.ValueBase64 != nil {
+		e.Value = string(j.ValueBase64)
+	}
+	return nil
+}
 
-		entry := SnapshotEntry{
-			Key:   key,
-			Value: value,
-		}
+// Snapshot represents the full cache state saved to disk.
+type Snapshot struct {
+	Version   string          `json:"version"`            // Snapshot format version
+	Timestamp time.Time       `json:"timestamp"`          // When snapshot was created
+	Entries   []SnapshotEntry `json:"entries"`            // All key-value pairs
+	Checksum  string          `json:"checksum,omitempty"` // Hex SHA-256 of the entries (empty in older files)
 
-		// Include expiration time if it exists
-		if hasExpiry && !expiresAt.IsZero() {
-			entry.ExpiresAt = expiresAt
-		}
+	Upgraded bool `json:"-"` // Loaded from an older version and converted in memory
+}
 
-		snapshot.Entries = append(snapshot.Entries, entry)
-	}
+// SaveSnapshot saves the current cache state to disk as a snapshot.
+// This creates a point-in-time backup of all data.
+// The cache lock is only held while the entries are copied; encoding and
+// writing the file happen without it, so reads and writes are not blocked by
+// disk I/O. Writes that land during the file write are simply not included.
+func (c *Cache) SaveSnapshot(snapshotPath string) error {
+	start := time.Now()
+	snapshot, dirty := c.buildSnapshot()
+	sealSnapshot(&snapshot)
 
 	// Write snapshot to temporary file first (atomic write)
 	tmpPath := snapshotPath + ".tmp"
@@ -67,12 +100,10 @@ func (c *Cache) SaveSnapshot(snapshotPath string) error {
 	}
 	defer file.Close()
 
-	// Encode snapshot as JSON
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(snapshot); err != nil {
+	rawSize, err := c.writeSnapshotData(file, &snapshot)
+	if err != nil {
 		os.Remove(tmpPath) // Clean up on error
-		return fmt.Errorf("failed to encode snapshot: %w", err)
+		return err
 	}
 
 	// Sync to ensure data is written to disk
@@ -81,22 +112,180 @@ func (c *Cache) SaveSnapshot(snapshotPath string) error {
 		return fmt.Errorf("failed to sync snapshot: %w", err)
 	}
 
+	info, err := file.Stat()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to stat snapshot file: %w", err)
+	}
+
 	if err := file.Close(); err != nil {
 		os.Remove(tmpPath)
 		return fmt.Errorf("failed to close snapshot file: %w", err)
 	}
 
+	// Keep the previous snapshot as an older generation
+	if c.snapshotKeep > 0 {
+		if err := rotateSnapshots(snapshotPath, c.snapshotKeep); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+
 	// Atomically replace old snapshot with new one
 	if err := os.Rename(tmpPath, snapshotPath); err != nil {
 		os.Remove(tmpPath)
 		return fmt.Errorf("failed to rename snapshot file: %w", err)
 	}
 
+	// Changes made while the file was written are not in the snapshot and stay counted
+	c.dirty.Add(-dirty)
+
+	c.snapshotMu.Lock()
+	c.lastSave = snapshot.Timestamp
+	c.lastSnapshot = SnapshotStats{
+		Time:       snapshot.Timestamp,
+		Duration:   time.Since(start),
+		Entries:    len(snapshot.Entries),
+		DiskSize:   info.Size(),
+		RawSize:    rawSize,
+		Format:     c.snapshotFormat,
+		Compressed: c.snapshotGzip,
+	}
+	c.snapshotMu.Unlock()
+
 	return nil
 }
 
+// writeSnapshotData encodes snapshot to w in the configured format and
+// compression. Returns the size of the uncompressed data.
+func (c *Cache) writeSnapshotData(w io.Writer, snapshot *Snapshot) (int64, error) {
+	// Optionally compress the snapshot with gzip
+	var gz *gzip.Writer
+	if c.snapshotGzip {
+		var err error
+		gz, err = gzip.NewWriterLevel(w, c.snapshotGzipLevel)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create gzip writer: %w", err)
+		}
+		w = gz
+	}
+
+	// Encode snapshot in the configured format, counting the uncompressed size
+	raw := &countingWriter{w: w}
+	if err := encodeSnapshot(raw, snapshot, c.snapshotFormat); err != nil {
+		return raw.n, fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return raw.n, fmt.Errorf("failed to compress snapshot: %w", err)
+		}
+	}
+
+	return raw.n, nil
+}
+
+// SnapshotStats describes the last snapshot saved by this process.
+type SnapshotStats struct {
+	Time       time.Time      // Point in time captured by the snapshot (zero if none saved yet)
+	Duration   time.Duration  // How long saving took
+	Entries    int            // Number of entries written
+	DiskSize   int64          // Size of the snapshot file on disk
+	RawSize    int64          // Size of the uncompressed snapshot data
+	Format     SnapshotFormat // Encoding of the snapshot
+	Compressed bool           // Whether the file is gzip-compressed
+}
+
+// SnapshotStats returns statistics about the last snapshot saved.
+func (c *Cache) SnapshotStats() SnapshotStats {
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+	return c.lastSnapshot
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write implements io.Writer.
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// ChangesSinceSave returns the number of changes (sets, deletes, and
+// evictions) since the last successful snapshot.
+func (c *Cache) ChangesSinceSave() int64 {
+	return c.dirty.Load()
+}
+
+// LastSave returns when the last successful snapshot was taken, or when the
+// cache was created if no snapshot has been saved since.
+func (c *Cache) LastSave() time.Time {
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+	return c.lastSave
+}
+
+// buildSnapshot copies all non-expired entries into a Snapshot under read
+// locks on all shards, after draining their read buffers. It also returns
+// the change counter at that moment.
+func (c *Cache) buildSnapshot() (Snapshot, int64) {
+	c.drainAccesses()
+	c.rlockAll()
+	defer c.runlockAll()
+
+	return c.buildSnapshotLocked(), c.dirty.Load()
+}
+
+// buildSnapshotLocked copies all non-expired entries into a Snapshot (must be
+// called with all shards locked).
+func (c *Cache) buildSnapshotLocked() Snapshot {
+	// Create snapshot structure
+	now := c.now()
+	snapshot := Snapshot{
+		Version:   snapshotVersion,
+		Timestamp: now,
+		Entries:   make([]SnapshotEntry, 0, c.keyCountLocked()),
+	}
+
+	// Copy all non-expired entries to snapshot
+	for _, s := range c.shards {
+		for key, value := range s.data {
+			expiresAt, hasExpiry := s.expires[key]
+
+			// Skip expired keys
+			if hasExpiry && now.After(expiresAt) {
+				continue
+			}
+
+			entry := SnapshotEntry{
+				Key:         key,
+				Value:       valueString(value),
+				LastAccess:  s.lru.lastAccess(key),
+				ContentType: s.meta[key].contentTypeString(),
+			}
+
+			// Include expiration time if it exists
+			if hasExpiry && !expiresAt.IsZero() {
+				entry.ExpiresAt = expiresAt
+			}
+
+			snapshot.Entries = append(snapshot.Entries, entry)
+		}
+	}
+
+	return snapshot
+}
+
 // LoadSnapshot loads a snapshot from disk and restores the cache state.
 // Returns true if snapshot was loaded, false if snapshot doesn't exist.
+// A snapshot that is empty, can't be decoded, has an unknown version, or fails
+// its checksum is ignored with a warning, unless strict loading is enabled
+// (WithStrictSnapshotLoad); then a *SnapshotCorruptionError is returned.
 func (c *Cache) LoadSnapshot(snapshotPath string) (bool, error) {
 	// Check if snapshot file exists
 	if _, err := os.Stat(snapshotPath); os.IsNotExist(err) {
@@ -108,7 +297,7 @@ func (c *Cache) LoadSnapshot(snapshotPath string) (bool, error) {
 	if err != nil {
 		return false, fmt.Errorf("failed to stat snapshot file: %w", err)
 	}
-	if fileInfo.Size() == 0 {
+	if fileInfo.Size() == 0 && !c.strictSnapshotLoad {
 		// Empty file, treat as no snapshot
 		return false, nil
 	}
@@ -121,114 +310,213 @@ func (c *Cache) LoadSnapshot(snapshotPath string) (bool, error) {
 	defer file.Close()
 
 	// Decode snapshot
-	var snapshot Snapshot
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&snapshot); err != nil {
+	snapshot, err := readSnapshot(snapshotPath, file)
+	if err != nil {
+		if c.strictSnapshotLoad {
+			return false, err
+		}
 		// If file is empty or corrupted, treat as no snapshot (don't fail startup)
 		// This can happen if a previous snapshot write was interrupted
+		slog.Warn("Ignoring snapshot", "err", err)
 		return false, nil
 	}
 
-	// Restore cache state (without logging to AOF)
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.restoreSnapshot(&snapshot)
+	if snapshot.Upgraded {
+		c.dirty.Add(1) // Make sure the next save writes the current version
+	}
+	return true, nil
+}
 
-	// Clear existing data
-	c.data = make(map[string]string)
-	c.expires = make(map[string]time.Time)
-	c.lastAccess = make(map[string]time.Time)
+// LoadSnapshotFrom replaces the cache contents with the snapshot at path,
+// e.g. an older generation kept by snapshot rotation. Unlike LoadSnapshot,
+// it fails if the file is missing or can't be decoded. The restored keys
+// count as changes, so the next snapshot saves them.
+// Returns the number of keys restored.
+func (c *Cache) LoadSnapshotFrom(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer file.Close()
 
-	// Restore entries
-	now := time.Now()
-	for _, entry := range snapshot.Entries {
-		// Skip entries that are already expired
-		if !entry.ExpiresAt.IsZero() && now.After(entry.ExpiresAt) {
-			continue
-		}
+	snapshot, err := readSnapshot(path, file)
+	if err != nil {
+		return 0, err
+	}
 
-		c.data[entry.Key] = entry.Value
+	n, _ := c.restoreSnapshot(&snapshot)
+	c.dirty.Add(int64(max(n, 1)))
+	return n, nil
+}
 
-		if !entry.ExpiresAt.IsZero() {
-			c.expires[entry.Key] = entry.ExpiresAt
-		} else {
-			c.expires[entry.Key] = time.Time{} // No expiration
+// readSnapshot decodes and verifies a snapshot file in any format, compressed
+// or not, and upgrades it to the current version.
+// Malformed data is reported as a *SnapshotCorruptionError naming path.
+func readSnapshot(path string, file io.Reader) (Snapshot, error) {
+	snapshot, err := decodeSnapshotFile(file)
+	if err == nil {
+		version := snapshot.Version
+		err = upgradeSnapshot(&snapshot)
+		if err == nil && version != snapshot.Version {
+			snapshot.Upgraded = true
+			slog.Info("Upgraded snapshot; it is rewritten by the next save",
+				"path", path, "from", version, "to", snapshot.Version)
 		}
-
-		// Set last access time to current time (keys loaded from snapshot are considered recently accessed)
-		c.lastAccess[entry.Key] = now
 	}
 
-	return true, nil
+	var corruptErr *SnapshotCorruptionError
+	if errors.As(err, &corruptErr) {
+		corruptErr.Path = path
+	}
+	return snapshot, err
 }
 
-// ClearAOF truncates the AOF file to zero length.
-// This is called after creating a snapshot to prevent infinite growth.
-func (c *Cache) ClearAOF() error {
-	if c.aof == nil {
-		return nil
+// decodeSnapshotFile decompresses (if needed) and decodes a snapshot.
+func decodeSnapshotFile(file io.Reader) (Snapshot, error) {
+	r, gz, err := decompressSnapshot(file)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if gz != nil {
+		defer gz.Close()
 	}
 
-	c.aof.mu.Lock()
-	defer c.aof.mu.Unlock()
+	// Decode snapshot (JSON or binary, detected from the magic header)
+	return decodeSnapshot(r)
+}
 
-	// Flush any pending writes
-	if c.aof.writer != nil {
-		if err := c.aof.writer.Flush(); err != nil {
-			return fmt.Errorf("failed to flush AOF before clearing: %w", err)
-		}
-	}
+// restoreSnapshot replaces the cache contents with the snapshot entries
+// (without logging to AOF), skipping expired ones and those exceeding the
+// key length or value size limit.
+// Returns the number of keys restored and of entries skipped for the limits.
+func (c *Cache) restoreSnapshot(snapshot *Snapshot) (int, int) {
+	c.lockAll()
+	defer c.unlockAll()
+	return c.restoreSnapshotLocked(snapshot, true)
+}
 
-	// Close the current file
-	if c.aof.file != nil {
-		if err := c.aof.file.Close(); err != nil {
-			return fmt.Errorf("failed to close AOF before clearing: %w", err)
+// restoreSnapshotLocked is restoreSnapshot for callers holding all shard
+// locks; entries exceeding the limits are only skipped if enforceLimits is true.
+func (c *Cache) restoreSnapshotLocked(snapshot *Snapshot, enforceLimits bool) (int, int) {
+	// Clear existing data
+	c.resetLocked()
+
+	// Restore entries
+	now := c.now()
+	oversized := 0
+	for _, entry := range snapshot.Entries {
+		// Skip entries that are already expired
+		if !entry.ExpiresAt.IsZero() && now.After(entry.ExpiresAt) {
+			continue
+		}
+		if enforceLimits && !c.loadWithinLimits(entry.Key, len(entry.Value)) {
+			oversized++
+			continue
 		}
-	}
 
-	// Truncate the file to zero length and reopen in append mode
-	file, err := os.OpenFile(c.aof.filePath, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to truncate AOF file: %w", err)
-	}
-	file.Close() // Close the truncated file
+		s := c.shardFor(entry.Key)
+		s.putLocked(entry.Key, []byte(entry.Value), entry.ContentType)
 
-	// Reopen in append mode for future writes
-	file, err = os.OpenFile(c.aof.filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to reopen AOF file: %w", err)
+		s.setExpiryLocked(entry.Key, entry.ExpiresAt) // Zero time: no expiration
+
+		// Restore the last access time for LRU; keys from snapshots without
+		// one are considered recently accessed
+		if !entry.LastAccess.IsZero() {
+			s.addKey(entry.Key, entry.LastAccess)
+		} else {
+			s.addKey(entry.Key, now)
+		}
 	}
+	c.sortByAccessLocked()
 
-	// Recreate writer
-	c.aof.file = file
-	c.aof.writer = bufio.NewWriter(file)
+	return c.keyCountLocked(), oversized
+}
 
-	return nil
+// ClearAOF compacts the AOF file after a snapshot, to prevent infinite growth.
+//
+// The file used to be truncated, which lost every write that landed between
+// the snapshot's copy of the dataset and the truncation: such a write was
+// neither in the snapshot nor, after the truncation, in the AOF. Instead the
+// AOF is now replaced by a rewrite (see RewriteAOF), whose dataset copy and
+// command buffering start atomically under the cache lock, and the old file
+// is only replaced once the new one is complete.
+func (c *Cache) ClearAOF() error {
+	return c.RewriteAOF()
 }
 
-// CreateSnapshotAndClearAOF creates a snapshot and then clears the AOF file.
+// CreateSnapshotAndClearAOF creates a snapshot and then compacts the AOF file.
 // This is the main method to call for periodic snapshots.
-func (c *Cache) CreateSnapshotAndClearAOF(snapshotPath string) error {
+//
+// The AOF is not truncated but rewritten with a preamble holding the full
+// dataset (see RewriteAOF), so it stays self-contained: a crash between the
+// snapshot and the rewrite leaves the old, complete AOF in place, and replay
+// never applies old commands on top of a newer snapshot.
+//
+// No acknowledged write is lost at any point. Writes that land after the
+// snapshot's copy of the dataset stay in the old AOF until the rewrite takes
+// its own copy; from then on they go to both the old AOF and the rewrite
+// buffer, and the old AOF is only replaced by the complete new file.
+//
+// If nothing changed since the last successful snapshot, the disk is not
+// touched and false is returned. Without persistence, it returns
+// ErrPersistenceDisabled.
+func (c *Cache) CreateSnapshotAndClearAOF(snapshotPath string) (bool, error) {
+	if c.noPersistence {
+		return false, ErrPersistenceDisabled
+	}
+	if c.ChangesSinceSave() == 0 {
+		return false, nil
+	}
+
 	// Save snapshot
 	if err := c.SaveSnapshot(snapshotPath); err != nil {
-		return fmt.Errorf("failed to save snapshot: %w", err)
+		return false, fmt.Errorf("failed to save snapshot: %w", err)
 	}
 
-	// Clear AOF after successful snapshot
-	if err := c.ClearAOF(); err != nil {
-		return fmt.Errorf("failed to clear AOF after snapshot: %w", err)
+	// Compact AOF after successful snapshot (a running rewrite compacts it anyway)
+	if err := c.RewriteAOF(); err != nil && !errors.Is(err, ErrRewriteInProgress) {
+		return true, fmt.Errorf("failed to compact AOF after snapshot: %w", err)
 	}
 
-	return nil
+	return true, nil
+}
+
+// ErrPersistenceDisabled is returned when a snapshot is requested from a cache without persistence.
+var ErrPersistenceDisabled = errors.New("persistence is disabled")
+
+// ErrSnapshotInProgress is returned when a snapshot is requested while another one is running.
+var ErrSnapshotInProgress = errors.New("snapshot already in progress")
+
+// SnapshotSaveStatus describes the current and last snapshot run by a SnapshotManager.
+type SnapshotSaveStatus struct {
+	InProgress   bool          // Whether a snapshot is being saved
+	CurrentJob   uint64        // ID of the running save (0 if none)
+	LastJob      uint64        // ID of the last finished save (0 if none)
+	LastTrigger  string        // What started the last save, e.g. "scheduled" or "manual"
+	LastStatus   string        // "ok", "err", "skipped" (no changes), or "" if no save finished yet
+	LastError    string        // Error of the last save, if it failed
+	LastTime     time.Time     // When the last save finished
+	LastDuration time.Duration // How long the last save took
+	LastSuccess  time.Time     // When the last successful save finished
 }
 
-// SnapshotManager manages periodic snapshot creation.
+// SnapshotManager manages periodic snapshot creation, either at a fixed
+// interval or when save rules match (see SetSaveRules). Scheduled and manual
+// snapshots (BackgroundSave) share saveMu, so they never overlap.
 type SnapshotManager struct {
 	cache        *Cache
 	snapshotPath string
 	interval     time.Duration
 	mu           sync.Mutex
 	stopChan     chan struct{}
+	reschedule   chan struct{} // Wakes run after SetInterval or SetSaveRules
 	running      bool
+
+	rules   []SaveRule         // Save rules replacing the fixed interval (see SetSaveRules)
+	saveMu  sync.Mutex         // Held while a snapshot is being saved
+	nextJob uint64             // Last job ID handed out (protected by mu)
+	status  SnapshotSaveStatus // Current and last save (protected by mu)
 }
 
 // NewSnapshotManager creates a new snapshot manager.
@@ -238,9 +526,49 @@ func NewSnapshotManager(cache *Cache, snapshotPath string, interval time.Duratio
 		snapshotPath: snapshotPath,
 		interval:     interval,
 		stopChan:     make(chan struct{}),
+		reschedule:   make(chan struct{}, 1),
+	}
+}
+
+// Interval returns the time between snapshots without save rules.
+func (sm *SnapshotManager) Interval() time.Duration {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.interval
+}
+
+// SetInterval changes the time between snapshots without save rules. If
+// the manager is running, the next snapshot is taken interval from now.
+func (sm *SnapshotManager) SetInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid snapshot interval %v (must be > 0)", interval)
+	}
+	sm.mu.Lock()
+	sm.interval = interval
+	sm.mu.Unlock()
+	sm.wake()
+	return nil
+}
+
+// wake makes run pick up a new interval or new save rules.
+func (sm *SnapshotManager) wake() {
+	select {
+	case sm.reschedule <- struct{}{}:
+	default: // Already pending
 	}
 }
 
+// schedule returns how often run checks for a snapshot, and whether it
+// checks the save rules or saves every interval.
+func (sm *SnapshotManager) schedule() (time.Duration, bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if len(sm.rules) > 0 {
+		return saveRuleCheckInterval, true
+	}
+	return sm.interval, false
+}
+
 // Start begins periodic snapshot creation in a background goroutine.
 func (sm *SnapshotManager) Start() error {
 	sm.mu.Lock()
@@ -257,6 +585,7 @@ func (sm *SnapshotManager) Start() error {
 }
 
 // Stop stops the periodic snapshot creation.
+// A snapshot that is already being saved runs to completion.
 func (sm *SnapshotManager) Stop() {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
@@ -269,21 +598,132 @@ func (sm *SnapshotManager) Stop() {
 	sm.running = false
 }
 
+// BackgroundSave starts a snapshot (CreateSnapshotAndClearAOF) in a background
+// goroutine and returns its job ID. It returns ErrSnapshotInProgress if a
+// scheduled or manual snapshot is already running.
+func (sm *SnapshotManager) BackgroundSave() (uint64, error) {
+	if !sm.saveMu.TryLock() {
+		return 0, ErrSnapshotInProgress
+	}
+
+	job := sm.beginSave()
+	go func() {
+		defer sm.saveMu.Unlock()
+		sm.save(job, "manual")
+	}()
+
+	return job, nil
+}
+
+// Save creates a snapshot (CreateSnapshotAndClearAOF) and waits for it to
+// finish. If another snapshot is running, it waits for that one first, so the
+// snapshot always includes every write acknowledged before Save was called.
+// Like every snapshot, it is skipped if nothing changed since the last one.
+func (sm *SnapshotManager) Save(trigger string) error {
+	sm.saveMu.Lock()
+	defer sm.saveMu.Unlock()
+	return sm.save(sm.beginSave(), trigger)
+}
+
+// Status returns the state of the current and last snapshot.
+func (sm *SnapshotManager) Status() SnapshotSaveStatus {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.status
+}
+
 // run executes the periodic snapshot creation loop.
+// With save rules, it checks them every saveRuleCheckInterval instead of
+// saving at a fixed interval.
 func (sm *SnapshotManager) run() {
-	ticker := time.NewTicker(sm.interval)
+	interval, useRules := sm.schedule()
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
+		case <-sm.reschedule:
+			interval, useRules = sm.schedule()
+			ticker.Reset(interval)
 		case <-ticker.C:
-			if err := sm.cache.CreateSnapshotAndClearAOF(sm.snapshotPath); err != nil {
-				fmt.Printf("Error creating snapshot: %v\n", err)
-			} else {
-				fmt.Printf("Snapshot created successfully at %s\n", sm.snapshotPath)
+			if useRules {
+				rule, ok := sm.matchSaveRule()
+				if !ok {
+					continue
+				}
+				slog.Info("Save rule matched, saving snapshot",
+					"changes", sm.cache.ChangesSinceSave(), "interval", rule.Interval, "rule", rule.String())
+			}
+
+			// Skip this tick if a manual snapshot is running; it covers the same data
+			if !sm.saveMu.TryLock() {
+				if !useRules {
+					slog.Info("Snapshot already in progress, skipping scheduled snapshot")
+				}
+				continue
 			}
+			sm.save(sm.beginSave(), "scheduled")
+			sm.saveMu.Unlock()
 		case <-sm.stopChan:
 			return
 		}
 	}
 }
+
+// beginSave assigns a job ID and marks a save as in progress.
+// Must be called with saveMu held.
+func (sm *SnapshotManager) beginSave() uint64 {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.nextJob++
+	sm.status.InProgress = true
+	sm.status.CurrentJob = sm.nextJob
+	return sm.nextJob
+}
+
+// save creates the snapshot and records the result.
+// Must be called with saveMu held.
+func (sm *SnapshotManager) save(job uint64, trigger string) error {
+	start := time.Now()
+	saved, err := sm.cache.CreateSnapshotAndClearAOF(sm.snapshotPath)
+	switch {
+	case err != nil:
+		slog.Error("Snapshot failed", "err", err)
+	case !saved:
+		slog.Debug("Snapshot skipped (no changes)")
+	default:
+		slog.Info("Snapshot created", "path", sm.snapshotPath)
+	}
+
+	sm.mu.Lock()
+	sm.status.InProgress = false
+	sm.status.CurrentJob = 0
+	sm.status.LastJob = job
+	sm.status.LastTrigger = trigger
+	sm.status.LastTime = time.Now()
+	sm.status.LastDuration = time.Since(start)
+	switch {
+	case err != nil:
+		sm.status.LastStatus = "err"
+		sm.status.LastError = err.Error()
+	case !saved:
+		sm.status.LastStatus = "skipped"
+		sm.status.LastError = ""
+	default:
+		sm.status.LastStatus = "ok"
+		sm.status.LastError = ""
+		sm.status.LastSuccess = sm.status.LastTime
+	}
+	sm.mu.Unlock()
+
+	// Upload the new snapshot (still holding saveMu, so it isn't replaced meanwhile).
+	// A failed upload is only reported, the local snapshot is saved; it is
+	// retried with the next snapshot, even if that one is skipped.
+	if saved || sm.cache.SnapshotUploadStats().LastStatus == "err" {
+		if err := sm.cache.uploadSnapshot(sm.snapshotPath); err != nil {
+			slog.Error("Snapshot upload failed", "err", err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"io"
+	"time"
+)
+
+// Backup is a point-in-time copy of the dataset that can be written as a
+// snapshot file to any writer, e.g. an HTTP response.
+//
+// Like SaveSnapshot, the cache lock is only held while the entries are copied
+// by NewBackup, so writing a backup of a large cache doesn't block writes.
+// The encoding is streamed to the writer; only the entry copy is kept in memory.
+type Backup struct {
+	cache    *Cache
+	snapshot Snapshot
+}
+
+// NewBackup copies the current dataset into a Backup.
+// It doesn't touch the snapshot file or the count of unsaved changes.
+func (c *Cache) NewBackup() *Backup {
+	snapshot, _ := c.buildSnapshot()
+	sealSnapshot(&snapshot)
+	return &Backup{cache: c, snapshot: snapshot}
+}
+
+// Timestamp returns the point in time captured by the backup.
+func (b *Backup) Timestamp() time.Time {
+	return b.snapshot.Timestamp
+}
+
+// Entries returns the number of entries in the backup.
+func (b *Backup) Entries() int {
+	return len(b.snapshot.Entries)
+}
+
+// Checksum returns the hex-encoded SHA-256 of the entries, which identifies
+// the content of the backup independently of its format and compression.
+func (b *Backup) Checksum() string {
+	return b.snapshot.Checksum
+}
+
+// Format returns the encoding used by WriteTo (the configured snapshot format).
+func (b *Backup) Format() SnapshotFormat {
+	return b.cache.snapshotFormat
+}
+
+// Compressed reports whether WriteTo gzip-compresses the data.
+func (b *Backup) Compressed() bool {
+	return b.cache.snapshotGzip
+}
+
+// WriteTo writes the backup to w as a snapshot file, in the configured format
+// and compression, so it can be loaded or uploaded to /restore as is.
+// Returns the number of bytes written to w.
+func (b *Backup) WriteTo(w io.Writer) (int64, error) {
+	out := &countingWriter{w: w}
+	_, err := b.cache.writeSnapshotData(out, &b.snapshot)
+	return out.n, err
+}
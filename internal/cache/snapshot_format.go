@@ -0,0 +1,252 @@
+package cache
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Snapshot file formats.
+//
+// A snapshot is either a JSON document (the original format) or a binary file
+// starting with snapshotMagic. The binary format avoids the cost of JSON
+// encoding for large datasets of small keys:
+//
+//	magic    snapshotMagic
+//	header   uvarint version length, version, varint timestamp
+//	         (Unix nanoseconds), uvarint entry count
+//	entries  encoded as defined by the version (see snapshot_version.go);
+//	         in 1.0: uvarint key length, key, uvarint value length, value,
+//	         varint expiration time (Unix nanoseconds, 0 = no expiry)
+//	checksum 32-byte SHA-256 of the entries (see snapshotChecksum)
+//
+// JSON snapshots store the same checksum, hex-encoded, in the "checksum"
+// field. Files written before checksums were added have none and are loaded
+// without verification.
+//
+// Either format may be gzip-compressed as a whole (see WithSnapshotCompression).
+// LoadSnapshot detects compression and format from the leading bytes, so
+// files written with any combination can be loaded.
+
+// snapshotMagic is the header identifying a binary snapshot file.
+const snapshotMagic = "MRSNAP1\n"
+
+// maxSnapshotFieldSize bounds the length of a key, value, or version read
+// from a binary snapshot, so a corrupted length can't trigger a huge allocation.
+const maxSnapshotFieldSize = maxAOFRecordSize
+
+// SnapshotFormat selects the encoding of snapshot files.
+type SnapshotFormat int
+
+const (
+	SnapshotFormatJSON   SnapshotFormat = iota // Indented JSON document (default)
+	SnapshotFormatBinary                       // Length-prefixed binary records
+)
+
+// String returns the name of the format.
+func (f SnapshotFormat) String() string {
+	switch f {
+	case SnapshotFormatJSON:
+		return "json"
+	case SnapshotFormatBinary:
+		return "binary"
+	default:
+		return fmt.Sprintf("SnapshotFormat(%d)", int(f))
+	}
+}
+
+// encodeSnapshot writes snapshot to w in the given format.
+func encodeSnapshot(w io.Writer, snapshot *Snapshot, format SnapshotFormat) error {
+	switch format {
+	case SnapshotFormatJSON:
+		return writeJSONSnapshot(w, snapshot)
+	case SnapshotFormatBinary:
+		return writeBinarySnapshot(w, snapshot)
+	default:
+		return fmt.Errorf("unknown snapshot format %v", format)
+	}
+}
+
+// writeJSONSnapshot writes snapshot to w as an indented JSON document, the
+// same as json.Encoder with a two-space indent would, but one entry at a time
+// so the whole document is never held in memory.
+func writeJSONSnapshot(w io.Writer, snapshot *Snapshot) error {
+	bw := bufio.NewWriterSize(w, 64*1024)
+
+	version, err := json.Marshal(snapshot.Version)
+	if err != nil {
+		return err
+	}
+	timestamp, err := json.Marshal(snapshot.Timestamp)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(bw, "{\n  \"version\": %s,\n  \"timestamp\": %s,\n  \"entries\": [", version, timestamp)
+
+	for i := range snapshot.Entries {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		entry, err := json.MarshalIndent(&snapshot.Entries[i], "    ", "  ")
+		if err != nil {
+			return err
+		}
+		bw.WriteString("\n    ")
+		if _, err := bw.Write(entry); err != nil {
+			return err
+		}
+	}
+	if len(snapshot.Entries) > 0 {
+		bw.WriteString("\n  ")
+	}
+	bw.WriteByte(']')
+
+	if snapshot.Checksum != "" {
+		checksum, err := json.Marshal(snapshot.Checksum)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, ",\n  \"checksum\": %s", checksum)
+	}
+	bw.WriteString("\n}\n")
+
+	return bw.Flush()
+}
+
+// writeBinarySnapshot writes snapshot to w in the binary format.
+func writeBinarySnapshot(w io.Writer, snapshot *Snapshot) error {
+	bw := bufio.NewWriterSize(w, 64*1024)
+
+	buf := append(make([]byte, 0, 256), snapshotMagic...)
+	buf = appendBytes(buf, snapshot.Version)
+	buf = binary.AppendVarint(buf, snapshot.Timestamp.UnixNano())
+	buf = binary.AppendUvarint(buf, uint64(len(snapshot.Entries)))
+	if _, err := bw.Write(buf); err != nil {
+		return err
+	}
+
+	codec, err := snapshotCodec(snapshot.Version)
+	if err != nil {
+		return err
+	}
+	for _, entry := range snapshot.Entries {
+		buf = codec.appendEntry(buf[:0], entry)
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	if snapshot.Checksum != "" {
+		sum, err := hex.DecodeString(snapshot.Checksum)
+		if err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("invalid snapshot checksum %q", snapshot.Checksum)
+		}
+		if _, err := bw.Write(sum); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// SnapshotCorruptionError describes a snapshot file that can't be loaded.
+type SnapshotCorruptionError struct {
+	Path   string // Snapshot file path
+	Offset int64  // Byte offset in the (uncompressed) data where decoding failed, -1 if not applicable
+	Reason string // What is wrong with the file
+}
+
+// Error implements the error interface.
+func (e *SnapshotCorruptionError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("snapshot %s is corrupted: %s", e.Path, e.Reason)
+	}
+	return fmt.Sprintf("snapshot %s is corrupted at offset %d: %s", e.Path, e.Offset, e.Reason)
+}
+
+// corruptSnapshot returns a *SnapshotCorruptionError with a formatted reason.
+// The path is filled in by the caller that opened the file.
+func corruptSnapshot(offset int64, format string, args ...any) error {
+	return &SnapshotCorruptionError{Offset: offset, Reason: fmt.Sprintf(format, args...)}
+}
+
+// decodeSnapshot reads a snapshot from r, detecting the format from its first bytes.
+// The entries are returned as stored, in the snapshot's version, without
+// verification (see upgradeSnapshot).
+// Malformed data is reported as a *SnapshotCorruptionError.
+func decodeSnapshot(r io.Reader) (Snapshot, error) {
+	sr, err := newSnapshotReader(r)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	snapshot := Snapshot{Version: sr.version, Timestamp: sr.timestamp}
+	if sr.count >= 0 {
+		snapshot.Entries = make([]SnapshotEntry, 0, min(sr.count, 1<<20))
+	}
+	for {
+		entry, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return snapshot, err
+		}
+		snapshot.Entries = append(snapshot.Entries, entry)
+	}
+
+	snapshot.Checksum = sr.checksum
+	return snapshot, nil
+}
+
+// offsetReader counts the bytes consumed from a bufio.Reader, so errors can
+// report where in the file decoding failed.
+type offsetReader struct {
+	r   *bufio.Reader
+	off int64
+}
+
+// ReadByte implements io.ByteReader.
+func (o *offsetReader) ReadByte() (byte, error) {
+	b, err := o.r.ReadByte()
+	if err == nil {
+		o.off++
+	}
+	return b, err
+}
+
+// Read implements io.Reader.
+func (o *offsetReader) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	o.off += int64(n)
+	return n, err
+}
+
+// readSnapshotString reads a length-prefixed string from a binary snapshot.
+func readSnapshotString(r *offsetReader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", snapshotReadError(err)
+	}
+	if n > maxSnapshotFieldSize {
+		return "", fmt.Errorf("field length %d exceeds limit", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", snapshotReadError(err)
+	}
+	return string(buf), nil
+}
+
+// snapshotReadError reports an unexpected end of file as a truncated snapshot.
+func snapshotReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("snapshot is truncated")
+	}
+	return err
+}
@@ -0,0 +1,373 @@
+package cache
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"time"
+)
+
+// SnapshotReader reads a snapshot entry by entry, so large files can be
+// examined without holding every entry in memory. It reads both formats,
+// compressed or not, and is used for loading snapshots as well.
+//
+// Readers created with NewSnapshotReader verify every entry and the snapshot
+// checksum as they go, and return entries converted to the current version.
+type SnapshotReader struct {
+	input      *offsetReader
+	gz         *gzip.Reader
+	format     SnapshotFormat
+	compressed bool
+
+	version   string    // Version the snapshot was written in
+	timestamp time.Time // When the snapshot was taken
+	count     int64     // Entries announced by the binary header, -1 for JSON
+	read      int64     // Entries returned so far
+	checksum  string    // Checksum stored in the file (complete once Next returned io.EOF)
+	err       error     // Sticky error (io.EOF once all entries were read)
+
+	json      *json.Decoder // JSON format only
+	inEntries bool          // JSON decoder is positioned inside the entries array
+
+	codec  snapshotVersionCodec // Codec of version (binary format or verifying readers)
+	verify bool                 // Verify and upgrade entries (NewSnapshotReader)
+	hash   hash.Hash            // Running checksum of the entries (verifying readers)
+	buf    []byte
+}
+
+// NewSnapshotReader reads the snapshot header from r and returns a reader
+// positioned at the first entry. Malformed data and checksum mismatches are
+// reported as a *SnapshotCorruptionError.
+func NewSnapshotReader(r io.Reader) (*SnapshotReader, error) {
+	input, gz, err := decompressSnapshot(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sr, err := newSnapshotReader(input)
+	if err != nil {
+		if gz != nil {
+			gz.Close()
+		}
+		return nil, err
+	}
+	sr.gz, sr.compressed = gz, gz != nil
+	sr.verify = true
+	sr.hash = sha256.New()
+	return sr, nil
+}
+
+// decompressSnapshot detects gzip compression from the magic bytes and
+// returns a reader of the uncompressed data, so plain snapshots still load.
+// The gzip reader, if any, must be closed by the caller.
+func decompressSnapshot(r io.Reader) (io.Reader, *gzip.Reader, error) {
+	reader := bufio.NewReader(r)
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, nil, corruptSnapshot(0, "invalid gzip header: %v", err)
+		}
+		return gz, gz, nil
+	}
+	return reader, nil, nil
+}
+
+// newSnapshotReader reads the header of an uncompressed snapshot. The reader
+// returns entries as stored, without verifying them.
+func newSnapshotReader(r io.Reader) (*SnapshotReader, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	sr := &SnapshotReader{input: &offsetReader{r: br}, count: -1}
+
+	head, err := br.Peek(len(snapshotMagic))
+	if err != nil && err != io.EOF {
+		return nil, corruptSnapshot(0, "%v", err)
+	}
+	if len(head) == 0 {
+		return nil, corruptSnapshot(0, "file is empty")
+	}
+
+	if string(head) == snapshotMagic {
+		br.Discard(len(snapshotMagic))
+		sr.input.off = int64(len(snapshotMagic))
+		sr.format = SnapshotFormatBinary
+		if err := sr.readBinaryHeader(); err != nil {
+			return nil, err
+		}
+		return sr, nil
+	}
+
+	sr.format = SnapshotFormatJSON
+	sr.json = json.NewDecoder(sr.input)
+	if tok, err := sr.json.Token(); err != nil {
+		return nil, sr.jsonError(err)
+	} else if tok != json.Delim('{') {
+		return nil, corruptSnapshot(0, "expected a JSON object")
+	}
+	if err := sr.readJSONFields(); err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// Version returns the version the snapshot was written in.
+func (sr *SnapshotReader) Version() string {
+	return sr.version
+}
+
+// Timestamp returns the point in time captured by the snapshot.
+func (sr *SnapshotReader) Timestamp() time.Time {
+	return sr.timestamp
+}
+
+// Count returns the number of entries announced by the header of a binary
+// snapshot, or -1 for JSON snapshots, which don't store it.
+func (sr *SnapshotReader) Count() int64 {
+	return sr.count
+}
+
+// Format returns the encoding of the snapshot.
+func (sr *SnapshotReader) Format() SnapshotFormat {
+	return sr.format
+}
+
+// Compressed reports whether the snapshot is gzip-compressed.
+func (sr *SnapshotReader) Compressed() bool {
+	return sr.compressed
+}
+
+// Checksum returns the hex-encoded checksum stored in the snapshot, or ""
+// for snapshots written before checksums were added. It is only complete
+// once Next has returned io.EOF.
+func (sr *SnapshotReader) Checksum() string {
+	return sr.checksum
+}
+
+// Close releases the decompressor. It doesn't close the underlying reader.
+func (sr *SnapshotReader) Close() error {
+	if sr.gz != nil {
+		return sr.gz.Close()
+	}
+	return nil
+}
+
+// Next returns the next entry, or io.EOF after the last one. A verifying
+// reader checks the snapshot checksum before returning io.EOF.
+func (sr *SnapshotReader) Next() (SnapshotEntry, error) {
+	if sr.err != nil {
+		return SnapshotEntry{}, sr.err
+	}
+
+	entry, err := sr.next()
+	if err == nil && sr.verify {
+		err = sr.verifyEntry(&entry)
+	}
+	if err == io.EOF && sr.verify {
+		err = sr.verifyChecksum()
+	}
+	if err != nil {
+		sr.err = err
+		return SnapshotEntry{}, err
+	}
+
+	sr.read++
+	return entry, nil
+}
+
+// next decodes the next entry in either format.
+func (sr *SnapshotReader) next() (SnapshotEntry, error) {
+	if sr.format == SnapshotFormatBinary {
+		return sr.nextBinary()
+	}
+	return sr.nextJSON()
+}
+
+// verifyEntry adds an entry to the running checksum, verifies it, and
+// converts it to the current version.
+func (sr *SnapshotReader) verifyEntry(entry *SnapshotEntry) error {
+	if err := sr.loadCodec(); err != nil {
+		return err
+	}
+
+	sr.buf = sr.codec.appendEntry(sr.buf[:0], *entry)
+	sr.hash.Write(sr.buf)
+
+	if err := sr.codec.upgradeEntry(entry); err != nil {
+		return corruptSnapshot(-1, "entry %d (key %q): %v", sr.read+1, entry.Key, err)
+	}
+	return nil
+}
+
+// loadCodec looks up the codec of the snapshot's version. The binary header
+// has it first; a JSON document may have it anywhere before the entries.
+func (sr *SnapshotReader) loadCodec() error {
+	if sr.codec.appendEntry != nil {
+		return nil
+	}
+	codec, err := snapshotCodec(sr.version)
+	if err != nil {
+		return err
+	}
+	sr.codec = codec
+	return nil
+}
+
+// verifyChecksum compares the running checksum with the stored one.
+func (sr *SnapshotReader) verifyChecksum() error {
+	if err := sr.loadCodec(); err != nil {
+		return err
+	}
+	// Snapshots written before checksums were added have none
+	if sr.checksum == "" {
+		return io.EOF
+	}
+	if got := hex.EncodeToString(sr.hash.Sum(nil)); got != sr.checksum {
+		return corruptSnapshot(-1, "checksum mismatch (expected %s, got %s)", sr.checksum, got)
+	}
+	return io.EOF
+}
+
+// readBinaryHeader reads the version, timestamp, and entry count of a binary snapshot.
+func (sr *SnapshotReader) readBinaryHeader() error {
+	r := sr.input
+	version, err := readSnapshotString(r)
+	if err != nil {
+		return corruptSnapshot(r.off, "header: %v", err)
+	}
+	timestamp, err := binary.ReadVarint(r)
+	if err != nil {
+		return corruptSnapshot(r.off, "header: %v", snapshotReadError(err))
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return corruptSnapshot(r.off, "header: %v", snapshotReadError(err))
+	}
+
+	codec, err := snapshotCodec(version)
+	if err != nil {
+		return err
+	}
+
+	sr.version = version
+	sr.timestamp = time.Unix(0, timestamp)
+	sr.count = int64(min(count, 1<<62))
+	sr.codec = codec
+	return nil
+}
+
+// nextBinary reads the next entry of a binary snapshot, or the checksum
+// trailer after the last one.
+func (sr *SnapshotReader) nextBinary() (SnapshotEntry, error) {
+	r := sr.input
+	if sr.read < sr.count {
+		start := r.off
+		entry, err := sr.codec.readEntry(r)
+		if err != nil {
+			return entry, corruptSnapshot(start, "entry %d of %d: %v", sr.read+1, sr.count, err)
+		}
+		return entry, nil
+	}
+
+	// Optional checksum trailer (snapshots written before checksums have none)
+	if _, err := r.r.Peek(1); err == nil {
+		start := r.off
+		sum := make([]byte, sha256.Size)
+		if _, err := io.ReadFull(r, sum); err != nil {
+			return SnapshotEntry{}, corruptSnapshot(start, "checksum: %v", snapshotReadError(err))
+		}
+		sr.checksum = hex.EncodeToString(sum)
+	}
+
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return SnapshotEntry{}, corruptSnapshot(r.off, "trailing data after snapshot")
+	}
+	return SnapshotEntry{}, io.EOF
+}
+
+// nextJSON decodes the next element of the entries array, or the fields
+// following the array after the last one.
+func (sr *SnapshotReader) nextJSON() (SnapshotEntry, error) {
+	var entry SnapshotEntry
+	if sr.inEntries {
+		if sr.json.More() {
+			if err := sr.json.Decode(&entry); err != nil {
+				return entry, sr.jsonError(err)
+			}
+			return entry, nil
+		}
+
+		// End of the entries array; the checksum follows it
+		if _, err := sr.json.Token(); err != nil {
+			return entry, sr.jsonError(err)
+		}
+		sr.inEntries = false
+		if err := sr.readJSONFields(); err != nil {
+			return entry, err
+		}
+		if sr.inEntries {
+			return sr.nextJSON() // Another entries array continues the entries
+		}
+	}
+	return entry, io.EOF
+}
+
+// readJSONFields reads the fields of the snapshot object up to the start of
+// the entries array, or up to the end of the object.
+func (sr *SnapshotReader) readJSONFields() error {
+	for sr.json.More() {
+		tok, err := sr.json.Token()
+		if err != nil {
+			return sr.jsonError(err)
+		}
+		key, _ := tok.(string)
+
+		switch key {
+		case "version":
+			err = sr.json.Decode(&sr.version)
+		case "timestamp":
+			err = sr.json.Decode(&sr.timestamp)
+		case "checksum":
+			err = sr.json.Decode(&sr.checksum)
+		case "entries":
+			tok, err = sr.json.Token()
+			if err == nil && tok == json.Delim('[') {
+				sr.inEntries = true
+				return nil
+			}
+			if err == nil && tok != nil { // null means no entries
+				return corruptSnapshot(sr.json.InputOffset(), "entries: expected an array")
+			}
+		default:
+			var skip json.RawMessage
+			err = sr.json.Decode(&skip)
+		}
+		if err != nil {
+			return sr.jsonError(err)
+		}
+	}
+
+	// End of the snapshot object
+	if _, err := sr.json.Token(); err != nil {
+		return sr.jsonError(err)
+	}
+	return nil
+}
+
+// jsonError reports a JSON decoding error with the offset where it occurred.
+func (sr *SnapshotReader) jsonError(err error) error {
+	offset := sr.json.InputOffset()
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		// The decoder reads ahead: the data ends here
+		offset, err = sr.input.off, errors.New("snapshot is truncated")
+	}
+	return corruptSnapshot(offset, "%v", err)
+}
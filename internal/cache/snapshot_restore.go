@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// RestoreResult describes a snapshot restored by RestoreSnapshot.
+type RestoreResult struct {
+	Restored  int // Keys loaded into the cache
+	Expired   int // Entries skipped because they had already expired
+	Oversized int // Entries skipped because they exceed the key length or value size limit
+}
+
+// RestoreSnapshot replaces the cache contents with a snapshot read from r, in
+// any format, compressed or not. The snapshot is fully decoded and verified
+// before the cache is touched, so a corrupted upload (reported as a
+// *SnapshotCorruptionError) leaves the current dataset in place.
+//
+// The dataset is swapped and the AOF rewrite is started under the same cache
+// lock, so the new AOF holds exactly the restored dataset plus the writes
+// made after it, and the old commands are never replayed again. Returns
+// ErrRewriteInProgress, without restoring, if an AOF rewrite is running.
+func (c *Cache) RestoreSnapshot(r io.Reader) (RestoreResult, error) {
+	snapshot, err := readSnapshot("upload", r)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+
+	n, oversized, err := c.replaceDataset(&snapshot, true)
+	if errors.Is(err, ErrRewriteInProgress) {
+		return RestoreResult{}, err
+	}
+
+	result := RestoreResult{Restored: n, Expired: len(snapshot.Entries) - n - oversized, Oversized: oversized}
+	if err != nil {
+		return result, fmt.Errorf("failed to reset AOF after restore: %w", err)
+	}
+	return result, nil
+}
+
+// replaceDataset replaces the cache contents with the snapshot entries and
+// rewrites the AOF from them, as described for RestoreSnapshot. Replicas of
+// this cache are disconnected and fully resync, since the new dataset isn't
+// the result of the commands they received. Returns the number of keys
+// loaded and of entries skipped for the limits (only applied if
+// enforceLimits is true), or ErrRewriteInProgress without touching the cache.
+func (c *Cache) replaceDataset(snapshot *Snapshot, enforceLimits bool) (int, int, error) {
+	c.lockAll()
+
+	// A running rewrite would replace the AOF with the old dataset
+	if c.aof != nil && c.aof.rewriteStats().InProgress {
+		c.unlockAll()
+		return 0, 0, ErrRewriteInProgress
+	}
+
+	n, oversized := c.restoreSnapshotLocked(snapshot, enforceLimits)
+	c.dirty.Add(int64(max(n, 1)))
+	if c.replication != nil {
+		c.replication.reset()
+	}
+
+	var entries []rewriteEntry
+	var err error
+	if c.aof != nil {
+		entries = c.rewriteEntriesLocked()
+		err = c.aof.startRewrite(int64(len(entries)))
+	}
+	c.unlockAll()
+
+	if err != nil {
+		return n, oversized, err
+	}
+	if c.aof != nil {
+		return n, oversized, c.aof.finishRewrite(entries)
+	}
+	return n, oversized, nil
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// rotateSnapshots shifts the older generations of the snapshot at path
+// (path.1 → path.2 …, dropping path.<keep>) and keeps the current snapshot as
+// path.1, so the next rename over path doesn't destroy it.
+//
+// The current snapshot is hard-linked (or copied) rather than renamed to
+// path.1, so path stays in place until the new snapshot replaces it
+// atomically: a crash at any point leaves a loadable snapshot at path.
+func rotateSnapshots(path string, keep int) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil // Nothing to rotate yet
+	}
+
+	for i := keep - 1; i >= 1; i-- {
+		from, to := snapshotGeneration(path, i), snapshotGeneration(path, i+1)
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate snapshot %s: %w", from, err)
+		}
+	}
+
+	first := snapshotGeneration(path, 1)
+	if err := os.Remove(first); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rotate snapshot %s: %w", first, err)
+	}
+	if err := linkOrCopy(path, first); err != nil {
+		return fmt.Errorf("failed to rotate snapshot %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// snapshotGeneration returns the path of the n-th older snapshot generation.
+func snapshotGeneration(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// linkOrCopy makes dst a hard link to src, or a copy if the file system
+// doesn't support hard links. The copy is written to a temporary file and
+// renamed, so dst is never left half-written.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpPath := dst + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, dst)
+}
+
+// restoreFrom loads the dataset from an older snapshot instead of the regular
+// snapshot and AOF. The AOF, which holds newer commands, is kept as
+// <aof>.before-restore and replaced by a fresh AOF holding the restored dataset.
+func (c *Cache) restoreFrom(path string) error {
+	n, err := c.LoadSnapshotFrom(path)
+	if err != nil {
+		return err
+	}
+	slog.Info("Restored snapshot", "keys", n, "path", path)
+
+	// Keep the AOF for inspection; its sequence numbers must not be continued
+	backup := c.aof.filePath + ".before-restore"
+	if err := linkOrCopy(c.aof.filePath, backup); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to back up AOF before restore: %w", err)
+	}
+	slog.Info("Previous AOF kept", "path", backup)
+
+	if err := c.RewriteAOF(); err != nil {
+		return fmt.Errorf("failed to rewrite AOF after restore: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// saveRuleCheckInterval is how often a SnapshotManager with save rules checks them.
+const saveRuleCheckInterval = 1 * time.Second
+
+// saveRetryDelay is how long a SnapshotManager with save rules waits after a
+// failed snapshot before trying again, so a full disk isn't hammered every second.
+const saveRetryDelay = 5 * time.Second
+
+// SaveRule triggers a snapshot once at least Changes changes have been made
+// and at least Interval has passed since the last snapshot, like the Redis
+// "save <seconds> <changes>" directive.
+type SaveRule struct {
+	Interval time.Duration // Minimum time since the last snapshot
+	Changes  int64         // Minimum number of changes since the last snapshot
+}
+
+// String formats the rule as "<seconds> <changes>".
+func (r SaveRule) String() string {
+	return fmt.Sprintf("%d %d", int64(r.Interval/time.Second), r.Changes)
+}
+
+// ParseSaveRules parses one or more rules written as "<seconds> <changes>"
+// pairs, e.g. "900 1" or "900 1 300 100".
+func ParseSaveRules(s string) ([]SaveRule, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save rule %q (expected \"<seconds> <changes>\" pairs)", s)
+	}
+
+	rules := make([]SaveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid save rule %q: seconds must be a positive integer", s)
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes <= 0 {
+			return nil, fmt.Errorf("invalid save rule %q: changes must be a positive integer", s)
+		}
+		rules = append(rules, SaveRule{Interval: time.Duration(seconds) * time.Second, Changes: changes})
+	}
+
+	return rules, nil
+}
+
+// SetSaveRules replaces the fixed snapshot interval with save rules: a
+// snapshot is taken as soon as any rule matches, and never while the cache is
+// unchanged. No rules bring back the fixed interval. It can be called while
+// the manager is running.
+func (sm *SnapshotManager) SetSaveRules(rules []SaveRule) error {
+	for _, r := range rules {
+		if r.Interval <= 0 || r.Changes <= 0 {
+			return fmt.Errorf("invalid save rule %q: seconds and changes must be positive", r)
+		}
+	}
+
+	sm.mu.Lock()
+	sm.rules = append([]SaveRule(nil), rules...)
+	sm.mu.Unlock()
+	sm.wake()
+	return nil
+}
+
+// SaveRules returns the configured save rules (nil if the fixed interval is used).
+func (sm *SnapshotManager) SaveRules() []SaveRule {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return append([]SaveRule(nil), sm.rules...)
+}
+
+// matchSaveRule returns the first rule that calls for a snapshot now, if any.
+func (sm *SnapshotManager) matchSaveRule() (SaveRule, bool) {
+	sm.mu.Lock()
+	rules := sm.rules
+	failedRecently := sm.status.LastStatus == "err" && time.Since(sm.status.LastTime) < saveRetryDelay
+	sm.mu.Unlock()
+
+	if failedRecently {
+		return SaveRule{}, false
+	}
+
+	changes := sm.cache.ChangesSinceSave()
+	elapsed := sm.cache.now().Sub(sm.cache.LastSave())
+	for _, r := range rules {
+		if changes >= r.Changes && elapsed >= r.Interval {
+			return r, true
+		}
+	}
+	return SaveRule{}, false
+}
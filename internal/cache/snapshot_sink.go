@@ -0,0 +1,235 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot sinks.
+//
+// A SnapshotSink keeps a copy of the snapshot file outside the local data
+// directory, e.g. for servers whose disks don't survive instance replacement.
+// With a sink configured (WithSnapshotSink), every snapshot saved by a
+// SnapshotManager is uploaded after the local save succeeded, and Load
+// downloads the snapshot from the sink if the local file is missing.
+//
+// Upload failures never fail the snapshot itself: the local file is already
+// saved, so they are retried a few times, logged, and reported through
+// SnapshotUploadStats.
+
+// ErrSnapshotNotFound is returned by SnapshotSink.Get if the sink has no snapshot with that name.
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// SnapshotSink stores snapshot files under a name.
+type SnapshotSink interface {
+	// Put stores the data read from r under name, replacing any previous copy.
+	Put(name string, r io.Reader) error
+
+	// Get returns the data stored under name, or ErrSnapshotNotFound.
+	// The caller must close it.
+	Get(name string) (io.ReadCloser, error)
+
+	// String describes the sink for logs and INFO, e.g. "s3://bucket/prefix".
+	String() string
+}
+
+// Upload retries after a failed snapshot upload.
+const (
+	snapshotUploadAttempts   = 3               // Tries per snapshot, including the first
+	snapshotUploadRetryDelay = 1 * time.Second // Wait after the first failure, doubled after each further one
+)
+
+// SnapshotUploadStats describes the snapshot uploads to the sink.
+type SnapshotUploadStats struct {
+	Sink         string        // Description of the sink, empty if none is configured
+	Count        int           // Number of successful uploads since startup
+	LastStatus   string        // "ok", "err", or empty if no upload has finished yet
+	LastError    string        // Error of the last upload, if it failed
+	LastTime     time.Time     // When the last upload finished
+	LastDuration time.Duration // How long the last upload took, including retries
+	LastAttempts int           // Number of tries of the last upload
+	LastSuccess  time.Time     // When the last successful upload finished
+}
+
+// SnapshotUploadStats returns statistics about snapshot uploads to the sink.
+func (c *Cache) SnapshotUploadStats() SnapshotUploadStats {
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+
+	stats := c.lastUpload
+	if c.snapshotSink != nil {
+		stats.Sink = c.snapshotSink.String()
+	}
+	return stats
+}
+
+// uploadSnapshot uploads the snapshot file at path to the sink, if any,
+// retrying with backoff. The result is recorded in the upload statistics.
+func (c *Cache) uploadSnapshot(path string) error {
+	if c.snapshotSink == nil {
+		return nil
+	}
+
+	start := time.Now()
+	name := filepath.Base(path)
+	delay := snapshotUploadRetryDelay
+
+	var err error
+	attempts := 0
+	for attempts < snapshotUploadAttempts {
+		attempts++
+		if err = c.putSnapshot(name, path); err == nil {
+			break
+		}
+		if attempts < snapshotUploadAttempts {
+			slog.Warn("Snapshot upload failed", "sink", c.snapshotSink.String(), "retry_in", delay, "err", err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+
+	c.lastUpload.LastTime = time.Now()
+	c.lastUpload.LastDuration = time.Since(start)
+	c.lastUpload.LastAttempts = attempts
+	if err != nil {
+		c.lastUpload.LastStatus = "err"
+		c.lastUpload.LastError = err.Error()
+		return fmt.Errorf("failed to upload snapshot to %s: %w", c.snapshotSink, err)
+	}
+
+	c.lastUpload.LastStatus = "ok"
+	c.lastUpload.LastError = ""
+	c.lastUpload.LastSuccess = c.lastUpload.LastTime
+	c.lastUpload.Count++
+	return nil
+}
+
+// putSnapshot uploads a single copy of the file at path.
+func (c *Cache) putSnapshot(name, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return c.snapshotSink.Put(name, file)
+}
+
+// fetchSnapshot downloads the snapshot from the sink if there is no local
+// snapshot file. A sink without a snapshot is not an error (e.g. the first
+// start); any other failure is, unless strict snapshot loading is disabled,
+// because starting empty would upload an empty snapshot over the remote one.
+func (c *Cache) fetchSnapshot() error {
+	if _, err := os.Stat(c.snapshotPath); !os.IsNotExist(err) {
+		return nil // Use the local snapshot
+	}
+
+	name := filepath.Base(c.snapshotPath)
+	err := c.downloadSnapshot(name)
+	switch {
+	case err == nil:
+		slog.Info("Downloaded snapshot", "name", name, "sink", c.snapshotSink.String())
+		return nil
+	case errors.Is(err, ErrSnapshotNotFound):
+		slog.Info("No snapshot in sink", "name", name, "sink", c.snapshotSink.String())
+		return nil
+	case !c.strictSnapshotLoad:
+		slog.Warn("Ignoring snapshot in sink", "sink", c.snapshotSink.String(), "err", err)
+		return nil
+	default:
+		return fmt.Errorf("failed to download snapshot from %s: %w", c.snapshotSink, err)
+	}
+}
+
+// downloadSnapshot copies the named snapshot from the sink to the local
+// snapshot path, through a temporary file so a failed download leaves nothing behind.
+func (c *Cache) downloadSnapshot(name string) error {
+	body, err := c.snapshotSink.Get(name)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	tmpPath := c.snapshotPath + ".download.tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, body); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, c.snapshotPath)
+}
+
+// FileSink is a SnapshotSink storing snapshots in a local directory, e.g. a
+// network file system mounted on every instance.
+type FileSink struct {
+	dir string
+}
+
+// NewFileSink creates a FileSink storing snapshots in dir, which is created if needed.
+func NewFileSink(dir string) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot sink directory: %w", err)
+	}
+	return &FileSink{dir: dir}, nil
+}
+
+// Put implements SnapshotSink. The file is replaced atomically.
+func (s *FileSink) Put(name string, r io.Reader) error {
+	path := filepath.Join(s.dir, name)
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Get implements SnapshotSink.
+func (s *FileSink) Get(name string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrSnapshotNotFound
+	}
+	return file, err
+}
+
+// String implements SnapshotSink.
+func (s *FileSink) String() string {
+	return s.dir
+}
@@ -0,0 +1,418 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSaveSnapshotDoesNotBlockReads checks that Gets and Sets keep going
+// while a large snapshot is encoded and written: the cache lock is only
+// held to copy the entries, so no Get waits for more than a fraction of the
+// whole save.
+func TestSaveSnapshotDoesNotBlockReads(t *testing.T) {
+	if testing.Short() {
+		t.Skip("large snapshot")
+	}
+	const keys = 100_000
+
+	c, err := NewCache("", "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+	value := strings.Repeat("v", 256)
+	for i := range keys {
+		if err := c.Set(fmt.Sprintf("key%d", i), value, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var done atomic.Bool
+	var wg sync.WaitGroup
+	var worst atomic.Int64
+	var gets atomic.Int64
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; !done.Load(); i++ {
+			start := time.Now()
+			if _, ok := c.Get(fmt.Sprintf("key%d", i%keys)); !ok {
+				t.Errorf("key%d missing during snapshot", i%keys)
+				return
+			}
+			if d := int64(time.Since(start)); d > worst.Load() {
+				worst.Store(d)
+			}
+			gets.Add(1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; !done.Load(); i++ {
+			if err := c.Set(fmt.Sprintf("new%d", i), "x", 0); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	err = c.SaveSnapshot(filepath.Join(t.TempDir(), "test.snapshot"))
+	elapsed := time.Since(start)
+	done.Store(true)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	t.Logf("snapshot took %v, %d gets, slowest %v", elapsed, gets.Load(), time.Duration(worst.Load()))
+	if d := time.Duration(worst.Load()); d > elapsed/2 {
+		t.Errorf("slowest Get during the snapshot took %v of %v, want at most half", d, elapsed)
+	}
+}
+
+// TestSnapshotAndClearAOFLosesNoWrites fires writes continuously while
+// snapshots are taken and the AOF is compacted, then checks that every
+// acknowledged write survives a reload.
+func TestSnapshotAndClearAOFLosesNoWrites(t *testing.T) {
+	// Writes are bounded, so the dataset stays small under the race
+	// detector, where snapshots are much slower than writes. Snapshots are
+	// taken until the writers are done.
+	const writers, maxWrites = 4, 20000
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot")
+	c, err := NewCache(aofPath, snapshotPath, 0, WithAOFFsync(FsyncNo))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	var running atomic.Int32
+	running.Store(writers)
+	var wg sync.WaitGroup
+	acked := make([]int, writers) // Writes acknowledged by each writer
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer running.Add(-1)
+			for i := range maxWrites {
+				key := fmt.Sprintf("w%d-%d", w, i)
+				if err := c.Set(key, key, 0); err != nil {
+					t.Error(err)
+					return
+				}
+				// Deleting the previous key checks that DELs aren't lost either
+				if i > 0 && i%2 == 0 && !c.Del(fmt.Sprintf("w%d-%d", w, i-1)) {
+					t.Errorf("w%d-%d missing before its delete", w, i-1)
+					return
+				}
+				acked[w] = i + 1
+			}
+		}()
+	}
+
+	for snapshots := 0; snapshots < 10 || running.Load() > 0; snapshots++ {
+		if _, err := c.CreateSnapshotAndClearAOF(snapshotPath); err != nil {
+			t.Errorf("CreateSnapshotAndClearAOF: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	c, err = NewCache(aofPath, snapshotPath, 0)
+	if err != nil {
+		t.Fatalf("NewCache after restart: %v", err)
+	}
+	defer c.Close()
+	for w, n := range acked {
+		for i := range n {
+			key := fmt.Sprintf("w%d-%d", w, i)
+			_, ok := c.Get(key)
+			// Odd keys were deleted when the next key was written
+			if want := i%2 == 0 || i == n-1; ok != want {
+				t.Fatalf("%s present = %v after reload, want %v (%d writes)", key, ok, want, n)
+			}
+		}
+	}
+}
+
+// TestSnapshotCompression checks that a gzip-compressed snapshot, in either
+// format, is loaded by a later run whatever its own compression setting, and
+// that the stats report the compressed and uncompressed sizes.
+func TestSnapshotCompression(t *testing.T) {
+	const keys = 1000
+	for _, format := range []SnapshotFormat{SnapshotFormatJSON, SnapshotFormatBinary} {
+		for _, compressed := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%v/compressed=%v", format, compressed), func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "dump.rdb")
+				opts := []Option{WithSnapshotFormat(format)}
+				if compressed {
+					opts = append(opts, WithSnapshotCompression(gzip.BestCompression))
+				}
+				c, err := NewCache("", "", 0, opts...)
+				if err != nil {
+					t.Fatalf("NewCache: %v", err)
+				}
+				value := strings.Repeat("repetitive ", 20)
+				for i := range keys {
+					if err := c.Set(fmt.Sprintf("key%d", i), value, time.Hour); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := c.SaveSnapshot(path); err != nil {
+					t.Fatalf("SaveSnapshot: %v", err)
+				}
+				c.Close()
+
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if isGzip := bytes.HasPrefix(data, []byte{0x1f, 0x8b}); isGzip != compressed {
+					t.Errorf("file gzip-compressed = %v, want %v", isGzip, compressed)
+				}
+				stats := c.SnapshotStats()
+				if stats.Compressed != compressed || stats.DiskSize != int64(len(data)) || stats.Entries != keys {
+					t.Errorf("stats = %+v, want compressed %v, %d bytes on disk, %d entries", stats, compressed, len(data), keys)
+				}
+				if compressed && stats.RawSize < 10*stats.DiskSize {
+					t.Errorf("raw size %d, disk size %d: want at least 10:1 for repetitive values", stats.RawSize, stats.DiskSize)
+				}
+				if !compressed && stats.RawSize != stats.DiskSize {
+					t.Errorf("raw size %d != disk size %d without compression", stats.RawSize, stats.DiskSize)
+				}
+
+				// A later run with the opposite setting detects the compression
+				var later []Option
+				if !compressed {
+					later = append(later, WithSnapshotCompression(gzip.DefaultCompression))
+				}
+				c2, err := NewCache("", "", 0, later...)
+				if err != nil {
+					t.Fatalf("NewCache: %v", err)
+				}
+				defer c2.Close()
+				if loaded, err := c2.LoadSnapshot(path); !loaded || err != nil {
+					t.Fatalf("LoadSnapshot = %v, %v", loaded, err)
+				}
+				for _, key := range []string{"key0", fmt.Sprintf("key%d", keys-1)} {
+					if got, ok := c2.Get(key); !ok || got != value {
+						t.Errorf("Get(%s) = %q, %v after loading", key, got, ok)
+					}
+				}
+				if n := c2.Stats().Keys; n != keys {
+					t.Errorf("%d keys loaded, want %d", n, keys)
+				}
+			})
+		}
+	}
+}
+
+// TestBinarySnapshot checks that a binary snapshot starts with its magic and
+// restores values of any bytes, expiration times, and content types.
+func TestBinarySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	c, err := NewCache("", "", 0, WithSnapshotFormat(SnapshotFormatBinary))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	values := map[string]string{"plain": "v", "binary": "\x00\xff\n\r\x80", "empty": "", "large": strings.Repeat("x", 1<<20)}
+	for k, v := range values {
+		if err := c.Set(k, v, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Set("ttl", "v", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetBytesWithContentType("typed", []byte("{}"), 0, "application/json"); err != nil {
+		t.Fatal(err)
+	}
+	_, expiresAt, _ := c.GetBytesWithExpiry("ttl")
+	if err := c.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+	c.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(snapshotMagic)) {
+		t.Fatalf("binary snapshot starts with %.16q, want %q", data, snapshotMagic)
+	}
+
+	// The JSON-format setting of a later run doesn't matter for loading
+	c2, err := NewCache("", "", 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c2.Close()
+	if loaded, err := c2.LoadSnapshot(path); !loaded || err != nil {
+		t.Fatalf("LoadSnapshot = %v, %v", loaded, err)
+	}
+	for k, want := range values {
+		if got, ok := c2.Get(k); !ok || got != want {
+			t.Errorf("Get(%q) = %d bytes (present %v), want %d bytes", k, len(got), ok, len(want))
+		}
+	}
+	if _, got, ok := c2.GetBytesWithExpiry("ttl"); !ok || !got.Equal(expiresAt) {
+		t.Errorf("ttl expires at %v (present %v), want %v", got, ok, expiresAt)
+	}
+	if _, stat, ok := c2.GetBytesWithStat("typed"); !ok || stat.ContentType != "application/json" {
+		t.Errorf("typed content type = %q (present %v), want application/json", stat.ContentType, ok)
+	}
+}
+
+// TestLoadSnapshotV1JSON checks that a version 1.0 JSON snapshot, written
+// before the binary format and checksums, still loads.
+func TestLoadSnapshotV1JSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	v1 := fmt.Sprintf(`{
+  "version": "1.0",
+  "timestamp": "2024-01-02T03:04:05Z",
+  "entries": [
+    {"key": "permanent", "value": "a\nb", "expires_at": "0001-01-01T00:00:00Z"},
+    {"key": "ttl", "value": "v", "expires_at": %q},
+    {"key": "expired", "value": "v", "expires_at": "2020-01-01T00:00:00Z"}
+  ]
+}`, expiresAt.Format(time.RFC3339))
+	if err := os.WriteFile(path, []byte(v1), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCache("", "", 0, WithStrictSnapshotLoad(true))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+	if loaded, err := c.LoadSnapshot(path); !loaded || err != nil {
+		t.Fatalf("LoadSnapshot = %v, %v", loaded, err)
+	}
+	if got, ok := c.Get("permanent"); !ok || got != "a\nb" {
+		t.Errorf("Get(permanent) = %q, %v", got, ok)
+	}
+	if _, got, ok := c.GetBytesWithExpiry("ttl"); !ok || !got.Equal(expiresAt) {
+		t.Errorf("ttl expires at %v (present %v), want %v", got, ok, expiresAt)
+	}
+	if _, ok := c.Get("expired"); ok {
+		t.Error("expired entry loaded")
+	}
+}
+
+// BenchmarkSnapshot compares saving and loading 1M small keys in the JSON
+// and binary formats.
+func BenchmarkSnapshot(b *testing.B) {
+	const keys = 1_000_000
+	for _, format := range []SnapshotFormat{SnapshotFormatJSON, SnapshotFormatBinary} {
+		path := filepath.Join(b.TempDir(), "dump.rdb")
+		c, err := NewCache("", "", 0, WithSnapshotFormat(format))
+		if err != nil {
+			b.Fatalf("NewCache: %v", err)
+		}
+		for i := range keys {
+			if err := c.Set("key:"+strconv.Itoa(i), "value:"+strconv.Itoa(i), 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.Run(format.String()+"/save", func(b *testing.B) {
+			for b.Loop() {
+				if err := c.SaveSnapshot(path); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(c.SnapshotStats().DiskSize), "file-bytes")
+		})
+		c.Close()
+
+		b.Run(format.String()+"/load", func(b *testing.B) {
+			for b.Loop() {
+				b.StopTimer()
+				c, err := NewCache("", "", 0)
+				if err != nil {
+					b.Fatalf("NewCache: %v", err)
+				}
+				b.StartTimer()
+				if loaded, err := c.LoadSnapshot(path); !loaded || err != nil {
+					b.Fatalf("LoadSnapshot = %v, %v", loaded, err)
+				}
+				b.StopTimer()
+				c.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// TestLRUOrderSurvivesRestart checks that after a restart from a snapshot,
+// or from an AOF preamble alone, the key that was coldest before the
+// restart is evicted first.
+func TestLRUOrderSurvivesRestart(t *testing.T) {
+	const keys = 5
+	for _, via := range []string{"snapshot", "aof preamble"} {
+		t.Run(via, func(t *testing.T) {
+			dir := t.TempDir()
+			aofPath, snapshotPath := filepath.Join(dir, "test.aof"), filepath.Join(dir, "test.snapshot")
+			clock := newFakeClock()
+			c, err := NewCache(aofPath, snapshotPath, keys, WithShards(1), WithClock(clock.Now))
+			if err != nil {
+				t.Fatalf("NewCache: %v", err)
+			}
+			for i := range keys {
+				clock.Advance(time.Second)
+				if err := c.Set(fmt.Sprintf("key%d", i), "v", 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// key3 is the coldest: neither the first nor the last set
+			for _, i := range []int{0, 1, 2, 4} {
+				clock.Advance(time.Second)
+				c.Get(fmt.Sprintf("key%d", i))
+			}
+			clock.Advance(time.Second)
+			if via == "snapshot" {
+				if _, err := c.CreateSnapshotAndClearAOF(snapshotPath); err != nil {
+					t.Fatalf("CreateSnapshotAndClearAOF: %v", err)
+				}
+			} else if err := c.RewriteAOF(); err != nil {
+				t.Fatalf("RewriteAOF: %v", err)
+			}
+			c.Close()
+			if via == "aof preamble" {
+				if _, err := os.Stat(snapshotPath); !os.IsNotExist(err) {
+					t.Fatalf("snapshot exists (%v), want the AOF alone", err)
+				}
+			}
+
+			clock.Advance(time.Hour)
+			c, err = NewCache(aofPath, snapshotPath, keys, WithShards(1), WithClock(clock.Now))
+			if err != nil {
+				t.Fatalf("NewCache after restart: %v", err)
+			}
+			defer c.Close()
+			if err := c.Set("new", "v", 0); err != nil {
+				t.Fatal(err)
+			}
+			for i := range keys {
+				_, ok := c.Get(fmt.Sprintf("key%d", i))
+				if want := i != 3; ok != want {
+					t.Errorf("key%d present = %v after an eviction, want %v", i, ok, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot versions.
+//
+// Every version that can be loaded has an entry in snapshotVersions, which
+// knows how its entries are encoded and how to upgrade a decoded snapshot to
+// snapshotVersion. Saving always writes snapshotVersion, so a file in an
+// older version is rewritten in the current one by the next save.
+//
+//	1.0  key, value, expiration time
+//	2.0  adds the last access time (for LRU) and a CRC32 per entry
+//	2.1  adds the content type
+
+// snapshotVersion is the version written by SaveSnapshot.
+const snapshotVersion = "2.1"
+
+// snapshotVersionCodec describes one snapshot version.
+type snapshotVersionCodec struct {
+	// appendEntry appends the binary encoding of an entry. The same encoding
+	// is hashed for the snapshot checksum, in both the binary and JSON formats.
+	appendEntry func(buf []byte, entry SnapshotEntry) []byte
+
+	// readEntry reads an entry in the binary format.
+	readEntry func(r *offsetReader) (SnapshotEntry, error)
+
+	// upgradeEntry verifies version-specific data of a decoded entry and
+	// converts it to snapshotVersion in place.
+	upgradeEntry func(entry *SnapshotEntry) error
+}
+
+// snapshotVersions is the registry of loadable snapshot versions.
+var snapshotVersions = map[string]snapshotVersionCodec{
+	"1.0": {appendEntry: appendSnapshotEntryV1, readEntry: readSnapshotEntryV1, upgradeEntry: upgradeSnapshotEntryV1},
+	"2.0": {appendEntry: appendSnapshotEntryV2, readEntry: readSnapshotEntryV2, upgradeEntry: upgradeSnapshotEntryV2},
+	"2.1": {appendEntry: appendSnapshotEntryV21, readEntry: readSnapshotEntryV21, upgradeEntry: verifySnapshotEntryV21},
+}
+
+// snapshotCodec returns the codec for a version, or a *SnapshotCorruptionError
+// if the version is unknown (e.g. written by a newer server).
+func snapshotCodec(version string) (snapshotVersionCodec, error) {
+	codec, ok := snapshotVersions[version]
+	if !ok {
+		known := make([]string, 0, len(snapshotVersions))
+		for v := range snapshotVersions {
+			known = append(known, v)
+		}
+		sort.Strings(known)
+		return codec, corruptSnapshot(-1, "unsupported version %q (this server reads %s; was the file written by a newer version?)",
+			version, strings.Join(known, ", "))
+	}
+	return codec, nil
+}
+
+// snapshotChecksum returns the hex-encoded SHA-256 of the entries, computed
+// over their binary encoding in the given version so it doesn't depend on
+// the file format.
+func snapshotChecksum(codec snapshotVersionCodec, entries []SnapshotEntry) string {
+	h := sha256.New()
+	buf := make([]byte, 0, 256)
+	for _, entry := range entries {
+		buf = codec.appendEntry(buf[:0], entry)
+		h.Write(buf)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// upgradeSnapshot verifies a decoded snapshot and converts it to snapshotVersion.
+func upgradeSnapshot(snapshot *Snapshot) error {
+	codec, err := snapshotCodec(snapshot.Version)
+	if err != nil {
+		return err
+	}
+
+	// Snapshots written before checksums were added have none
+	if snapshot.Checksum != "" {
+		if got := snapshotChecksum(codec, snapshot.Entries); got != snapshot.Checksum {
+			return corruptSnapshot(-1, "checksum mismatch (expected %s, got %s)", snapshot.Checksum, got)
+		}
+	}
+
+	for i := range snapshot.Entries {
+		if err := codec.upgradeEntry(&snapshot.Entries[i]); err != nil {
+			return corruptSnapshot(-1, "entry %d (key %q): %v", i+1, snapshot.Entries[i].Key, err)
+		}
+	}
+
+	// The checksum covers the entries in the original version
+	if snapshot.Version != snapshotVersion {
+		snapshot.Version = snapshotVersion
+		snapshot.Checksum = ""
+	}
+	return nil
+}
+
+// sealSnapshot fills in the per-entry and snapshot checksums before saving.
+func sealSnapshot(snapshot *Snapshot) {
+	for i := range snapshot.Entries {
+		snapshot.Entries[i].Checksum = snapshotEntryCRC(snapshot.Entries[i])
+	}
+	snapshot.Checksum = snapshotChecksum(snapshotVersions[snapshotVersion], snapshot.Entries)
+}
+
+// unixNano returns t in Unix nanoseconds, or 0 for the zero time.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano is the inverse of unixNano.
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// Version 1.0
+
+// appendSnapshotEntryV1 appends key, value, and expiration time.
+func appendSnapshotEntryV1(buf []byte, entry SnapshotEntry) []byte {
+	buf = appendBytes(buf, entry.Key)
+	buf = appendBytes(buf, entry.Value)
+	return binary.AppendVarint(buf, unixNano(entry.ExpiresAt))
+}
+
+// readSnapshotEntryV1 reads an entry written by appendSnapshotEntryV1.
+func readSnapshotEntryV1(r *offsetReader) (SnapshotEntry, error) {
+	var entry SnapshotEntry
+	var err error
+	if entry.Key, err = readSnapshotString(r); err != nil {
+		return entry, err
+	}
+	if entry.Value, err = readSnapshotString(r); err != nil {
+		return entry, err
+	}
+	expiresAt, err := binary.ReadVarint(r)
+	if err != nil {
+		return entry, snapshotReadError(err)
+	}
+	entry.ExpiresAt = fromUnixNano(expiresAt)
+	return entry, nil
+}
+
+// upgradeSnapshotEntryV1 converts a 1.0 entry to the current version.
+// Access times are unknown and left zero, so the keys count as accessed at
+// load time.
+func upgradeSnapshotEntryV1(entry *SnapshotEntry) error {
+	entry.LastAccess = time.Time{}
+	entry.Checksum = snapshotEntryCRC(*entry)
+	return nil
+}
+
+// Version 2.0
+
+// snapshotEntryFieldsV2 appends the 2.0 entry fields without the CRC.
+func snapshotEntryFieldsV2(buf []byte, entry SnapshotEntry) []byte {
+	buf = appendSnapshotEntryV1(buf, entry)
+	return binary.AppendVarint(buf, unixNano(entry.LastAccess))
+}
+
+// snapshotEntryCRCV2 returns the CRC32 of an entry's 2.0 fields.
+func snapshotEntryCRCV2(entry SnapshotEntry) uint32 {
+	var scratch [64]byte
+	return crc32.ChecksumIEEE(snapshotEntryFieldsV2(scratch[:0], entry))
+}
+
+// appendSnapshotEntryV2 appends key, value, expiration time, last access
+// time, and the CRC32 (big endian) of these fields.
+func appendSnapshotEntryV2(buf []byte, entry SnapshotEntry) []byte {
+	start := len(buf)
+	buf = snapshotEntryFieldsV2(buf, entry)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[start:]))
+}
+
+// readSnapshotEntryFieldsV2 reads the 2.0 fields of an entry, without the CRC.
+func readSnapshotEntryFieldsV2(r *offsetReader) (SnapshotEntry, error) {
+	entry, err := readSnapshotEntryV1(r)
+	if err != nil {
+		return entry, err
+	}
+	lastAccess, err := binary.ReadVarint(r)
+	if err != nil {
+		return entry, snapshotReadError(err)
+	}
+	entry.LastAccess = fromUnixNano(lastAccess)
+	return entry, nil
+}
+
+// readSnapshotEntryV2 reads an entry written by appendSnapshotEntryV2 and checks its CRC.
+func readSnapshotEntryV2(r *offsetReader) (SnapshotEntry, error) {
+	entry, err := readSnapshotEntryFieldsV2(r)
+	if err != nil {
+		return entry, err
+	}
+	return entry, readSnapshotEntryCRC(r, &entry, snapshotEntryCRCV2)
+}
+
+// readSnapshotEntryCRC reads the CRC32 following the fields of entry and
+// checks it against the CRC computed by crc.
+func readSnapshotEntryCRC(r *offsetReader, entry *SnapshotEntry, crc func(SnapshotEntry) uint32) error {
+	var sum [4]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return snapshotReadError(err)
+	}
+	entry.Checksum = binary.BigEndian.Uint32(sum[:])
+	return verifySnapshotEntryCRC(entry, crc)
+}
+
+// verifySnapshotEntryCRC checks the Checksum of entry against the CRC
+// computed by crc.
+func verifySnapshotEntryCRC(entry *SnapshotEntry, crc func(SnapshotEntry) uint32) error {
+	if got := crc(*entry); got != entry.Checksum {
+		return fmt.Errorf("checksum mismatch (expected %08x, got %08x)", entry.Checksum, got)
+	}
+	return nil
+}
+
+// upgradeSnapshotEntryV2 checks the checksum of a 2.0 entry and converts it
+// to the current version, without a content type.
+func upgradeSnapshotEntryV2(entry *SnapshotEntry) error {
+	if err := verifySnapshotEntryCRC(entry, snapshotEntryCRCV2); err != nil {
+		return err
+	}
+	entry.Checksum = snapshotEntryCRC(*entry)
+	return nil
+}
+
+// Version 2.1
+
+// snapshotEntryFields appends the 2.1 entry fields without the CRC.
+func snapshotEntryFields(buf []byte, entry SnapshotEntry) []byte {
+	buf = snapshotEntryFieldsV2(buf, entry)
+	return appendBytes(buf, entry.ContentType)
+}
+
+// snapshotEntryCRC returns the CRC32 of an entry's 2.1 fields, the
+// Checksum of entries in the current version.
+func snapshotEntryCRC(entry SnapshotEntry) uint32 {
+	var scratch [64]byte
+	return crc32.ChecksumIEEE(snapshotEntryFields(scratch[:0], entry))
+}
+
+// appendSnapshotEntryV21 appends the fields of appendSnapshotEntryV2 and
+// the content type, and the CRC32 (big endian) of these fields.
+func appendSnapshotEntryV21(buf []byte, entry SnapshotEntry) []byte {
+	start := len(buf)
+	buf = snapshotEntryFields(buf, entry)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[start:]))
+}
+
+// readSnapshotEntryV21 reads an entry written by appendSnapshotEntryV21 and checks its CRC.
+func readSnapshotEntryV21(r *offsetReader) (SnapshotEntry, error) {
+	entry, err := readSnapshotEntryFieldsV2(r)
+	if err != nil {
+		return entry, err
+	}
+	if entry.ContentType, err = readSnapshotString(r); err != nil {
+		return entry, err
+	}
+	return entry, readSnapshotEntryCRC(r, &entry, snapshotEntryCRC)
+}
+
+// verifySnapshotEntryV21 checks the checksum of a 2.1 entry.
+func verifySnapshotEntryV21(entry *SnapshotEntry) error {
+	return verifySnapshotEntryCRC(entry, snapshotEntryCRC)
+}
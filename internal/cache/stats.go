@@ -0,0 +1,57 @@
+package cache
+
+// Stats describes the size of the dataset, its limits, and how many keys
+// were removed since startup, by reason.
+type Stats struct {
+	Keys           int            // Keys in the cache, including expired keys not removed yet
+	MaxKeys        int            // Key limit (0 = unlimited)
+	UsedMemory     int64          // Estimated memory used by the dataset in bytes
+	InternalKeys   int            // Keys of the internal namespace, included in Keys (see internal.go)
+	InternalMemory int64          // Memory used by the internal namespace, included in UsedMemory
+	MaxMemory      int64          // Memory limit in bytes (0 = unlimited)
+	EvictionPolicy EvictionPolicy // Eviction policy applied at the limits
+	Shards         int            // Partitions of the dataset, each with its share of the limits
+
+	ExpiredLazy   int64 // Expired keys removed when accessed
+	ExpiredActive int64 // Expired keys removed by the periodic cleanup
+	Evicted       int64 // Keys evicted by the eviction policy
+	Deleted       int64 // Keys deleted by clients
+
+	EvictCallbacksDropped int64 // Removals not passed to the WithOnEvict callback because it fell behind
+
+	LastExpireCycle        ExpireCycleStats // Last Cleanup cycle
+	CleanupCyclesTruncated int64            // Cleanup cycles that ran out of budget with keys still due
+}
+
+// Stats returns the size of the dataset, its limits, and the removal counters.
+// The shards are read one at a time, so the totals may mix the states of
+// the shards at slightly different times under concurrent writes.
+func (c *Cache) Stats() Stats {
+	stats := Stats{
+		MaxKeys:        c.MaxKeys(),
+		MaxMemory:      c.MaxMemory(),
+		EvictionPolicy: c.policy(),
+		Shards:         len(c.shards),
+
+		ExpiredLazy:   c.expiredLazy.Load(),
+		ExpiredActive: c.expiredActive.Load(),
+		Evicted:       c.evicted.Load(),
+		Deleted:       c.deleted.Load(),
+
+		EvictCallbacksDropped: c.onEvict.droppedCount(),
+
+		CleanupCyclesTruncated: c.cleanupTruncated.Load(),
+	}
+	if cycle := c.lastExpireCycle.Load(); cycle != nil {
+		stats.LastExpireCycle = *cycle
+	}
+	for _, s := range c.shards {
+		s.mu.RLock()
+		stats.Keys += len(s.data)
+		stats.UsedMemory += s.usedMemory
+		stats.InternalKeys += s.internalKeys
+		stats.InternalMemory += s.internalMemory
+		s.mu.RUnlock()
+	}
+	return stats
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Read-modify-write operations.
+//
+// Incr and Expire change a key in place under its shard's lock, so
+// concurrent updates of the same key can't be lost as they would with a Get
+// followed by a Set. Both are logged to the AOF as a SET of the resulting
+// value and expiration time, so replay and replicas need no new commands.
+
+// ErrNotInteger is returned by Incr when the stored value isn't a base-10
+// 64-bit integer.
+var ErrNotInteger = errors.New("value is not an integer")
+
+// ErrIntegerOverflow is returned by Incr when the result doesn't fit in 64 bits.
+var ErrIntegerOverflow = errors.New("increment would overflow")
+
+// Incr adds delta to the integer stored under key and returns the result,
+// like Redis INCRBY. A missing or expired key counts as 0 and is created
+// without a TTL; an existing key keeps its TTL but loses its content type,
+// as the value is replaced by a number. The limits apply as for Set.
+func (c *Cache) Incr(key string, delta int64) (int64, error) {
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.beginWriteLocked(key)
+
+	var n int64
+	var expiresAt time.Time
+	if old, ok := s.data[key]; ok {
+		var err error
+		if n, err = strconv.ParseInt(valueString(old), 10, 64); err != nil {
+			return 0, ErrNotInteger
+		}
+		expiresAt = s.expires[key]
+	}
+	if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+		return 0, ErrIntegerOverflow
+	}
+	n += delta
+
+	if err := s.storeLocked(key, strconv.AppendInt(nil, n, 10), expiresAt, ""); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Expire sets the TTL of an existing key, like Redis EXPIRE, and reports
+// whether the key exists. A ttl of 0 removes the TTL, like Redis PERSIST;
+// an invalid ttl (see Set) returns ErrInvalidTTL. The value, its metadata (see
+// KeyStat), and its eviction order are unchanged.
+func (c *Cache) Expire(key string, ttl time.Duration) (bool, error) {
+	if err := c.checkTTL(ttl); err != nil {
+		return false, err
+	}
+
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expireKeyLocked(key) || !s.hasKey(key) {
+		return false, nil
+	}
+
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = c.now().Add(ttl)
+	}
+	s.setExpiryLocked(key, expiresAt)
+	c.dirty.Add(1)
+	c.notifyWatchers(KeyEventExpire, key)
+
+	if c.aof != nil {
+		c.aof.LogSet(key, valueString(s.data[key]), expiresAt, s.meta[key].contentTypeString())
+	}
+	return true, nil
+}
@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Key change events.
+//
+// Watch returns a Watcher receiving an event for every change of the keys
+// starting with a prefix: writes (set), deletes by clients or the primary
+// (del), TTL changes (expire), and removals by the cache itself (expired,
+// evicted). Keys of the internal namespace aren't reported. Replacing the
+// dataset (a restore or a full resync) reports the keys loaded as set, but
+// not the keys dropped with the old dataset.
+//
+// Events are sent under the lock of the key's shard without ever blocking:
+// the events of a key arrive in the order of its changes, but the events of
+// keys of different shards may not. A watcher that falls behind by more
+// than its buffer is closed with ErrWatchOverflow rather than making
+// writers wait or silently missing events; its client should read the keys
+// it cares about again and watch anew.
+
+// KeyEventType is the kind of change of a KeyEvent.
+type KeyEventType string
+
+const (
+	KeyEventSet     KeyEventType = "set"     // Value written (Set, Incr, batches, replication)
+	KeyEventDel     KeyEventType = "del"     // Deleted by a client or the primary
+	KeyEventExpire  KeyEventType = "expire"  // TTL set or removed by Expire
+	KeyEventExpired KeyEventType = "expired" // Removed because its TTL passed
+	KeyEventEvicted KeyEventType = "evicted" // Removed by the eviction policy
+)
+
+// KeyEvent is a change of a key.
+type KeyEvent struct {
+	Type KeyEventType
+	Key  string
+	Time time.Time
+}
+
+// ErrWatchOverflow is the error of a Watcher closed because it fell behind.
+var ErrWatchOverflow = errors.New("watcher fell behind")
+
+// DefaultWatchBuffer is the buffer of a Watcher created with a buffer <= 0.
+const DefaultWatchBuffer = 1024
+
+// Watcher receives the events of the keys starting with its prefix, see
+// above.
+type Watcher struct {
+	cache  *Cache
+	prefix string
+
+	mu     sync.Mutex // Guards ch against sends after close
+	ch     chan KeyEvent
+	closed bool
+	err    error
+}
+
+// watchers are the watchers of a cache.
+type watchers struct {
+	count atomic.Int32 // len(list), read without the lock on every change
+	mu    sync.RWMutex
+	list  []*Watcher
+}
+
+// Watch returns a watcher receiving the changes of the keys starting with
+// prefix ("" = all keys), buffering up to buffer events. Close it when
+// done.
+func (c *Cache) Watch(prefix string, buffer int) *Watcher {
+	if buffer <= 0 {
+		buffer = DefaultWatchBuffer
+	}
+	w := &Watcher{cache: c, prefix: prefix, ch: make(chan KeyEvent, buffer)}
+	c.watchers.mu.Lock()
+	c.watchers.list = append(c.watchers.list, w)
+	c.watchers.count.Store(int32(len(c.watchers.list)))
+	c.watchers.mu.Unlock()
+	return w
+}
+
+// Watchers returns the number of open watchers.
+func (c *Cache) Watchers() int {
+	return int(c.watchers.count.Load())
+}
+
+// Events returns the channel of the events, closed when the watcher is.
+func (w *Watcher) Events() <-chan KeyEvent {
+	return w.ch
+}
+
+// Err returns ErrWatchOverflow if the watcher was closed because it fell
+// behind, and nil otherwise.
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close stops the watcher and closes its channel. It may be called more
+// than once.
+func (w *Watcher) Close() {
+	w.closeWith(nil)
+}
+
+// closeWith closes the watcher with err and removes it from its cache.
+func (w *Watcher) closeWith(err error) {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed, w.err = true, err
+	close(w.ch)
+	w.mu.Unlock()
+	w.cache.removeWatcher(w)
+}
+
+// removeWatcher removes w from the watchers of c.
+func (c *Cache) removeWatcher(w *Watcher) {
+	c.watchers.mu.Lock()
+	defer c.watchers.mu.Unlock()
+	for i, other := range c.watchers.list {
+		if other == w {
+			c.watchers.list = append(c.watchers.list[:i], c.watchers.list[i+1:]...)
+			break
+		}
+	}
+	c.watchers.count.Store(int32(len(c.watchers.list)))
+}
+
+// send delivers ev, closing the watcher with ErrWatchOverflow if its
+// buffer is full. It never blocks.
+func (w *Watcher) send(ev KeyEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.ch <- ev:
+	default:
+		w.closed, w.err = true, ErrWatchOverflow
+		close(w.ch)
+		// Removing it takes the lock of the list, which notifyWatchers holds
+		go w.cache.removeWatcher(w)
+	}
+}
+
+// notifyWatchers sends the change of key to the watchers of its prefix.
+// It is called with the lock of the key's shard held.
+func (c *Cache) notifyWatchers(typ KeyEventType, key string) {
+	if c.watchers.count.Load() == 0 || IsInternalKey(key) {
+		return
+	}
+	ev := KeyEvent{Type: typ, Key: key, Time: c.now()}
+	c.watchers.mu.RLock()
+	defer c.watchers.mu.RUnlock()
+	for _, w := range c.watchers.list {
+		if strings.HasPrefix(key, w.prefix) {
+			w.send(ev)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Package cluster maps keys to hash slots and slots to the nodes of a
+// cluster, like Redis Cluster: every key belongs to one of SlotCount slots,
+// and every slot is owned by exactly one node.
+package cluster
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SlotCount is the number of hash slots.
+const SlotCount = 16384
+
+// KeySlot returns the hash slot of a key: CRC16 (XMODEM) of the key modulo
+// SlotCount, as in Redis Cluster. If the key contains a non-empty hash tag
+// "{...}", only the tag is hashed, so keys like "{user1}.name" and
+// "{user1}.email" always share a slot.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % SlotCount
+}
+
+// crc16 computes the CRC16-CCITT (XMODEM) checksum used by Redis Cluster.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// SlotRange is a range of slots owned by a node.
+type SlotRange struct {
+	Start int    `json:"start"` // First slot
+	End   int    `json:"end"`   // Last slot (inclusive)
+	Node  string `json:"node"`  // host:port of the owner
+}
+
+// SlotMap assigns every slot to a node.
+type SlotMap struct {
+	ranges []SlotRange // Sorted by Start, without gaps or overlaps
+}
+
+// NewSlotMap creates a slot map from ranges, which must cover every slot
+// exactly once.
+func NewSlotMap(ranges []SlotRange) (*SlotMap, error) {
+	sorted := append([]SlotRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	next := 0
+	for _, r := range sorted {
+		if r.Node == "" {
+			return nil, fmt.Errorf("slot range %d-%d has no node", r.Start, r.End)
+		}
+		if r.Start < 0 || r.End >= SlotCount || r.Start > r.End {
+			return nil, fmt.Errorf("invalid slot range %d-%d (slots are 0-%d)", r.Start, r.End, SlotCount-1)
+		}
+		if r.Start < next {
+			return nil, fmt.Errorf("slot %d is assigned twice", r.Start)
+		}
+		if r.Start > next {
+			return nil, fmt.Errorf("slots %d-%d are not assigned", next, r.Start-1)
+		}
+		next = r.End + 1
+	}
+	if next < SlotCount {
+		return nil, fmt.Errorf("slots %d-%d are not assigned", next, SlotCount-1)
+	}
+
+	return &SlotMap{ranges: sorted}, nil
+}
+
+// ParseSlotMap parses a slot map from a flag value listing the slot ranges
+// of every node, e.g. "10.0.0.1:8080=0-8191,10.0.0.2:8080=8192-16383". A node
+// can be listed several times, and a range can be a single slot.
+func ParseSlotMap(s string) (*SlotMap, error) {
+	var ranges []SlotRange
+	for _, part := range strings.Split(s, ",") {
+		node, slots, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid slot assignment %q (expected host:port=start-end)", part)
+		}
+		r, err := parseSlotRange(slots)
+		if err != nil {
+			return nil, err
+		}
+		r.Node = node
+		ranges = append(ranges, r)
+	}
+	return NewSlotMap(ranges)
+}
+
+// LoadSlotMap reads a slot map file: one node per line, followed by its slot
+// ranges, e.g. "10.0.0.1:8080 0-5460 10000". Empty lines and lines starting
+// with # are ignored.
+func LoadSlotMap(path string) (*SlotMap, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open slot map: %w", err)
+	}
+	defer file.Close()
+
+	m, err := readSlotMap(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid slot map %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// readSlotMap parses the slot map file format of LoadSlotMap.
+func readSlotMap(r io.Reader) (*SlotMap, error) {
+	var ranges []SlotRange
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected a node followed by slot ranges", line)
+		}
+		for _, field := range fields[1:] {
+			r, err := parseSlotRange(field)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			r.Node = fields[0]
+			ranges = append(ranges, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewSlotMap(ranges)
+}
+
+// parseSlotRange parses "start-end" or a single slot.
+func parseSlotRange(s string) (SlotRange, error) {
+	startStr, endStr, isRange := strings.Cut(s, "-")
+	start, err := strconv.Atoi(startStr)
+	if err != nil {
+		return SlotRange{}, fmt.Errorf("invalid slot range %q", s)
+	}
+	end := start
+	if isRange {
+		if end, err = strconv.Atoi(endStr); err != nil {
+			return SlotRange{}, fmt.Errorf("invalid slot range %q", s)
+		}
+	}
+	return SlotRange{Start: start, End: end}, nil
+}
+
+// Owner returns the node owning slot.
+func (m *SlotMap) Owner(slot int) string {
+	i := sort.Search(len(m.ranges), func(i int) bool { return m.ranges[i].End >= slot })
+	return m.ranges[i].Node
+}
+
+// Ranges returns the slot ranges, sorted by slot.
+func (m *SlotMap) Ranges() []SlotRange {
+	return append([]SlotRange(nil), m.ranges...)
+}
+
+// Slots returns the number of slots owned by node.
+func (m *SlotMap) Slots(node string) int {
+	n := 0
+	for _, r := range m.ranges {
+		if r.Node == node {
+			n += r.End - r.Start + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,199 @@
+package grpcapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC over HTTP/2.
+//
+// A call is a POST to /<service>/<method> with the content type
+// application/grpc. The request and response bodies are sequences of
+// messages, each prefixed with a compression flag byte and its length
+// (4 bytes, big endian); unary methods have one of each, and Watch streams
+// response messages. The outcome is in the trailers: grpc-status, a Code,
+// and grpc-message, percent-encoded. Compression isn't supported, and
+// neither is sent by default by gRPC clients.
+
+// Service is the name of the gRPC service.
+const Service = "miniredis.v1.Cache"
+
+// Paths of the methods.
+const (
+	PathGet    = "/" + Service + "/Get"
+	PathSet    = "/" + Service + "/Set"
+	PathDel    = "/" + Service + "/Del"
+	PathMGet   = "/" + Service + "/MGet"
+	PathMSet   = "/" + Service + "/MSet"
+	PathExpire = "/" + Service + "/Expire"
+	PathWatch  = "/" + Service + "/Watch"
+	PathStats  = "/" + Service + "/Stats"
+)
+
+// ContentType is the content type of gRPC requests and responses.
+const ContentType = "application/grpc"
+
+// DefaultMaxMessageBytes is the default limit of a received message, as
+// in other gRPC implementations.
+const DefaultMaxMessageBytes = 4 << 20
+
+// Code is a gRPC status code.
+type Code int
+
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	NotFound           Code = 5
+	AlreadyExists      Code = 6
+	PermissionDenied   Code = 7
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Aborted            Code = 10
+	OutOfRange         Code = 11
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+	DataLoss           Code = 15
+	Unauthenticated    Code = 16
+)
+
+var codeNames = [...]string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED",
+	"NOT_FOUND", "ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED",
+	"INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+// String returns the name of the code, e.g. "NOT_FOUND".
+func (c Code) String() string {
+	if c >= 0 && int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return "CODE(" + strconv.Itoa(int(c)) + ")"
+}
+
+// Status is the outcome of a call that failed.
+type Status struct {
+	Code    Code
+	Message string
+}
+
+// Error implements the error interface.
+func (s *Status) Error() string {
+	return fmt.Sprintf("grpc: %s: %s", s.Code, s.Message)
+}
+
+// Errorf returns a Status with the code and a formatted message.
+func Errorf(code Code, format string, args ...any) *Status {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// WriteMessage writes m as a frame of a body.
+func WriteMessage(w io.Writer, m Message) error {
+	b := m.Marshal()
+	frame := make([]byte, 5, 5+len(b))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(b)))
+	_, err := w.Write(append(frame, b...))
+	return err
+}
+
+// ReadMessage reads the next frame of a body into m. It returns io.EOF at
+// the end of the body, and a Status for frames it doesn't accept:
+// compressed or larger than limit bytes.
+func ReadMessage(r io.Reader, m Message, limit int) error {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Errorf(Internal, "truncated message")
+		}
+		return err
+	}
+	if header[0] != 0 {
+		return Errorf(Unimplemented, "compressed messages aren't supported")
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if uint64(n) > uint64(limit) {
+		return Errorf(ResourceExhausted, "message larger than %d bytes", limit)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return Errorf(Internal, "truncated message")
+	}
+	if err := m.Unmarshal(b); err != nil {
+		return Errorf(Internal, "invalid message: %v", err)
+	}
+	return nil
+}
+
+// EncodeMessage percent-encodes a status message for grpc-message.
+func EncodeMessage(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// DecodeMessage decodes a grpc-message, leaving invalid escapes as is.
+func DecodeMessage(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(v))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// timeoutUnits are the units of grpc-timeout.
+var timeoutUnits = map[byte]time.Duration{
+	'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+	'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+}
+
+// ParseTimeout parses a grpc-timeout header: up to 8 digits and a unit.
+func ParseTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+	unit, ok := timeoutUnits[s[len(s)-1]]
+	n, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// FormatTimeout formats d for grpc-timeout, rounded up to a unit that
+// fits in 8 digits.
+func FormatTimeout(d time.Duration) string {
+	for _, u := range []struct {
+		unit byte
+		d    time.Duration
+	}{{'n', time.Nanosecond}, {'u', time.Microsecond}, {'m', time.Millisecond}, {'S', time.Second}, {'M', time.Minute}} {
+		if n := (d + u.d - 1) / u.d; n < 1e8 {
+			return strconv.FormatInt(int64(n), 10) + string(u.unit)
+		}
+	}
+	return strconv.FormatInt(int64((d+time.Hour-1)/time.Hour), 10) + "H"
+}
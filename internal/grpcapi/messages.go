@@ -0,0 +1,442 @@
+package grpcapi
+
+// Messages of miniredis.proto, with the same field numbers.
+
+// Message is a message of the API.
+type Message interface {
+	Marshal() []byte
+	Unmarshal(b []byte) error
+}
+
+// decode calls field for every field of b, which reads the value with the
+// decoder, or skips it.
+func decode(b []byte, field func(d *decoder) error) error {
+	d := decoder{b: b}
+	for {
+		ok, err := d.next()
+		if !ok || err != nil {
+			return err
+		}
+		if err := field(&d); err != nil {
+			return err
+		}
+	}
+}
+
+// GetRequest is the request of Get.
+type GetRequest struct {
+	Key string
+}
+
+func (m *GetRequest) Marshal() []byte {
+	var e encoder
+	e.string(1, m.Key)
+	return e.b
+}
+
+func (m *GetRequest) Unmarshal(b []byte) (err error) {
+	*m = GetRequest{}
+	return decode(b, func(d *decoder) error {
+		switch d.field {
+		case 1:
+			m.Key, err = d.string()
+		default:
+			err = d.skip()
+		}
+		return err
+	})
+}
+
+// GetResponse is the response of Get, and an element of MGetResponse.
+type GetResponse struct {
+	Found       bool
+	Value       []byte
+	TTLMs       int64 // Milliseconds until the key expires (-1: no TTL)
+	ContentType string
+}
+
+func (m *GetResponse) Marshal() []byte {
+	var e encoder
+	e.bool(1, m.Found)
+	e.bytes(2, m.Value)
+	e.int64(3, m.TTLMs)
+	e.string(4, m.ContentType)
+	return e.b
+}
+
+func (m *GetResponse) Unmarshal(b []byte) (err error) {
+	*m = GetResponse{}
+	return decode(b, func(d *decoder) error {
+		switch d.field {
+		case 1:
+			m.Found, err = d.bool()
+		case 2:
+			var v []byte
+			v, err = d.bytes()
+			m.Value = append([]byte(nil), v...)
+		case 3:
+			m.TTLMs, err = d.int64()
+		case 4:
+			m.ContentType, err = d.string()
+		default:
+			err = d.skip()
+		}
+		return err
+	})
+}
+
+// SetRequest is the request of Set.
+type SetRequest struct {
+	Key         string
+	Value       []byte
+	TTLMs       int64 // 0: no TTL
+	ContentType string
+}
+
+func (m *SetRequest) Marshal() []byte {
+	var e encoder
+	e.string(1, m.Key)
+	e.bytes(2, m.Value)
+	e.int64(3, m.TTLMs)
+	e.string(4, m.ContentType)
+	return e.b
+}
+
+func (m *SetRequest) Unmarshal(b []byte) (err error) {
+	*m = SetRequest{}
+	return decode(b, func(d *decoder) error {
+		switch d.field {
+		case 1:
+			m.Key, err = d.string()
+		case 2:
+			var v []byte
+			v, err = d.bytes()
+			m.Value = append([]byte(nil), v...)
+		case 3:
+			m.TTLMs, err = d.int64()
+		case 4:
+			m.ContentType, err = d.string()
+		default:
+			err = d.skip()
+		}
+		return err
+	})
+}
+
+// Empty is the message without fields: SetResponse, MSetResponse, and
+// StatsRequest.
+type Empty struct{}
+
+func (m *Empty) Marshal() []byte { return nil }
+
+func (m *Empty) Unmarshal(b []byte) error {
+	return decode(b, func(d *decoder) error { return d.skip() })
+}
+
+// Keys is a message with repeated keys as field 1: DelRequest and
+// MGetRequest.
+type Keys struct {
+	Keys []string
+}
+
+func (m *Keys) Marshal() []byte {
+	var e encoder
+	e.repeatedString(1, m.Keys)
+	return e.b
+}
+
+func (m *Keys) Unmarshal(b []byte) error {
+	*m = Keys{}
+	return decode(b, func(d *decoder) error {
+		if d.field != 1 {
+			return d.skip()
+		}
+		key, err := d.string()
+		m.Keys = append(m.Keys, key)
+		return err
+	})
+}
+
+// DelResponse is the response of Del.
+type DelResponse struct {
+	Deleted int64
+}
+
+func (m *DelResponse) Marshal() []byte {
+	var e encoder
+	e.int64(1, m.Deleted)
+	return e.b
+}
+
+func (m *DelResponse) Unmarshal(b []byte) (err error) {
+	*m = DelResponse{}
+	return decode(b, func(d *decoder) error {
+		switch d.field {
+		case 1:
+			m.Deleted, err = d.int64()
+		default:
+			err = d.skip()
+		}
+		return err
+	})
+}
+
+// MGetResponse is the response of MGet.
+type MGetResponse struct {
+	Values []*GetResponse
+}
+
+func (m *MGetResponse) Marshal() []byte {
+	var e encoder
+	for _, v := range m.Values {
+		e.message(1, v)
+	}
+	return e.b
+}
+
+func (m *MGetResponse) Unmarshal(b []byte) error {
+	*m = MGetResponse{}
+	return decode(b, func(d *decoder) error {
+		if d.field != 1 {
+			return d.skip()
+		}
+		v, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		value := new(GetResponse)
+		m.Values = append(m.Values, value)
+		return value.Unmarshal(v)
+	})
+}
+
+// KeyValue is an entry of MSetRequest.
+type KeyValue struct {
+	Key   string
+	Value []byte
+	TTLMs int64 // 0: no TTL
+}
+
+func (m *KeyValue) Marshal() []byte {
+	var e encoder
+	e.string(1, m.Key)
+	e.bytes(2, m.Value)
+	e.int64(3, m.TTLMs)
+	return e.b
+}
+
+func (m *KeyValue) Unmarshal(b []byte) (err error) {
+	*m = KeyValue{}
+	return decode(b, func(d *decoder) error {
+		switch d.field {
+		case 1:
+			m.Key, err = d.string()
+		case 2:
+			var v []byte
+			v, err = d.bytes()
+			m.Value = append([]byte(nil), v...)
+		case 3:
+			m.TTLMs, err = d.int64()
+		default:
+			err = d.skip()
+		}
+		return err
+	})
+}
+
+// MSetRequest is the request of MSet.
+type MSetRequest struct {
+	Entries []*KeyValue
+}
+
+func (m *MSetRequest) Marshal() []byte {
+	var e encoder
+	for _, kv := range m.Entries {
+		e.message(1, kv)
+	}
+	return e.b
+}
+
+func (m *MSetRequest) Unmarshal(b []byte) error {
+	*m = MSetRequest{}
+	return decode(b, func(d *decoder) error {
+		if d.field != 1 {
+			return d.skip()
+		}
+		v, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		kv := new(KeyValue)
+		m.Entries = append(m.Entries, kv)
+		return kv.Unmarshal(v)
+	})
+}
+
+// ExpireRequest is the request of Expire.
+type ExpireRequest struct {
+	Key   string
+	TTLMs int64 // 0: remove the TTL
+}
+
+func (m *ExpireRequest) Marshal() []byte {
+	var e encoder
+	e.string(1, m.Key)
+	e.int64(2, m.TTLMs)
+	return e.b
+}
+
+func (m *ExpireRequest) Unmarshal(b []byte) (err error) {
+	*m = ExpireRequest{}
+	return decode(b, func(d *decoder) error {
+		switch d.field {
+		case 1:
+			m.Key, err = d.string()
+		case 2:
+			m.TTLMs, err = d.int64()
+		default:
+			err = d.skip()
+		}
+		return err
+	})
+}
+
+// ExpireResponse is the response of Expire.
+type ExpireResponse struct {
+	Exists bool
+}
+
+func (m *ExpireResponse) Marshal() []byte {
+	var e encoder
+	e.bool(1, m.Exists)
+	return e.b
+}
+
+func (m *ExpireResponse) Unmarshal(b []byte) (err error) {
+	*m = ExpireResponse{}
+	return decode(b, func(d *decoder) error {
+		switch d.field {
+		case 1:
+			m.Exists, err = d.bool()
+		default:
+			err = d.skip()
+		}
+		return err
+	})
+}
+
+// WatchRequest is the request of Watch.
+type WatchRequest struct {
+	Prefix string // Empty: every key
+}
+
+func (m *WatchRequest) Marshal() []byte {
+	var e encoder
+	e.string(1, m.Prefix)
+	return e.b
+}
+
+func (m *WatchRequest) Unmarshal(b []byte) (err error) {
+	*m = WatchRequest{}
+	return decode(b, func(d *decoder) error {
+		switch d.field {
+		case 1:
+			m.Prefix, err = d.string()
+		default:
+			err = d.skip()
+		}
+		return err
+	})
+}
+
+// KeyEvent is a message of the Watch stream.
+type KeyEvent struct {
+	Type       string // set, del, expire, expired, or evicted
+	Key        string
+	TimeUnixMs int64
+}
+
+func (m *KeyEvent) Marshal() []byte {
+	var e encoder
+	e.string(1, m.Type)
+	e.string(2, m.Key)
+	e.int64(3, m.TimeUnixMs)
+	return e.b
+}
+
+func (m *KeyEvent) Unmarshal(b []byte) (err error) {
+	*m = KeyEvent{}
+	return decode(b, func(d *decoder) error {
+		switch d.field {
+		case 1:
+			m.Type, err = d.string()
+		case 2:
+			m.Key, err = d.string()
+		case 3:
+			m.TimeUnixMs, err = d.int64()
+		default:
+			err = d.skip()
+		}
+		return err
+	})
+}
+
+// StatsResponse is the response of Stats.
+type StatsResponse struct {
+	Keys           int64
+	MaxKeys        int64
+	UsedMemory     int64
+	MaxMemory      int64
+	EvictionPolicy string
+	ExpiredLazy    int64
+	ExpiredActive  int64
+	Evicted        int64
+	Deleted        int64
+	Watchers       int64 // Open Watch streams
+}
+
+func (m *StatsResponse) Marshal() []byte {
+	var e encoder
+	e.int64(1, m.Keys)
+	e.int64(2, m.MaxKeys)
+	e.int64(3, m.UsedMemory)
+	e.int64(4, m.MaxMemory)
+	e.string(5, m.EvictionPolicy)
+	e.int64(6, m.ExpiredLazy)
+	e.int64(7, m.ExpiredActive)
+	e.int64(8, m.Evicted)
+	e.int64(9, m.Deleted)
+	e.int64(10, m.Watchers)
+	return e.b
+}
+
+func (m *StatsResponse) Unmarshal(b []byte) (err error) {
+	*m = StatsResponse{}
+	return decode(b, func(d *decoder) error {
+		switch d.field {
+		case 1:
+			m.Keys, err = d.int64()
+		case 2:
+			m.MaxKeys, err = d.int64()
+		case 3:
+			m.UsedMemory, err = d.int64()
+		case 4:
+			m.MaxMemory, err = d.int64()
+		case 5:
+			m.EvictionPolicy, err = d.string()
+		case 6:
+			m.ExpiredLazy, err = d.int64()
+		case 7:
+			m.ExpiredActive, err = d.int64()
+		case 8:
+			m.Evicted, err = d.int64()
+		case 9:
+			m.Deleted, err = d.int64()
+		case 10:
+			m.Watchers, err = d.int64()
+		default:
+			err = d.skip()
+		}
+		return err
+	})
+}
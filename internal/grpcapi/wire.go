@@ -0,0 +1,198 @@
+// Package grpcapi holds the messages of the gRPC API (see miniredis.proto)
+// and the parts of the gRPC protocol shared by the server and the client.
+//
+// gRPC runs over HTTP/2, which net/http serves and speaks, including
+// without TLS, so only the protocol itself is implemented here: the
+// protobuf encoding of the messages, the length-prefixed framing of the
+// request and response bodies, and the status codes sent in trailers. The
+// messages are encoded by hand, which is little code for flat messages of
+// strings, bytes, and integers, instead of generating them with protoc.
+package grpcapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Protobuf wire types.
+const (
+	wireVarint = 0
+	wireI64    = 1
+	wireBytes  = 2
+	wireI32    = 5
+)
+
+// errTruncated is the error of a message that ends within a field.
+var errTruncated = errors.New("grpcapi: truncated message")
+
+// encoder appends the fields of a message to b. Fields with their default
+// value are left out, as proto3 does.
+type encoder struct {
+	b []byte
+}
+
+// tag appends the key of a field.
+func (e *encoder) tag(field, wire int) {
+	e.b = binary.AppendUvarint(e.b, uint64(field)<<3|uint64(wire))
+}
+
+// string appends a string field.
+func (e *encoder) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// bytes appends a bytes field.
+func (e *encoder) bytes(field int, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// repeatedString appends a repeated string field, empty strings included.
+func (e *encoder) repeatedString(field int, list []string) {
+	for _, s := range list {
+		e.tag(field, wireBytes)
+		e.b = binary.AppendUvarint(e.b, uint64(len(s)))
+		e.b = append(e.b, s...)
+	}
+}
+
+// int64 appends an int64 field (negative values take ten bytes, as in
+// protobuf).
+func (e *encoder) int64(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.b = binary.AppendUvarint(e.b, uint64(v))
+}
+
+// bool appends a bool field.
+func (e *encoder) bool(field int, v bool) {
+	if !v {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.b = append(e.b, 1)
+}
+
+// message appends an embedded message, even an empty one, since it is an
+// element of a repeated field.
+func (e *encoder) message(field int, m Message) {
+	b := m.Marshal()
+	e.tag(field, wireBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// decoder reads the fields of a message. Fields unknown to the caller are
+// skipped, so older servers and clients ignore fields added later.
+type decoder struct {
+	b     []byte
+	field int // Field of the last next
+	wire  int // Wire type of the last next
+}
+
+// next reads the key of the next field, or returns false at the end.
+func (d *decoder) next() (bool, error) {
+	if len(d.b) == 0 {
+		return false, nil
+	}
+	key, err := d.uvarint()
+	if err != nil {
+		return false, err
+	}
+	if key>>3 == 0 || key>>3 > math.MaxInt32 {
+		return false, fmt.Errorf("grpcapi: invalid field number %d", key>>3)
+	}
+	d.field, d.wire = int(key>>3), int(key&7)
+	return true, nil
+}
+
+// uvarint reads a varint.
+func (d *decoder) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	d.b = d.b[n:]
+	return v, nil
+}
+
+// bytes reads the value of a length-delimited field, which aliases the
+// message.
+func (d *decoder) bytes() ([]byte, error) {
+	if d.wire != wireBytes {
+		return nil, d.wireError()
+	}
+	n, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.b)) {
+		return nil, errTruncated
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b, nil
+}
+
+// string reads the value of a string field.
+func (d *decoder) string() (string, error) {
+	b, err := d.bytes()
+	return string(b), err
+}
+
+// int64 reads the value of an int64 field.
+func (d *decoder) int64() (int64, error) {
+	if d.wire != wireVarint {
+		return 0, d.wireError()
+	}
+	v, err := d.uvarint()
+	return int64(v), err
+}
+
+// bool reads the value of a bool field.
+func (d *decoder) bool() (bool, error) {
+	v, err := d.int64()
+	return v != 0, err
+}
+
+// skip skips the value of a field unknown to the caller.
+func (d *decoder) skip() error {
+	var n int
+	switch d.wire {
+	case wireVarint:
+		_, err := d.uvarint()
+		return err
+	case wireI64:
+		n = 8
+	case wireI32:
+		n = 4
+	case wireBytes:
+		_, err := d.bytes()
+		return err
+	default:
+		return fmt.Errorf("grpcapi: unsupported wire type %d", d.wire)
+	}
+	if len(d.b) < n {
+		return errTruncated
+	}
+	d.b = d.b[n:]
+	return nil
+}
+
+// wireError is the error of a field of the wrong wire type.
+func (d *decoder) wireError() error {
+	return fmt.Errorf("grpcapi: field %d has wire type %d", d.field, d.wire)
+}